@@ -0,0 +1,101 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package tailnetauth is HTTP middleware that authenticates requests
+// by the tailnet identity of the peer they come from, for services
+// listening on a node's Tailscale IPs. It asks the local tailscaled
+// who's at the request's remote address, and passes the answer on to
+// the wrapped handler in the request's context and headers, such as
+// to a backend behind a reverse proxy.
+package tailnetauth
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+)
+
+// The headers Handler sets on requests. Those of them that don't
+// apply, such as the login of a node owned by tags, are removed, so
+// that clients can't set them.
+const (
+	// LoginHeader is the login name of the peer's user.
+	LoginHeader = "Tailscale-User-Login"
+	// NameHeader is the display name of the peer's user, RFC 2047
+	// encoded if it's not ASCII.
+	NameHeader = "Tailscale-User-Name"
+	// NodeHeader is the peer's DNS name, without the trailing dot.
+	NodeHeader = "Tailscale-Node"
+	// TagsHeader is the peer's ACL tags, comma-separated, if it's
+	// owned by tags rather than a user.
+	TagsHeader = "Tailscale-Tags"
+)
+
+var allHeaders = []string{LoginHeader, NameHeader, NodeHeader, TagsHeader}
+
+// WhoIsFunc returns the tailnet peer at remoteAddr, an "ip:port".
+// tailscale.WhoIs, which asks the local tailscaled, is one.
+type WhoIsFunc func(ctx context.Context, remoteAddr string) (*ipn.Peer, error)
+
+type peerKey struct{}
+
+// PeerFromContext returns the peer a request handled by Handler came
+// from, given its context.
+func PeerFromContext(ctx context.Context) (p *ipn.Peer, ok bool) {
+	p, ok = ctx.Value(peerKey{}).(*ipn.Peer)
+	return p, ok
+}
+
+// Handler returns a handler that serves requests from tailnet peers
+// with h, after setting the identity headers and the peer in the
+// request's context, and refuses others. If whois is nil,
+// tailscale.WhoIs is used.
+func Handler(h http.Handler, whois WhoIsFunc) http.Handler {
+	if whois == nil {
+		whois = tailscale.WhoIs
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := whois(r.Context(), r.RemoteAddr)
+		if err != nil || p.Node == nil {
+			http.Error(w, "not from a tailnet peer", http.StatusForbidden)
+			return
+		}
+		r2 := r.WithContext(context.WithValue(r.Context(), peerKey{}, p))
+		r2.Header = r.Header.Clone()
+		setHeaders(r2.Header, p)
+		h.ServeHTTP(w, r2)
+	})
+}
+
+// setHeaders sets the identity headers in hdr for p, removing any
+// already there.
+func setHeaders(hdr http.Header, p *ipn.Peer) {
+	for _, k := range allHeaders {
+		hdr.Del(k)
+	}
+	hdr.Set(NodeHeader, strings.TrimSuffix(p.Node.Name, "."))
+	if len(p.Node.Tags) > 0 {
+		hdr.Set(TagsHeader, strings.Join(p.Node.Tags, ","))
+		return
+	}
+	if p.User.LoginName != "" {
+		hdr.Set(LoginHeader, p.User.LoginName)
+	}
+	if p.User.DisplayName != "" {
+		hdr.Set(NameHeader, mime.QEncoding.Encode("utf-8", p.User.DisplayName))
+	}
+}
+
+// ReverseProxy returns a handler proxying the requests of tailnet
+// peers to target with the identity headers set, and refusing
+// others.
+func ReverseProxy(target *url.URL) http.Handler {
+	return Handler(httputil.NewSingleHostReverseProxy(target), nil)
+}
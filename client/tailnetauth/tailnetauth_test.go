@@ -0,0 +1,101 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tailnetauth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+)
+
+func TestHandler(t *testing.T) {
+	peers := map[string]*ipn.Peer{
+		"100.101.102.103:1234": {
+			Node: &tailcfg.Node{Name: "laptop.example.ts.net."},
+			User: tailcfg.UserProfile{LoginName: "alice@example.com", DisplayName: "Alice Müller"},
+		},
+		"100.101.102.104:1234": {
+			Node: &tailcfg.Node{Name: "ci.example.ts.net.", Tags: []string{"tag:ci", "tag:prod"}},
+			User: tailcfg.UserProfile{LoginName: "tagged-devices"},
+		},
+	}
+	whois := func(ctx context.Context, addr string) (*ipn.Peer, error) {
+		if p, ok := peers[addr]; ok {
+			return p, nil
+		}
+		return nil, errors.New("no peer")
+	}
+
+	var got http.Header
+	var gotPeer *ipn.Peer
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+		gotPeer, _ = PeerFromContext(r.Context())
+	}), whois)
+
+	tests := []struct {
+		addr string
+		code int
+		want map[string]string
+	}{
+		{
+			addr: "100.101.102.103:1234",
+			code: 200,
+			want: map[string]string{
+				LoginHeader: "alice@example.com",
+				NameHeader:  "=?utf-8?q?Alice_M=C3=BCller?=",
+				NodeHeader:  "laptop.example.ts.net",
+				TagsHeader:  "",
+			},
+		},
+		{
+			addr: "100.101.102.104:1234",
+			code: 200,
+			want: map[string]string{
+				LoginHeader: "",
+				NameHeader:  "",
+				NodeHeader:  "ci.example.ts.net",
+				TagsHeader:  "tag:ci,tag:prod",
+			},
+		},
+		{
+			addr: "192.168.1.5:1234",
+			code: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		got, gotPeer = nil, nil
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.addr
+		// Clients can't impersonate anyone.
+		req.Header.Set(LoginHeader, "mallory@example.com")
+		req.Header.Set(TagsHeader, "tag:admin")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("%s: code = %d; want %d", tt.addr, rec.Code, tt.code)
+			continue
+		}
+		if tt.code != 200 {
+			if got != nil {
+				t.Errorf("%s: refused request reached the handler", tt.addr)
+			}
+			continue
+		}
+		for k, v := range tt.want {
+			if g := got.Get(k); g != v {
+				t.Errorf("%s: %s = %q; want %q", tt.addr, k, g, v)
+			}
+		}
+		if gotPeer != peers[tt.addr] {
+			t.Errorf("%s: PeerFromContext = %v", tt.addr, gotPeer)
+		}
+	}
+}
@@ -0,0 +1,636 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package tailscale contains Tailscale client code for talking to
+// the local tailscaled's local API.
+package tailscale
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/health"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/log/auditlog"
+	"tailscale.com/net/trafficstats"
+	"tailscale.com/paths"
+	"tailscale.com/safesocket"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tka"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/filter/acltest"
+	"tailscale.com/wgengine/tstun"
+)
+
+// TailscaledSocket is the tailscaled Unix socket.
+var TailscaledSocket = paths.DefaultTailscaledSocket()
+
+// LocalAPIToken, if non-empty, is sent with every request as a bearer
+// token, to get full access to the local API from a user who
+// otherwise only gets read access. It's the contents of the file
+// tailscaled was started with -localapi-token-file, such as read by
+// ReadLocalAPIToken.
+var LocalAPIToken string
+
+// ReadLocalAPIToken sets LocalAPIToken from the token file at path.
+func ReadLocalAPIToken(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	LocalAPIToken = strings.TrimSpace(string(b))
+	return nil
+}
+
+// tailscaledPort is the localhost TCP port tailscaled listens on
+// for frontends on platforms without Unix sockets.
+const tailscaledPort = 41112
+
+// DoLocalRequest makes an HTTP request to the local machine's
+// Tailscale daemon.
+//
+// URLs are of the form http://local-tailscaled.sock/localapi/v0/files/.
+//
+// The hostname is conventionally "local-tailscaled.sock", but no DNS
+// lookup is done; the connection always goes to TailscaledSocket (or
+// the named pipe or localhost TCP port on Windows).
+func DoLocalRequest(req *http.Request) (*http.Response, error) {
+	if LocalAPIToken != "" {
+		req.Header.Set("Authorization", "Bearer "+LocalAPIToken)
+	}
+	tr := &http.Transport{
+		DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+			return safesocket.Connect(TailscaledSocket, tailscaledPort)
+		},
+	}
+	defer tr.CloseIdleConnections()
+	return (&http.Client{Transport: tr}).Do(req)
+}
+
+func send(ctx context.Context, method, path string, wantStatus int, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, "http://local-tailscaled.sock"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	res, err := DoLocalRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	slurp, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != wantStatus {
+		return nil, fmt.Errorf("HTTP %s: %s (expected %v)", res.Status, slurp, wantStatus)
+	}
+	return slurp, nil
+}
+
+func get200(ctx context.Context, path string) ([]byte, error) {
+	return send(ctx, "GET", path, 200, nil)
+}
+
+// Status returns the status of the local tailscaled.
+func Status(ctx context.Context) (*ipnstate.Status, error) {
+	body, err := get200(ctx, "/localapi/v0/status")
+	if err != nil {
+		return nil, err
+	}
+	st := new(ipnstate.Status)
+	if err := json.Unmarshal(body, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Health returns the health of the local tailscaled's node.
+func Health(ctx context.Context) (*health.Status, error) {
+	body, err := get200(ctx, "/localapi/v0/health")
+	if err != nil {
+		return nil, err
+	}
+	st := new(health.Status)
+	if err := json.Unmarshal(body, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// CurrentDERPMap returns the DERP map that tailscaled got from its
+// control server, or nil if it has none yet.
+func CurrentDERPMap(ctx context.Context) (*tailcfg.DERPMap, error) {
+	body, err := get200(ctx, "/localapi/v0/derpmap")
+	if err != nil {
+		return nil, err
+	}
+	var dm *tailcfg.DERPMap
+	if err := json.Unmarshal(body, &dm); err != nil {
+		return nil, err
+	}
+	return dm, nil
+}
+
+// PeerPath returns the paths to the peer handling the Tailscale IP
+// ip that tailscaled knows about.
+func PeerPath(ctx context.Context, ip netaddr.IP) (*ipnstate.PeerPath, error) {
+	body, err := get200(ctx, "/localapi/v0/peer-path?ip="+url.QueryEscape(ip.String()))
+	if err != nil {
+		return nil, err
+	}
+	pp := new(ipnstate.PeerPath)
+	if err := json.Unmarshal(body, pp); err != nil {
+		return nil, err
+	}
+	return pp, nil
+}
+
+// StreamCapture starts a pcapng capture of the decrypted traffic
+// passing through tailscaled's TUN device. The capture continues
+// until ctx is done or rc is closed; the caller must close rc.
+func StreamCapture(ctx context.Context) (rc io.ReadCloser, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://local-tailscaled.sock/localapi/v0/debug-capture", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := DoLocalRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, fmt.Errorf("HTTP %s: %s", res.Status, body)
+	}
+	return res.Body, nil
+}
+
+// WatchIPNBus calls fn with each notification tailscaled's backend
+// sends, starting with one of its current state and engine status,
+// until ctx is done or fn returns an error, which it returns.
+func WatchIPNBus(ctx context.Context, fn func(*ipn.Notify) error) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://local-tailscaled.sock/localapi/v0/watch-ipn-bus", nil)
+	if err != nil {
+		return err
+	}
+	res, err := DoLocalRequest(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("HTTP %s: %s", res.Status, body)
+	}
+	dec := json.NewDecoder(res.Body)
+	for {
+		n := new(ipn.Notify)
+		if err := dec.Decode(n); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if err := fn(n); err != nil {
+			return err
+		}
+	}
+}
+
+// LogLevels returns the levels of tailscaled's logging components.
+func LogLevels(ctx context.Context) (map[string]logger.Level, error) {
+	body, err := get200(ctx, "/localapi/v0/log-levels")
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]logger.Level
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// SetLogLevels sets the levels of the named logging components of
+// tailscaled, leaving the others as they are.
+func SetLogLevels(ctx context.Context, levels map[string]logger.Level) error {
+	j, err := json.Marshal(levels)
+	if err != nil {
+		return err
+	}
+	_, err = send(ctx, "POST", "/localapi/v0/log-levels", http.StatusNoContent, bytes.NewReader(j))
+	return err
+}
+
+// LogUpload returns whether the local tailscaled uploads its logs.
+func LogUpload(ctx context.Context) (*ipn.LogUploadState, error) {
+	body, err := get200(ctx, "/localapi/v0/log-upload")
+	if err != nil {
+		return nil, err
+	}
+	st := new(ipn.LogUploadState)
+	if err := json.Unmarshal(body, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// SetLogUploadDisabled turns the local tailscaled's log uploading off
+// or, from its next start on, back on. It returns the new state.
+func SetLogUploadDisabled(ctx context.Context, disabled bool) (*ipn.LogUploadState, error) {
+	j, err := json.Marshal(ipn.LogUploadState{Disabled: disabled})
+	if err != nil {
+		return nil, err
+	}
+	body, err := send(ctx, "POST", "/localapi/v0/log-upload", 200, bytes.NewReader(j))
+	if err != nil {
+		return nil, err
+	}
+	st := new(ipn.LogUploadState)
+	if err := json.Unmarshal(body, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// AuditLog returns the entries of the local tailscaled's audit log of
+// configuration and policy changes with a Seq greater than since,
+// oldest first. Use auditlog.Verify to check that they're intact.
+func AuditLog(ctx context.Context, since int64) ([]auditlog.Entry, error) {
+	body, err := get200(ctx, "/localapi/v0/audit-log?since="+strconv.FormatInt(since, 10))
+	if err != nil {
+		return nil, err
+	}
+	var ents []auditlog.Entry
+	if err := json.Unmarshal(body, &ents); err != nil {
+		return nil, err
+	}
+	return ents, nil
+}
+
+// TrafficStats returns the bytes the local tailscaled sent to and
+// received from each peer, keyed by node key, and through each route
+// it advertises, over the last d.
+func TrafficStats(ctx context.Context, d time.Duration) (*trafficstats.Totals, error) {
+	body, err := get200(ctx, "/localapi/v0/traffic-stats?since="+url.QueryEscape(d.String()))
+	if err != nil {
+		return nil, err
+	}
+	t := new(trafficstats.Totals)
+	if err := json.Unmarshal(body, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// WhoIs returns the identity of the tailnet peer at remoteAddr, an
+// "ip:port" such as the remote address of an incoming connection, or
+// an IP: its node, whose Tags are its ACL tags, and its user.
+func WhoIs(ctx context.Context, remoteAddr string) (*ipn.Peer, error) {
+	body, err := get200(ctx, "/localapi/v0/whois?addr="+url.QueryEscape(remoteAddr))
+	if err != nil {
+		return nil, err
+	}
+	p := new(ipn.Peer)
+	if err := json.Unmarshal(body, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// StartLoginInteractive asks the local tailscaled to start an
+// interactive login, or to pick up the one in progress. The auth URL
+// shows up in LoginStatus soon after; WaitLogin waits for it.
+func StartLoginInteractive(ctx context.Context) error {
+	_, err := send(ctx, "POST", "/localapi/v0/login-interactive", 200, nil)
+	return err
+}
+
+// LoginStatus returns the progress of the local tailscaled's login.
+func LoginStatus(ctx context.Context) (*ipn.LoginStatus, error) {
+	body, err := get200(ctx, "/localapi/v0/login-status")
+	if err != nil {
+		return nil, err
+	}
+	st := new(ipn.LoginStatus)
+	if err := json.Unmarshal(body, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// WaitLogin polls the local tailscaled until it's logged in, or ctx
+// is done, calling onURL with each new auth URL the user must visit.
+// It backs off from polling twice a second to every few seconds.
+func WaitLogin(ctx context.Context, onURL func(url string)) error {
+	const (
+		minPoll = 500 * time.Millisecond
+		maxPoll = 5 * time.Second
+	)
+	poll := minPoll
+	lastURL := ""
+	for {
+		st, err := LoginStatus(ctx)
+		if err != nil {
+			return err
+		}
+		switch st.State {
+		case ipn.Starting.String(), ipn.Running.String():
+			return nil
+		}
+		if st.AuthURL != "" && st.AuthURL != lastURL {
+			lastURL = st.AuthURL
+			poll = minPoll
+			if onURL != nil {
+				onURL(st.AuthURL)
+			}
+		}
+		t := time.NewTimer(poll)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+		if poll *= 2; poll > maxPoll {
+			poll = maxPoll
+		}
+	}
+}
+
+// GetPrefs returns the preferences of the local tailscaled.
+func GetPrefs(ctx context.Context) (*ipn.Prefs, error) {
+	body, err := get200(ctx, "/localapi/v0/prefs")
+	if err != nil {
+		return nil, err
+	}
+	p := new(ipn.Prefs)
+	if err := json.Unmarshal(body, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// SetPrefs replaces the preferences of the local tailscaled with p,
+// other than its Persist field, and returns the new preferences.
+func SetPrefs(ctx context.Context, p *ipn.Prefs) (*ipn.Prefs, error) {
+	j, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	body, err := send(ctx, "POST", "/localapi/v0/prefs", 200, bytes.NewReader(j))
+	if err != nil {
+		return nil, err
+	}
+	newp := new(ipn.Prefs)
+	if err := json.Unmarshal(body, newp); err != nil {
+		return nil, err
+	}
+	return newp, nil
+}
+
+// GetServeConfig returns the configuration of the services that
+// tailscaled publishes to the tailnet.
+func GetServeConfig(ctx context.Context) (*ipn.ServeConfig, error) {
+	body, err := get200(ctx, "/localapi/v0/serve-config")
+	if err != nil {
+		return nil, err
+	}
+	sc := new(ipn.ServeConfig)
+	if err := json.Unmarshal(body, sc); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// SetServeConfig replaces the configuration of the services that
+// tailscaled publishes to the tailnet.
+func SetServeConfig(ctx context.Context, sc *ipn.ServeConfig) error {
+	j, err := json.Marshal(sc)
+	if err != nil {
+		return err
+	}
+	_, err = send(ctx, "POST", "/localapi/v0/serve-config", http.StatusNoContent, bytes.NewReader(j))
+	return err
+}
+
+// Shapes returns the bandwidth caps on the traffic the local
+// tailscaled sends to peers and subnets, keyed by peer Tailscale IP
+// or subnet CIDR.
+func Shapes(ctx context.Context) (map[string]tstun.Shape, error) {
+	body, err := get200(ctx, "/localapi/v0/shaping")
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]tstun.Shape
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// SetShapes replaces the bandwidth caps on the traffic the local
+// tailscaled sends to peers and subnets, keyed by peer Tailscale IP
+// or subnet CIDR.
+func SetShapes(ctx context.Context, m map[string]tstun.Shape) error {
+	j, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = send(ctx, "POST", "/localapi/v0/shaping", http.StatusNoContent, bytes.NewReader(j))
+	return err
+}
+
+// ACLTest runs the ACL tests in testsJSON, as parsed by
+// acltest.Parse, against the local tailscaled's packet filter, and
+// returns the checks that failed.
+func ACLTest(ctx context.Context, testsJSON []byte) ([]acltest.Failure, error) {
+	body, err := send(ctx, "POST", "/localapi/v0/acl-test", 200, bytes.NewReader(testsJSON))
+	if err != nil {
+		return nil, err
+	}
+	var failures []acltest.Failure
+	if err := json.Unmarshal(body, &failures); err != nil {
+		return nil, err
+	}
+	return failures, nil
+}
+
+// NetworkLockStatus returns the state of network lock on the local
+// tailscaled's node.
+func NetworkLockStatus(ctx context.Context) (*ipn.NetworkLockStatus, error) {
+	body, err := get200(ctx, "/localapi/v0/lock-status")
+	if err != nil {
+		return nil, err
+	}
+	st := new(ipn.NetworkLockStatus)
+	if err := json.Unmarshal(body, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// NetworkLockInit enables network lock on the local tailscaled's
+// node, trusting keys.
+func NetworkLockInit(ctx context.Context, keys []tka.Key) error {
+	j, err := json.Marshal(struct{ Keys []tka.Key }{keys})
+	if err != nil {
+		return err
+	}
+	_, err = send(ctx, "POST", "/localapi/v0/lock-init", http.StatusNoContent, bytes.NewReader(j))
+	return err
+}
+
+// NetworkLockSign signs the node key nk with the local tailscaled's
+// network lock signing key, submitting the signature to the control
+// server, and returns it.
+func NetworkLockSign(ctx context.Context, nk tailcfg.NodeKey) (string, error) {
+	j, err := json.Marshal(struct{ NodeKey tailcfg.NodeKey }{nk})
+	if err != nil {
+		return "", err
+	}
+	body, err := send(ctx, "POST", "/localapi/v0/lock-sign", 200, bytes.NewReader(j))
+	if err != nil {
+		return "", err
+	}
+	var res struct{ Signature string }
+	if err := json.Unmarshal(body, &res); err != nil {
+		return "", err
+	}
+	return res.Signature, nil
+}
+
+// CertPair returns a TLS certificate and private key for domain, one
+// of the node's DNS names, in PEM form. tailscaled gets the
+// certificate from Let's Encrypt the first time, which can take a
+// minute.
+func CertPair(ctx context.Context, domain string) (certPEM, keyPEM []byte, err error) {
+	res, err := send(ctx, "GET", "/localapi/v0/cert/"+url.PathEscape(domain)+"?type=pair", 200, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The response is the key followed by the certificate chain.
+	i := bytes.Index(res, []byte("-----BEGIN CERTIFICATE-----"))
+	if i == -1 {
+		return nil, nil, errors.New("no certificate in response")
+	}
+	return res[i:], res[:i], nil
+}
+
+// WaitingFiles returns the files received from peers that are
+// waiting in tailscaled's inbox.
+func WaitingFiles(ctx context.Context) ([]ipn.WaitingFile, error) {
+	body, err := get200(ctx, "/localapi/v0/files/")
+	if err != nil {
+		return nil, err
+	}
+	var wfs []ipn.WaitingFile
+	if err := json.Unmarshal(body, &wfs); err != nil {
+		return nil, err
+	}
+	return wfs, nil
+}
+
+// DeleteWaitingFile deletes the waiting file baseName from
+// tailscaled's inbox.
+func DeleteWaitingFile(ctx context.Context, baseName string) error {
+	_, err := send(ctx, "DELETE", "/localapi/v0/files/"+url.PathEscape(baseName), http.StatusNoContent, nil)
+	return err
+}
+
+// GetWaitingFile opens the waiting file baseName in tailscaled's
+// inbox for reading. The caller must close rc.
+func GetWaitingFile(ctx context.Context, baseName string) (rc io.ReadCloser, size int64, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://local-tailscaled.sock/localapi/v0/files/"+url.PathEscape(baseName), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	res, err := DoLocalRequest(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, 0, fmt.Errorf("HTTP %s: %s", res.Status, body)
+	}
+	if res.ContentLength < 0 {
+		res.Body.Close()
+		return nil, 0, errors.New("missing Content-Length")
+	}
+	return res.Body, res.ContentLength, nil
+}
+
+// FileTargets returns the peers that files can be sent to.
+func FileTargets(ctx context.Context) ([]*ipn.FileTarget, error) {
+	body, err := get200(ctx, "/localapi/v0/file-targets")
+	if err != nil {
+		return nil, err
+	}
+	var fts []*ipn.FileTarget
+	if err := json.Unmarshal(body, &fts); err != nil {
+		return nil, err
+	}
+	return fts, nil
+}
+
+// PartialFile returns how much of the file named baseName the peer
+// with Tailscale IP peerIP already has from an earlier, interrupted
+// transfer, and the hash of it. Sending can resume from there if the
+// hash matches the start of the file.
+func PartialFile(ctx context.Context, peerIP netaddr.IP, baseName string) (*ipn.PartialFile, error) {
+	body, err := get200(ctx, filePutPath(peerIP, baseName))
+	if err != nil {
+		return nil, err
+	}
+	pf := new(ipn.PartialFile)
+	if err := json.Unmarshal(body, pf); err != nil {
+		return nil, err
+	}
+	return pf, nil
+}
+
+// PushFile sends a size-byte file to the peer with Tailscale IP
+// peerIP, to be stored as baseName. The transfer starts at offset,
+// which must be zero or the Offset returned by PartialFile, in which
+// case prefixSha256 is the hex SHA-256 of the file's first offset
+// bytes. r must yield the file's contents from offset on.
+func PushFile(ctx context.Context, peerIP netaddr.IP, baseName string, offset int64, prefixSha256 string, size int64, r io.Reader) error {
+	q := url.Values{"offset": {strconv.FormatInt(offset, 10)}}
+	if offset > 0 {
+		q.Set("sha256", prefixSha256)
+	}
+	path := filePutPath(peerIP, baseName) + "?" + q.Encode()
+	req, err := http.NewRequestWithContext(ctx, "PUT", "http://local-tailscaled.sock"+path, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size - offset
+	res, err := DoLocalRequest(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("HTTP %s: %s", res.Status, body)
+	}
+	return nil
+}
+
+func filePutPath(peerIP netaddr.IP, baseName string) string {
+	return "/localapi/v0/file-put/" + peerIP.String() + "/" + url.PathEscape(baseName)
+}
@@ -0,0 +1,275 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package clientupdate updates Tailscale to the latest release of a
+// release track, by the platform's package manager if it was
+// installed by one, or else by replacing the binaries or running the
+// installer.
+//
+// Each track publishes a manifest of its latest release,
+// release.json, signed with ed25519 in release.json.sig. Updates are
+// only made from manifests signed with one of the release keys built
+// in, and packages are checked against the manifest's SHA-256 sums.
+package clientupdate
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"tailscale.com/types/logger"
+	"tailscale.com/version"
+)
+
+// DefaultBaseURL is where the release tracks are published.
+const DefaultBaseURL = "https://pkgs.tailscale.com"
+
+// Release tracks.
+const (
+	StableTrack   = "stable"
+	UnstableTrack = "unstable"
+)
+
+// releaseKeys are the hex-encoded ed25519 public keys, comma
+// separated, that sign release manifests. They're set when linking
+// release builds, with:
+//
+//	-X tailscale.com/clientupdate.releaseKeys=...
+//
+// Builds without them can't update themselves.
+var releaseKeys string
+
+// ErrUnsupported is returned by Updater.Update on platforms and
+// installs it can't update, such as App Store apps.
+var ErrUnsupported = errors.New("updating isn't supported for this install; update it the way it was installed")
+
+// maxManifestSize is the largest release manifest fetched.
+const maxManifestSize = 1 << 20
+
+// Release is the latest release of a track, as described by its
+// manifest.
+type Release struct {
+	// Version is the release's version, such as "1.4.0".
+	Version string
+	// Packages are the release's packages for each platform, by
+	// GOOS-GOARCH, such as "linux-amd64": a tarball of the
+	// binaries on Linux, and an MSI installer on Windows.
+	Packages map[string]Package
+}
+
+// Package is a file of a release.
+type Package struct {
+	// Name is the package's file name, relative to the track.
+	Name   string
+	SHA256 string // hex
+	Size   int64
+}
+
+// Updater checks for and installs releases.
+type Updater struct {
+	Logf logger.Logf
+
+	// Track is the release track to follow. If empty,
+	// DefaultTrack is used.
+	Track string
+	// BaseURL is where the tracks are published. If empty,
+	// DefaultBaseURL is used.
+	BaseURL string
+	// Keys are the release keys that may sign manifests. If nil,
+	// the ones built in are used.
+	Keys []ed25519.PublicKey
+	// Client is the HTTP client used. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+}
+
+// DefaultTrack returns the track this build is from: unstable for
+// odd minor versions, and stable for the rest, including builds
+// without a version number.
+func DefaultTrack() string {
+	return trackOf(version.Short)
+}
+
+func trackOf(v string) string {
+	f := strings.SplitN(v, ".", 3)
+	if len(f) < 2 {
+		return StableTrack
+	}
+	if minor, err := strconv.Atoi(f[1]); err == nil && f[0] != "date" && minor%2 == 1 {
+		return UnstableTrack
+	}
+	return StableTrack
+}
+
+func (u *Updater) logf(format string, args ...interface{}) {
+	if u.Logf != nil {
+		u.Logf(format, args...)
+	}
+}
+
+func (u *Updater) trackURL() string {
+	base := u.BaseURL
+	if base == "" {
+		base = DefaultBaseURL
+	}
+	track := u.Track
+	if track == "" {
+		track = DefaultTrack()
+	}
+	return strings.TrimSuffix(base, "/") + "/" + track + "/"
+}
+
+func (u *Updater) client() *http.Client {
+	if u.Client != nil {
+		return u.Client
+	}
+	return http.DefaultClient
+}
+
+func (u *Updater) keys() ([]ed25519.PublicKey, error) {
+	if u.Keys != nil {
+		return u.Keys, nil
+	}
+	var keys []ed25519.PublicKey
+	for _, s := range strings.Split(releaseKeys, ",") {
+		if s == "" {
+			continue
+		}
+		k, err := hex.DecodeString(s)
+		if err != nil || len(k) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid built-in release key %q", s)
+		}
+		keys = append(keys, ed25519.PublicKey(k))
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("this build has no release keys to verify updates with")
+	}
+	return keys, nil
+}
+
+// get fetches name from the track, reading at most limit bytes.
+func (u *Updater) get(ctx context.Context, name string, limit int64) ([]byte, error) {
+	res, err := u.fetch(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > limit {
+		return nil, fmt.Errorf("%s: too large", name)
+	}
+	return b, nil
+}
+
+func (u *Updater) fetch(ctx context.Context, name string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u.trackURL()+name, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := u.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		res.Body.Close()
+		return nil, fmt.Errorf("fetching %s: %s", req.URL, res.Status)
+	}
+	return res, nil
+}
+
+// Check returns the track's latest release, after verifying its
+// manifest's signature.
+func (u *Updater) Check(ctx context.Context) (*Release, error) {
+	keys, err := u.keys()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := u.get(ctx, "release.json", maxManifestSize)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := u.get(ctx, "release.json.sig", ed25519.SignatureSize)
+	if err != nil {
+		return nil, err
+	}
+	verified := false
+	for _, k := range keys {
+		if ed25519.Verify(k, manifest, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("release manifest isn't signed by a release key")
+	}
+	rel := new(Release)
+	if err := json.Unmarshal(manifest, rel); err != nil {
+		return nil, fmt.Errorf("release manifest: %v", err)
+	}
+	if rel.Version == "" {
+		return nil, errors.New("release manifest has no version")
+	}
+	return rel, nil
+}
+
+// Newer reports whether rel is newer than the running version.
+func Newer(rel *Release) bool {
+	return !version.AtLeast(version.Short, rel.Version)
+}
+
+// platformPackage returns rel's package for this platform.
+func platformPackage(rel *Release) (Package, error) {
+	plat := runtime.GOOS + "-" + runtime.GOARCH
+	pkg, ok := rel.Packages[plat]
+	if !ok {
+		return Package{}, fmt.Errorf("release %s has no package for %s", rel.Version, plat)
+	}
+	if pkg.Name == "" || strings.Contains(pkg.Name, "..") || len(pkg.SHA256) != 2*sha256.Size {
+		return Package{}, fmt.Errorf("release %s: invalid package for %s", rel.Version, plat)
+	}
+	return pkg, nil
+}
+
+// download writes pkg to w, failing if it doesn't match its size and
+// SHA-256 sum in the manifest, in which case what was written must
+// not be used.
+func (u *Updater) download(ctx context.Context, pkg Package, w io.Writer) error {
+	res, err := u.fetch(ctx, pkg.Name)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), io.LimitReader(res.Body, pkg.Size+1))
+	if err != nil {
+		return err
+	}
+	if n != pkg.Size {
+		return fmt.Errorf("%s: got %d bytes; want %d", pkg.Name, n, pkg.Size)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != strings.ToLower(pkg.SHA256) {
+		return fmt.Errorf("%s: SHA-256 mismatch", pkg.Name)
+	}
+	return nil
+}
+
+// Update installs rel, which should be newer than the running
+// version.
+func (u *Updater) Update(ctx context.Context, rel *Release) error {
+	u.logf("clientupdate: updating from %s to %s", version.Short, rel.Version)
+	return u.update(ctx, rel)
+}
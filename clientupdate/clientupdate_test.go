@@ -0,0 +1,170 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clientupdate
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTrackOf(t *testing.T) {
+	tests := map[string]string{
+		"1.2.3":         StableTrack,
+		"1.3.0":         UnstableTrack,
+		"1.10.1-t1234":  StableTrack,
+		"date.20201207": StableTrack,
+		"":              StableTrack,
+	}
+	for v, want := range tests {
+		if got := trackOf(v); got != want {
+			t.Errorf("trackOf(%q) = %q; want %q", v, got, want)
+		}
+	}
+}
+
+// serveTrack serves files at /stable/ and returns an Updater for it.
+func serveTrack(t *testing.T, files map[string][]byte, keys ...ed25519.PublicKey) (*Updater, func()) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(b)
+	}))
+	u := &Updater{Logf: t.Logf, Track: StableTrack, BaseURL: ts.URL, Keys: keys}
+	return u, ts.Close
+}
+
+func TestCheck(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, otherPriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := json.Marshal(Release{Version: "1.4.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, done := serveTrack(t, map[string][]byte{
+		"/stable/release.json":     manifest,
+		"/stable/release.json.sig": ed25519.Sign(priv, manifest),
+	}, otherPub, pub)
+	defer done()
+	rel, err := u.Check(context.Background())
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if rel.Version != "1.4.0" {
+		t.Errorf("Version = %q", rel.Version)
+	}
+
+	u, done = serveTrack(t, map[string][]byte{
+		"/stable/release.json":     manifest,
+		"/stable/release.json.sig": ed25519.Sign(otherPriv, manifest),
+	}, pub)
+	defer done()
+	if _, err := u.Check(context.Background()); err == nil {
+		t.Error("Check accepted a manifest signed with another key")
+	}
+
+	u.Keys = nil
+	if _, err := u.Check(context.Background()); err == nil {
+		t.Error("Check succeeded without release keys")
+	}
+}
+
+func TestDownload(t *testing.T) {
+	data := []byte("installer")
+	sum := sha256.Sum256(data)
+	u, done := serveTrack(t, map[string][]byte{"/stable/pkg": data})
+	defer done()
+
+	tests := []struct {
+		pkg  Package
+		want bool
+	}{
+		{Package{Name: "pkg", SHA256: hex.EncodeToString(sum[:]), Size: int64(len(data))}, true},
+		{Package{Name: "pkg", SHA256: hex.EncodeToString(sum[:]), Size: int64(len(data)) - 1}, false},
+		{Package{Name: "pkg", SHA256: hex.EncodeToString(make([]byte, sha256.Size)), Size: int64(len(data))}, false},
+		{Package{Name: "missing", SHA256: hex.EncodeToString(sum[:]), Size: int64(len(data))}, false},
+	}
+	for i, tt := range tests {
+		var buf bytes.Buffer
+		err := u.download(context.Background(), tt.pkg, &buf)
+		if (err == nil) != tt.want {
+			t.Errorf("%d: download error = %v; want success %v", i, err, tt.want)
+		}
+	}
+}
+
+func TestReplaceBinaries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clientupdate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dsts := map[string]string{
+		"tailscale":  filepath.Join(dir, "tailscale"),
+		"tailscaled": filepath.Join(dir, "tailscaled"),
+	}
+	for _, p := range dsts {
+		if err := ioutil.WriteFile(p, []byte("old"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for name, body := range map[string]string{
+		"tailscale_1.4.0_amd64/tailscale":  "new tailscale",
+		"tailscale_1.4.0_amd64/tailscaled": "new tailscaled",
+		"tailscale_1.4.0_amd64/README":     "readme",
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(body)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(body))
+	}
+	tw.Close()
+	zw.Close()
+
+	if err := replaceBinaries(&buf, dsts); err != nil {
+		t.Fatal(err)
+	}
+	for name, p := range dsts {
+		got, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "new "+name {
+			t.Errorf("%s = %q", name, got)
+		}
+	}
+	ents, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 2 {
+		t.Errorf("%d files left in dir; want 2", len(ents))
+	}
+}
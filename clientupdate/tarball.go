@@ -0,0 +1,96 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clientupdate
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// downloadTemp downloads pkg to a new temporary file in dir, or the
+// default directory for temporary files if dir is empty, and returns
+// its path. The caller must remove it.
+func (u *Updater) downloadTemp(ctx context.Context, pkg Package, dir string) (string, error) {
+	f, err := ioutil.TempFile(dir, "tailscale-update-*-"+filepath.Base(pkg.Name))
+	if err != nil {
+		return "", err
+	}
+	err = u.download(ctx, pkg, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// replaceBinaries replaces the files at the paths in dsts, keyed by
+// base name, with the regular files of the same base name in the
+// gzipped tarball r. A binary is replaced by renaming the new one over
+// it, so running copies carry on undisturbed. Nothing is replaced
+// unless all of them found in the tarball were extracted.
+func replaceBinaries(r io.Reader, dsts map[string]string) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	var news []string // temporary files, in the order of olds
+	var olds []string
+	defer func() {
+		for _, n := range news {
+			os.Remove(n)
+		}
+	}()
+	tr := tar.NewReader(zr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		dst, ok := dsts[path.Base(h.Name)]
+		if !ok || h.Typeflag != tar.TypeReg {
+			continue
+		}
+		f, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst)+".new-*")
+		if err != nil {
+			return err
+		}
+		news = append(news, f.Name())
+		olds = append(olds, dst)
+		_, err = io.Copy(f, tr)
+		if err == nil {
+			err = f.Chmod(0755)
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("extracting %s: %v", h.Name, err)
+		}
+	}
+	if len(news) == 0 {
+		return errors.New("update tarball has none of the binaries to replace")
+	}
+	for i, n := range news {
+		if err := os.Rename(n, olds[i]); err != nil {
+			return err
+		}
+	}
+	news = nil
+	return nil
+}
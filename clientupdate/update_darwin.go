@@ -0,0 +1,34 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clientupdate
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+
+	"tailscale.com/version"
+)
+
+func (u *Updater) update(ctx context.Context, rel *Release) error {
+	// The App Store and the app's own updater handle the GUI apps.
+	// Only the open source tailscaled from Homebrew is updated
+	// here.
+	if version.IsMobile() || version.IsSandboxed() {
+		return ErrUnsupported
+	}
+	if _, err := exec.LookPath("brew"); err != nil {
+		return ErrUnsupported
+	}
+	if exec.CommandContext(ctx, "brew", "list", "--versions", "tailscale").Run() != nil {
+		return ErrUnsupported
+	}
+	u.logf("clientupdate: running brew upgrade tailscale")
+	out, err := exec.CommandContext(ctx, "brew", "upgrade", "tailscale").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("brew upgrade tailscale: %v\n%s", err, out)
+	}
+	return nil
+}
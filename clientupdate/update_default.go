@@ -0,0 +1,13 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux,!windows,!darwin
+
+package clientupdate
+
+import "context"
+
+func (u *Updater) update(ctx context.Context, rel *Release) error {
+	return ErrUnsupported
+}
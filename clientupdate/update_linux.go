@@ -0,0 +1,123 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clientupdate
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"tailscale.com/version/distro"
+)
+
+// binaries are the binaries a Linux tarball install updates.
+var binaries = []string{"tailscale", "tailscaled"}
+
+func (u *Updater) update(ctx context.Context, rel *Release) error {
+	if distro.Get() == distro.Synology {
+		return ErrUnsupported // by Package Center
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	if cmds := packageManagerUpdate(ctx, exe); cmds != nil {
+		for _, args := range cmds {
+			u.logf("clientupdate: running %s", strings.Join(args, " "))
+			out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+			if err != nil {
+				return fmt.Errorf("%s: %v\n%s", strings.Join(args, " "), err, out)
+			}
+		}
+		return nil
+	}
+
+	pkg, err := platformPackage(rel)
+	if err != nil {
+		return err
+	}
+	dsts := installedBinaries(exe)
+	if len(dsts) == 0 {
+		return ErrUnsupported
+	}
+	tgz, err := u.downloadTemp(ctx, pkg, filepath.Dir(exe))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tgz)
+	f, err := os.Open(tgz)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := replaceBinaries(f, dsts); err != nil {
+		return err
+	}
+
+	// The package scripts of the package managers restart
+	// tailscaled, so do the same. It's asynchronous, as tailscaled
+	// may be what's updating.
+	if _, err := os.Stat("/run/systemd/system"); err == nil {
+		out, err := exec.Command("systemctl", "--no-block", "try-restart", "tailscaled.service").CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("updated, but restarting tailscaled: %v\n%s", err, out)
+		}
+		return nil
+	}
+	u.logf("clientupdate: updated to %s; restart tailscaled to finish", rel.Version)
+	return nil
+}
+
+// packageManagerUpdate returns the commands updating Tailscale if
+// the binary exe was installed by a package manager, or nil if not.
+func packageManagerUpdate(ctx context.Context, exe string) [][]string {
+	owned := func(args ...string) bool {
+		if _, err := exec.LookPath(args[0]); err != nil {
+			return false
+		}
+		return exec.CommandContext(ctx, args[0], append(args[1:], exe)...).Run() == nil
+	}
+	switch {
+	case owned("dpkg", "-S"):
+		return [][]string{
+			{"apt-get", "update"},
+			{"apt-get", "install", "-y", "--only-upgrade", "tailscale"},
+		}
+	case owned("rpm", "-qf"):
+		if _, err := exec.LookPath("dnf"); err == nil {
+			return [][]string{{"dnf", "upgrade", "-y", "tailscale"}}
+		}
+		return [][]string{{"yum", "upgrade", "-y", "tailscale"}}
+	case owned("apk", "info", "--who-owns"):
+		return [][]string{
+			{"apk", "update"},
+			{"apk", "upgrade", "tailscale"},
+		}
+	}
+	return nil
+}
+
+// installedBinaries returns the paths of the installed binaries to
+// update, by name: those next to exe, the running one, or else in
+// $PATH.
+func installedBinaries(exe string) map[string]string {
+	ret := make(map[string]string)
+	for _, name := range binaries {
+		p := filepath.Join(filepath.Dir(exe), name)
+		if _, err := os.Stat(p); err != nil {
+			if p, err = exec.LookPath(name); err != nil {
+				continue
+			}
+		}
+		ret[name] = p
+	}
+	return ret
+}
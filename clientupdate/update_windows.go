@@ -0,0 +1,32 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clientupdate
+
+import (
+	"context"
+	"os"
+	"os/exec"
+)
+
+func (u *Updater) update(ctx context.Context, rel *Release) error {
+	pkg, err := platformPackage(rel)
+	if err != nil {
+		return err
+	}
+	msi, err := u.downloadTemp(ctx, pkg, "")
+	if err != nil {
+		return err
+	}
+	// The installer stops the service, which may be what's
+	// updating, so it's left running on its own, and the MSI is
+	// left in the temporary directory for it.
+	cmd := exec.Command("msiexec.exe", "/i", msi, "/quiet", "/norestart")
+	if err := cmd.Start(); err != nil {
+		os.Remove(msi)
+		return err
+	}
+	u.logf("clientupdate: installer started for %s", rel.Version)
+	return cmd.Process.Release()
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go4.org/mem"
+	"tailscale.com/derp"
+	"tailscale.com/types/key"
+)
+
+// clientACL is the set of node keys of the clients allowed to use the
+// server, loaded from --allowed-clients.
+type clientACL struct {
+	s    *derp.Server
+	src  string
+	keys atomic.Value // of map[key.Public]bool
+}
+
+// startClientACL restricts s to the clients in --allowed-clients, if
+// set, reloading the list every --allowed-clients-refresh and
+// disconnecting the clients it no longer has. The list must load at
+// startup; later failures keep the previous one.
+func startClientACL(s *derp.Server) error {
+	if *allowedClients == "" {
+		return nil
+	}
+	if strings.HasPrefix(*allowedClients, "http://") {
+		return errors.New("http URLs are refused, as anyone on the path could add keys; use https or a local file")
+	}
+	a := &clientACL{s: s, src: *allowedClients}
+	if err := a.load(); err != nil {
+		return err
+	}
+	s.SetAllowClient(a.allow)
+	if *allowedClientsRefresh > 0 {
+		go a.refreshLoop(*allowedClientsRefresh)
+	}
+	return nil
+}
+
+// allow reports whether the client with key k may use the server.
+func (a *clientACL) allow(k key.Public) bool {
+	return a.keys.Load().(map[key.Public]bool)[k]
+}
+
+func (a *clientACL) refreshLoop(d time.Duration) {
+	for {
+		time.Sleep(d)
+		if err := a.load(); err != nil {
+			log.Printf("reloading allowed clients, keeping the previous list: %v", err)
+			continue
+		}
+		a.s.RecheckClients()
+	}
+}
+
+// load reads the list of allowed clients from a.src.
+func (a *clientACL) load() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var b []byte
+	var err error
+	if strings.HasPrefix(a.src, "https://") {
+		b, err = fetchClientACL(ctx, a.src)
+	} else {
+		b, err = ioutil.ReadFile(a.src)
+	}
+	if err != nil {
+		return fmt.Errorf("loading allowed clients from %s: %v", a.src, err)
+	}
+	keys, err := parseClientACL(b)
+	if err != nil {
+		return fmt.Errorf("allowed clients from %s: %v", a.src, err)
+	}
+	if old, _ := a.keys.Load().(map[key.Public]bool); len(old) != len(keys) {
+		log.Printf("%d allowed clients", len(keys))
+	}
+	a.keys.Store(keys)
+	return nil
+}
+
+// clientACLClient fetches the list of allowed clients, refusing to
+// follow redirects away from https.
+var clientACLClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if req.URL.Scheme != "https" {
+			return fmt.Errorf("redirected to non-https URL %s", req.URL)
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	},
+}
+
+func fetchClientACL(ctx context.Context, urlStr string) ([]byte, error) {
+	req, err := http.NewRequest("GET", urlStr, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := clientACLClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, errors.New(res.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(res.Body, 16<<20))
+}
+
+// parseClientACL parses a list of node keys, one per line, in hex
+// with or without the "nodekey:" prefix. Blank lines and "#"
+// comments are ignored.
+func parseClientACL(b []byte) (map[key.Public]bool, error) {
+	keys := make(map[key.Public]bool)
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		k, err := key.NewPublicFromHexMem(mem.S(strings.TrimPrefix(line, "nodekey:")))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		keys[k] = true
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
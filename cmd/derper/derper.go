@@ -17,7 +17,6 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -31,8 +30,6 @@ import (
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
 	"tailscale.com/logpolicy"
-	"tailscale.com/metrics"
-	"tailscale.com/net/stun"
 	"tailscale.com/tsweb"
 	"tailscale.com/types/key"
 	"tailscale.com/version"
@@ -46,8 +43,13 @@ var (
 	hostname      = flag.String("hostname", "derp.tailscale.com", "LetsEncrypt host name, if addr's port is :443")
 	logCollection = flag.String("logcollection", "", "If non-empty, logtail collection to log to")
 	runSTUN       = flag.Bool("stun", false, "also run a STUN server")
+	runSTUNTCP    = flag.Bool("stun-tcp", false, "with --stun, also accept STUN requests over TCP on the STUN port, for clients whose UDP is blocked")
+	metricsAddr   = flag.String("metrics-addr", "", "if non-empty, address (such as on a private interface) on which to serve Prometheus metrics at /metrics, without access control")
 	meshPSKFile   = flag.String("mesh-psk-file", defaultMeshPSKFile(), "if non-empty, path to file containing the mesh pre-shared key file. It should contain some hex string; whitespace is trimmed.")
-	meshWith      = flag.String("mesh-with", "", "optional comma-separated list of hostnames to mesh with; the server's own hostname can be in the list")
+	meshWith      = flag.String("mesh-with", "", "optional comma-separated list of hostnames (or http(s)://host:port/derp URLs) of the other servers in this region to mesh with; the server's own can be in the list")
+
+	allowedClients        = flag.String("allowed-clients", "", `if non-empty, path or https URL of a list of the node keys ("nodekey:" and hex, one per line; "#" starts a comment) of the only clients allowed to use the server, so it isn't an open relay; mesh peers are always allowed`)
+	allowedClientsRefresh = flag.Duration("allowed-clients-refresh", time.Minute, "with --allowed-clients, how often to reload the list; 0 loads it only at startup")
 )
 
 type config struct {
@@ -140,6 +142,9 @@ func main() {
 	if err := startMesh(s); err != nil {
 		log.Fatalf("startMesh: %v", err)
 	}
+	if err := startClientACL(s); err != nil {
+		log.Fatalf("--allowed-clients: %v", err)
+	}
 	expvar.Publish("derp", s.ExpVar())
 
 	// Create our own mux so we don't expose /debug/ stuff to the world.
@@ -163,7 +168,14 @@ func main() {
 	}))
 
 	if *runSTUN {
+		expvar.Publish("stun", stunStats)
 		go serveSTUN()
+		if *runSTUNTCP {
+			go serveSTUNTCP()
+		}
+	}
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr)
 	}
 
 	httpsrv := &http.Server{
@@ -214,6 +226,17 @@ func main() {
 	}
 }
 
+// serveMetrics serves the Prometheus metrics on addr, separately from
+// the main listener so that they can be scraped without debug access.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", tsweb.VarzHandler)
+	log.Printf("derper: serving metrics on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("metrics: %v", err)
+	}
+}
+
 func debugHandler(s *derp.Server) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.RequestURI == "/debug/check" {
@@ -247,70 +270,6 @@ func debugHandler(s *derp.Server) http.Handler {
 	})
 }
 
-func serveSTUN() {
-	pc, err := net.ListenPacket("udp", ":3478")
-	if err != nil {
-		log.Fatalf("failed to open STUN listener: %v", err)
-	}
-	log.Printf("running STUN server on %v", pc.LocalAddr())
-
-	var (
-		stats           = new(metrics.Set)
-		stunDisposition = &metrics.LabelMap{Label: "disposition"}
-		stunAddrFamily  = &metrics.LabelMap{Label: "family"}
-
-		stunReadError  = stunDisposition.Get("read_error")
-		stunNotSTUN    = stunDisposition.Get("not_stun")
-		stunWriteError = stunDisposition.Get("write_error")
-		stunSuccess    = stunDisposition.Get("success")
-
-		stunIPv4 = stunAddrFamily.Get("ipv4")
-		stunIPv6 = stunAddrFamily.Get("ipv6")
-	)
-	stats.Set("counter_requests", stunDisposition)
-	stats.Set("counter_addrfamily", stunAddrFamily)
-	expvar.Publish("stun", stats)
-
-	var buf [64 << 10]byte
-	for {
-		n, addr, err := pc.ReadFrom(buf[:])
-		if err != nil {
-			log.Printf("STUN ReadFrom: %v", err)
-			time.Sleep(time.Second)
-			stunReadError.Add(1)
-			continue
-		}
-		ua, ok := addr.(*net.UDPAddr)
-		if !ok {
-			log.Printf("STUN unexpected address %T %v", addr, addr)
-			stunReadError.Add(1)
-			continue
-		}
-		pkt := buf[:n]
-		if !stun.Is(pkt) {
-			stunNotSTUN.Add(1)
-			continue
-		}
-		txid, err := stun.ParseBindingRequest(pkt)
-		if err != nil {
-			stunNotSTUN.Add(1)
-			continue
-		}
-		if ua.IP.To4() != nil {
-			stunIPv4.Add(1)
-		} else {
-			stunIPv6.Add(1)
-		}
-		res := stun.Response(txid, ua.IP, uint16(ua.Port))
-		_, err = pc.WriteTo(res, addr)
-		if err != nil {
-			stunWriteError.Add(1)
-		} else {
-			stunSuccess.Add(1)
-		}
-	}
-}
-
 var validProdHostname = regexp.MustCompile(`^derp([^.]*)\.tailscale\.com\.?$`)
 
 func prodAutocertHostPolicy(_ context.Context, host string) error {
@@ -5,8 +5,16 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"fmt"
+	"io"
+	"strings"
 	"testing"
+
+	"tailscale.com/net/stun"
+	"tailscale.com/types/key"
 )
 
 func TestProdAutocertHostPolicy(t *testing.T) {
@@ -33,3 +41,54 @@ func TestProdAutocertHostPolicy(t *testing.T) {
 	}
 
 }
+
+func TestReadSTUNMessage(t *testing.T) {
+	req1 := stun.Request(stun.NewTxID())
+	req2 := stun.Request(stun.NewTxID())
+	br := bufio.NewReader(bytes.NewReader(append(append([]byte(nil), req1...), req2...)))
+	for i, want := range [][]byte{req1, req2} {
+		got, err := readSTUNMessage(br)
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("message %d = %x; want %x", i, got, want)
+		}
+	}
+	if _, err := readSTUNMessage(br); err != io.EOF {
+		t.Errorf("at end, err = %v; want EOF", err)
+	}
+
+	br = bufio.NewReader(bytes.NewReader(req1[:len(req1)-1]))
+	if _, err := readSTUNMessage(br); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated message: err = %v; want ErrUnexpectedEOF", err)
+	}
+
+	big := append([]byte(nil), req1[:20]...)
+	big[2], big[3] = 0xff, 0xff
+	br = bufio.NewReader(strings.NewReader(string(big)))
+	if _, err := readSTUNMessage(br); err != errSTUNTooLarge {
+		t.Errorf("large message: err = %v; want errSTUNTooLarge", err)
+	}
+}
+
+func TestParseClientACL(t *testing.T) {
+	k1 := key.Public{1}
+	k2 := key.Public{2}
+	in := fmt.Sprintf(`# office laptops
+nodekey:%x
+  %x   # build server
+
+`, k1[:], k2[:])
+	got, err := parseClientACL([]byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || !got[k1] || !got[k2] {
+		t.Errorf("got %v; want %v and %v", got, k1, k2)
+	}
+
+	if _, err := parseClientACL([]byte("nodekey:abc\n")); err == nil {
+		t.Error("short key parsed")
+	}
+}
@@ -31,9 +31,19 @@ func startMesh(s *derp.Server) error {
 	return nil
 }
 
+// meshURL returns the DERP URL of the mesh peer named by host, which
+// is either a hostname or, for peers that aren't reachable over
+// HTTPS (such as on a private network), a full http(s) URL.
+func meshURL(host string) string {
+	if strings.HasPrefix(host, "https://") || strings.HasPrefix(host, "http://") {
+		return host
+	}
+	return "https://" + host + "/derp"
+}
+
 func startMeshWithHost(s *derp.Server, host string) error {
 	logf := logger.WithPrefix(log.Printf, fmt.Sprintf("mesh(%q): ", host))
-	c, err := derphttp.NewClient(s.PrivateKey(), "https://"+host+"/derp", logf)
+	c, err := derphttp.NewClient(s.PrivateKey(), meshURL(host), logf)
 	if err != nil {
 		return err
 	}
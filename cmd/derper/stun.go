@@ -0,0 +1,188 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"tailscale.com/metrics"
+	"tailscale.com/net/stun"
+)
+
+const stunAddr = ":3478"
+
+var (
+	stunStats       = new(metrics.Set)
+	stunDisposition = &metrics.LabelMap{Label: "disposition"}
+	stunAddrFamily  = &metrics.LabelMap{Label: "family"}
+	stunProto       = &metrics.LabelMap{Label: "proto"}
+
+	stunReadError  = stunDisposition.Get("read_error")
+	stunNotSTUN    = stunDisposition.Get("not_stun")
+	stunWriteError = stunDisposition.Get("write_error")
+	stunSuccess    = stunDisposition.Get("success")
+
+	stunIPv4 = stunAddrFamily.Get("ipv4")
+	stunIPv6 = stunAddrFamily.Get("ipv6")
+
+	stunUDP = stunProto.Get("udp")
+	stunTCP = stunProto.Get("tcp")
+)
+
+func init() {
+	stunStats.Set("counter_requests", stunDisposition)
+	stunStats.Set("counter_addrfamily", stunAddrFamily)
+	stunStats.Set("counter_proto", stunProto)
+}
+
+// stunResponse returns the response to the STUN binding request pkt
+// from ip:port, or nil if pkt isn't one.
+func stunResponse(pkt []byte, ip net.IP, port int) []byte {
+	if !stun.Is(pkt) {
+		stunNotSTUN.Add(1)
+		return nil
+	}
+	txid, err := stun.ParseBindingRequest(pkt)
+	if err != nil {
+		stunNotSTUN.Add(1)
+		return nil
+	}
+	if ip.To4() != nil {
+		stunIPv4.Add(1)
+	} else {
+		stunIPv6.Add(1)
+	}
+	return stun.Response(txid, ip, uint16(port))
+}
+
+func serveSTUN() {
+	pc, err := net.ListenPacket("udp", stunAddr)
+	if err != nil {
+		log.Fatalf("failed to open STUN listener: %v", err)
+	}
+	log.Printf("running STUN server on %v", pc.LocalAddr())
+
+	var buf [64 << 10]byte
+	for {
+		n, addr, err := pc.ReadFrom(buf[:])
+		if err != nil {
+			log.Printf("STUN ReadFrom: %v", err)
+			time.Sleep(time.Second)
+			stunReadError.Add(1)
+			continue
+		}
+		ua, ok := addr.(*net.UDPAddr)
+		if !ok {
+			log.Printf("STUN unexpected address %T %v", addr, addr)
+			stunReadError.Add(1)
+			continue
+		}
+		res := stunResponse(buf[:n], ua.IP, ua.Port)
+		if res == nil {
+			continue
+		}
+		stunUDP.Add(1)
+		_, err = pc.WriteTo(res, addr)
+		if err != nil {
+			stunWriteError.Add(1)
+		} else {
+			stunSuccess.Add(1)
+		}
+	}
+}
+
+// serveSTUNTCP accepts STUN binding requests over TCP, where each
+// message is delimited by the length in its header (RFC 5389 section
+// 7.2.2). The reported address is the client's TCP source address,
+// which is of limited use for UDP NAT traversal but still tells a
+// client behind a UDP-blocking firewall its public IP.
+func serveSTUNTCP() {
+	ln, err := net.Listen("tcp", stunAddr)
+	if err != nil {
+		log.Fatalf("failed to open STUN TCP listener: %v", err)
+	}
+	log.Printf("running STUN server on TCP %v", ln.Addr())
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			log.Printf("STUN Accept: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go handleSTUNConn(c)
+	}
+}
+
+const (
+	// stunTCPIdleTimeout is how long a STUN TCP connection may go
+	// without a request before it's closed.
+	stunTCPIdleTimeout = 30 * time.Second
+
+	// stunMaxMessageSize is the largest STUN message accepted over
+	// TCP. Binding requests are much smaller.
+	stunMaxMessageSize = 1 << 10
+)
+
+func handleSTUNConn(c net.Conn) {
+	defer c.Close()
+	ta, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	br := bufio.NewReader(c)
+	for {
+		c.SetDeadline(time.Now().Add(stunTCPIdleTimeout))
+		pkt, err := readSTUNMessage(br)
+		if err != nil {
+			if err != io.EOF {
+				stunReadError.Add(1)
+			}
+			return
+		}
+		res := stunResponse(pkt, ta.IP, ta.Port)
+		if res == nil {
+			// The stream is no longer in sync.
+			return
+		}
+		stunTCP.Add(1)
+		if _, err := c.Write(res); err != nil {
+			stunWriteError.Add(1)
+			return
+		}
+		stunSuccess.Add(1)
+	}
+}
+
+// readSTUNMessage reads one STUN message from br.
+func readSTUNMessage(br *bufio.Reader) ([]byte, error) {
+	const headerLen = 20
+	hdr, err := br.Peek(headerLen)
+	if err != nil {
+		if err == io.EOF && br.Buffered() > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	n := headerLen + int(binary.BigEndian.Uint16(hdr[2:4]))
+	if n > stunMaxMessageSize {
+		return nil, errSTUNTooLarge
+	}
+	pkt := make([]byte, n)
+	if _, err := io.ReadFull(br, pkt); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return pkt, nil
+}
+
+var errSTUNTooLarge = errors.New("STUN message too large")
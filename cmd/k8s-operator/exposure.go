@@ -0,0 +1,142 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"tailscale.com/kube"
+)
+
+// exposurePath is the API path of all TailnetExposures.
+const exposurePath = "/apis/tailscale.com/v1alpha1/tailnetexposures"
+
+// tailnetExposure is a TailnetExposure, the custom resource through
+// which namespace owners ask for a Service in their namespace to be
+// exposed on the tailnet, possibly with ACL tags. See
+// tailnetexposure-crd.yaml.
+type tailnetExposure struct {
+	kube.TypeMeta
+	Metadata kube.ObjectMeta `json:"metadata"`
+	Spec     struct {
+		Service  string   `json:"service"`
+		Hostname string   `json:"hostname,omitempty"`
+		Tags     []string `json:"tags,omitempty"`
+	} `json:"spec"`
+	Status exposureStatus `json:"status,omitempty"`
+}
+
+// exposureStatus is the status of a TailnetExposure, as set by the
+// operator.
+type exposureStatus struct {
+	Phase   string `json:"phase,omitempty"` // "Accepted" or "Rejected"
+	Message string `json:"message,omitempty"`
+}
+
+type tailnetExposureList struct {
+	Items []tailnetExposure `json:"items"`
+}
+
+// exposurePolicy is the cluster's policy on TailnetExposures, read
+// from the -exposure-policy file:
+//
+//	{
+//	  "namespaces": {
+//	    "payments": {"tags": ["tag:payments"], "authKeySecret": "payments-authkey"},
+//	    "*": {"tags": ["tag:k8s"]}
+//	  }
+//	}
+//
+// A namespace's entry, or else the "*" one, lists the tags its
+// TailnetExposures may request and the Secret, in the proxy
+// namespace, whose auth key their proxies log in with; that key's
+// owner must be allowed by the tailnet's ACLs to assign the tags.
+// Without an entry, a namespace may only request untagged exposure,
+// with the default auth key.
+type exposurePolicy struct {
+	Namespaces map[string]namespacePolicy `json:"namespaces"`
+}
+
+type namespacePolicy struct {
+	Tags          []string `json:"tags"`
+	AuthKeySecret string   `json:"authKeySecret,omitempty"`
+}
+
+// loadExposurePolicy reads the policy file at path. An empty path
+// means the empty policy.
+func loadExposurePolicy(path string) (*exposurePolicy, error) {
+	pol := new(exposurePolicy)
+	if path == "" {
+		return pol, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, pol); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for ns, np := range pol.Namespaces {
+		for _, tag := range np.Tags {
+			if !strings.HasPrefix(tag, "tag:") {
+				return nil, fmt.Errorf("%s: namespace %q: tag %q doesn't start with \"tag:\"", path, ns, tag)
+			}
+		}
+	}
+	return pol, nil
+}
+
+// forNamespace returns the policy for the namespace ns.
+func (pol *exposurePolicy) forNamespace(ns string) namespacePolicy {
+	if np, ok := pol.Namespaces[ns]; ok {
+		return np
+	}
+	return pol.Namespaces["*"]
+}
+
+// exposureProxy returns the proxy for the TailnetExposure e, or why
+// the policy pol or the state of the cluster doesn't allow it.
+// clusterIPs are the cluster IPs of Services by "ns/name".
+func exposureProxy(e tailnetExposure, clusterIPs map[string]string, pol *exposurePolicy) (proxy, error) {
+	meta := e.Metadata
+	np := pol.forNamespace(meta.Namespace)
+	for _, tag := range e.Spec.Tags {
+		if !containsString(np.Tags, tag) {
+			return proxy{}, fmt.Errorf("tag %q is not allowed in namespace %q", tag, meta.Namespace)
+		}
+	}
+	if e.Spec.Service == "" {
+		return proxy{}, fmt.Errorf("no service to expose")
+	}
+	ip := clusterIPs[meta.Namespace+"/"+e.Spec.Service]
+	if ip == "" || ip == "None" {
+		return proxy{}, fmt.Errorf("svc %s/%s has no cluster IP to proxy to", meta.Namespace, e.Spec.Service)
+	}
+	p := proxy{
+		ParentKind:    "exposure",
+		ParentNS:      meta.Namespace,
+		ParentName:    meta.Name,
+		Hostname:      e.Spec.Hostname,
+		DestIP:        ip,
+		Tags:          e.Spec.Tags,
+		AuthKeySecret: np.AuthKeySecret,
+	}
+	if p.Hostname == "" {
+		p.Hostname = meta.Namespace + "-" + meta.Name
+	}
+	return p, nil
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
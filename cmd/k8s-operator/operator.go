@@ -0,0 +1,463 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The k8s-operator command exposes Kubernetes Services and Ingresses
+// on a tailnet.
+//
+// It watches for Services and Ingresses annotated with
+// tailscale.com/expose: "true" and, for each, runs a proxy
+// Deployment: an ephemeral tailscale node, named after the
+// tailscale.com/hostname annotation or <namespace>-<name>, that
+// forwards its tailnet traffic to the Service's cluster IP (for an
+// Ingress, that of its default backend's Service). The proxies log in
+// with the auth key in the "authkey" field of the Secret named by
+// -authkey-secret, which should be a reusable, ephemeral key. When
+// the Service or Ingress is deleted or loses the annotation, the
+// operator deletes its proxy, and the ephemeral node leaves the
+// tailnet.
+//
+// In the other direction, an ExternalName Service annotated with
+// tailscale.com/tailnet-ip: <tailnet IP> lets workloads in the
+// cluster reach that tailnet node without joining the tailnet
+// themselves. The operator runs an egress proxy for it, puts a
+// ClusterIP Service with the same ports in front of the proxy, and
+// points the annotated Service's externalName at that ClusterIP
+// Service. Like the other proxies, egress proxies route with a TUN
+// device and iptables, so they run with the NET_ADMIN, NET_RAW and
+// MKNOD capabilities, though not privileged.
+//
+// To expose several Services on one tailnet node, create a ConfigMap
+// labeled tailscale.com/proxy-group: "true" whose data maps tailnet
+// ports to Services:
+//
+//	data:
+//	  "80": web
+//	  "5432": db/postgres
+//	  "8443": api:443
+//
+// A Service is named as [namespace/]name[:port], defaulting to the
+// ConfigMap's namespace and to the same port as on the tailnet. Only
+// ConfigMaps in the proxy namespace may name Services in other
+// namespaces. The operator runs one proxy for the ConfigMap and hands
+// it the resolved mappings in a ConfigMap of its own, which the proxy
+// rereads, so that editing the mappings doesn't restart it or change
+// its tailnet IP.
+//
+// Namespace owners who need their proxies to carry ACL tags create a
+// TailnetExposure instead (see tailnetexposure-crd.yaml):
+//
+//	apiVersion: tailscale.com/v1alpha1
+//	kind: TailnetExposure
+//	metadata: {name: api, namespace: payments}
+//	spec: {service: api, tags: ["tag:payments"]}
+//
+// The cluster admin's -exposure-policy file says which tags each
+// namespace may request, and with which auth key its proxies log in.
+// The operator exposes the Service if the policy allows the tags, and
+// records the outcome in the TailnetExposure's status.
+//
+// The operator's service account needs to get, list and watch
+// Services, Ingresses, ConfigMaps and TailnetExposures in all
+// namespaces, to patch Services and the status of TailnetExposures,
+// and to get, list, create, update, patch and delete Deployments,
+// Services, Secrets and ConfigMaps in the proxy namespace.
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"tailscale.com/kube"
+	"tailscale.com/logtail/backoff"
+	"tailscale.com/types/logger"
+)
+
+var (
+	proxyNS       = flag.String("proxy-namespace", "", "namespace to run proxies in; empty means the operator's own")
+	proxyImage    = flag.String("proxy-image", "tailscale/tailscale:latest", "container image for proxies, with tailscale, tailscaled and iptables")
+	authKeySecret = flag.String("authkey-secret", "tailscale-operator-authkey", `name of the Secret in the proxy namespace whose "authkey" field proxies log in with`)
+	clusterDomain = flag.String("cluster-domain", "cluster.local", "DNS domain of the cluster, for the names egress Services point at")
+	policyPath    = flag.String("exposure-policy", "", "path of the JSON policy on which tags each namespace's TailnetExposures may request; empty means none")
+	resync        = flag.Duration("resync", 5*time.Minute, "how often to reconcile everything even without changes")
+)
+
+func main() {
+	flag.Parse()
+	kc, err := kube.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	pol, err := loadExposurePolicy(*policyPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	op := &operator{
+		kc:            kc,
+		logf:          log.Printf,
+		ns:            *proxyNS,
+		image:         *proxyImage,
+		authKeySecret: *authKeySecret,
+		clusterDomain: *clusterDomain,
+		policy:        pol,
+	}
+	if op.ns == "" {
+		op.ns = kc.Namespace()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigc
+		cancel()
+	}()
+
+	op.run(ctx, *resync)
+}
+
+type operator struct {
+	kc            *kube.Client
+	logf          logger.Logf
+	ns            string // namespace of proxies
+	image         string
+	authKeySecret string
+	clusterDomain string
+	policy        *exposurePolicy
+}
+
+// run reconciles whenever a Service, Ingress, proxy group ConfigMap or
+// TailnetExposure changes, and every resync, until ctx is done.
+func (op *operator) run(ctx context.Context, resync time.Duration) {
+	changed := make(chan struct{}, 1)
+	notify := func(kube.WatchEvent) error {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+	for _, path := range []string{"/api/v1/services", "/apis/networking.k8s.io/v1/ingresses", groupPath, exposurePath} {
+		go op.watch(ctx, path, notify)
+	}
+
+	bo := backoff.NewBackoff("reconcile", op.logf, time.Minute)
+	t := time.NewTicker(resync)
+	defer t.Stop()
+	for {
+		err := op.reconcile(ctx)
+		if err != nil {
+			op.logf("reconcile: %v", err)
+		}
+		bo.BackOff(ctx, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+			// Let a burst of changes settle.
+			time.Sleep(time.Second)
+		case <-t.C:
+		}
+	}
+}
+
+// watch watches the collection at path until ctx is done, calling fn
+// for every event and re-establishing the watch when it ends.
+func (op *operator) watch(ctx context.Context, path string, fn func(kube.WatchEvent) error) {
+	bo := backoff.NewBackoff("watch "+path, op.logf, time.Minute)
+	for ctx.Err() == nil {
+		err := op.kc.Watch(ctx, path, "", fn)
+		if kube.IsNotFound(err) {
+			op.logf("watch %s: not supported by this cluster", path)
+			return
+		}
+		bo.BackOff(ctx, err)
+	}
+}
+
+// groupPath is the API path of the proxy group ConfigMaps.
+var groupPath = "/api/v1/configmaps?labelSelector=" + url.QueryEscape(groupSelector)
+
+// proxyPaths returns the API paths of the collections of proxy
+// Deployments, Secrets, Services and ConfigMaps.
+func (op *operator) proxyPaths() (deploys, secrets, svcs, cms string) {
+	return "/apis/apps/v1/namespaces/" + op.ns + "/deployments",
+		"/api/v1/namespaces/" + op.ns + "/secrets",
+		"/api/v1/namespaces/" + op.ns + "/services",
+		"/api/v1/namespaces/" + op.ns + "/configmaps"
+}
+
+// reconcile makes the proxies in the cluster match the annotated
+// Services and Ingresses, the proxy group ConfigMaps and the
+// TailnetExposures.
+func (op *operator) reconcile(ctx context.Context) error {
+	var svcs kube.ServiceList
+	if err := op.kc.Do(ctx, "GET", "/api/v1/services", nil, &svcs); err != nil {
+		return fmt.Errorf("listing services: %w", err)
+	}
+	var ings kube.IngressList
+	if err := op.kc.Do(ctx, "GET", "/apis/networking.k8s.io/v1/ingresses", nil, &ings); err != nil && !kube.IsNotFound(err) {
+		return fmt.Errorf("listing ingresses: %w", err)
+	}
+	var groups kube.ConfigMapList
+	if err := op.kc.Do(ctx, "GET", groupPath, nil, &groups); err != nil {
+		return fmt.Errorf("listing proxy groups: %w", err)
+	}
+	var exps tailnetExposureList
+	if err := op.kc.Do(ctx, "GET", exposurePath, nil, &exps); err != nil && !kube.IsNotFound(err) {
+		return fmt.Errorf("listing tailnet exposures: %w", err)
+	}
+	want, rejected := desiredProxies(svcs.Items, ings.Items, groups.Items, exps.Items, op.policy, op.ns, op.logf)
+
+	deployPath, secretPath, svcPath, cmPath := op.proxyPaths()
+	selector := "?labelSelector=" + url.QueryEscape(managedSelector)
+	var deploys kube.ObjectList
+	var secrets kube.SecretList
+	var proxySvcs kube.ServiceList
+	var proxyCMs kube.ConfigMapList
+	if err := op.kc.Do(ctx, "GET", deployPath+selector, nil, &deploys); err != nil {
+		return fmt.Errorf("listing proxies: %w", err)
+	}
+	if err := op.kc.Do(ctx, "GET", secretPath+selector, nil, &secrets); err != nil {
+		return fmt.Errorf("listing proxy secrets: %w", err)
+	}
+	if err := op.kc.Do(ctx, "GET", svcPath+selector, nil, &proxySvcs); err != nil {
+		return fmt.Errorf("listing proxy services: %w", err)
+	}
+	if err := op.kc.Do(ctx, "GET", cmPath+selector, nil, &proxyCMs); err != nil {
+		return fmt.Errorf("listing proxy configmaps: %w", err)
+	}
+
+	haveDeploy := make(map[string]kube.ObjectMeta)
+	for _, d := range deploys.Items {
+		haveDeploy[d.Metadata.Name] = d.Metadata
+	}
+	haveSecret := make(map[string]*kube.Secret)
+	for i, s := range secrets.Items {
+		haveSecret[s.Metadata.Name] = &secrets.Items[i]
+	}
+	haveSvc := make(map[string]*kube.Service)
+	for i, s := range proxySvcs.Items {
+		haveSvc[s.Metadata.Name] = &proxySvcs.Items[i]
+	}
+	haveCM := make(map[string]*kube.ConfigMap)
+	for i, cm := range proxyCMs.Items {
+		haveCM[cm.Metadata.Name] = &proxyCMs.Items[i]
+	}
+
+	var firstErr error
+	setErr := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	authKeys := make(map[string][]byte) // by Secret name
+	for _, name := range sortedNames(want) {
+		p := want[name]
+		secret := p.AuthKeySecret
+		if secret == "" {
+			secret = op.authKeySecret
+		}
+		authKey, ok := authKeys[secret]
+		if !ok {
+			var err error
+			if authKey, err = op.authKey(ctx, secret); err != nil {
+				// Stale proxies are still deleted below.
+				setErr(err)
+				continue
+			}
+			authKeys[secret] = authKey
+		}
+		var err error
+		if p.group() {
+			// Before the Deployment, whose pod mounts it.
+			err = op.ensureGroupConfig(ctx, p, haveCM[name])
+		}
+		if err == nil {
+			err = op.ensureProxy(ctx, p, authKey, haveSecret[name], haveDeploy)
+		}
+		if err == nil && p.egress() {
+			err = op.ensureEgressService(ctx, p, haveSvc[name], svcs.Items)
+		}
+		setErr(err)
+	}
+	for _, e := range exps.Items {
+		setErr(op.updateExposureStatus(ctx, e, want, rejected))
+	}
+	for name := range haveDeploy {
+		if _, ok := want[name]; !ok {
+			op.logf("deleting proxy %s", name)
+			setErr(op.deleteIfExists(ctx, deployPath+"/"+name))
+		}
+	}
+	for name := range haveSecret {
+		if _, ok := want[name]; !ok {
+			setErr(op.deleteIfExists(ctx, secretPath+"/"+name))
+		}
+	}
+	for name := range haveSvc {
+		if _, ok := want[name]; !ok {
+			setErr(op.deleteIfExists(ctx, svcPath+"/"+name))
+		}
+	}
+	for name := range haveCM {
+		if _, ok := want[name]; !ok {
+			setErr(op.deleteIfExists(ctx, cmPath+"/"+name))
+		}
+	}
+	return firstErr
+}
+
+// authKey returns the auth key in the Secret named secret in the
+// proxy namespace.
+func (op *operator) authKey(ctx context.Context, secret string) ([]byte, error) {
+	var s kube.Secret
+	if err := op.kc.Do(ctx, "GET", "/api/v1/namespaces/"+op.ns+"/secrets/"+secret, nil, &s); err != nil {
+		return nil, fmt.Errorf("reading auth key secret %s/%s: %w", op.ns, secret, err)
+	}
+	if len(s.Data[authKeySecretKey]) == 0 {
+		return nil, fmt.Errorf("auth key secret %s/%s has no %q field", op.ns, secret, authKeySecretKey)
+	}
+	return s.Data[authKeySecretKey], nil
+}
+
+// updateExposureStatus records in the status of the TailnetExposure
+// e whether it was rejected, per rejected, or which of the proxies in
+// want exposes it.
+func (op *operator) updateExposureStatus(ctx context.Context, e tailnetExposure, want map[string]proxy, rejected map[string]error) error {
+	meta := e.Metadata
+	var st exposureStatus
+	if err, ok := rejected[meta.Namespace+"/"+meta.Name]; ok {
+		st = exposureStatus{Phase: "Rejected", Message: err.Error()}
+	} else {
+		name := proxy{ParentKind: "exposure", ParentNS: meta.Namespace, ParentName: meta.Name}.name()
+		st = exposureStatus{Phase: "Accepted", Message: fmt.Sprintf("exposed by proxy %s as %q", name, want[name].Hostname)}
+	}
+	if st == e.Status {
+		return nil
+	}
+	path := "/apis/tailscale.com/v1alpha1/namespaces/" + meta.Namespace + "/tailnetexposures/" + meta.Name + "/status"
+	if err := op.kc.Patch(ctx, path, map[string]interface{}{"status": st}, nil); err != nil {
+		return fmt.Errorf("tailnetexposure %s/%s status: %w", meta.Namespace, meta.Name, err)
+	}
+	return nil
+}
+
+// ensureProxy creates or updates the Secret and Deployment of p.
+func (op *operator) ensureProxy(ctx context.Context, p proxy, authKey []byte, haveSecret *kube.Secret, haveDeploy map[string]kube.ObjectMeta) error {
+	name := p.name()
+	secret := p.secretManifest(op.ns, authKey)
+	deployPath, secretPath, _, _ := op.proxyPaths()
+	var err error
+	switch {
+	case haveSecret == nil:
+		err = op.kc.Do(ctx, "POST", secretPath, secret, nil)
+	case !bytes.Equal(haveSecret.Data[authKeySecretKey], authKey):
+		err = op.kc.Do(ctx, "PUT", secretPath+"/"+name, secret, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("proxy %s secret: %w", name, err)
+	}
+
+	deploy := p.deploymentManifest(op.ns, op.image, authKey)
+	meta, ok := haveDeploy[name]
+	switch {
+	case !ok:
+		op.logf("creating proxy %s for %s %s/%s as %q", name, p.ParentKind, p.ParentNS, p.ParentName, p.Hostname)
+		err = op.kc.Do(ctx, "POST", deployPath, deploy, nil)
+	case meta.Annotations[annotationConfig] != p.configHash(op.image, authKey):
+		op.logf("updating proxy %s", name)
+		deploy["metadata"].(map[string]interface{})["resourceVersion"] = meta.ResourceVersion
+		err = op.kc.Do(ctx, "PUT", deployPath+"/"+name, deploy, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("proxy %s: %w", name, err)
+	}
+	return nil
+}
+
+// ensureEgressService creates or updates the ClusterIP Service in
+// front of the egress proxy p, and points p's parent Service at it.
+func (op *operator) ensureEgressService(ctx context.Context, p proxy, have *kube.Service, svcs []kube.Service) error {
+	name := p.name()
+	_, _, svcPath, _ := op.proxyPaths()
+	var err error
+	switch {
+	case have == nil:
+		err = op.kc.Do(ctx, "POST", svcPath, p.serviceManifest(op.ns), nil)
+	case !samePorts(have.Spec.Ports, p.Ports):
+		patch := map[string]interface{}{"spec": map[string]interface{}{"ports": p.Ports}}
+		err = op.kc.Patch(ctx, svcPath+"/"+name, patch, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("proxy %s service: %w", name, err)
+	}
+
+	externalName := name + "." + op.ns + ".svc." + op.clusterDomain
+	for _, svc := range svcs {
+		if svc.Metadata.Namespace != p.ParentNS || svc.Metadata.Name != p.ParentName {
+			continue
+		}
+		if svc.Spec.ExternalName == externalName {
+			return nil
+		}
+		op.logf("pointing svc %s/%s at %s", p.ParentNS, p.ParentName, externalName)
+		patch := map[string]interface{}{"spec": map[string]interface{}{"externalName": externalName}}
+		if err := op.kc.Patch(ctx, "/api/v1/namespaces/"+p.ParentNS+"/services/"+p.ParentName, patch, nil); err != nil {
+			return fmt.Errorf("svc %s/%s: %w", p.ParentNS, p.ParentName, err)
+		}
+	}
+	return nil
+}
+
+// ensureGroupConfig creates or updates the ConfigMap of the group
+// proxy p's mappings. The proxy picks up changes to it by itself.
+func (op *operator) ensureGroupConfig(ctx context.Context, p proxy, have *kube.ConfigMap) error {
+	name := p.name()
+	_, _, _, cmPath := op.proxyPaths()
+	cm := p.configMapManifest(op.ns)
+	var err error
+	switch {
+	case have == nil:
+		err = op.kc.Do(ctx, "POST", cmPath, cm, nil)
+	case have.Data[mappingsKey] != cm.Data[mappingsKey]:
+		op.logf("updating proxy %s mappings", name)
+		cm.Metadata.ResourceVersion = have.Metadata.ResourceVersion
+		err = op.kc.Do(ctx, "PUT", cmPath+"/"+name, cm, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("proxy %s configmap: %w", name, err)
+	}
+	return nil
+}
+
+// samePorts reports whether a and b have the same ports, protocols
+// and port names, in order.
+func samePorts(a, b []kube.ServicePort) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (op *operator) deleteIfExists(ctx context.Context, path string) error {
+	err := op.kc.Do(ctx, "DELETE", path, nil, nil)
+	if kube.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,531 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"tailscale.com/kube"
+)
+
+func TestProxyName(t *testing.T) {
+	p := proxy{ParentKind: "svc", ParentNS: "default", ParentName: "web"}
+	if got, want := p.name(), "ts-svc-default-web"; got != want {
+		t.Errorf("name = %q; want %q", got, want)
+	}
+	p.ParentName = "a." + strings.Repeat("x", 80)
+	if got := p.name(); len(got) > maxKubeNameLength || strings.Contains(got, ".") {
+		t.Errorf("long name = %q; want at most %d characters without dots", got, maxKubeNameLength)
+	}
+}
+
+func TestDesiredProxies(t *testing.T) {
+	svc := func(ns, name, ip string, ann map[string]string) kube.Service {
+		return kube.Service{
+			Metadata: kube.ObjectMeta{Namespace: ns, Name: name, Annotations: ann},
+			Spec:     kube.ServiceSpec{ClusterIP: ip},
+		}
+	}
+	expose := map[string]string{annotationExpose: "true"}
+	svcs := []kube.Service{
+		svc("default", "web", "10.0.0.1", expose),
+		svc("default", "db", "10.0.0.2", map[string]string{annotationExpose: "true", annotationHostname: "database"}),
+		svc("default", "headless", "None", expose),
+		svc("default", "private", "10.0.0.3", nil),
+		{
+			Metadata: kube.ObjectMeta{Namespace: "default", Name: "pg", Annotations: map[string]string{annotationTailnetIP: "100.64.0.5"}},
+			Spec: kube.ServiceSpec{
+				Type:  "ExternalName",
+				Ports: []kube.ServicePort{{Port: 5432}},
+			},
+		},
+		{
+			Metadata: kube.ObjectMeta{Namespace: "default", Name: "notts", Annotations: map[string]string{annotationTailnetIP: "10.1.2.3"}},
+			Spec: kube.ServiceSpec{
+				Type:  "ExternalName",
+				Ports: []kube.ServicePort{{Port: 80}},
+			},
+		},
+	}
+	ings := []kube.Ingress{{
+		Metadata: kube.ObjectMeta{Namespace: "default", Name: "front", Annotations: expose},
+		Spec: kube.IngressSpec{DefaultBackend: &kube.IngressBackend{
+			Service: &kube.IngressServiceBackend{Name: "private"},
+		}},
+	}}
+
+	svcs = append(svcs, svc("other", "secret", "10.0.1.1", nil))
+
+	cms := []kube.ConfigMap{{
+		Metadata: kube.ObjectMeta{Namespace: "default", Name: "apps"},
+		Data: map[string]string{
+			"80":   "web",
+			"5432": "default/db:6432",
+			"http": "web",
+			"22":   "missing",
+			"443":  "other/secret",
+		},
+	}, {
+		Metadata: kube.ObjectMeta{Namespace: "tailscale", Name: "shared"},
+		Data: map[string]string{
+			"443": "other/secret",
+		},
+	}}
+
+	got, _ := desiredProxies(svcs, ings, cms, nil, new(exposurePolicy), "tailscale", t.Logf)
+	want := map[string]string{ // name => hostname@destIP
+		"ts-svc-default-web":        "default-web@10.0.0.1",
+		"ts-svc-default-db":         "database@10.0.0.2",
+		"ts-ingress-default-front":  "default-front-ingress@10.0.0.3",
+		"ts-egress-default-pg":      "default-pg-egress@100.64.0.5",
+		"ts-group-default-apps":     "default-apps@",
+		"ts-group-tailscale-shared": "tailscale-shared@",
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %d proxies %v; want %d", len(got), sortedNames(got), len(want))
+	}
+	for name, hd := range want {
+		p, ok := got[name]
+		if !ok {
+			t.Errorf("missing proxy %s", name)
+			continue
+		}
+		if g := p.Hostname + "@" + p.DestIP; g != hd {
+			t.Errorf("proxy %s = %s; want %s", name, g, hd)
+		}
+	}
+	if ports := got["ts-egress-default-pg"].Ports; len(ports) != 1 || ports[0].Protocol != "TCP" {
+		t.Errorf("egress ports = %+v; want one TCP port", ports)
+	}
+	if got, want := got["ts-group-default-apps"].mappingsFile(), "80 10.0.0.1 80\n5432 10.0.0.2 6432\n"; got != want {
+		t.Errorf("group mappings = %q; want %q", got, want)
+	}
+	if got, want := got["ts-group-tailscale-shared"].mappingsFile(), "443 10.0.1.1 443\n"; got != want {
+		t.Errorf("proxy namespace group mappings = %q; want %q", got, want)
+	}
+}
+
+// fakeKube is a fake Kubernetes API server holding objects by path.
+type fakeKube struct {
+	mu      sync.Mutex
+	objects map[string]json.RawMessage // "/api/v1/namespaces/ns/secrets/name" => object
+}
+
+func (k *fakeKube) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	path := r.URL.Path
+	switch r.Method {
+	case "GET":
+		if obj, ok := k.objects[path]; ok {
+			w.Write(obj)
+			return
+		}
+		if !listResources[path[strings.LastIndexByte(path, '/')+1:]] {
+			http.Error(w, `{"message":"not found"}`, http.StatusNotFound)
+			return
+		}
+		// A list of the objects directly under path, or for a
+		// cluster-wide list, under it in any namespace.
+		sel := r.URL.Query().Get("labelSelector") // "key=value" or empty
+		var names []string
+		for p := range k.objects {
+			names = append(names, p)
+		}
+		sort.Strings(names)
+		items := []json.RawMessage{}
+		for _, p := range names {
+			if !matchesList(path, p) {
+				continue
+			}
+			var obj struct {
+				Metadata kube.ObjectMeta `json:"metadata"`
+			}
+			json.Unmarshal(k.objects[p], &obj)
+			if i := strings.IndexByte(sel, '='); i != -1 && obj.Metadata.Labels[sel[:i]] != sel[i+1:] {
+				continue
+			}
+			items = append(items, k.objects[p])
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+	case "POST", "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		var obj struct {
+			Metadata kube.ObjectMeta `json:"metadata"`
+		}
+		json.Unmarshal(body, &obj)
+		if r.Method == "POST" {
+			path += "/" + obj.Metadata.Name
+		}
+		k.objects[path] = body
+	case "PATCH":
+		// A patch of the status subresource patches the object.
+		path = strings.TrimSuffix(path, "/status")
+		old, ok := k.objects[path]
+		if !ok {
+			http.Error(w, `{"message":"not found"}`, http.StatusNotFound)
+			return
+		}
+		var o, patch map[string]interface{}
+		json.Unmarshal(old, &o)
+		json.NewDecoder(r.Body).Decode(&patch)
+		mergePatch(o, patch)
+		k.objects[path], _ = json.Marshal(o)
+	case "DELETE":
+		if _, ok := k.objects[path]; !ok {
+			http.Error(w, `{"message":"not found"}`, http.StatusNotFound)
+			return
+		}
+		delete(k.objects, path)
+	}
+}
+
+// mergePatch applies the JSON merge patch patch to o.
+func mergePatch(o, patch map[string]interface{}) {
+	for k, v := range patch {
+		pm, ok := v.(map[string]interface{})
+		om, ok2 := o[k].(map[string]interface{})
+		switch {
+		case v == nil:
+			delete(o, k)
+		case ok && ok2:
+			mergePatch(om, pm)
+		default:
+			o[k] = v
+		}
+	}
+}
+
+// listResources are the kinds of objects the fake serves lists of.
+var listResources = map[string]bool{
+	"services":         true,
+	"ingresses":        true,
+	"secrets":          true,
+	"deployments":      true,
+	"configmaps":       true,
+	"tailnetexposures": true,
+}
+
+// matchesList reports whether the object at path p is in the list at
+// listPath, such as "/api/v1/services" for
+// "/api/v1/namespaces/default/services/web".
+func matchesList(listPath, p string) bool {
+	i := strings.LastIndexByte(p, '/')
+	dir := p[:i]
+	if dir == listPath {
+		return true
+	}
+	// Cluster-wide list.
+	base := listPath[strings.LastIndexByte(listPath, '/'):]
+	prefix := listPath[:strings.LastIndexByte(listPath, '/')] + "/namespaces/"
+	return strings.HasPrefix(dir, prefix) && strings.HasSuffix(dir, base) && strings.Count(dir[len(prefix):], "/") == 1
+}
+
+func (k *fakeKube) put(path string, obj interface{}) {
+	j, _ := json.Marshal(obj)
+	k.objects[path] = j
+}
+
+func (k *fakeKube) paths(prefix string) []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var ret []string
+	for p := range k.objects {
+		if strings.HasPrefix(p, prefix) {
+			ret = append(ret, strings.TrimPrefix(p, prefix))
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func TestReconcile(t *testing.T) {
+	fk := &fakeKube{objects: map[string]json.RawMessage{}}
+	fk.put("/api/v1/namespaces/tailscale/secrets/tailscale-operator-authkey", kube.Secret{
+		Metadata: kube.ObjectMeta{Name: "tailscale-operator-authkey"},
+		Data:     map[string][]byte{"authkey": []byte("tskey-123")},
+	})
+	fk.put("/api/v1/namespaces/default/services/web", kube.Service{
+		Metadata: kube.ObjectMeta{Namespace: "default", Name: "web", Annotations: map[string]string{annotationExpose: "true"}},
+		Spec:     kube.ServiceSpec{ClusterIP: "10.0.0.1"},
+	})
+	ts := httptest.NewServer(fk)
+	defer ts.Close()
+
+	op := &operator{
+		kc:            kube.NewForTest(ts.URL, "tailscale"),
+		logf:          t.Logf,
+		ns:            "tailscale",
+		image:         "tailscale/tailscale:test",
+		authKeySecret: "tailscale-operator-authkey",
+	}
+	ctx := context.Background()
+	if err := op.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(fk.paths("/apis/apps/v1/namespaces/tailscale/deployments/"), ","), "ts-svc-default-web"; got != want {
+		t.Errorf("deployments = %q; want %q", got, want)
+	}
+	if got, want := strings.Join(fk.paths("/api/v1/namespaces/tailscale/secrets/"), ","), "tailscale-operator-authkey,ts-svc-default-web"; got != want {
+		t.Errorf("secrets = %q; want %q", got, want)
+	}
+
+	// Deleting the Service deletes its proxy.
+	fk.mu.Lock()
+	delete(fk.objects, "/api/v1/namespaces/default/services/web")
+	fk.mu.Unlock()
+	if err := op.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := fk.paths("/apis/apps/v1/namespaces/tailscale/deployments/"); len(got) != 0 {
+		t.Errorf("deployments after delete = %q; want none", got)
+	}
+	if got, want := strings.Join(fk.paths("/api/v1/namespaces/tailscale/secrets/"), ","), "tailscale-operator-authkey"; got != want {
+		t.Errorf("secrets after delete = %q; want %q", got, want)
+	}
+}
+
+func TestReconcileEgress(t *testing.T) {
+	fk := &fakeKube{objects: map[string]json.RawMessage{}}
+	fk.put("/api/v1/namespaces/tailscale/secrets/tailscale-operator-authkey", kube.Secret{
+		Metadata: kube.ObjectMeta{Name: "tailscale-operator-authkey"},
+		Data:     map[string][]byte{"authkey": []byte("tskey-123")},
+	})
+	fk.put("/api/v1/namespaces/default/services/pg", kube.Service{
+		Metadata: kube.ObjectMeta{Namespace: "default", Name: "pg", Annotations: map[string]string{annotationTailnetIP: "100.64.0.5"}},
+		Spec: kube.ServiceSpec{
+			Type:         "ExternalName",
+			ExternalName: "placeholder",
+			Ports:        []kube.ServicePort{{Name: "pg", Protocol: "TCP", Port: 5432}},
+		},
+	})
+	ts := httptest.NewServer(fk)
+	defer ts.Close()
+
+	op := &operator{
+		kc:            kube.NewForTest(ts.URL, "tailscale"),
+		logf:          t.Logf,
+		ns:            "tailscale",
+		image:         "tailscale/tailscale:test",
+		authKeySecret: "tailscale-operator-authkey",
+		clusterDomain: "cluster.local",
+	}
+	ctx := context.Background()
+	if err := op.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(fk.paths("/apis/apps/v1/namespaces/tailscale/deployments/"), ","), "ts-egress-default-pg"; got != want {
+		t.Errorf("deployments = %q; want %q", got, want)
+	}
+	var proxySvc kube.Service
+	if err := op.kc.Do(ctx, "GET", "/api/v1/namespaces/tailscale/services/ts-egress-default-pg", nil, &proxySvc); err != nil {
+		t.Fatal(err)
+	}
+	if len(proxySvc.Spec.Ports) != 1 || proxySvc.Spec.Ports[0].Port != 5432 || proxySvc.Spec.Selector[labelProxy] != "ts-egress-default-pg" {
+		t.Errorf("proxy service spec = %+v", proxySvc.Spec)
+	}
+	var parent kube.Service
+	if err := op.kc.Do(ctx, "GET", "/api/v1/namespaces/default/services/pg", nil, &parent); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := parent.Spec.ExternalName, "ts-egress-default-pg.tailscale.svc.cluster.local"; got != want {
+		t.Errorf("externalName = %q; want %q", got, want)
+	}
+	if len(parent.Spec.Ports) != 1 {
+		t.Errorf("patching externalName lost the parent's ports: %+v", parent.Spec)
+	}
+
+	// Removing the annotation deletes the proxy and its Service.
+	parent.Metadata.Annotations = nil
+	fk.mu.Lock()
+	fk.put("/api/v1/namespaces/default/services/pg", parent)
+	fk.mu.Unlock()
+	if err := op.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := fk.paths("/apis/apps/v1/namespaces/tailscale/deployments/"); len(got) != 0 {
+		t.Errorf("deployments after delete = %q; want none", got)
+	}
+	if got := fk.paths("/api/v1/namespaces/tailscale/services/"); len(got) != 0 {
+		t.Errorf("proxy services after delete = %q; want none", got)
+	}
+}
+
+func TestReconcileGroup(t *testing.T) {
+	fk := &fakeKube{objects: map[string]json.RawMessage{}}
+	fk.put("/api/v1/namespaces/tailscale/secrets/tailscale-operator-authkey", kube.Secret{
+		Metadata: kube.ObjectMeta{Name: "tailscale-operator-authkey"},
+		Data:     map[string][]byte{"authkey": []byte("tskey-123")},
+	})
+	for name, ip := range map[string]string{"web": "10.0.0.1", "api": "10.0.0.2"} {
+		fk.put("/api/v1/namespaces/default/services/"+name, kube.Service{
+			Metadata: kube.ObjectMeta{Namespace: "default", Name: name},
+			Spec:     kube.ServiceSpec{ClusterIP: ip},
+		})
+	}
+	group := kube.ConfigMap{
+		Metadata: kube.ObjectMeta{Namespace: "default", Name: "apps", Labels: map[string]string{labelProxyGroup: "true"}},
+		Data:     map[string]string{"80": "web", "443": "api:8443"},
+	}
+	fk.put("/api/v1/namespaces/default/configmaps/apps", group)
+	ts := httptest.NewServer(fk)
+	defer ts.Close()
+
+	op := &operator{
+		kc:            kube.NewForTest(ts.URL, "tailscale"),
+		logf:          t.Logf,
+		ns:            "tailscale",
+		image:         "tailscale/tailscale:test",
+		authKeySecret: "tailscale-operator-authkey",
+	}
+	ctx := context.Background()
+	const (
+		deployPath = "/apis/apps/v1/namespaces/tailscale/deployments/ts-group-default-apps"
+		cmPath     = "/api/v1/namespaces/tailscale/configmaps/ts-group-default-apps"
+	)
+	mappings := func() string {
+		var cm kube.ConfigMap
+		if err := op.kc.Do(ctx, "GET", cmPath, nil, &cm); err != nil {
+			t.Fatal(err)
+		}
+		return cm.Data[mappingsKey]
+	}
+	if err := op.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mappings(), "80 10.0.0.1 80\n443 10.0.0.2 8443\n"; got != want {
+		t.Errorf("mappings = %q; want %q", got, want)
+	}
+	fk.mu.Lock()
+	deploy := string(fk.objects[deployPath])
+	fk.mu.Unlock()
+	if deploy == "" {
+		t.Fatal("no proxy deployment")
+	}
+
+	// Changing the mappings updates the proxy's ConfigMap but not
+	// its Deployment, so the proxy isn't restarted.
+	group.Data = map[string]string{"80": "web"}
+	fk.mu.Lock()
+	fk.put("/api/v1/namespaces/default/configmaps/apps", group)
+	fk.mu.Unlock()
+	if err := op.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mappings(), "80 10.0.0.1 80\n"; got != want {
+		t.Errorf("mappings after edit = %q; want %q", got, want)
+	}
+	fk.mu.Lock()
+	redeployed := string(fk.objects[deployPath]) != deploy
+	fk.mu.Unlock()
+	if redeployed {
+		t.Error("editing the mappings updated the proxy deployment")
+	}
+
+	// Deleting the group deletes the proxy and its ConfigMap.
+	fk.mu.Lock()
+	delete(fk.objects, "/api/v1/namespaces/default/configmaps/apps")
+	fk.mu.Unlock()
+	if err := op.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := fk.paths("/apis/apps/v1/namespaces/tailscale/deployments/"); len(got) != 0 {
+		t.Errorf("deployments after delete = %q; want none", got)
+	}
+	if got := fk.paths("/api/v1/namespaces/tailscale/configmaps/"); len(got) != 0 {
+		t.Errorf("configmaps after delete = %q; want none", got)
+	}
+}
+
+func TestReconcileExposure(t *testing.T) {
+	fk := &fakeKube{objects: map[string]json.RawMessage{}}
+	for name, key := range map[string]string{"tailscale-operator-authkey": "tskey-default", "payments-authkey": "tskey-payments"} {
+		fk.put("/api/v1/namespaces/tailscale/secrets/"+name, kube.Secret{
+			Metadata: kube.ObjectMeta{Name: name},
+			Data:     map[string][]byte{"authkey": []byte(key)},
+		})
+	}
+	fk.put("/api/v1/namespaces/payments/services/api", kube.Service{
+		Metadata: kube.ObjectMeta{Namespace: "payments", Name: "api"},
+		Spec:     kube.ServiceSpec{ClusterIP: "10.0.0.1"},
+	})
+	exposure := func(name string, tags ...string) {
+		var e tailnetExposure
+		e.Metadata = kube.ObjectMeta{Namespace: "payments", Name: name}
+		e.Spec.Service = "api"
+		e.Spec.Tags = tags
+		fk.put("/apis/tailscale.com/v1alpha1/namespaces/payments/tailnetexposures/"+name, e)
+	}
+	exposure("api", "tag:payments")
+	exposure("sneaky", "tag:admin")
+	ts := httptest.NewServer(fk)
+	defer ts.Close()
+
+	op := &operator{
+		kc:            kube.NewForTest(ts.URL, "tailscale"),
+		logf:          t.Logf,
+		ns:            "tailscale",
+		image:         "tailscale/tailscale:test",
+		authKeySecret: "tailscale-operator-authkey",
+		policy: &exposurePolicy{Namespaces: map[string]namespacePolicy{
+			"payments": {Tags: []string{"tag:payments"}, AuthKeySecret: "payments-authkey"},
+		}},
+	}
+	ctx := context.Background()
+	if err := op.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(fk.paths("/apis/apps/v1/namespaces/tailscale/deployments/"), ","), "ts-exposure-payments-api"; got != want {
+		t.Errorf("deployments = %q; want %q", got, want)
+	}
+	var secret kube.Secret
+	if err := op.kc.Do(ctx, "GET", "/api/v1/namespaces/tailscale/secrets/ts-exposure-payments-api", nil, &secret); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(secret.Data[authKeySecretKey]); got != "tskey-payments" {
+		t.Errorf("proxy auth key = %q; want the payments namespace's", got)
+	}
+	var deploy struct {
+		Spec struct {
+			Template struct {
+				Spec struct {
+					Containers []struct {
+						Env []struct{ Name, Value string }
+					}
+				}
+			}
+		}
+	}
+	if err := op.kc.Do(ctx, "GET", "/apis/apps/v1/namespaces/tailscale/deployments/ts-exposure-payments-api", nil, &deploy); err != nil {
+		t.Fatal(err)
+	}
+	var tags string
+	for _, env := range deploy.Spec.Template.Spec.Containers[0].Env {
+		if env.Name == "TS_TAGS" {
+			tags = env.Value
+		}
+	}
+	if tags != "tag:payments" {
+		t.Errorf("TS_TAGS = %q; want tag:payments", tags)
+	}
+
+	for name, want := range map[string]string{"api": "Accepted", "sneaky": "Rejected"} {
+		var e tailnetExposure
+		if err := op.kc.Do(ctx, "GET", "/apis/tailscale.com/v1alpha1/namespaces/payments/tailnetexposures/"+name, nil, &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Status.Phase != want {
+			t.Errorf("%s status = %+v; want phase %s", name, e.Status, want)
+		}
+	}
+}
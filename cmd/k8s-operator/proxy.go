@@ -0,0 +1,508 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"inet.af/netaddr"
+	"tailscale.com/kube"
+	"tailscale.com/net/tsaddr"
+)
+
+const (
+	// annotationExpose, set to "true" on a Service or Ingress, asks
+	// the operator to expose it on the tailnet.
+	annotationExpose = "tailscale.com/expose"
+	// annotationHostname optionally sets the tailnet hostname, and
+	// so the MagicDNS name, of an exposed Service or Ingress. It
+	// defaults to <namespace>-<name>.
+	annotationHostname = "tailscale.com/hostname"
+	// annotationTailnetIP, set on an ExternalName Service, asks the
+	// operator to make the Service forward to that tailnet IP.
+	annotationTailnetIP = "tailscale.com/tailnet-ip"
+	// labelProxyGroup, set to "true" on a ConfigMap, asks the
+	// operator to run one proxy exposing several Services, each on
+	// the tailnet port that the ConfigMap maps to it.
+	labelProxyGroup = "tailscale.com/proxy-group"
+	// annotationConfig, on a proxy Deployment, is a hash of the
+	// proxy's configuration, to tell when it needs updating.
+	annotationConfig = "tailscale.com/proxy-config"
+
+	labelManaged      = "tailscale.com/managed"
+	labelProxy        = "tailscale.com/proxy"
+	labelParentKind   = "tailscale.com/parent-resource-type"
+	labelParentNS     = "tailscale.com/parent-resource-ns"
+	labelParentName   = "tailscale.com/parent-resource"
+	managedSelector   = labelManaged + "=true"
+	groupSelector     = labelProxyGroup + "=true"
+	authKeySecretKey  = "authkey"
+	maxKubeNameLength = 63
+
+	// mappingsDir is where a group proxy's ConfigMap of port
+	// mappings is mounted, and mappingsKey the name of its file.
+	mappingsDir = "/etc/tailscale-proxy"
+	mappingsKey = "mappings"
+)
+
+// proxy is a tailscale node that forwards the traffic it gets from
+// the tailnet to a cluster IP or, for an egress proxy, the traffic it
+// gets from the cluster to a tailnet IP.
+type proxy struct {
+	ParentKind string // "svc", "ingress", "egress", "group" or "exposure"
+	ParentNS   string
+	ParentName string
+	Hostname   string // tailnet hostname
+	DestIP     string // cluster IP, or for egress tailnet IP, to forward to
+
+	// Ports are, for an egress proxy, the ports of its ClusterIP
+	// Service.
+	Ports []kube.ServicePort
+
+	// Mappings are, for a group proxy, what it forwards each port
+	// to, by port. They aren't part of the Deployment, so that they
+	// can change without restarting the proxy.
+	Mappings []portMapping
+
+	// Tags are the ACL tags the proxy's node requests.
+	Tags []string
+	// AuthKeySecret is the Secret in the proxy namespace whose auth
+	// key the proxy logs in with, if not the default one.
+	AuthKeySecret string
+}
+
+// portMapping is a port of a group proxy and where it forwards to.
+type portMapping struct {
+	Port     int
+	DestIP   string
+	DestPort int
+}
+
+func (p proxy) egress() bool { return p.ParentKind == "egress" }
+func (p proxy) group() bool  { return p.ParentKind == "group" }
+
+// name returns the name of the proxy's Deployment and Secret.
+func (p proxy) name() string {
+	// Ingress names can contain dots, which Deployment names can't.
+	name := strings.Join([]string{"ts", p.ParentKind, p.ParentNS, p.ParentName}, "-")
+	name = strings.ReplaceAll(name, ".", "-")
+	if len(name) <= maxKubeNameLength {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	return strings.TrimRight(name[:maxKubeNameLength-9], "-.") + "-" + hex.EncodeToString(sum[:4])
+}
+
+func (p proxy) labels() map[string]string {
+	return map[string]string{
+		labelManaged:    "true",
+		labelProxy:      p.name(),
+		labelParentKind: p.ParentKind,
+		labelParentNS:   p.ParentNS,
+		labelParentName: p.ParentName,
+	}
+}
+
+// configHash returns a hash of the proxy's configuration together
+// with the image and auth key it runs with.
+func (p proxy) configHash(image string, authKey []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%q %q %q %q %q %q %x", p.ParentKind, p.Hostname, p.DestIP, p.Tags, image, proxyScript, sha256.Sum256(authKey))
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// desiredProxies returns the proxies for the Services and Ingresses
+// annotated to be exposed, for the Services annotated with a tailnet
+// IP, for the proxy group ConfigMaps in cms, and for the
+// TailnetExposures in exps that pol allows, keyed by name. proxyNS is
+// the proxy namespace, whose group ConfigMaps may name Services in
+// other namespaces. Ingresses
+// are exposed by proxying to the Service of their default backend.
+// Objects that can't be proxied are reported with logf and skipped;
+// for TailnetExposures, rejected says why, by "ns/name".
+func desiredProxies(svcs []kube.Service, ings []kube.Ingress, cms []kube.ConfigMap, exps []tailnetExposure, pol *exposurePolicy, proxyNS string, logf func(string, ...interface{})) (ret map[string]proxy, rejected map[string]error) {
+	clusterIPs := make(map[string]string) // "ns/name" => cluster IP
+	for _, svc := range svcs {
+		clusterIPs[svc.Metadata.Namespace+"/"+svc.Metadata.Name] = svc.Spec.ClusterIP
+	}
+	ret = make(map[string]proxy)
+	add := func(kind string, meta kube.ObjectMeta, ip string) {
+		if meta.Annotations[annotationExpose] != "true" {
+			return
+		}
+		if ip == "" || ip == "None" {
+			logf("%s %s/%s: no cluster IP to proxy to; not exposing", kind, meta.Namespace, meta.Name)
+			return
+		}
+		p := proxy{
+			ParentKind: kind,
+			ParentNS:   meta.Namespace,
+			ParentName: meta.Name,
+			Hostname:   meta.Annotations[annotationHostname],
+			DestIP:     ip,
+		}
+		if p.Hostname == "" {
+			p.Hostname = meta.Namespace + "-" + meta.Name
+			if kind == "ingress" {
+				p.Hostname += "-ingress"
+			}
+		}
+		ret[p.name()] = p
+	}
+	for _, svc := range svcs {
+		add("svc", svc.Metadata, svc.Spec.ClusterIP)
+		if p, ok := egressProxy(svc, logf); ok {
+			ret[p.name()] = p
+		}
+	}
+	for _, ing := range ings {
+		var ip string
+		if b := ing.Spec.DefaultBackend; b != nil && b.Service != nil {
+			ip = clusterIPs[ing.Metadata.Namespace+"/"+b.Service.Name]
+		}
+		add("ingress", ing.Metadata, ip)
+	}
+	for _, cm := range cms {
+		if p, ok := groupProxy(cm, clusterIPs, proxyNS, logf); ok {
+			ret[p.name()] = p
+		}
+	}
+	rejected = make(map[string]error)
+	for _, e := range exps {
+		p, err := exposureProxy(e, clusterIPs, pol)
+		if err != nil {
+			logf("tailnetexposure %s/%s: %v; not exposing", e.Metadata.Namespace, e.Metadata.Name, err)
+			rejected[e.Metadata.Namespace+"/"+e.Metadata.Name] = err
+			continue
+		}
+		ret[p.name()] = p
+	}
+	return ret, rejected
+}
+
+// groupProxy returns the group proxy for the ConfigMap cm, whose data
+// maps tailnet ports to Services as "[namespace/]name[:port]". The
+// namespace defaults to the ConfigMap's, and the port to the tailnet
+// one. Only a ConfigMap in the proxy namespace proxyNS may name
+// another namespace: elsewhere, whoever can create a ConfigMap could
+// otherwise expose other namespaces' Services, which their owners
+// only expose with the annotation or a TailnetExposure. clusterIPs
+// are the cluster IPs of Services by "ns/name".
+func groupProxy(cm kube.ConfigMap, clusterIPs map[string]string, proxyNS string, logf func(string, ...interface{})) (p proxy, ok bool) {
+	meta := cm.Metadata
+	p = proxy{
+		ParentKind: "group",
+		ParentNS:   meta.Namespace,
+		ParentName: meta.Name,
+		Hostname:   meta.Annotations[annotationHostname],
+	}
+	if p.Hostname == "" {
+		p.Hostname = meta.Namespace + "-" + meta.Name
+	}
+	for key, target := range cm.Data {
+		port, err := strconv.Atoi(key)
+		if err != nil || port < 1 || port > 65535 {
+			logf("configmap %s/%s: %q is not a port; skipped", meta.Namespace, meta.Name, key)
+			continue
+		}
+		ns, name := meta.Namespace, strings.TrimSpace(target)
+		if i := strings.IndexByte(name, '/'); i != -1 {
+			ns, name = name[:i], name[i+1:]
+		}
+		destPort := port
+		if i := strings.LastIndexByte(name, ':'); i != -1 {
+			destPort, err = strconv.Atoi(name[i+1:])
+			if err != nil || destPort < 1 || destPort > 65535 {
+				logf("configmap %s/%s: bad port in %q; skipped", meta.Namespace, meta.Name, target)
+				continue
+			}
+			name = name[:i]
+		}
+		if ns != meta.Namespace && meta.Namespace != proxyNS {
+			logf("configmap %s/%s: port %d: svc %s/%s is in another namespace, which only proxy groups in %s may expose; skipped", meta.Namespace, meta.Name, port, ns, name, proxyNS)
+			continue
+		}
+		ip := clusterIPs[ns+"/"+name]
+		if ip == "" || ip == "None" {
+			logf("configmap %s/%s: port %d: no cluster IP for svc %s/%s; skipped", meta.Namespace, meta.Name, port, ns, name)
+			continue
+		}
+		p.Mappings = append(p.Mappings, portMapping{Port: port, DestIP: ip, DestPort: destPort})
+	}
+	if len(p.Mappings) == 0 {
+		logf("configmap %s/%s: no ports to expose", meta.Namespace, meta.Name)
+		return proxy{}, false
+	}
+	sort.Slice(p.Mappings, func(i, j int) bool { return p.Mappings[i].Port < p.Mappings[j].Port })
+	return p, true
+}
+
+// mappingsFile returns the contents of a group proxy's mappings file,
+// as read by proxyScript: a line of "port dest-ip dest-port" per
+// mapping.
+func (p proxy) mappingsFile() string {
+	var sb strings.Builder
+	for _, m := range p.Mappings {
+		fmt.Fprintf(&sb, "%d %s %d\n", m.Port, m.DestIP, m.DestPort)
+	}
+	return sb.String()
+}
+
+// egressProxy returns the egress proxy for svc, if it's annotated
+// with a tailnet IP.
+func egressProxy(svc kube.Service, logf func(string, ...interface{})) (p proxy, ok bool) {
+	meta := svc.Metadata
+	target := meta.Annotations[annotationTailnetIP]
+	if target == "" {
+		return proxy{}, false
+	}
+	ip, err := netaddr.ParseIP(target)
+	if err != nil || !tsaddr.IsTailscaleIP(ip) {
+		logf("svc %s/%s: %s %q is not a tailnet IP; not forwarding", meta.Namespace, meta.Name, annotationTailnetIP, target)
+		return proxy{}, false
+	}
+	if svc.Spec.Type != "ExternalName" {
+		logf("svc %s/%s: has %s but is type %q, not ExternalName; not forwarding", meta.Namespace, meta.Name, annotationTailnetIP, svc.Spec.Type)
+		return proxy{}, false
+	}
+	if len(svc.Spec.Ports) == 0 {
+		logf("svc %s/%s: no ports to forward", meta.Namespace, meta.Name)
+		return proxy{}, false
+	}
+	p = proxy{
+		ParentKind: "egress",
+		ParentNS:   meta.Namespace,
+		ParentName: meta.Name,
+		Hostname:   meta.Annotations[annotationHostname],
+		DestIP:     ip.String(),
+	}
+	if p.Hostname == "" {
+		p.Hostname = meta.Namespace + "-" + meta.Name + "-egress"
+	}
+	for _, sp := range svc.Spec.Ports {
+		if sp.Protocol == "" {
+			sp.Protocol = "TCP"
+		}
+		p.Ports = append(p.Ports, kube.ServicePort{Name: sp.Name, Protocol: sp.Protocol, Port: sp.Port})
+	}
+	return p, true
+}
+
+// proxyScript is the shell script the proxy container runs. It
+// starts an ephemeral tailscaled, so that the node leaves the tailnet
+// when the proxy is deleted, and forwards everything arriving over
+// the tailnet to the cluster IP or, for an egress proxy, everything
+// arriving from the cluster to the tailnet IP. A group proxy instead
+// forwards each port as its mappings file says. It watches the file's
+// directory for the kubelet's updates, with busybox's inotifyd or
+// else by polling, and replaces its rules with iptables-restore, in
+// one step, only when the file has changed.
+//
+// The container isn't privileged, so the script creates the TUN
+// device node, which container runtimes allow but don't provide.
+const proxyScript = `set -eu
+if [ ! -c /dev/net/tun ]; then
+	mkdir -p /dev/net
+	mknod /dev/net/tun c 10 200
+fi
+tailscaled --state=mem: --socket=/tmp/tailscaled.sock &
+PID=$!
+trap 'kill -TERM $PID' TERM INT
+tailscale --socket=/tmp/tailscaled.sock up --authkey="$TS_AUTHKEY" --hostname="$TS_HOSTNAME" --advertise-tags="$TS_TAGS"
+if [ "$TS_MODE" = group ]; then
+	# rules writes the iptables-restore input for the nat table's
+	# chains for family $1, 4 or 6. Declaring a chain flushes it, so
+	# restoring replaces the old rules at once.
+	rules() {
+		echo '*nat'
+		echo ':TS-DNAT - [0:0]'
+		echo ':TS-SNAT - [0:0]'
+		while read -r PORT DEST DPORT; do
+			case "$DEST" in
+			*:*) [ "$1" = 6 ] || continue; TO="[$DEST]:$DPORT" ;;
+			*) [ "$1" = 4 ] || continue; TO="$DEST:$DPORT" ;;
+			esac
+			for PROTO in tcp udp; do
+				echo "-A TS-DNAT -p $PROTO --dport $PORT -j DNAT --to-destination $TO"
+			done
+			echo "-A TS-SNAT -d $DEST -j MASQUERADE"
+		done <"$TS_MAPPINGS"
+		echo COMMIT
+	}
+	LAST=
+	apply() {
+		CUR=$(cat "$TS_MAPPINGS")
+		[ "$CUR" != "$LAST" ] || return 0
+		for F in 4 6; do
+			IPT=iptables
+			[ $F = 4 ] || IPT=ip6tables
+			command -v $IPT >/dev/null || continue
+			rules $F | $IPT-restore --noflush
+			$IPT -t nat -C PREROUTING -i tailscale0 -j TS-DNAT 2>/dev/null || $IPT -t nat -A PREROUTING -i tailscale0 -j TS-DNAT
+			$IPT -t nat -C POSTROUTING -j TS-SNAT 2>/dev/null || $IPT -t nat -A POSTROUTING -j TS-SNAT
+		done
+		LAST=$CUR
+	}
+	apply
+	# The kubelet updates a ConfigMap volume by swapping its ..data
+	# symlink, which shows up as an entry created or moved in.
+	if command -v inotifyd >/dev/null; then
+		inotifyd - "$(dirname "$TS_MAPPINGS")":ny | while read -r _; do
+			apply || echo "applying $TS_MAPPINGS failed; will retry on the next change" >&2
+		done &
+	else
+		while sleep 10; do
+			apply || echo "applying $TS_MAPPINGS failed; will retry" >&2
+		done &
+	fi
+	WATCH=$!
+	wait $PID
+	kill $WATCH 2>/dev/null || true
+	exit
+fi
+case "$TS_DEST_IP" in
+*:*) IPT=ip6tables ;;
+*) IPT=iptables ;;
+esac
+if [ "$TS_MODE" = egress ]; then
+	$IPT -t nat -I PREROUTING ! -i tailscale0 -j DNAT --to-destination "$TS_DEST_IP"
+else
+	$IPT -t nat -I PREROUTING -i tailscale0 -j DNAT --to-destination "$TS_DEST_IP"
+fi
+$IPT -t nat -I POSTROUTING -d "$TS_DEST_IP" -j MASQUERADE
+wait $PID
+`
+
+// secretManifest returns the Secret holding the proxy's auth key.
+func (p proxy) secretManifest(ns string, authKey []byte) *kube.Secret {
+	return &kube.Secret{
+		TypeMeta: kube.TypeMeta{Kind: "Secret", APIVersion: "v1"},
+		Metadata: kube.ObjectMeta{
+			Name:      p.name(),
+			Namespace: ns,
+			Labels:    p.labels(),
+		},
+		Data: map[string][]byte{authKeySecretKey: authKey},
+	}
+}
+
+// serviceManifest returns the ClusterIP Service in front of an egress
+// proxy.
+func (p proxy) serviceManifest(ns string) *kube.Service {
+	return &kube.Service{
+		TypeMeta: kube.TypeMeta{Kind: "Service", APIVersion: "v1"},
+		Metadata: kube.ObjectMeta{
+			Name:      p.name(),
+			Namespace: ns,
+			Labels:    p.labels(),
+		},
+		Spec: kube.ServiceSpec{
+			Type:     "ClusterIP",
+			Selector: map[string]string{labelProxy: p.name()},
+			Ports:    p.Ports,
+		},
+	}
+}
+
+// configMapManifest returns the ConfigMap of a group proxy's
+// mappings.
+func (p proxy) configMapManifest(ns string) *kube.ConfigMap {
+	return &kube.ConfigMap{
+		TypeMeta: kube.TypeMeta{Kind: "ConfigMap", APIVersion: "v1"},
+		Metadata: kube.ObjectMeta{
+			Name:      p.name(),
+			Namespace: ns,
+			Labels:    p.labels(),
+		},
+		Data: map[string]string{mappingsKey: p.mappingsFile()},
+	}
+}
+
+// deploymentManifest returns the proxy's Deployment.
+func (p proxy) deploymentManifest(ns, image string, authKey []byte) map[string]interface{} {
+	labels := p.labels()
+	mode := "ingress"
+	if p.egress() || p.group() {
+		mode = p.ParentKind
+	}
+	container := map[string]interface{}{
+		"name":    "tailscale",
+		"image":   image,
+		"command": []string{"/bin/sh", "-c", proxyScript},
+		"env": []interface{}{
+			map[string]interface{}{
+				"name": "TS_AUTHKEY",
+				"valueFrom": map[string]interface{}{
+					"secretKeyRef": map[string]string{"name": p.name(), "key": authKeySecretKey},
+				},
+			},
+			map[string]string{"name": "TS_HOSTNAME", "value": p.Hostname},
+			map[string]string{"name": "TS_DEST_IP", "value": p.DestIP},
+			map[string]string{"name": "TS_MODE", "value": mode},
+			map[string]string{"name": "TS_MAPPINGS", "value": mappingsDir + "/" + mappingsKey},
+			map[string]string{"name": "TS_TAGS", "value": strings.Join(p.Tags, ",")},
+		},
+		// Enough for the TUN device and iptables, and no more.
+		"securityContext": map[string]interface{}{
+			"privileged":               false,
+			"allowPrivilegeEscalation": false,
+			"capabilities": map[string]interface{}{
+				"drop": []string{"ALL"},
+				"add":  []string{"NET_ADMIN", "NET_RAW", "MKNOD"},
+			},
+		},
+	}
+	podSpec := map[string]interface{}{
+		"containers": []interface{}{container},
+	}
+	if p.group() {
+		container["volumeMounts"] = []interface{}{
+			map[string]string{"name": "mappings", "mountPath": mappingsDir},
+		}
+		podSpec["volumes"] = []interface{}{
+			map[string]interface{}{
+				"name":      "mappings",
+				"configMap": map[string]string{"name": p.name()},
+			},
+		}
+	}
+	return map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata": map[string]interface{}{
+			"name":        p.name(),
+			"namespace":   ns,
+			"labels":      labels,
+			"annotations": map[string]string{annotationConfig: p.configHash(image, authKey)},
+		},
+		"spec": map[string]interface{}{
+			"replicas": 1,
+			// Never run two proxies with the same hostname.
+			"strategy": map[string]interface{}{"type": "Recreate"},
+			"selector": map[string]interface{}{
+				"matchLabels": map[string]string{labelProxy: p.name()},
+			},
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{"labels": labels},
+				"spec":     podSpec,
+			},
+		},
+	}
+}
+
+// sortedNames returns the keys of m in order.
+func sortedNames(m map[string]proxy) []string {
+	var ret []string
+	for name := range m {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/atomicfile"
+	"tailscale.com/client/tailscale"
+)
+
+var certCmd = &ffcli.Command{
+	Name:       "cert",
+	ShortUsage: "cert [flags] <domain>",
+	ShortHelp:  "Get a TLS certificate for one of this node's DNS names",
+	LongHelp: strings.TrimSpace(`
+
+The 'tailscale cert' command gets a TLS certificate from Let's Encrypt
+for one of this node's MagicDNS names, such as
+"host.tailnet-name.beta.tailscale.net", and writes it and its
+private key to files.
+
+tailscaled keeps the certificate and renews it when it's due, so
+running the command again (for instance, from cron) is cheap and
+fetches the current certificate.
+
+`),
+	Exec: runCert,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("cert", flag.ExitOnError)
+		fs.StringVar(&certArgs.certFile, "cert-file", "", `output cert file; defaults to DOMAIN.crt; "-" for stdout`)
+		fs.StringVar(&certArgs.keyFile, "key-file", "", `output key file; defaults to DOMAIN.key; "-" for stdout`)
+		return fs
+	})(),
+}
+
+var certArgs struct {
+	certFile string
+	keyFile  string
+}
+
+func runCert(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tailscale cert [flags] <domain>")
+	}
+	domain := strings.TrimSuffix(args[0], ".")
+	if certArgs.certFile == "" {
+		certArgs.certFile = domain + ".crt"
+	}
+	if certArgs.keyFile == "" {
+		certArgs.keyFile = domain + ".key"
+	}
+	certPEM, keyPEM, err := tailscale.CertPair(ctx, domain)
+	if err != nil {
+		return err
+	}
+	if err := writeCertFile(certArgs.certFile, certPEM, 0644); err != nil {
+		return err
+	}
+	return writeCertFile(certArgs.keyFile, keyPEM, 0600)
+}
+
+func writeCertFile(name string, contents []byte, perm os.FileMode) error {
+	if name == "-" {
+		fmt.Printf("%s", contents)
+		return nil
+	}
+	if old, err := ioutil.ReadFile(name); err == nil && string(old) == string(contents) {
+		return nil
+	}
+	if err := atomicfile.WriteFile(name, contents, perm); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s\n", name)
+	return nil
+}
@@ -18,6 +18,7 @@ import (
 	"syscall"
 
 	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
 	"tailscale.com/ipn"
 	"tailscale.com/paths"
 	"tailscale.com/safesocket"
@@ -31,7 +32,7 @@ func ActLikeCLI() bool {
 		return false
 	}
 	switch os.Args[1] {
-	case "up", "down", "status", "netcheck", "ping", "version",
+	case "up", "down", "set", "status", "netcheck", "ping", "version", "file", "serve", "cert", "web", "update",
 		"debug",
 		"-V", "--version", "-h", "--help":
 		return true
@@ -47,6 +48,7 @@ func Run(args []string) error {
 
 	rootfs := flag.NewFlagSet("tailscale", flag.ExitOnError)
 	rootfs.StringVar(&rootArgs.socket, "socket", paths.DefaultTailscaledSocket(), "path to tailscaled's unix socket")
+	rootfs.StringVar(&rootArgs.tokenFile, "localapi-token-file", "", "path of tailscaled's -localapi-token-file, to use its token for full access to tailscaled as a regular user")
 
 	rootCmd := &ffcli.Command{
 		Name:       "tailscale",
@@ -59,10 +61,17 @@ change in the future.
 		Subcommands: []*ffcli.Command{
 			upCmd,
 			downCmd,
+			setCmd,
 			netcheckCmd,
 			statusCmd,
 			pingCmd,
 			versionCmd,
+			fileCmd,
+			serveCmd,
+			certCmd,
+			lockCmd,
+			webCmd,
+			updateCmd,
 		},
 		FlagSet: rootfs,
 		Exec:    func(context.Context, []string) error { return flag.ErrHelp },
@@ -76,6 +85,12 @@ change in the future.
 	if err := rootCmd.Parse(args); err != nil {
 		return err
 	}
+	tailscale.TailscaledSocket = rootArgs.socket
+	if rootArgs.tokenFile != "" {
+		if err := tailscale.ReadLocalAPIToken(rootArgs.tokenFile); err != nil {
+			return err
+		}
+	}
 
 	err := rootCmd.Run(context.Background())
 	if err == flag.ErrHelp {
@@ -90,7 +105,8 @@ func fatalf(format string, a ...interface{}) {
 }
 
 var rootArgs struct {
-	socket string
+	socket    string
+	tokenFile string
 }
 
 func connect(ctx context.Context) (net.Conn, *ipn.BackendClient, context.Context, context.CancelFunc) {
@@ -11,20 +11,34 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptrace"
 	"net/url"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/peterbourgon/ff/v2/ffcli"
+	"inet.af/netaddr"
+	"tailscale.com/client/tailscale"
 	"tailscale.com/derp/derphttp"
-	"tailscale.com/derp/derpmap"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/log/auditlog"
 	"tailscale.com/net/interfaces"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tshttpproxy"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/filter/acltest"
 	"tailscale.com/wgengine/monitor"
 )
 
@@ -38,6 +52,373 @@ var debugCmd = &ffcli.Command{
 		fs.StringVar(&debugArgs.derpCheck, "derp", "", "if non-empty, test a DERP ping via named region code")
 		return fs
 	})(),
+	Subcommands: []*ffcli.Command{
+		peerPathCmd,
+		captureCmd,
+		logLevelCmd,
+		logUploadCmd,
+		auditLogCmd,
+		aclTestCmd,
+		viaCmd,
+	},
+}
+
+var peerPathCmd = &ffcli.Command{
+	Name:       "peer-path",
+	ShortUsage: "debug peer-path [--json] <hostname-or-IP>",
+	ShortHelp:  "Show why a peer is or isn't reached directly",
+	LongHelp: strings.TrimSpace(`
+The 'tailscale debug peer-path' command shows the candidate endpoints
+of a peer, the results of the last discovery pings to them, the NAT
+types of both sides, and the likely reason traffic to the peer is
+relayed via DERP if it is.
+
+Endpoints are only probed while there's traffic to the peer, so run
+'tailscale ping' against it first.
+`),
+	Exec: runPeerPath,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("peer-path", flag.ExitOnError)
+		fs.BoolVar(&peerPathArgs.json, "json", false, "output in JSON format")
+		return fs
+	})(),
+}
+
+var captureCmd = &ffcli.Command{
+	Name:       "capture",
+	ShortUsage: "debug capture [-o <file>]",
+	ShortHelp:  "Capture tailnet traffic in pcapng format",
+	LongHelp: strings.TrimSpace(`
+The 'tailscale debug capture' command streams the decrypted packets
+passing through tailscaled's TUN device, in pcapng format, until
+interrupted. Each packet is captured before and, if accepted, after
+the packet filter; a packet comment says which.
+
+To watch live in Wireshark:
+
+    tailscale debug capture | wireshark -k -i -
+`),
+	Exec: runCapture,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("capture", flag.ExitOnError)
+		fs.StringVar(&captureArgs.outFile, "o", "-", "file to write the capture to, or - for stdout")
+		return fs
+	})(),
+}
+
+var viaCmd = &ffcli.Command{
+	Name:       "via",
+	ShortUsage: "debug via <site-id> <v4-cidr> | debug via <v6-route>",
+	ShortHelp:  "Convert between IPv4 subnets and 4via6 routes",
+	LongHelp: strings.TrimSpace(`
+The 'tailscale debug via' command converts an IPv4 subnet at a site to
+its 4via6 route, or a 4via6 route back. Sites advertising the same
+IPv4 subnet can all be reached by each advertising its 4via6 route
+with --advertise-routes instead, using a site ID from 0 to 65535 that
+is unique among them. For example:
+
+    tailscale debug via 7 10.1.1.0/24
+
+The subnet's hosts are then reachable at their 4via6 addresses, or
+with MagicDNS by names like 10-1-1-16-via-7.
+`),
+	Exec: runVia,
+}
+
+func runVia(ctx context.Context, args []string) error {
+	switch len(args) {
+	case 1:
+		ipp, err := netaddr.ParseIPPrefix(args[0])
+		if err != nil {
+			return err
+		}
+		site, ip, ok := tsaddr.UnmapVia(ipp.IP)
+		if !ok || ipp.Bits < 96 {
+			return fmt.Errorf("%v is not a 4via6 route", ipp)
+		}
+		fmt.Printf("site %d (0x%x), %v\n", site, site, netaddr.IPPrefix{IP: ip, Bits: ipp.Bits - 96})
+	case 2:
+		site, err := strconv.ParseUint(args[0], 0, 16)
+		if err != nil {
+			return fmt.Errorf("invalid site ID %q; want a number from 0 to 65535", args[0])
+		}
+		ipp, err := netaddr.ParseIPPrefix(args[1])
+		if err != nil {
+			return err
+		}
+		if ipp != ipp.Masked() {
+			return fmt.Errorf("%s has non-address bits set; expected %s", ipp, ipp.Masked())
+		}
+		via, err := tsaddr.MapVia(uint16(site), ipp)
+		if err != nil {
+			return err
+		}
+		fmt.Println(via)
+	default:
+		return errors.New("want <site-id> <v4-cidr> or <v6-route>")
+	}
+	return nil
+}
+
+var logLevelCmd = &ffcli.Command{
+	Name:       "log-level",
+	ShortUsage: "debug log-level [<component>=<level> ...]",
+	ShortHelp:  "Show or change tailscaled's log levels",
+	LongHelp: strings.TrimSpace(`
+The 'tailscale debug log-level' command shows the log level of each of
+tailscaled's logging components, or sets the levels of the components
+given. Levels are "off", "info" (the default) and "debug". For example,
+to log every packet filter decision:
+
+    tailscale debug log-level filter=debug
+
+Levels go back to "info" when tailscaled restarts.
+`),
+	Exec: runLogLevel,
+}
+
+func runLogLevel(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		levels, err := tailscale.LogLevels(ctx)
+		if err != nil {
+			return err
+		}
+		names := make([]string, 0, len(levels))
+		for name := range levels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%-12s %v\n", name, levels[name])
+		}
+		return nil
+	}
+	levels := make(map[string]logger.Level)
+	for _, arg := range args {
+		i := strings.IndexByte(arg, '=')
+		if i == -1 {
+			return fmt.Errorf("invalid argument %q; want <component>=<level>", arg)
+		}
+		l, err := logger.ParseLevel(arg[i+1:])
+		if err != nil {
+			return err
+		}
+		levels[arg[:i]] = l
+	}
+	return tailscale.SetLogLevels(ctx, levels)
+}
+
+var logUploadCmd = &ffcli.Command{
+	Name:       "log-upload",
+	ShortUsage: "debug log-upload [on|off]",
+	ShortHelp:  "Show or change whether tailscaled uploads its logs",
+	LongHelp: strings.TrimSpace(`
+The 'tailscale debug log-upload' command shows whether tailscaled
+uploads its logs to Tailscale's log service, or turns uploading off or
+on. With uploading off, logs only go to stderr and to the log file and
+syslog set with tailscaled's -log-file and -syslog flags. Tailscale
+can't help debug problems without the logs.
+
+Turning uploading off takes effect immediately; turning it back on
+takes effect when tailscaled restarts. The choice is remembered.
+`),
+	Exec: runLogUpload,
+}
+
+func runLogUpload(ctx context.Context, args []string) error {
+	var st *ipn.LogUploadState
+	var err error
+	switch {
+	case len(args) == 0:
+		st, err = tailscale.LogUpload(ctx)
+	case len(args) == 1 && args[0] == "on":
+		st, err = tailscale.SetLogUploadDisabled(ctx, false)
+	case len(args) == 1 && args[0] == "off":
+		st, err = tailscale.SetLogUploadDisabled(ctx, true)
+	default:
+		return fmt.Errorf("invalid arguments %q; want on or off", args)
+	}
+	if err != nil {
+		return err
+	}
+	switch {
+	case st.Uploading:
+		fmt.Println("uploading")
+	case st.Disabled:
+		fmt.Println("not uploading")
+	default:
+		// Either just turned back on, or off by tailscaled's
+		// -no-logs-no-support flag.
+		fmt.Println("not uploading until tailscaled restarts without -no-logs-no-support")
+	}
+	return nil
+}
+
+var auditLogCmd = &ffcli.Command{
+	Name:       "audit-log",
+	ShortUsage: "debug audit-log [-since N] [-json]",
+	ShortHelp:  "Show tailscaled's audit log of configuration and policy changes",
+	LongHelp: strings.TrimSpace(`
+The 'tailscale debug audit-log' command shows the log tailscaled keeps
+of preference changes, packet filter changes from the network map, and
+logins and logouts. Each entry carries a hash of the entry before it;
+the command checks the chain and fails if an entry was modified or
+removed.
+`),
+	Exec: runAuditLog,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("audit-log", flag.ExitOnError)
+		fs.Int64Var(&auditLogArgs.since, "since", 0, "only show entries after this sequence number")
+		fs.BoolVar(&auditLogArgs.json, "json", false, "output in JSON format")
+		return fs
+	})(),
+}
+
+var auditLogArgs struct {
+	since int64
+	json  bool
+}
+
+func runAuditLog(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unknown arguments")
+	}
+	ents, err := tailscale.AuditLog(ctx, auditLogArgs.since)
+	if err != nil {
+		return err
+	}
+	if auditLogArgs.json {
+		j, err := json.MarshalIndent(ents, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", j)
+	} else {
+		for _, e := range ents {
+			fmt.Printf("%d %s %-7s %s\n", e.Seq, e.Time.Local().Format(time.RFC3339), e.Kind, e.Message)
+		}
+	}
+	if err := auditlog.Verify(ents); err != nil {
+		return fmt.Errorf("audit log chain broken: %v", err)
+	}
+	return nil
+}
+
+var aclTestCmd = &ffcli.Command{
+	Name:       "acl-test",
+	ShortUsage: "debug acl-test [-rules file] <tests-file>",
+	ShortHelp:  "Check which sources can reach which destinations",
+	LongHelp: strings.TrimSpace(`
+The 'tailscale debug acl-test' command runs ACL tests, a JSON list such
+as
+
+  [{"src": "100.101.102.103", "accept": ["100.64.0.2:22"], "deny": ["100.64.0.2:80"]}]
+
+or a policy file's "tests" section, against this node's packet filter,
+which only covers traffic to this node and its subnet routes. With
+-rules, it runs them against the packet filter rules in that file
+instead, a JSON list of rules as sent by the control server, without
+needing tailscaled, such as in CI before rolling out a policy change.
+A tests-file of "-" means stdin. Sources and destinations are IP
+addresses.
+`),
+	Exec: runACLTest,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("acl-test", flag.ExitOnError)
+		fs.StringVar(&aclTestArgs.rules, "rules", "", "file of packet filter rules to test instead of the node's")
+		return fs
+	})(),
+}
+
+var aclTestArgs struct {
+	rules string
+}
+
+func runACLTest(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tailscale debug acl-test [-rules file] <tests-file>")
+	}
+	var testsJSON []byte
+	var err error
+	if args[0] == "-" {
+		testsJSON, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		testsJSON, err = ioutil.ReadFile(args[0])
+	}
+	if err != nil {
+		return err
+	}
+	var failures []acltest.Failure
+	if aclTestArgs.rules != "" {
+		failures, err = aclTestRules(aclTestArgs.rules, testsJSON)
+	} else {
+		failures, err = tailscale.ACLTest(ctx, testsJSON)
+	}
+	if err != nil {
+		return err
+	}
+	for _, f := range failures {
+		fmt.Printf("FAIL: %v\n", f)
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d ACL checks failed", len(failures))
+	}
+	fmt.Println("all ACL tests passed")
+	return nil
+}
+
+// aclTestRules runs the tests in testsJSON against the filter rules
+// in the file rulesFile.
+func aclTestRules(rulesFile string, testsJSON []byte) ([]acltest.Failure, error) {
+	b, err := ioutil.ReadFile(rulesFile)
+	if err != nil {
+		return nil, err
+	}
+	var rules []tailcfg.FilterRule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %v", rulesFile, err)
+	}
+	matches, err := filter.MatchesFromFilterRules(rules)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", rulesFile, err)
+	}
+	tests, err := acltest.Parse(testsJSON)
+	if err != nil {
+		return nil, err
+	}
+	return acltest.Run(matches, tests)
+}
+
+var captureArgs struct {
+	outFile string
+}
+
+func runCapture(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unknown arguments")
+	}
+	var out io.Writer = os.Stdout
+	if captureArgs.outFile != "-" {
+		f, err := os.Create(captureArgs.outFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	} else if fi, err := os.Stdout.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		return errors.New("refusing to write a binary capture to a terminal; redirect stdout or use -o")
+	}
+	rc, err := tailscale.StreamCapture(ctx)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(out, rc)
+	return err
+}
+
+var peerPathArgs struct {
+	json bool
 }
 
 var debugArgs struct {
@@ -62,6 +443,78 @@ func runDebug(ctx context.Context, args []string) error {
 	return errors.New("only --monitor is available at the moment")
 }
 
+func runPeerPath(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: debug peer-path <hostname-or-IP>")
+	}
+	hostOrIP := args[0]
+	var res net.Resolver
+	addrs, err := res.LookupHost(ctx, hostOrIP)
+	if err != nil {
+		return fmt.Errorf("error looking up IP of %q: %v", hostOrIP, err)
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("no IPs found for %q", hostOrIP)
+	}
+	ip, err := netaddr.ParseIP(addrs[0])
+	if err != nil {
+		return err
+	}
+	pp, err := tailscale.PeerPath(ctx, ip)
+	if err != nil {
+		return err
+	}
+	if peerPathArgs.json {
+		j, err := json.MarshalIndent(pp, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", j)
+		return nil
+	}
+	printPeerPath(os.Stdout, pp, time.Now())
+	return nil
+}
+
+func printPeerPath(w io.Writer, pp *ipnstate.PeerPath, now time.Time) {
+	f := func(format string, a ...interface{}) { fmt.Fprintf(w, format, a...) }
+	ago := func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return now.Sub(t).Round(time.Second).String() + " ago"
+	}
+	orUnknown := func(s string) string {
+		if s == "" {
+			return "unknown"
+		}
+		return s
+	}
+	f("peer %s (%s), home DERP region %s\n", pp.NodeName, pp.PublicKey.ShortString(), orUnknown(pp.Relay))
+	f("NAT: this node %s, peer %s\n", orUnknown(pp.SelfNAT), orUnknown(pp.PeerNAT))
+	if pp.CurAddr != "" {
+		f("direct path: %s (%v)\n", pp.CurAddr, time.Duration(pp.CurAddrLatencySeconds*float64(time.Second)).Round(time.Millisecond))
+	} else {
+		f("relayed via DERP: %s\n", pp.Reason)
+	}
+	if pp.PathMTU != 0 {
+		f("path MTU: %d\n", pp.PathMTU)
+	}
+	f("last full ping: %s\n", ago(pp.LastFullPing))
+	for _, e := range pp.Endpoints {
+		src := "netmap"
+		if e.Learned {
+			src = "learned"
+		}
+		f("  %-47s %-7s ping %s, ", e.Addr, src, ago(e.LastPing))
+		if e.LastPong.IsZero() {
+			f("no pong\n")
+			continue
+		}
+		f("pong %s in %v (saw us as %s)\n", ago(e.LastPong), time.Duration(e.LatencySeconds*float64(time.Second)).Round(time.Millisecond), e.PongSrc)
+	}
+}
+
 func runMonitor(ctx context.Context) error {
 	dump := func() {
 		st, err := interfaces.GetState()
@@ -134,7 +587,7 @@ func getURL(ctx context.Context, urlStr string) error {
 }
 
 func checkDerp(ctx context.Context, derpRegion string) error {
-	dmap := derpmap.Prod()
+	dmap := netcheckDERPMap(ctx)
 	getRegion := func() *tailcfg.DERPRegion {
 		for _, r := range dmap.Regions {
 			if r.RegionCode == derpRegion {
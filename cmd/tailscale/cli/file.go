@@ -0,0 +1,295 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"inet.af/netaddr"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+)
+
+var fileCmd = &ffcli.Command{
+	Name:       "file",
+	ShortUsage: "file <cp|get> ...",
+	ShortHelp:  "Send or receive files",
+	Subcommands: []*ffcli.Command{
+		fileCpCmd,
+		fileGetCmd,
+	},
+	Exec: func(context.Context, []string) error { return flag.ErrHelp },
+}
+
+var fileCpCmd = &ffcli.Command{
+	Name:       "cp",
+	ShortUsage: "file cp <files...> <target>:",
+	ShortHelp:  "Copy file(s) to a host",
+	LongHelp: strings.TrimSpace(`
+
+The 'tailscale file cp' command sends files to another of your
+nodes. The target may be given by hostname, MagicDNS name or
+Tailscale IP, and must be followed by a colon.
+
+If a previous transfer of a file to the same target was interrupted,
+the transfer resumes where it left off.
+
+`),
+	Exec: runCp,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("cp", flag.ExitOnError)
+		fs.BoolVar(&cpArgs.verbose, "verbose", false, "verbose output")
+		fs.BoolVar(&cpArgs.targets, "targets", false, "list possible file cp targets")
+		return fs
+	})(),
+}
+
+var cpArgs struct {
+	verbose bool
+	targets bool
+}
+
+func runCp(ctx context.Context, args []string) error {
+	if cpArgs.targets {
+		return runCpTargets(ctx, args)
+	}
+	if len(args) < 2 {
+		return errors.New("usage: tailscale file cp <files...> <target>:")
+	}
+	files, target := args[:len(args)-1], args[len(args)-1]
+	if !strings.HasSuffix(target, ":") {
+		return fmt.Errorf("final argument to 'tailscale file cp' must end in colon")
+	}
+	target = strings.TrimSuffix(target, ":")
+
+	fts, err := tailscale.FileTargets(ctx)
+	if err != nil {
+		return fmt.Errorf("getting file targets: %v", err)
+	}
+	ft, ip, err := findFileTarget(fts, target)
+	if err != nil {
+		return err
+	}
+	if cpArgs.verbose {
+		log.Printf("sending to %v (%v)", ft.Node.Name, ip)
+	}
+	for _, name := range files {
+		if err := sendFile(ctx, ip, name); err != nil {
+			return fmt.Errorf("sending %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func sendFile(ctx context.Context, ip netaddr.IP, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return errors.New("not a regular file")
+	}
+	baseName := filepath.Base(name)
+	pf, err := tailscale.PartialFile(ctx, ip, baseName)
+	if err != nil {
+		return err
+	}
+	offset, prefixSum := pf.Offset, ""
+	if offset > 0 && offset <= fi.Size() {
+		h := sha256.New()
+		if _, err := io.CopyN(h, f, offset); err != nil {
+			return err
+		}
+		prefixSum = hex.EncodeToString(h.Sum(nil))
+	}
+	if offset > fi.Size() || prefixSum != pf.Sha256 {
+		// Whatever the receiver has isn't a prefix of this file.
+		if cpArgs.verbose && offset > 0 {
+			log.Printf("%s: receiver's partial copy differs; starting over", baseName)
+		}
+		offset, prefixSum = 0, ""
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if offset > 0 && cpArgs.verbose {
+		log.Printf("%s: resuming at byte %d of %d", baseName, offset, fi.Size())
+	}
+	if err := tailscale.PushFile(ctx, ip, baseName, offset, prefixSum, fi.Size(), f); err != nil {
+		return err
+	}
+	if cpArgs.verbose {
+		log.Printf("sent %s (%d bytes)", baseName, fi.Size())
+	}
+	return nil
+}
+
+// findFileTarget returns the file target matching target, which is
+// either a Tailscale IP, a MagicDNS name (with or without the
+// trailing dot), or the first label of one or a machine hostname.
+func findFileTarget(fts []*ipn.FileTarget, target string) (*ipn.FileTarget, netaddr.IP, error) {
+	var match *ipn.FileTarget
+	for _, ft := range fts {
+		n := ft.Node
+		name := strings.TrimSuffix(n.Name, ".")
+		short := name
+		if i := strings.Index(short, "."); i != -1 {
+			short = short[:i]
+		}
+		ok := strings.EqualFold(target, name) ||
+			strings.EqualFold(target, short) ||
+			strings.EqualFold(target, n.Hostinfo.Hostname) ||
+			strings.HasPrefix(ft.PeerAPIURL, "http://"+target+":")
+		if !ok {
+			continue
+		}
+		if match != nil {
+			return nil, netaddr.IP{}, fmt.Errorf("target %q is ambiguous; use its Tailscale IP", target)
+		}
+		match = ft
+	}
+	if match == nil {
+		return nil, netaddr.IP{}, fmt.Errorf("unknown target %q; see 'tailscale file cp --targets'", target)
+	}
+	hostPort := strings.TrimPrefix(match.PeerAPIURL, "http://")
+	ipp, err := netaddr.ParseIPPort(hostPort)
+	if err != nil {
+		return nil, netaddr.IP{}, fmt.Errorf("bad peer API address %q: %v", hostPort, err)
+	}
+	return match, ipp.IP, nil
+}
+
+func runCpTargets(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("invalid arguments with --targets")
+	}
+	fts, err := tailscale.FileTargets(ctx)
+	if err != nil {
+		return err
+	}
+	for _, ft := range fts {
+		n := ft.Node
+		var ip string
+		if len(n.Addresses) > 0 {
+			ip = strings.TrimSuffix(n.Addresses[0].String(), "/32")
+		}
+		fmt.Printf("%s\t%s\t%s\n", ip, strings.TrimSuffix(n.Name, "."), n.Hostinfo.OS)
+	}
+	return nil
+}
+
+var fileGetCmd = &ffcli.Command{
+	Name:       "get",
+	ShortUsage: "file get [--wait] <target-directory>",
+	ShortHelp:  "Move files out of the Tailscale file inbox",
+	LongHelp: strings.TrimSpace(`
+
+The 'tailscale file get' command moves files that your other nodes
+sent to this one out of tailscaled's inbox and into the given
+directory. Existing files in the directory are not overwritten.
+
+`),
+	Exec: runFileGet,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("get", flag.ExitOnError)
+		fs.BoolVar(&getArgs.wait, "wait", false, "wait for a file to arrive if inbox is empty")
+		fs.BoolVar(&getArgs.verbose, "verbose", false, "verbose output")
+		return fs
+	})(),
+}
+
+var getArgs struct {
+	wait    bool
+	verbose bool
+}
+
+func runFileGet(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tailscale file get <target-directory>")
+	}
+	dir := args[0]
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return fmt.Errorf("%q is not a directory", dir)
+	}
+
+	var wfs []ipn.WaitingFile
+	for {
+		var err error
+		wfs, err = tailscale.WaitingFiles(ctx)
+		if err != nil {
+			return fmt.Errorf("getting waiting files: %v", err)
+		}
+		if len(wfs) > 0 || !getArgs.wait {
+			break
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	var errs int
+	for _, wf := range wfs {
+		if err := receiveFile(ctx, dir, wf); err != nil {
+			warnf("%s: %v", wf.Name, err)
+			errs++
+		}
+	}
+	if errs > 0 {
+		return fmt.Errorf("failed to receive %d of %d files", errs, len(wfs))
+	}
+	return nil
+}
+
+// receiveFile copies the waiting file wf into dir and then deletes it
+// from the inbox.
+func receiveFile(ctx context.Context, dir string, wf ipn.WaitingFile) error {
+	rc, size, err := tailscale.GetWaitingFile(ctx, wf.Name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	dst := filepath.Join(dir, wf.Name)
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return fmt.Errorf("refusing to overwrite %s", dst)
+	}
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, rc)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n != size {
+		err = fmt.Errorf("short read: got %d of %d bytes", n, size)
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	if getArgs.verbose {
+		log.Printf("wrote %s (%d bytes)", dst, n)
+	}
+	return tailscale.DeleteWaitingFile(ctx, wf.Name)
+}
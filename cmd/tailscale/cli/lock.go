@@ -0,0 +1,137 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tka"
+)
+
+var lockCmd = &ffcli.Command{
+	Name:       "lock",
+	ShortUsage: "lock <init|sign|status> ...",
+	ShortHelp:  "Manage network lock, which only trusts peers signed by your keys",
+	LongHelp: strings.TrimSpace(`
+
+With network lock, a node only connects to peers whose node keys are
+signed by one of a set of trusted signing keys, so that the control
+server can't add nodes to your tailnet on its own.
+
+Each node has a signing key of its own, shown by 'tailscale lock
+status'. Enable the lock on every node with 'tailscale lock init',
+giving the same keys, then sign each node's key from a node whose
+signing key is trusted with 'tailscale lock sign'.
+
+`),
+	Subcommands: []*ffcli.Command{
+		lockInitCmd,
+		lockSignCmd,
+		lockStatusCmd,
+	},
+	Exec: func(context.Context, []string) error { return flag.ErrHelp },
+}
+
+var lockInitCmd = &ffcli.Command{
+	Name:       "init",
+	ShortUsage: "lock init <tlpub:key>...",
+	ShortHelp:  "Enable network lock, trusting the given signing keys",
+	Exec:       runLockInit,
+}
+
+func runLockInit(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: tailscale lock init <tlpub:key>...")
+	}
+	var keys []tka.Key
+	for _, arg := range args {
+		k, err := tka.ParseKey(arg)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, k)
+	}
+	if err := tailscale.NetworkLockInit(ctx, keys); err != nil {
+		return err
+	}
+	fmt.Printf("Network lock enabled, trusting %d keys.\n", len(keys))
+	return nil
+}
+
+var lockSignCmd = &ffcli.Command{
+	Name:       "sign",
+	ShortUsage: "lock sign <nodekey:key>",
+	ShortHelp:  "Sign a node's key with this node's signing key",
+	Exec:       runLockSign,
+}
+
+func runLockSign(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tailscale lock sign <nodekey:key>")
+	}
+	var nk tailcfg.NodeKey
+	if err := nk.UnmarshalText([]byte(args[0])); err != nil {
+		return fmt.Errorf("invalid node key %q: %v", args[0], err)
+	}
+	sig, err := tailscale.NetworkLockSign(ctx, nk)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Signed %v; the signature was sent to the coordination server:\n%s\n", nk, sig)
+	return nil
+}
+
+var lockStatusCmd = &ffcli.Command{
+	Name:       "status",
+	ShortUsage: "lock status",
+	ShortHelp:  "Show the state of network lock",
+	Exec:       runLockStatus,
+}
+
+func runLockStatus(ctx context.Context, args []string) error {
+	st, err := tailscale.NetworkLockStatus(ctx)
+	if err != nil {
+		return err
+	}
+	if st.PublicKey != (tka.Key{}) {
+		fmt.Printf("This node's signing key: %v\n", st.PublicKey)
+	}
+	if !st.Enabled {
+		fmt.Println("Network lock is not enabled.")
+		return nil
+	}
+	if st.Error != "" {
+		fmt.Printf("Network lock state is unreadable, refusing all peers: %s\n", st.Error)
+		return nil
+	}
+	fmt.Printf("Network lock is enabled, at %s.\n", st.Head)
+	fmt.Println("Trusted signing keys:")
+	for _, k := range st.TrustedKeys {
+		mark := ""
+		if k == st.PublicKey {
+			mark = " (this node)"
+		}
+		fmt.Printf("\t%v%s\n", k, mark)
+	}
+	if st.NodeKeySigned {
+		fmt.Printf("This node's key %v is signed.\n", st.NodeKey)
+	} else {
+		fmt.Printf("This node's key %v is NOT signed; locked peers refuse it.\n", st.NodeKey)
+	}
+	if len(st.Rejected) > 0 {
+		fmt.Println("Refused peers:")
+		for _, p := range st.Rejected {
+			fmt.Printf("\t%s\t%v\t%s\n", p.Name, p.NodeKey, p.Reason)
+		}
+	}
+	return nil
+}
@@ -16,6 +16,7 @@ import (
 	"time"
 
 	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
 	"tailscale.com/derp/derpmap"
 	"tailscale.com/net/netcheck"
 	"tailscale.com/tailcfg"
@@ -55,7 +56,7 @@ func runNetcheck(ctx context.Context, args []string) error {
 		fmt.Fprintln(os.Stderr, "# Warning: this JSON format is not yet considered a stable interface")
 	}
 
-	dm := derpmap.Prod()
+	dm := netcheckDERPMap(ctx)
 	for {
 		t0 := time.Now()
 		report, err := c.GetReport(ctx, dm)
@@ -76,6 +77,16 @@ func runNetcheck(ctx context.Context, args []string) error {
 	}
 }
 
+// netcheckDERPMap returns the DERP map to measure: the one tailscaled
+// got from its control server, or if it's not running or has none,
+// Tailscale's default one.
+func netcheckDERPMap(ctx context.Context) *tailcfg.DERPMap {
+	if dm, err := tailscale.CurrentDERPMap(ctx); err == nil && dm != nil && len(dm.Regions) > 0 {
+		return dm
+	}
+	return derpmap.Prod()
+}
+
 func printReport(dm *tailcfg.DERPMap, report *netcheck.Report) error {
 	var j []byte
 	var err error
@@ -115,6 +126,9 @@ func printReport(dm *tailcfg.DERPMap, report *netcheck.Report) error {
 	fmt.Printf("\t* MappingVariesByDestIP: %v\n", report.MappingVariesByDestIP)
 	fmt.Printf("\t* HairPinning: %v\n", report.HairPinning)
 	fmt.Printf("\t* PortMapping: %v\n", portMapping(report))
+	if nat := report.NATType(); nat != "" {
+		fmt.Printf("\t* NAT: %v\n", nat)
+	}
 
 	// When DERP latency checking failed,
 	// magicsock will try to pick the DERP server that
@@ -0,0 +1,205 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+)
+
+var serveCmd = &ffcli.Command{
+	Name:       "serve",
+	ShortUsage: "serve [--set-path=/path] <port|url|file|dir|text:...>\n  tailscale serve --remove [--set-path=/path]\n  tailscale serve <status|reset>",
+	ShortHelp:  "Share a local server, file or directory with your tailnet",
+	LongHelp: strings.TrimSpace(`
+
+The 'tailscale serve' command publishes a local service over HTTPS at
+this node's MagicDNS name, reachable by the peers the ACLs allow to
+connect to port 443.
+
+The target can be:
+
+  3000                        a local HTTP server on port 3000
+  http://127.0.0.1:3000/api   a local HTTP(S) server at a URL
+  /srv/www                    a directory or file
+  text:hello                  a static text response
+
+By default the target is served at "/"; use --set-path to serve
+several targets under different paths. The configuration persists
+across tailscaled restarts until removed.
+
+`),
+	Exec: runServe,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("serve", flag.ExitOnError)
+		fs.StringVar(&serveArgs.setPath, "set-path", "/", "URL path at which to serve the target")
+		fs.BoolVar(&serveArgs.remove, "remove", false, "stop serving at --set-path")
+		return fs
+	})(),
+	Subcommands: []*ffcli.Command{
+		{
+			Name:       "status",
+			ShortUsage: "serve status",
+			ShortHelp:  "Show what is being served",
+			Exec:       runServeStatus,
+		},
+		{
+			Name:       "reset",
+			ShortUsage: "serve reset",
+			ShortHelp:  "Stop serving everything",
+			Exec:       runServeReset,
+		},
+	},
+}
+
+var serveArgs struct {
+	setPath string
+	remove  bool
+}
+
+func runServe(ctx context.Context, args []string) error {
+	mount, err := cleanMountPoint(serveArgs.setPath)
+	if err != nil {
+		return err
+	}
+	if serveArgs.remove {
+		if len(args) != 0 {
+			return errors.New("usage: tailscale serve --remove [--set-path=/path]")
+		}
+	} else if len(args) != 1 {
+		return flag.ErrHelp
+	}
+
+	sc, err := tailscale.GetServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if serveArgs.remove {
+		if _, ok := sc.Web[mount]; !ok {
+			return fmt.Errorf("nothing is served at %s", mount)
+		}
+		delete(sc.Web, mount)
+	} else {
+		h, err := parseServeTarget(args[0])
+		if err != nil {
+			return err
+		}
+		if sc.Web == nil {
+			sc.Web = map[string]*ipn.HTTPHandler{}
+		}
+		sc.Web[mount] = h
+	}
+	if err := tailscale.SetServeConfig(ctx, sc); err != nil {
+		return err
+	}
+	return runServeStatus(ctx, nil)
+}
+
+// cleanMountPoint returns the path p in the form used as a
+// ServeConfig mount point.
+func cleanMountPoint(p string) (string, error) {
+	if p == "" {
+		return "/", nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	if strings.Contains(p, "..") {
+		return "", fmt.Errorf("invalid path %q", p)
+	}
+	p = strings.TrimRight(p, "/")
+	if p == "" {
+		return "/", nil
+	}
+	return p, nil
+}
+
+// parseServeTarget parses the target argument of 'tailscale serve'.
+func parseServeTarget(target string) (*ipn.HTTPHandler, error) {
+	if port, err := strconv.ParseUint(target, 10, 16); err == nil && port != 0 {
+		return &ipn.HTTPHandler{Proxy: "http://127.0.0.1:" + target}, nil
+	}
+	if strings.HasPrefix(target, "text:") {
+		text := strings.TrimPrefix(target, "text:")
+		if text == "" {
+			return nil, errors.New("empty text")
+		}
+		return &ipn.HTTPHandler{Text: text}, nil
+	}
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid URL %q", target)
+		}
+		return &ipn.HTTPHandler{Proxy: target}, nil
+	}
+	abs, err := filepath.Abs(target)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(abs); err != nil {
+		return nil, err
+	}
+	return &ipn.HTTPHandler{Path: abs}, nil
+}
+
+func runServeStatus(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	sc, err := tailscale.GetServeConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if len(sc.Web) == 0 {
+		fmt.Println("Nothing is being served.")
+		return nil
+	}
+	base := "https://<this node's MagicDNS name>"
+	if st, err := tailscale.Status(ctx); err == nil && st.Self != nil && st.Self.DNSName != "" {
+		base = "https://" + strings.TrimSuffix(st.Self.DNSName, ".")
+	}
+	mounts := make([]string, 0, len(sc.Web))
+	for m := range sc.Web {
+		mounts = append(mounts, m)
+	}
+	sort.Strings(mounts)
+	for _, m := range mounts {
+		h := sc.Web[m]
+		var what string
+		switch {
+		case h.Proxy != "":
+			what = "proxy " + h.Proxy
+		case h.Path != "":
+			what = "path  " + h.Path
+		default:
+			what = fmt.Sprintf("text  %q", h.Text)
+		}
+		fmt.Printf("%s%s\t%s\n", base, strings.TrimSuffix(m, "/")+"/", what)
+	}
+	return nil
+}
+
+func runServeReset(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	return tailscale.SetServeConfig(ctx, &ipn.ServeConfig{})
+}
@@ -0,0 +1,243 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"inet.af/netaddr"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+)
+
+var setCmd = &ffcli.Command{
+	Name:       "set",
+	ShortUsage: "set [flags]",
+	ShortHelp:  "Change specified preferences",
+	LongHelp: strings.TrimSpace(`
+
+"tailscale set" changes the preferences given as flags, leaving all
+others as they are. Unlike "tailscale up", it never starts a login.
+
+`),
+	FlagSet: setFlagSet,
+	Exec:    runSet,
+}
+
+var setFlagSet = (func() *flag.FlagSet {
+	fs := flag.NewFlagSet("set", flag.ExitOnError)
+	fs.StringVar(&setArgs.exitNode, "exit-node", "", `exit node (IP or hostname) to route internet traffic through, "auto" to pick the fastest one, or empty to not use one`)
+	fs.BoolVar(&setArgs.exitNodeAllowLANAccess, "exit-node-allow-lan-access", false, "while using an exit node, keep reaching this machine's local networks (printers, NAS) directly rather than through it")
+	fs.BoolVar(&setArgs.acceptRoutes, "accept-routes", false, "accept routes advertised by other Tailscale nodes")
+	fs.StringVar(&setArgs.routeMetrics, "route-metrics", "", "metrics of accepted routes, lower to prefer them or higher to prefer other routes to the same subnets (comma-separated ROUTE=METRIC, e.g. 10.0.0.0/8=500), or empty for the default; on macOS, which has no metrics, any metric yields to other routes")
+	fs.BoolVar(&setArgs.allowRoutesOverLAN, "allow-routes-over-lan", false, "install accepted routes that overlap this machine's local networks as they are, rather than keeping the local networks reachable")
+	fs.BoolVar(&setArgs.acceptDNS, "accept-dns", true, "accept DNS configuration from the admin panel")
+	fs.BoolVar(&setArgs.shieldsUp, "shields-up", false, "don't allow incoming connections")
+	fs.StringVar(&setArgs.allowFrom, "allow-from", "", "with --shields-up, still allow incoming connections from these ACL tags or Tailscale IPs (comma-separated, e.g. tag:admin,100.101.102.103), or empty for any")
+	fs.StringVar(&setArgs.allowPort, "allow-port", "", "with --shields-up, still allow incoming connections to these ports (comma-separated, e.g. 22,443), or empty for any")
+	fs.StringVar(&setArgs.hostname, "hostname", "", "hostname to use instead of the one provided by the OS")
+	fs.BoolVar(&setArgs.autoUpdate, "auto-update", false, "have tailscaled update itself daily to the latest release of its track (see 'tailscale update')")
+	fs.StringVar(&setArgs.proxy, "proxy", "", "HTTP or HTTPS proxy URL (optionally with user:password@) for reaching the control and DERP servers, or empty to use the environment's")
+	if hasNetfilter(runtime.GOOS) {
+		fs.BoolVar(&setArgs.snat, "snat-subnet-routes", true, "source NAT traffic to local routes advertised with --advertise-routes; false keeps peers' Tailscale IPs as the source, which needs routes back to the tailnet in those subnets")
+	}
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		fs.BoolVar(&setArgs.runSSH, "ssh", false, "run an SSH server on port 22 of this node's Tailscale IPs")
+	}
+	return fs
+})()
+
+var setArgs struct {
+	exitNode               string
+	exitNodeAllowLANAccess bool
+	acceptRoutes           bool
+	routeMetrics           string
+	allowRoutesOverLAN     bool
+	acceptDNS              bool
+	shieldsUp              bool
+	allowFrom              string
+	allowPort              string
+	hostname               string
+	proxy                  string
+	runSSH                 bool
+	autoUpdate             bool
+	snat                   bool
+}
+
+func runSet(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("too many non-flag arguments: %q", args)
+	}
+	prefs, err := tailscale.GetPrefs(ctx)
+	if err != nil {
+		return err
+	}
+	changed := false
+	var visitErr error
+	setFlagSet.Visit(func(f *flag.Flag) {
+		changed = true
+		switch f.Name {
+		case "exit-node":
+			ip, auto, err := resolveExitNode(ctx, setArgs.exitNode)
+			if err != nil {
+				visitErr = err
+				return
+			}
+			prefs.ExitNodeIP, prefs.AutoExitNode = ip, auto
+		case "exit-node-allow-lan-access":
+			prefs.ExitNodeAllowLANAccess = setArgs.exitNodeAllowLANAccess
+		case "accept-routes":
+			prefs.RouteAll = setArgs.acceptRoutes
+		case "route-metrics":
+			metrics, err := parseRouteMetricsFlag(setArgs.routeMetrics)
+			if err != nil {
+				visitErr = fmt.Errorf("--route-metrics: %v", err)
+				return
+			}
+			prefs.RouteMetrics = metrics
+		case "allow-routes-over-lan":
+			prefs.AllowRoutesOverLAN = setArgs.allowRoutesOverLAN
+		case "accept-dns":
+			prefs.CorpDNS = setArgs.acceptDNS
+		case "shields-up":
+			prefs.ShieldsUp = setArgs.shieldsUp
+		case "allow-from":
+			var from []string
+			if setArgs.allowFrom != "" {
+				from = strings.Split(setArgs.allowFrom, ",")
+			}
+			for _, s := range from {
+				if err := ipn.CheckShieldsUpAllowFrom(s); err != nil {
+					visitErr = fmt.Errorf("--allow-from: %v", err)
+					return
+				}
+			}
+			prefs.ShieldsUpAllowFrom = from
+		case "allow-port":
+			ports, err := parsePortsFlag(setArgs.allowPort)
+			if err != nil {
+				visitErr = fmt.Errorf("--allow-port: %v", err)
+				return
+			}
+			prefs.ShieldsUpAllowPorts = ports
+		case "hostname":
+			if len(setArgs.hostname) > 256 {
+				visitErr = fmt.Errorf("hostname too long: %d bytes (max 256)", len(setArgs.hostname))
+				return
+			}
+			prefs.Hostname = setArgs.hostname
+		case "proxy":
+			if err := checkProxyURL(setArgs.proxy); err != nil {
+				visitErr = err
+				return
+			}
+			prefs.ProxyURL = setArgs.proxy
+		case "ssh":
+			prefs.RunSSH = setArgs.runSSH
+		case "auto-update":
+			prefs.AutoUpdate = setArgs.autoUpdate
+		case "snat-subnet-routes":
+			prefs.NoSNAT = !setArgs.snat
+			if prefs.NoSNAT && len(prefs.AdvertiseRoutes) > 0 {
+				warnNoSNAT()
+			}
+		}
+	})
+	if visitErr != nil {
+		return visitErr
+	}
+	if !changed {
+		return errors.New("no preferences given; see 'tailscale set --help'")
+	}
+	_, err = tailscale.SetPrefs(ctx, prefs)
+	return err
+}
+
+// parsePortsFlag parses a comma-separated list of ports.
+func parsePortsFlag(s string) ([]uint16, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var ports []uint16
+	for _, ps := range strings.Split(s, ",") {
+		port, err := strconv.ParseUint(ps, 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("invalid port %q", ps)
+		}
+		ports = append(ports, uint16(port))
+	}
+	return ports, nil
+}
+
+// parseRouteMetricsFlag parses a comma-separated list of
+// ROUTE=METRIC, the value of Prefs.RouteMetrics.
+func parseRouteMetricsFlag(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	metrics := strings.Split(s, ",")
+	for _, m := range metrics {
+		if _, _, err := ipn.ParseRouteMetric(m); err != nil {
+			return nil, err
+		}
+	}
+	return metrics, nil
+}
+
+// checkProxyURL reports an error if s is neither empty nor a valid
+// URL of an HTTP or HTTPS proxy.
+func checkProxyURL(s string) error {
+	if s == "" {
+		return nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("invalid proxy URL: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid proxy URL %q; want http://host:port or https://host:port", u.Redacted())
+	}
+	return nil
+}
+
+// resolveExitNode parses the value of an --exit-node flag: an IP
+// address or hostname of a peer, "auto", or empty for no exit node.
+// Hostnames are looked up in the status of the running tailscaled.
+func resolveExitNode(ctx context.Context, s string) (ip netaddr.IP, auto bool, err error) {
+	switch s {
+	case "":
+		return netaddr.IP{}, false, nil
+	case "auto":
+		return netaddr.IP{}, true, nil
+	}
+	if ip, err := netaddr.ParseIP(s); err == nil {
+		return ip, false, nil
+	}
+	st, err := tailscale.Status(ctx)
+	if err != nil {
+		return netaddr.IP{}, false, fmt.Errorf("looking up exit node %q: %v", s, err)
+	}
+	for _, ps := range st.Peer {
+		dnsName := strings.TrimSuffix(ps.DNSName, ".")
+		if !strings.EqualFold(ps.HostName, s) && !strings.EqualFold(dnsName, s) &&
+			!strings.EqualFold(strings.SplitN(dnsName, ".", 2)[0], s) {
+			continue
+		}
+		ip, err := netaddr.ParseIP(ps.TailAddr)
+		if err != nil {
+			return netaddr.IP{}, false, fmt.Errorf("exit node %q has no Tailscale IP", s)
+		}
+		return ip, false, nil
+	}
+	return netaddr.IP{}, false, fmt.Errorf("no peer named %q", s)
+}
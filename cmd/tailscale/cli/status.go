@@ -18,24 +18,27 @@ import (
 
 	"github.com/peterbourgon/ff/v2/ffcli"
 	"github.com/toqueteos/webbrowser"
+	"tailscale.com/client/tailscale"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/interfaces"
+	"tailscale.com/net/netcheck"
 )
 
 var statusCmd = &ffcli.Command{
 	Name:       "status",
-	ShortUsage: "status [-active] [-web] [-json]",
+	ShortUsage: "status [-active] [-web] [-json] [-health]",
 	ShortHelp:  "Show state of tailscaled and its connections",
 	Exec:       runStatus,
 	FlagSet: (func() *flag.FlagSet {
 		fs := flag.NewFlagSet("status", flag.ExitOnError)
-		fs.BoolVar(&statusArgs.json, "json", false, "output in JSON format (WARNING: format subject to change)")
+		fs.BoolVar(&statusArgs.json, "json", false, "output in JSON format (versioned schema; see ipnstate.StatusV1)")
 		fs.BoolVar(&statusArgs.web, "web", false, "run webserver with HTML showing status")
 		fs.BoolVar(&statusArgs.active, "active", false, "filter output to only peers with active sessions (not applicable to web mode)")
 		fs.BoolVar(&statusArgs.self, "self", true, "show status of local machine")
 		fs.StringVar(&statusArgs.listen, "listen", "127.0.0.1:8384", "listen address; use port 0 for automatic")
 		fs.BoolVar(&statusArgs.browser, "browser", true, "Open a browser in web mode")
+		fs.BoolVar(&statusArgs.health, "health", false, "only show the node's health, exiting with status 1 if it has problems")
 		return fs
 	})(),
 }
@@ -47,9 +50,13 @@ var statusArgs struct {
 	browser bool   // in web mode, whether to open browser
 	active  bool   // in CLI mode, filter output to only peers with active sessions
 	self    bool   // in CLI mode, show status of local machine
+	health  bool   // only show health
 }
 
 func runStatus(ctx context.Context, args []string) error {
+	if statusArgs.health {
+		return runHealth(ctx)
+	}
 	c, bc, ctx, cancel := connect(ctx)
 	defer cancel()
 
@@ -87,7 +94,7 @@ func runStatus(ctx context.Context, args []string) error {
 				}
 			}
 		}
-		j, err := json.MarshalIndent(st, "", "  ")
+		j, err := json.MarshalIndent(st.V1(), "", "  ")
 		if err != nil {
 			return err
 		}
@@ -131,6 +138,12 @@ func runStatus(ctx context.Context, args []string) error {
 		fmt.Println("Tailscale is stopped.")
 		os.Exit(1)
 	}
+	for _, msg := range st.Health {
+		warnf("%s", msg)
+	}
+	if msg := natExplanation(st.NAT); msg != "" {
+		fmt.Println(msg)
+	}
 
 	var buf bytes.Buffer
 	f := func(format string, a ...interface{}) { fmt.Fprintf(&buf, format, a...) }
@@ -155,12 +168,20 @@ func runStatus(ctx context.Context, args []string) error {
 			if i != 0 {
 				f(", ")
 			}
-			if addr == ps.CurAddr {
+			if addr == ps.CurAddr && ps.LAN {
+				f("*%s* (LAN)", addr)
+			} else if addr == ps.CurAddr {
 				f("*%s*", addr)
 			} else {
 				f("%s", addr)
 			}
 		}
+		if ps.DERPTxBytes != 0 || ps.DERPRxBytes != 0 {
+			f(" (relayed tx=%d rx=%d, tx=%d/s rx=%d/s)", ps.DERPTxBytes, ps.DERPRxBytes, ps.DERPTxRate, ps.DERPRxRate)
+		}
+		if ps.TxBytesDay != 0 || ps.RxBytesDay != 0 {
+			f(" (24h tx=%d rx=%d)", ps.TxBytesDay, ps.RxBytesDay)
+		}
 		f("\n")
 	}
 
@@ -182,6 +203,45 @@ func runStatus(ctx context.Context, args []string) error {
 	return nil
 }
 
+// natExplanation returns what the NAT type nat, as in Status.NAT,
+// means for the node's connections, or the empty string if it
+// doesn't keep them from being direct.
+func natExplanation(nat string) string {
+	switch nat {
+	case netcheck.NATUDPBlocked:
+		return "UDP is blocked on this network: you will always be relayed through DERP on it."
+	case netcheck.NATHard:
+		return "This network's NAT maps ports differently per destination: connections to peers behind such NATs too will be relayed through DERP."
+	}
+	return ""
+}
+
+// runHealth prints the node's health, exiting with status 1 if it has
+// problems.
+func runHealth(ctx context.Context) error {
+	st, err := tailscale.Health(ctx)
+	if err != nil {
+		return err
+	}
+	if statusArgs.json {
+		j, err := json.MarshalIndent(st, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", j)
+	} else if st.Healthy {
+		fmt.Println("healthy")
+	} else {
+		for _, msg := range st.Strings() {
+			fmt.Println(msg)
+		}
+	}
+	if !st.Healthy {
+		os.Exit(1)
+	}
+	return nil
+}
+
 // peerActive reports whether ps has recent activity.
 //
 // TODO: have the server report this bool instead.
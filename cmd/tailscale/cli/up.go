@@ -10,6 +10,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
@@ -17,12 +18,17 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/peterbourgon/ff/v2/ffcli"
 	"github.com/tailscale/wireguard-go/wgcfg"
 	"inet.af/netaddr"
 	"tailscale.com/ipn"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/flagtype"
+	"tailscale.com/util/qrcode"
 	"tailscale.com/version"
 	"tailscale.com/version/distro"
 	"tailscale.com/wgengine/router"
@@ -44,20 +50,45 @@ specify any flags, options are reset to their default.
 		upf := flag.NewFlagSet("up", flag.ExitOnError)
 		upf.StringVar(&upArgs.server, "login-server", "https://login.tailscale.com", "base URL of control server")
 		upf.BoolVar(&upArgs.acceptRoutes, "accept-routes", false, "accept routes advertised by other Tailscale nodes")
+		upf.StringVar(&upArgs.routeMetrics, "route-metrics", "", "metrics of accepted routes, lower to prefer them or higher to prefer other routes to the same subnets, such as another VPN's (comma-separated ROUTE=METRIC, covering the routes within ROUTE; e.g. 10.0.0.0/8=500); on macOS, which has no metrics, any metric yields to other routes")
+		upf.BoolVar(&upArgs.allowRoutesOverLAN, "allow-routes-over-lan", false, "install accepted routes that overlap this machine's local networks as they are, rather than keeping the local networks reachable")
 		upf.BoolVar(&upArgs.acceptDNS, "accept-dns", true, "accept DNS configuration from the admin panel")
 		upf.BoolVar(&upArgs.singleRoutes, "host-routes", true, "install host routes to other Tailscale nodes")
 		upf.BoolVar(&upArgs.shieldsUp, "shields-up", false, "don't allow incoming connections")
 		upf.BoolVar(&upArgs.forceReauth, "force-reauth", false, "force reauthentication")
+		upf.BoolVar(&upArgs.qr, "qr", false, "show a QR code of the login URL, to log in from a phone on devices without a browser")
+		upf.DurationVar(&upArgs.timeout, "timeout", 0, "give up if not logged in and connected within this long; 0 means wait forever")
 		upf.StringVar(&upArgs.advertiseTags, "advertise-tags", "", "ACL tags to request (comma-separated, e.g. eng,montreal,ssh)")
-		upf.StringVar(&upArgs.authKey, "authkey", "", "node authorization key")
+		upf.StringVar(&upArgs.hardening, "hardening", "", `local restrictions on incoming connections, on top of the ACLs: "server" (only from --hardening-admin-tags), "isolated" (none) or "none" (the default)`)
+		upf.StringVar(&upArgs.hardeningAdminTags, "hardening-admin-tags", "", `ACL tags of the nodes "--hardening=server" lets in (comma-separated, e.g. tag:admin)`)
+		upf.StringVar(&upArgs.authKey, "authkey", "", `node authorization key; if it begins with "file:", the path of a file containing it`)
 		upf.StringVar(&upArgs.hostname, "hostname", "", "hostname to use instead of the one provided by the OS")
+		upf.StringVar(&upArgs.exitNode, "exit-node", "", `exit node (IP or hostname) to route internet traffic through, or "auto" to pick the fastest one`)
+		upf.BoolVar(&upArgs.exitNodeAllowLANAccess, "exit-node-allow-lan-access", false, "with --exit-node, keep reaching this machine's local networks (printers, NAS) directly rather than through the exit node")
+		upf.Var(flagtype.PortValue(&upArgs.listenPort, 0), "port", "UDP port to listen on for WireGuard and peer-to-peer traffic, overriding tailscaled's --port; 0 means tailscaled's choice")
+		upf.BoolVar(&upArgs.privateEndpoints, "advertise-private-endpoints", true, "let peers see this machine's private LAN addresses, to connect to it directly on the same LAN")
+		upf.StringVar(&upArgs.noEndpointInterfaces, "hide-endpoint-interfaces", "", "network interfaces whose addresses aren't shown to peers (comma-separated, e.g. eth1,docker0)")
+		upf.StringVar(&upArgs.keepAlivePeers, "keepalive-peers", "", "Tailscale IPs of peers to keep the NAT path to open even when idle (comma-separated)")
+		upf.DurationVar(&upArgs.keepAliveInterval, "keepalive-interval", 0, "how often to send keepalives to --keepalive-peers; 0 means 25s")
+		upf.StringVar(&upArgs.relayOnlyPeers, "relay-only-peers", "", "Tailscale IPs of peers to only reach through DERP relays, never directly (comma-separated)")
+		upf.BoolVar(&upArgs.lowResource, "low-resource", false, "use less memory and CPU at some cost in throughput and debuggability, for routers and small boards")
+		upf.BoolVar(&upArgs.autoUpdate, "auto-update", false, "have tailscaled update itself daily to the latest release of its track")
+		upf.StringVar(&upArgs.proxy, "proxy", "", "HTTP or HTTPS proxy URL (optionally with user:password@) for reaching the control and DERP servers; default is from the environment")
 		if runtime.GOOS == "linux" || isBSD(runtime.GOOS) || version.OS() == "macOS" {
 			upf.StringVar(&upArgs.advertiseRoutes, "advertise-routes", "", "routes to advertise to other nodes (comma-separated, e.g. 10.0.0.0/8,192.168.0.0/24)")
+			upf.StringVar(&upArgs.advertiseRouteChecks, "advertise-route-checks", "", "reachability checks of --advertise-routes, which withdraw a route while it fails them (comma-separated ROUTE=CHECK, with CHECK ping:IP, tcp:IP:PORT or, on Linux, arp:IP; e.g. 10.0.0.0/24=tcp:10.0.0.1:22)")
 		}
-		if runtime.GOOS == "linux" {
-			upf.BoolVar(&upArgs.snat, "snat-subnet-routes", true, "source NAT traffic to local routes advertised with --advertise-routes")
+		if hasNetfilter(runtime.GOOS) {
+			upf.BoolVar(&upArgs.snat, "snat-subnet-routes", true, "source NAT traffic to local routes advertised with --advertise-routes; false keeps peers' Tailscale IPs as the source, which needs routes back to the tailnet in those subnets")
 			upf.StringVar(&upArgs.netfilterMode, "netfilter-mode", defaultNetfilterMode(), "netfilter mode (one of on, nodivert, off)")
 		}
+		if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+			upf.BoolVar(&upArgs.runSSH, "ssh", false, "run an SSH server on port 22 of this node's Tailscale IPs, permitting access per the ACLs to your other nodes")
+		}
+		if runtime.GOOS == "linux" || runtime.GOOS == "windows" {
+			upf.StringVar(&upArgs.splitTunnelApps, "split-tunnel-apps", "", "the only apps whose traffic uses Tailscale (comma-separated cgroup v2 paths on Linux, e.g. system.slice/backup.service, or executable paths on Windows, without an exit node or subnet routes)")
+			upf.BoolVar(&upArgs.splitTunnelExclude, "split-tunnel-exclude", false, "make --split-tunnel-apps the apps whose traffic doesn't use Tailscale instead")
+		}
 		return upf
 	})(),
 	Exec: runUp,
@@ -71,18 +102,43 @@ func defaultNetfilterMode() string {
 }
 
 var upArgs struct {
-	server          string
-	acceptRoutes    bool
-	acceptDNS       bool
-	singleRoutes    bool
-	shieldsUp       bool
-	forceReauth     bool
-	advertiseRoutes string
-	advertiseTags   string
-	snat            bool
-	netfilterMode   string
-	authKey         string
-	hostname        string
+	server                 string
+	acceptRoutes           bool
+	routeMetrics           string
+	allowRoutesOverLAN     bool
+	acceptDNS              bool
+	singleRoutes           bool
+	shieldsUp              bool
+	runSSH                 bool
+	forceReauth            bool
+	qr                     bool
+	timeout                time.Duration
+	advertiseRoutes        string
+	advertiseTags          string
+	snat                   bool
+	netfilterMode          string
+	authKey                string
+	hostname               string
+	exitNode               string
+	exitNodeAllowLANAccess bool
+	proxy                  string
+	listenPort             uint16
+	keepAlivePeers         string
+	keepAliveInterval      time.Duration
+	relayOnlyPeers         string
+	lowResource            bool
+	autoUpdate             bool
+
+	privateEndpoints     bool
+	noEndpointInterfaces string
+
+	hardening          string
+	hardeningAdminTags string
+
+	advertiseRouteChecks string
+
+	splitTunnelApps    string
+	splitTunnelExclude bool
 }
 
 // parseIPOrCIDR parses an IP address or a CIDR prefix. If the input
@@ -108,10 +164,60 @@ func parseIPOrCIDR(s string) (wgcfg.CIDR, bool) {
 	}
 }
 
+// parseIPsFlag parses the value s of the comma-separated list of IP
+// addresses flag name, exiting if any isn't one.
+func parseIPsFlag(name, s string) []netaddr.IP {
+	if s == "" {
+		return nil
+	}
+	var ips []netaddr.IP
+	for _, v := range strings.Split(s, ",") {
+		ip, err := netaddr.ParseIP(v)
+		if err != nil {
+			fatalf("--%s: %q is not an IP address", name, v)
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// resolveAuthKey returns the auth key given by the --authkey flag
+// value v, reading it from a file if v is of the form "file:path".
+// Keeping the key in a file keeps it out of the process list.
+func resolveAuthKey(v string) (string, error) {
+	if !strings.HasPrefix(v, "file:") {
+		return v, nil
+	}
+	path := strings.TrimPrefix(v, "file:")
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading auth key: %v", err)
+	}
+	key := strings.TrimSpace(string(b))
+	if key == "" {
+		return "", fmt.Errorf("auth key file %s is empty", path)
+	}
+	return key, nil
+}
+
 func isBSD(s string) bool {
 	return s == "dragonfly" || s == "freebsd" || s == "netbsd" || s == "openbsd"
 }
 
+// hasNetfilter reports whether tailscaled manages the firewall and
+// subnet route SNAT on OS s.
+func hasNetfilter(s string) bool {
+	return s == "linux" || s == "freebsd" || s == "openbsd"
+}
+
+// warnNoSNAT warns that with subnet route SNAT off, the advertised
+// subnets need a route back to the tailnet through this machine.
+func warnNoSNAT() {
+	warnf("--snat-subnet-routes=false keeps peers' Tailscale IPs as the source of their traffic to --advertise-routes.\n"+
+		"For replies to get back, hosts in those subnets need %v and %v routed via this machine.",
+		tsaddr.CGNATRange(), tsaddr.TailscaleULARange())
+}
+
 func warnf(format string, args ...interface{}) {
 	fmt.Printf("Warning: "+format+"\n", args...)
 }
@@ -179,6 +285,29 @@ func runUp(ctx context.Context, args []string) error {
 		checkIPForwarding()
 	}
 
+	var routeChecks []string
+	if upArgs.advertiseRouteChecks != "" {
+		routeChecks = strings.Split(upArgs.advertiseRouteChecks, ",")
+		for _, s := range routeChecks {
+			route, _, err := ipn.ParseRouteCheck(s)
+			if err != nil {
+				fatalf("--advertise-route-checks: %v", err)
+			}
+			found := false
+			for _, r := range routes {
+				found = found || r == route
+			}
+			if !found {
+				fatalf("--advertise-route-checks: %v is not in --advertise-routes", route)
+			}
+		}
+	}
+
+	routeMetrics, err := parseRouteMetricsFlag(upArgs.routeMetrics)
+	if err != nil {
+		fatalf("--route-metrics: %v", err)
+	}
+
 	var tags []string
 	if upArgs.advertiseTags != "" {
 		tags = strings.Split(upArgs.advertiseTags, ",")
@@ -190,34 +319,106 @@ func runUp(ctx context.Context, args []string) error {
 		}
 	}
 
+	if err := ipn.CheckHardeningProfile(upArgs.hardening); err != nil {
+		fatalf("--hardening: %v", err)
+	}
+	var adminTags []string
+	if upArgs.hardeningAdminTags != "" {
+		adminTags = strings.Split(upArgs.hardeningAdminTags, ",")
+		for _, tag := range adminTags {
+			if err := tailcfg.CheckTag(tag); err != nil {
+				fatalf("admin tag: %q: %s", tag, err)
+			}
+		}
+	}
+
 	if len(upArgs.hostname) > 256 {
 		fatalf("hostname too long: %d bytes (max 256)", len(upArgs.hostname))
 	}
 
+	exitNodeIP, autoExitNode, err := resolveExitNode(ctx, upArgs.exitNode)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if upArgs.exitNodeAllowLANAccess && exitNodeIP.IsZero() && !autoExitNode {
+		fatalf("--exit-node-allow-lan-access needs --exit-node")
+	}
+
+	keepAlivePeers := parseIPsFlag("keepalive-peers", upArgs.keepAlivePeers)
+	relayOnlyPeers := parseIPsFlag("relay-only-peers", upArgs.relayOnlyPeers)
+	if upArgs.keepAliveInterval < 0 || upArgs.keepAliveInterval > 0xffff*time.Second {
+		fatalf("--keepalive-interval out of range")
+	}
+	if upArgs.splitTunnelExclude && upArgs.splitTunnelApps == "" {
+		fatalf("--split-tunnel-exclude needs --split-tunnel-apps")
+	}
+
+	authKey, err := resolveAuthKey(upArgs.authKey)
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	if err := checkProxyURL(upArgs.proxy); err != nil {
+		fatalf("%v", err)
+	}
+
 	// TODO(apenwarr): fix different semantics between prefs and uflags
 	prefs := ipn.NewPrefs()
 	prefs.ControlURL = upArgs.server
 	prefs.WantRunning = true
 	prefs.RouteAll = upArgs.acceptRoutes
+	prefs.RouteMetrics = routeMetrics
+	prefs.AllowRoutesOverLAN = upArgs.allowRoutesOverLAN
 	prefs.CorpDNS = upArgs.acceptDNS
 	prefs.AllowSingleHosts = upArgs.singleRoutes
 	prefs.ShieldsUp = upArgs.shieldsUp
+	prefs.RunSSH = upArgs.runSSH
+	prefs.AutoUpdate = upArgs.autoUpdate
 	prefs.AdvertiseRoutes = routes
+	prefs.AdvertiseRouteChecks = routeChecks
 	prefs.AdvertiseTags = tags
+	prefs.HardeningProfile = upArgs.hardening
+	prefs.HardeningAdminTags = adminTags
 	prefs.NoSNAT = !upArgs.snat
+	if hasNetfilter(runtime.GOOS) && prefs.NoSNAT && len(routes) > 0 {
+		warnNoSNAT()
+	}
 	prefs.Hostname = upArgs.hostname
+	prefs.ExitNodeIP = exitNodeIP
+	prefs.AutoExitNode = autoExitNode
+	prefs.ExitNodeAllowLANAccess = upArgs.exitNodeAllowLANAccess
+	prefs.ProxyURL = upArgs.proxy
+	prefs.ListenPort = upArgs.listenPort
+	prefs.NoPrivateEndpoints = !upArgs.privateEndpoints
+	if upArgs.noEndpointInterfaces != "" {
+		prefs.NoEndpointInterfaces = strings.Split(upArgs.noEndpointInterfaces, ",")
+	}
+	prefs.KeepAlivePeers = keepAlivePeers
+	prefs.KeepAliveSeconds = int(upArgs.keepAliveInterval / time.Second)
+	prefs.RelayOnlyPeers = relayOnlyPeers
+	prefs.LowResource = upArgs.lowResource
+	if upArgs.splitTunnelApps != "" {
+		prefs.SplitTunnelApps = strings.Split(upArgs.splitTunnelApps, ",")
+		prefs.SplitTunnelExclude = upArgs.splitTunnelExclude
+	}
 	prefs.ForceDaemon = (runtime.GOOS == "windows")
 
-	if runtime.GOOS == "linux" {
+	if hasNetfilter(runtime.GOOS) {
+		firewall := "iptables"
+		if runtime.GOOS != "linux" {
+			firewall = "pf"
+		}
 		switch upArgs.netfilterMode {
 		case "on":
 			prefs.NetfilterMode = router.NetfilterOn
 		case "nodivert":
 			prefs.NetfilterMode = router.NetfilterNoDivert
-			warnf("netfilter=nodivert; add iptables calls to ts-* chains manually.")
+			if runtime.GOOS == "linux" {
+				warnf("netfilter=nodivert; add iptables calls to ts-* chains manually.")
+			}
 		case "off":
 			prefs.NetfilterMode = router.NetfilterOff
-			warnf("netfilter=off; configure iptables yourself.")
+			warnf("netfilter=off; configure %s yourself.", firewall)
 		default:
 			fatalf("invalid value --netfilter-mode: %q", upArgs.netfilterMode)
 		}
@@ -234,7 +435,7 @@ func runUp(ctx context.Context, args []string) error {
 
 	opts := ipn.Options{
 		StateKey: ipn.GlobalDaemonStateKey,
-		AuthKey:  upArgs.authKey,
+		AuthKey:  authKey,
 		Notify: func(n ipn.Notify) {
 			if n.ErrMessage != nil {
 				fatalf("backend error: %v\n", *n.ErrMessage)
@@ -246,6 +447,9 @@ func runUp(ctx context.Context, args []string) error {
 					startLoginInteractive()
 				case ipn.NeedsMachineAuth:
 					printed = true
+					if authKey != "" {
+						fmt.Fprintf(os.Stderr, "\nThe auth key isn't pre-authorized.")
+					}
 					fmt.Fprintf(os.Stderr, "\nTo authorize your machine, visit (as admin):\n\n\t%s/admin/machines\n\n", upArgs.server)
 				case ipn.Starting, ipn.Running:
 					// Done full authentication process
@@ -258,6 +462,9 @@ func runUp(ctx context.Context, args []string) error {
 			}
 			if url := n.BrowseToURL; url != nil {
 				fmt.Fprintf(os.Stderr, "\nTo authenticate, visit:\n\n\t%s\n\n", *url)
+				if upArgs.qr {
+					printQR(*url)
+				}
 			}
 		},
 	}
@@ -289,7 +496,32 @@ func runUp(ctx context.Context, args []string) error {
 		printed = true
 		startLoginInteractive()
 	}
+	var timedOut int32
+	if upArgs.timeout > 0 {
+		t := time.AfterFunc(upArgs.timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			c.Close()
+			cancel()
+		})
+		defer t.Stop()
+	}
 	pump(ctx, bc, c)
 
+	if atomic.LoadInt32(&timedOut) != 0 {
+		return fmt.Errorf("not connected after %v; timed out", upArgs.timeout)
+	}
 	return nil
 }
+
+// printQR prints a QR code of the login URL url to stderr, for
+// scanning with a phone.
+func printQR(url string) {
+	q, err := qrcode.Encode(url)
+	if err != nil {
+		warnf("can't show a QR code: %v", err)
+		return
+	}
+	// Most terminals draw light text on a dark background, so draw
+	// the light modules as text.
+	fmt.Fprintf(os.Stderr, "%s\n", q.TerminalInverted())
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/clientupdate"
+	"tailscale.com/version"
+)
+
+var updateCmd = &ffcli.Command{
+	Name:       "update",
+	ShortUsage: "update [--track=stable|unstable] [--dry-run] [--yes]",
+	ShortHelp:  "Update Tailscale to the latest release",
+	LongHelp: strings.TrimSpace(`
+
+"tailscale update" updates Tailscale to the latest release of its
+release track, after checking the release's signature. It uses the
+package manager Tailscale was installed with, if any; otherwise it
+replaces the binaries (Linux) or runs the installer (Windows).
+
+To have tailscaled update itself daily, use "tailscale set
+--auto-update".
+
+`),
+	Exec: runUpdate,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("update", flag.ExitOnError)
+		fs.StringVar(&updateArgs.track, "track", "", `release track to update from, "stable" or "unstable"; default is this version's`)
+		fs.BoolVar(&updateArgs.dryRun, "dry-run", false, "only check for a newer release")
+		fs.BoolVar(&updateArgs.yes, "yes", false, "update without asking for confirmation")
+		return fs
+	})(),
+}
+
+var updateArgs struct {
+	track  string
+	dryRun bool
+	yes    bool
+}
+
+func runUpdate(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("too many non-flag arguments: %q", args)
+	}
+	switch updateArgs.track {
+	case "", clientupdate.StableTrack, clientupdate.UnstableTrack:
+	default:
+		return fmt.Errorf("invalid --track %q; want %q or %q", updateArgs.track, clientupdate.StableTrack, clientupdate.UnstableTrack)
+	}
+	u := &clientupdate.Updater{
+		Logf:  log.Printf,
+		Track: updateArgs.track,
+	}
+	rel, err := u.Check(ctx)
+	if err != nil {
+		return err
+	}
+	if !clientupdate.Newer(rel) {
+		fmt.Printf("Already up to date: %s is the latest release.\n", version.Short)
+		return nil
+	}
+	if updateArgs.dryRun {
+		fmt.Printf("Release %s is available (running %s).\n", rel.Version, version.Short)
+		return nil
+	}
+	if !updateArgs.yes {
+		fmt.Printf("Update from %s to %s? [y/N] ", version.Short, rel.Version)
+		line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if ans := strings.ToLower(strings.TrimSpace(line)); ans != "y" && ans != "yes" {
+			return errors.New("update canceled")
+		}
+	}
+	if err := u.Update(ctx, rel); err != nil {
+		return err
+	}
+	fmt.Printf("Updated to %s.\n", rel.Version)
+	return nil
+}
@@ -0,0 +1,463 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
+	"tailscale.com/client/tailnetauth"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+)
+
+var webCmd = &ffcli.Command{
+	Name:       "web",
+	ShortUsage: "web [--listen=ADDR] [--allow=LOGINS_OR_TAGS]",
+	ShortHelp:  "Run a web server for managing this node from the tailnet",
+	LongHelp: strings.TrimSpace(`
+
+"tailscale web" serves a small web UI for managing this node, for
+devices without a screen or a shell handy, such as NAS boxes. It
+shows the node's status and lets you choose an exit node, change
+the routes it advertises and turn shields-up on or off.
+
+It listens on this node's Tailscale IP, and only serves peers whose
+user or ACL tags are in --allow, by default the user who owns this
+node. Peers are identified by their Tailscale IP, so the tailnet's
+ACLs must also let them reach the port. It must be opened by one of
+the node's Tailscale IPs or its MagicDNS name.
+
+`),
+	Exec: runWeb,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("web", flag.ExitOnError)
+		fs.StringVar(&webArgs.listen, "listen", "", `address to listen on, by default port 5252 of this node's Tailscale IP`)
+		fs.StringVar(&webArgs.allow, "allow", "", "login names and ACL tags of the peers allowed to use the web UI (comma-separated, e.g. alice@example.com,tag:admin), by default the owner of this node")
+		return fs
+	})(),
+}
+
+var webArgs struct {
+	listen string
+	allow  string
+}
+
+// webDefaultPort is the port of the node's Tailscale IP "tailscale
+// web" listens on by default.
+const webDefaultPort = 5252
+
+func runWeb(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("too many non-flag arguments: %q", args)
+	}
+	st, err := tailscale.Status(ctx)
+	if err != nil {
+		return err
+	}
+	addr := webArgs.listen
+	if addr == "" {
+		if len(st.TailscaleIPs) == 0 {
+			return errors.New("this node has no Tailscale IP yet; run 'tailscale up' first")
+		}
+		addr = net.JoinHostPort(st.TailscaleIPs[0].String(), strconv.Itoa(webDefaultPort))
+	}
+	allow := map[string]bool{}
+	if webArgs.allow != "" {
+		for _, s := range strings.Split(webArgs.allow, ",") {
+			allow[s] = true
+		}
+	} else {
+		var owner tailcfg.UserProfile
+		ok := false
+		if st.Self != nil {
+			owner, ok = st.User[st.Self.UserID]
+		}
+		if !ok || owner.LoginName == "" {
+			return errors.New("can't tell who owns this node; use --allow")
+		}
+		allow[owner.LoginName] = true
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	ws := &webServer{allow: allow}
+	if _, err := crand.Read(ws.csrfKey[:]); err != nil {
+		return err
+	}
+	fmt.Printf("Serving the web UI at http://%v/ ...\n", ln.Addr())
+	err = http.Serve(ln, tailnetauth.Handler(ws, nil))
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// webServer is the handler of "tailscale web", behind
+// tailnetauth.Handler.
+type webServer struct {
+	allow   map[string]bool // login names and tags
+	csrfKey [32]byte        // signs sessions' CSRF tokens; see csrfToken
+}
+
+// webSessionCookie is the name of the cookie holding a browser's web
+// UI session ID, which its CSRF token is derived from.
+const webSessionCookie = "TS-Web-Session"
+
+// csrfToken returns the CSRF token of the session with the given ID,
+// which /set requires in its form.
+func (s *webServer) csrfToken(session string) string {
+	h := hmac.New(sha256.New, s.csrfKey[:])
+	io.WriteString(h, session)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// session returns the web UI session ID of r's browser, setting a
+// cookie with a new one in w if it has none.
+func (s *webServer) session(w http.ResponseWriter, r *http.Request) (string, error) {
+	if c, err := r.Cookie(webSessionCookie); err == nil && c.Value != "" {
+		return c.Value, nil
+	}
+	var b [16]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b[:])
+	http.SetCookie(w, &http.Cookie{
+		Name:     webSessionCookie,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return id, nil
+}
+
+// validHost reports whether host, a request's Host header, names this
+// node: one of its Tailscale IPs or its MagicDNS name. Other names,
+// such as one an attacker's DNS points at the node's IP, are refused,
+// so pages on other sites can't reach the web UI as their own origin.
+func validHost(st *ipnstate.Status, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	if ip, err := netaddr.ParseIP(host); err == nil {
+		for _, tip := range st.TailscaleIPs {
+			if ip == tip {
+				return true
+			}
+		}
+		return false
+	}
+	return st.Self != nil && st.Self.DNSName != "" &&
+		strings.EqualFold(host, strings.TrimSuffix(st.Self.DNSName, "."))
+}
+
+// checkSameOrigin returns an error unless the POST r says it comes
+// from a page of the web UI itself. Browsers send Origin or
+// Sec-Fetch-Site with POSTs; one lacking both isn't trusted.
+func checkSameOrigin(r *http.Request) error {
+	origin, site := r.Header.Get("Origin"), r.Header.Get("Sec-Fetch-Site")
+	if origin == "" && site == "" {
+		return errors.New("missing Origin and Sec-Fetch-Site")
+	}
+	if origin != "" {
+		if u, err := url.Parse(origin); err != nil || u.Host != r.Host {
+			return errors.New("cross-origin request")
+		}
+	}
+	if site != "" && site != "same-origin" {
+		return errors.New("cross-site request")
+	}
+	return nil
+}
+
+// allowed reports whether the peer p may use the web UI.
+func (s *webServer) allowed(p *ipn.Peer) bool {
+	if len(p.Node.Tags) > 0 {
+		for _, t := range p.Node.Tags {
+			if s.allow[t] {
+				return true
+			}
+		}
+		return false
+	}
+	return s.allow[p.User.LoginName]
+}
+
+func (s *webServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p, ok := tailnetauth.PeerFromContext(r.Context())
+	if !ok || !s.allowed(p) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	st, err := tailscale.Status(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !validHost(st, r.Host) {
+		http.Error(w, "unknown host", http.StatusMisdirectedRequest)
+		return
+	}
+	session, err := s.session(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	switch r.URL.Path {
+	case "/":
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "want GET", http.StatusMethodNotAllowed)
+			return
+		}
+		s.serveIndex(w, r, p, session, http.StatusOK, "")
+	case "/set":
+		if r.Method != "POST" {
+			http.Error(w, "want POST", http.StatusMethodNotAllowed)
+			return
+		}
+		// Peers are trusted by IP, so a page on another site
+		// open in an allowed peer's browser could post here.
+		if err := checkSameOrigin(r); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if !hmac.Equal([]byte(r.PostFormValue("csrf")), []byte(s.csrfToken(session))) {
+			http.Error(w, "invalid CSRF token; reload the page", http.StatusForbidden)
+			return
+		}
+		if err := s.set(r); err != nil {
+			s.serveIndex(w, r, p, session, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Printf("web: prefs changed by %s from %v", p.User.LoginName, p.Addr)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// webExitNode is an exit node choice on the web UI.
+type webExitNode struct {
+	Value    string // of the form field
+	Name     string
+	Selected bool
+}
+
+// webPage is the data of webTemplate.
+type webPage struct {
+	Viewer    string
+	Error     string
+	Status    *ipnstate.Status
+	Hostname  string
+	IPs       string
+	ExitNodes []webExitNode
+	Routes    string
+	ShieldsUp bool
+	CSRF      string // the session's token for /set
+}
+
+// serveIndex serves the web UI's page for session with the HTTP status
+// code, showing errMsg if non-empty.
+func (s *webServer) serveIndex(w http.ResponseWriter, r *http.Request, p *ipn.Peer, session string, code int, errMsg string) {
+	st, err := tailscale.Status(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	prefs, err := tailscale.GetPrefs(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page := &webPage{
+		Viewer:    p.User.LoginName,
+		Error:     errMsg,
+		Status:    st,
+		ShieldsUp: prefs.ShieldsUp,
+		CSRF:      s.csrfToken(session),
+	}
+	if len(p.Node.Tags) > 0 {
+		page.Viewer = strings.Join(p.Node.Tags, ", ")
+	}
+	if st.Self != nil {
+		page.Hostname = st.Self.HostName
+	}
+	var ips []string
+	for _, ip := range st.TailscaleIPs {
+		ips = append(ips, ip.String())
+	}
+	page.IPs = strings.Join(ips, ", ")
+	var routes []string
+	for _, r := range prefs.AdvertiseRoutes {
+		routes = append(routes, r.String())
+	}
+	page.Routes = strings.Join(routes, ",")
+
+	page.ExitNodes = []webExitNode{
+		{Value: "", Name: "None", Selected: prefs.ExitNodeIP.IsZero() && !prefs.AutoExitNode},
+		{Value: "auto", Name: "Automatic (fastest)", Selected: prefs.AutoExitNode},
+	}
+	var exits []webExitNode
+	for _, ps := range st.Peer {
+		if !offersExitNode(ps) {
+			continue
+		}
+		name := strings.TrimSuffix(ps.DNSName, ".")
+		if name == "" {
+			name = ps.SimpleHostName()
+		}
+		exits = append(exits, webExitNode{
+			Value:    ps.TailAddr,
+			Name:     fmt.Sprintf("%s (%s)", name, ps.TailAddr),
+			Selected: !prefs.AutoExitNode && ps.TailAddr == prefs.ExitNodeIP.String(),
+		})
+	}
+	sort.Slice(exits, func(i, j int) bool { return exits[i].Name < exits[j].Name })
+	page.ExitNodes = append(page.ExitNodes, exits...)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	if err := webTemplate.Execute(w, page); err != nil {
+		log.Printf("web: %v", err)
+	}
+}
+
+// offersExitNode reports whether the peer ps advertises a default
+// route.
+func offersExitNode(ps *ipnstate.PeerStatus) bool {
+	for _, r := range ps.AdvertisedRoutes {
+		if r == "0.0.0.0/0" || r == "::/0" {
+			return true
+		}
+	}
+	return false
+}
+
+// set applies the form posted to /set to the prefs.
+func (s *webServer) set(r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+	ctx := r.Context()
+	prefs, err := tailscale.GetPrefs(ctx)
+	if err != nil {
+		return err
+	}
+
+	switch v := r.PostForm.Get("exit-node"); v {
+	case "":
+		prefs.ExitNodeIP, prefs.AutoExitNode = netaddr.IP{}, false
+	case "auto":
+		prefs.ExitNodeIP, prefs.AutoExitNode = netaddr.IP{}, true
+	default:
+		ip, err := netaddr.ParseIP(v)
+		if err != nil {
+			return fmt.Errorf("invalid exit node %q", v)
+		}
+		prefs.ExitNodeIP, prefs.AutoExitNode = ip, false
+	}
+
+	var routes []wgcfg.CIDR
+	for _, s := range strings.Split(r.PostForm.Get("routes"), ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		cidr, ok := parseIPOrCIDR(s)
+		ipp, err := netaddr.ParseIPPrefix(s)
+		if !ok || (err == nil && ipp != ipp.Masked()) {
+			return fmt.Errorf("%q is not a valid route", s)
+		}
+		routes = append(routes, cidr)
+	}
+	prefs.AdvertiseRoutes = routes
+	// Drop the reachability checks of routes no longer advertised.
+	var checks []string
+	for _, c := range prefs.AdvertiseRouteChecks {
+		route, _, err := ipn.ParseRouteCheck(c)
+		if err != nil {
+			continue
+		}
+		for _, r := range routes {
+			if r == route {
+				checks = append(checks, c)
+				break
+			}
+		}
+	}
+	prefs.AdvertiseRouteChecks = checks
+
+	prefs.ShieldsUp = r.PostForm.Get("shields-up") == "on"
+
+	_, err = tailscale.SetPrefs(ctx, prefs)
+	return err
+}
+
+var webTemplate = template.Must(template.New("web").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Tailscale: {{.Hostname}}</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 1em auto; padding: 0 1em; }
+label { display: block; margin: 1em 0 0.3em; font-weight: bold; }
+input[type=text], select { width: 100%; }
+.error { color: #b00; }
+.muted { color: #666; }
+</style>
+</head>
+<body>
+<h1>{{.Hostname}}</h1>
+<p class="muted">Signed in as {{.Viewer}}</p>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<table>
+<tr><td>State</td><td>{{.Status.BackendState}}</td></tr>
+<tr><td>Tailscale IPs</td><td>{{.IPs}}</td></tr>
+{{if .Status.Self}}<tr><td>DNS name</td><td>{{.Status.Self.DNSName}}</td></tr>{{end}}
+{{range .Status.Health}}<tr><td>Health</td><td class="error">{{.}}</td></tr>{{end}}
+</table>
+<form method="POST" action="/set">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<label for="exit-node">Exit node</label>
+<select id="exit-node" name="exit-node">
+{{range .ExitNodes}}<option value="{{.Value}}"{{if .Selected}} selected{{end}}>{{.Name}}</option>
+{{end}}</select>
+<label for="routes">Advertised routes</label>
+<input type="text" id="routes" name="routes" value="{{.Routes}}" placeholder="10.0.0.0/8,192.168.0.0/24">
+<label><input type="checkbox" name="shields-up"{{if .ShieldsUp}} checked{{end}}> Shields up (block incoming connections)</label>
+<p><button type="submit">Save</button></p>
+</form>
+</body>
+</html>
+`))
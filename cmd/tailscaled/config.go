@@ -0,0 +1,117 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/conffile"
+	"tailscale.com/ipn/ipnserver"
+	"tailscale.com/types/logger"
+)
+
+// configPollInterval is how often the --config file is checked for
+// changes, besides on SIGHUP.
+const configPollInterval = 10 * time.Second
+
+// configFile is the --config file, as last loaded successfully.
+type configFile struct {
+	path string
+	logf logger.Logf
+
+	mu   sync.Mutex
+	c    *conffile.Config
+	data []byte // contents c was parsed from
+}
+
+// configureFile sets up opts to follow the --config file, if any.
+func configureFile(opts *ipnserver.Options, logf logger.Logf) error {
+	if args.configPath == "" {
+		return nil
+	}
+	cf := &configFile{path: args.configPath, logf: logger.WithPrefix(logf, "config: ")}
+	if _, err := cf.load(); err != nil {
+		return err
+	}
+	key, err := cf.c.ResolveAuthKey()
+	if err != nil {
+		return err
+	}
+	opts.AuthKey = key
+	opts.EditPrefs = cf.apply
+	opts.WatchConfig = cf.watch
+	return nil
+}
+
+// load reads the file and, if it changed, parses it and applies its
+// log levels. It reports whether it changed.
+func (cf *configFile) load() (changed bool, err error) {
+	data, err := ioutil.ReadFile(cf.path)
+	if err != nil {
+		return false, err
+	}
+	cf.mu.Lock()
+	same := cf.c != nil && bytes.Equal(data, cf.data)
+	cf.mu.Unlock()
+	if same {
+		return false, nil
+	}
+	c, err := conffile.Parse(data)
+	if err != nil {
+		return false, err
+	}
+	for name, l := range c.LogLevels {
+		if err := logger.PresetLevel(name, l); err != nil {
+			return false, err
+		}
+	}
+	cf.mu.Lock()
+	cf.c, cf.data = c, data
+	cf.mu.Unlock()
+	return true, nil
+}
+
+func (cf *configFile) apply(p *ipn.Prefs) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	cf.c.Apply(p)
+}
+
+// watch reloads the file on SIGHUP and when it changes, calling
+// reload after each change, until ctx is done. A file that fails to
+// load is reported and otherwise ignored.
+func (cf *configFile) watch(ctx context.Context, reload func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	t := time.NewTicker(configPollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			cf.logf("reloading %s on SIGHUP", cf.path)
+		case <-t.C:
+		}
+		changed, err := cf.load()
+		if err != nil {
+			cf.logf("%v; keeping the previous config", err)
+			continue
+		}
+		if changed {
+			cf.logf("%s changed; applying", cf.path)
+			reload()
+		}
+	}
+}
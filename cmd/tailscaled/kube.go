@@ -0,0 +1,148 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/ipn/ipnserver"
+	"tailscale.com/ipn/kubestore"
+	"tailscale.com/kube"
+	"tailscale.com/kube/leader"
+	"tailscale.com/kube/netpolicy"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/filter"
+)
+
+// configureKube sets up opts for the flags that make tailscaled work
+// with the Kubernetes cluster whose pod it runs in, if any. If it
+// returns a non-nil beforeShutdown, that's to be run when tailscaled
+// is asked to shut down, before it does.
+func configureKube(opts *ipnserver.Options, logf logger.Logf) (beforeShutdown func(), err error) {
+	useKubeState := strings.HasPrefix(args.statepath, kubeStatePrefix)
+	if !useKubeState && !args.kubeNetPol && !args.kubeRoutes && args.kubeHALease == "" {
+		return nil, nil
+	}
+	kc, err := kube.New()
+	if err != nil {
+		return nil, err
+	}
+	if useKubeState {
+		opts.Store, err = kubestore.New(kc, strings.TrimPrefix(args.statepath, kubeStatePrefix))
+		if err != nil {
+			return nil, fmt.Errorf("--state=%s: %v", args.statepath, err)
+		}
+	}
+	if args.kubeNetPol {
+		opts.PolicyFilter = func(ctx context.Context, set func([]filter.Match)) {
+			netpolicy.Run(ctx, kc, podName(), logf, set)
+		}
+	}
+	if args.kubeRoutes {
+		opts.AutoRoutes = func(ctx context.Context, set func([]wgcfg.CIDR)) {
+			runKubeRoutes(ctx, kc, logf, set)
+		}
+	}
+	if args.kubeHALease != "" {
+		beforeShutdown = configureKubeHA(opts, kc, logf)
+	}
+	return beforeShutdown, nil
+}
+
+// podName returns the name of the pod tailscaled runs in.
+func podName() string {
+	if pod := os.Getenv("POD_NAME"); pod != "" {
+		return pod
+	}
+	pod, _ := os.Hostname()
+	return pod
+}
+
+// configureKubeHA makes the node one of the replicas of a subnet
+// router, per --kube-ha-lease: it only advertises its routes while it
+// holds the Lease. It returns the function to run before shutting
+// down, which hands the Lease over to another replica and then keeps
+// routing for --kube-ha-drain, while peers move their connections
+// over.
+func configureKubeHA(opts *ipnserver.Options, kc *kube.Client, logf logger.Logf) (beforeShutdown func()) {
+	haCtx, stopHA := context.WithCancel(context.Background())
+	haDone := make(chan struct{})
+	var led int32 // atomic; whether the node was ever the primary
+	opts.RoutesStandby = func(ctx context.Context, set func(bool)) {
+		defer close(haDone)
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-haCtx.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		leader.New(kc, args.kubeHALease, podName(), logf).Run(ctx, func(leading bool) {
+			if leading {
+				atomic.StoreInt32(&led, 1)
+			}
+			set(!leading)
+		})
+	}
+	return func() {
+		stopHA()
+		select {
+		case <-haDone:
+		case <-time.After(5 * time.Second):
+		}
+		if atomic.LoadInt32(&led) == 1 && args.kubeHADrain > 0 {
+			logf("draining connections for %v before shutting down", args.kubeHADrain)
+			time.Sleep(args.kubeHADrain)
+		}
+	}
+}
+
+// kubeRoutesInterval is how often runKubeRoutes looks for changes to
+// the cluster's CIDRs.
+const kubeRoutesInterval = time.Minute
+
+// runKubeRoutes calls set with the cluster's pod and Service CIDRs,
+// and again whenever they change, until ctx is done.
+func runKubeRoutes(ctx context.Context, kc *kube.Client, logf logger.Logf, set func([]wgcfg.CIDR)) {
+	logf = logger.WithPrefix(logf, "kube-advertise-cidrs: ")
+	var last []string
+	t := time.NewTicker(kubeRoutesInterval)
+	defer t.Stop()
+	for {
+		cidrs, err := kc.ClusterCIDRs(ctx)
+		switch {
+		case err != nil:
+			// Keep advertising what was last found.
+			logf("%v", err)
+		case !reflect.DeepEqual(cidrs, last):
+			var routes []wgcfg.CIDR
+			for _, s := range cidrs {
+				r, err := wgcfg.ParseCIDR(s)
+				if err != nil {
+					logf("%q: %v", s, err)
+					continue
+				}
+				routes = append(routes, r)
+			}
+			logf("advertising %v", cidrs)
+			set(routes)
+			last = cidrs
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,24 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin
+
+package main
+
+import (
+	"flag"
+
+	"tailscale.com/ssh/tailssh"
+)
+
+var sshRecordDir string
+
+func init() {
+	flag.StringVar(&sshRecordDir, "ssh-record-dir", "", "if non-empty, directory in which to record sessions of the SSH server enabled by 'tailscale up --ssh'")
+	configureSSH = func() {
+		if sshRecordDir != "" {
+			tailssh.SetSessionRecorder(tailssh.NewDirRecorder(sshRecordDir))
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"tailscale.com/control/controlclient"
+	"tailscale.com/ipn/ipnserver"
+	"tailscale.com/types/logger"
+)
+
+// staticFile is the --static-config file, whose peers the node uses
+// instead of a control server's.
+type staticFile struct {
+	path string
+	logf logger.Logf
+	sm   *controlclient.StaticMap
+	data []byte // contents sm was last set from
+}
+
+// configureStatic sets up opts to run from the --static-config file,
+// if any. It returns a func to run for as long as tailscaled does,
+// which reloads the file when it changes, or nil.
+func configureStatic(opts *ipnserver.Options, logf logger.Logf) (watch func(context.Context), err error) {
+	if args.staticConfig == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(args.staticConfig)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := controlclient.ParseStaticConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	sf := &staticFile{
+		path: args.staticConfig,
+		logf: logger.WithPrefix(logf, "static-config: "),
+		sm:   controlclient.NewStaticMap(cfg),
+		data: data,
+	}
+	opts.Static = sf.sm
+	return sf.watch, nil
+}
+
+// watch reloads the file on SIGHUP and when it changes, until ctx is
+// done. A file that fails to load is reported and otherwise ignored.
+func (sf *staticFile) watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	t := time.NewTicker(configPollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			sf.logf("reloading %s on SIGHUP", sf.path)
+		case <-t.C:
+		}
+		data, err := ioutil.ReadFile(sf.path)
+		if err != nil {
+			sf.logf("%v; keeping the previous config", err)
+			continue
+		}
+		if bytes.Equal(data, sf.data) {
+			continue
+		}
+		cfg, err := controlclient.ParseStaticConfig(data)
+		if err != nil {
+			sf.logf("%s: %v; keeping the previous config", sf.path, err)
+			continue
+		}
+		sf.logf("%s changed; applying", sf.path)
+		sf.data = data
+		sf.sm.Set(cfg)
+	}
+}
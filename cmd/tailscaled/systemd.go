@@ -0,0 +1,83 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnserver"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/systemd"
+)
+
+// configureSystemd sets up opts to serve on the socket passed by
+// systemd socket activation, if any, and to tell systemd when
+// tailscaled is ready, until ctx is done.
+func configureSystemd(ctx context.Context, opts *ipnserver.Options, logf logger.Logf) error {
+	lns, err := systemd.Listeners()
+	if err != nil {
+		return err
+	}
+	if len(lns) > 0 {
+		logf("serving on the socket passed by systemd")
+		opts.Listener = lns[0]
+		for _, ln := range lns[1:] {
+			ln.Close()
+		}
+	}
+	opts.Serving = func(b *ipn.LocalBackend) {
+		go notifySystemd(ctx, logf, b)
+	}
+	return nil
+}
+
+// notifySystemd tells systemd that tailscaled is ready and keeps the
+// service's status line up to date with the backend's state. If the
+// service has a watchdog, it pings it for as long as the backend
+// responds.
+func notifySystemd(ctx context.Context, logf logger.Logf, b *ipn.LocalBackend) {
+	if err := systemd.Notify(systemd.Ready); err != nil {
+		logf("%v", err)
+		return
+	}
+	if iv := systemd.WatchdogInterval(); iv > 0 {
+		go pingSystemdWatchdog(ctx, logf, b, iv/2)
+	}
+	b.WatchNotifications(ctx, func(n *ipn.Notify) {
+		if n.State != nil {
+			systemd.Notify(systemd.Status("State: " + n.State.String()))
+		}
+	})
+}
+
+// pingSystemdWatchdog pings systemd's watchdog every period while b,
+// and the engine beneath it, answer for their status within it, so
+// that systemd restarts a wedged tailscaled.
+func pingSystemdWatchdog(ctx context.Context, logf logger.Logf, b *ipn.LocalBackend, period time.Duration) {
+	t := time.NewTicker(period)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		answered := make(chan bool, 1)
+		go func() {
+			b.Status()
+			answered <- true
+		}()
+		select {
+		case <-answered:
+			systemd.Notify(systemd.Watchdog)
+		case <-time.After(period):
+			logf("systemd watchdog: backend not responding")
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -11,29 +11,38 @@ package main // import "tailscale.com/cmd/tailscaled"
 
 import (
 	"context"
+	"expvar"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"os/signal"
+	"os/user"
+	"path/filepath"
 	"runtime"
 	"runtime/debug"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/apenwarr/fixconsole"
 	"tailscale.com/ipn/ipnserver"
 	"tailscale.com/logpolicy"
+	"tailscale.com/net/tlsdial"
 	"tailscale.com/paths"
 	"tailscale.com/types/flagtype"
 	"tailscale.com/types/logger"
+	"tailscale.com/util/privdrop"
+	"tailscale.com/util/systemd"
 	"tailscale.com/version"
 	"tailscale.com/wgengine"
 	"tailscale.com/wgengine/magicsock"
 	"tailscale.com/wgengine/router"
+	"tailscale.com/wgengine/tstun"
 )
 
 // globalStateKey is the ipn.StateKey that tailscaled loads on
@@ -56,14 +65,72 @@ func defaultTunName() string {
 	return "tailscale0"
 }
 
+// configureSSH applies the SSH server flags. It's non-nil on
+// platforms with SSH server support.
+var configureSSH func()
+
+// serviceCommand, if non-nil, installs or removes tailscaled as an OS
+// service if that's what its flags say to do, and reports whether
+// they did. runService, if non-nil, runs tailscaled as an OS service
+// if it was started as one, and reports whether it was. They're
+// non-nil on Windows.
+var serviceCommand, runService func() bool
+
+// takeOver, if non-nil, returns an engine carrying on with the TUN
+// device and UDP sockets of the running tailscaled, which exits, for
+// --upgrade. serveHandoff, if non-nil, lets a new tailscaled take
+// over from this one that way. They're non-nil on Linux.
+var (
+	takeOver     func(logger.Logf) (wgengine.Engine, error)
+	serveHandoff func(logger.Logf, wgengine.Engine)
+)
+
+// interrupt receives the signals that shut tailscaled down, and a
+// service manager's requests to stop it.
+var interrupt = make(chan os.Signal, 1)
+
+// memStatePath is the --state value that keeps all state in memory
+// and registers the node as ephemeral, for short-lived nodes like CI
+// runners that shouldn't write keys to disk.
+const memStatePath = "mem:"
+
+// kubeStatePrefix prefixes the name of the Kubernetes Secret to keep
+// state in, in the --state value, for tailscaled in a pod.
+const kubeStatePrefix = "kube:"
+
 var args struct {
-	cleanup    bool
-	fake       bool
-	debug      string
-	tunname    string
-	port       uint16
-	statepath  string
-	socketpath string
+	cleanup      bool
+	fake         bool
+	kernelWG     bool
+	user         string
+	unprivileged bool
+	debug        string
+	tunname      string
+	tunMTU       int
+	port         uint16
+	statepath    string
+	socketpath   string
+	tokenFile    string
+	tokenGroup   string
+	inboxdir     string
+	derpMap      string
+	caBundle     string
+	noLogs       bool
+	logFile      string
+	logFileMax   int64
+	syslog       bool
+	probeAddr    string
+	reconfigHook string
+	kubeNetPol   bool
+	kubeRoutes   bool
+	configPath   string
+	staticConfig string
+	wgPeers      string
+	kubeHALease  string
+	kubeHADrain  time.Duration
+	stopDrain    time.Duration
+	upgrade      bool
+	connLog      string
 }
 
 func main() {
@@ -78,11 +145,36 @@ func main() {
 	printVersion := false
 	flag.BoolVar(&args.cleanup, "cleanup", false, "clean up system state and exit")
 	flag.BoolVar(&args.fake, "fake", false, "use userspace fake tunnel+routing instead of kernel TUN interface")
+	flag.BoolVar(&args.kernelWG, "kernel-wg", false, "use the Linux kernel's WireGuard module for the data plane, falling back to userspace WireGuard if it's unavailable; the -tun name is used for the WireGuard interface")
+	flag.StringVar(&args.user, "user", "", "if started as root, run as this user instead, keeping only the capabilities to configure the network (CAP_NET_ADMIN and CAP_NET_RAW) and forbidding system calls it doesn't need; the directories of -state and -socket, which must be its own such as /var/lib/tailscale rather than shared ones such as /var/lib, are handed over to the user (Linux only)")
+	flag.BoolVar(&args.unprivileged, "unprivileged", false, `run without root or capabilities on the existing -tun device, created beforehand with "ip tuntap add name NAME mode tun user USER" and brought up, leaving its addresses, routes and DNS to -reconfig-hook, and forbidding system calls it doesn't need (Linux only)`)
 	flag.StringVar(&args.debug, "debug", "", "listen address ([ip]:port) of optional debug server")
-	flag.StringVar(&args.tunname, "tun", defaultTunName(), "tunnel interface name")
+	flag.StringVar(&args.tunname, "tun", defaultTunName(), `tunnel interface name; "tap:" and a name for a layer 2 TAP device instead, for bridging to VMs, on which tailscaled answers ARP and NDP for the tailnet's IPs (Linux only)`)
+	flag.IntVar(&args.tunMTU, "tun-mtu", 1280, "MTU of the tunnel interface; more than 1280 turns on path MTU discovery, which limits the packets to each peer to what the path to it carries (Linux only)")
 	flag.Var(flagtype.PortValue(&args.port, magicsock.DefaultPort), "port", "UDP port to listen on for WireGuard and peer-to-peer traffic; 0 means automatically select")
-	flag.StringVar(&args.statepath, "state", paths.DefaultTailscaledStateFile(), "path of state file")
+	flag.StringVar(&args.statepath, "state", paths.DefaultTailscaledStateFile(), `path of state file, "mem:" to keep state in memory only and register as an ephemeral node, or "kube:<secret-name>" to keep it in a Kubernetes Secret in the pod's namespace`)
 	flag.StringVar(&args.socketpath, "socket", paths.DefaultTailscaledSocket(), "path of the service unix socket")
+	flag.StringVar(&args.tokenFile, "localapi-token-file", "", "if non-empty, path of a file to write a new random local API token to at startup; requests bearing it get full access, letting GUIs and other frontends running as regular users change settings")
+	flag.StringVar(&args.tokenGroup, "localapi-token-group", "", "name of a group allowed to read the -localapi-token-file file (not on Windows)")
+	flag.StringVar(&args.inboxdir, "inbox-dir", "", `directory for files received from your other nodes; empty means "files" next to the state file, "off" disables receiving`)
+	flag.StringVar(&args.derpMap, "derp-map", "", "path or http(s) URL of a JSON DERP map whose regions are added to (or, if null, removed from) the control server's")
+	flag.StringVar(&args.caBundle, "ca-bundle", "", "path of a PEM file of extra CA certificates to trust for control, DERP and log server connections")
+	flag.BoolVar(&args.noLogs, "no-logs-no-support", false, "don't upload logs to Tailscale; Tailscale can't help debug problems without them")
+	flag.StringVar(&args.logFile, "log-file", "", "path of a file to also write logs to, rotated as it grows; with -no-logs-no-support, logs stay on this machine")
+	flag.Int64Var(&args.logFileMax, "log-file-max-size", 10<<20, "size in bytes at which the -log-file file is rotated; the 3 most recent rotated files are kept")
+	flag.BoolVar(&args.syslog, "syslog", false, "also send logs to the local syslog daemon (not on Windows)")
+	flag.StringVar(&args.connLog, "conn-log", "", `"syslog" to log each inbound connection the packet filter accepts, with its peer, protocol and ports, to the local syslog daemon or journald as tag "tailscaled-conn", independently of other logs, or "syslog:FACILITY" for a facility other than daemon, such as authpriv or local0 (not on Windows)`)
+	flag.StringVar(&args.probeAddr, "probe-listen", "", `if non-empty, TCP address ([ip]:port) on which to serve HTTP liveness and readiness probes at "/healthz" and "/readyz"`)
+	flag.StringVar(&args.reconfigHook, "reconfig-hook", "", `path of an executable to run with argument "pre" before and "post" after each change to the addresses, routes, DNS or packet filter, with a JSON description of the change on stdin`)
+	flag.BoolVar(&args.kubeNetPol, "kube-network-policy", false, "in a Kubernetes pod, only let in the tailnet traffic that the NetworkPolicies selecting the pod (named by $POD_NAME or the hostname) allow")
+	flag.BoolVar(&args.kubeRoutes, "kube-advertise-cidrs", false, "in a Kubernetes pod, advertise the cluster's pod and Service CIDRs as subnet routes, following them as they change")
+	flag.StringVar(&args.kubeHALease, "kube-ha-lease", "", "in a Kubernetes pod, name of a Lease in the pod's namespace that replicas of a subnet router compete for; only its holder advertises the routes")
+	flag.DurationVar(&args.kubeHADrain, "kube-ha-drain", 15*time.Second, "with -kube-ha-lease, how long the primary keeps routing after handing over the Lease on shutdown, while connections move to the new primary")
+	flag.DurationVar(&args.stopDrain, "shutdown-drain", 5*time.Second, "on shutdown, how long a subnet router or exit node keeps routing after withdrawing its routes and telling the control server it's going offline, while connections move to other routers; 0 stops at once")
+	flag.StringVar(&args.configPath, "config", "", "path of a HuJSON file configuring the node's prefs, auth key and log levels, reapplied when it changes or on SIGHUP; see package tailscale.com/ipn/conffile")
+	flag.StringVar(&args.staticConfig, "static-config", "", "path of a JSON file of peers, DERP map and packet filter to run from instead of a control server, such as in an air-gapped network, reloaded when it changes or on SIGHUP; see tailscale.com/control/controlclient.StaticConfig")
+	flag.StringVar(&args.wgPeers, "wg-peers", "", "path of a JSON file of plain WireGuard peers, not running Tailscale, to add to the interface alongside the tailnet's, subject to its packet filter; see tailscale.com/wgengine.LoadPlainPeers")
+	flag.BoolVar(&args.upgrade, "upgrade", false, "take over from the tailscaled running with the same -socket, carrying on with its TUN device and UDP sockets so that connections over the tunnel survive, for an in-place upgrade; peers handshake afresh (Linux only)")
 	flag.BoolVar(&printVersion, "version", false, "print version information and exit")
 
 	err := fixconsole.FixConsoleIfNeeded()
@@ -100,14 +192,49 @@ func main() {
 		os.Exit(0)
 	}
 
+	if serviceCommand != nil && serviceCommand() {
+		return
+	}
+
 	if args.statepath == "" {
 		log.Fatalf("--state is required")
 	}
 
+	if args.upgrade && (args.fake || args.kernelWG || args.unprivileged) {
+		log.Fatalf("--upgrade can't be used with --fake, --kernel-wg or --unprivileged")
+	}
+
 	if args.socketpath == "" && runtime.GOOS != "windows" {
 		log.Fatalf("--socket is required")
 	}
 
+	if args.user != "" {
+		if os.Getuid() == 0 {
+			os.Exit(runAsUser())
+		}
+		if u, err := user.Current(); err != nil || u.Username != args.user {
+			log.Fatalf("--user=%s requires starting as root", args.user)
+		}
+	}
+
+	if args.caBundle != "" {
+		if err := tlsdial.SetRootCAsFromFile(args.caBundle); err != nil {
+			log.Fatalf("--ca-bundle: %v", err)
+		}
+	}
+	if args.noLogs {
+		logpolicy.DisableUpload()
+	}
+	logpolicy.SetLocalOutput(logpolicy.LocalOptions{
+		File:    args.logFile,
+		MaxSize: args.logFileMax,
+		Syslog:  args.syslog,
+	})
+
+	if runService != nil && runService() {
+		return
+	}
+
 	if err := run(); err != nil {
 		// No need to log; the func already did
 		os.Exit(1)
@@ -132,32 +259,109 @@ func run() error {
 	logf = logger.RateLimitedFn(logf, 5*time.Second, 5, 100)
 
 	if args.cleanup {
-		router.Cleanup(logf, args.tunname)
+		router.Cleanup(logf, strings.TrimPrefix(args.tunname, tstun.TAPPrefix))
 		return nil
 	}
 
+	if configureSSH != nil {
+		configureSSH()
+	}
+
 	var debugMux *http.ServeMux
 	if args.debug != "" {
 		debugMux = newDebugMux()
+		expvar.Publish("magicsock", magicsock.ExpVar())
 		go runDebugServer(debugMux, args.debug)
 	}
 
 	var e wgengine.Engine
-	if args.fake {
+	if args.upgrade {
+		if takeOver == nil {
+			err = fmt.Errorf("--upgrade not supported on %s", runtime.GOOS)
+		} else {
+			e, err = takeOver(logf)
+		}
+	} else if args.fake {
 		e, err = wgengine.NewFakeUserspaceEngine(logf, args.port)
+	} else if args.unprivileged {
+		e, err = wgengine.NewUnprivilegedEngine(logf, args.tunname, args.port)
+	} else if args.kernelWG {
+		e, err = wgengine.NewKernelEngine(logf, args.tunname, args.port)
+		if err != nil {
+			logf("in-kernel wireguard unavailable, using userspace wireguard: %v", err)
+			e, err = wgengine.NewUserspaceEngine(logf, args.tunname, args.port, args.tunMTU)
+		}
 	} else {
-		e, err = wgengine.NewUserspaceEngine(logf, args.tunname, args.port)
+		e, err = wgengine.NewUserspaceEngine(logf, args.tunname, args.port, args.tunMTU)
 	}
 	if err != nil {
 		logf("wgengine.New: %v", err)
 		return err
 	}
+	if args.user != "" || args.unprivileged {
+		if err := privdrop.Seccomp(); err != nil {
+			logf("not restricting system calls: %v", err)
+		}
+	}
+	if args.reconfigHook != "" {
+		e = wgengine.WithReconfigHooks(e, wgengine.ExecReconfigHook(logf, args.reconfigHook))
+	}
+	if args.wgPeers != "" {
+		peers, err := wgengine.LoadPlainPeers(args.wgPeers)
+		if err != nil {
+			logf("--wg-peers: %v", err)
+			return err
+		}
+		e = wgengine.WithPlainPeers(e, logf, peers)
+	}
 	e = wgengine.NewWatchdog(e)
+	if serveHandoff != nil && !args.fake && !args.kernelWG && !args.unprivileged {
+		go serveHandoff(logf, e)
+	}
+
+	opts := ipnserver.Options{
+		SocketPath:         args.socketpath,
+		Port:               41112,
+		StatePath:          statePath(),
+		Ephemeral:          args.statepath == memStatePath,
+		AutostartStateKey:  globalStateKey,
+		LegacyConfigPath:   paths.LegacyConfigPath(),
+		SurviveDisconnects: true,
+		DebugMux:           debugMux,
+		InboxDir:           inboxDir(),
+		ShutdownDrain:      args.stopDrain,
+		DERPMap:            args.derpMap,
+		LogPolicy:          pol,
+		ProbeAddr:          args.probeAddr,
+		LocalAPITokenFile:  args.tokenFile,
+		LocalAPITokenGroup: args.tokenGroup,
+	}
+	if args.connLog != "" {
+		w, err := connLogWriter(args.connLog)
+		if err != nil {
+			logf("--conn-log: %v", err)
+			return err
+		}
+		opts.ConnLog = w
+	}
+	if err := configureFile(&opts, logf); err != nil {
+		logf("--config: %v", err)
+		return err
+	}
+	watchStatic, err := configureStatic(&opts, logf)
+	if err != nil {
+		logf("--static-config: %v", err)
+		return err
+	}
+	beforeShutdown, err := configureKube(&opts, logf)
+	if err != nil {
+		logf("%v", err)
+		return err
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	// Exit gracefully by cancelling the ipnserver context in most common cases:
 	// interrupted from the TTY or killed by a service manager.
-	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
 	// SIGPIPE sometimes gets generated when CLIs disconnect from
 	// tailscaled. The default action is to terminate the process, we
@@ -167,20 +371,21 @@ func run() error {
 		select {
 		case s := <-interrupt:
 			logf("tailscaled got signal %v; shutting down", s)
+			systemd.Notify(systemd.Stopping)
+			if beforeShutdown != nil {
+				beforeShutdown()
+			}
 			cancel()
 		case <-ctx.Done():
 			// continue
 		}
 	}()
-
-	opts := ipnserver.Options{
-		SocketPath:         args.socketpath,
-		Port:               41112,
-		StatePath:          args.statepath,
-		AutostartStateKey:  globalStateKey,
-		LegacyConfigPath:   paths.LegacyConfigPath(),
-		SurviveDisconnects: true,
-		DebugMux:           debugMux,
+	if watchStatic != nil {
+		go watchStatic(ctx)
+	}
+	if err := configureSystemd(ctx, &opts, logf); err != nil {
+		logf("%v", err)
+		return err
 	}
 	err = ipnserver.Run(ctx, logf, pol.PublicID.String(), ipnserver.FixedEngine(e), opts)
 	// Cancelation is not an error: it is the only way to stop ipnserver.
@@ -192,6 +397,66 @@ func run() error {
 	return nil
 }
 
+// connLogWriter returns the writer for the connection log described
+// by the --conn-log value v.
+func connLogWriter(v string) (io.Writer, error) {
+	if v != "syslog" && !strings.HasPrefix(v, "syslog:") {
+		return nil, fmt.Errorf("unknown value %q", v)
+	}
+	facility := "daemon"
+	if i := strings.IndexByte(v, ':'); i != -1 {
+		facility = v[i+1:]
+	}
+	return logpolicy.NewSyslogWriter("tailscaled-conn", facility)
+}
+
+// runAsUser runs tailscaled again as args.user, handing it the
+// directories of the state file and socket, and returns its exit code.
+func runAsUser() int {
+	var dirs []string
+	if p := statePath(); p != "" {
+		dirs = append(dirs, filepath.Dir(p))
+	}
+	dirs = append(dirs, filepath.Dir(args.socketpath))
+	// systemd's watchdog is for this process; let the one running
+	// as the user ping it instead, and serve on the socket passed by
+	// socket activation.
+	os.Unsetenv("WATCHDOG_PID")
+	systemd.PassListeners()
+	code, err := privdrop.RunAsUser(args.user, privdrop.NetworkCaps, dirs...)
+	if err != nil {
+		log.Printf("--user=%s: %v", args.user, err)
+		return 1
+	}
+	return code
+}
+
+// statePath returns the path of the state file per the --state flag,
+// or the empty string if state is kept in memory or in a Kubernetes
+// Secret.
+func statePath() string {
+	if args.statepath == memStatePath || strings.HasPrefix(args.statepath, kubeStatePrefix) {
+		return ""
+	}
+	return args.statepath
+}
+
+// inboxDir returns the directory in which to store files received
+// from peers, per the --inbox-dir and --state flags, or the empty
+// string if receiving files is disabled.
+func inboxDir() string {
+	switch args.inboxdir {
+	case "off":
+		return ""
+	case "":
+		if statePath() == "" {
+			return ""
+		}
+		return filepath.Join(filepath.Dir(args.statepath), "files")
+	}
+	return args.inboxdir
+}
+
 func newDebugMux() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
@@ -199,6 +464,7 @@ func newDebugMux() *http.ServeMux {
 	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
 	return mux
 }
 
@@ -0,0 +1,180 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceName is the name of the Windows service tailscaled installs
+// itself as.
+const serviceName = "Tailscale"
+
+var installService, uninstallService bool
+
+func init() {
+	flag.BoolVar(&installService, "install-service", false, `install and start tailscaled, with the other flags given, as the Windows service "Tailscale", started at boot and restarted if it fails, and exit`)
+	flag.BoolVar(&uninstallService, "uninstall-service", false, `stop and remove the Windows service "Tailscale", and exit`)
+	serviceCommand = windowsServiceCommand
+	runService = runWindowsService
+}
+
+func windowsServiceCommand() bool {
+	switch {
+	case installService:
+		if args.statepath == "" {
+			log.Fatalf("--install-service requires --state")
+		}
+		if err := installWindowsService(); err != nil {
+			log.Fatalf("installing service: %v", err)
+		}
+		return true
+	case uninstallService:
+		if err := uninstallWindowsService(); err != nil {
+			log.Fatalf("uninstalling service: %v", err)
+		}
+		return true
+	}
+	return false
+}
+
+func runWindowsService() bool {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false
+	}
+	if err := svc.Run(serviceName, serviceHandler{}); err != nil {
+		log.Fatalf("running service: %v", err)
+	}
+	return true
+}
+
+// serviceHandler runs tailscaled as a Windows service.
+type serviceHandler struct{}
+
+func (serviceHandler) Execute(args []string, reqs <-chan svc.ChangeRequest, status chan<- svc.Status) (svcSpecificEC bool, exitCode uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	done := make(chan error, 1)
+	go func() { done <- run() }()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				// With the failure actions set for non-crash
+				// failures, this has the service restarted.
+				return false, 1
+			}
+			return false, 0
+		case req := <-reqs:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				select {
+				case interrupt <- syscall.SIGTERM:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// serviceConfigFailureActionsFlag is SERVICE_CONFIG_FAILURE_ACTIONS_FLAG,
+// for ChangeServiceConfig2 to take a serviceFailureActionsFlag.
+const serviceConfigFailureActionsFlag = 4
+
+// serviceFailureActionsFlag is SERVICE_FAILURE_ACTIONS_FLAG.
+type serviceFailureActionsFlag struct {
+	failureActionsOnNonCrashFailures int32
+}
+
+func installWindowsService() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %q already exists", serviceName)
+	}
+
+	var args []string
+	for _, arg := range os.Args[1:] {
+		if strings.TrimLeft(arg, "-") != "install-service" {
+			args = append(args, arg)
+		}
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "Tailscale",
+		Description: "Connects this computer to others on the Tailscale network.",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	// Restart it when it fails, backing off a little, and forget
+	// about the failures after a day.
+	restart := func(d time.Duration) mgr.RecoveryAction {
+		return mgr.RecoveryAction{Type: mgr.ServiceRestart, Delay: d}
+	}
+	actions := []mgr.RecoveryAction{restart(time.Second), restart(5 * time.Second), restart(30 * time.Second)}
+	if err := s.SetRecoveryActions(actions, uint32((24 * time.Hour).Seconds())); err != nil {
+		return fmt.Errorf("setting recovery actions: %w", err)
+	}
+	// And not only when it crashes, but when it exits with an error.
+	flag := serviceFailureActionsFlag{failureActionsOnNonCrashFailures: 1}
+	if err := windows.ChangeServiceConfig2(s.Handle, serviceConfigFailureActionsFlag, (*byte)(unsafe.Pointer(&flag))); err != nil {
+		return fmt.Errorf("setting recovery on failures: %w", err)
+	}
+	return s.Start()
+}
+
+func uninstallWindowsService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if st, err := s.Control(svc.Stop); err == nil {
+		for deadline := time.Now().Add(30 * time.Second); st.State != svc.Stopped; {
+			if time.Now().After(deadline) {
+				return errors.New("timed out waiting for the service to stop")
+			}
+			time.Sleep(100 * time.Millisecond)
+			if st, err = s.Query(); err != nil {
+				return err
+			}
+		}
+	}
+	return s.Delete()
+}
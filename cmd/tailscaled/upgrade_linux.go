@@ -0,0 +1,155 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"tailscale.com/safesocket"
+	"tailscale.com/types/logger"
+	"tailscale.com/util/handoff"
+	"tailscale.com/util/systemd"
+	"tailscale.com/wgengine"
+)
+
+// handoffTimeout is how long either tailscaled waits for the other
+// in an upgrade: the old one for the new one to start its engine, and
+// the new one for the old one to exit.
+const handoffTimeout = 30 * time.Second
+
+// systemdEnv are the environment variables passed to a new
+// tailscaled, which likely wasn't started by systemd, so that it can
+// tell systemd it's the service's main process now and keep pinging
+// its watchdog.
+var systemdEnv = []string{"NOTIFY_SOCKET", "WATCHDOG_USEC"}
+
+// handoffState is what tailscaled passes to a new tailscaled taking
+// over from it, besides the engine's files.
+type handoffState struct {
+	Engine *wgengine.Handoff
+	Env    map[string]string // of systemdEnv
+}
+
+func init() {
+	takeOver = receiveHandoff
+	serveHandoff = runHandoffServer
+}
+
+// handoffPath returns the path of the unix socket on which tailscaled
+// waits for a new tailscaled to take over from it.
+func handoffPath() string {
+	return args.socketpath + ".handoff"
+}
+
+// runHandoffServer waits for a new tailscaled to take over from this
+// one, handing it e's TUN device and sockets, and exits once it has.
+func runHandoffServer(logf logger.Logf, e wgengine.Engine) {
+	ln, err := handoff.Listen(handoffPath())
+	if err != nil {
+		logf("upgrade: not accepting upgrades: %v", err)
+		return
+	}
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			logf("upgrade: %v", err)
+			return
+		}
+		// The socket's mode already keeps other users out; check
+		// anyway, as they'd be handed the TUN device.
+		if pc, ok := safesocket.ConnPeerCreds(c.UnixConn()); !ok || pc.UID != strconv.Itoa(os.Getuid()) {
+			logf("upgrade: refusing handoff to uid %q, pid %d", pc.UID, pc.Pid)
+			c.Close()
+			continue
+		}
+		if err := handOff(c, e); err != nil {
+			logf("upgrade: new tailscaled didn't take over, carrying on: %v", err)
+			c.Close()
+			continue
+		}
+		// The TUN device's addresses and routes, the routing
+		// rules and the netfilter rules are now the new
+		// tailscaled's, so exit without tearing them down.
+		logf("upgrade: new tailscaled took over; exiting")
+		os.Exit(0)
+	}
+}
+
+func handOff(c *handoff.Conn, e wgengine.Engine) error {
+	h, err := e.Handoff()
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	st := handoffState{
+		Engine: h,
+		Env:    make(map[string]string),
+	}
+	for _, k := range systemdEnv {
+		if v, ok := os.LookupEnv(k); ok {
+			st.Env[k] = v
+		}
+	}
+	if err := c.Send(st, h.Files()); err != nil {
+		return err
+	}
+	return c.WaitAck(handoffTimeout)
+}
+
+// receiveHandoff takes over from the running tailscaled, returning an
+// engine carrying on with its TUN device and sockets once it's exited.
+func receiveHandoff(logf logger.Logf) (wgengine.Engine, error) {
+	c, err := handoff.Dial(handoffPath())
+	if err != nil {
+		return nil, fmt.Errorf("--upgrade: connecting to running tailscaled: %w", err)
+	}
+	defer c.Close()
+
+	var st handoffState
+	files, err := c.Receive(&st)
+	if err != nil {
+		return nil, fmt.Errorf("--upgrade: %w", err)
+	}
+	h := st.Engine
+	if h == nil {
+		err = errors.New("no engine state")
+	} else {
+		err = h.SetFiles(files)
+	}
+	if err != nil {
+		for _, f := range files {
+			f.Close()
+		}
+		return nil, fmt.Errorf("--upgrade: %w", err)
+	}
+	// Closing c without an ack, on error, tells the old tailscaled
+	// to carry on.
+	e, err := wgengine.NewHandoffEngine(logf, h, args.port)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(st.Env) > 0 {
+		for k, v := range st.Env {
+			os.Setenv(k, v)
+		}
+		os.Unsetenv("WATCHDOG_PID")
+		if err := systemd.Notify(systemd.MainPID(os.Getpid())); err != nil {
+			logf("upgrade: telling systemd: %v", err)
+		}
+	}
+	if err := c.Ack(); err != nil {
+		logf("upgrade: %v", err)
+	}
+	if err := c.WaitClose(handoffTimeout); err != nil {
+		logf("upgrade: waiting for old tailscaled to exit: %v", err)
+	}
+	logf("upgrade: took over from old tailscaled")
+	return e, nil
+}
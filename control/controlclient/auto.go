@@ -12,6 +12,7 @@ package controlclient
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
 	"sync"
@@ -67,6 +68,7 @@ type Status struct {
 	_             structs.Incomparable
 	LoginFinished *empty.Message
 	Err           string
+	LoginErr      string // if non-empty, control refused to log in (see LoginError)
 	URL           string
 	Persist       *Persist          // locally persisted configuration
 	NetMap        *NetworkMap       // server-pushed configuration
@@ -82,6 +84,7 @@ func (s *Status) Equal(s2 *Status) bool {
 	return s != nil && s2 != nil &&
 		(s.LoginFinished == nil) == (s2.LoginFinished == nil) &&
 		s.Err == s2.Err &&
+		s.LoginErr == s2.LoginErr &&
 		s.URL == s2.URL &&
 		reflect.DeepEqual(s.Persist, s2.Persist) &&
 		reflect.DeepEqual(s.NetMap, s2.NetMap) &&
@@ -338,7 +341,17 @@ func (c *Client) authRoutine() {
 				url, err = c.direct.TryLogin(ctx, goal.token, goal.flags)
 				f = "TryLogin"
 			}
-			if err != nil {
+			var lerr *LoginError
+			if errors.As(err, &lerr) {
+				// Retrying won't help; wait for the user
+				// to log in again with other credentials.
+				c.mu.Lock()
+				c.loginGoal = nil
+				c.state = StateNotAuthenticated
+				c.mu.Unlock()
+				report(err, f)
+				continue
+			} else if err != nil {
 				report(err, f)
 				bo.BackOff(ctx, err)
 				continue
@@ -596,6 +609,10 @@ func (c *Client) sendStatus(who string, err error, url string, nm *NetworkMap) {
 	}
 	if err != nil {
 		new.Err = err.Error()
+		var lerr *LoginError
+		if errors.As(err, &lerr) {
+			new.LoginErr = lerr.Msg
+		}
 	}
 	if statusFunc != nil {
 		statusFunc(new)
@@ -639,6 +656,30 @@ func (c *Client) UpdateEndpoints(localPort uint16, endpoints []string) {
 	}
 }
 
+// SetDNS asks control to add a DNS record on behalf of this node.
+// See Direct.SetDNS.
+func (c *Client) SetDNS(ctx context.Context, req *tailcfg.SetDNSRequest) error {
+	return c.direct.SetDNS(ctx, req)
+}
+
+// SubmitKeySignature sends control a network lock signature of
+// another node's key. See Direct.SubmitKeySignature.
+func (c *Client) SubmitKeySignature(ctx context.Context, nk tailcfg.NodeKey, sig string) error {
+	return c.direct.SubmitKeySignature(ctx, nk, sig)
+}
+
+// ExpireNodeKey asks control to expire the node key now.
+// See Direct.ExpireNodeKey.
+func (c *Client) ExpireNodeKey(ctx context.Context) error {
+	return c.direct.ExpireNodeKey(ctx)
+}
+
+// SendGoingOffline tells control that the node is about to shut
+// down on purpose. See Direct.SendGoingOffline.
+func (c *Client) SendGoingOffline(ctx context.Context) error {
+	return c.direct.SendGoingOffline(ctx)
+}
+
 func (c *Client) Shutdown() {
 	c.logf("client.Shutdown()")
 
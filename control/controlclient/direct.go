@@ -37,6 +37,7 @@ import (
 	"inet.af/netaddr"
 	"tailscale.com/log/logheap"
 	"tailscale.com/net/dnscache"
+	"tailscale.com/net/nat64"
 	"tailscale.com/net/netns"
 	"tailscale.com/net/tlsdial"
 	"tailscale.com/net/tshttpproxy"
@@ -116,6 +117,8 @@ type Direct struct {
 	discoPubKey     tailcfg.DiscoKey
 	machinePrivKey  wgcfg.PrivateKey
 	debugFlags      []string
+	ephemeral       bool
+	static          *StaticMap // if non-nil, used instead of a server
 
 	mu           sync.Mutex // mutex guards the following fields
 	serverKey    wgcfg.Key
@@ -143,6 +146,11 @@ type Options struct {
 	Logf              logger.Logf
 	HTTPTestClient    *http.Client // optional HTTP client to use (for tests only)
 	DebugFlags        []string     // debug settings to send to control
+	Ephemeral         bool         // register as an ephemeral node
+
+	// Static, if non-nil, is where the client gets its network map
+	// from instead of a control server, which it then never talks to.
+	Static *StaticMap
 }
 
 type Decompressor interface {
@@ -152,7 +160,7 @@ type Decompressor interface {
 
 // NewDirect returns a new Direct client.
 func NewDirect(opts Options) (*Direct, error) {
-	if opts.ServerURL == "" {
+	if opts.ServerURL == "" && opts.Static == nil {
 		return nil, errors.New("controlclient.New: no server URL specified")
 	}
 	if opts.MachinePrivateKey.IsZero() {
@@ -182,7 +190,7 @@ func NewDirect(opts Options) (*Direct, error) {
 		tr := http.DefaultTransport.(*http.Transport).Clone()
 		tr.Proxy = tshttpproxy.ProxyFromEnvironment
 		tshttpproxy.SetTransportGetProxyConnectHeader(tr)
-		tr.DialContext = dnscache.Dialer(dialer.DialContext, dnsCache)
+		tr.DialContext = dnscache.Dialer(dnscache.DialContextFunc(nat64.Dialer(dialer.DialContext)), dnsCache)
 		tr.ForceAttemptHTTP2 = true
 		tr.TLSClientConfig = tlsdial.Config(serverURL.Host, tr.TLSClientConfig)
 		httpc = &http.Client{Transport: tr}
@@ -200,6 +208,8 @@ func NewDirect(opts Options) (*Direct, error) {
 		authKey:         opts.AuthKey,
 		discoPubKey:     opts.DiscoPublicKey,
 		debugFlags:      opts.DebugFlags,
+		ephemeral:       opts.Ephemeral,
+		static:          opts.Static,
 	}
 	if opts.Hostinfo == nil {
 		c.SetHostinfo(NewHostinfo())
@@ -272,9 +282,19 @@ func (c *Direct) GetPersist() Persist {
 
 type LoginFlags int
 
+// A LoginError is returned when the control server refuses to log
+// in, such as because the auth key is invalid or was already used.
+// Unlike other login errors, retrying won't help.
+type LoginError struct {
+	Msg string // the server's explanation
+}
+
+func (e *LoginError) Error() string { return "login refused: " + e.Msg }
+
 const (
 	LoginDefault     = LoginFlags(0)
 	LoginInteractive = LoginFlags(1 << iota) // force user login and key refresh
+	LoginRenewKey                            // key refresh without user login
 )
 
 func (c *Direct) TryLogout(ctx context.Context) error {
@@ -326,6 +346,10 @@ func (c *Direct) doLogin(ctx context.Context, t *oauth2.Token, flags LoginFlags,
 	if c.machinePrivKey.IsZero() {
 		return false, "", errors.New("controlclient.Direct requires a machine private key")
 	}
+	if c.static != nil {
+		c.staticLogin()
+		return false, "", nil
+	}
 
 	if expired {
 		c.logf("Old key expired -> regen=true")
@@ -335,6 +359,10 @@ func (c *Direct) doLogin(ctx context.Context, t *oauth2.Token, flags LoginFlags,
 		c.logf("LoginInteractive -> regen=true")
 		regen = true
 	}
+	if (flags & LoginRenewKey) != 0 {
+		c.logf("LoginRenewKey -> regen=true")
+		regen = true
+	}
 
 	c.logf("doLogin(regen=%v, hasUrl=%v)", regen, url != "")
 	if serverKey == (wgcfg.Key{}) {
@@ -381,6 +409,7 @@ func (c *Direct) doLogin(ctx context.Context, t *oauth2.Token, flags LoginFlags,
 		NodeKey:    tailcfg.NodeKey(tryingNewKey.Public()),
 		Hostinfo:   hostinfo,
 		Followup:   url,
+		Ephemeral:  c.ephemeral,
 	}
 	c.logf("RegisterReq: onode=%v node=%v fup=%v",
 		request.OldNodeKey.ShortString(),
@@ -421,6 +450,9 @@ func (c *Direct) doLogin(ctx context.Context, t *oauth2.Token, flags LoginFlags,
 	c.logf("RegisterReq: got response; nodeKeyExpired=%v, machineAuthorized=%v; authURL=%v",
 		resp.NodeKeyExpired, resp.MachineAuthorized, resp.AuthURL != "")
 
+	if resp.Error != "" {
+		return regen, "", &LoginError{Msg: resp.Error}
+	}
 	if resp.NodeKeyExpired {
 		if regen {
 			return true, "", fmt.Errorf("weird: regen=true but server says NodeKeyExpired: %v", request.NodeKey)
@@ -444,14 +476,25 @@ func (c *Direct) doLogin(ctx context.Context, t *oauth2.Token, flags LoginFlags,
 
 	if resp.AuthURL != "" {
 		c.logf("AuthURL is %v", resp.AuthURL)
+		if authKey != "" {
+			c.logf("auth key not accepted; interactive login required")
+		}
 	} else {
 		c.logf("No AuthURL")
 	}
+	if ki := resp.AuthKey; ki != nil && authKey != "" && resp.AuthURL == "" {
+		logAuthKeyInfo(c.logf, ki, hostinfo.RequestTags)
+	}
 
 	c.mu.Lock()
 	if resp.AuthURL == "" {
 		// key rotation is complete
 		persist.PrivateNodeKey = tryingNewKey
+		if ki := resp.AuthKey; ki != nil && !ki.Reusable && c.authKey == authKey {
+			// A single-use key is spent now; sending it again
+			// on a later re-registration would only fail.
+			c.authKey = ""
+		}
 	} else {
 		// save it for the retry-with-URL
 		c.tryingNewKey = tryingNewKey
@@ -518,6 +561,9 @@ func inTest() bool { return flag.Lookup("test.v") != nil }
 // maxPolls is how many network maps to download; common values are 1
 // or -1 (to keep a long-poll query open to the server).
 func (c *Direct) PollNetMap(ctx context.Context, maxPolls int, cb func(*NetworkMap)) error {
+	if c.static != nil {
+		return c.pollStatic(ctx, maxPolls, cb)
+	}
 	c.mu.Lock()
 	persist := c.persist
 	serverURL := c.serverURL
@@ -536,13 +582,13 @@ func (c *Direct) PollNetMap(ctx context.Context, maxPolls int, cb func(*NetworkM
 	allowStream := maxPolls != 1
 	c.logf("PollNetMap: stream=%v :%v ep=%v", allowStream, localPort, ep)
 
-	vlogf := logger.Discard
+	vlogf := logger.ComponentDebug(c.logf, "control")
 	if Debug.NetMap {
 		vlogf = c.logf
 	}
 
 	request := tailcfg.MapRequest{
-		Version:    6,
+		Version:    7,
 		KeepAlive:  c.keepAlive,
 		NodeKey:    tailcfg.NodeKey(persist.PrivateNodeKey.Public()),
 		DiscoKey:   c.discoPubKey,
@@ -636,6 +682,8 @@ func (c *Direct) PollNetMap(ctx context.Context, maxPolls int, cb func(*NetworkM
 	}()
 
 	var lastDERPMap *tailcfg.DERPMap
+	var lastKeyAuthority []string
+	var lastSSHPolicy *tailcfg.SSHPolicy
 	var lastUserProfile = map[tailcfg.UserID]tailcfg.UserProfile{}
 	var lastParsedPacketFilter []filter.Match
 
@@ -685,6 +733,9 @@ func (c *Direct) PollNetMap(ctx context.Context, maxPolls int, cb func(*NetworkM
 			continue
 		}
 
+		if len(resp.Peers) == 0 {
+			vlogf("netmap: delta: %d changed, %d patched, %d removed", len(resp.PeersChanged), len(resp.PeersChangedPatch), len(resp.PeersRemoved))
+		}
 		undeltaPeers(&resp, previousPeers)
 		previousPeers = cloneNodes(resp.Peers) // defensive/lazy clone, since this escapes to who knows where
 		for _, up := range resp.UserProfiles {
@@ -695,12 +746,19 @@ func (c *Direct) PollNetMap(ctx context.Context, maxPolls int, cb func(*NetworkM
 			vlogf("netmap: new map contains DERP map")
 			lastDERPMap = resp.DERPMap
 		}
+		if resp.KeyAuthority != nil {
+			lastKeyAuthority = resp.KeyAuthority
+		}
+		if resp.SSHPolicy != nil {
+			lastSSHPolicy = resp.SSHPolicy
+		}
 		if resp.Debug != nil {
 			if resp.Debug.LogHeapPprof {
 				go logheap.LogHeap(resp.Debug.LogHeapURL)
 			}
 			setControlAtomic(&controlUseDERPRoute, resp.Debug.DERPRoute)
 			setControlAtomic(&controlTrimWGConfig, resp.Debug.TrimWGConfig)
+			atomic.StoreInt64(&controlLazyPeerIdleSeconds, int64(resp.Debug.LazyPeerIdleSeconds))
 		}
 		// Temporarily (2020-06-29) support removing all but
 		// discovery-supporting nodes during development, for
@@ -724,6 +782,7 @@ func (c *Direct) PollNetMap(ctx context.Context, maxPolls int, cb func(*NetworkM
 			PrivateKey:   persist.PrivateNodeKey,
 			MachineKey:   machinePubKey,
 			Expiry:       resp.Node.KeyExpiry,
+			KeyRenewal:   resp.KeyRenewal,
 			Name:         resp.Node.Name,
 			Addresses:    resp.Node.Addresses,
 			Peers:        resp.Peers,
@@ -735,6 +794,9 @@ func (c *Direct) PollNetMap(ctx context.Context, maxPolls int, cb func(*NetworkM
 			Hostinfo:     resp.Node.Hostinfo,
 			PacketFilter: lastParsedPacketFilter,
 			DERPMap:      lastDERPMap,
+			KeySignature: resp.Node.KeySignature,
+			KeyAuthority: lastKeyAuthority,
+			SSHPolicy:    lastSSHPolicy,
 			Debug:        resp.Debug,
 		}
 		addUserProfile := func(userID tailcfg.UserID) {
@@ -788,6 +850,218 @@ func (c *Direct) PollNetMap(ctx context.Context, maxPolls int, cb func(*NetworkM
 	return nil
 }
 
+// SetDNS asks control to add the DNS record described by req, on
+// behalf of this node. It's used to complete ACME DNS-01 challenges.
+func (c *Direct) SetDNS(ctx context.Context, req *tailcfg.SetDNSRequest) error {
+	if c.static != nil {
+		return errNoServer
+	}
+	c.mu.Lock()
+	persist := c.persist
+	serverURL := c.serverURL
+	serverKey := c.serverKey
+	c.mu.Unlock()
+
+	if persist.PrivateNodeKey.IsZero() {
+		return errors.New("not logged in")
+	}
+	r := *req
+	r.Version = 6
+	r.NodeKey = tailcfg.NodeKey(persist.PrivateNodeKey.Public())
+	bodyData, err := encode(r, &serverKey, &c.machinePrivKey)
+	if err != nil {
+		return err
+	}
+	machinePubKey := tailcfg.MachineKey(c.machinePrivKey.Public())
+	u := fmt.Sprintf("%s/machine/%s/set-dns", serverURL, machinePubKey.HexString())
+	hreq, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(bodyData))
+	if err != nil {
+		return err
+	}
+	res, err := c.httpc.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return fmt.Errorf("set-dns: %d: %s", res.StatusCode, msg)
+	}
+	return nil
+}
+
+// SubmitKeySignature sends control the network lock signature sig of
+// the node key nk, made by this node's signing key, for control to
+// hand out as that node's Node.KeySignature.
+func (c *Direct) SubmitKeySignature(ctx context.Context, nk tailcfg.NodeKey, sig string) error {
+	if c.static != nil {
+		return errNoServer
+	}
+	c.mu.Lock()
+	persist := c.persist
+	serverURL := c.serverURL
+	serverKey := c.serverKey
+	c.mu.Unlock()
+
+	if persist.PrivateNodeKey.IsZero() {
+		return errors.New("not logged in")
+	}
+	req := tailcfg.TKASignRequest{
+		Version:   6,
+		NodeKey:   tailcfg.NodeKey(persist.PrivateNodeKey.Public()),
+		SignedKey: nk,
+		Signature: sig,
+	}
+	bodyData, err := encode(req, &serverKey, &c.machinePrivKey)
+	if err != nil {
+		return err
+	}
+	machinePubKey := tailcfg.MachineKey(c.machinePrivKey.Public())
+	u := fmt.Sprintf("%s/machine/%s/tka-sign", serverURL, machinePubKey.HexString())
+	hreq, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(bodyData))
+	if err != nil {
+		return err
+	}
+	res, err := c.httpc.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return fmt.Errorf("tka-sign: %d: %s", res.StatusCode, msg)
+	}
+	return nil
+}
+
+// logAuthKeyInfo logs the properties of the auth key the node
+// registered with, and warns about requested tags that a tagged key
+// didn't grant.
+func logAuthKeyInfo(logf logger.Logf, ki *tailcfg.AuthKeyInfo, requestedTags []string) {
+	logf("auth key: reusable=%v ephemeral=%v preauthorized=%v tags=%v",
+		ki.Reusable, ki.Ephemeral, ki.Preauthorized, ki.Tags)
+	if !ki.Expires.IsZero() {
+		logf("auth key expires %v", ki.Expires.Format(time.RFC3339))
+	}
+	if len(ki.Tags) == 0 {
+		return
+	}
+	for _, t := range requestedTags {
+		found := false
+		for _, kt := range ki.Tags {
+			if kt == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			logf("warning: requested tag %q isn't one of the auth key's tags", t)
+		}
+	}
+}
+
+// SendGoingOffline tells the control server that the node is about
+// to shut down on purpose, with a map request marked GoingOffline
+// whose Hostinfo advertises no routes, so that they fail over to
+// other routers at once.
+func (c *Direct) SendGoingOffline(ctx context.Context) error {
+	if c.static != nil {
+		return errNoServer
+	}
+	c.mu.Lock()
+	persist := c.persist
+	serverURL := c.serverURL
+	serverKey := c.serverKey
+	hostinfo := c.hostinfo.Clone()
+	ep := append([]string(nil), c.endpoints...)
+	c.mu.Unlock()
+
+	if persist.PrivateNodeKey.IsZero() {
+		return errors.New("not logged in")
+	}
+	if hostinfo != nil {
+		hostinfo.RoutableIPs = nil
+	}
+	request := tailcfg.MapRequest{
+		Version:      7,
+		NodeKey:      tailcfg.NodeKey(persist.PrivateNodeKey.Public()),
+		DiscoKey:     c.discoPubKey,
+		Endpoints:    ep,
+		Hostinfo:     hostinfo,
+		OmitPeers:    true,
+		GoingOffline: true,
+	}
+	bodyData, err := encode(request, &serverKey, &c.machinePrivKey)
+	if err != nil {
+		return err
+	}
+	machinePubKey := tailcfg.MachineKey(c.machinePrivKey.Public())
+	u := fmt.Sprintf("%s/machine/%s/map", serverURL, machinePubKey.HexString())
+	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(bodyData))
+	if err != nil {
+		return err
+	}
+	res, err := c.httpc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return fmt.Errorf("going-offline map request: %d: %s", res.StatusCode, msg)
+	}
+	return nil
+}
+
+// ExpireNodeKey asks the control server to expire the current node
+// key immediately, which deletes the node if it's ephemeral. Unlike
+// TryLogout, it doesn't forget the key locally.
+func (c *Direct) ExpireNodeKey(ctx context.Context) error {
+	if c.static != nil {
+		return errNoServer
+	}
+	c.mu.Lock()
+	persist := c.persist
+	serverKey := c.serverKey
+	hostinfo := c.hostinfo.Clone()
+	c.mu.Unlock()
+
+	if persist.PrivateNodeKey.IsZero() {
+		return errors.New("not logged in")
+	}
+	if serverKey == (wgcfg.Key{}) {
+		return errors.New("no server key")
+	}
+	request := tailcfg.RegisterRequest{
+		Version:   1,
+		NodeKey:   tailcfg.NodeKey(persist.PrivateNodeKey.Public()),
+		Hostinfo:  hostinfo,
+		Expiry:    time.Unix(123, 0), // any time in the past
+		Ephemeral: c.ephemeral,
+	}
+	request.Auth.Provider = persist.Provider
+	request.Auth.LoginName = persist.LoginName
+	bodyData, err := encode(request, &serverKey, &c.machinePrivKey)
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf("%s/machine/%s", c.serverURL, c.machinePrivKey.Public().HexString())
+	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(bodyData))
+	if err != nil {
+		return err
+	}
+	res, err := c.httpc.Do(req)
+	if err != nil {
+		return fmt.Errorf("expire request: %v", err)
+	}
+	var resp tailcfg.RegisterResponse
+	if err := decode(res, &resp, &serverKey, &c.machinePrivKey); err != nil {
+		return fmt.Errorf("expire request: %v", err)
+	}
+	c.logf("node key %v expired", request.NodeKey.ShortString())
+	return nil
+}
+
 func decode(res *http.Response, v interface{}, serverKey *wgcfg.Key, mkey *wgcfg.PrivateKey) error {
 	defer res.Body.Close()
 	msg, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
@@ -962,8 +1236,10 @@ func envBool(k string) bool {
 }
 
 // undeltaPeers updates mapRes.Peers to be complete based on the provided previous peer list
-// and the PeersRemoved and PeersChanged fields in mapRes.
+// and the PeersRemoved, PeersChanged and PeersChangedPatch fields in mapRes.
 // It then also nils out the delta fields.
+//
+// Nodes in prev are not modified; patched peers are cloned first.
 func undeltaPeers(mapRes *tailcfg.MapResponse, prev []*tailcfg.Node) {
 	if len(mapRes.Peers) > 0 {
 		// Not delta encoded.
@@ -971,8 +1247,12 @@ func undeltaPeers(mapRes *tailcfg.MapResponse, prev []*tailcfg.Node) {
 			log.Printf("netmap: undeltaPeers: MapResponse.Peers not sorted; sorting")
 			sortNodes(mapRes.Peers)
 		}
+		mapRes.PeersChanged = nil
+		mapRes.PeersRemoved = nil
+		mapRes.PeersChangedPatch = nil
 		return
 	}
+	defer applyPeerPatches(mapRes)
 
 	var removed map[tailcfg.NodeID]bool
 	if pr := mapRes.PeersRemoved; len(pr) > 0 {
@@ -1031,6 +1311,46 @@ func undeltaPeers(mapRes *tailcfg.MapResponse, prev []*tailcfg.Node) {
 	mapRes.PeersRemoved = nil
 }
 
+// applyPeerPatches applies mapRes.PeersChangedPatch to the
+// (already undeltaed) mapRes.Peers and then nils it out.
+func applyPeerPatches(mapRes *tailcfg.MapResponse) {
+	patches := mapRes.PeersChangedPatch
+	mapRes.PeersChangedPatch = nil
+	if len(patches) == 0 {
+		return
+	}
+	// Peers may alias the caller's previous peer list, so copy it
+	// before replacing any of its nodes.
+	peers := append([]*tailcfg.Node(nil), mapRes.Peers...)
+	for _, pc := range patches {
+		i := sort.Search(len(peers), func(i int) bool { return peers[i].ID >= pc.NodeID })
+		if i == len(peers) || peers[i].ID != pc.NodeID {
+			log.Printf("netmap: undeltaPeers: patch for unknown peer %v; ignoring", pc.NodeID)
+			continue
+		}
+		n := peers[i].Clone()
+		if pc.DERPRegion != 0 {
+			n.DERP = fmt.Sprintf("127.3.3.40:%v", pc.DERPRegion) // magicsock.DerpMagicIP
+		}
+		if pc.Endpoints != nil {
+			n.Endpoints = append([]string(nil), pc.Endpoints...)
+		}
+		if pc.DiscoKey != nil {
+			n.DiscoKey = *pc.DiscoKey
+		}
+		if pc.LastSeen != nil {
+			t := *pc.LastSeen
+			n.LastSeen = &t
+		}
+		if pc.Online != nil {
+			v := *pc.Online
+			n.Online = &v
+		}
+		peers[i] = n
+	}
+	mapRes.Peers = peers
+}
+
 func nodesSorted(v []*tailcfg.Node) bool {
 	for i, n := range v {
 		if i > 0 && n.ID <= v[i-1].ID {
@@ -1061,6 +1381,10 @@ var (
 	controlTrimWGConfig atomic.Value
 )
 
+// controlLazyPeerIdleSeconds is the last LazyPeerIdleSeconds from
+// control. It's accessed atomically.
+var controlLazyPeerIdleSeconds int64
+
 func setControlAtomic(dst *atomic.Value, v opt.Bool) {
 	old, ok := dst.Load().(opt.Bool)
 	if !ok || old != v {
@@ -1082,6 +1406,13 @@ func TrimWGConfig() opt.Bool {
 	return v
 }
 
+// LazyPeerIdleThreshold reports the last value from control for how
+// long a peer may be idle before lazy wireguard configuration removes
+// it. Zero means control didn't say.
+func LazyPeerIdleThreshold() time.Duration {
+	return time.Duration(atomic.LoadInt64(&controlLazyPeerIdleSeconds)) * time.Second
+}
+
 // ipForwardingBroken reports whether the system's IP forwarding is disabled
 // and will definitely not work for the routes provided.
 //
@@ -1091,18 +1422,24 @@ func ipForwardingBroken(routes []wgcfg.CIDR) bool {
 		// Nothing to route, so no need to warn.
 		return false
 	}
-	if runtime.GOOS != "linux" {
-		// We only do subnet routing on Linux for now.
+	var out []byte
+	var err error
+	switch runtime.GOOS {
+	case "linux":
+		out, err = ioutil.ReadFile("/proc/sys/net/ipv4/ip_forward")
+		if err != nil {
+			// Try another way.
+			out, err = exec.Command("sysctl", "-n", "net.ipv4.ip_forward").Output()
+		}
+	case "freebsd", "openbsd":
+		out, err = exec.Command("sysctl", "-n", "net.inet.ip.forwarding").Output()
+	default:
+		// We only do subnet routing on Linux and the BSDs for now.
 		// It might work on darwin/macOS when building from source, so
 		// don't return true for other OSes. We can OS-based warnings
 		// already in the admin panel.
 		return false
 	}
-	out, err := ioutil.ReadFile("/proc/sys/net/ipv4/ip_forward")
-	if err != nil {
-		// Try another way.
-		out, err = exec.Command("sysctl", "-n", "net.ipv4.ip_forward").Output()
-	}
 	if err != nil {
 		// Oh well, we tried. This is just for debugging.
 		// We don't want false positives.
@@ -64,6 +64,35 @@ func TestUndeltaPeers(t *testing.T) {
 			},
 			want: peers(n(1, "foo2")),
 		},
+		{
+			name: "patch_endpoints",
+			prev: peers(n(1, "foo"), n(2, "bar")),
+			mapRes: &tailcfg.MapResponse{
+				PeersChangedPatch: []*tailcfg.PeerChange{{
+					NodeID:     2,
+					DERPRegion: 3,
+					Endpoints:  []string{"1.2.3.4:41641"},
+				}},
+			},
+			want: peers(n(1, "foo"), &tailcfg.Node{
+				ID:        2,
+				Name:      "bar",
+				DERP:      "127.3.3.40:3",
+				Endpoints: []string{"1.2.3.4:41641"},
+			}),
+		},
+		{
+			name: "patch_and_remove",
+			prev: peers(n(1, "foo"), n(2, "bar")),
+			mapRes: &tailcfg.MapResponse{
+				PeersRemoved: []tailcfg.NodeID{1},
+				PeersChangedPatch: []*tailcfg.PeerChange{
+					{NodeID: 1, DERPRegion: 1},
+					{NodeID: 2, Endpoints: []string{"5.6.7.8:1"}},
+				},
+			},
+			want: peers(&tailcfg.Node{ID: 2, Name: "bar", Endpoints: []string{"5.6.7.8:1"}}),
+		},
 		{
 			name:   "unchanged",
 			prev:   peers(n(1, "foo"), n(2, "bar")),
@@ -73,7 +102,11 @@ func TestUndeltaPeers(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			prevClone := cloneNodes(tt.prev)
 			undeltaPeers(tt.mapRes, tt.prev)
+			if !reflect.DeepEqual(tt.prev, prevClone) {
+				t.Errorf("prev modified\n got: %s\nwant: %s", formatNodes(tt.prev), formatNodes(prevClone))
+			}
 			if !reflect.DeepEqual(tt.mapRes.Peers, tt.want) {
 				t.Errorf("wrong results\n got: %s\nwant: %s", formatNodes(tt.mapRes.Peers), formatNodes(tt.want))
 			}
@@ -25,6 +25,9 @@ type NetworkMap struct {
 	NodeKey    tailcfg.NodeKey
 	PrivateKey wgcfg.PrivateKey
 	Expiry     time.Time
+	// KeyRenewal is whether the node key can be renewed before
+	// Expiry without user interaction.
+	KeyRenewal bool
 	// Name is the DNS name assigned to this node.
 	Name          string
 	Addresses     []wgcfg.CIDR
@@ -40,6 +43,17 @@ type NetworkMap struct {
 	// between updates and should not be modified.
 	DERPMap *tailcfg.DERPMap
 
+	// KeySignature is this node's network lock signature, from its
+	// tailcfg.Node.
+	KeySignature string
+	// KeyAuthority is the last MapResponse.KeyAuthority received,
+	// the tailnet's chain of network lock updates.
+	KeyAuthority []string
+
+	// SSHPolicy is the last MapResponse.SSHPolicy received, or nil
+	// if none has been. It should not be modified.
+	SSHPolicy *tailcfg.SSHPolicy
+
 	// Debug knobs from control server for debug or feature gating.
 	Debug *tailcfg.Debug
 
@@ -0,0 +1,83 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/tailcfg"
+)
+
+// TestSelfHostedControl registers a node with a real control server,
+// such as a local headscale instance, and checks that it gets a
+// usable network map. It runs only when TS_TEST_CONTROL_URL and
+// TS_TEST_AUTHKEY (a reusable, pre-authorized key) are set.
+func TestSelfHostedControl(t *testing.T) {
+	serverURL := os.Getenv("TS_TEST_CONTROL_URL")
+	authKey := os.Getenv("TS_TEST_AUTHKEY")
+	if serverURL == "" || authKey == "" {
+		t.Skip("TS_TEST_CONTROL_URL and TS_TEST_AUTHKEY not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	mkey, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hi := NewHostinfo()
+	hi.BackendLogID = "selfhosted-test"
+	c, err := NewDirect(Options{
+		ServerURL:         serverURL,
+		AuthKey:           authKey,
+		MachinePrivateKey: mkey,
+		Hostinfo:          hi,
+		Logf:              t.Logf,
+		Ephemeral:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url, err := c.TryLogin(ctx, nil, LoginDefault)
+	if err != nil {
+		t.Fatalf("TryLogin: %v", err)
+	}
+	if url != "" {
+		t.Fatalf("auth key login wants interactive login at %s", url)
+	}
+	defer func() {
+		if err := c.ExpireNodeKey(context.Background()); err != nil {
+			t.Logf("ExpireNodeKey: %v", err)
+		}
+	}()
+
+	var nm *NetworkMap
+	if err := c.PollNetMap(ctx, 1, func(m *NetworkMap) { nm = m }); err != nil {
+		t.Fatalf("PollNetMap: %v", err)
+	}
+	if nm == nil {
+		t.Fatal("no network map")
+	}
+	if len(nm.Addresses) == 0 {
+		t.Error("network map has no addresses for this node")
+	}
+	if nm.DERPMap == nil || len(nm.DERPMap.Regions) == 0 {
+		t.Error("network map has no DERP regions")
+	}
+	if nm.MachineStatus != tailcfg.MachineAuthorized {
+		t.Errorf("machine status = %v; want authorized (use a pre-authorized key)", nm.MachineStatus)
+	}
+
+	// Servers that don't know GoingOffline take it as a plain,
+	// non-streaming map request.
+	if err := c.SendGoingOffline(ctx); err != nil {
+		t.Errorf("SendGoingOffline: %v", err)
+	}
+}
@@ -0,0 +1,311 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/tailcfg"
+	"tailscale.com/wgengine/filter"
+)
+
+// StaticConfig is a network map configured locally rather than by a
+// control server, for networks such as air-gapped labs that have
+// none. It's read from JSON such as:
+//
+//	{
+//		"PrivateKey": "privkey:6f0e...",
+//		"Name": "lab1.lab.",
+//		"Addresses": ["100.64.0.1/32"],
+//		"Peers": [{
+//			"Name": "lab2.lab.",
+//			"PublicKey": "nodekey:3b1a...",
+//			"Addresses": ["100.64.0.2/32"],
+//			"Routes": ["10.2.0.0/16"],
+//			"Endpoints": ["192.168.0.2:41641"]
+//		}],
+//		"PacketFilter": [{"SrcIPs": ["*"], "DstPorts": [{"IP": "*", "Ports": {"First": 22, "Last": 22}}]}]
+//	}
+//
+// Keys are either hex with their type's prefix, as tailscale prints
+// them, or base64, as wg(8) does.
+type StaticConfig struct {
+	// PrivateKey is this node's private node key, which its peers
+	// know the public half of.
+	PrivateKey string
+
+	// Name is this node's DNS name.
+	Name string
+
+	// Addresses are this node's tailnet addresses.
+	Addresses []wgcfg.CIDR
+
+	// Peers are the nodes this node connects to.
+	Peers []StaticPeer
+
+	// DERPMap, if non-nil, is the DERP relays the nodes can reach
+	// each other through when they can't directly.
+	DERPMap *tailcfg.DERPMap `json:",omitempty"`
+
+	// PacketFilter is the rules for incoming traffic. If nil, all
+	// traffic from peers is accepted.
+	PacketFilter []tailcfg.FilterRule `json:",omitempty"`
+
+	// DNS is the DNS configuration to use.
+	DNS tailcfg.DNSConfig
+
+	privateKey wgcfg.PrivateKey // parsed PrivateKey
+	filter     []filter.Match   // parsed PacketFilter
+}
+
+// StaticPeer is a peer in a StaticConfig.
+type StaticPeer struct {
+	// Name is the peer's DNS name.
+	Name string
+
+	// PublicKey is the peer's public node key, and DiscoKey, if
+	// non-empty, its discovery key, which lets the nodes find direct
+	// paths between them through NATs.
+	PublicKey string
+	DiscoKey  string `json:",omitempty"`
+
+	// Addresses are the peer's tailnet addresses, and Routes the
+	// subnets reached through it.
+	Addresses []wgcfg.CIDR
+	Routes    []wgcfg.CIDR `json:",omitempty"`
+
+	// Endpoints are the peer's "ip:port" UDP endpoints.
+	Endpoints []string `json:",omitempty"`
+
+	// DERPRegion, if non-zero, is the DERPMap region the peer is
+	// reachable through.
+	DERPRegion int `json:",omitempty"`
+
+	// KeepAlive is whether to keep a connection to the peer open.
+	KeepAlive bool `json:",omitempty"`
+
+	key   tailcfg.NodeKey  // parsed PublicKey
+	disco tailcfg.DiscoKey // parsed DiscoKey
+}
+
+// errNoServer is returned by the requests that need a control server
+// when the client has a StaticMap instead.
+var errNoServer = errors.New("no control server with a static config")
+
+// staticUserID is the user that all nodes of a StaticConfig belong to.
+const staticUserID = tailcfg.UserID(1)
+
+// LoadStaticConfig reads and parses the StaticConfig at path.
+func LoadStaticConfig(path string) (*StaticConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := ParseStaticConfig(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// ParseStaticConfig parses and checks a StaticConfig.
+func ParseStaticConfig(b []byte) (*StaticConfig, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	cfg := new(StaticConfig)
+	if err := dec.Decode(cfg); err != nil {
+		return nil, err
+	}
+	k, err := parseStaticKey(cfg.PrivateKey, "privkey:")
+	if err != nil {
+		return nil, fmt.Errorf("PrivateKey: %v", err)
+	}
+	cfg.privateKey = wgcfg.PrivateKey(k)
+	if len(cfg.Addresses) == 0 {
+		return nil, errors.New("no Addresses")
+	}
+	self := tailcfg.NodeKey(cfg.privateKey.Public())
+	seen := map[tailcfg.NodeKey]bool{self: true}
+	for i := range cfg.Peers {
+		p := &cfg.Peers[i]
+		k, err := parseStaticKey(p.PublicKey, "nodekey:")
+		if err != nil {
+			return nil, fmt.Errorf("peer %q: PublicKey: %v", p.Name, err)
+		}
+		p.key = tailcfg.NodeKey(k)
+		if seen[p.key] {
+			return nil, fmt.Errorf("peer %q: duplicate PublicKey %v", p.Name, p.key.ShortString())
+		}
+		seen[p.key] = true
+		if p.DiscoKey != "" {
+			k, err := parseStaticKey(p.DiscoKey, "discokey:")
+			if err != nil {
+				return nil, fmt.Errorf("peer %q: DiscoKey: %v", p.Name, err)
+			}
+			p.disco = tailcfg.DiscoKey(k)
+		}
+		if len(p.Addresses) == 0 {
+			return nil, fmt.Errorf("peer %q: no Addresses", p.Name)
+		}
+		if p.DERPRegion != 0 && (cfg.DERPMap == nil || cfg.DERPMap.Regions[p.DERPRegion] == nil) {
+			return nil, fmt.Errorf("peer %q: DERPRegion %d not in DERPMap", p.Name, p.DERPRegion)
+		}
+	}
+	rules := cfg.PacketFilter
+	if rules == nil {
+		rules = tailcfg.FilterAllowAll
+	}
+	cfg.filter, err = filter.MatchesFromFilterRules(rules)
+	if err != nil {
+		return nil, fmt.Errorf("PacketFilter: %v", err)
+	}
+	return cfg, nil
+}
+
+// parseStaticKey parses a 32-byte key that's either hex with prefix
+// or base64.
+func parseStaticKey(s, prefix string) (k [32]byte, err error) {
+	var b []byte
+	if strings.HasPrefix(s, prefix) {
+		b, err = hex.DecodeString(strings.TrimPrefix(s, prefix))
+	} else {
+		b, err = base64.StdEncoding.DecodeString(s)
+	}
+	if err != nil {
+		return k, fmt.Errorf("want %s<hex> or base64: %v", prefix, err)
+	}
+	if len(b) != len(k) {
+		return k, fmt.Errorf("got %d bytes; want %d", len(b), len(k))
+	}
+	copy(k[:], b)
+	return k, nil
+}
+
+// netMap returns the network map cfg configures.
+func (cfg *StaticConfig) netMap() *NetworkMap {
+	nm := &NetworkMap{
+		NodeKey:       tailcfg.NodeKey(cfg.privateKey.Public()),
+		PrivateKey:    cfg.privateKey,
+		Name:          cfg.Name,
+		Addresses:     cfg.Addresses,
+		MachineStatus: tailcfg.MachineAuthorized,
+		DNS:           cfg.DNS,
+		PacketFilter:  cfg.filter,
+		DERPMap:       cfg.DERPMap,
+		User:          staticUserID,
+		UserProfiles: map[tailcfg.UserID]tailcfg.UserProfile{
+			staticUserID: {
+				ID:          staticUserID,
+				LoginName:   "static",
+				DisplayName: "Static configuration",
+			},
+		},
+	}
+	for i, p := range cfg.Peers {
+		n := &tailcfg.Node{
+			ID:                tailcfg.NodeID(i + 1),
+			Name:              p.Name,
+			User:              staticUserID,
+			Key:               p.key,
+			DiscoKey:          p.disco,
+			Addresses:         p.Addresses,
+			AllowedIPs:        append(append([]wgcfg.CIDR(nil), p.Addresses...), p.Routes...),
+			Endpoints:         p.Endpoints,
+			KeepAlive:         p.KeepAlive,
+			MachineAuthorized: true,
+		}
+		n.Hostinfo.Hostname = strings.SplitN(p.Name, ".", 2)[0]
+		if p.DERPRegion != 0 {
+			n.DERP = fmt.Sprintf("127.3.3.40:%d", p.DERPRegion)
+		}
+		nm.Peers = append(nm.Peers, n)
+	}
+	return nm
+}
+
+// StaticMap is the StaticConfig that a client without a control
+// server gets its network map from. It can be replaced while the
+// client runs, such as when its file changes.
+type StaticMap struct {
+	mu      sync.Mutex
+	cfg     *StaticConfig
+	changed chan struct{} // closed when cfg is replaced
+}
+
+// NewStaticMap returns a StaticMap holding cfg, which must be from
+// LoadStaticConfig or ParseStaticConfig.
+func NewStaticMap(cfg *StaticConfig) *StaticMap {
+	return &StaticMap{cfg: cfg, changed: make(chan struct{})}
+}
+
+// Set replaces the config, sending clients a new network map.
+func (m *StaticMap) Set(cfg *StaticConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cfg = cfg
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// get returns the current config and a channel closed when it's
+// replaced.
+func (m *StaticMap) get() (*StaticConfig, <-chan struct{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cfg, m.changed
+}
+
+// staticLogin "logs in" with the StaticMap's node key, which needs
+// no control server.
+func (c *Direct) staticLogin() {
+	cfg, _ := c.static.get()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.persist.PrivateNodeKey = cfg.privateKey
+	c.persist.LoginName = "static"
+	c.logf("static config: logged in as %v", tailcfg.NodeKey(cfg.privateKey.Public()).ShortString())
+}
+
+// pollStatic is PollNetMap for a StaticMap: it calls cb with its
+// network map now and again each time it's replaced.
+func (c *Direct) pollStatic(ctx context.Context, maxPolls int, cb func(*NetworkMap)) error {
+	machinePubKey := tailcfg.MachineKey(c.machinePrivKey.Public())
+	for i := 0; i < maxPolls || maxPolls < 0; i++ {
+		cfg, changed := c.static.get()
+
+		c.mu.Lock()
+		c.persist.PrivateNodeKey = cfg.privateKey
+		hostinfo := c.hostinfo.Clone()
+		localPort := c.localPort
+		c.mu.Unlock()
+
+		nm := cfg.netMap()
+		nm.MachineKey = machinePubKey
+		nm.LocalPort = localPort
+		nm.Hostinfo = *hostinfo
+		c.logf("static config: %d peers", len(nm.Peers))
+		cb(nm)
+
+		if i+1 == maxPolls {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestStaticConfig(t *testing.T) {
+	const privKey = "privkey:0202020202020202020202020202020202020202020202020202020202020202"
+	const config = `{
+		"PrivateKey": "` + privKey + `",
+		"Name": "lab1.lab.",
+		"Addresses": ["100.64.0.1/32"],
+		"Peers": [
+			{
+				"Name": "lab2.lab.",
+				"PublicKey": "nodekey:0303030303030303030303030303030303030303030303030303030303030303",
+				"Addresses": ["100.64.0.2/32"],
+				"Routes": ["10.2.0.0/16"],
+				"Endpoints": ["192.168.0.2:41641"],
+				"DERPRegion": 1
+			},
+			{
+				"Name": "lab3.lab.",
+				"PublicKey": "BAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQ=",
+				"Addresses": ["100.64.0.3/32"]
+			}
+		],
+		"DERPMap": {"Regions": {"1": {"RegionID": 1, "Nodes": [{"Name": "1a", "RegionID": 1, "HostName": "derp.lab"}]}}}
+	}`
+	cfg, err := ParseStaticConfig([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nm := cfg.netMap()
+	if nm.MachineStatus != tailcfg.MachineAuthorized {
+		t.Errorf("MachineStatus = %v; want authorized", nm.MachineStatus)
+	}
+	if len(nm.PacketFilter) == 0 {
+		t.Errorf("no packet filter; want one allowing all")
+	}
+	if len(nm.Peers) != 2 {
+		t.Fatalf("got %d peers; want 2", len(nm.Peers))
+	}
+	p := nm.Peers[0]
+	if p.ID != 1 || p.Key[0] != 3 {
+		t.Errorf("peer 0 = %v, %v", p.ID, p.Key)
+	}
+	if len(p.AllowedIPs) != 2 {
+		t.Errorf("peer 0 AllowedIPs = %v; want its address and route", p.AllowedIPs)
+	}
+	if p.DERP != "127.3.3.40:1" {
+		t.Errorf("peer 0 DERP = %q", p.DERP)
+	}
+	if p.Hostinfo.Hostname != "lab2" {
+		t.Errorf("peer 0 Hostname = %q; want lab2", p.Hostinfo.Hostname)
+	}
+	if nm.Peers[1].Key[0] != 4 {
+		t.Errorf("peer 1 key = %v; want the base64 one", nm.Peers[1].Key)
+	}
+
+	for _, bad := range []string{
+		`{"PrivateKey": "` + privKey + `"}`,
+		`{"PrivateKey": "nodekey:02", "Addresses": ["100.64.0.1/32"]}`,
+		`{"PrivateKey": "` + privKey + `", "Addresses": ["100.64.0.1/32"], "Bogus": 1}`,
+		`{"PrivateKey": "` + privKey + `", "Addresses": ["100.64.0.1/32"], "Peers": [{"PublicKey": "nodekey:0303030303030303030303030303030303030303030303030303030303030303", "Addresses": ["100.64.0.2/32"], "DERPRegion": 2}]}`,
+	} {
+		if _, err := ParseStaticConfig([]byte(bad)); err == nil {
+			t.Errorf("ParseStaticConfig(%s) succeeded; want error", bad)
+		}
+	}
+
+	// Replacing the config sends a new netmap.
+	sm := NewStaticMap(cfg)
+	c := &Direct{logf: t.Logf, static: sm, hostinfo: &tailcfg.Hostinfo{}}
+	c.staticLogin()
+	if got := c.GetPersist().PrivateNodeKey; got != cfg.privateKey {
+		t.Errorf("persisted node key not from the config")
+	}
+	cfg2, err := ParseStaticConfig([]byte(strings.Replace(config, `"Peers": [`, `"Peers": [{"Name": "lab4", "PublicKey": "nodekey:0505050505050505050505050505050505050505050505050505050505050505", "Addresses": ["100.64.0.4/32"]},`, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var peers []int
+	err = c.PollNetMap(context.Background(), 2, func(nm *NetworkMap) {
+		peers = append(peers, len(nm.Peers))
+		if len(peers) == 1 {
+			sm.Set(cfg2)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 || peers[0] != 2 || peers[1] != 3 {
+		t.Errorf("netmap peer counts = %v; want [2 3]", peers)
+	}
+}
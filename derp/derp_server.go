@@ -87,6 +87,7 @@ type Server struct {
 	logf        logger.Logf
 	memSys0     uint64 // runtime.MemStats.Sys at start (or early-ish)
 	meshKey     string
+	allowClient func(key.Public) bool // or nil to allow all; see SetAllowClient
 	limitedLogf logger.Logf
 	metaCert    []byte // the encoded x509 cert to send after LetsEncrypt cert+intermediate
 
@@ -106,6 +107,7 @@ type Server struct {
 	packetsDroppedQueueHead  *expvar.Int // queue full, drop head packet
 	packetsDroppedQueueTail  *expvar.Int // queue full, drop tail packet
 	packetsDroppedWrite      *expvar.Int // error writing to dst conn
+	packetsDroppedFwdError   *expvar.Int // error forwarding to mesh peer
 	_                        [pad32bit]byte
 	packetsForwardedOut      expvar.Int
 	packetsForwardedIn       expvar.Int
@@ -114,6 +116,8 @@ type Server struct {
 	curClients               expvar.Int
 	curHomeClients           expvar.Int // ones with preferred
 	clientsReplaced          expvar.Int
+	clientsRejected          expvar.Int // not allowed by allowClient
+	clientsRevoked           expvar.Int // no longer allowed by allowClient; see RecheckClients
 	unknownFrames            expvar.Int
 	homeMovesIn              expvar.Int // established clients announce home server moves in
 	homeMovesOut             expvar.Int // established clients announce home server moves out
@@ -192,6 +196,7 @@ func NewServer(privateKey key.Private, logf logger.Logf) *Server {
 	s.packetsDroppedQueueHead = s.packetsDroppedReason.Get("queue_head")
 	s.packetsDroppedQueueTail = s.packetsDroppedReason.Get("queue_tail")
 	s.packetsDroppedWrite = s.packetsDroppedReason.Get("write_error")
+	s.packetsDroppedFwdError = s.packetsDroppedReason.Get("forward_error")
 	return s
 }
 
@@ -203,6 +208,36 @@ func (s *Server) SetMeshKey(v string) {
 	s.meshKey = v
 }
 
+// SetAllowClient sets the func deciding which clients, by public key,
+// may use the server; others are disconnected once they've sent
+// their key. Mesh peers presenting the mesh key are always allowed.
+// The func may be called concurrently. If what it allows changes,
+// call RecheckClients to disconnect the clients it no longer allows.
+//
+// It must be called before serving begins.
+func (s *Server) SetAllowClient(f func(clientKey key.Public) bool) {
+	s.allowClient = f
+}
+
+// RecheckClients disconnects the connected clients that the func set
+// by SetAllowClient no longer allows, such as after it's reloaded its
+// list. Mesh peers are left connected.
+func (s *Server) RecheckClients() {
+	if s.allowClient == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, c := range s.clients {
+		if c.canMesh || s.allowClient(k) {
+			continue
+		}
+		s.clientsRevoked.Add(1)
+		c.logf("disconnecting; no longer an allowed client")
+		go c.nc.Close()
+	}
+}
+
 // HasMeshKey reports whether the server is configured with a mesh key.
 func (s *Server) HasMeshKey() bool { return s.meshKey != "" }
 
@@ -636,6 +671,7 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 	if err != nil {
 		return fmt.Errorf("client %x: recvPacket: %v", c.key, err)
 	}
+	c.bytesRecv.Add(int64(len(contents)))
 
 	var fwd PacketForwarder
 	s.mu.Lock()
@@ -651,8 +687,16 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 		if fwd != nil {
 			s.packetsForwardedOut.Add(1)
 			if err := fwd.ForwardPacket(c.key, dstKey, contents); err != nil {
-				// TODO:
-				return nil
+				// The mesh peer is probably restarting. Its
+				// watch loop will drop or replace the
+				// forwarding entry once it notices; until
+				// then, drop the packet as WireGuard would
+				// on a lossy path.
+				s.packetsDropped.Add(1)
+				s.packetsDroppedFwdError.Add(1)
+				if debug {
+					c.logf("dropping packet for %x; forwarding: %v", dstKey, err)
+				}
 			}
 			return nil
 		}
@@ -750,8 +794,17 @@ func (c *sclient) requestMeshUpdate() {
 }
 
 func (s *Server) verifyClient(clientKey key.Public, info *clientInfo) error {
-	// TODO(crawshaw): implement policy constraints on who can use the DERP server
-	// TODO(bradfitz): ... and at what rate.
+	// TODO(bradfitz): limit the rate at which clients can use the DERP server.
+	if s.allowClient == nil {
+		return nil
+	}
+	if info != nil && info.MeshKey != "" && info.MeshKey == s.meshKey {
+		return nil
+	}
+	if !s.allowClient(clientKey) {
+		s.clientsRejected.Add(1)
+		return errors.New("not an allowed client")
+	}
 	return nil
 }
 
@@ -898,6 +951,10 @@ type sclient struct {
 	meshUpdate chan struct{}   // write request to write peerStateChange
 	canMesh    bool            // clientInfo had correct mesh token for inter-region routing
 
+	// Safe for concurrent use.
+	bytesRecv expvar.Int // payload bytes this client sent us to relay
+	bytesSent expvar.Int // payload bytes relayed to this client
+
 	// Owned by run, not thread-safe.
 	br          *bufio.Reader
 	connectedAt time.Time
@@ -1122,6 +1179,7 @@ func (c *sclient) sendPacket(srcKey key.Public, contents []byte) (err error) {
 		} else {
 			c.s.packetsSent.Add(1)
 			c.s.bytesSent.Add(int64(len(contents)))
+			c.bytesSent.Add(int64(len(contents)))
 		}
 	}()
 
@@ -1156,7 +1214,7 @@ func (s *Server) AddPacketForwarder(dst key.Public, fwd PacketForwarder) {
 			return
 		}
 		if m, ok := prev.(multiForwarder); ok {
-			if _, ok := m[fwd]; !ok {
+			if _, ok := m[fwd]; ok {
 				// Duplicate registration of same forwarder in set; ignore.
 				return
 			}
@@ -1274,8 +1332,16 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("gauge_clients_remote", expvar.Func(func() interface{} { return len(s.clientsMesh) - len(s.clients) }))
 	m.Set("accepts", &s.accepts)
 	m.Set("clients_replaced", &s.clientsReplaced)
+	m.Set("clients_rejected", &s.clientsRejected)
+	m.Set("clients_revoked", &s.clientsRevoked)
 	m.Set("bytes_received", &s.bytesRecv)
 	m.Set("bytes_sent", &s.bytesSent)
+	m.Set("counter_client_bytes_received", s.expVarFunc(func() interface{} {
+		return s.clientCountersLocked(func(c *sclient) *expvar.Int { return &c.bytesRecv })
+	}))
+	m.Set("counter_client_bytes_sent", s.expVarFunc(func() interface{} {
+		return s.clientCountersLocked(func(c *sclient) *expvar.Int { return &c.bytesSent })
+	}))
 	m.Set("packets_dropped", &s.packetsDropped)
 	m.Set("counter_packets_dropped_reason", &s.packetsDroppedReason)
 	m.Set("counter_packets_received_kind", &s.packetsRecvByKind)
@@ -1296,6 +1362,17 @@ func (s *Server) ExpVar() expvar.Var {
 	return m
 }
 
+// clientCountersLocked returns the counter f selects for each
+// currently connected client, labeled by the client's public key.
+// s.mu must be held.
+func (s *Server) clientCountersLocked(f func(*sclient) *expvar.Int) *metrics.LabelMap {
+	m := &metrics.LabelMap{Label: "client"}
+	for k, c := range s.clients {
+		m.Set(fmt.Sprintf("%x", k[:]), f(c))
+	}
+	return m
+}
+
 func (s *Server) ConsistencyCheck() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
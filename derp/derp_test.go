@@ -718,6 +718,27 @@ func TestForwarderRegistration(t *testing.T) {
 	})
 	wantCounter(&s.multiForwarderCreated, 1)
 
+	// A third forwarder joins the set, after the first two.
+	s.AddPacketForwarder(u1, testFwd(200))
+	want(map[key.Public]PacketForwarder{
+		u1: multiForwarder{
+			testFwd(1):   1,
+			testFwd(100): 2,
+			testFwd(200): 3,
+		},
+	})
+
+	// Adding one that's already in the set does nothing.
+	s.AddPacketForwarder(u1, testFwd(100))
+	want(map[key.Public]PacketForwarder{
+		u1: multiForwarder{
+			testFwd(1):   1,
+			testFwd(100): 2,
+			testFwd(200): 3,
+		},
+	})
+	s.RemovePacketForwarder(u1, testFwd(200))
+
 	// Removing a forwarder in a multi set that doesn't exist; does nothing.
 	s.RemovePacketForwarder(u1, testFwd(55))
 	want(map[key.Public]PacketForwarder{
@@ -791,6 +812,87 @@ func TestMetaCert(t *testing.T) {
 	}
 }
 
+func TestAllowClient(t *testing.T) {
+	s := NewServer(newPrivateKey(t), t.Logf)
+	defer s.Close()
+	s.SetMeshKey("abc123")
+
+	allowed := newPrivateKey(t).Public()
+	other := newPrivateKey(t).Public()
+	if err := s.verifyClient(other, &clientInfo{}); err != nil {
+		t.Errorf("with no allow func, got %v; want all clients allowed", err)
+	}
+
+	s.SetAllowClient(func(k key.Public) bool { return k == allowed })
+	if err := s.verifyClient(allowed, &clientInfo{}); err != nil {
+		t.Errorf("allowed client rejected: %v", err)
+	}
+	if err := s.verifyClient(other, &clientInfo{}); err == nil {
+		t.Error("unknown client allowed")
+	}
+	if err := s.verifyClient(other, &clientInfo{MeshKey: "wrong"}); err == nil {
+		t.Error("unknown client with the wrong mesh key allowed")
+	}
+	if err := s.verifyClient(other, &clientInfo{MeshKey: "abc123"}); err != nil {
+		t.Errorf("mesh peer rejected: %v", err)
+	}
+	if got := s.clientsRejected.Value(); got != 2 {
+		t.Errorf("clients rejected = %d; want 2", got)
+	}
+}
+
+func TestRecheckClients(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close(t)
+
+	var mu sync.Mutex
+	allowed := map[key.Public]bool{}
+	ts.s.SetAllowClient(func(k key.Public) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return allowed[k]
+	})
+	allow := func(k key.Public, ok bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		allowed[k] = ok
+	}
+
+	// The watcher presents the mesh key, so isn't in the list.
+	w1 := newTestWatcher(t, ts, "w1")
+	w1.wantPresent(t, w1.pub)
+
+	var cs []*testClient
+	for _, name := range []string{"c1", "c2"} {
+		tc := newTestClient(t, ts, name, func(nc net.Conn, priv key.Private, logf logger.Logf) (*Client, error) {
+			allow(priv.Public(), true)
+			brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+			c, err := NewClient(priv, nc, brw, logf)
+			if err != nil {
+				return nil, err
+			}
+			waitConnect(t, c)
+			return c, nil
+		})
+		w1.wantPresent(t, tc.pub)
+		cs = append(cs, tc)
+	}
+
+	ts.s.RecheckClients()
+	allow(cs[1].pub, false)
+	ts.s.RecheckClients()
+	w1.wantGone(t, cs[1].pub)
+	if got := ts.s.clientsRevoked.Value(); got != 1 {
+		t.Errorf("clients revoked = %d; want 1", got)
+	}
+	ts.s.mu.Lock()
+	_, ok := ts.s.clients[cs[0].pub]
+	ts.s.mu.Unlock()
+	if !ok {
+		t.Error("allowed client was disconnected")
+	}
+}
+
 func BenchmarkSendRecv(b *testing.B) {
 	for _, size := range []int{10, 100, 1000, 10000} {
 		b.Run(fmt.Sprintf("msgsize=%d", size), func(b *testing.B) { benchmarkSendRecvSize(b, size) })
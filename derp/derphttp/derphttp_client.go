@@ -8,6 +8,9 @@
 // A server can implement DERP over HTTPS and even if the TLS connection
 // intercepted using a fake root CA, unless the interceptor knows how to
 // detect DERP packets, it will look like a web socket.
+//
+// Where even that is blocked, the client can carry DERP in
+// ordinary HTTPS long-poll requests instead; see longpoll.go.
 package derphttp
 
 import (
@@ -32,6 +35,7 @@ import (
 	"inet.af/netaddr"
 	"tailscale.com/derp"
 	"tailscale.com/net/dnscache"
+	"tailscale.com/net/nat64"
 	"tailscale.com/net/netns"
 	"tailscale.com/net/tlsdial"
 	"tailscale.com/net/tshttpproxy"
@@ -50,6 +54,8 @@ type Client struct {
 	TLSConfig *tls.Config        // optional; nil means default
 	DNSCache  *dnscache.Resolver // optional; nil means no caching
 	MeshKey   string             // optional; for trusted clients
+	WebSocket bool               // optional; whether to always carry DERP in WebSocket messages
+	LongPoll  bool               // optional; whether to always carry DERP in HTTPS long-poll requests
 
 	privateKey key.Private
 	logf       logger.Logf
@@ -68,6 +74,29 @@ type Client struct {
 	client       *derp.Client
 	connGen      int // incremented once per new connection; valid values are >0
 	serverPubKey key.Public
+	fallback     transport // to use unless one is forced, after the others failed
+}
+
+// transport is a way of carrying DERP over HTTP.
+type transport int
+
+const (
+	transportUpgrade   transport = iota // upgraded HTTP connection
+	transportWebSocket                  // WebSocket messages
+	transportLongPoll                   // HTTPS long-poll requests
+	numTransports
+)
+
+func (t transport) String() string {
+	switch t {
+	case transportUpgrade:
+		return "DERP upgrade"
+	case transportWebSocket:
+		return "WebSocket"
+	case transportLongPoll:
+		return "HTTPS long-poll"
+	}
+	return fmt.Sprintf("transport(%d)", int(t))
 }
 
 // NewRegionClient returns a new DERP-over-HTTP client. It connects lazily.
@@ -294,10 +323,62 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 	brw := bufio.NewReadWriter(bufio.NewReader(httpConn), bufio.NewWriter(httpConn))
 	var derpClient *derp.Client
 
-	req, err := http.NewRequest("GET", c.urlString(node), nil)
+	var derpConn derp.Conn = httpConn // what DERP is spoken over
+	var netConn io.Closer = tcpConn   // what to close to end it
+	tr := c.transport()
+	switch tr {
+	case transportWebSocket:
+		wc, err := c.upgradeWebSocket(httpConn, brw, node)
+		if err != nil {
+			c.noteUpgradeFailed(ctx, tr, err)
+			return nil, 0, err
+		}
+		derpConn = wc
+		brw = bufio.NewReadWriter(bufio.NewReader(wc), bufio.NewWriter(wc))
+	case transportLongPoll:
+		pc, err := c.openLongPoll(ctx, httpConn, node)
+		if err != nil {
+			c.noteUpgradeFailed(ctx, tr, err)
+			return nil, 0, err
+		}
+		derpConn, netConn = pc, pc
+		brw = bufio.NewReadWriter(bufio.NewReader(pc), bufio.NewWriter(pc))
+	default:
+		if err := c.upgradeDERP(brw, node, serverPub, serverProtoVersion); err != nil {
+			c.noteUpgradeFailed(ctx, tr, err)
+			return nil, 0, err
+		}
+	}
+	derpClient, err = derp.NewClient(c.privateKey, derpConn, brw, c.logf, derp.MeshKey(c.MeshKey), derp.ServerPublicKey(serverPub))
 	if err != nil {
+		c.noteUpgradeFailed(ctx, tr, err)
+		if tr == transportLongPoll {
+			netConn.Close()
+		}
 		return nil, 0, err
 	}
+	if c.preferred {
+		if err := derpClient.NotePreferred(true); err != nil {
+			go derpConn.Close()
+			return nil, 0, err
+		}
+	}
+
+	c.serverPubKey = derpClient.ServerPublicKey()
+	c.client = derpClient
+	c.netConn = netConn
+	c.connGen++
+	return c.client, c.connGen, nil
+}
+
+// upgradeDERP sends the HTTP request to upgrade the connection
+// buffered by brw to DERP, and reads the server's response unless
+// the server's key is already known from its TLS certificate.
+func (c *Client) upgradeDERP(brw *bufio.ReadWriter, node *tailcfg.DERPNode, serverPub key.Public, serverProtoVersion int) error {
+	req, err := http.NewRequest("GET", c.urlString(node), nil)
+	if err != nil {
+		return err
+	}
 	req.Header.Set("Upgrade", "DERP")
 	req.Header.Set("Connection", "Upgrade")
 
@@ -311,44 +392,92 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 		// that we don't want to deal with its HTTP response.
 		req.Header.Set(fastStartHeader, "1") // suppresses the server's HTTP response
 		if err := req.Write(brw); err != nil {
-			return nil, 0, err
+			return err
 		}
 		// No need to flush the HTTP request. the derp.Client's initial
 		// client auth frame will flush it.
 	} else {
 		if err := req.Write(brw); err != nil {
-			return nil, 0, err
+			return err
 		}
 		if err := brw.Flush(); err != nil {
-			return nil, 0, err
+			return err
 		}
 
 		resp, err := http.ReadResponse(brw.Reader, req)
 		if err != nil {
-			return nil, 0, err
+			return err
 		}
 		if resp.StatusCode != http.StatusSwitchingProtocols {
 			b, _ := ioutil.ReadAll(resp.Body)
 			resp.Body.Close()
-			return nil, 0, fmt.Errorf("GET failed: %v: %s", err, b)
+			return fmt.Errorf("GET failed: %v: %s", err, b)
 		}
 	}
-	derpClient, err = derp.NewClient(c.privateKey, httpConn, brw, c.logf, derp.MeshKey(c.MeshKey), derp.ServerPublicKey(serverPub))
+	return nil
+}
+
+// upgradeWebSocket upgrades httpConn, buffered by brw, to a WebSocket
+// connection carrying DERP.
+func (c *Client) upgradeWebSocket(httpConn net.Conn, brw *bufio.ReadWriter, node *tailcfg.DERPNode) (*wsConn, error) {
+	wsKey, err := newWSKey()
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
-	if c.preferred {
-		if err := derpClient.NotePreferred(true); err != nil {
-			go httpConn.Close()
-			return nil, 0, err
-		}
+	req, err := http.NewRequest("GET", c.urlString(node), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", wsKey)
+	req.Header.Set("Sec-WebSocket-Protocol", websocketProtocol)
+	if err := req.Write(brw); err != nil {
+		return nil, err
 	}
+	if err := brw.Flush(); err != nil {
+		return nil, err
+	}
+	resp, err := http.ReadResponse(brw.Reader, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		resp.Body.Close()
+		return nil, fmt.Errorf("WebSocket upgrade failed: %v: %s", resp.Status, b)
+	}
+	if got, want := resp.Header.Get("Sec-WebSocket-Accept"), wsAcceptKey(wsKey); got != want {
+		return nil, fmt.Errorf("WebSocket upgrade: bad Sec-WebSocket-Accept %q", got)
+	}
+	return newWSConn(httpConn, brw.Reader, true), nil
+}
 
-	c.serverPubKey = derpClient.ServerPublicKey()
-	c.client = derpClient
-	c.netConn = tcpConn
-	c.connGen++
-	return c.client, c.connGen, nil
+// transport returns the transport for the next connection. c.mu
+// must be held.
+func (c *Client) transport() transport {
+	switch {
+	case c.LongPoll:
+		return transportLongPoll
+	case c.WebSocket:
+		return transportWebSocket
+	}
+	return c.fallback
+}
+
+// noteUpgradeFailed records that setting up DERP with transport tr
+// on an established TCP or TLS connection failed, which is what
+// happens when a middlebox interferes with it. Unless WebSocket or
+// LongPoll is set, the next connection attempt tries the next
+// transport, in the order upgrade, WebSocket, long-poll and back to
+// upgrade. c.mu must be held.
+func (c *Client) noteUpgradeFailed(ctx context.Context, tr transport, err error) {
+	if ctx.Err() != nil || c.WebSocket || c.LongPoll {
+		return
+	}
+	c.fallback = (tr + 1) % numTransports
+	c.logf("derphttp: %v failed (%v); will try %v next", tr, err, c.fallback)
 }
 
 func (c *Client) dialURL(ctx context.Context) (net.Conn, error) {
@@ -452,7 +581,7 @@ func (c *Client) DialRegionTLS(ctx context.Context, reg *tailcfg.DERPRegion) (tl
 }
 
 func (c *Client) dialContext(ctx context.Context, proto, addr string) (net.Conn, error) {
-	return netns.NewDialer().DialContext(ctx, proto, addr)
+	return nat64.Dialer(netns.NewDialer().DialContext)(ctx, proto, addr)
 }
 
 // shouldDialProto reports whether an explicitly provided IPv4 or IPv6
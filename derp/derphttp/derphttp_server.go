@@ -5,6 +5,7 @@
 package derphttp
 
 import (
+	"bufio"
 	"fmt"
 	"log"
 	"net/http"
@@ -19,7 +20,16 @@ import (
 const fastStartHeader = "Derp-Fast-Start"
 
 func Handler(s *derp.Server) http.Handler {
+	ps := newPollServer(s)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPollRequest(r) {
+			ps.ServeHTTP(w, r)
+			return
+		}
+		if isWebSocketUpgrade(r) {
+			serveWebSocket(s, w, r)
+			return
+		}
 		if p := r.Header.Get("Upgrade"); p != "WebSocket" && p != "DERP" {
 			http.Error(w, "DERP requires connection upgrade", http.StatusUpgradeRequired)
 			return
@@ -53,3 +63,33 @@ func Handler(s *derp.Server) http.Handler {
 		s.Accept(netConn, conn, netConn.RemoteAddr().String())
 	})
 }
+
+// serveWebSocket accepts a DERP connection carried in WebSocket
+// binary messages.
+func serveWebSocket(s *derp.Server, w http.ResponseWriter, r *http.Request) {
+	h, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "HTTP does not support general TCP support", 500)
+		return
+	}
+	netConn, conn, err := h.Hijack()
+	if err != nil {
+		log.Printf("Hijack failed: %v", err)
+		http.Error(w, "HTTP does not support general TCP support", 500)
+		return
+	}
+	fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n"+
+		"Sec-WebSocket-Protocol: %s\r\n\r\n",
+		wsAcceptKey(r.Header.Get("Sec-WebSocket-Key")),
+		websocketProtocol)
+	if err := conn.Flush(); err != nil {
+		netConn.Close()
+		return
+	}
+	wc := newWSConn(netConn, conn.Reader, false)
+	brw := bufio.NewReadWriter(bufio.NewReader(wc), bufio.NewWriter(wc))
+	s.Accept(wc, brw, netConn.RemoteAddr().String())
+}
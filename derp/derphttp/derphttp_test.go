@@ -17,7 +17,11 @@ import (
 	"tailscale.com/types/key"
 )
 
-func TestSendRecv(t *testing.T) {
+func TestSendRecv(t *testing.T)          { testSendRecv(t, transportUpgrade) }
+func TestSendRecvWebSocket(t *testing.T) { testSendRecv(t, transportWebSocket) }
+func TestSendRecvLongPoll(t *testing.T)  { testSendRecv(t, transportLongPoll) }
+
+func testSendRecv(t *testing.T, tr transport) {
 	serverPrivateKey := key.NewPrivate()
 
 	const numClients = 3
@@ -70,6 +74,8 @@ func TestSendRecv(t *testing.T) {
 		if err != nil {
 			t.Fatalf("client %d: %v", i, err)
 		}
+		c.WebSocket = tr == transportWebSocket
+		c.LongPoll = tr == transportLongPoll
 		if err := c.Connect(context.Background()); err != nil {
 			t.Fatalf("client %d Connect: %v", i, err)
 		}
@@ -154,3 +160,103 @@ func waitConnect(t testing.TB, c *Client) {
 		t.Fatalf("client first Recv was unexpected type %T", v)
 	}
 }
+
+// newTestServer starts an HTTP server for s and returns its URL.
+func newTestServer(t *testing.T, s *derp.Server) (serverURL string, close func()) {
+	t.Helper()
+	httpsrv := &http.Server{
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+		Handler:      Handler(s),
+	}
+	ln, err := net.Listen("tcp4", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go httpsrv.Serve(ln)
+	return "http://" + ln.Addr().String(), func() { httpsrv.Close() }
+}
+
+func TestMeshForward(t *testing.T) {
+	const meshKey = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	s1 := derp.NewServer(key.NewPrivate(), t.Logf)
+	defer s1.Close()
+	s1.SetMeshKey(meshKey)
+	s2 := derp.NewServer(key.NewPrivate(), t.Logf)
+	defer s2.Close()
+	s2.SetMeshKey(meshKey)
+
+	url1, close1 := newTestServer(t, s1)
+	defer close1()
+	url2, close2 := newTestServer(t, s2)
+	defer close2()
+
+	// Have s1 learn about the clients of s2, as cmd/derper does.
+	mc, err := NewClient(s1.PrivateKey(), url2, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc.MeshKey = meshKey
+	defer mc.Close()
+	added := make(chan key.Public, 10)
+	go mc.RunWatchConnectionLoop(s1.PublicKey(), func(k key.Public) {
+		s1.AddPacketForwarder(k, mc)
+		added <- k
+	}, func(k key.Public) {
+		s1.RemovePacketForwarder(k, mc)
+	})
+
+	newClient := func(serverURL string) *Client {
+		c, err := NewClient(key.NewPrivate(), serverURL, t.Logf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Connect(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		waitConnect(t, c)
+		return c
+	}
+	c1 := newClient(url1)
+	defer c1.Close()
+	c2 := newClient(url2)
+	defer c2.Close()
+
+	timeout := time.After(5 * time.Second)
+	for waiting := true; waiting; {
+		select {
+		case k := <-added:
+			waiting = k != c2.privateKey.Public()
+		case <-timeout:
+			t.Fatal("timeout waiting for mesh peer")
+		}
+	}
+
+	msg := []byte("hello via mesh")
+	if err := c1.Send(c2.privateKey.Public(), msg); err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan derp.ReceivedPacket, 1)
+	go func() {
+		for {
+			m, err := c2.Recv()
+			if err != nil {
+				return
+			}
+			if p, ok := m.(derp.ReceivedPacket); ok {
+				got <- p
+				return
+			}
+		}
+	}()
+	select {
+	case p := <-got:
+		if string(p.Data) != string(msg) {
+			t.Errorf("got %q; want %q", p.Data, msg)
+		}
+		if p.Source != c1.privateKey.Public() {
+			t.Errorf("source = %v; want %v", p.Source.ShortString(), c1.privateKey.Public().ShortString())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for forwarded packet")
+	}
+}
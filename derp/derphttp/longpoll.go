@@ -0,0 +1,498 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package derphttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"tailscale.com/derp"
+	"tailscale.com/tailcfg"
+)
+
+// This file implements DERP over plain HTTPS requests, for networks
+// whose proxies don't pass upgraded connections of any kind. A
+// session's client sends its bytes of the DERP protocol in POST
+// requests and long-polls for the server's with GET requests, each
+// naming the session in pollSessionHeader. The client opens a session
+// with a POST with pollHeader "open", whose response names it, and
+// may close it with a POST with pollHeader "close". The server also
+// closes sessions that go pollIdleTimeout without a request.
+
+const (
+	pollHeader        = "Derp-Poll"
+	pollSessionHeader = "Derp-Poll-Session"
+
+	// pollWait is how long the server holds a GET with no data to
+	// return, short enough for proxies to let it finish.
+	pollWait = 25 * time.Second
+	// pollIdleTimeout is how long a session lasts without a
+	// request.
+	pollIdleTimeout = 2 * pollWait
+	// pollMaxBody is the most bytes a request or response body
+	// carries, and how much the server buffers per direction.
+	pollMaxBody = 256 << 10
+)
+
+// pollBuf is one direction of a long-poll session: a bounded byte
+// queue between the DERP connection and the HTTP requests carrying
+// it.
+type pollBuf struct {
+	mu      sync.Mutex
+	b       []byte
+	closed  bool
+	changed chan struct{} // closed and replaced when the above change
+}
+
+func newPollBuf() *pollBuf {
+	return &pollBuf{changed: make(chan struct{})}
+}
+
+func (pb *pollBuf) notifyLocked() {
+	close(pb.changed)
+	pb.changed = make(chan struct{})
+}
+
+// wake wakes the waiters on pb, so that they notice a new deadline.
+func (pb *pollBuf) wake() {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	pb.notifyLocked()
+}
+
+func (pb *pollBuf) close() {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	pb.closed = true
+	pb.notifyLocked()
+}
+
+// waitLocked waits for pb to change, for the deadline returned by dl
+// to pass, or for done to be closed. pb.mu must be held; it's
+// released while waiting.
+func (pb *pollBuf) waitLocked(dl func() time.Time, done <-chan struct{}) error {
+	deadline := dl()
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return os.ErrDeadlineExceeded
+	}
+	ch := pb.changed
+	pb.mu.Unlock()
+	defer pb.mu.Lock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-done:
+		return context.Canceled
+	}
+}
+
+// write appends p to pb, waiting while pb is full.
+func (pb *pollBuf) write(p []byte, dl func() time.Time, done <-chan struct{}) (int, error) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	for !pb.closed && len(pb.b) >= pollMaxBody {
+		if err := pb.waitLocked(dl, done); err != nil {
+			return 0, err
+		}
+	}
+	if pb.closed {
+		return 0, io.ErrClosedPipe
+	}
+	pb.b = append(pb.b, p...)
+	pb.notifyLocked()
+	return len(p), nil
+}
+
+// read reads from pb into p, waiting while pb is empty. It returns
+// io.EOF once pb is closed and empty.
+func (pb *pollBuf) read(p []byte, dl func() time.Time, done <-chan struct{}) (int, error) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	for !pb.closed && len(pb.b) == 0 {
+		if err := pb.waitLocked(dl, done); err != nil {
+			return 0, err
+		}
+	}
+	if len(pb.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, pb.b)
+	pb.b = pb.b[n:]
+	pb.notifyLocked()
+	return n, nil
+}
+
+// take is like read, but returns everything buffered, up to
+// pollMaxBody bytes, and returns nothing rather than an error if
+// the deadline passes.
+func (pb *pollBuf) take(deadline time.Time, done <-chan struct{}) ([]byte, error) {
+	b := make([]byte, pollMaxBody)
+	n, err := pb.read(b, func() time.Time { return deadline }, done)
+	if err == os.ErrDeadlineExceeded {
+		return nil, nil
+	}
+	return b[:n], err
+}
+
+// pollConn is a derp.Conn carried by a long-poll session. Reads come
+// from in and writes go to out.
+type pollConn struct {
+	in, out *pollBuf
+	closed  chan struct{}
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	closeOnce     sync.Once
+	onClose       func() // optional
+}
+
+func newPollConn() *pollConn {
+	return &pollConn{in: newPollBuf(), out: newPollBuf(), closed: make(chan struct{})}
+}
+
+func (pc *pollConn) getReadDeadline() time.Time {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.readDeadline
+}
+
+func (pc *pollConn) getWriteDeadline() time.Time {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.writeDeadline
+}
+
+func (pc *pollConn) Read(p []byte) (int, error) {
+	return pc.in.read(p, pc.getReadDeadline, nil)
+}
+
+func (pc *pollConn) Write(p []byte) (int, error) {
+	return pc.out.write(p, pc.getWriteDeadline, nil)
+}
+
+func (pc *pollConn) Close() error {
+	pc.closeOnce.Do(func() {
+		close(pc.closed)
+		pc.in.close()
+		pc.out.close()
+		if pc.onClose != nil {
+			pc.onClose()
+		}
+	})
+	return nil
+}
+
+func (pc *pollConn) SetDeadline(t time.Time) error {
+	pc.SetReadDeadline(t)
+	return pc.SetWriteDeadline(t)
+}
+
+func (pc *pollConn) SetReadDeadline(t time.Time) error {
+	pc.mu.Lock()
+	pc.readDeadline = t
+	pc.mu.Unlock()
+	pc.in.wake()
+	return nil
+}
+
+func (pc *pollConn) SetWriteDeadline(t time.Time) error {
+	pc.mu.Lock()
+	pc.writeDeadline = t
+	pc.mu.Unlock()
+	pc.out.wake()
+	return nil
+}
+
+// pollServer serves the long-poll sessions of a DERP server.
+type pollServer struct {
+	s *derp.Server
+
+	mu       sync.Mutex
+	sessions map[string]*pollSession
+}
+
+type pollSession struct {
+	conn *pollConn
+
+	mu       sync.Mutex
+	lastSeen time.Time
+}
+
+func (ss *pollSession) touch() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.lastSeen = time.Now()
+}
+
+// expireWhenIdle closes ss's connection once it's gone
+// pollIdleTimeout without a request.
+func (ss *pollSession) expireWhenIdle() {
+	t := time.NewTicker(pollIdleTimeout / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-ss.conn.closed:
+			return
+		case now := <-t.C:
+			ss.mu.Lock()
+			idle := now.Sub(ss.lastSeen)
+			ss.mu.Unlock()
+			if idle > pollIdleTimeout {
+				ss.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func newPollServer(s *derp.Server) *pollServer {
+	return &pollServer{s: s, sessions: make(map[string]*pollSession)}
+}
+
+// isPollRequest reports whether r is a long-poll session request.
+func isPollRequest(r *http.Request) bool {
+	return r.Header.Get(pollHeader) != "" || r.Header.Get(pollSessionHeader) != ""
+}
+
+func (ps *pollServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get(pollHeader) == "open" {
+		ps.open(w, r)
+		return
+	}
+	id := r.Header.Get(pollSessionHeader)
+	ps.mu.Lock()
+	ss := ps.sessions[id]
+	ps.mu.Unlock()
+	if ss == nil {
+		http.Error(w, "no such DERP session", http.StatusGone)
+		return
+	}
+	ss.touch()
+	switch {
+	case r.Method == "POST" && r.Header.Get(pollHeader) == "close":
+		ss.conn.Close()
+	case r.Method == "POST":
+		b, err := ioutil.ReadAll(io.LimitReader(r.Body, pollMaxBody+1))
+		if err != nil {
+			return
+		}
+		if len(b) > pollMaxBody {
+			http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if _, err := ss.conn.in.write(b, noDeadline, r.Context().Done()); err != nil {
+			http.Error(w, "DERP session closed", http.StatusGone)
+			return
+		}
+	case r.Method == "GET":
+		b, err := ss.conn.out.take(time.Now().Add(pollWait), r.Context().Done())
+		if err != nil {
+			http.Error(w, "DERP session closed", http.StatusGone)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(b)
+	default:
+		http.Error(w, "bad DERP session request", http.StatusMethodNotAllowed)
+	}
+}
+
+// open starts a session and its DERP connection.
+func (ps *pollServer) open(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "DERP session must be opened with POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var idb [16]byte
+	if _, err := rand.Read(idb[:]); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	id := hex.EncodeToString(idb[:])
+	pc := newPollConn()
+	ss := &pollSession{conn: pc, lastSeen: time.Now()}
+	pc.onClose = func() {
+		ps.mu.Lock()
+		defer ps.mu.Unlock()
+		delete(ps.sessions, id)
+	}
+	ps.mu.Lock()
+	ps.sessions[id] = ss
+	ps.mu.Unlock()
+
+	go ss.expireWhenIdle()
+	go ps.s.Accept(pc, bufio.NewReadWriter(bufio.NewReader(pc), bufio.NewWriter(pc)), r.RemoteAddr)
+	w.Header().Set(pollSessionHeader, id)
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+func noDeadline() time.Time { return time.Time{} }
+
+// openLongPoll opens a long-poll session with node, the first request
+// going over first, an established connection to it, and returns the
+// session's connection.
+func (c *Client) openLongPoll(ctx context.Context, first net.Conn, node *tailcfg.DERPNode) (*pollConn, error) {
+	var firstMu sync.Mutex
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		firstMu.Lock()
+		nc := first
+		first = nil
+		firstMu.Unlock()
+		if nc != nil {
+			return nc, nil
+		}
+		// The session is on this node, so stick to it.
+		return c.dialHTTPConn(ctx, node)
+	}
+	tr := &http.Transport{
+		DialContext:         dial,
+		DialTLSContext:      dial,
+		MaxIdleConnsPerHost: 2, // one for GETs and one for POSTs
+		IdleConnTimeout:     pollIdleTimeout,
+	}
+	hc := &http.Client{Transport: tr}
+	urlStr := c.urlString(node)
+
+	req, err := http.NewRequest("POST", urlStr, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(pollHeader, "open")
+	res, err := hc.Do(req.WithContext(ctx))
+	if err != nil {
+		tr.CloseIdleConnections()
+		return nil, err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<10))
+	res.Body.Close()
+	id := res.Header.Get(pollSessionHeader)
+	if res.StatusCode != http.StatusOK || id == "" {
+		tr.CloseIdleConnections()
+		return nil, fmt.Errorf("opening DERP long-poll session: %v", res.Status)
+	}
+
+	pc := newPollConn()
+	pctx, cancel := context.WithCancel(context.Background())
+	do := func(method string, body []byte, hdr string) (*http.Response, error) {
+		req, err := http.NewRequest(method, urlStr, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(pollSessionHeader, id)
+		if hdr != "" {
+			req.Header.Set(pollHeader, hdr)
+		}
+		return hc.Do(req.WithContext(pctx))
+	}
+	pc.onClose = func() {
+		cancel()
+		// Tell the server, rather than leave the session to
+		// expire, but don't wait for it.
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			req, err := http.NewRequest("POST", urlStr, nil)
+			if err == nil {
+				req.Header.Set(pollSessionHeader, id)
+				req.Header.Set(pollHeader, "close")
+				if res, err := hc.Do(req.WithContext(ctx)); err == nil {
+					res.Body.Close()
+				}
+			}
+			tr.CloseIdleConnections()
+		}()
+	}
+
+	// Receive: long-poll for the server's bytes.
+	go func() {
+		defer pc.Close()
+		for {
+			res, err := do("GET", nil, "")
+			if err != nil {
+				return
+			}
+			b, err := ioutil.ReadAll(io.LimitReader(res.Body, pollMaxBody+1))
+			res.Body.Close()
+			if err != nil || res.StatusCode != http.StatusOK {
+				return
+			}
+			if len(b) == 0 {
+				continue
+			}
+			if _, err := pc.in.write(b, noDeadline, pc.closed); err != nil {
+				return
+			}
+		}
+	}()
+	// Send: post what the DERP client writes, in order.
+	go func() {
+		defer pc.Close()
+		for {
+			b, err := pc.out.take(time.Time{}, pc.closed)
+			if err != nil {
+				return
+			}
+			res, err := do("POST", b, "")
+			if err != nil {
+				return
+			}
+			io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<10))
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				return
+			}
+		}
+	}()
+	return pc, nil
+}
+
+// dialHTTPConn dials node, or c's URL if it has one, for another HTTP
+// request to the same server, doing the TLS handshake if needed.
+func (c *Client) dialHTTPConn(ctx context.Context, node *tailcfg.DERPNode) (net.Conn, error) {
+	var nc net.Conn
+	var err error
+	if c.url != nil {
+		nc, err = c.dialURL(ctx)
+	} else {
+		nc, err = c.dialNode(ctx, node)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !c.useHTTPS() {
+		return nc, nil
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(dl)
+		defer nc.SetDeadline(time.Time{})
+	}
+	tc := c.tlsClient(nc, node)
+	if err := tc.Handshake(); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return tc, nil
+}
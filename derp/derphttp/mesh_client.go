@@ -16,6 +16,7 @@ import (
 // connection changes.
 //
 // If the server's public key is ignoreServerKey, RunWatchConnectionLoop returns.
+// It also returns once c is closed.
 //
 // Otherwise, the add and remove funcs are called as clients come & go.
 func (c *Client) RunWatchConnectionLoop(ignoreServerKey key.Public, add, remove func(key.Public)) {
@@ -81,6 +82,10 @@ func (c *Client) RunWatchConnectionLoop(ignoreServerKey key.Public, add, remove
 
 	for {
 		err := c.WatchConnectionChanges()
+		if err == ErrClientClosed {
+			clear()
+			return
+		}
 		if err != nil {
 			clear()
 			logf("WatchConnectionChanges: %v", err)
@@ -94,6 +99,10 @@ func (c *Client) RunWatchConnectionLoop(ignoreServerKey key.Public, add, remove
 		}
 		for {
 			m, connGen, err := c.RecvDetail()
+			if err == ErrClientClosed {
+				clear()
+				return
+			}
 			if err != nil {
 				clear()
 				logf("Recv: %v", err)
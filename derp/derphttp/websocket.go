@@ -0,0 +1,237 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package derphttp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// This file implements just enough of WebSockets (RFC 6455) to carry
+// the DERP protocol in binary messages, for networks whose middleboxes
+// understand WebSockets but break other upgraded HTTP connections.
+
+// websocketProtocol is the WebSocket subprotocol name for DERP.
+const websocketProtocol = "derp"
+
+// websocketGUID is the magic value from RFC 6455 section 1.3 used to
+// compute Sec-WebSocket-Accept.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket frame opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// wsAcceptKey returns the Sec-WebSocket-Accept value for the
+// Sec-WebSocket-Key value key.
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key)
+	io.WriteString(h, websocketGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// newWSKey returns a random Sec-WebSocket-Key value.
+func newWSKey() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b[:]), nil
+}
+
+// isWebSocketUpgrade reports whether r asks for a WebSocket upgrade
+// with the DERP subprotocol.
+func isWebSocketUpgrade(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || r.Header.Get("Sec-WebSocket-Key") == "" {
+		return false
+	}
+	for _, v := range r.Header["Sec-Websocket-Protocol"] {
+		for _, p := range strings.Split(v, ",") {
+			if strings.TrimSpace(p) == websocketProtocol {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn is a net.Conn that reads and writes the payloads of binary
+// WebSocket messages on an underlying connection.
+type wsConn struct {
+	net.Conn               // the underlying connection; Read and Write are overridden
+	br       *bufio.Reader // reads from Conn
+	client   bool          // whether we're the client, which masks its frames
+
+	readMu  sync.Mutex // guards the following
+	rem     uint64     // bytes remaining in current frame's payload
+	mask    [4]byte    // current frame's masking key, if masked
+	masked  bool
+	maskPos int
+	readErr error // sticky
+
+	writeMu sync.Mutex // serializes writes of whole frames
+}
+
+func newWSConn(nc net.Conn, br *bufio.Reader, client bool) *wsConn {
+	return &wsConn{Conn: nc, br: br, client: client}
+}
+
+func (c *wsConn) Read(p []byte) (n int, err error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if c.readErr != nil {
+		return 0, c.readErr
+	}
+	for c.rem == 0 {
+		if err := c.readFrameHeaderLocked(); err != nil {
+			c.readErr = err
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > c.rem {
+		p = p[:c.rem]
+	}
+	n, err = c.br.Read(p)
+	c.unmaskLocked(p[:n])
+	c.rem -= uint64(n)
+	return n, err
+}
+
+func (c *wsConn) unmaskLocked(p []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range p {
+		p[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+// readFrameHeaderLocked reads the next frame header, leaving c.rem
+// set to the length of its payload if it's a data frame. Control
+// frames are handled entirely, leaving c.rem zero.
+func (c *wsConn) readFrameHeaderLocked() error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return err
+	}
+	op := hdr[0] & 0x0f
+	if hdr[0]&0x70 != 0 {
+		return errors.New("websocket: unexpected RSV bits")
+	}
+	c.masked = hdr[1]&0x80 != 0
+	if c.masked == c.client {
+		return errors.New("websocket: wrong frame masking")
+	}
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return err
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(c.br, b[:]); err != nil {
+			return err
+		}
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	if c.masked {
+		if _, err := io.ReadFull(c.br, c.mask[:]); err != nil {
+			return err
+		}
+	}
+	c.maskPos = 0
+
+	switch op {
+	case wsBinary, wsContinuation:
+		c.rem = n
+		return nil
+	case wsClose, wsPing, wsPong:
+		if n > 125 {
+			return errors.New("websocket: control frame too long")
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return err
+		}
+		c.unmaskLocked(payload)
+		switch op {
+		case wsClose:
+			c.writeFrame(wsClose, payload)
+			return io.EOF
+		case wsPing:
+			if _, err := c.writeFrame(wsPong, payload); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("websocket: unexpected opcode %d", op)
+	}
+}
+
+func (c *wsConn) Write(p []byte) (n int, err error) {
+	return c.writeFrame(wsBinary, p)
+}
+
+// writeFrame writes p as a single frame with opcode op.
+func (c *wsConn) writeFrame(op byte, p []byte) (n int, err error) {
+	buf := make([]byte, 0, 14+len(p))
+	buf = append(buf, 0x80|op) // FIN
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch {
+	case len(p) <= 125:
+		buf = append(buf, maskBit|byte(len(p)))
+	case len(p) <= 0xffff:
+		buf = append(buf, maskBit|126, byte(len(p)>>8), byte(len(p)))
+	default:
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(len(p)))
+		buf = append(buf, maskBit|127)
+		buf = append(buf, b[:]...)
+	}
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return 0, err
+		}
+		buf = append(buf, mask[:]...)
+		for i, b := range p {
+			buf = append(buf, b^mask[i&3])
+		}
+	} else {
+		buf = append(buf, p...)
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
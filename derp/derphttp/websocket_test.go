@@ -0,0 +1,76 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package derphttp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestWSAcceptKey(t *testing.T) {
+	// From RFC 6455 section 1.3.
+	if got, want := wsAcceptKey("dGhlIHNhbXBsZSBub25jZQ=="), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="; got != want {
+		t.Errorf("wsAcceptKey = %q; want %q", got, want)
+	}
+}
+
+func TestWSConn(t *testing.T) {
+	// Not net.Pipe, which has no buffering: the server's pong
+	// must not wait for the client to read.
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c1, err := net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	c2, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	client := newWSConn(c1, bufio.NewReader(c1), true)
+	server := newWSConn(c2, bufio.NewReader(c2), false)
+
+	msgs := [][]byte{
+		[]byte("hello"),
+		bytes.Repeat([]byte("x"), 300),   // 16-bit length
+		bytes.Repeat([]byte("y"), 70000), // 64-bit length
+	}
+	go func() {
+		// A ping between data frames must be answered and
+		// otherwise ignored.
+		client.Write(msgs[0])
+		client.writeFrame(wsPing, []byte("ping"))
+		client.Write(msgs[1])
+		client.Write(msgs[2])
+	}()
+	for _, want := range msgs {
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(server, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("read %d bytes that differ from what was written", len(got))
+		}
+	}
+
+	// The pong for the ping, which the client reads and ignores,
+	// is followed by the server's data.
+	go server.Write([]byte("bye"))
+	got := make([]byte, 3)
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "bye" {
+		t.Errorf("client read %q; want %q", got, "bye")
+	}
+}
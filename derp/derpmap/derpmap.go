@@ -2,14 +2,12 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// Package derpmap contains information about Tailscale.com's production DERP nodes.
+// Package derpmap contains information about Tailscale.com's production DERP nodes,
+// and support for DERP maps supplied by a node's operator.
 //
-// This package is only used by the "tailscale netcheck" command for debugging.
-// In normal operation the Tailscale nodes get this sent to them from the control
-// server.
-//
-// TODO: remove this package and make "tailscale netcheck" get the
-// list from the control server too.
+// The production map is only used by the "tailscale netcheck" command
+// for debugging. In normal operation the Tailscale nodes get this sent
+// to them from the control server.
 package derpmap
 
 import (
@@ -0,0 +1,131 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package derpmap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"tailscale.com/net/tlsdial"
+	"tailscale.com/net/tshttpproxy"
+	"tailscale.com/tailcfg"
+)
+
+// Merge returns the DERP map to use given base, the map from the
+// control server, and overlay, a map supplied locally by the node's
+// operator. Either may be nil.
+//
+// Regions in overlay replace the base regions with the same ID, or
+// add new ones (private regions conventionally use IDs of 900 and
+// up). A region whose value in overlay is nil (null in JSON) is
+// removed. If overlay.OmitDefaultRegions is set, none of the base
+// regions are used.
+//
+// Neither argument is modified; the regions of the result are shared
+// with them.
+func Merge(base, overlay *tailcfg.DERPMap) *tailcfg.DERPMap {
+	if overlay == nil {
+		return base
+	}
+	ret := &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{}}
+	if base != nil && !overlay.OmitDefaultRegions {
+		for id, r := range base.Regions {
+			ret.Regions[id] = r
+		}
+	}
+	for id, r := range overlay.Regions {
+		if r == nil {
+			delete(ret.Regions, id)
+			continue
+		}
+		ret.Regions[id] = r
+	}
+	return ret
+}
+
+// Load reads a DERP map in JSON form from src, which is either an
+// http or https URL or a file path. The result is suitable as the
+// overlay argument of Merge.
+func Load(ctx context.Context, src string) (*tailcfg.DERPMap, error) {
+	var b []byte
+	var err error
+	if strings.HasPrefix(src, "https://") || strings.HasPrefix(src, "http://") {
+		b, err = fetch(ctx, src)
+	} else {
+		b, err = ioutil.ReadFile(src)
+	}
+	if err != nil {
+		return nil, err
+	}
+	dm := new(tailcfg.DERPMap)
+	if err := json.Unmarshal(b, dm); err != nil {
+		return nil, fmt.Errorf("parsing DERP map from %s: %v", src, err)
+	}
+	if err := fixRegionIDs(dm); err != nil {
+		return nil, fmt.Errorf("DERP map from %s: %v", src, err)
+	}
+	return dm, nil
+}
+
+// fixRegionIDs fills in the region IDs of dm's regions and nodes
+// from the map keys, and reports an error if one is inconsistent.
+func fixRegionIDs(dm *tailcfg.DERPMap) error {
+	for id, r := range dm.Regions {
+		if r == nil {
+			continue
+		}
+		if id <= 0 {
+			return fmt.Errorf("invalid region ID %d", id)
+		}
+		if r.RegionID == 0 {
+			r.RegionID = id
+		}
+		if r.RegionID != id {
+			return fmt.Errorf("region %d has RegionID %d", id, r.RegionID)
+		}
+		if len(r.Nodes) == 0 {
+			return fmt.Errorf("region %d has no nodes", id)
+		}
+		for _, n := range r.Nodes {
+			if n.RegionID == 0 {
+				n.RegionID = id
+			}
+			if n.RegionID != id {
+				return fmt.Errorf("node %q in region %d has RegionID %d", n.Name, id, n.RegionID)
+			}
+			if n.HostName == "" {
+				return fmt.Errorf("node %q in region %d has no HostName", n.Name, id)
+			}
+		}
+	}
+	return nil
+}
+
+func fetch(ctx context.Context, urlStr string) ([]byte, error) {
+	req, err := http.NewRequest("GET", urlStr, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = tshttpproxy.ProxyFromEnvironment
+	tr.TLSClientConfig = tlsdial.Config(req.URL.Hostname(), tr.TLSClientConfig)
+	defer tr.CloseIdleConnections()
+	res, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, errors.New(res.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package derpmap
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestMerge(t *testing.T) {
+	r := func(id int) *tailcfg.DERPRegion { return &tailcfg.DERPRegion{RegionID: id} }
+	base := &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{1: r(1), 2: r(2)}}
+	private := r(900)
+
+	tests := []struct {
+		name    string
+		overlay *tailcfg.DERPMap
+		want    []int
+	}{
+		{"nil", nil, []int{1, 2}},
+		{"add", &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{900: private}}, []int{1, 2, 900}},
+		{"remove", &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{1: nil}}, []int{2}},
+		{"omit_default", &tailcfg.DERPMap{
+			Regions:            map[int]*tailcfg.DERPRegion{900: private},
+			OmitDefaultRegions: true,
+		}, []int{900}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Merge(base, tt.overlay)
+			if ids := got.RegionIDs(); !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("regions = %v; want %v", ids, tt.want)
+			}
+			if len(base.Regions) != 2 {
+				t.Errorf("base modified: %v", base.RegionIDs())
+			}
+		})
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "derpmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "derpmap.json")
+	const good = `{"Regions": {
+		"900": {"RegionCode": "home", "Nodes": [{"Name": "900a", "HostName": "derp.example.com"}]},
+		"3": null
+	}}`
+	if err := ioutil.WriteFile(path, []byte(good), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dm, err := Load(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := dm.Regions[900]
+	if r == nil || r.RegionID != 900 || r.Nodes[0].RegionID != 900 {
+		t.Errorf("region 900 = %+v; want RegionIDs filled in", r)
+	}
+	if r, ok := dm.Regions[3]; !ok || r != nil {
+		t.Errorf("region 3 = %v, %v; want nil, true", r, ok)
+	}
+
+	const bad = `{"Regions": {"900": {"RegionID": 901, "Nodes": [{"HostName": "derp.example.com"}]}}}`
+	if err := ioutil.WriteFile(path, []byte(bad), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(context.Background(), path); err == nil {
+		t.Error("Load of mismatched RegionID succeeded")
+	}
+}
@@ -97,10 +97,15 @@ func appendMsgHeader(b []byte, t MessageType, ver uint8, dataLen int) (all, data
 
 type Ping struct {
 	TxID [12]byte
+
+	// Padding is the number of zero bytes after TxID, to make
+	// the ping a given size when probing a path's MTU. Receivers
+	// that predate it ignore the extra bytes.
+	Padding int
 }
 
 func (m *Ping) AppendMarshal(b []byte) []byte {
-	ret, d := appendMsgHeader(b, TypePing, v0, 12)
+	ret, d := appendMsgHeader(b, TypePing, v0, 12+m.Padding)
 	copy(d, m.TxID[:])
 	return ret
 }
@@ -111,6 +116,7 @@ func parsePing(ver uint8, p []byte) (m *Ping, err error) {
 	}
 	m = new(Ping)
 	copy(m.TxID[:], p)
+	m.Padding = len(p) - 12
 	return m, nil
 }
 
@@ -0,0 +1,121 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package health tracks problems with the subsystems of the running
+// node, such as failing to program routes, and rolls them up into an
+// overall health state.
+package health
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Subsystem is a part of the node whose health is tracked.
+type Subsystem string
+
+const (
+	// SysRouter is the OS router: addresses, routes and firewall
+	// rules.
+	SysRouter Subsystem = "router"
+	// SysDNS is the OS DNS configuration.
+	SysDNS Subsystem = "dns"
+	// SysDERP is the home DERP region.
+	SysDERP Subsystem = "derp"
+	// SysKeyExpiry is the node key's expiry.
+	SysKeyExpiry Subsystem = "key-expiry"
+	// SysSubnetRoutes is the reachability of the subnets the node
+	// advertises routes to.
+	SysSubnetRoutes Subsystem = "subnet-routes"
+	// SysRouteConflicts is the overlap of the routes accepted from
+	// peers with the node's LAN subnets.
+	SysRouteConflicts Subsystem = "route-conflicts"
+	// SysPeerHandshakes is the completion of WireGuard handshakes
+	// with the peers there's traffic for.
+	SysPeerHandshakes Subsystem = "peer-handshakes"
+)
+
+// Status is the health of the node.
+type Status struct {
+	// Healthy is whether no subsystem has a problem.
+	Healthy bool
+	// Problems maps each subsystem with a problem to a description
+	// of it.
+	Problems map[Subsystem]string `json:",omitempty"`
+}
+
+// Strings returns the problems in st as "subsystem: problem" lines,
+// sorted by subsystem.
+func (st Status) Strings() []string {
+	var ret []string
+	for sys, msg := range st.Problems {
+		ret = append(ret, fmt.Sprintf("%s: %s", sys, msg))
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+var (
+	mu       sync.Mutex
+	problems = map[Subsystem]string{}
+	watchers = map[*watcher]bool{}
+)
+
+type watcher struct{ fn func() }
+
+// Set records the health of sys: err describes its problem, or is nil
+// if it has none. Watchers are called if that changes the node's
+// health.
+func Set(sys Subsystem, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	old, had := problems[sys]
+	if err == nil {
+		if !had {
+			return
+		}
+		delete(problems, sys)
+	} else {
+		msg := err.Error()
+		if had && msg == old {
+			return
+		}
+		problems[sys] = msg
+	}
+	for w := range watchers {
+		// In a new goroutine, as Set is called with other locks
+		// held. The watcher can call Get for the latest state.
+		go w.fn()
+	}
+}
+
+// Get returns the current health of the node.
+func Get() Status {
+	mu.Lock()
+	defer mu.Unlock()
+	st := Status{Healthy: len(problems) == 0}
+	if len(problems) > 0 {
+		st.Problems = make(map[Subsystem]string, len(problems))
+		for sys, msg := range problems {
+			st.Problems[sys] = msg
+		}
+	}
+	return st
+}
+
+// RegisterWatcher arranges for fn to be called, in a new goroutine,
+// whenever the node's health changes. It returns a func to stop
+// calling fn.
+func RegisterWatcher(fn func()) (unregister func()) {
+	w := &watcher{fn}
+	mu.Lock()
+	defer mu.Unlock()
+	watchers[w] = true
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(watchers, w)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package health
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	changed := make(chan bool, 10)
+	unregister := RegisterWatcher(func() { changed <- true })
+	defer unregister()
+	wantChange := func(want bool) {
+		t.Helper()
+		select {
+		case <-changed:
+			if !want {
+				t.Error("unexpected watcher call")
+			}
+		case <-time.After(50 * time.Millisecond):
+			if want {
+				t.Error("watcher not called")
+			}
+		}
+	}
+
+	if st := Get(); !st.Healthy || len(st.Problems) != 0 {
+		t.Fatalf("initial status = %+v; want healthy", st)
+	}
+
+	Set(SysRouter, errors.New("route add failed"))
+	wantChange(true)
+	Set(SysRouter, errors.New("route add failed"))
+	wantChange(false)
+	Set(SysDNS, errors.New("resolv.conf not writable"))
+	wantChange(true)
+
+	st := Get()
+	if st.Healthy {
+		t.Error("Healthy with problems")
+	}
+	want := []string{"dns: resolv.conf not writable", "router: route add failed"}
+	if got := st.Strings(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Strings = %q; want %q", got, want)
+	}
+
+	Set(SysRouter, nil)
+	wantChange(true)
+	Set(SysRouter, nil)
+	wantChange(false)
+	Set(SysDNS, nil)
+	wantChange(true)
+	if st := Get(); !st.Healthy {
+		t.Errorf("status = %+v; want healthy", st)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"tailscale.com/log/auditlog"
+	"tailscale.com/wgengine/filter"
+)
+
+// Kinds of audit log entries.
+const (
+	AuditPrefs  = "prefs"  // a Prefs change
+	AuditFilter = "filter" // a packet filter change from the netmap or prefs
+	AuditLogin  = "login"  // a login started, finished or changed user
+	AuditLogout = "logout" // a logout
+	AuditLock   = "lock"   // a network lock change or signature
+)
+
+// auditf records an event in the audit log.
+func (b *LocalBackend) auditf(kind, format string, args ...interface{}) {
+	if err := b.audit.Append(kind, fmt.Sprintf(format, args...)); err != nil {
+		b.logf("audit log: %v", err)
+	}
+}
+
+// AuditLog returns the audit log entries with a Seq greater than
+// since, oldest first.
+func (b *LocalBackend) AuditLog(since int64) ([]auditlog.Entry, error) {
+	return b.audit.Entries(since)
+}
+
+// prefsChanges describes the fields that differ between old and new,
+// other than Persist, one per element.
+func prefsChanges(old, new *Prefs) []string {
+	var ret []string
+	ov, nv := reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem()
+	t := ov.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Name
+		of, nf := ov.Field(i).Interface(), nv.Field(i).Interface()
+		if name == "Persist" || reflect.DeepEqual(of, nf) {
+			continue
+		}
+		if name == "ProxyURL" {
+			// It can hold a password.
+			ret = append(ret, name+" changed")
+			continue
+		}
+		ret = append(ret, fmt.Sprintf("%s: %v -> %v", name, of, nf))
+	}
+	return ret
+}
+
+// auditFilter records a change of the packet filter in the audit log,
+// if its rules or whether shields are up changed since the last
+// change recorded.
+func (b *LocalBackend) auditFilter(rules []filter.Match, shieldsUp bool) {
+	if shieldsUp {
+		if !b.auditedShieldsUp {
+			b.auditf(AuditFilter, "shields up: all incoming connections blocked")
+			b.auditedShieldsUp = true
+		}
+		return
+	}
+	diff, changed := filterRulesDiff(b.auditedRules, rules)
+	switch {
+	case b.auditedShieldsUp:
+		b.auditf(AuditFilter, "shields down: %s", diff)
+	case changed:
+		b.auditf(AuditFilter, "%s", diff)
+	}
+	b.auditedShieldsUp = false
+	b.auditedRules = rules
+}
+
+// filterRulesDiff summarizes the rules added and removed going from
+// the packet filter old to new, and reports whether there are any.
+func filterRulesDiff(old, new []filter.Match) (summary string, changed bool) {
+	oldSet := make(map[string]bool)
+	for _, m := range old {
+		oldSet[m.String()] = true
+	}
+	newSet := make(map[string]bool)
+	var added, removed []string
+	for _, m := range new {
+		s := m.String()
+		newSet[s] = true
+		if !oldSet[s] {
+			added = append(added, s)
+		}
+	}
+	for _, m := range old {
+		if s := m.String(); !newSet[s] {
+			removed = append(removed, s)
+		}
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d rules (+%d -%d)", len(new), len(added), len(removed))
+	for _, s := range added {
+		fmt.Fprintf(&sb, "\n+ %s", s)
+	}
+	for _, s := range removed {
+		fmt.Fprintf(&sb, "\n- %s", s)
+	}
+	return sb.String(), len(added)+len(removed) > 0
+}
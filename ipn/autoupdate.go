@@ -0,0 +1,85 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"tailscale.com/clientupdate"
+)
+
+const (
+	// autoUpdateInterval is how often tailscaled checks for a new
+	// release while Prefs.AutoUpdate is set, give or take
+	// autoUpdateJitter so that nodes don't all update at once.
+	autoUpdateInterval = 24 * time.Hour
+	autoUpdateJitter   = time.Hour
+
+	// autoUpdateFirstCheck is how long after the pref is set, or
+	// tailscaled starts, the first check is made.
+	autoUpdateFirstCheck = 5 * time.Minute
+
+	// autoUpdateTimeout is how long an update may take.
+	autoUpdateTimeout = 30 * time.Minute
+)
+
+// startAutoUpdateLocked starts autoUpdateLoop if p has AutoUpdate set
+// and it's not already running. b.mu must be held.
+func (b *LocalBackend) startAutoUpdateLocked(p *Prefs) {
+	if p == nil || !p.AutoUpdate || b.autoUpdating {
+		return
+	}
+	b.autoUpdating = true
+	go b.autoUpdateLoop()
+}
+
+// autoUpdateLoop checks for and installs new releases daily while
+// Prefs.AutoUpdate is set.
+func (b *LocalBackend) autoUpdateLoop() {
+	wait := autoUpdateFirstCheck
+	for {
+		t := time.NewTimer(wait)
+		select {
+		case <-b.ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		b.mu.Lock()
+		on := b.prefs != nil && b.prefs.AutoUpdate
+		if !on {
+			b.autoUpdating = false
+		}
+		b.mu.Unlock()
+		if !on {
+			return
+		}
+
+		b.autoUpdate()
+		wait = autoUpdateInterval - autoUpdateJitter + time.Duration(rand.Int63n(int64(2*autoUpdateJitter)))
+	}
+}
+
+// autoUpdate installs the latest release of this build's track, if
+// it's newer.
+func (b *LocalBackend) autoUpdate() {
+	ctx, cancel := context.WithTimeout(b.ctx, autoUpdateTimeout)
+	defer cancel()
+	u := &clientupdate.Updater{Logf: b.logf}
+	rel, err := u.Check(ctx)
+	if err != nil {
+		b.logf("autoupdate: checking for updates: %v", err)
+		return
+	}
+	if !clientupdate.Newer(rel) {
+		return
+	}
+	b.logf("autoupdate: updating to %s", rel.Version)
+	if err := u.Update(ctx, rel); err != nil {
+		b.logf("autoupdate: %v", err)
+	}
+}
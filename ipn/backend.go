@@ -10,6 +10,7 @@ import (
 
 	"golang.org/x/oauth2"
 	"tailscale.com/control/controlclient"
+	"tailscale.com/health"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/empty"
@@ -52,6 +53,29 @@ type EngineStatus struct {
 	LivePeers      map[tailcfg.NodeKey]wgengine.PeerStatus
 }
 
+// LogUploadState is whether tailscaled uploads its logs to the log
+// service, as served by the local API.
+type LogUploadState struct {
+	// Uploading is whether logs are being uploaded now.
+	Uploading bool
+	// Disabled is whether uploading is turned off in the saved log
+	// config. Turning it back on takes effect when tailscaled
+	// restarts, so Disabled can be false while Uploading is too.
+	Disabled bool
+}
+
+// LoginStatus is the progress of logging in, as served by the local
+// API for installers and other frontends driving an interactive login
+// without a browser.
+type LoginStatus struct {
+	// State is the backend's state, as a State's String.
+	State string
+	// AuthURL is the URL at which the user must log in to finish,
+	// once the control server has sent it. It's empty when logged
+	// in.
+	AuthURL string `json:",omitempty"`
+}
+
 // Notify is a communication from a backend (e.g. tailscaled) to a frontend
 // (cmd/tailscale, iOS, macOS, Win Tasktray).
 // In any given notification, any or all of these may be nil, meaning
@@ -71,6 +95,29 @@ type Notify struct {
 	BackendLogID  *string                   // public logtail id used by backend
 	PingResult    *ipnstate.PingResult
 
+	// FilesWaiting, if non-nil, is an event that a file was
+	// received from a peer into the inbox directory and is waiting
+	// to be picked up (see LocalBackend.WaitingFiles).
+	FilesWaiting *empty.Message `json:",omitempty"`
+
+	// KeyExpiry, if non-nil, warns that the node key expires (or
+	// expired) at the given time and that the user will need to log
+	// in again. It's not sent when the key is renewed automatically.
+	KeyExpiry *time.Time `json:",omitempty"`
+
+	// Health, if non-nil, is the node's new health, sent when a
+	// subsystem develops or recovers from a problem.
+	Health *health.Status `json:",omitempty"`
+
+	// PeerChanges, if non-nil, are peers that came online, went
+	// offline, or changed paths. They're only sent to watchers;
+	// see LocalBackend.WatchNotifications.
+	PeerChanges []PeerChange `json:",omitempty"`
+
+	// PacketFilter, if non-nil, is the new packet filter, sent
+	// when it changes.
+	PacketFilter *FilterUpdate `json:",omitempty"`
+
 	// LocalTCPPort, if non-nil, informs the UI frontend which
 	// (non-zero) localhost TCP port it's listening on.
 	// This is currently only used by Tailscale when run in the
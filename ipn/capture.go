@@ -0,0 +1,97 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"tailscale.com/net/pcapng"
+	"tailscale.com/wgengine/tstun"
+)
+
+// captureQueueLen is how many packets a capture stream buffers
+// before dropping them, so that a slow reader doesn't slow down the
+// tunnel.
+const captureQueueLen = 512
+
+type capturedPacket struct {
+	where tstun.CapturePoint
+	when  time.Time
+	pkt   []byte
+}
+
+// StreamCapture writes a pcapng capture of the decrypted packets
+// passing through the TUN device to w until ctx is done or writing
+// fails. Each packet appears once as seen before the packet filter
+// and, if accepted, again after it; a comment on each tells which.
+//
+// If w is an http.Flusher, it's flushed whenever the capture catches
+// up with the traffic.
+func (b *LocalBackend) StreamCapture(ctx context.Context, w io.Writer) error {
+	pw, err := pcapng.NewWriter(w, pcapng.LinkTypeRaw, "tailscale")
+	if err != nil {
+		return err
+	}
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	sink := make(chan capturedPacket, captureQueueLen)
+	b.captureMu.Lock()
+	if b.captureSinks == nil {
+		b.captureSinks = make(map[chan capturedPacket]bool)
+	}
+	b.captureSinks[sink] = true
+	if len(b.captureSinks) == 1 {
+		b.e.SetCaptureHook(b.capturePacket)
+	}
+	b.captureMu.Unlock()
+
+	defer func() {
+		b.captureMu.Lock()
+		defer b.captureMu.Unlock()
+		delete(b.captureSinks, sink)
+		if len(b.captureSinks) == 0 {
+			b.e.SetCaptureHook(nil)
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case p := <-sink:
+			dir := pcapng.DirOutbound
+			if p.where.FromPeer() {
+				dir = pcapng.DirInbound
+			}
+			if err := pw.WritePacket(p.when, p.pkt, dir, p.where.String()); err != nil {
+				return err
+			}
+			if flusher != nil && len(sink) == 0 {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// capturePacket is the engine's capture hook while StreamCapture is
+// running. It hands a copy of pkt to every capture stream with room
+// for it.
+func (b *LocalBackend) capturePacket(where tstun.CapturePoint, when time.Time, pkt []byte) {
+	p := capturedPacket{where, when, append([]byte(nil), pkt...)}
+	b.captureMu.Lock()
+	defer b.captureMu.Unlock()
+	for sink := range b.captureSinks {
+		select {
+		case sink <- p:
+		default:
+		}
+	}
+}
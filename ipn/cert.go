@@ -0,0 +1,245 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"tailscale.com/atomicfile"
+	"tailscale.com/tailcfg"
+)
+
+// certRenewWindow is how long before expiry a certificate is
+// replaced with a new one.
+const certRenewWindow = 30 * 24 * time.Hour
+
+// acmeMu serializes certificate issuance, so concurrent requests for
+// the same name don't each go to the ACME server.
+var acmeMu sync.Mutex
+
+// GetCertPEM returns a TLS certificate and private key for domain,
+// which must be one of the node's CertDomains, in PEM form.
+//
+// Certificates are issued by Let's Encrypt, completing the DNS-01
+// challenge through the control server, and are kept under the
+// TailscaleVarRoot until they're due for renewal.
+func (b *LocalBackend) GetCertPEM(ctx context.Context, domain string) (certPEM, keyPEM []byte, err error) {
+	b.mu.Lock()
+	nm := b.netMap
+	cc := b.c
+	dir := b.varRoot
+	b.mu.Unlock()
+
+	if dir == "" {
+		return nil, nil, errors.New("no state directory to keep certificates in")
+	}
+	if nm == nil || cc == nil {
+		return nil, nil, errors.New("not connected to control")
+	}
+	if !validCertDomain(nm.DNS.CertDomains, domain) {
+		if len(nm.DNS.CertDomains) == 0 {
+			return nil, nil, errors.New("your Tailscale network doesn't support TLS certificates")
+		}
+		return nil, nil, fmt.Errorf("invalid domain %q; must be one of %q", domain, nm.DNS.CertDomains)
+	}
+	dir = filepath.Join(dir, "certs")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, err
+	}
+
+	acmeMu.Lock()
+	defer acmeMu.Unlock()
+
+	now := time.Now()
+	if certPEM, keyPEM, ok := readCertPair(dir, domain, now); ok {
+		return certPEM, keyPEM, nil
+	}
+	certPEM, keyPEM, err = b.issueCert(ctx, cc.SetDNS, dir, domain)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
+func validCertDomain(certDomains []string, domain string) bool {
+	for _, d := range certDomains {
+		if d == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// readCertPair returns the cached certificate for domain in dir, if
+// there is one that isn't due for renewal.
+func readCertPair(dir, domain string, now time.Time) (certPEM, keyPEM []byte, ok bool) {
+	certPEM, err := ioutil.ReadFile(filepath.Join(dir, domain+".crt"))
+	if err != nil {
+		return nil, nil, false
+	}
+	keyPEM, err = ioutil.ReadFile(filepath.Join(dir, domain+".key"))
+	if err != nil {
+		return nil, nil, false
+	}
+	c, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, nil, false
+	}
+	leaf, err := x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		return nil, nil, false
+	}
+	if now.Add(certRenewWindow).After(leaf.NotAfter) {
+		return nil, nil, false
+	}
+	return certPEM, keyPEM, true
+}
+
+// issueCert gets a new certificate for domain from Let's Encrypt and
+// stores it in dir. setDNS publishes the DNS-01 challenge records.
+func (b *LocalBackend) issueCert(ctx context.Context, setDNS func(context.Context, *tailcfg.SetDNSRequest) error, dir, domain string) (certPEM, keyPEM []byte, err error) {
+	b.logf("cert: requesting certificate for %q", domain)
+	acctKey, err := loadOrCreateKey(filepath.Join(dir, "acme-account.key.pem"))
+	if err != nil {
+		return nil, nil, err
+	}
+	ac := &acme.Client{Key: acctKey}
+	if _, err := ac.Register(ctx, new(acme.Account), acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		return nil, nil, fmt.Errorf("acme register: %v", err)
+	}
+
+	order, err := ac.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		return nil, nil, fmt.Errorf("acme order: %v", err)
+	}
+	for _, u := range order.AuthzURLs {
+		az, err := ac.GetAuthorization(ctx, u)
+		if err != nil {
+			return nil, nil, err
+		}
+		if az.Status == acme.StatusValid {
+			continue
+		}
+		var chal *acme.Challenge
+		for _, c := range az.Challenges {
+			if c.Type == "dns-01" {
+				chal = c
+				break
+			}
+		}
+		if chal == nil {
+			return nil, nil, errors.New("acme: no dns-01 challenge offered")
+		}
+		rec, err := ac.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = setDNS(ctx, &tailcfg.SetDNSRequest{
+			Name:  "_acme-challenge." + domain,
+			Type:  "TXT",
+			Value: rec,
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("setting DNS-01 challenge record: %v", err)
+		}
+		if _, err := ac.Accept(ctx, chal); err != nil {
+			return nil, nil, fmt.Errorf("acme accept: %v", err)
+		}
+		if _, err := ac.WaitAuthorization(ctx, u); err != nil {
+			return nil, nil, fmt.Errorf("acme authorization: %v", err)
+		}
+	}
+	order, err = ac.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, nil, fmt.Errorf("acme order: %v", err)
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: []string{domain},
+	}, certKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, _, err := ac.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("acme finalize: %v", err)
+	}
+
+	var certBuf bytes.Buffer
+	for _, d := range der {
+		pem.Encode(&certBuf, &pem.Block{Type: "CERTIFICATE", Bytes: d})
+	}
+	keyPEM, err = encodeECKey(certKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := atomicfile.WriteFile(filepath.Join(dir, domain+".key"), keyPEM, 0600); err != nil {
+		return nil, nil, err
+	}
+	if err := atomicfile.WriteFile(filepath.Join(dir, domain+".crt"), certBuf.Bytes(), 0644); err != nil {
+		return nil, nil, err
+	}
+	b.logf("cert: got certificate for %q", domain)
+	return certBuf.Bytes(), keyPEM, nil
+}
+
+// loadOrCreateKey returns the ECDSA private key stored in PEM form at
+// path, creating it if it doesn't exist.
+func loadOrCreateKey(path string) (crypto.Signer, error) {
+	pemBytes, err := ioutil.ReadFile(path)
+	if err == nil {
+		blk, _ := pem.Decode(pemBytes)
+		if blk == nil || !strings.HasSuffix(blk.Type, "PRIVATE KEY") {
+			return nil, fmt.Errorf("%s: invalid PEM", path)
+		}
+		return x509.ParseECPrivateKey(blk.Bytes)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	pemBytes, err = encodeECKey(k)
+	if err != nil {
+		return nil, err
+	}
+	if err := atomicfile.WriteFile(path, pemBytes, 0600); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func encodeECKey(k *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(k)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
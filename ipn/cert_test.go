@@ -0,0 +1,78 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"crypto/ecdsa"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadCertPair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cert-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const domain = "foo.example.beta.tailscale.net"
+	now := time.Now()
+	if _, _, ok := readCertPair(dir, domain, now); ok {
+		t.Fatal("found certificate in empty dir")
+	}
+
+	c, err := selfSignedCert(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := encodeECKey(c.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Certificate[0]})
+	if err := ioutil.WriteFile(filepath.Join(dir, domain+".crt"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, domain+".key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	gotCert, gotKey, ok := readCertPair(dir, domain, now)
+	if !ok {
+		t.Fatal("didn't find stored certificate")
+	}
+	if string(gotCert) != string(certPEM) || string(gotKey) != string(keyPEM) {
+		t.Error("read back different certificate or key")
+	}
+	// Due for renewal.
+	if _, _, ok := readCertPair(dir, domain, c.Leaf.NotAfter.Add(-certRenewWindow/2)); ok {
+		t.Error("returned certificate that's due for renewal")
+	}
+}
+
+func TestLoadOrCreateKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cert-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "acme-account.key.pem")
+	k1, err := loadOrCreateKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, err := loadOrCreateKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !k1.(*ecdsa.PrivateKey).Equal(k2) {
+		t.Error("key changed after reload")
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package conffile reads tailscaled's declarative config file, which
+// sets the node's prefs the way "tailscale up" flags would, so that
+// deployments such as Helm charts can keep the whole configuration
+// in one file.
+//
+// The file is JSON that may also have comments and trailing commas
+// (HuJSON):
+//
+//	{
+//		"AuthKey": "file:/etc/tailscale/authkey",
+//		"Hostname": "gateway",
+//		"AdvertiseRoutes": ["10.0.0.0/16"],
+//		"AdvertiseTags": ["tag:gateway"],
+//		"AcceptDNS": false,
+//		"LogLevels": {"filter": "debug"}, // log every verdict
+//	}
+//
+// Fields that are left out leave the corresponding prefs as they
+// are.
+package conffile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+)
+
+// Config is the contents of a config file.
+type Config struct {
+	// AuthKey is the auth key to log in with when the node isn't
+	// logged in, or "file:<path>" to read it from a file. It's only
+	// used when tailscaled starts.
+	AuthKey string
+
+	// ServerURL is the URL of the control server.
+	ServerURL string
+
+	// Hostname overrides the OS hostname.
+	Hostname string
+
+	// Enabled is whether the node should be connected. It defaults
+	// to true.
+	Enabled *bool
+
+	// AdvertiseRoutes are the subnet routes to advertise.
+	AdvertiseRoutes []string
+
+	// AdvertiseTags are the ACL tags to request.
+	AdvertiseTags []string
+
+	// ExitNode is the tailnet IP of the exit node to route internet
+	// traffic through, "auto" to pick the fastest one, or empty for
+	// none.
+	ExitNode *string
+
+	// AcceptDNS is whether to use the tailnet's DNS settings.
+	AcceptDNS *bool
+
+	// AcceptRoutes is whether to use the subnet routes advertised
+	// by other nodes.
+	AcceptRoutes *bool
+
+	// ShieldsUp is whether to block incoming connections.
+	ShieldsUp *bool
+
+	// LogLevels are the log levels of components such as "filter"
+	// or "magicsock", for debugging.
+	LogLevels map[string]logger.Level
+
+	routes   []wgcfg.CIDR // parsed AdvertiseRoutes
+	exitNode netaddr.IP   // parsed ExitNode
+}
+
+// Load reads and parses the config file at path.
+func Load(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Parse parses and checks the contents of a config file.
+func Parse(b []byte) (*Config, error) {
+	b, err := standardize(b)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	c := new(Config)
+	if err := dec.Decode(c); err != nil {
+		return nil, err
+	}
+	for _, s := range c.AdvertiseRoutes {
+		r, err := wgcfg.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("AdvertiseRoutes: %q: %v", s, err)
+		}
+		c.routes = append(c.routes, r)
+	}
+	for _, tag := range c.AdvertiseTags {
+		if err := tailcfg.CheckTag(tag); err != nil {
+			return nil, fmt.Errorf("AdvertiseTags: %q: %v", tag, err)
+		}
+	}
+	if c.ExitNode != nil && *c.ExitNode != "" && *c.ExitNode != "auto" {
+		c.exitNode, err = netaddr.ParseIP(*c.ExitNode)
+		if err != nil {
+			return nil, fmt.Errorf("ExitNode: %v", err)
+		}
+	}
+	return c, nil
+}
+
+// ResolveAuthKey returns the auth key, read from its file if AuthKey
+// is of the form "file:<path>".
+func (c *Config) ResolveAuthKey() (string, error) {
+	if !strings.HasPrefix(c.AuthKey, "file:") {
+		return c.AuthKey, nil
+	}
+	path := strings.TrimPrefix(c.AuthKey, "file:")
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading auth key: %v", err)
+	}
+	key := strings.TrimSpace(string(b))
+	if key == "" {
+		return "", fmt.Errorf("auth key file %s is empty", path)
+	}
+	return key, nil
+}
+
+// Apply sets the prefs in p that c configures.
+func (c *Config) Apply(p *ipn.Prefs) {
+	if c.ServerURL != "" {
+		p.ControlURL = c.ServerURL
+	}
+	if c.Hostname != "" {
+		p.Hostname = c.Hostname
+	}
+	p.WantRunning = c.Enabled == nil || *c.Enabled
+	if c.AdvertiseRoutes != nil {
+		p.AdvertiseRoutes = append([]wgcfg.CIDR(nil), c.routes...)
+	}
+	if c.AdvertiseTags != nil {
+		p.AdvertiseTags = append([]string(nil), c.AdvertiseTags...)
+	}
+	if c.ExitNode != nil {
+		p.ExitNodeIP = c.exitNode
+		p.AutoExitNode = *c.ExitNode == "auto"
+	}
+	if c.AcceptDNS != nil {
+		p.CorpDNS = *c.AcceptDNS
+	}
+	if c.AcceptRoutes != nil {
+		p.RouteAll = *c.AcceptRoutes
+	}
+	if c.ShieldsUp != nil {
+		p.ShieldsUp = *c.ShieldsUp
+	}
+}
+
+// standardize returns b, which is HuJSON, as standard JSON: with its
+// comments and trailing commas blanked out, so that the offsets in
+// JSON syntax errors still match the file.
+func standardize(b []byte) ([]byte, error) {
+	out := append([]byte(nil), b...)
+	comma := -1 // index of the last comma, while it may be trailing
+	for i := 0; i < len(out); i++ {
+		switch c := out[i]; {
+		case c == '"':
+			for i++; i < len(out) && out[i] != '"'; i++ {
+				if out[i] == '\\' {
+					i++
+				}
+			}
+			comma = -1
+		case c == '/' && i+1 < len(out) && out[i+1] == '/':
+			for ; i < len(out) && out[i] != '\n'; i++ {
+				out[i] = ' '
+			}
+		case c == '/' && i+1 < len(out) && out[i+1] == '*':
+			n := bytes.Index(out[i+2:], []byte("*/"))
+			if n == -1 {
+				return nil, errors.New("unterminated comment")
+			}
+			end := i + 2 + n + 2
+			for ; i < end; i++ {
+				if out[i] != '\n' {
+					out[i] = ' '
+				}
+			}
+			i--
+		case c == ',':
+			comma = i
+		case c == ']' || c == '}':
+			if comma != -1 {
+				out[comma] = ' '
+			}
+			comma = -1
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+		default:
+			comma = -1
+		}
+	}
+	return out, nil
+}
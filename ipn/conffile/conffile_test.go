@@ -0,0 +1,79 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package conffile
+
+import (
+	"testing"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/types/logger"
+)
+
+func TestStandardize(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{`{"a": 1}`, `{"a": 1}`},
+		{`{"a": [1, 2,],}`, `{"a": [1, 2 ] }`},
+		{"{\"a\": 1, // one\n}", "{\"a\": 1        \n}"},
+		{`{"a": /* , */ "//,}"}`, `{"a":         "//,}"}`},
+		{`{"a": "\",", }`, `{"a": "\","  }`},
+	}
+	for _, tt := range tests {
+		got, err := standardize([]byte(tt.in))
+		if err != nil || string(got) != tt.want {
+			t.Errorf("standardize(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+	if _, err := standardize([]byte(`{/* "a": 1}`)); err == nil {
+		t.Error("unterminated comment: no error")
+	}
+}
+
+func TestParseApply(t *testing.T) {
+	c, err := Parse([]byte(`{
+		// A gateway.
+		"Hostname": "gw",
+		"AdvertiseRoutes": ["10.0.0.0/16"],
+		"AdvertiseTags": ["tag:gw"],
+		"ExitNode": "100.64.0.1",
+		"AcceptDNS": false,
+		"LogLevels": {"filter": "debug"},
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.LogLevels["filter"] != logger.LevelDebug {
+		t.Errorf("LogLevels = %v", c.LogLevels)
+	}
+
+	p := ipn.NewPrefs()
+	p.ShieldsUp = true
+	c.Apply(p)
+	want := ipn.NewPrefs()
+	want.ShieldsUp = true // not configured, so kept
+	want.Hostname = "gw"
+	want.AdvertiseRoutes = []wgcfg.CIDR{{IP: netaddr.IPv4(10, 0, 0, 0), Mask: 16}}
+	want.AdvertiseTags = []string{"tag:gw"}
+	want.ExitNodeIP = netaddr.IPv4(100, 64, 0, 1)
+	want.CorpDNS = false
+	if !p.Equals(want) {
+		t.Errorf("applied prefs:\n%v\nwant:\n%v", p.Pretty(), want.Pretty())
+	}
+
+	for _, bad := range []string{
+		`{"Hostnmae": "gw"}`,
+		`{"AdvertiseRoutes": ["10.0.0.0/99"]}`,
+		`{"AdvertiseTags": ["gw"]}`,
+		`{"ExitNode": "gw"}`,
+		`{"LogLevels": {"filter": "loud"}}`,
+	} {
+		if _, err := Parse([]byte(bad)); err == nil {
+			t.Errorf("Parse(%s) succeeded; want error", bad)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"tailscale.com/net/packet"
+	"tailscale.com/wgengine/tstun"
+)
+
+// connEventQueueLen is how many connection events a watcher buffers
+// before dropping them, so that a slow one doesn't slow down the
+// tunnel.
+const connEventQueueLen = 256
+
+// ConnEvent is a new inbound connection to this node, or to a subnet
+// it routes, that the packet filter accepted: a TCP connection
+// attempt, or the first UDP packet of a flow in a while.
+type ConnEvent struct {
+	Time  time.Time
+	Proto string // "tcp" or "udp"
+	Src   string // ip:port of the sender
+	Dst   string // ip:port connected to
+
+	// PeerNode and PeerUser identify the sender, if Src is the
+	// Tailscale IP of a node in the network map: its name and
+	// the login name of its user.
+	PeerNode string `json:",omitempty"`
+	PeerUser string `json:",omitempty"`
+}
+
+// String returns ev as a line of a connection log, in a stable format
+// of space-separated key=value fields, without the time:
+//
+//	proto=tcp src=100.101.102.103:51234 dst=100.64.0.1:22 node=laptop.example.ts.net user=alice@example.com
+//
+// node and user are left out if the sender isn't known, and fields
+// may be added at the end in future.
+func (ev ConnEvent) String() string {
+	var sb strings.Builder
+	sb.WriteString("proto=" + ev.Proto + " src=" + ev.Src + " dst=" + ev.Dst)
+	if ev.PeerNode != "" {
+		sb.WriteString(" node=" + ev.PeerNode)
+	}
+	if ev.PeerUser != "" {
+		sb.WriteString(" user=" + ev.PeerUser)
+	}
+	return sb.String()
+}
+
+// WatchConns calls fn with each new inbound connection until ctx is
+// done. fn is called from a single goroutine; while it's busy, up to
+// a few hundred events queue up, and any more are dropped.
+func (b *LocalBackend) WatchConns(ctx context.Context, fn func(ConnEvent)) {
+	sink := make(chan tstun.ConnEvent, connEventQueueLen)
+	b.connMu.Lock()
+	if b.connSinks == nil {
+		b.connSinks = make(map[chan tstun.ConnEvent]bool)
+	}
+	b.connSinks[sink] = true
+	if len(b.connSinks) == 1 {
+		b.e.SetConnHook(b.connEvent)
+	}
+	b.connMu.Unlock()
+
+	defer func() {
+		b.connMu.Lock()
+		defer b.connMu.Unlock()
+		delete(b.connSinks, sink)
+		if len(b.connSinks) == 0 {
+			b.e.SetConnHook(nil)
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-sink:
+			fn(b.connEventOf(ev))
+		}
+	}
+}
+
+// connEvent is the engine's conn hook while WatchConns is running.
+// It hands ev to every watcher with room for it.
+func (b *LocalBackend) connEvent(ev tstun.ConnEvent) {
+	b.connMu.Lock()
+	defer b.connMu.Unlock()
+	for sink := range b.connSinks {
+		select {
+		case sink <- ev:
+		default:
+		}
+	}
+}
+
+// connEventOf returns ev with its sender identified from the
+// network map.
+func (b *LocalBackend) connEventOf(ev tstun.ConnEvent) ConnEvent {
+	ce := ConnEvent{
+		Time:  ev.Time,
+		Proto: "udp",
+		Src:   ev.Src.String(),
+		Dst:   ev.Dst.String(),
+	}
+	if ev.Proto == packet.TCP {
+		ce.Proto = "tcp"
+	}
+	if peer, nm, ok := b.peerForIP(ev.Src.IP); ok {
+		ce.PeerNode = peer.Name
+		ce.PeerUser = nm.UserProfiles[peer.User].LoginName
+	}
+	return ce
+}
@@ -0,0 +1,28 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import "testing"
+
+func TestConnEventString(t *testing.T) {
+	tests := []struct {
+		ev   ConnEvent
+		want string
+	}{
+		{
+			ConnEvent{Proto: "tcp", Src: "100.101.102.103:51234", Dst: "100.64.0.1:22", PeerNode: "laptop.example.ts.net", PeerUser: "alice@example.com"},
+			"proto=tcp src=100.101.102.103:51234 dst=100.64.0.1:22 node=laptop.example.ts.net user=alice@example.com",
+		},
+		{
+			ConnEvent{Proto: "udp", Src: "[fd7a:115c:a1e0::1]:5353", Dst: "10.0.0.5:53"},
+			"proto=udp src=[fd7a:115c:a1e0::1]:5353 dst=10.0.0.5:53",
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.ev.String(); got != tt.want {
+			t.Errorf("got  %q\nwant %q", got, tt.want)
+		}
+	}
+}
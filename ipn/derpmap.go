@@ -0,0 +1,75 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"time"
+
+	"tailscale.com/derp/derpmap"
+	"tailscale.com/tailcfg"
+)
+
+// derpMapRefresh is how often a DERP map from a URL is fetched again.
+const derpMapRefresh = 15 * time.Minute
+
+// SetDERPMapSource sets a file path or http(s) URL from which to load
+// a DERP map that's merged with the one from the control server, as
+// described by derpmap.Merge. It's read right away and, if it's a
+// URL, periodically afterwards. An empty src means none.
+func (b *LocalBackend) SetDERPMapSource(src string) {
+	if src == "" {
+		return
+	}
+	go b.derpMapLoop(src)
+}
+
+func (b *LocalBackend) derpMapLoop(src string) {
+	isURL := strings.HasPrefix(src, "https://") || strings.HasPrefix(src, "http://")
+	for {
+		ctx, cancel := context.WithTimeout(b.ctx, time.Minute)
+		dm, err := derpmap.Load(ctx, src)
+		cancel()
+		if err != nil {
+			b.logf("loading DERP map: %v", err)
+		} else {
+			b.setDERPMapOverlay(dm)
+		}
+		if !isURL {
+			return
+		}
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-time.After(derpMapRefresh):
+		}
+	}
+}
+
+// setDERPMapOverlay sets the local DERP map and applies it to the
+// current network map, if any.
+func (b *LocalBackend) setDERPMapOverlay(dm *tailcfg.DERPMap) {
+	b.mu.Lock()
+	if reflect.DeepEqual(dm, b.derpMapOverlay) {
+		b.mu.Unlock()
+		return
+	}
+	b.derpMapOverlay = dm
+	var merged *tailcfg.DERPMap
+	if b.netMap != nil {
+		nm := *b.netMap
+		nm.DERPMap = derpmap.Merge(b.controlDERPMap, dm)
+		b.netMap = &nm
+		merged = nm.DERPMap
+	}
+	b.mu.Unlock()
+
+	b.logf("using local DERP map with %d regions", len(dm.Regions))
+	if merged != nil {
+		b.e.SetDERPMap(merged)
+	}
+}
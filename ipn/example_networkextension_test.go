@@ -0,0 +1,85 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn_test
+
+import (
+	"log"
+	"path/filepath"
+
+	"github.com/tailscale/wireguard-go/device"
+	"github.com/tailscale/wireguard-go/tun"
+	"tailscale.com/ipn"
+	"tailscale.com/types/logger"
+	"tailscale.com/version"
+	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/router"
+	"tailscale.com/wgengine/tstun"
+)
+
+// These stand in for the Swift side of a Network Extension, which a
+// real host calls through cgo.
+var (
+	// containerDir is the app group container shared with the app.
+	containerDir string
+	// setTunnelNetworkSettings applies a router configuration as
+	// NEPacketTunnelNetworkSettings.
+	setTunnelNetworkSettings func(*router.Config) error
+	// writePacketsToFlow writes IP packets to the NEPacketTunnelFlow.
+	writePacketsToFlow func([]byte)
+	// sendToApp sends a message to the app, the extension's frontend.
+	sendToApp func([]byte)
+	// handleAppMessages sets the handler of the app's messages.
+	handleAppMessages func(func([]byte) error)
+)
+
+// This example is the Go half of an iOS or macOS Network Extension
+// running a node, within the extension's memory limit and without
+// forking or execing anything.
+func Example_networkExtension() {
+	logf := logger.Logf(log.Printf)
+	version.SetSandboxed(true)
+
+	// The extension reads and writes packets through its
+	// NEPacketTunnelFlow, not a TUN device, and configures the
+	// interface through NEPacketTunnelNetworkSettings.
+	tdev := tstun.NewChannelTUN()
+	e, err := wgengine.NewUserspaceEngineAdvanced(wgengine.EngineConfig{
+		Logf: logf,
+		TUN:  tdev,
+		RouterGen: func(logger.Logf, *device.Device, tun.Device) (router.Router, error) {
+			return &router.CallbackRouter{SetConfig: setTunnelNetworkSettings}, nil
+		},
+		LowMemory: true,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		for {
+			pkt, err := tdev.ReadOutbound()
+			if err != nil {
+				return
+			}
+			writePacketsToFlow(pkt)
+		}
+	}()
+	// The Swift side's readPackets completion handler passes each
+	// packet to tdev.InjectInbound.
+
+	store, err := ipn.NewFileStore(filepath.Join(containerDir, "tailscaled.state"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	b, err := ipn.NewLocalBackend(logf, "example-logid", store, e)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The app drives the backend as its frontend: its commands,
+	// starting with Start, go to the BackendServer, and the
+	// backend's notifications go back to it.
+	bs := ipn.NewBackendServer(logf, b, sendToApp)
+	handleAppMessages(bs.GotCommandMsg)
+}
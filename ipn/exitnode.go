@@ -0,0 +1,345 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
+	"tailscale.com/control/controlclient"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/interfaces"
+	"tailscale.com/tailcfg"
+)
+
+const (
+	// exitNodeProbeInterval is how often the candidate exit nodes
+	// are pinged while AutoExitNode is set.
+	exitNodeProbeInterval = time.Minute
+
+	// exitNodeProbeTimeout is how long to wait for a ping reply
+	// before counting the probe as failed.
+	exitNodeProbeTimeout = 5 * time.Second
+
+	// exitNodeMaxFailures is how many probes in a row an exit node
+	// may fail before it's considered offline.
+	exitNodeMaxFailures = 2
+)
+
+// exitNodeProbe is the result of probing a candidate exit node.
+type exitNodeProbe struct {
+	latency  time.Duration // of the last successful probe; 0 if none
+	failures int           // consecutive failed probes
+}
+
+// isExitNode reports whether n advertises a default route.
+func isExitNode(n *tailcfg.Node) bool {
+	return hasDefaultRoute(n.AllowedIPs)
+}
+
+// hasDefaultRoute reports whether cidrs includes a default route.
+func hasDefaultRoute(cidrs []wgcfg.CIDR) bool {
+	for _, cidr := range cidrs {
+		if cidr.Mask == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// exitNodeCandidates returns the peers in nm that advertise a default
+// route.
+func exitNodeCandidates(nm *controlclient.NetworkMap) []*tailcfg.Node {
+	var ret []*tailcfg.Node
+	for _, p := range nm.Peers {
+		if isExitNode(p) {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// nodeHasIP reports whether ip is one of n's Tailscale IPs.
+func nodeHasIP(n *tailcfg.Node, ip netaddr.IP) bool {
+	for _, pfx := range wgCIDRsToNetaddr(n.Addresses) {
+		if pfx.IP == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// derpRegionOfNode returns the ID of n's home DERP region, or 0 if
+// unknown.
+func derpRegionOfNode(n *tailcfg.Node) int {
+	const derpPrefix = "127.3.3.40:"
+	if !strings.HasPrefix(n.DERP, derpPrefix) {
+		return 0
+	}
+	id, _ := strconv.Atoi(strings.TrimPrefix(n.DERP, derpPrefix))
+	return id
+}
+
+// exitNodeLatency estimates the latency to exit node candidate n: the
+// latency of the last ping to it if there was one, or else the
+// latency netcheck measured to its home DERP region. ok is false if
+// neither is known.
+func exitNodeLatency(n *tailcfg.Node, probes map[tailcfg.NodeID]exitNodeProbe, derpLatency map[string]float64) (d time.Duration, ok bool) {
+	if p, ok := probes[n.ID]; ok && p.latency > 0 {
+		return p.latency, true
+	}
+	region := derpRegionOfNode(n)
+	if region == 0 {
+		return 0, false
+	}
+	best := 0.0
+	for _, fam := range []string{"-v4", "-v6"} {
+		if sec, ok := derpLatency[fmt.Sprint(region, fam)]; ok && (best == 0 || sec < best) {
+			best = sec
+		}
+	}
+	if best == 0 {
+		return 0, false
+	}
+	return time.Duration(best * float64(time.Second)), true
+}
+
+// pickExitNode returns the candidate to use as the automatic exit
+// node, or nil if there is none. Candidates that failed their recent
+// probes are skipped. The current choice is kept unless another
+// candidate is clearly faster, so that similar latencies don't make
+// the exit node flap.
+func pickExitNode(cands []*tailcfg.Node, current tailcfg.NodeID, probes map[tailcfg.NodeID]exitNodeProbe, derpLatency map[string]float64) *tailcfg.Node {
+	type cand struct {
+		n     *tailcfg.Node
+		d     time.Duration
+		known bool
+	}
+	var cs []cand
+	for _, n := range cands {
+		if probes[n.ID].failures >= exitNodeMaxFailures {
+			continue
+		}
+		d, known := exitNodeLatency(n, probes, derpLatency)
+		cs = append(cs, cand{n, d, known})
+	}
+	if len(cs) == 0 {
+		return nil
+	}
+	sort.SliceStable(cs, func(i, j int) bool {
+		a, b := cs[i], cs[j]
+		if a.known != b.known {
+			return a.known
+		}
+		if a.d != b.d {
+			return a.d < b.d
+		}
+		return a.n.ID < b.n.ID
+	})
+	best := cs[0]
+	for _, c := range cs {
+		if c.n.ID != current || c.n == best.n {
+			continue
+		}
+		// Keep the current exit node if it's within 20% (or
+		// 10ms) of the best one.
+		if c.known && best.known && (c.d-best.d < 10*time.Millisecond || c.d < best.d*6/5) {
+			return c.n
+		}
+	}
+	return best.n
+}
+
+// exitNodeLocked returns the peer to use as the exit node according
+// to prefs, or nil for none. b.mu must be held.
+func (b *LocalBackend) exitNodeLocked(prefs *Prefs, nm *controlclient.NetworkMap) *tailcfg.Node {
+	if !prefs.ExitNodeIP.IsZero() {
+		for _, p := range nm.Peers {
+			if nodeHasIP(p, prefs.ExitNodeIP) {
+				if !isExitNode(p) {
+					b.logf("exit node %v doesn't advertise a default route", prefs.ExitNodeIP)
+					return nil
+				}
+				return p
+			}
+		}
+		b.logf("exit node %v not found in network map", prefs.ExitNodeIP)
+		return nil
+	}
+	if !prefs.AutoExitNode {
+		return nil
+	}
+	var derpLatency map[string]float64
+	if b.hostinfo != nil && b.hostinfo.NetInfo != nil {
+		derpLatency = b.hostinfo.NetInfo.DERPLatency
+	}
+	n := pickExitNode(exitNodeCandidates(nm), b.autoExitNode, b.exitNodeProbes, derpLatency)
+	var id tailcfg.NodeID
+	if n != nil {
+		id = n.ID
+	}
+	if id != b.autoExitNode {
+		if n != nil {
+			b.logf("auto exit node: using %v (%v)", n.Name, n.Key.ShortString())
+		} else {
+			b.logf("auto exit node: no exit node available")
+		}
+		b.autoExitNode = id
+	}
+	if !b.exitNodeProbing {
+		b.exitNodeProbing = true
+		go b.exitNodeProbeLoop()
+	}
+	return n
+}
+
+// onlyExitNodeDefaultRoute removes the default routes that cfg
+// routes to peers other than exit. If exit is nil, it removes all
+// default routes.
+func onlyExitNodeDefaultRoute(cfg *wgcfg.Config, exit *tailcfg.Node) {
+	for i := range cfg.Peers {
+		p := &cfg.Peers[i]
+		if exit != nil && p.PublicKey == wgcfg.Key(exit.Key) {
+			continue
+		}
+		aips := p.AllowedIPs[:0]
+		for _, cidr := range p.AllowedIPs {
+			if cidr.Mask != 0 {
+				aips = append(aips, cidr)
+			}
+		}
+		p.AllowedIPs = aips
+	}
+}
+
+// lanPrefixes returns the subnets of this machine's network
+// interfaces, or nil if they can't be determined.
+func (b *LocalBackend) lanPrefixes() []netaddr.IPPrefix {
+	lans, err := interfaces.LANPrefixes()
+	if err != nil {
+		b.logf("LAN prefixes: %v", err)
+		return nil
+	}
+	return lans
+}
+
+// exitNodeLANRoutes returns the LAN subnets lans that
+// ExitNodeAllowLANAccess keeps off the Tailscale interface, except
+// those already in one of skip. Those that the routes to peers have
+// exactly are to be skipped, as the OS can't have both.
+func exitNodeLANRoutes(lans []netaddr.IPPrefix, skip ...[]netaddr.IPPrefix) []netaddr.IPPrefix {
+	skipped := make(map[netaddr.IPPrefix]bool)
+	for _, pfxs := range skip {
+		for _, pfx := range pfxs {
+			skipped[pfx] = true
+		}
+	}
+	var ret []netaddr.IPPrefix
+	for _, lan := range lans {
+		if !skipped[lan] {
+			ret = append(ret, lan)
+		}
+	}
+	return ret
+}
+
+// exitNodeProbeLoop periodically pings the candidate exit nodes
+// while AutoExitNode is set, and reconfigures when the result changes
+// which one should be used.
+func (b *LocalBackend) exitNodeProbeLoop() {
+	t := time.NewTicker(exitNodeProbeInterval)
+	defer t.Stop()
+	for {
+		b.mu.Lock()
+		nm := b.netMap
+		auto := b.prefs != nil && b.prefs.AutoExitNode && b.prefs.ExitNodeIP.IsZero()
+		if !auto {
+			b.exitNodeProbing = false
+			b.exitNodeProbes = nil
+			b.autoExitNode = 0
+		}
+		b.mu.Unlock()
+		if !auto {
+			return
+		}
+
+		if nm != nil {
+			if b.probeExitNodes(exitNodeCandidates(nm)) {
+				b.authReconfig()
+			}
+		}
+
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// probeExitNodes pings each of cands once and records the results.
+// It reports whether the automatic exit node choice changed.
+func (b *LocalBackend) probeExitNodes(cands []*tailcfg.Node) (changed bool) {
+	type result struct {
+		id tailcfg.NodeID
+		d  time.Duration // 0 on failure
+	}
+	results := make(chan result, len(cands))
+	for _, n := range cands {
+		if len(n.Addresses) == 0 {
+			results <- result{n.ID, 0}
+			continue
+		}
+		n := n
+		ip, _ := netaddr.FromStdIP(n.Addresses[0].IP.IP())
+		done := make(chan time.Duration, 1)
+		b.e.Ping(ip, func(pr *ipnstate.PingResult) {
+			var d time.Duration
+			if pr.Err == "" {
+				d = time.Duration(pr.LatencySeconds * float64(time.Second))
+			}
+			select {
+			case done <- d:
+			default:
+			}
+		})
+		go func() {
+			select {
+			case d := <-done:
+				results <- result{n.ID, d}
+			case <-time.After(exitNodeProbeTimeout):
+				results <- result{n.ID, 0}
+			}
+		}()
+	}
+	probes := make(map[tailcfg.NodeID]exitNodeProbe, len(cands))
+	for range cands {
+		r := <-results
+		probes[r.id] = exitNodeProbe{latency: r.d}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, p := range probes {
+		if p.latency == 0 {
+			old := b.exitNodeProbes[id]
+			p.latency = old.latency
+			p.failures = old.failures + 1
+			probes[id] = p
+		}
+	}
+	b.exitNodeProbes = probes
+	var derpLatency map[string]float64
+	if b.hostinfo != nil && b.hostinfo.NetInfo != nil {
+		derpLatency = b.hostinfo.NetInfo.DERPLatency
+	}
+	n := pickExitNode(cands, b.autoExitNode, probes, derpLatency)
+	return n == nil && b.autoExitNode != 0 || n != nil && n.ID != b.autoExitNode
+}
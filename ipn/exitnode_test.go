@@ -0,0 +1,167 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+)
+
+func TestDERPRegionOfNode(t *testing.T) {
+	tests := []struct {
+		derp string
+		want int
+	}{
+		{"", 0},
+		{"127.3.3.40:1", 1},
+		{"127.3.3.40:12", 12},
+		{"1.2.3.4:5", 0},
+	}
+	for _, tt := range tests {
+		if got := derpRegionOfNode(&tailcfg.Node{DERP: tt.derp}); got != tt.want {
+			t.Errorf("derpRegionOfNode(%q) = %d; want %d", tt.derp, got, tt.want)
+		}
+	}
+}
+
+func TestPickExitNode(t *testing.T) {
+	a := &tailcfg.Node{ID: 1, DERP: "127.3.3.40:1"}
+	b := &tailcfg.Node{ID: 2, DERP: "127.3.3.40:2"}
+	c := &tailcfg.Node{ID: 3}
+	derpLatency := map[string]float64{
+		"1-v4": 0.050,
+		"2-v4": 0.020,
+		"2-v6": 0.030,
+	}
+	ms := time.Millisecond
+	tests := []struct {
+		name    string
+		cands   []*tailcfg.Node
+		current tailcfg.NodeID
+		probes  map[tailcfg.NodeID]exitNodeProbe
+		want    *tailcfg.Node
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:  "derp_latency",
+			cands: []*tailcfg.Node{a, b, c},
+			want:  b,
+		},
+		{
+			name:   "ping_beats_derp",
+			cands:  []*tailcfg.Node{a, b, c},
+			probes: map[tailcfg.NodeID]exitNodeProbe{1: {latency: 5 * ms}},
+			want:   a,
+		},
+		{
+			name:   "unknown_last",
+			cands:  []*tailcfg.Node{c, a},
+			probes: map[tailcfg.NodeID]exitNodeProbe{},
+			want:   a,
+		},
+		{
+			name:  "only_unknown",
+			cands: []*tailcfg.Node{c},
+			want:  c,
+		},
+		{
+			name:   "skip_offline",
+			cands:  []*tailcfg.Node{a, b},
+			probes: map[tailcfg.NodeID]exitNodeProbe{2: {latency: 20 * ms, failures: exitNodeMaxFailures}},
+			want:   a,
+		},
+		{
+			name:   "all_offline",
+			cands:  []*tailcfg.Node{a},
+			probes: map[tailcfg.NodeID]exitNodeProbe{1: {failures: exitNodeMaxFailures}},
+		},
+		{
+			name:    "keep_current_if_close",
+			cands:   []*tailcfg.Node{a, b},
+			current: 1,
+			probes:  map[tailcfg.NodeID]exitNodeProbe{1: {latency: 110 * ms}, 2: {latency: 100 * ms}},
+			want:    a,
+		},
+		{
+			name:    "switch_if_much_faster",
+			cands:   []*tailcfg.Node{a, b},
+			current: 1,
+			probes:  map[tailcfg.NodeID]exitNodeProbe{1: {latency: 200 * ms}, 2: {latency: 100 * ms}},
+			want:    b,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := pickExitNode(tt.cands, tt.current, tt.probes, derpLatency)
+			if got != tt.want {
+				t.Errorf("got %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOnlyExitNodeDefaultRoute(t *testing.T) {
+	mustCIDR := func(s string) wgcfg.CIDR {
+		c, err := wgcfg.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	k1 := tailcfg.NodeKey{1}
+	k2 := tailcfg.NodeKey{2}
+	newCfg := func() *wgcfg.Config {
+		return &wgcfg.Config{Peers: []wgcfg.Peer{
+			{PublicKey: wgcfg.Key(k1), AllowedIPs: []wgcfg.CIDR{mustCIDR("100.64.0.1/32"), mustCIDR("0.0.0.0/0")}},
+			{PublicKey: wgcfg.Key(k2), AllowedIPs: []wgcfg.CIDR{mustCIDR("0.0.0.0/0"), mustCIDR("100.64.0.2/32"), mustCIDR("::/0")}},
+		}}
+	}
+
+	cfg := newCfg()
+	onlyExitNodeDefaultRoute(cfg, &tailcfg.Node{Key: k2})
+	if got := len(cfg.Peers[0].AllowedIPs); got != 1 {
+		t.Errorf("peer 1 has %d AllowedIPs; want 1", got)
+	}
+	if got := len(cfg.Peers[1].AllowedIPs); got != 3 {
+		t.Errorf("exit node has %d AllowedIPs; want 3", got)
+	}
+
+	cfg = newCfg()
+	onlyExitNodeDefaultRoute(cfg, nil)
+	for i, p := range cfg.Peers {
+		if len(p.AllowedIPs) != 1 {
+			t.Errorf("peer %d AllowedIPs = %v; want only its own address", i, p.AllowedIPs)
+		}
+	}
+}
+
+func mustPrefixes(t *testing.T, ss ...string) []netaddr.IPPrefix {
+	var ret []netaddr.IPPrefix
+	for _, s := range ss {
+		p, err := netaddr.ParseIPPrefix(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret = append(ret, p)
+	}
+	return ret
+}
+
+func TestExitNodeLANRoutes(t *testing.T) {
+	lans := mustPrefixes(t, "192.168.1.0/24", "10.0.0.0/24", "fd00::/64")
+	routes := mustPrefixes(t, "0.0.0.0/0", "::/0", "10.0.0.0/24", "192.168.1.5/32")
+	got := exitNodeLANRoutes(lans, routes)
+	want := mustPrefixes(t, "192.168.1.0/24", "fd00::/64")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("exitNodeLANRoutes = %v; want %v", got, want)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"tailscale.com/control/controlclient"
+	"tailscale.com/health"
+)
+
+const (
+	// keyExpiryWarnWindow is how long before the node key expires
+	// that the user is warned about it, or that it's renewed if the
+	// control server permits.
+	keyExpiryWarnWindow = 7 * 24 * time.Hour
+
+	// keyExpiryRecheck is how often the node key expiry is rechecked
+	// once it's within keyExpiryWarnWindow. It's also the minimum
+	// time between renewal attempts.
+	keyExpiryRecheck = time.Hour
+)
+
+// nextKeyExpiryCheck returns how long to wait before next checking on
+// a node key that expires at expiry. ok is false if there's nothing
+// more to check: the key doesn't expire, or already has.
+func nextKeyExpiryCheck(now, expiry time.Time) (d time.Duration, ok bool) {
+	if expiry.IsZero() || !now.Before(expiry) {
+		return 0, false
+	}
+	if warnAt := expiry.Add(-keyExpiryWarnWindow); now.Before(warnAt) {
+		return warnAt.Sub(now), true
+	}
+	if d := expiry.Sub(now); d < keyExpiryRecheck {
+		return d, true
+	}
+	return keyExpiryRecheck, true
+}
+
+// keyExpiryWarning returns a message warning that the node key
+// expires at expiry, or "" if it's not due to expire soon.
+func keyExpiryWarning(now, expiry time.Time) string {
+	switch {
+	case expiry.IsZero() || now.Before(expiry.Add(-keyExpiryWarnWindow)):
+		return ""
+	case !now.Before(expiry):
+		return "node key has expired; log in again with 'tailscale up'"
+	default:
+		// Renewing early with --force-reauth logs the node out
+		// until the new login completes, so say so.
+		left := expiry.Sub(now).Round(time.Minute)
+		return fmt.Sprintf("node key expires in %v; 'tailscale up' will ask you to log in again then, or 'tailscale up --force-reauth' renews it now but logs this node out until you do", left)
+	}
+}
+
+// updateKeyExpiryTimerLocked arranges for checkKeyExpiry to run when
+// the node key in nm next needs attention. b.mu must be held.
+func (b *LocalBackend) updateKeyExpiryTimerLocked(nm *controlclient.NetworkMap) {
+	if b.keyExpiryTimer != nil {
+		b.keyExpiryTimer.Stop()
+		b.keyExpiryTimer = nil
+	}
+	if nm == nil {
+		health.Set(health.SysKeyExpiry, nil)
+		return
+	}
+	if msg := keyExpiryWarning(time.Now(), nm.Expiry); msg != "" {
+		health.Set(health.SysKeyExpiry, errors.New(msg))
+	} else {
+		health.Set(health.SysKeyExpiry, nil)
+	}
+	if d, ok := nextKeyExpiryCheck(time.Now(), nm.Expiry); ok {
+		b.keyExpiryTimer = time.AfterFunc(d, b.checkKeyExpiry)
+	}
+}
+
+// checkKeyExpiry renews the node key if it's about to expire and the
+// control server permits it, or otherwise tells the frontends that
+// the user has to log in again.
+func (b *LocalBackend) checkKeyExpiry() {
+	now := time.Now()
+	b.mu.Lock()
+	nm := b.netMap
+	cc := b.c
+	if nm == nil || nm.Expiry.IsZero() {
+		b.mu.Unlock()
+		return
+	}
+	expiry := nm.Expiry
+	renew := nm.KeyRenewal && cc != nil && now.Before(expiry) && now.Sub(b.lastKeyRenew) >= keyExpiryRecheck
+	if renew {
+		b.lastKeyRenew = now
+	}
+	b.updateKeyExpiryTimerLocked(nm)
+	b.mu.Unlock()
+
+	if !now.Before(expiry) {
+		b.logf("node key expired at %v", expiry.Format(time.RFC3339))
+		b.stateMachine()
+		return
+	}
+	if renew {
+		b.logf("node key expires at %v; renewing", expiry.Format(time.RFC3339))
+		cc.Login(nil, controlclient.LoginRenewKey)
+		return
+	}
+	if msg := keyExpiryWarning(now, expiry); msg != "" {
+		b.logf("%s", msg)
+		b.send(Notify{KeyExpiry: &expiry})
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNextKeyExpiryCheck(t *testing.T) {
+	now := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	tests := []struct {
+		name   string
+		expiry time.Time
+		want   time.Duration
+		wantOK bool
+	}{
+		{"no_expiry", time.Time{}, 0, false},
+		{"expired", now.Add(-time.Minute), 0, false},
+		{"expires_now", now, 0, false},
+		{"far", now.Add(30 * day), 23 * day, true},
+		{"in_window", now.Add(2 * day), keyExpiryRecheck, true},
+		{"almost", now.Add(10 * time.Minute), 10 * time.Minute, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := nextKeyExpiryCheck(now, tt.expiry)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("got (%v, %v); want (%v, %v)", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestKeyExpiryWarning(t *testing.T) {
+	now := time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		expiry time.Time
+		want   string // substring; empty means no warning
+	}{
+		{time.Time{}, ""},
+		{now.Add(30 * 24 * time.Hour), ""},
+		{now.Add(48 * time.Hour), "expires in 48h0m0s"},
+		{now.Add(time.Hour), "logs this node out"},
+		{now.Add(-time.Second), "has expired"},
+	}
+	for _, tt := range tests {
+		got := keyExpiryWarning(now, tt.expiry)
+		if tt.want == "" && got != "" || !strings.Contains(got, tt.want) {
+			t.Errorf("keyExpiryWarning(%v) = %q; want %q", tt.expiry, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+// When a frontend owns the prefs, as the Windows GUI does in client
+// mode, a login is only saved once the frontend saves the prefs the
+// backend sent it after logging in. So that a backend crash or restart
+// before then doesn't lose the login, the backend keeps a copy of the
+// prefs too, and restores the login from it when the frontend
+// reconnects without one.
+
+// frontendPrefsKey returns the state key of the backend's copy of the
+// prefs owned by userID's frontend. It's the same key the user's prefs
+// are kept under in server mode.
+func frontendPrefsKey(userID string) StateKey {
+	return StateKey("user-" + userID)
+}
+
+// saveFrontendPrefs saves the backend's copy of prefs, owned by
+// userID's frontend.
+func (b *LocalBackend) saveFrontendPrefs(userID string, prefs *Prefs) {
+	if userID == "" {
+		return
+	}
+	if err := b.store.WriteState(frontendPrefsKey(userID), prefs.ToBytes()); err != nil {
+		b.logf("saving copy of frontend prefs: %v", err)
+	}
+}
+
+// forgetFrontendLogin removes the login from the backend's copy of
+// the prefs owned by userID's frontend, on logout.
+func (b *LocalBackend) forgetFrontendLogin(userID string) {
+	if userID == "" {
+		return
+	}
+	bs, err := b.store.ReadState(frontendPrefsKey(userID))
+	if err != nil {
+		return
+	}
+	prefs, err := PrefsFromBytes(bs, false)
+	if err != nil || prefs.Persist == nil {
+		return
+	}
+	prefs.Persist = nil
+	b.saveFrontendPrefs(userID, prefs)
+}
+
+// restoreFrontendLoginLocked restores the login to b.prefs, just
+// received from b.userID's frontend, from the backend's copy of them,
+// if the frontend has none but the copy has one for the same control
+// server.
+//
+// b.mu must be held.
+func (b *LocalBackend) restoreFrontendLoginLocked() {
+	if b.userID == "" || b.prefs.Persist != nil && !b.prefs.Persist.PrivateNodeKey.IsZero() {
+		return
+	}
+	bs, err := b.store.ReadState(frontendPrefsKey(b.userID))
+	if err != nil {
+		return
+	}
+	saved, err := PrefsFromBytes(bs, false)
+	if err != nil || saved.Persist == nil || saved.Persist.PrivateNodeKey.IsZero() || saved.ControlURL != b.prefs.ControlURL {
+		return
+	}
+	b.logf("restoring login %q missing from the frontend's prefs", saved.Persist.LoginName)
+	b.prefs.Persist = saved.Persist.Clone()
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"testing"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/control/controlclient"
+	"tailscale.com/wgengine"
+)
+
+func TestRestoreFrontendLogin(t *testing.T) {
+	e, err := wgengine.NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &MemoryStore{cache: make(map[StateKey][]byte)}
+	b, err := NewLocalBackend(t.Logf, "logid", store, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+	b.SetCurrentUserID("S-1-5-21-1")
+
+	nodeKey, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loggedIn := NewPrefs()
+	loggedIn.Persist = &controlclient.Persist{PrivateNodeKey: nodeKey, LoginName: "user@example.com"}
+	b.saveFrontendPrefs("S-1-5-21-1", loggedIn)
+
+	// load starts the backend with the frontend's prefs, and returns
+	// the login it ends up with.
+	load := func(prefs *Prefs) *controlclient.Persist {
+		t.Helper()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if err := b.loadStateLocked("", prefs, ""); err != nil {
+			t.Fatal(err)
+		}
+		return b.prefs.Persist
+	}
+
+	if p := load(NewPrefs()); p == nil || p.PrivateNodeKey != nodeKey {
+		t.Errorf("login not restored for a frontend without one: %+v", p)
+	}
+	other := NewPrefs()
+	other.ControlURL = "https://control.example.com"
+	if p := load(other); p != nil {
+		t.Errorf("login restored for another control server: %+v", p)
+	}
+
+	b.forgetFrontendLogin("S-1-5-21-1")
+	if p := load(NewPrefs()); p != nil {
+		t.Errorf("login restored after logout: %+v", p)
+	}
+}
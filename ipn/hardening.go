@@ -0,0 +1,107 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"fmt"
+
+	"inet.af/netaddr"
+	"tailscale.com/control/controlclient"
+	"tailscale.com/wgengine/filter"
+)
+
+// Hardening profiles, for Prefs.HardeningProfile.
+const (
+	// HardeningNone applies no local restrictions.
+	HardeningNone = "none"
+	// HardeningServer only lets in nodes with one of
+	// Prefs.HardeningAdminTags.
+	HardeningServer = "server"
+	// HardeningIsolated lets no node in.
+	HardeningIsolated = "isolated"
+)
+
+// CheckHardeningProfile reports whether s is a valid value for
+// Prefs.HardeningProfile.
+func CheckHardeningProfile(s string) error {
+	switch s {
+	case "", HardeningNone, HardeningServer, HardeningIsolated:
+		return nil
+	}
+	return fmt.Errorf("unknown hardening profile %q (want %s, %s or %s)", s, HardeningNone, HardeningServer, HardeningIsolated)
+}
+
+// hardeningProfile returns the hardening profile p selects.
+func (p *Prefs) hardeningProfile() string {
+	if p.HardeningProfile != "" {
+		return p.HardeningProfile
+	}
+	return HardeningNone
+}
+
+// hardeningRules returns the rules of the hardening profile prefs
+// selects, for filter.Intersect with the netmap's packet filter, or
+// nil if it has none.
+func hardeningRules(prefs *Prefs, nm *controlclient.NetworkMap) []filter.Match {
+	if prefs == nil {
+		return nil
+	}
+	var srcs []netaddr.IPPrefix
+	switch prefs.hardeningProfile() {
+	case HardeningServer:
+		srcs = taggedPeerSrcs(nm, prefs.HardeningAdminTags)
+	case HardeningIsolated:
+	default:
+		return nil
+	}
+	rules := []filter.Match{} // non-nil: with no srcs, nothing gets in
+	if len(srcs) > 0 {
+		rules = append(rules, filter.Match{Srcs: srcs, Dsts: allDsts})
+	}
+	return rules
+}
+
+// taggedPeerSrcs returns the Tailscale IPs of the peers in nm with
+// any of tags.
+//
+// A peer's tags are the ones control assigned it, in Node.Tags, not
+// the Hostinfo.RequestTags it asks for, which any peer can set.
+func taggedPeerSrcs(nm *controlclient.NetworkMap, tags []string) []netaddr.IPPrefix {
+	if nm == nil || len(tags) == 0 {
+		return nil
+	}
+	want := make(map[string]bool)
+	for _, tag := range tags {
+		want[tag] = true
+	}
+	var srcs []netaddr.IPPrefix
+	for _, peer := range nm.Peers {
+		for _, tag := range peer.Tags {
+			if want[tag] {
+				srcs = append(srcs, wgCIDRsToNetaddr(peer.Addresses)...)
+				break
+			}
+		}
+	}
+	return srcs
+}
+
+// allIPs are the prefixes of all IPv4 and all IPv6 addresses.
+var allIPs = []netaddr.IPPrefix{
+	{IP: netaddr.IPv4(0, 0, 0, 0)},
+	{IP: netaddr.IPFrom16([16]byte{})},
+}
+
+// allDsts are all ports of all addresses.
+var allDsts = portDsts(filter.PortRange{First: 0, Last: 65535})
+
+// portDsts returns the NetPortRanges of ports pr of all addresses.
+func portDsts(pr filter.PortRange) []filter.NetPortRange {
+	var ret []filter.NetPortRange
+	for _, pfx := range allIPs {
+		ret = append(ret, filter.NetPortRange{Net: pfx, Ports: pr})
+	}
+	return ret
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/control/controlclient"
+	"tailscale.com/tailcfg"
+)
+
+func TestHardeningRules(t *testing.T) {
+	node := func(addr string, tags ...string) *tailcfg.Node {
+		c, err := wgcfg.ParseCIDR(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &tailcfg.Node{
+			Addresses: []wgcfg.CIDR{c},
+			Tags:      tags,
+		}
+	}
+	// A peer only asking for tag:admin doesn't get it.
+	claimer := node("100.64.0.4/32")
+	claimer.Hostinfo.RequestTags = []string{"tag:admin"}
+	nm := &controlclient.NetworkMap{Peers: []*tailcfg.Node{
+		node("100.64.0.1/32", "tag:admin"),
+		node("100.64.0.2/32", "tag:web"),
+		node("100.64.0.3/32", "tag:web", "tag:ops"),
+		claimer,
+	}}
+
+	tests := []struct {
+		name  string
+		prefs *Prefs
+		want  string // of the rules' Srcs, or "nil"
+	}{
+		{"no_prefs", nil, "nil"},
+		{"none", &Prefs{}, "nil"},
+		{"explicit_none", &Prefs{HardeningProfile: HardeningNone, AdvertiseTags: []string{"tag:server"}}, "nil"},
+		{"isolated", &Prefs{HardeningProfile: HardeningIsolated}, "[]"},
+		{
+			name:  "server",
+			prefs: &Prefs{HardeningProfile: HardeningServer, HardeningAdminTags: []string{"tag:admin", "tag:ops"}},
+			want:  "[[100.64.0.1/32 100.64.0.3/32]]",
+		},
+		{
+			// Only the pref turns a profile on, not the tags.
+			name:  "tagged_server",
+			prefs: &Prefs{AdvertiseTags: []string{"tag:server"}, HardeningAdminTags: []string{"tag:admin"}},
+			want:  "nil",
+		},
+		{
+			name:  "server_no_admins",
+			prefs: &Prefs{HardeningProfile: HardeningServer},
+			want:  "[]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := hardeningRules(tt.prefs, nm)
+			got := "nil"
+			if rules != nil {
+				var srcs []string
+				for _, m := range rules {
+					srcs = append(srcs, fmt.Sprint(m.Srcs))
+				}
+				got = fmt.Sprint(srcs)
+			}
+			if got != tt.want {
+				t.Errorf("srcs = %s; want %s", got, tt.want)
+			}
+		})
+	}
+}
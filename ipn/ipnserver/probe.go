@@ -0,0 +1,39 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"fmt"
+	"net/http"
+
+	"tailscale.com/ipn"
+)
+
+// newProbeHandler returns the handler for the liveness and readiness
+// probes of container orchestrators such as Kubernetes:
+//
+//	GET /healthz  200 if b is working (see LocalBackend.Live), else 503
+//	GET /readyz   200 if b is ready to carry traffic, else 503
+//
+// /healthz fails for a wedged engine or an expired login, but not
+// while b is starting up. The body says what's wrong, if anything.
+func newProbeHandler(b *ipn.LocalBackend) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if err := b.Live(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := b.Ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
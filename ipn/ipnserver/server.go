@@ -7,6 +7,7 @@ package ipnserver
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -18,16 +19,21 @@ import (
 	"os/exec"
 	"os/signal"
 	"os/user"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/tailscale/wireguard-go/wgcfg"
 	"inet.af/netaddr"
 	"tailscale.com/control/controlclient"
 	"tailscale.com/ipn"
+	"tailscale.com/ipn/localapi"
 	"tailscale.com/log/filelogger"
+	"tailscale.com/logpolicy"
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/net/netstat"
 	"tailscale.com/safesocket"
@@ -36,6 +42,7 @@ import (
 	"tailscale.com/util/pidowner"
 	"tailscale.com/version"
 	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/filter"
 )
 
 // Options is the configuration of the Tailscale node agent.
@@ -48,9 +55,18 @@ type Options struct {
 	// frontend connections.
 	Port int
 
-	// StatePath is the path to the stored agent state.
+	// StatePath is the path to the stored agent state. If empty,
+	// the state is kept in memory only.
 	StatePath string
 
+	// Store, if non-nil, is where the agent state is stored,
+	// instead of StatePath.
+	Store ipn.StateStore
+
+	// Ephemeral is whether the node registers as an ephemeral node,
+	// which is deleted from the tailnet when the server exits.
+	Ephemeral bool
+
 	// AutostartStateKey, if non-empty, immediately starts the agent
 	// using the given StateKey. If empty, the agent stays idle and
 	// waits for a frontend to start it.
@@ -85,13 +101,113 @@ type Options struct {
 	// DebugMux, if non-nil, specifies an HTTP ServeMux in which
 	// to register a debug handler.
 	DebugMux *http.ServeMux
+
+	// ProbeAddr, if non-empty, is the TCP address on which to
+	// serve HTTP liveness and readiness probes, at /healthz and
+	// /readyz, for container orchestrators such as Kubernetes.
+	ProbeAddr string
+
+	// InboxDir, if non-empty, is the directory in which files
+	// sent by the user's other nodes are stored until they're
+	// picked up with "tailscale file get". If empty, the node
+	// doesn't accept files.
+	InboxDir string
+
+	// DERPMap, if non-empty, is the path or http(s) URL of a DERP
+	// map to merge with the one from the control server. See
+	// derpmap.Merge.
+	DERPMap string
+
+	// LogPolicy, if non-nil, is the process's log policy, whose
+	// uploading can be turned off over the local API.
+	LogPolicy *logpolicy.Policy
+
+	// Listener, if non-nil, is the listener to serve frontends on
+	// instead of SocketPath or Port, such as one passed by systemd
+	// socket activation.
+	Listener net.Listener
+
+	// Serving, if non-nil, is called with the backend once the
+	// server has started it and is about to serve frontends, such as
+	// to tell a service manager that the daemon is ready.
+	Serving func(*ipn.LocalBackend)
+
+	// LocalAPITokenFile, if non-empty, is the path of a file to
+	// which a new random token is written at startup. Local API
+	// requests bearing it in an "Authorization: Bearer" header get
+	// read and write access even from users who otherwise only get
+	// read access, such as a GUI running as a regular user on Linux.
+	// The file is only readable by root (or the user tailscaled runs
+	// as) and LocalAPITokenGroup.
+	LocalAPITokenFile string
+
+	// LocalAPITokenGroup, if non-empty, is the name of the group
+	// that can read LocalAPITokenFile. It's not supported on Windows,
+	// where the file's ACL is inherited from its directory.
+	LocalAPITokenGroup string
+
+	// PolicyFilter, if non-nil, is run in its own goroutine for as
+	// long as the server runs, and calls set to restrict incoming
+	// traffic further than the tailnet's ACLs do. See
+	// ipn.LocalBackend.SetPolicyFilter.
+	PolicyFilter func(ctx context.Context, set func([]filter.Match))
+
+	// AutoRoutes, if non-nil, is run in its own goroutine for as
+	// long as the server runs, and calls set with routes to
+	// advertise besides those in the prefs. See
+	// ipn.LocalBackend.SetAutoRoutes.
+	AutoRoutes func(ctx context.Context, set func([]wgcfg.CIDR))
+
+	// RoutesStandby, if non-nil, makes the node start as a standby
+	// subnet router, and is run in its own goroutine for as long as
+	// the server runs, calling set when the node becomes the
+	// primary router or a standby again. See
+	// ipn.LocalBackend.SetRoutesStandby.
+	RoutesStandby func(ctx context.Context, set func(standby bool))
+
+	// ShutdownDrain, if non-zero, makes the agent, when it's
+	// stopped while running, withdraw its routes and tell the
+	// control server it's going offline, and then keep routing for
+	// ShutdownDrain if it was routing. See
+	// ipn.LocalBackend.SetShutdownDrain.
+	ShutdownDrain time.Duration
+
+	// ConnLog, if non-nil, is written a line for each new inbound
+	// connection that the packet filter accepts, as formatted by
+	// ipn.ConnEvent.String, for a local record of access to the
+	// node. Lines are dropped if it falls behind.
+	ConnLog io.Writer
+
+	// Static, if non-nil, makes the agent run from the peers, DERP
+	// map and packet filter it holds, which may be replaced while it
+	// runs, instead of from a control server. See
+	// ipn.LocalBackend.SetStaticMap.
+	Static *controlclient.StaticMap
+
+	// AuthKey, if non-empty, is the auth key that the agent
+	// autostarted per AutostartStateKey logs in with if it needs to.
+	AuthKey string
+
+	// EditPrefs, if non-nil, edits the prefs of the agent
+	// autostarted per AutostartStateKey before it starts, so that
+	// they follow a declarative config such as a config file.
+	EditPrefs func(*ipn.Prefs)
+
+	// WatchConfig, if non-nil, is run in its own goroutine for as
+	// long as the server runs, once the agent has been autostarted,
+	// and calls reload whenever EditPrefs should be applied again.
+	WatchConfig func(ctx context.Context, reload func())
 }
 
 // server is an IPN backend and its set of 0 or more active connections
 // talking to an IPN backend.
 type server struct {
-	b    *ipn.LocalBackend
-	logf logger.Logf
+	b      *ipn.LocalBackend
+	logf   logger.Logf
+	logPol *logpolicy.Policy // or nil
+	// localAPIToken, if non-empty, grants local API requests bearing
+	// it full access. See Options.LocalAPITokenFile.
+	localAPIToken string
 	// resetOnZero is whether to call bs.Reset on transition from
 	// 1->0 connections.  That is, this is whether the backend is
 	// being run in "client mode" that requires an active GUI
@@ -110,40 +226,37 @@ type server struct {
 	disconnectSub  map[chan<- struct{}]struct{} // keys are subscribers of disconnects
 }
 
-// connIdentity represents the owner of a localhost TCP connection.
+// connIdentity represents the owner of a localhost TCP, Unix socket or
+// named pipe connection.
 type connIdentity struct {
 	Unknown bool
 	Pid     int
 	UserID  string
 	User    *user.User
+
+	// PeerUID is the uid of the process at the other end of a Unix
+	// socket, or empty if unknown. Unix connections are otherwise
+	// Unknown, as all local users share the daemon there; it only
+	// decides their local API permissions.
+	PeerUID string
 }
 
-// getConnIdentity returns the localhost TCP connection's identity information
-// (pid, userid, user). If it's not Windows (for now), it returns a nil error
-// and a ConnIdentity with Unknown set true. It's only an error if we expected
-// to be able to map it and couldn't.
+// getConnIdentity returns the localhost TCP or named pipe connection's
+// identity information (pid, userid, user). If it's not Windows (for
+// now), it returns a nil error and a ConnIdentity with Unknown set true,
+// and the peer's pid and uid if the OS reports them. It's only an error
+// if we expected to be able to map it and couldn't.
 func (s *server) getConnIdentity(c net.Conn) (ci connIdentity, err error) {
 	if runtime.GOOS != "windows" { // for now; TODO: expand to other OSes
-		return connIdentity{Unknown: true}, nil
-	}
-	la, err := netaddr.ParseIPPort(c.LocalAddr().String())
-	if err != nil {
-		return ci, fmt.Errorf("parsing local address: %w", err)
-	}
-	ra, err := netaddr.ParseIPPort(c.RemoteAddr().String())
-	if err != nil {
-		return ci, fmt.Errorf("parsing local remote: %w", err)
-	}
-	if !la.IP.IsLoopback() || !ra.IP.IsLoopback() {
-		return ci, errors.New("non-loopback connection")
+		ci.Unknown = true
+		if pc, ok := safesocket.ConnPeerCreds(c); ok {
+			ci.Pid, ci.PeerUID = pc.Pid, pc.UID
+		}
+		return ci, nil
 	}
-	tab, err := netstat.Get()
+	pid, err := windowsConnPid(c)
 	if err != nil {
-		return ci, fmt.Errorf("failed to get local connection table: %w", err)
-	}
-	pid := peerPid(tab.Entries, la, ra)
-	if pid == 0 {
-		return ci, errors.New("no local process found matching localhost connection")
+		return ci, err
 	}
 	ci.Pid = pid
 	uid, err := pidowner.OwnerOfPID(pid)
@@ -163,6 +276,34 @@ func (s *server) getConnIdentity(c net.Conn) (ci connIdentity, err error) {
 	return ci, nil
 }
 
+// windowsConnPid returns the pid of the process at the other end of
+// c, a named pipe or localhost TCP connection.
+func windowsConnPid(c net.Conn) (int, error) {
+	if pc, ok := safesocket.ConnPeerCreds(c); ok {
+		return pc.Pid, nil
+	}
+	la, err := netaddr.ParseIPPort(c.LocalAddr().String())
+	if err != nil {
+		return 0, fmt.Errorf("parsing local address: %w", err)
+	}
+	ra, err := netaddr.ParseIPPort(c.RemoteAddr().String())
+	if err != nil {
+		return 0, fmt.Errorf("parsing local remote: %w", err)
+	}
+	if !la.IP.IsLoopback() || !ra.IP.IsLoopback() {
+		return 0, errors.New("non-loopback connection")
+	}
+	tab, err := netstat.Get()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get local connection table: %w", err)
+	}
+	pid := peerPid(tab.Entries, la, ra)
+	if pid == 0 {
+		return 0, errors.New("no local process found matching localhost connection")
+	}
+	return pid, nil
+}
+
 func (s *server) lookupUserFromID(uid string) (*user.User, error) {
 	u, err := user.LookupId(uid)
 	if err != nil && runtime.GOOS == "windows" && errors.Is(err, syscall.Errno(0x534)) {
@@ -221,7 +362,7 @@ func (s *server) serveConn(ctx context.Context, c net.Conn, logf logger.Logf) {
 	c.SetReadDeadline(time.Now().Add(time.Second))
 	peek, _ := br.Peek(4)
 	c.SetReadDeadline(time.Time{})
-	isHTTPReq := string(peek) == "GET "
+	isHTTPReq := isHTTPMethodPrefix(string(peek))
 
 	ci, err := s.addConn(c, isHTTPReq)
 	if err != nil {
@@ -267,6 +408,11 @@ func (s *server) serveConn(ctx context.Context, c net.Conn, logf logger.Logf) {
 	defer s.removeAndCloseConn(c)
 	logf("incoming control connection")
 
+	// The IPN protocol predates local API permissions; hold it to
+	// the same rules, so a read-only user can't use it to do what
+	// the local API refuses them.
+	_, canWrite := localAPIPermissions(ci)
+
 	for ctx.Err() == nil {
 		msg, err := ipn.ReadMsg(br)
 		if err != nil {
@@ -275,6 +421,13 @@ func (s *server) serveConn(ctx context.Context, c net.Conn, logf logger.Logf) {
 			}
 			return
 		}
+		if !canWrite && !isReadOnlyCommand(msg) {
+			logf("denied mutating command from uid %q", ci.PeerUID)
+			s.mu.Lock() // serializes writes to c with writeToClients
+			ipn.NewBackendServer(logf, nil, func(b []byte) { ipn.WriteMsg(c, b) }).SendErrorMessage("access denied: this user can't change Tailscale's state")
+			s.mu.Unlock()
+			continue
+		}
 		s.bsMu.Lock()
 		if err := s.bs.GotCommandMsg(msg); err != nil {
 			logf("GotCommandMsg: %v", err)
@@ -287,6 +440,22 @@ func (s *server) serveConn(ctx context.Context, c net.Conn, logf logger.Logf) {
 	}
 }
 
+// isReadOnlyCommand reports whether the IPN protocol message msg only
+// asks for information, and so may be sent by a client without write
+// permission.
+func isReadOnlyCommand(msg []byte) bool {
+	var cmd ipn.Command
+	if err := json.Unmarshal(msg, &cmd); err != nil {
+		return false
+	}
+	if cmd.Start != nil || cmd.StartLoginInteractive != nil || cmd.Login != nil ||
+		cmd.Logout != nil || cmd.SetPrefs != nil || cmd.SetWantRunning != nil ||
+		cmd.FakeExpireAfter != nil {
+		return false
+	}
+	return true
+}
+
 // inUseOtherUserError is the error type for when the server is in use
 // by a different local user.
 type inUseOtherUserError struct{ error }
@@ -474,15 +643,27 @@ func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (
 	runDone := make(chan struct{})
 	defer close(runDone)
 
-	listen, _, err := safesocket.Listen(opts.SocketPath, uint16(opts.Port))
-	if err != nil {
-		return fmt.Errorf("safesocket.Listen: %v", err)
+	var err error
+	listen := opts.Listener
+	if listen == nil {
+		listen, _, err = safesocket.Listen(opts.SocketPath, uint16(opts.Port))
+		if err != nil {
+			return fmt.Errorf("safesocket.Listen: %v", err)
+		}
 	}
 
 	server := &server{
 		logf:        logf,
+		logPol:      opts.LogPolicy,
 		resetOnZero: !opts.SurviveDisconnects,
 	}
+	if opts.LocalAPITokenFile != "" {
+		server.localAPIToken, err = writeLocalAPIToken(opts.LocalAPITokenFile, opts.LocalAPITokenGroup)
+		if err != nil {
+			listen.Close()
+			return fmt.Errorf("local API token: %w", err)
+		}
+	}
 
 	// When the context is closed or when we return, whichever is first, close our listner
 	// and all open connections.
@@ -532,7 +713,9 @@ func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (
 	}
 
 	var store ipn.StateStore
-	if opts.StatePath != "" {
+	if opts.Store != nil {
+		store = opts.Store
+	} else if opts.StatePath != "" {
 		store, err = ipn.NewFileStore(opts.StatePath)
 		if err != nil {
 			return fmt.Errorf("ipn.NewFileStore(%q): %v", opts.StatePath, err)
@@ -567,6 +750,50 @@ func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (
 	b.SetDecompressor(func() (controlclient.Decompressor, error) {
 		return smallzstd.NewDecoder(nil)
 	})
+	b.SetInboxDir(opts.InboxDir)
+	b.SetEphemeral(opts.Ephemeral)
+	b.SetDERPMapSource(opts.DERPMap)
+	b.SetStaticMap(opts.Static)
+	b.SetShutdownDrain(opts.ShutdownDrain)
+	if opts.ConnLog != nil {
+		go b.WatchConns(ctx, func(ev ipn.ConnEvent) {
+			io.WriteString(opts.ConnLog, ev.String()+"\n")
+		})
+	}
+	if opts.StatePath != "" {
+		b.SetVarRoot(filepath.Dir(opts.StatePath))
+	}
+
+	if opts.PolicyFilter != nil || opts.AutoRoutes != nil || opts.RoutesStandby != nil {
+		hctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		if opts.PolicyFilter != nil {
+			go opts.PolicyFilter(hctx, b.SetPolicyFilter)
+		}
+		if opts.AutoRoutes != nil {
+			go opts.AutoRoutes(hctx, b.SetAutoRoutes)
+		}
+		if opts.RoutesStandby != nil {
+			b.SetRoutesStandby(true)
+			go opts.RoutesStandby(hctx, b.SetRoutesStandby)
+		}
+	}
+
+	if opts.ProbeAddr != "" {
+		ln, err := net.Listen("tcp", opts.ProbeAddr)
+		if err != nil {
+			return fmt.Errorf("probe listener: %v", err)
+		}
+		logf("serving probes on %v", ln.Addr())
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-runDone:
+			}
+			ln.Close()
+		}()
+		go http.Serve(ln, newProbeHandler(b))
+	}
 
 	if opts.DebugMux != nil {
 		opts.DebugMux.HandleFunc("/debug/ipn", func(w http.ResponseWriter, r *http.Request) {
@@ -578,15 +805,35 @@ func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (
 	server.bs = ipn.NewBackendServer(logf, b, server.writeToClients)
 
 	if opts.AutostartStateKey != "" {
+		start := ipn.Options{
+			StateKey:         opts.AutostartStateKey,
+			LegacyConfigPath: opts.LegacyConfigPath,
+			AuthKey:          opts.AuthKey,
+		}
+		if opts.EditPrefs != nil {
+			prefs := ipn.NewPrefs()
+			bs, err := store.ReadState(opts.AutostartStateKey)
+			if err == nil {
+				prefs, err = ipn.PrefsFromBytes(bs, false)
+			}
+			if err != nil && err != ipn.ErrStateNotExist {
+				return fmt.Errorf("reading prefs to edit: %w", err)
+			}
+			start.Prefs = editedPrefs(prefs, opts.EditPrefs)
+		}
 		server.bs.GotCommand(&ipn.Command{
 			Version: version.Long,
-			Start: &ipn.StartArgs{
-				Opts: ipn.Options{
-					StateKey:         opts.AutostartStateKey,
-					LegacyConfigPath: opts.LegacyConfigPath,
-				},
-			},
+			Start:   &ipn.StartArgs{Opts: start},
 		})
+		if opts.EditPrefs != nil && opts.WatchConfig != nil {
+			go opts.WatchConfig(ctx, func() {
+				server.reloadPrefs(start, opts.EditPrefs)
+			})
+		}
+	}
+
+	if opts.Serving != nil {
+		opts.Serving(b)
 	}
 
 	for i := 1; ctx.Err() == nil; i++ {
@@ -610,6 +857,40 @@ func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (
 	return ctx.Err()
 }
 
+// editedPrefs returns a copy of p edited by edit. If that changes the
+// control server, the copy has no login, since the login was with the
+// old one.
+func editedPrefs(p *ipn.Prefs, edit func(*ipn.Prefs)) *ipn.Prefs {
+	p2 := p.Clone()
+	edit(p2)
+	if p2.ControlURL != p.ControlURL {
+		p2.Persist = nil
+	}
+	return p2
+}
+
+// reloadPrefs applies edit to the prefs of the agent started with
+// start. A change of control server restarts the agent; other
+// changes are made in place.
+func (s *server) reloadPrefs(start ipn.Options, edit func(*ipn.Prefs)) {
+	old := s.b.Prefs()
+	prefs := editedPrefs(old, edit)
+	switch {
+	case prefs.Equals(old):
+		return
+	case prefs.ControlURL != old.ControlURL:
+		s.logf("ipnserver: config: control server changed to %s; restarting", prefs.ControlURL)
+		start.Prefs = prefs
+		s.bs.GotCommand(&ipn.Command{
+			Version: version.Long,
+			Start:   &ipn.StartArgs{Opts: start},
+		})
+	default:
+		s.logf("ipnserver: config: applying changed prefs")
+		s.b.SetPrefs(prefs)
+	}
+}
+
 // BabysitProc runs the current executable as a child process with the
 // provided args, capturing its output, writing it to files, and
 // restarting the process on any crashes.
@@ -788,8 +1069,28 @@ func (psc *protoSwitchConn) Close() error {
 	return nil
 }
 
+// isHTTPMethodPrefix reports whether the first four bytes read from
+// a new connection are the start of an HTTP request we serve, rather
+// than an IPN protocol message.
+func isHTTPMethodPrefix(peek string) bool {
+	switch peek {
+	case "GET ", "PUT ", "POST", "DELE":
+		return true
+	}
+	return false
+}
+
 func (s *server) localhostHandler(ci connIdentity) http.Handler {
+	lah := localapi.NewHandler(s.b, s.logf)
+	lah.PermitRead, lah.PermitWrite = localAPIPermissions(ci)
+	lah.Token = s.localAPIToken
+	lah.LogPolicy = s.logPol
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/localapi/") {
+			lah.ServeHTTP(w, r)
+			return
+		}
 		if ci.Unknown {
 			io.WriteString(w, "<html><title>Tailscale</title><body><h1>Tailscale</h1>This is the local Tailscale daemon.")
 			return
@@ -798,6 +1099,30 @@ func (s *server) localhostHandler(ci connIdentity) http.Handler {
 	})
 }
 
+// localAPIPermissions returns the read and write permissions of a
+// local API connection from ci.
+//
+// On Unix, only users who can open the socket get this far. Those are
+// trusted fully if the OS doesn't say who they are, as before peer
+// credentials were checked; otherwise only root and the user
+// tailscaled runs as get write access, and other users need the
+// local API token for it. On Windows, any local process can connect
+// to the TCP port, so only connections whose owner was identified
+// (and accepted by checkConnIdentityLocked) are trusted.
+func localAPIPermissions(ci connIdentity) (read, write bool) {
+	if runtime.GOOS != "windows" {
+		switch ci.PeerUID {
+		case "", "0", strconv.Itoa(os.Getuid()):
+			return true, true
+		}
+		return true, false
+	}
+	if ci.Unknown {
+		return false, false
+	}
+	return true, true
+}
+
 func serveHTMLStatus(w http.ResponseWriter, b *ipn.LocalBackend) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	st := b.Status()
@@ -0,0 +1,72 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+)
+
+// writeLocalAPIToken writes a new random local API token to path,
+// readable by group if non-empty, and returns it. Any old token in
+// path stops working, as the file is replaced rather than rewritten.
+func writeLocalAPIToken(path, group string) (string, error) {
+	gid := -1
+	if group != "" {
+		if runtime.GOOS == "windows" {
+			return "", errors.New("token file groups are not supported on Windows")
+		}
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return "", err
+		}
+		gid, err = strconv.Atoi(g.Gid)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b[:])
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return "", err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	_, err = f.WriteString(token + "\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	if gid != -1 {
+		if err := os.Chown(tmp, -1, gid); err != nil {
+			return "", err
+		}
+		if err := os.Chmod(tmp, 0640); err != nil {
+			return "", err
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return "", err
+	}
+	return token, nil
+}
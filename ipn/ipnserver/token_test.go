@@ -0,0 +1,96 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestWriteLocalAPIToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	tok1, err := writeLocalAPIToken(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok2, err := writeLocalAPIToken(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tok2) != 64 || tok1 == tok2 {
+		t.Errorf("tokens %q, %q; want two different 64 digit ones", tok1, tok2)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(b)) != tok2 {
+		t.Errorf("file has %q; want %q", b, tok2)
+	}
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0600 {
+			t.Errorf("mode = %v; want 0600", fi.Mode())
+		}
+	}
+}
+
+func TestLocalAPIPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix socket permissions")
+	}
+	other := strconv.Itoa(os.Getuid() + 1)
+	if os.Getuid() == 0 {
+		other = "1000"
+	}
+	tests := []struct {
+		uid         string
+		read, write bool
+	}{
+		{"", true, true},
+		{"0", true, true},
+		{strconv.Itoa(os.Getuid()), true, true},
+		{other, true, false},
+	}
+	for _, tt := range tests {
+		read, write := localAPIPermissions(connIdentity{Unknown: true, PeerUID: tt.uid})
+		if read != tt.read || write != tt.write {
+			t.Errorf("uid %q: got %v, %v; want %v, %v", tt.uid, read, write, tt.read, tt.write)
+		}
+	}
+}
+
+func TestIsReadOnlyCommand(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want bool
+	}{
+		{`{"RequestStatus":{}}`, true},
+		{`{"RequestEngineStatus":{}}`, true},
+		{`{"Ping":{"IP":"100.64.0.1"}}`, true},
+		{`{"Quit":{}}`, true},
+		{`{"SetWantRunning":false}`, false},
+		{`{"SetPrefs":{"New":{}}}`, false},
+		{`{"Start":{}}`, false},
+		{`{"Logout":{}}`, false},
+		{`{"StartLoginInteractive":{}}`, false},
+		{`{"FakeExpireAfter":{"Duration":0}}`, false},
+		{`{"RequestStatus":{},"SetWantRunning":true}`, false},
+		{`not json`, false},
+	}
+	for _, tt := range tests {
+		if got := isReadOnlyCommand([]byte(tt.msg)); got != tt.want {
+			t.Errorf("isReadOnlyCommand(%s) = %v; want %v", tt.msg, got, tt.want)
+		}
+	}
+}
@@ -31,6 +31,18 @@ type Status struct {
 
 	Peer map[key.Public]*PeerStatus
 	User map[tailcfg.UserID]tailcfg.UserProfile
+
+	// Health contains warnings about problems with this node that
+	// the user should know about.
+	Health []string `json:",omitempty"`
+
+	// NAT classifies the NAT in front of this node: "none", "easy"
+	// if it maps a local port to the same public port for all
+	// destinations, "hard" if the mapping varies by destination,
+	// "udp-blocked" if UDP doesn't get through at all, or empty if
+	// unknown. It's as of the latest netcheck, so it's empty until
+	// the first one after tailscaled starts.
+	NAT string `json:",omitempty"`
 }
 
 func (s *Status) Peers() []key.Public {
@@ -54,6 +66,7 @@ type PeerStatus struct {
 	// Endpoints:
 	Addrs   []string
 	CurAddr string // one of Addrs, or unique if roaming
+	LAN     bool   // whether CurAddr is on a local network shared with the peer
 	Relay   string // DERP region
 
 	RxBytes       int64
@@ -64,6 +77,33 @@ type PeerStatus struct {
 	LastHandshake time.Time // with local wireguard
 	KeepAlive     bool
 
+	// DERPRxBytes and DERPTxBytes are the bytes received from and
+	// sent to the peer via DERP relays, including WireGuard and
+	// discovery overhead. Peers with a direct path have little
+	// DERP traffic.
+	DERPRxBytes int64 `json:",omitempty"`
+	DERPTxBytes int64 `json:",omitempty"`
+	// DERPRxRate and DERPTxRate are the rates of that traffic, in
+	// bytes per second, over the last ten seconds or so.
+	DERPRxRate int64 `json:",omitempty"`
+	DERPTxRate int64 `json:",omitempty"`
+
+	// RxBytesDay and TxBytesDay are the bytes received from and
+	// sent to the peer over the last day, including before any
+	// restart of this node.
+	RxBytesDay int64 `json:",omitempty"`
+	TxBytesDay int64 `json:",omitempty"`
+
+	// AdvertisedRoutes are the routes, in CIDR notation, that the
+	// peer offers to route, other than its own addresses.
+	// AcceptedRoutes are those of them, including an exit node's
+	// default routes, that this node sends to the peer.
+	AdvertisedRoutes []string `json:",omitempty"`
+	AcceptedRoutes   []string `json:",omitempty"`
+
+	// KeyExpiry, if non-nil, is when the node's key expires.
+	KeyExpiry *time.Time `json:",omitempty"`
+
 	// ShareeNode indicates this node exists in the netmap because
 	// it's owned by a shared-to user and that node might connect
 	// to us. These nodes should be hidden by "tailscale status"
@@ -117,6 +157,13 @@ func (sb *StatusBuilder) SetSelfStatus(ss *PeerStatus) {
 	sb.st.Self = ss
 }
 
+// SetNAT sets the classification of the NAT in front of this node.
+func (sb *StatusBuilder) SetNAT(v string) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	sb.st.NAT = v
+}
+
 // AddUser adds a user profile to the status.
 func (sb *StatusBuilder) AddUser(id tailcfg.UserID, up tailcfg.UserProfile) {
 	sb.mu.Lock()
@@ -133,6 +180,18 @@ func (sb *StatusBuilder) AddUser(id tailcfg.UserID, up tailcfg.UserProfile) {
 	sb.st.User[id] = up
 }
 
+// AddHealth adds a warning about the health of the node.
+func (sb *StatusBuilder) AddHealth(msg string) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.locked {
+		log.Printf("[unexpected] ipnstate: AddHealth after Locked")
+		return
+	}
+
+	sb.st.Health = append(sb.st.Health, msg)
+}
+
 // AddIP adds a Tailscale IP address to the status.
 func (sb *StatusBuilder) AddTailscaleIP(ip netaddr.IP) {
 	sb.mu.Lock()
@@ -194,12 +253,39 @@ func (sb *StatusBuilder) AddPeer(peer key.Public, st *PeerStatus) {
 	if v := st.CurAddr; v != "" {
 		e.CurAddr = v
 	}
+	if st.LAN {
+		e.LAN = true
+	}
 	if v := st.RxBytes; v != 0 {
 		e.RxBytes = v
 	}
 	if v := st.TxBytes; v != 0 {
 		e.TxBytes = v
 	}
+	if v := st.DERPRxBytes; v != 0 {
+		e.DERPRxBytes = v
+	}
+	if v := st.DERPTxBytes; v != 0 {
+		e.DERPTxBytes = v
+	}
+	if v := st.DERPRxRate; v != 0 {
+		e.DERPRxRate = v
+	}
+	if v := st.DERPTxRate; v != 0 {
+		e.DERPTxRate = v
+	}
+	if v := st.RxBytesDay; v != 0 {
+		e.RxBytesDay = v
+	}
+	if v := st.TxBytesDay; v != 0 {
+		e.TxBytesDay = v
+	}
+	if v := st.AdvertisedRoutes; v != nil {
+		e.AdvertisedRoutes = v
+	}
+	if v := st.AcceptedRoutes; v != nil {
+		e.AcceptedRoutes = v
+	}
 	if v := st.LastHandshake; !v.IsZero() {
 		e.LastHandshake = v
 	}
@@ -212,6 +298,9 @@ func (sb *StatusBuilder) AddPeer(peer key.Public, st *PeerStatus) {
 	if v := st.LastWrite; !v.IsZero() {
 		e.LastWrite = v
 	}
+	if v := st.KeyExpiry; v != nil {
+		e.KeyExpiry = v
+	}
 	if st.InNetworkMap {
 		e.InNetworkMap = true
 	}
@@ -310,10 +399,16 @@ table tbody tr:nth-child(even) td { background-color: #f5f5f5; }
 				f("derp-%v<br>", html.EscapeString(relay))
 			}
 		}
+		if ps.DERPRxBytes != 0 || ps.DERPTxBytes != 0 {
+			f("<span class=\"relayed\">relayed rx %v, tx %v (rx %v/s, tx %v/s)</span><br>", ps.DERPRxBytes, ps.DERPTxBytes, ps.DERPRxRate, ps.DERPTxRate)
+		}
 
 		match := false
 		for _, addr := range ps.Addrs {
-			if addr == ps.CurAddr {
+			if addr == ps.CurAddr && ps.LAN {
+				match = true
+				f("🔗 <b>%s</b> (LAN)<br>", addr)
+			} else if addr == ps.CurAddr {
 				match = true
 				f("🔗 <b>%s</b><br>", addr)
 			} else {
@@ -368,3 +463,50 @@ type PingResult struct {
 
 	// TODO(bradfitz): details like whether port mapping was used on either side? (Once supported)
 }
+
+// PeerPath describes the paths to a peer that are known, for the
+// "tailscale debug peer-path" subcommand, which is used to diagnose
+// why traffic to a peer is relayed via DERP.
+type PeerPath struct {
+	PublicKey key.Public
+	NodeName  string // DNS name base or (possibly not unique) hostname
+	Relay     string // DERP region code of the peer's home region
+
+	// CurAddr is the ip:port of the direct path in use, if any.
+	CurAddr               string  `json:",omitempty"`
+	CurAddrLatencySeconds float64 `json:",omitempty"`
+
+	// LastFullPing is when all the peer's endpoints were last pinged.
+	LastFullPing time.Time `json:",omitempty"`
+
+	// PathMTU is the largest packet, in bytes, that path MTU
+	// discovery found fits through the tunnel on the path in use to
+	// the peer, or zero if it's off or hasn't probed the peer.
+	PathMTU int `json:",omitempty"`
+
+	// Endpoints are the candidate endpoints of the peer.
+	Endpoints []*PeerPathEndpoint
+
+	// SelfNAT and PeerNAT classify the NATs in front of this node
+	// and the peer, as in Status.NAT.
+	SelfNAT string `json:",omitempty"`
+	PeerNAT string `json:",omitempty"`
+
+	// Reason is why there's no direct path to the peer, or empty
+	// if there is one.
+	Reason string `json:",omitempty"`
+}
+
+// PeerPathEndpoint is the state of a candidate endpoint of a peer.
+type PeerPathEndpoint struct {
+	Addr string // ip:port
+
+	// Learned is whether the endpoint was learned from a ping the
+	// peer sent from it, rather than from the network map.
+	Learned bool `json:",omitempty"`
+
+	LastPing       time.Time `json:",omitempty"` // last discovery ping sent
+	LastPong       time.Time `json:",omitempty"` // last reply to one
+	LatencySeconds float64   `json:",omitempty"` // of the last reply
+	PongSrc        string    `json:",omitempty"` // our ip:port as the peer saw it in the last reply
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnstate
+
+import (
+	"time"
+
+	"tailscale.com/types/key"
+)
+
+// StatusV1Version is the Version of StatusV1 documents.
+const StatusV1Version = 1
+
+// StatusV1 is the stable JSON form of a Status, as printed by
+// "tailscale status --json" for monitoring agents and other programs.
+//
+// Fields may be added to it, but existing fields keep their names,
+// types and meaning; any other change gets a new Version.
+type StatusV1 struct {
+	Version      int      `json:"version"` // StatusV1Version
+	BackendState string   `json:"backendState"`
+	TailscaleIPs []string `json:"tailscaleIPs"`
+	Self         *PeerV1  `json:"self,omitempty"`
+	Peers        []PeerV1 `json:"peers"` // sorted by PublicKey
+
+	// Health contains warnings about problems with this node.
+	// It's empty, not null, when the node is healthy.
+	Health []string `json:"health"`
+
+	// NAT classifies the NAT in front of this node; see Status.NAT.
+	NAT string `json:"nat,omitempty"`
+}
+
+// PeerV1 is a peer in a StatusV1.
+type PeerV1 struct {
+	PublicKey   key.Public   `json:"publicKey"` // base64
+	HostName    string       `json:"hostName"`
+	DNSName     string       `json:"dnsName"`
+	OS          string       `json:"os"`
+	TailscaleIP string       `json:"tailscaleIP"`
+	Connection  ConnectionV1 `json:"connection"`
+
+	// RxBytes and TxBytes count WireGuard bytes from and to the
+	// peer, whichever the path.
+	RxBytes int64 `json:"rxBytes"`
+	TxBytes int64 `json:"txBytes"`
+
+	// LastSeen is when the peer was last connected to the
+	// coordination server, and LastHandshake when it last completed
+	// a WireGuard handshake with this node. Each is omitted if never.
+	LastSeen      *time.Time `json:"lastSeen,omitempty"`
+	LastHandshake *time.Time `json:"lastHandshake,omitempty"`
+
+	AdvertisedRoutes []string `json:"advertisedRoutes"` // by the peer
+	AcceptedRoutes   []string `json:"acceptedRoutes"`   // sent to the peer by this node
+}
+
+// ConnectionV1 is the path to a peer.
+type ConnectionV1 struct {
+	// Type is "direct" if packets go straight to the peer, at Addr,
+	// "derp" if they're relayed through the DERP region DERPRegion,
+	// or "none" if there is no path to it yet. LAN is whether a
+	// direct Addr is on a local network shared with the peer.
+	Type       string `json:"type"`
+	Addr       string `json:"addr,omitempty"`
+	LAN        bool   `json:"lan,omitempty"`
+	DERPRegion string `json:"derpRegion,omitempty"`
+}
+
+// V1 returns s in its stable JSON form.
+func (s *Status) V1() *StatusV1 {
+	v := &StatusV1{
+		Version:      StatusV1Version,
+		BackendState: s.BackendState,
+		TailscaleIPs: []string{},
+		Peers:        []PeerV1{},
+		Health:       []string{},
+		NAT:          s.NAT,
+	}
+	for _, ip := range s.TailscaleIPs {
+		v.TailscaleIPs = append(v.TailscaleIPs, ip.String())
+	}
+	if s.Self != nil {
+		self := s.Self.v1()
+		v.Self = &self
+	}
+	for _, k := range s.Peers() {
+		v.Peers = append(v.Peers, s.Peer[k].v1())
+	}
+	v.Health = append(v.Health, s.Health...)
+	return v
+}
+
+func (ps *PeerStatus) v1() PeerV1 {
+	p := PeerV1{
+		PublicKey:        ps.PublicKey,
+		HostName:         ps.HostName,
+		DNSName:          ps.DNSName,
+		OS:               ps.OS,
+		TailscaleIP:      ps.TailAddr,
+		RxBytes:          ps.RxBytes,
+		TxBytes:          ps.TxBytes,
+		LastSeen:         timeOrNil(ps.LastSeen),
+		LastHandshake:    timeOrNil(ps.LastHandshake),
+		AdvertisedRoutes: append([]string{}, ps.AdvertisedRoutes...),
+		AcceptedRoutes:   append([]string{}, ps.AcceptedRoutes...),
+	}
+	switch {
+	case ps.CurAddr != "":
+		p.Connection = ConnectionV1{Type: "direct", Addr: ps.CurAddr, LAN: ps.LAN}
+	case ps.Relay != "":
+		p.Connection = ConnectionV1{Type: "derp", DERPRegion: ps.Relay}
+	default:
+		p.Connection = ConnectionV1{Type: "none"}
+	}
+	return p
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
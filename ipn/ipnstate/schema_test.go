@@ -0,0 +1,59 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnstate
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/types/key"
+)
+
+func TestStatusV1(t *testing.T) {
+	seen := time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC)
+	sb := new(StatusBuilder)
+	sb.SetBackendState("Running")
+	sb.AddTailscaleIP(netaddr.IPv4(100, 64, 0, 1))
+	sb.AddHealth("router: no route")
+	sb.SetNAT("hard")
+	sb.AddPeer(key.Public{1}, &PeerStatus{
+		HostName:         "router",
+		TailAddr:         "100.64.0.2",
+		CurAddr:          "1.2.3.4:41641",
+		LAN:              true,
+		Relay:            "nyc",
+		RxBytes:          10,
+		TxBytes:          20,
+		LastSeen:         seen,
+		AdvertisedRoutes: []string{"10.0.0.0/8", "0.0.0.0/0"},
+	})
+	sb.AddPeer(key.Public{1}, &PeerStatus{
+		AcceptedRoutes: []string{"10.0.0.0/8"},
+	})
+	sb.AddPeer(key.Public{2}, &PeerStatus{
+		HostName: "laptop",
+		Relay:    "sfo",
+	})
+	sb.AddPeer(key.Public{3}, &PeerStatus{HostName: "new"})
+
+	got, err := json.Marshal(sb.Status().V1())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = `{"version":1,"backendState":"Running","tailscaleIPs":["100.64.0.1"],"peers":[` +
+		`{"publicKey":"AQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=","hostName":"router","dnsName":"","os":"","tailscaleIP":"100.64.0.2",` +
+		`"connection":{"type":"direct","addr":"1.2.3.4:41641","lan":true},"rxBytes":10,"txBytes":20,"lastSeen":"2020-12-01T00:00:00Z",` +
+		`"advertisedRoutes":["10.0.0.0/8","0.0.0.0/0"],"acceptedRoutes":["10.0.0.0/8"]},` +
+		`{"publicKey":"AgAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=","hostName":"laptop","dnsName":"","os":"","tailscaleIP":"",` +
+		`"connection":{"type":"derp","derpRegion":"sfo"},"rxBytes":0,"txBytes":0,"advertisedRoutes":[],"acceptedRoutes":[]},` +
+		`{"publicKey":"AwAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=","hostName":"new","dnsName":"","os":"","tailscaleIP":"",` +
+		`"connection":{"type":"none"},"rxBytes":0,"txBytes":0,"advertisedRoutes":[],"acceptedRoutes":[]}` +
+		`],"health":["router: no route"],"nat":"hard"}`
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
+)
+
+// defaultKeepAliveSeconds is the keepalive interval used when
+// Prefs.KeepAliveSeconds is zero.
+const defaultKeepAliveSeconds = 25
+
+// setKeepAlives turns on WireGuard persistent keepalives in cfg for
+// the peers in prefs.KeepAlivePeers.
+func setKeepAlives(cfg *wgcfg.Config, prefs *Prefs) {
+	if len(prefs.KeepAlivePeers) == 0 {
+		return
+	}
+	secs := prefs.KeepAliveSeconds
+	if secs <= 0 {
+		secs = defaultKeepAliveSeconds
+	}
+	if secs > 0xffff {
+		secs = 0xffff
+	}
+	want := make(map[netaddr.IP]bool, len(prefs.KeepAlivePeers))
+	for _, ip := range prefs.KeepAlivePeers {
+		want[ip] = true
+	}
+	for i := range cfg.Peers {
+		p := &cfg.Peers[i]
+		for _, pfx := range wgCIDRsToNetaddr(p.AllowedIPs) {
+			single := pfx.Bits == 128 || (pfx.IP.Is4() && pfx.Bits == 32)
+			if single && want[pfx.IP] {
+				p.PersistentKeepalive = uint16(secs)
+				break
+			}
+		}
+	}
+}
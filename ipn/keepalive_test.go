@@ -0,0 +1,74 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"testing"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
+)
+
+func TestSetKeepAlives(t *testing.T) {
+	mustCIDR := func(s string) wgcfg.CIDR {
+		c, err := wgcfg.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	newCfg := func() *wgcfg.Config {
+		return &wgcfg.Config{Peers: []wgcfg.Peer{
+			{AllowedIPs: []wgcfg.CIDR{mustCIDR("100.64.0.1/32")}},
+			{AllowedIPs: []wgcfg.CIDR{mustCIDR("100.64.0.2/32"), mustCIDR("10.0.0.0/8")}},
+			{AllowedIPs: []wgcfg.CIDR{mustCIDR("100.64.0.3/32")}},
+		}}
+	}
+	keepalives := func(cfg *wgcfg.Config) []uint16 {
+		var ret []uint16
+		for _, p := range cfg.Peers {
+			ret = append(ret, p.PersistentKeepalive)
+		}
+		return ret
+	}
+
+	tests := []struct {
+		name  string
+		prefs *Prefs
+		want  []uint16
+	}{
+		{"none", &Prefs{}, []uint16{0, 0, 0}},
+		{
+			name:  "default_interval",
+			prefs: &Prefs{KeepAlivePeers: []netaddr.IP{netaddr.IPv4(100, 64, 0, 2)}},
+			want:  []uint16{0, 25, 0},
+		},
+		{
+			name: "custom_interval",
+			prefs: &Prefs{
+				KeepAlivePeers:   []netaddr.IP{netaddr.IPv4(100, 64, 0, 1), netaddr.IPv4(100, 64, 0, 3)},
+				KeepAliveSeconds: 10,
+			},
+			want: []uint16{10, 0, 10},
+		},
+		{
+			name:  "subnet_address_is_not_peer",
+			prefs: &Prefs{KeepAlivePeers: []netaddr.IP{netaddr.IPv4(10, 0, 0, 0)}},
+			want:  []uint16{0, 0, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newCfg()
+			setKeepAlives(cfg, tt.prefs)
+			got := keepalives(cfg)
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("keepalives = %v; want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
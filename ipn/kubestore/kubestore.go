@@ -0,0 +1,139 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package kubestore is an ipn.StateStore that keeps state in a
+// Kubernetes Secret, so that a tailscaled running in a pod keeps its
+// node identity when the pod is replaced, without a persistent
+// volume.
+package kubestore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/kube"
+)
+
+// Store is an ipn.StateStore in a Secret, one state per field.
+//
+// Writes are optimistically concurrent: each merge-patches the
+// Secret at the resourceVersion it was read at and retries on
+// conflict, so concurrent writers never lose each other's changes to
+// other fields.
+type Store struct {
+	kc     *kube.Client
+	secret string
+	path   string // API path of the Secret
+}
+
+// timeout bounds each ReadState and WriteState.
+const timeout = 30 * time.Second
+
+// New returns a Store in the Secret named secret, in the namespace of
+// kc. The Secret is created on the first write if it doesn't exist.
+// The pod's service account needs to get, create and patch it.
+func New(kc *kube.Client, secret string) (*Store, error) {
+	if secret == "" {
+		return nil, errors.New("kubestore: empty Secret name")
+	}
+	s := &Store{
+		kc:     kc,
+		secret: secret,
+		path:   "/api/v1/namespaces/" + kc.Namespace() + "/secrets/" + secret,
+	}
+	// Check that the Secret is readable, so that a missing
+	// permission shows up at startup.
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if _, err := s.get(ctx); err != nil && !kube.IsNotFound(err) {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) String() string {
+	return fmt.Sprintf("kubestore.Store(%s/%s)", s.kc.Namespace(), s.secret)
+}
+
+// fieldName returns the Secret field holding the state id. Field
+// names may only contain alphanumerics, '-', '_' and '.'.
+func fieldName(id ipn.StateKey) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, string(id))
+}
+
+func (s *Store) get(ctx context.Context) (*kube.Secret, error) {
+	sec := new(kube.Secret)
+	if err := s.kc.Do(ctx, "GET", s.path, nil, sec); err != nil {
+		return nil, err
+	}
+	return sec, nil
+}
+
+// ReadState implements the ipn.StateStore interface.
+func (s *Store) ReadState(id ipn.StateKey) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	sec, err := s.get(ctx)
+	if kube.IsNotFound(err) {
+		return nil, ipn.ErrStateNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	bs, ok := sec.Data[fieldName(id)]
+	if !ok {
+		return nil, ipn.ErrStateNotExist
+	}
+	return bs, nil
+}
+
+// WriteState implements the ipn.StateStore interface.
+func (s *Store) WriteState(id ipn.StateKey, bs []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	field := fieldName(id)
+	for attempt := 0; ; attempt++ {
+		err := s.write(ctx, field, bs)
+		if !kube.IsConflict(err) || attempt == 4 {
+			return err
+		}
+		// Someone else wrote the Secret since it was read;
+		// read it again.
+	}
+}
+
+func (s *Store) write(ctx context.Context, field string, bs []byte) error {
+	sec, err := s.get(ctx)
+	if kube.IsNotFound(err) {
+		// Creating races with other creators; losing is a
+		// conflict, and the retry patches their Secret.
+		return s.kc.Do(ctx, "POST", s.path[:strings.LastIndexByte(s.path, '/')], &kube.Secret{
+			TypeMeta: kube.TypeMeta{Kind: "Secret", APIVersion: "v1"},
+			Metadata: kube.ObjectMeta{Name: s.secret},
+			Data:     map[string][]byte{field: bs},
+		}, nil)
+	}
+	if err != nil {
+		return err
+	}
+	if old, ok := sec.Data[field]; ok && bytes.Equal(old, bs) {
+		return nil
+	}
+	patch := map[string]interface{}{
+		"metadata": map[string]string{"resourceVersion": sec.Metadata.ResourceVersion},
+		"data":     map[string][]byte{field: bs},
+	}
+	return s.kc.Patch(ctx, s.path, patch, nil)
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kubestore
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"tailscale.com/ipn"
+	"tailscale.com/kube"
+)
+
+// fakeSecret is a fake API server holding the Secret
+// /api/v1/namespaces/ns/secrets/state.
+type fakeSecret struct {
+	mu     sync.Mutex
+	secret *kube.Secret // nil if it doesn't exist
+	rv     int
+
+	// beforePatch, if non-nil, runs before a patch is applied, as
+	// another writer would.
+	beforePatch func(*fakeSecret)
+}
+
+const secretPath = "/api/v1/namespaces/ns/secrets/state"
+
+func (f *fakeSecret) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == "GET" && r.URL.Path == secretPath:
+		if f.secret == nil {
+			http.Error(w, `{"message":"not found"}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(f.secret)
+	case r.Method == "POST" && r.URL.Path == "/api/v1/namespaces/ns/secrets":
+		if f.secret != nil {
+			http.Error(w, `{"message":"already exists"}`, http.StatusConflict)
+			return
+		}
+		f.secret = new(kube.Secret)
+		json.NewDecoder(r.Body).Decode(f.secret)
+		f.bump()
+	case r.Method == "PATCH" && r.URL.Path == secretPath:
+		if r.Header.Get("Content-Type") != "application/merge-patch+json" {
+			http.Error(w, `{"message":"bad content type"}`, http.StatusUnsupportedMediaType)
+			return
+		}
+		if f.secret == nil {
+			http.Error(w, `{"message":"not found"}`, http.StatusNotFound)
+			return
+		}
+		if f.beforePatch != nil {
+			f.beforePatch(f)
+			f.beforePatch = nil
+		}
+		var patch kube.Secret
+		json.NewDecoder(r.Body).Decode(&patch)
+		if patch.Metadata.ResourceVersion != f.secret.Metadata.ResourceVersion {
+			http.Error(w, `{"message":"conflict"}`, http.StatusConflict)
+			return
+		}
+		for k, v := range patch.Data {
+			f.secret.Data[k] = v
+		}
+		f.bump()
+	default:
+		http.Error(w, "unexpected "+r.Method+" "+r.URL.Path, http.StatusBadRequest)
+	}
+}
+
+func (f *fakeSecret) bump() {
+	f.rv++
+	f.secret.Metadata.ResourceVersion = strconv.Itoa(f.rv)
+}
+
+func TestStore(t *testing.T) {
+	fs := new(fakeSecret)
+	ts := httptest.NewServer(fs)
+	defer ts.Close()
+
+	s, err := New(kube.NewForTest(ts.URL, "ns"), "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ReadState(ipn.GlobalDaemonStateKey); err != ipn.ErrStateNotExist {
+		t.Fatalf("ReadState before any write: err = %v; want ErrStateNotExist", err)
+	}
+	if err := s.WriteState(ipn.GlobalDaemonStateKey, []byte("prefs")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteState(ipn.MachineKeyStateKey, []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[ipn.StateKey]string{
+		ipn.GlobalDaemonStateKey: "prefs",
+		ipn.MachineKeyStateKey:   "key",
+	} {
+		got, err := s.ReadState(id)
+		if err != nil || string(got) != want {
+			t.Errorf("ReadState(%q) = %q, %v; want %q", id, got, err, want)
+		}
+	}
+
+	// A write racing with another writer retries, keeping both.
+	fs.mu.Lock()
+	fs.beforePatch = func(f *fakeSecret) {
+		f.secret.Data["other"] = []byte("theirs")
+		f.bump()
+	}
+	fs.mu.Unlock()
+	if err := s.WriteState(ipn.GlobalDaemonStateKey, []byte("prefs2")); err != nil {
+		t.Fatal(err)
+	}
+	fs.mu.Lock()
+	data := fs.secret.Data
+	fs.mu.Unlock()
+	if string(data["_daemon"]) != "prefs2" || string(data["other"]) != "theirs" {
+		t.Errorf("after racing write, secret data = %q", data)
+	}
+}
+
+func TestFieldName(t *testing.T) {
+	for in, want := range map[ipn.StateKey]string{
+		"_daemon":               "_daemon",
+		"server-mode-start-key": "server-mode-start-key",
+		`user-S-1-5-21\foo`:     "user-S-1-5-21_foo",
+	} {
+		if got := fieldName(in); got != want {
+			t.Errorf("fieldName(%q) = %q; want %q", in, got, want)
+		}
+	}
+}
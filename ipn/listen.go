@@ -0,0 +1,96 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/wgengine/filter"
+)
+
+// Peer identifies the tailnet peer at the remote end of a connection,
+// as found by WhoIs.
+type Peer struct {
+	Addr netaddr.IPPort // the peer's end of the connection
+	Node *tailcfg.Node
+	User tailcfg.UserProfile
+}
+
+// AuthzFunc decides whether a peer may use a service at accept time.
+// A non-nil error rejects the connection, and is logged.
+type AuthzFunc func(Peer) error
+
+// Listen listens on the TCP address addr, as net.Listen does, for a
+// Go service run alongside the backend on the node's Tailscale IPs.
+// The listener only returns connections from peers in the network
+// map that the packet filter lets reach the address they connected
+// to, so the tailnet's ACLs still apply, and that authz, if non-nil,
+// authorizes. Others are closed at once.
+//
+// The connections are from the OS network stack, so the engine must
+// be running on a TUN device.
+func (b *LocalBackend) Listen(network, addr string, authz AuthzFunc) (net.Listener, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &authzListener{Listener: ln, b: b, authz: authz}, nil
+}
+
+// authzListener is a listener returned by LocalBackend.Listen.
+type authzListener struct {
+	net.Listener
+	b     *LocalBackend
+	authz AuthzFunc
+}
+
+func (ln *authzListener) Accept() (net.Conn, error) {
+	for {
+		c, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if err := ln.b.authorizeConn(c, ln.authz); err != nil {
+			ln.b.logf("listen %v: rejecting connection from %v: %v", ln.Addr(), c.RemoteAddr(), err)
+			c.Close()
+			continue
+		}
+		return c, nil
+	}
+}
+
+// authorizeConn reports whether the connection c, accepted by a
+// listener from Listen, may be used: the remote end must be a known
+// peer, the packet filter must allow it, and so must authz.
+func (b *LocalBackend) authorizeConn(c net.Conn, authz AuthzFunc) error {
+	remote, err := netaddr.ParseIPPort(c.RemoteAddr().String())
+	if err != nil {
+		return err
+	}
+	local, err := netaddr.ParseIPPort(c.LocalAddr().String())
+	if err != nil {
+		return err
+	}
+	n, u, ok := b.WhoIs(remote.IP)
+	if !ok {
+		return errors.New("not a known peer")
+	}
+	if f := b.e.GetFilter(); f == nil || f.CheckTCP(remote.IP, local.IP, local.Port) != filter.Accept {
+		return errors.New("not permitted by packet filter")
+	}
+	if authz == nil {
+		return nil
+	}
+	return authz(Peer{Addr: remote, Node: n, User: u})
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/control/controlclient"
+	"tailscale.com/tailcfg"
+	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/filter"
+)
+
+func TestListenAuthz(t *testing.T) {
+	e, err := wgengine.NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &MemoryStore{cache: make(map[StateKey][]byte)}
+	b, err := NewLocalBackend(t.Logf, "logid", store, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	// The "peer" dials from 127.0.0.1.
+	addr, err := wgcfg.ParseCIDR("127.0.0.1/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	b.netMap = &controlclient.NetworkMap{
+		Peers: []*tailcfg.Node{{Name: "peer.", User: 2, Addresses: []wgcfg.CIDR{addr}}},
+		UserProfiles: map[tailcfg.UserID]tailcfg.UserProfile{
+			2: {ID: 2, LoginName: "bob@example.com"},
+		},
+	}
+	b.mu.Unlock()
+
+	// dial connects to ln, whose accepted connections arrive on
+	// got, and reports whether the connection was accepted.
+	dial := func(ln net.Listener, got <-chan net.Conn) (accepted bool) {
+		t.Helper()
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		select {
+		case ac := <-got:
+			ac.Close()
+			return true
+		case <-time.After(500 * time.Millisecond):
+			return false
+		}
+	}
+	accept := func(ln net.Listener) <-chan net.Conn {
+		got := make(chan net.Conn, 1)
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				got <- c
+			}
+		}()
+		return got
+	}
+
+	seen := make(chan Peer, 1)
+	ln, err := b.Listen("tcp", "127.0.0.1:0", func(p Peer) error {
+		seen <- p
+		if p.User.LoginName != "alice@example.com" {
+			return errors.New("not alice")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	got := accept(ln)
+
+	// The default filter blocks everything.
+	if dial(ln, got) {
+		t.Error("connection accepted despite the packet filter")
+	}
+
+	e.SetFilter(filter.NewAllowAllForTest(t.Logf))
+	if dial(ln, got) {
+		t.Error("connection accepted despite authz")
+	}
+	if p := <-seen; p.Node == nil || p.Node.Name != "peer." || p.User.LoginName != "bob@example.com" {
+		t.Errorf("authz got %+v", p)
+	}
+
+	ln2, err := b.Listen("tcp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln2.Close()
+	if !dial(ln2, accept(ln2)) {
+		t.Error("connection without authz not accepted")
+	}
+}
@@ -7,9 +7,12 @@ package ipn
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
@@ -19,22 +22,30 @@ import (
 	"golang.org/x/oauth2"
 	"inet.af/netaddr"
 	"tailscale.com/control/controlclient"
+	"tailscale.com/derp/derpmap"
+	"tailscale.com/health"
 	"tailscale.com/internal/deepprint"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/ipn/policy"
+	"tailscale.com/log/auditlog"
 	"tailscale.com/net/interfaces"
+	"tailscale.com/net/trafficstats"
 	"tailscale.com/net/tsaddr"
+	"tailscale.com/net/tshttpproxy"
 	"tailscale.com/portlist"
 	"tailscale.com/tailcfg"
+	"tailscale.com/tka"
 	"tailscale.com/types/empty"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/version"
 	"tailscale.com/wgengine"
 	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/magicsock"
 	"tailscale.com/wgengine/router"
 	"tailscale.com/wgengine/router/dns"
 	"tailscale.com/wgengine/tsdns"
+	"tailscale.com/wgengine/tstun"
 )
 
 var controlDebugFlags = getControlDebugFlags()
@@ -71,9 +82,18 @@ type LocalBackend struct {
 	gotPortPollRes  chan struct{}    // closed upon first readPoller result
 	serverURL       string           // tailcontrol URL
 	newDecompressor func() (controlclient.Decompressor, error)
+	audit           *auditlog.Log
+	traffic         *trafficstats.Store
+	unwatchHealth   func() // stops health watching; called by Shutdown
 
 	filterHash string
 
+	// auditedRules and auditedShieldsUp are the packet filter last
+	// recorded in the audit log. Like filterHash, they're only used
+	// by updateFilter.
+	auditedRules     []filter.Match
+	auditedShieldsUp bool
+
 	// The mutex protects the following elements.
 	mu             sync.Mutex
 	notify         func(Notify)
@@ -94,7 +114,87 @@ type LocalBackend struct {
 	blocked      bool
 	authURL      string
 	interact     bool
+	loginURL     string // last authURL sent to the frontend, until logged in
 	prevIfState  *interfaces.State
+	inbox        string // directory for files received from peers; empty means disabled
+	varRoot      string // directory for persistent state; empty means none
+	ephemeral    bool   // register as an ephemeral node
+
+	// lastEngineStatus is when the engine last posted a status,
+	// or when b was created if it hasn't yet.
+	lastEngineStatus time.Time
+
+	// shutdownDrain is how long Shutdown keeps routing after
+	// withdrawing the node's routes; see SetShutdownDrain.
+	// shuttingDown is whether it has withdrawn them.
+	shutdownDrain time.Duration
+	shuttingDown  bool
+
+	// static, if non-nil, is the network map to use instead of a
+	// control server's.
+	static *controlclient.StaticMap
+
+	peerAPIListeners []*peerAPIListener
+	sshServer        SSHServer // lazily created on first use; nil until Prefs.RunSSH is set
+	sshListeners     []*sshListener
+	serveConfig      *ServeConfig // nil if nothing is served
+	serveListeners   []*serveListener
+	serveCert        *tls.Certificate // for the MagicDNS name; nil until first needed
+	serveCertFailed  time.Time        // last time getting a real serveCert failed
+	autoExitNode     tailcfg.NodeID   // exit node picked for Prefs.AutoExitNode; 0 if none
+	exitNodeProbes   map[tailcfg.NodeID]exitNodeProbe
+	exitNodeProbing  bool             // whether exitNodeProbeLoop is running
+	keyExpiryTimer   *time.Timer      // runs checkKeyExpiry; nil if not needed
+	lastKeyRenew     time.Time        // last time checkKeyExpiry tried to renew the node key
+	reconfigTimer    *time.Timer      // pending authReconfigSoon call; nil if none
+	reconfigured     bool             // whether the engine and router took the netmap's config
+	derpMapOverlay   *tailcfg.DERPMap // from SetDERPMapSource; nil if none
+	policyFilter     []filter.Match   // from SetPolicyFilter; nil if none
+	autoRoutes       []wgcfg.CIDR     // from SetAutoRoutes
+	routesStandby    bool             // from SetRoutesStandby
+	routeChecking    bool             // whether routeCheckLoop is running
+	routeFailures    map[wgcfg.CIDR]int
+	autoUpdating     bool             // whether autoUpdateLoop is running
+	controlDERPMap   *tailcfg.DERPMap // last DERP map from control, before derpMapOverlay
+
+	// lock is the network lock authority; nil unless it's enabled.
+	// lockErr is why the saved one couldn't be loaded, if so.
+	// lockPeers are the peers in the last netmap from control,
+	// before lock refused those in lockRejected, with the reasons.
+	lock         *tka.Authority
+	lockErr      error
+	lockPeers    []*tailcfg.Node
+	lockRejected map[tailcfg.NodeKey]string
+
+	// peerRoutes are the AllowedIPs of each peer in the config the
+	// engine last took; nil if none.
+	peerRoutes map[key.Public][]wgcfg.CIDR
+
+	// impairments is the packet loss and delay from SetImpairments;
+	// nil if none.
+	impairments map[netaddr.IP]tstun.Impairment
+
+	// shapes is the bandwidth caps from SetShapes; nil if none.
+	shapes map[netaddr.IPPrefix]tstun.Shape
+
+	// captureMu guards captureSinks, the packet capture streams
+	// running from StreamCapture. It's separate from mu because it's
+	// taken on the packet path while capturing.
+	captureMu    sync.Mutex
+	captureSinks map[chan capturedPacket]bool
+
+	// connMu guards connSinks, the connection event streams
+	// running from WatchConns. Like captureMu, it's taken on the
+	// packet path.
+	connMu    sync.Mutex
+	connSinks map[chan tstun.ConnEvent]bool
+
+	// watchMu guards watchers, the notification streams running
+	// from WatchNotifications, and watchedPeers, the peers' paths
+	// as last sent to them.
+	watchMu      sync.Mutex
+	watchers     map[chan *Notify]bool
+	watchedPeers map[tailcfg.NodeKey]PeerChange
 
 	// statusLock must be held before calling statusChanged.Wait() or
 	// statusChanged.Broadcast().
@@ -110,7 +210,9 @@ func NewLocalBackend(logf logger.Logf, logid string, store StateStore, e wgengin
 	}
 
 	// Default filter blocks everything, until Start() is called.
-	e.SetFilter(filter.NewAllowNone(logf))
+	// It keeps the engine's flow state, such as that handed off
+	// by a previous tailscaled, for the filters that follow.
+	e.SetFilter(filter.New(nil, nil, e.GetFilter(), logf))
 
 	ctx, cancel := context.WithCancel(context.Background())
 	portpoll, err := portlist.NewPoller()
@@ -130,10 +232,20 @@ func NewLocalBackend(logf logger.Logf, logid string, store StateStore, e wgengin
 		state:          NoState,
 		portpoll:       portpoll,
 		gotPortPollRes: make(chan struct{}),
+		audit:          auditlog.New(),
+		traffic:        trafficstats.New(),
+
+		lastEngineStatus: time.Now(),
 	}
 	e.SetLinkChangeCallback(b.linkChange)
 	b.statusChanged = sync.NewCond(&b.statusLock)
+	b.unwatchHealth = health.RegisterWatcher(b.healthChanged)
+
+	b.mu.Lock()
+	b.loadServeConfigLocked()
+	b.mu.Unlock()
 
+	go b.pollTrafficStats()
 	return b, nil
 }
 
@@ -159,22 +271,69 @@ func (b *LocalBackend) linkChange(major bool, ifst *interfaces.State) {
 		case NoState, Stopped:
 			// Do nothing.
 		default:
-			go b.authReconfig()
+			b.authReconfigSoonLocked()
 		}
 	}
+
+	// The machine's LANs may have changed, which
+	// ExitNodeAllowLANAccess's routes depend on.
+	if major && b.prefs != nil && b.prefs.ExitNodeAllowLANAccess {
+		go b.authReconfigSoon()
+	}
+}
+
+// healthChanged is called by the health package when the node's
+// health changes. It tells the frontends.
+func (b *LocalBackend) healthChanged() {
+	st := health.Get()
+	if st.Healthy {
+		b.logf("health: ok")
+	} else {
+		b.logf("health: %s", strings.Join(st.Strings(), "; "))
+	}
+	b.send(Notify{Health: &st})
 }
 
 // Shutdown halts the backend and all its sub-components. The backend
 // can no longer be used after Shutdown returns.
 func (b *LocalBackend) Shutdown() {
+	b.unwatchHealth()
 	b.mu.Lock()
 	cli := b.c
+	ephemeral := b.ephemeral
+	drain := b.shutdownDrain
+	running := b.state == Running
 	b.mu.Unlock()
 
 	if cli != nil {
+		if ephemeral {
+			// Remove the node from the tailnet now rather than
+			// leaving it for control to notice it's gone.
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := cli.ExpireNodeKey(ctx); err != nil {
+				b.logf("expiring ephemeral node key: %v", err)
+			}
+			cancel()
+		} else if drain > 0 && running {
+			b.goOffline(cli, drain)
+		}
 		cli.Shutdown()
 	}
+	b.mu.Lock()
+	b.closePeerAPIListenersLocked()
+	b.closeSSHListenersLocked()
+	b.closeServeListenersLocked()
+	if b.keyExpiryTimer != nil {
+		b.keyExpiryTimer.Stop()
+	}
+	if b.reconfigTimer != nil {
+		b.reconfigTimer.Stop()
+	}
+	b.mu.Unlock()
 	b.ctxCancel()
+	if err := b.traffic.Save(); err != nil {
+		b.logf("traffic stats: %v", err)
+	}
 	b.e.Close()
 	b.e.Wait()
 }
@@ -191,6 +350,8 @@ func (b *LocalBackend) Status() *ipnstate.Status {
 func (b *LocalBackend) UpdateStatus(sb *ipnstate.StatusBuilder) {
 	b.e.UpdateStatus(sb)
 
+	traffic := b.traffic.Totals(time.Now(), trafficstats.Window)
+
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
@@ -211,6 +372,12 @@ func (b *LocalBackend) UpdateStatus(sb *ipnstate.StatusBuilder) {
 			if len(p.Addresses) > 0 {
 				tailAddr = strings.TrimSuffix(p.Addresses[0].String(), "/32")
 			}
+			var keyExpiry *time.Time
+			if !p.KeyExpiry.IsZero() {
+				keyExpiry = &p.KeyExpiry
+			}
+			advertised, accepted := b.peerRoutesLocked(p)
+			day := traffic.Peers[p.Key.String()]
 			sb.AddPeer(key.Public(p.Key), &ipnstate.PeerStatus{
 				InNetworkMap: true,
 				UserID:       p.User,
@@ -222,10 +389,50 @@ func (b *LocalBackend) UpdateStatus(sb *ipnstate.StatusBuilder) {
 				Created:      p.Created,
 				LastSeen:     lastSeen,
 				ShareeNode:   p.Hostinfo.ShareeNode,
+				KeyExpiry:    keyExpiry,
+				RxBytesDay:   day.RxBytes,
+				TxBytesDay:   day.TxBytes,
+
+				AdvertisedRoutes: advertised,
+				AcceptedRoutes:   accepted,
 			})
 		}
 	}
+	for _, msg := range health.Get().Strings() {
+		sb.AddHealth(msg)
+	}
+}
+
+// peerRoutesLocked returns the routes, other than its own addresses,
+// that the peer p advertises and those that the engine's config sends
+// to it, in CIDR notation.
+//
+// b.mu must be held.
+func (b *LocalBackend) peerRoutesLocked(p *tailcfg.Node) (advertised, accepted []string) {
+	own := make(map[string]bool, len(p.Addresses))
+	for _, a := range p.Addresses {
+		own[a.String()] = true
+	}
+	for _, r := range p.Hostinfo.RoutableIPs {
+		if s := r.String(); !own[s] {
+			advertised = append(advertised, s)
+		}
+	}
+	for _, r := range b.peerRoutes[key.Public(p.Key)] {
+		if s := r.String(); !own[s] {
+			accepted = append(accepted, s)
+		}
+	}
+	return advertised, accepted
+}
 
+// peerRoutes returns the AllowedIPs of each peer in cfg.
+func peerRoutes(cfg *wgcfg.Config) map[key.Public][]wgcfg.CIDR {
+	m := make(map[key.Public][]wgcfg.CIDR, len(cfg.Peers))
+	for _, p := range cfg.Peers {
+		m[key.Public(p.PublicKey)] = p.AllowedIPs
+	}
+	return m
 }
 
 // SetDecompressor sets a decompression function, which must be a zstd
@@ -238,10 +445,103 @@ func (b *LocalBackend) SetDecompressor(fn func() (controlclient.Decompressor, er
 	b.newDecompressor = fn
 }
 
+// SetVarRoot sets the directory in which tailscaled keeps
+// persistent state other than the IPN state store, such as the SSH
+// server's host key, the audit log and traffic statistics. An empty
+// dir (the default) means there is none, and the audit log and
+// traffic statistics are only kept in memory.
+func (b *LocalBackend) SetVarRoot(dir string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.varRoot = dir
+	if dir != "" {
+		b.loadLockLocked(dir)
+		if err := b.audit.SetFile(filepath.Join(dir, "audit.log")); err != nil {
+			b.logf("audit log: %v; keeping it in memory", err)
+		}
+		if err := b.traffic.SetFile(filepath.Join(dir, "traffic-stats.json")); err != nil {
+			b.logf("traffic stats: %v; keeping them in memory", err)
+		}
+	}
+}
+
+// SetEphemeral sets whether the node registers with the control
+// server as an ephemeral node, which is deleted from the tailnet when
+// the backend shuts down or stays offline. It must be called before
+// Start.
+func (b *LocalBackend) SetEphemeral(ephemeral bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ephemeral = ephemeral
+}
+
+// SetShutdownDrain makes Shutdown, when the node is running, first
+// withdraw its routes and tell the control server it's going
+// offline, and then, if it was routing, keep routing for d while
+// peers move their connections to other routers. Zero (the default)
+// means Shutdown just stops.
+func (b *LocalBackend) SetShutdownDrain(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.shutdownDrain = d
+}
+
+// goOffline is the part of Shutdown enabled by SetShutdownDrain.
+func (b *LocalBackend) goOffline(cli *controlclient.Client, drain time.Duration) {
+	b.mu.Lock()
+	var newHi *tailcfg.Hostinfo
+	routing := false
+	if b.hostinfo != nil && b.prefs != nil {
+		routing = len(b.hostinfoRoutesLocked(b.prefs)) > 0
+		b.shuttingDown = true
+		newHi = b.hostinfo.Clone()
+		newHi.RoutableIPs = b.hostinfoRoutesLocked(b.prefs)
+		b.hostinfo = newHi
+	}
+	b.mu.Unlock()
+
+	b.logf("going offline")
+	if newHi != nil {
+		b.doSetHostinfoFilterServices(newHi)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := cli.SendGoingOffline(ctx); err != nil {
+		b.logf("telling control we're going offline: %v", err)
+	}
+	cancel()
+	if routing {
+		b.logf("draining routed connections for %v before shutting down", drain)
+		time.Sleep(drain)
+	}
+}
+
+// SetStaticMap makes the backend run from sm instead of a control
+// server, for networks without one. It must be called before Start.
+func (b *LocalBackend) SetStaticMap(sm *controlclient.StaticMap) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.static = sm
+}
+
+// TailscaleVarRoot returns the directory set by SetVarRoot, or the
+// empty string if there is none.
+func (b *LocalBackend) TailscaleVarRoot() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.varRoot
+}
+
 // setClientStatus is the callback invoked by the control client whenever it posts a new status.
 // Among other things, this is where we update the netmap, packet filters, DNS and DERP maps.
 func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 	// The following do not depend on any data for which we need to lock b.
+	if st.LoginErr != "" {
+		b.logf("Received login error: %v", st.LoginErr)
+		msg := "login failed: " + st.LoginErr
+		b.send(Notify{ErrMessage: &msg})
+		b.stateMachine()
+		return
+	}
 	if st.Err != "" {
 		// TODO(crawshaw): display in the UI.
 		b.logf("Received error: %v", st.Err)
@@ -249,6 +549,7 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 	}
 	if st.LoginFinished != nil {
 		// Auth completed, unblock the engine
+		b.auditf(AuditLogin, "login finished")
 		b.blockEngineUpdates(false)
 		b.authReconfig()
 		b.send(Notify{LoginFinished: &empty.Message{}})
@@ -261,6 +562,7 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 
 	prefs := b.prefs
 	stateKey := b.stateKey
+	userID := b.userID
 	netMap := b.netMap
 	interact := b.interact
 
@@ -276,6 +578,13 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 		prefsChanged = true
 	}
 	if st.NetMap != nil {
+		b.controlDERPMap = st.NetMap.DERPMap
+		if b.derpMapOverlay != nil {
+			nm := *st.NetMap
+			nm.DERPMap = derpmap.Merge(nm.DERPMap, b.derpMapOverlay)
+			st.NetMap = &nm
+		}
+		st.NetMap = b.applyLockLocked(st.NetMap)
 		b.setNetMapLocked(st.NetMap)
 
 	}
@@ -285,6 +594,7 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 	if b.state == NeedsLogin {
 		if !b.prefs.WantRunning {
 			prefsChanged = true
+			b.auditf(AuditPrefs, "WantRunning: false -> true (login needed)")
 		}
 		b.prefs.WantRunning = true
 	}
@@ -301,6 +611,8 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 			if err := b.store.WriteState(stateKey, prefs.ToBytes()); err != nil {
 				b.logf("Failed to save new controlclient state: %v", err)
 			}
+		} else {
+			b.saveFrontendPrefs(userID, prefs)
 		}
 		b.send(Notify{Prefs: prefs})
 	}
@@ -322,6 +634,7 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 		b.e.SetDERPMap(st.NetMap.DERPMap)
 
 		b.send(Notify{NetMap: st.NetMap})
+		b.sendPeerChanges()
 	}
 	if st.URL != "" {
 		b.logf("Received auth URL: %.20v...", st.URL)
@@ -332,7 +645,8 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 	b.stateMachine()
 	// This is currently (2020-07-28) necessary; conditionally disabling it is fragile!
 	// This is where netmap information gets propagated to router and magicsock.
-	b.authReconfig()
+	// It's debounced so a burst of netmaps from control only reconfigures once.
+	b.authReconfigSoon()
 }
 
 // setWgengineStatus is the callback by the wireguard engine whenever it posts a new status.
@@ -347,10 +661,13 @@ func (b *LocalBackend) setWgengineStatus(s *wgengine.Status, err error) {
 		return
 	}
 
+	b.observeTraffic(s)
+
 	b.mu.Lock()
 	es := b.parseWgStatusLocked(s)
 	c := b.c
 	b.engineStatus = es
+	b.lastEngineStatus = time.Now()
 	b.endpoints = append([]string{}, s.LocalAddrs...)
 	b.mu.Unlock()
 
@@ -364,6 +681,56 @@ func (b *LocalBackend) setWgengineStatus(s *wgengine.Status, err error) {
 	b.statusLock.Unlock()
 
 	b.send(Notify{Engine: &es})
+	b.sendPeerChanges()
+}
+
+// trafficPollInterval is how often the engine is asked for its
+// status, to keep traffic statistics current without a frontend
+// asking for it.
+const trafficPollInterval = time.Minute
+
+// pollTrafficStats requests the engine's status every
+// trafficPollInterval, until b is shut down.
+func (b *LocalBackend) pollTrafficStats() {
+	t := time.NewTicker(trafficPollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-t.C:
+			b.e.RequestStatus()
+		}
+	}
+}
+
+// observeTraffic records the peer and route byte counts in s in the
+// traffic statistics.
+func (b *LocalBackend) observeTraffic(s *wgengine.Status) {
+	peers := make(map[string]trafficstats.Counts, len(s.Peers))
+	for _, p := range s.Peers {
+		peers[p.NodeKey.String()] = trafficstats.Counts{
+			RxBytes: int64(p.RxBytes),
+			TxBytes: int64(p.TxBytes),
+		}
+	}
+	routes := make(map[string]trafficstats.Counts, len(s.Routes))
+	for _, r := range s.Routes {
+		routes[r.Route.String()] = trafficstats.Counts{
+			RxBytes: int64(r.RxBytes),
+			TxBytes: int64(r.TxBytes),
+		}
+	}
+	if err := b.traffic.Observe(time.Now(), peers, routes); err != nil {
+		b.logf("traffic stats: %v", err)
+	}
+}
+
+// TrafficStats returns the traffic to and from each peer, keyed by
+// node key, and through each advertised route over the last d, up to
+// trafficstats.Window.
+func (b *LocalBackend) TrafficStats(d time.Duration) trafficstats.Totals {
+	return b.traffic.Totals(time.Now(), d)
 }
 
 // Start applies the configuration specified in opts, and starts the
@@ -411,6 +778,10 @@ func (b *LocalBackend) Start(opts Options) error {
 	b.hostinfo = hostinfo
 	b.state = NoState
 
+	if opts.Prefs != nil && b.prefs != nil {
+		opts.Prefs = opts.Prefs.Clone()
+		opts.Prefs.ProxyURL = unredactProxyURL(opts.Prefs.ProxyURL, b.prefs.ProxyURL)
+	}
 	if err := b.loadStateLocked(opts.StateKey, opts.Prefs, opts.LegacyConfigPath); err != nil {
 		b.mu.Unlock()
 		return fmt.Errorf("loading requested state: %v", err)
@@ -418,7 +789,9 @@ func (b *LocalBackend) Start(opts Options) error {
 
 	b.inServerMode = b.prefs.ForceDaemon
 	b.serverURL = b.prefs.ControlURL
-	hostinfo.RoutableIPs = append(hostinfo.RoutableIPs, b.prefs.AdvertiseRoutes...)
+	b.setProxyFromPrefs(b.prefs)
+	b.startAutoUpdateLocked(b.prefs)
+	hostinfo.RoutableIPs = append(hostinfo.RoutableIPs, b.hostinfoRoutesLocked(b.prefs)...)
 	hostinfo.RequestTags = append(hostinfo.RequestTags, b.prefs.AdvertiseTags...)
 	if b.inServerMode || runtime.GOOS == "windows" {
 		b.logf("Start: serverMode=%v", b.inServerMode)
@@ -429,8 +802,18 @@ func (b *LocalBackend) Start(opts Options) error {
 	b.setNetMapLocked(nil)
 	persist := b.prefs.Persist
 	machinePrivKey := b.machinePrivKey
+	ephemeral := b.ephemeral
+	static := b.static
+	listenPort := b.prefs.ListenPort
+	lowResource := b.prefs.LowResource
+	epPrivacy := endpointPrivacy(b.prefs)
+	relayOnlyPeers := b.prefs.RelayOnlyPeers
 	b.mu.Unlock()
 
+	version.SetLowResource(lowResource)
+	b.e.SetListenPort(listenPort)
+	b.e.SetEndpointPrivacy(epPrivacy)
+	b.e.SetRelayOnlyPeers(relayOnlyPeers)
 	b.updateFilter(nil, nil)
 
 	if b.portpoll != nil {
@@ -466,7 +849,7 @@ func (b *LocalBackend) Start(opts Options) error {
 	}
 	cli, err := controlclient.New(controlclient.Options{
 		MachinePrivateKey: machinePrivKey,
-		Logf:              logger.WithPrefix(b.logf, "control: "),
+		Logf:              logger.WithPrefix(logger.Component(b.logf, "control"), "control: "),
 		Persist:           *persist,
 		ServerURL:         b.serverURL,
 		AuthKey:           opts.AuthKey,
@@ -476,6 +859,8 @@ func (b *LocalBackend) Start(opts Options) error {
 		HTTPTestClient:    opts.HTTPTestClient,
 		DiscoPublicKey:    discoPublic,
 		DebugFlags:        controlDebugFlags,
+		Ephemeral:         ephemeral,
+		Static:            static,
 	})
 	if err != nil {
 		return err
@@ -532,8 +917,23 @@ func (b *LocalBackend) updateFilter(netMap *controlclient.NetworkMap, prefs *Pre
 		addrs = netMap.Addresses
 		packetFilter = netMap.PacketFilter
 	}
+	b.mu.Lock()
 	if prefs != nil {
-		advRoutes = prefs.AdvertiseRoutes
+		advRoutes = b.advertiseRoutesLocked(prefs)
+	}
+	policy := b.policyFilter
+	b.mu.Unlock()
+	if policy != nil {
+		packetFilter = filter.Intersect(packetFilter, policy)
+	}
+	if hardening := hardeningRules(prefs, netMap); hardening != nil {
+		packetFilter = filter.Intersect(packetFilter, hardening)
+	}
+	// blockAll is whether shields are up with no exceptions.
+	blockAll := shieldsUp
+	if exceptions := shieldsUpRules(prefs, netMap); shieldsUp && exceptions != nil {
+		packetFilter = filter.Intersect(packetFilter, exceptions)
+		blockAll = false
 	}
 
 	changed := deepprint.UpdateHash(&b.filterHash, haveNetmap, addrs, packetFilter, advRoutes, shieldsUp)
@@ -543,20 +943,142 @@ func (b *LocalBackend) updateFilter(netMap *controlclient.NetworkMap, prefs *Pre
 
 	if !haveNetmap {
 		b.logf("netmap packet filter: (not ready yet)")
-		b.e.SetFilter(filter.NewAllowNone(b.logf))
+		b.e.SetFilter(filter.New(nil, nil, b.e.GetFilter(), b.logf))
 		return
 	}
 
 	localNets := wgCIDRsToNetaddr(netMap.Addresses, advRoutes)
 
-	if shieldsUp {
+	b.auditFilter(packetFilter, blockAll)
+
+	if prefs != nil && prefs.hardeningProfile() != HardeningNone {
+		b.logf("hardening profile: %s", prefs.hardeningProfile())
+	}
+
+	if blockAll {
 		b.logf("netmap packet filter: (shields up)")
 		var prevFilter *filter.Filter // don't reuse old filter state
-		b.e.SetFilter(filter.New(nil, localNets, prevFilter, b.logf))
+		b.e.SetFilter(filter.New(nil, localNets, prevFilter, logger.Component(b.logf, "filter")))
 	} else {
+		if shieldsUp {
+			b.logf("netmap packet filter: (shields up, with exceptions)")
+		}
 		b.logf("netmap packet filter: %v", packetFilter)
-		b.e.SetFilter(filter.New(packetFilter, localNets, b.e.GetFilter(), b.logf))
+		b.e.SetFilter(filter.New(packetFilter, localNets, b.e.GetFilter(), logger.Component(b.logf, "filter")))
+	}
+	b.send(Notify{PacketFilter: &FilterUpdate{Rules: packetFilter, ShieldsUp: shieldsUp}})
+}
+
+// SetPolicyFilter further restricts the incoming traffic the packet
+// filter allows to that also matched by rules, for when something
+// other than the tailnet's ACLs, such as Kubernetes NetworkPolicies,
+// governs what may reach this node. A nil rules lifts the restriction;
+// a non-nil empty one blocks all incoming traffic.
+func (b *LocalBackend) SetPolicyFilter(rules []filter.Match) {
+	b.mu.Lock()
+	b.policyFilter = rules
+	netMap := b.netMap
+	prefs := b.prefs
+	b.mu.Unlock()
+	b.updateFilter(netMap, prefs)
+}
+
+// PacketFilterMatches returns the rules of the packet filter in
+// effect, which are empty with shields up or before the first netmap.
+func (b *LocalBackend) PacketFilterMatches() []filter.Match {
+	f := b.e.GetFilter()
+	if f == nil {
+		return nil
 	}
+	return f.Matches()
+}
+
+// SetAutoRoutes sets routes to advertise in addition to those in
+// Prefs.AdvertiseRoutes, such as ones discovered from the environment
+// the node runs in. Unlike those in Prefs, they aren't persisted and
+// aren't replaced by a "tailscale up".
+func (b *LocalBackend) SetAutoRoutes(routes []wgcfg.CIDR) {
+	b.mu.Lock()
+	b.autoRoutes = append([]wgcfg.CIDR(nil), routes...)
+	if b.prefs == nil || b.hostinfo == nil {
+		b.mu.Unlock()
+		return
+	}
+	prefs := b.prefs.Clone()
+	netMap := b.netMap
+	newHi := b.hostinfo.Clone()
+	newHi.RoutableIPs = b.hostinfoRoutesLocked(b.prefs)
+	b.hostinfo = newHi
+	b.mu.Unlock()
+
+	b.doSetHostinfoFilterServices(newHi)
+	b.updateFilter(netMap, prefs)
+	b.authReconfig()
+}
+
+// SetRoutesStandby sets whether the node is a standby subnet router,
+// one of several nodes able to route the same subnets of which only
+// the primary advertises them. A standby keeps routing whatever
+// traffic still reaches it, so that connections through it drain
+// rather than break when it stops being primary.
+func (b *LocalBackend) SetRoutesStandby(standby bool) {
+	b.mu.Lock()
+	if b.routesStandby == standby {
+		b.mu.Unlock()
+		return
+	}
+	b.routesStandby = standby
+	if b.prefs == nil || b.hostinfo == nil {
+		b.mu.Unlock()
+		return
+	}
+	newHi := b.hostinfo.Clone()
+	newHi.RoutableIPs = b.hostinfoRoutesLocked(b.prefs)
+	b.hostinfo = newHi
+	b.mu.Unlock()
+
+	b.logf("SetRoutesStandby: %v", standby)
+	b.doSetHostinfoFilterServices(newHi)
+}
+
+// hostinfoRoutesLocked returns the routes to tell the control server
+// that the node routes with prefs p: none while it's a standby or
+// shutting down, and otherwise those of advertiseRoutesLocked.
+//
+// b.mu must be held.
+func (b *LocalBackend) hostinfoRoutesLocked(p *Prefs) []wgcfg.CIDR {
+	if b.routesStandby || b.shuttingDown {
+		return nil
+	}
+	return b.advertiseRoutesLocked(p)
+}
+
+// advertiseRoutesLocked returns the routes to advertise with prefs p:
+// p.AdvertiseRoutes and the automatic routes not among them, less
+// those withdrawn for failing their checks.
+//
+// b.mu must be held.
+func (b *LocalBackend) advertiseRoutesLocked(p *Prefs) []wgcfg.CIDR {
+	b.startRouteChecksLocked(p)
+	var ret []wgcfg.CIDR
+	for _, r := range p.AdvertiseRoutes {
+		if !b.routeWithdrawnLocked(r) {
+			ret = append(ret, r)
+		}
+	}
+	for _, r := range b.autoRoutes {
+		dup := false
+		for _, pr := range p.AdvertiseRoutes {
+			if pr == r {
+				dup = true
+				break
+			}
+		}
+		if !dup && !b.routeWithdrawnLocked(r) {
+			ret = append(ret, r)
+		}
+	}
+	return ret
 }
 
 // dnsCIDRsEqual determines whether two CIDR lists are equal
@@ -677,12 +1199,14 @@ func (b *LocalBackend) send(n Notify) {
 	notify := b.notify
 	b.mu.Unlock()
 
+	n.Version = version.Long
+	n.Prefs = n.Prefs.Redacted()
 	if notify != nil {
-		n.Version = version.Long
 		notify(n)
 	} else {
 		b.logf("nil notify callback; dropping %+v", n)
 	}
+	b.sendToWatchers(&n)
 }
 
 // popBrowserAuthNow shuts down the data plane and sends an auth URL
@@ -692,6 +1216,7 @@ func (b *LocalBackend) popBrowserAuthNow() {
 	url := b.authURL
 	b.interact = false
 	b.authURL = ""
+	b.loginURL = url
 	b.mu.Unlock()
 
 	b.logf("popBrowserAuthNow: url=%v", url != "")
@@ -832,6 +1357,7 @@ func (b *LocalBackend) loadStateLocked(key StateKey, prefs *Prefs, legacyPath st
 		// value instead of making up a new one.
 		b.logf("using frontend prefs: %s", prefs.Pretty())
 		b.prefs = prefs.Clone()
+		b.restoreFrontendLoginLocked()
 		if err := b.initMachineKeyLocked(); err != nil {
 			return fmt.Errorf("initMachineKeyLocked: %w", err)
 		}
@@ -861,6 +1387,12 @@ func (b *LocalBackend) loadStateLocked(key StateKey, prefs *Prefs, legacyPath st
 					b.prefs = NewPrefs()
 				} else {
 					b.logf("imported prefs from relaynode for %q: %v", key, b.prefs.Pretty())
+					// Save them right away, so that they're
+					// imported once, rather than on every
+					// start until something else saves them.
+					if err := b.store.WriteState(key, b.prefs.ToBytes()); err != nil {
+						b.logf("failed to save imported prefs: %v", err)
+					}
 				}
 			} else {
 				b.prefs = NewPrefs()
@@ -915,6 +1447,7 @@ func (b *LocalBackend) Login(token *oauth2.Token) {
 	c := b.c
 	b.mu.Unlock()
 
+	b.auditf(AuditLogin, "login with token started")
 	c.Login(token, controlclient.LoginInteractive)
 }
 
@@ -930,6 +1463,7 @@ func (b *LocalBackend) StartLoginInteractive() {
 	c := b.c
 	b.mu.Unlock()
 	b.logf("StartLoginInteractive: url=%v", url != "")
+	b.auditf(AuditLogin, "interactive login started")
 
 	if url != "" {
 		b.popBrowserAuthNow()
@@ -938,6 +1472,28 @@ func (b *LocalBackend) StartLoginInteractive() {
 	}
 }
 
+// StartLogin is StartLoginInteractive for frontends that may call it
+// before the backend has started, such as over the local API. The
+// auth URL shows up in LoginStatus, besides being sent to the
+// frontend.
+func (b *LocalBackend) StartLogin() error {
+	b.mu.Lock()
+	started := b.c != nil
+	b.mu.Unlock()
+	if !started {
+		return errors.New("backend not started")
+	}
+	b.StartLoginInteractive()
+	return nil
+}
+
+// LoginStatus returns the progress of logging in.
+func (b *LocalBackend) LoginStatus() LoginStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return LoginStatus{State: b.state.String(), AuthURL: b.loginURL}
+}
+
 // FakeExpireAfter implements Backend.
 func (b *LocalBackend) FakeExpireAfter(x time.Duration) {
 	b.logf("FakeExpireAfter: %v", x)
@@ -971,6 +1527,46 @@ func (b *LocalBackend) Ping(ipStr string) {
 	})
 }
 
+// PeerPath reports the known paths to the peer handling ip.
+func (b *LocalBackend) PeerPath(ip netaddr.IP) (*ipnstate.PeerPath, error) {
+	return b.e.PeerPath(ip)
+}
+
+// SetImpairments sets artificial packet loss and delay for the
+// traffic of the peers with the given Tailscale IPs, replacing any
+// set before. It's a debugging aid; the impairments don't survive a
+// restart of tailscaled.
+func (b *LocalBackend) SetImpairments(m map[netaddr.IP]tstun.Impairment) {
+	b.mu.Lock()
+	b.impairments = m
+	b.mu.Unlock()
+	b.e.SetImpairments(m)
+}
+
+// Impairments returns the impairments set by SetImpairments.
+func (b *LocalBackend) Impairments() map[netaddr.IP]tstun.Impairment {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.impairments
+}
+
+// SetShapes caps the bandwidth of the traffic sent to the given peer
+// Tailscale IPs or subnets, replacing any caps set before. Like
+// impairments, they don't survive a restart of tailscaled.
+func (b *LocalBackend) SetShapes(m map[netaddr.IPPrefix]tstun.Shape) {
+	b.mu.Lock()
+	b.shapes = m
+	b.mu.Unlock()
+	b.e.SetShapes(m)
+}
+
+// Shapes returns the bandwidth caps set by SetShapes.
+func (b *LocalBackend) Shapes() map[netaddr.IPPrefix]tstun.Shape {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.shapes
+}
+
 // parseWgStatusLocked returns an EngineStatus based on s.
 //
 // b.mu must be held; mostly because the caller is about to anyway, and doing so
@@ -1007,7 +1603,10 @@ func (b *LocalBackend) parseWgStatusLocked(s *wgengine.Status) (ret EngineStatus
 func (b *LocalBackend) shieldsAreUp() bool {
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	return b.shieldsAreUpLocked()
+}
 
+func (b *LocalBackend) shieldsAreUpLocked() bool {
 	if b.prefs == nil {
 		return true // default to safest setting
 	}
@@ -1020,6 +1619,13 @@ func (b *LocalBackend) SetCurrentUserID(uid string) {
 	b.mu.Unlock()
 }
 
+// Prefs returns a copy of the current prefs.
+func (b *LocalBackend) Prefs() *Prefs {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.prefs.Clone()
+}
+
 func (b *LocalBackend) SetWantRunning(wantRunning bool) {
 	b.mu.Lock()
 	new := b.prefs.Clone()
@@ -1046,14 +1652,17 @@ func (b *LocalBackend) SetPrefs(newp *Prefs) {
 
 	oldp := b.prefs
 	newp.Persist = oldp.Persist // caller isn't allowed to override this
+	newp.ProxyURL = unredactProxyURL(newp.ProxyURL, oldp.ProxyURL)
 	b.prefs = newp
 	b.inServerMode = newp.ForceDaemon
+	b.setProxyFromPrefs(newp)
+	b.startAutoUpdateLocked(newp)
 	// We do this to avoid holding the lock while doing everything else.
 	newp = b.prefs.Clone()
 
 	oldHi := b.hostinfo
 	newHi := oldHi.Clone()
-	newHi.RoutableIPs = append([]wgcfg.CIDR(nil), b.prefs.AdvertiseRoutes...)
+	newHi.RoutableIPs = b.hostinfoRoutesLocked(b.prefs)
 	applyPrefsToHostinfo(newHi, newp)
 	b.hostinfo = newHi
 	hostInfoChanged := !oldHi.Equal(newHi)
@@ -1068,6 +1677,10 @@ func (b *LocalBackend) SetPrefs(newp *Prefs) {
 	}
 	b.writeServerModeStartState(userID, newp)
 
+	if changes := prefsChanges(oldp, newp); len(changes) > 0 {
+		b.auditf(AuditPrefs, "%s", strings.Join(changes, "; "))
+	}
+
 	// [GRINDER STATS LINE] - please don't remove (used for log parsing)
 	b.logf("SetPrefs: %v", newp.Pretty())
 	if netMap != nil {
@@ -1089,6 +1702,19 @@ func (b *LocalBackend) SetPrefs(newp *Prefs) {
 		b.doSetHostinfoFilterServices(newHi)
 	}
 
+	if oldp.ListenPort != newp.ListenPort {
+		b.e.SetListenPort(newp.ListenPort)
+	}
+	if oldp.NoPrivateEndpoints != newp.NoPrivateEndpoints || !compareStrings(oldp.NoEndpointInterfaces, newp.NoEndpointInterfaces) {
+		b.e.SetEndpointPrivacy(endpointPrivacy(newp))
+	}
+	if !compareIPs(oldp.RelayOnlyPeers, newp.RelayOnlyPeers) {
+		b.e.SetRelayOnlyPeers(newp.RelayOnlyPeers)
+	}
+	if oldp.LowResource != newp.LowResource {
+		version.SetLowResource(newp.LowResource)
+	}
+
 	b.updateFilter(netMap, newp)
 
 	if netMap != nil {
@@ -1104,6 +1730,15 @@ func (b *LocalBackend) SetPrefs(newp *Prefs) {
 	b.send(Notify{Prefs: newp})
 }
 
+// endpointPrivacy returns the engine's endpoint privacy settings for
+// prefs.
+func endpointPrivacy(prefs *Prefs) magicsock.EndpointPrivacy {
+	return magicsock.EndpointPrivacy{
+		NoPrivate:    prefs.NoPrivateEndpoints,
+		NoInterfaces: prefs.NoEndpointInterfaces,
+	}
+}
+
 // doSetHostinfoFilterServices calls SetHostinfo on the controlclient,
 // possibly after mangling the given hostinfo.
 //
@@ -1119,6 +1754,11 @@ func (b *LocalBackend) doSetHostinfoFilterServices(hi *tailcfg.Hostinfo) {
 
 	b.mu.Lock()
 	cli := b.c
+	if !b.shieldsAreUpLocked() {
+		if peerAPI := b.peerAPIServicesLocked(); len(peerAPI) > 0 {
+			hi2.Services = append(hi2.Services[:len(hi2.Services):len(hi2.Services)], peerAPI...)
+		}
+	}
 	b.mu.Unlock()
 
 	// b.c might not be started yet
@@ -1146,6 +1786,52 @@ func (b *LocalBackend) blockEngineUpdates(block bool) {
 	b.mu.Unlock()
 }
 
+// setProxyFromPrefs makes control and DERP connections use the proxy
+// in p.ProxyURL, if any, instead of the environment's.
+func (b *LocalBackend) setProxyFromPrefs(p *Prefs) {
+	if p.ProxyURL == "" {
+		tshttpproxy.SetProxyOverride(nil)
+		return
+	}
+	u, err := url.Parse(p.ProxyURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		b.logf("ignoring invalid ProxyURL in prefs; using proxy from environment")
+		tshttpproxy.SetProxyOverride(nil)
+		return
+	}
+	tshttpproxy.SetProxyOverride(u)
+}
+
+// reconfigDebounce is how long authReconfigSoon waits for further
+// changes before reconfiguring.
+const reconfigDebounce = 250 * time.Millisecond
+
+// authReconfigSoon arranges for authReconfig to run within
+// reconfigDebounce. Calls made while one is already pending are
+// coalesced into it; authReconfig uses whatever state is current
+// when it runs.
+func (b *LocalBackend) authReconfigSoon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.authReconfigSoonLocked()
+}
+
+// authReconfigSoonLocked is authReconfigSoon with b.mu held.
+func (b *LocalBackend) authReconfigSoonLocked() {
+	if b.reconfigTimer != nil {
+		return
+	}
+	b.reconfigTimer = time.AfterFunc(reconfigDebounce, func() {
+		b.mu.Lock()
+		b.reconfigTimer = nil
+		b.mu.Unlock()
+		if b.ctx.Err() != nil {
+			return
+		}
+		b.authReconfig()
+	})
+}
+
 // authReconfig pushes a new configuration into wgengine, if engine
 // updates are not currently blocked, based on the cached netmap and
 // user prefs.
@@ -1153,6 +1839,10 @@ func (b *LocalBackend) authReconfig() {
 	b.mu.Lock()
 	blocked := b.blocked
 	uc := b.prefs
+	if len(b.autoRoutes) > 0 || len(b.routeFailures) > 0 {
+		uc = uc.Clone()
+		uc.AdvertiseRoutes = b.advertiseRoutesLocked(b.prefs)
+	}
 	nm := b.netMap
 	hasPAC := b.prevIfState.HasPAC()
 	disableSubnetsIfPAC := nm != nil && nm.Debug != nil && nm.Debug.DisableSubnetsIfPAC.EqualBool(true)
@@ -1171,7 +1861,15 @@ func (b *LocalBackend) authReconfig() {
 		return
 	}
 
+	wantExitNode := !uc.ExitNodeIP.IsZero() || uc.AutoExitNode
+	b.mu.Lock()
+	exitNode := b.exitNodeLocked(uc, nm)
+	b.mu.Unlock()
+
 	var flags controlclient.WGConfigFlags
+	if exitNode != nil {
+		flags |= controlclient.AllowDefaultRoute
+	}
 	if uc.RouteAll {
 		flags |= controlclient.AllowDefaultRoute
 		// TODO(apenwarr): Make subnet routes a different pref?
@@ -1192,8 +1890,29 @@ func (b *LocalBackend) authReconfig() {
 		b.logf("wgcfg: %v", err)
 		return
 	}
+	if wantExitNode {
+		onlyExitNodeDefaultRoute(cfg, exitNode)
+	}
+	setKeepAlives(cfg, uc)
 
 	rcfg := routerConfig(cfg, uc)
+	lanAccess := exitNode != nil && uc.ExitNodeAllowLANAccess
+	var lans []netaddr.IPPrefix
+	if uc.RouteAll || lanAccess {
+		lans = b.lanPrefixes()
+	}
+	if uc.AllowRoutesOverLAN {
+		setRouteConflictHealth(nil)
+	} else {
+		conflicts := keepLANsLocal(rcfg, lans)
+		if len(conflicts) > 0 {
+			b.logf("authReconfig: keeping local networks local: %s", strings.Join(conflicts, ", "))
+		}
+		setRouteConflictHealth(conflicts)
+	}
+	if lanAccess {
+		rcfg.LocalRoutes = append(rcfg.LocalRoutes, exitNodeLANRoutes(lans, rcfg.Routes, rcfg.LocalRoutes)...)
+	}
 
 	// If CorpDNS is false, rcfg.DNS remains the zero value.
 	if uc.CorpDNS {
@@ -1217,12 +1936,40 @@ func (b *LocalBackend) authReconfig() {
 	}
 
 	err = b.e.Reconfig(cfg, rcfg)
+	if err == nil || err == wgengine.ErrNoChanges {
+		b.initPeerAPIListeners()
+		b.mu.Lock()
+		b.reconfigured = true
+		b.peerRoutes = peerRoutes(cfg)
+		b.initSSHListenersLocked()
+		b.initServeListenersLocked()
+		b.mu.Unlock()
+	} else {
+		b.mu.Lock()
+		b.reconfigured = false
+		b.peerRoutes = nil
+		b.mu.Unlock()
+	}
 	if err == wgengine.ErrNoChanges {
 		return
 	}
 	b.logf("authReconfig: ra=%v dns=%v 0x%02x: %v", uc.RouteAll, uc.CorpDNS, flags, err)
 }
 
+// initPeerAPIListeners starts or updates the peer API listeners for
+// the current netmap and, if they changed, re-advertises them to
+// control via Hostinfo.
+func (b *LocalBackend) initPeerAPIListeners() {
+	b.mu.Lock()
+	changed := b.initPeerAPIListenersLocked()
+	hi := b.hostinfo
+	b.mu.Unlock()
+
+	if changed && hi != nil {
+		b.doSetHostinfoFilterServices(hi)
+	}
+}
+
 // domainsForProxying produces a list of search domains for proxied DNS.
 func domainsForProxying(nm *controlclient.NetworkMap) []string {
 	var domains []string
@@ -1267,6 +2014,10 @@ func routerConfig(cfg *wgcfg.Config, prefs *Prefs) *router.Config {
 		SNATSubnetRoutes: !prefs.NoSNAT,
 		NetfilterMode:    prefs.NetfilterMode,
 	}
+	if len(prefs.SplitTunnelApps) > 0 {
+		rs.SplitTunnelApps = append([]string(nil), prefs.SplitTunnelApps...)
+		rs.SplitTunnelExclude = prefs.SplitTunnelExclude
+	}
 
 	for _, peer := range cfg.Peers {
 		rs.Routes = append(rs.Routes, wgCIDRsToNetaddr(peer.AllowedIPs)...)
@@ -1276,6 +2027,7 @@ func routerConfig(cfg *wgcfg.Config, prefs *Prefs) *router.Config {
 		IP:   tsaddr.TailscaleServiceIP(),
 		Bits: 32,
 	})
+	rs.RouteMetrics = routeMetrics(rs.Routes, prefs.RouteMetrics)
 
 	return rs
 }
@@ -1318,6 +2070,9 @@ func (b *LocalBackend) enterState(newState State) {
 	b.mu.Lock()
 	state := b.state
 	b.state = newState
+	if newState == Starting || newState == Running {
+		b.loginURL = ""
+	}
 	prefs := b.prefs
 	notify := b.notify
 	bc := b.c
@@ -1342,6 +2097,11 @@ func (b *LocalBackend) enterState(newState State) {
 		b.blockEngineUpdates(true)
 		fallthrough
 	case Stopped:
+		b.mu.Lock()
+		b.closePeerAPIListenersLocked()
+		b.closeSSHListenersLocked()
+		b.closeServeListenersLocked()
+		b.mu.Unlock()
 		err := b.e.Reconfig(&wgcfg.Config{}, &router.Config{})
 		if err != nil {
 			b.logf("Reconfig(down): %v", err)
@@ -1462,9 +2222,14 @@ func (b *LocalBackend) requestEngineStatusAndWait() {
 func (b *LocalBackend) Logout() {
 	b.mu.Lock()
 	c := b.c
+	login := b.activeLogin
 	b.setNetMapLocked(nil)
 	b.mu.Unlock()
 
+	if login != "" {
+		b.auditf(AuditLogout, "logout of %s", login)
+	}
+
 	if c == nil {
 		// Double Logout can happen via repeated IPN
 		// connections to ipnserver making it repeatedly
@@ -1480,7 +2245,11 @@ func (b *LocalBackend) Logout() {
 
 	b.mu.Lock()
 	b.setNetMapLocked(nil)
+	userID, stateKey := b.userID, b.stateKey
 	b.mu.Unlock()
+	if stateKey == "" {
+		b.forgetFrontendLogin(userID)
+	}
 
 	b.stateMachine()
 }
@@ -1517,8 +2286,16 @@ func (b *LocalBackend) setNetMapLocked(nm *controlclient.NetworkMap) {
 		}
 	}
 	b.netMap = nm
+	if nm == nil {
+		b.reconfigured = false
+		b.peerRoutes = nil
+	}
+	b.updateKeyExpiryTimerLocked(nm)
 	if login != b.activeLogin {
 		b.logf("active login: %v", login)
+		if login != "" {
+			b.auditf(AuditLogin, "active login: %v", login)
+		}
 		b.activeLogin = login
 	}
 }
@@ -0,0 +1,118 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/tailcfg"
+	"tailscale.com/wgengine"
+)
+
+func TestAdvertiseRoutes(t *testing.T) {
+	cidrs := func(ss ...string) (ret []wgcfg.CIDR) {
+		for _, s := range ss {
+			c, err := wgcfg.ParseCIDR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ret = append(ret, c)
+		}
+		return ret
+	}
+	b := &LocalBackend{autoRoutes: cidrs("10.96.0.0/12", "192.168.1.0/24")}
+	p := NewPrefs()
+	p.AdvertiseRoutes = cidrs("192.168.1.0/24", "172.16.0.0/16")
+
+	got := fmt.Sprint(b.advertiseRoutesLocked(p))
+	if want := "[192.168.1.0/24 172.16.0.0/16 10.96.0.0/12]"; got != want {
+		t.Errorf("routes = %s; want %s", got, want)
+	}
+	if len(p.AdvertiseRoutes) != 2 {
+		t.Errorf("prefs modified: %v", p.AdvertiseRoutes)
+	}
+
+	// A standby still routes, but doesn't advertise.
+	b.routesStandby = true
+	if got := b.hostinfoRoutesLocked(p); len(got) != 0 {
+		t.Errorf("standby hostinfo routes = %v; want none", got)
+	}
+	if got := b.advertiseRoutesLocked(p); len(got) != 3 {
+		t.Errorf("standby routes = %v; want all 3", got)
+	}
+}
+
+func TestPeerRoutes(t *testing.T) {
+	cidrs := func(ss ...string) (ret []wgcfg.CIDR) {
+		for _, s := range ss {
+			c, err := wgcfg.ParseCIDR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ret = append(ret, c)
+		}
+		return ret
+	}
+	n := &tailcfg.Node{
+		Key:        tailcfg.NodeKey{1},
+		Addresses:  cidrs("100.64.0.2/32"),
+		AllowedIPs: cidrs("100.64.0.2/32", "10.0.0.0/8", "0.0.0.0/0"),
+		Hostinfo: tailcfg.Hostinfo{
+			RoutableIPs: cidrs("10.0.0.0/8", "0.0.0.0/0"),
+		},
+	}
+	cfg := &wgcfg.Config{Peers: []wgcfg.Peer{{
+		PublicKey:  wgcfg.Key(n.Key),
+		AllowedIPs: cidrs("100.64.0.2/32", "10.0.0.0/8"),
+	}}}
+	b := &LocalBackend{peerRoutes: peerRoutes(cfg)}
+	advertised, accepted := b.peerRoutesLocked(n)
+	if got, want := fmt.Sprint(advertised), "[10.0.0.0/8 0.0.0.0/0]"; got != want {
+		t.Errorf("advertised = %s; want %s", got, want)
+	}
+	if got, want := fmt.Sprint(accepted), "[10.0.0.0/8]"; got != want {
+		t.Errorf("accepted = %s; want %s", got, want)
+	}
+
+	n.Key = tailcfg.NodeKey{2}
+	if _, accepted := b.peerRoutesLocked(n); accepted != nil {
+		t.Errorf("accepted for peer not in config = %v; want none", accepted)
+	}
+}
+
+func TestLoginStatus(t *testing.T) {
+	e, err := wgengine.NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewLocalBackend(t.Logf, "logid", &MemoryStore{cache: make(map[StateKey][]byte)}, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	if err := b.StartLogin(); err == nil {
+		t.Error("StartLogin before Start succeeded")
+	}
+	if got := b.LoginStatus(); got != (LoginStatus{State: "NoState"}) {
+		t.Errorf("before login: %+v", got)
+	}
+
+	const url = "https://login.example.com/a/123"
+	b.mu.Lock()
+	b.state = NeedsLogin
+	b.loginURL = url
+	b.mu.Unlock()
+	if got := b.LoginStatus(); got != (LoginStatus{State: "NeedsLogin", AuthURL: url}) {
+		t.Errorf("needing login: %+v", got)
+	}
+
+	b.enterState(Running)
+	if got := b.LoginStatus(); got != (LoginStatus{State: "Running"}) {
+		t.Errorf("logged in: %+v", got)
+	}
+}
@@ -0,0 +1,943 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package localapi contains the HTTP handlers for tailscaled's local
+// API, which frontends such as the CLI reach over the same socket as
+// the IPN protocol.
+package localapi
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/health"
+	"tailscale.com/ipn"
+	"tailscale.com/log/auditlog"
+	"tailscale.com/logpolicy"
+	"tailscale.com/net/trafficstats"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tka"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/filter/acltest"
+	"tailscale.com/wgengine/tstun"
+)
+
+// NewHandler returns a new Handler serving the local API for b.
+func NewHandler(b *ipn.LocalBackend, logf logger.Logf) *Handler {
+	return &Handler{b: b, logf: logf}
+}
+
+// Handler is an http.Handler for the local API, rooted at
+// "/localapi/".
+type Handler struct {
+	// PermitRead is whether read-only HTTP handlers are allowed.
+	PermitRead bool
+
+	// PermitWrite is whether mutating HTTP handlers are allowed.
+	PermitWrite bool
+
+	// Token, if non-empty, is a secret that grants requests bearing
+	// it in an "Authorization: Bearer" header read and write access
+	// regardless of PermitRead and PermitWrite, for frontends such as
+	// GUIs running as users who otherwise only get read access.
+	Token string
+
+	// LogPolicy, if non-nil, is tailscaled's log policy, whose
+	// uploading the log-upload handler reports and changes.
+	LogPolicy *logpolicy.Policy
+
+	b    *ipn.LocalBackend
+	logf logger.Logf
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.b == nil {
+		http.Error(w, "server has no local backend", http.StatusInternalServerError)
+		return
+	}
+	if r.Referer() != "" || r.Header.Get("Origin") != "" {
+		// The local API is for local programs, not web pages a
+		// local browser happens to be visiting.
+		http.Error(w, "invalid localapi request", http.StatusForbidden)
+		return
+	}
+	if !h.PermitWrite && h.validToken(r) {
+		h2 := *h
+		h2.PermitRead, h2.PermitWrite = true, true
+		h = &h2
+	}
+	if !h.PermitRead {
+		http.Error(w, "localapi access denied", http.StatusForbidden)
+		return
+	}
+	switch {
+	case r.URL.Path == "/localapi/v0/status":
+		h.serveStatus(w, r)
+	case r.URL.Path == "/localapi/v0/health":
+		h.serveHealth(w, r)
+	case r.URL.Path == "/localapi/v0/watch-ipn-bus":
+		h.serveWatchIPNBus(w, r)
+	case r.URL.Path == "/localapi/v0/derpmap":
+		h.serveDERPMap(w, r)
+	case r.URL.Path == "/localapi/v0/peer-path":
+		h.servePeerPath(w, r)
+	case r.URL.Path == "/localapi/v0/debug-impairments":
+		h.serveImpairments(w, r)
+	case r.URL.Path == "/localapi/v0/shaping":
+		h.serveShaping(w, r)
+	case r.URL.Path == "/localapi/v0/debug-capture":
+		h.serveCapture(w, r)
+	case r.URL.Path == "/localapi/v0/conn-events":
+		h.serveConnEvents(w, r)
+	case r.URL.Path == "/localapi/v0/log-levels":
+		h.serveLogLevels(w, r)
+	case r.URL.Path == "/localapi/v0/log-upload":
+		h.serveLogUpload(w, r)
+	case r.URL.Path == "/localapi/v0/audit-log":
+		h.serveAuditLog(w, r)
+	case r.URL.Path == "/localapi/v0/traffic-stats":
+		h.serveTrafficStats(w, r)
+	case r.URL.Path == "/localapi/v0/whois":
+		h.serveWhoIs(w, r)
+	case r.URL.Path == "/localapi/v0/login-interactive":
+		h.serveLoginInteractive(w, r)
+	case r.URL.Path == "/localapi/v0/login-status":
+		h.serveLoginStatus(w, r)
+	case r.URL.Path == "/localapi/v0/prefs":
+		h.servePrefs(w, r)
+	case r.URL.Path == "/localapi/v0/serve-config":
+		h.serveServeConfig(w, r)
+	case r.URL.Path == "/localapi/v0/acl-test":
+		h.serveACLTest(w, r)
+	case r.URL.Path == "/localapi/v0/lock-status":
+		h.serveLockStatus(w, r)
+	case r.URL.Path == "/localapi/v0/lock-init":
+		h.serveLockInit(w, r)
+	case r.URL.Path == "/localapi/v0/lock-sign":
+		h.serveLockSign(w, r)
+	case strings.HasPrefix(r.URL.Path, "/localapi/v0/cert/"):
+		h.serveCert(w, r)
+	case r.URL.Path == "/localapi/v0/file-targets":
+		h.serveFileTargets(w, r)
+	case strings.HasPrefix(r.URL.Path, "/localapi/v0/files/"):
+		h.serveFiles(w, r)
+	case strings.HasPrefix(r.URL.Path, "/localapi/v0/file-put/"):
+		h.serveFilePut(w, r)
+	default:
+		http.Error(w, "404 not found", http.StatusNotFound)
+	}
+}
+
+// validToken reports whether r bears h.Token.
+func (h *Handler) validToken(r *http.Request) bool {
+	if h.Token == "" {
+		return false
+	}
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, prefix)), []byte(h.Token)) == 1
+}
+
+func (h *Handler) serveStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, h.b.Status())
+}
+
+// serveHealth serves the node's health as JSON health.Status.
+func (h *Handler) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, health.Get())
+}
+
+// serveWatchIPNBus streams the backend's notifications, as JSON
+// ipn.Notify objects one per line, until the client goes away. The
+// first is of the current state and engine status; after that come
+// changes to them, peers coming online, going offline or changing
+// paths, packet filter updates, and the rest.
+//
+// Network maps aren't included, nor are the keys and proxy password
+// in prefs.
+func (h *Handler) serveWatchIPNBus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	h.b.WatchNotifications(ctx, func(n *ipn.Notify) {
+		if n.NetMap != nil {
+			// Network maps are sent alone, and what watchers
+			// want of them follows as PeerChanges.
+			return
+		}
+		if n.Prefs != nil {
+			n2 := *n
+			n2.Prefs = n.Prefs.Clone()
+			n2.Prefs.Persist = nil
+			n = &n2
+		}
+		if err := enc.Encode(n); err != nil {
+			cancel()
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+}
+
+// serveDERPMap serves the DERP map the node got from its control
+// server, or JSON null if it has none yet.
+func (h *Handler) serveDERPMap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	var dm *tailcfg.DERPMap
+	if nm := h.b.NetMap(); nm != nil {
+		dm = nm.DERPMap
+	}
+	writeJSON(w, dm)
+}
+
+// servePeerPath serves the known paths to the peer handling the IP
+// in the "ip" query parameter, as JSON ipnstate.PeerPath.
+func (h *Handler) servePeerPath(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	ip, err := netaddr.ParseIP(r.FormValue("ip"))
+	if err != nil {
+		http.Error(w, "invalid or missing ip parameter", http.StatusBadRequest)
+		return
+	}
+	pp, err := h.b.PeerPath(ip)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, pp)
+}
+
+// serveImpairments serves the artificial packet loss and delay applied
+// to peers' traffic for debugging, as a JSON object from peer
+// Tailscale IPs to tstun.Impairment:
+//
+//	GET /localapi/v0/debug-impairments   the current impairments
+//	POST /localapi/v0/debug-impairments  replace them with the JSON body
+//
+// POSTing an empty object removes all impairments.
+func (h *Handler) serveImpairments(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		m := map[string]tstun.Impairment{}
+		for ip, imp := range h.b.Impairments() {
+			m[ip.String()] = imp
+		}
+		writeJSON(w, m)
+	case "POST":
+		if !h.PermitWrite {
+			http.Error(w, "impairments access denied", http.StatusForbidden)
+			return
+		}
+		var in map[string]tstun.Impairment
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		m := make(map[netaddr.IP]tstun.Impairment, len(in))
+		for s, imp := range in {
+			ip, err := netaddr.ParseIP(s)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid IP %q", s), http.StatusBadRequest)
+				return
+			}
+			if imp.LossPercent < 0 || imp.LossPercent > 100 || imp.DelayMS < 0 {
+				http.Error(w, fmt.Sprintf("invalid impairment for %v", ip), http.StatusBadRequest)
+				return
+			}
+			m[ip] = imp
+		}
+		h.b.SetImpairments(m)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "want GET or POST", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveShaping serves the bandwidth caps on the traffic sent to peers
+// and subnets, as a JSON object from peer Tailscale IPs or subnet
+// CIDRs to tstun.Shape:
+//
+//	GET /localapi/v0/shaping   the current caps
+//	POST /localapi/v0/shaping  replace them with the JSON body
+//
+// For example, {"10.2.0.0/16": {"Kbps": 50000}} caps the traffic to a
+// remote site's subnet at 50 Mbps. POSTing an empty object removes
+// all caps.
+func (h *Handler) serveShaping(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		m := map[string]tstun.Shape{}
+		for pfx, s := range h.b.Shapes() {
+			m[pfx.String()] = s
+		}
+		writeJSON(w, m)
+	case "POST":
+		if !h.PermitWrite {
+			http.Error(w, "shaping access denied", http.StatusForbidden)
+			return
+		}
+		var in map[string]tstun.Shape
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		m := make(map[netaddr.IPPrefix]tstun.Shape, len(in))
+		for k, s := range in {
+			pfx, err := parseIPOrPrefix(k)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid IP or CIDR %q", k), http.StatusBadRequest)
+				return
+			}
+			if s.Kbps <= 0 || s.BurstBytes < 0 {
+				http.Error(w, fmt.Sprintf("invalid shape for %v", pfx), http.StatusBadRequest)
+				return
+			}
+			m[pfx] = s
+		}
+		h.b.SetShapes(m)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "want GET or POST", http.StatusMethodNotAllowed)
+	}
+}
+
+// parseIPOrPrefix parses a CIDR prefix, or an IP address as the
+// prefix of just it.
+func parseIPOrPrefix(s string) (netaddr.IPPrefix, error) {
+	if strings.Contains(s, "/") {
+		return netaddr.ParseIPPrefix(s)
+	}
+	ip, err := netaddr.ParseIP(s)
+	if err != nil {
+		return netaddr.IPPrefix{}, err
+	}
+	bits := uint8(32)
+	if ip.Is6() {
+		bits = 128
+	}
+	return netaddr.IPPrefix{IP: ip, Bits: bits}, nil
+}
+
+// serveCapture streams a pcapng capture of the decrypted tailnet
+// traffic passing through the TUN device until the client hangs up:
+//
+//	GET /localapi/v0/debug-capture
+//
+// Packets are captured both before and after the packet filter, with
+// a comment on each saying which. The capture includes the contents
+// of all traffic, so it needs write access.
+func (h *Handler) serveCapture(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.PermitWrite {
+		http.Error(w, "capture access denied", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pcapng")
+	if err := h.b.StreamCapture(r.Context(), w); err != nil {
+		h.logf("capture: %v", err)
+	}
+}
+
+// serveConnEvents streams the new inbound connections that the packet
+// filter accepts, as JSON ipn.ConnEvent objects one per line, until
+// the client goes away. It's meant for feeding intrusion detection
+// and SIEM systems without capturing packets.
+func (h *Handler) serveConnEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.PermitWrite {
+		http.Error(w, "connection events access denied", http.StatusForbidden)
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "application/json")
+	if flusher != nil {
+		flusher.Flush()
+	}
+	enc := json.NewEncoder(w)
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	h.b.WatchConns(ctx, func(ev ipn.ConnEvent) {
+		if err := enc.Encode(ev); err != nil {
+			cancel()
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+}
+
+// serveLogLevels serves the levels of tailscaled's logging
+// components, such as "filter" and "magicsock", as a JSON object from
+// component names to "off", "info" or "debug":
+//
+//	GET /localapi/v0/log-levels   the current levels
+//	POST /localapi/v0/log-levels  set the levels of the components in the JSON body
+//
+// Levels go back to "info" when tailscaled restarts.
+func (h *Handler) serveLogLevels(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, logger.Levels())
+	case "POST":
+		if !h.PermitWrite {
+			http.Error(w, "log level access denied", http.StatusForbidden)
+			return
+		}
+		var in map[string]logger.Level
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		known := logger.Levels()
+		for name := range in {
+			if _, ok := known[name]; !ok {
+				http.Error(w, fmt.Sprintf("unknown log component %q", name), http.StatusBadRequest)
+				return
+			}
+		}
+		for name, l := range in {
+			if err := logger.SetLevel(name, l); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			h.logf("log level of %s set to %v", name, l)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "want GET or POST", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveLogUpload serves whether tailscaled uploads its logs, as JSON
+// ipn.LogUploadState:
+//
+//	GET /localapi/v0/log-upload   the current state
+//	POST /localapi/v0/log-upload  set Disabled from the JSON body
+//
+// Disabling takes effect immediately and logs then only go to the
+// local destinations; re-enabling takes effect on restart. Both are
+// remembered across restarts.
+func (h *Handler) serveLogUpload(w http.ResponseWriter, r *http.Request) {
+	if h.LogPolicy == nil {
+		http.Error(w, "no log policy", http.StatusNotImplemented)
+		return
+	}
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if !h.PermitWrite {
+			http.Error(w, "log upload access denied", http.StatusForbidden)
+			return
+		}
+		var in ipn.LogUploadState
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.LogPolicy.SetUploadDisabled(in.Disabled); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		h.logf("log upload disabled set to %v", in.Disabled)
+	default:
+		http.Error(w, "want GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, ipn.LogUploadState{
+		Uploading: h.LogPolicy.Uploading(),
+		Disabled:  h.LogPolicy.UploadDisabled(),
+	})
+}
+
+// serveAuditLog serves the entries of the audit log of configuration
+// and policy changes as a JSON array of auditlog.Entry, oldest first.
+// The optional "since" query parameter limits them to those with a
+// greater Seq.
+func (h *Handler) serveAuditLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.PermitWrite {
+		http.Error(w, "audit log access denied", http.StatusForbidden)
+		return
+	}
+	var since int64
+	if v := r.FormValue("since"); v != "" {
+		var err error
+		since, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid since parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	ents, err := h.b.AuditLog(since)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if ents == nil {
+		ents = []auditlog.Entry{}
+	}
+	writeJSON(w, ents)
+}
+
+// serveTrafficStats serves the bytes sent to and received from each
+// peer, keyed by node key, and through each route this node
+// advertises, as JSON trafficstats.Totals. The optional "since" query
+// parameter, a duration such as "1h", limits them to that span
+// before now; the default is the whole day kept.
+func (h *Handler) serveTrafficStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	d := trafficstats.Window
+	if v := r.FormValue("since"); v != "" {
+		var err error
+		d, err = time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid since parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, h.b.TrafficStats(d))
+}
+
+// serveWhoIs serves the identity of the peer at the address in the
+// addr parameter, "ip:port" or just "ip", such as the remote address
+// of a connection from the tailnet: JSON ipn.Peer, whose Node has the
+// peer's ACL tags. It's for identity-aware proxies and other services
+// on the node.
+func (h *Handler) serveWhoIs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	v := r.FormValue("addr")
+	ipp, err := netaddr.ParseIPPort(v)
+	if err != nil {
+		ip, err := netaddr.ParseIP(v)
+		if err != nil {
+			http.Error(w, "invalid addr parameter", http.StatusBadRequest)
+			return
+		}
+		ipp = netaddr.IPPort{IP: ip}
+	}
+	n, u, ok := h.b.WhoIs(ipp.IP)
+	if !ok {
+		http.Error(w, "no peer at that address", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, ipn.Peer{Addr: ipp, Node: n, User: u})
+}
+
+// serveLoginInteractive starts an interactive login, or picks up the
+// one in progress. The auth URL to visit shows up in login-status.
+func (h *Handler) serveLoginInteractive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "want POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.PermitWrite {
+		http.Error(w, "login access denied", http.StatusForbidden)
+		return
+	}
+	if err := h.b.StartLogin(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, h.b.LoginStatus())
+}
+
+// serveLoginStatus serves the progress of logging in as a JSON
+// ipn.LoginStatus.
+func (h *Handler) serveLoginStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, h.b.LoginStatus())
+}
+
+// servePrefs serves the node's preferences:
+//
+//	GET /localapi/v0/prefs   JSON ipn.Prefs
+//	POST /localapi/v0/prefs  replace them with the JSON body
+//
+// The Persist field, which holds the node's keys, is never returned
+// and is never changed by a POST. Nor is the proxy password, which a
+// POST of the same ProxyURL without it keeps.
+func (h *Handler) servePrefs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, h.prefsWithoutPersist())
+	case "POST":
+		if !h.PermitWrite {
+			http.Error(w, "prefs access denied", http.StatusForbidden)
+			return
+		}
+		p := new(ipn.Prefs)
+		if err := json.NewDecoder(r.Body).Decode(p); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		h.b.SetPrefs(p)
+		writeJSON(w, h.prefsWithoutPersist())
+	default:
+		http.Error(w, "want GET or POST", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) prefsWithoutPersist() *ipn.Prefs {
+	p := h.b.Prefs().Redacted()
+	p.Persist = nil
+	return p
+}
+
+// serveServeConfig serves the configuration of the services this
+// node publishes to its tailnet:
+//
+//	GET /localapi/v0/serve-config   JSON ipn.ServeConfig
+//	POST /localapi/v0/serve-config  replace it with the JSON body
+func (h *Handler) serveServeConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, h.b.ServeConfig())
+	case "POST":
+		if !h.PermitWrite {
+			http.Error(w, "serve config access denied", http.StatusForbidden)
+			return
+		}
+		sc := new(ipn.ServeConfig)
+		if err := json.NewDecoder(r.Body).Decode(sc); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if err := h.b.SetServeConfig(sc); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "want GET or POST", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveACLTest runs the ACL tests in the JSON body, as parsed by
+// acltest.Parse, against the node's packet filter, serving the checks
+// that failed as a JSON []acltest.Failure.
+func (h *Handler) serveACLTest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "want POST", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tests, err := acltest.Parse(body)
+	if err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	failures, err := acltest.Run(h.b.PacketFilterMatches(), tests)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if failures == nil {
+		failures = []acltest.Failure{}
+	}
+	writeJSON(w, failures)
+}
+
+// serveLockStatus serves the state of network lock as JSON
+// ipn.NetworkLockStatus.
+func (h *Handler) serveLockStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, h.b.NetworkLockStatus())
+}
+
+// serveLockInit enables network lock, trusting the keys in the JSON
+// body {"Keys": ["tlpub:..."]}.
+func (h *Handler) serveLockInit(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "network lock access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct{ Keys []tka.Key }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := h.b.NetworkLockInit(req.Keys); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveLockSign signs the node key in the JSON body
+// {"NodeKey": "nodekey:..."} with the node's network lock signing key,
+// serving {"Signature": "..."}.
+func (h *Handler) serveLockSign(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "network lock access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct{ NodeKey tailcfg.NodeKey }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	sig, err := h.b.NetworkLockSign(r.Context(), req.NodeKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, struct{ Signature string }{sig})
+}
+
+// serveCert serves a TLS certificate for one of the node's DNS names:
+//
+//	GET /localapi/v0/cert/<domain>?type=pair  key and certificate PEM
+//	GET /localapi/v0/cert/<domain>?type=cert  certificate PEM only
+//	GET /localapi/v0/cert/<domain>?type=key   key PEM only
+func (h *Handler) serveCert(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		// Private keys need more than read access.
+		http.Error(w, "cert access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	domain := strings.TrimPrefix(r.URL.Path, "/localapi/v0/cert/")
+	if domain == "" || strings.Contains(domain, "/") {
+		http.Error(w, "bad domain", http.StatusBadRequest)
+		return
+	}
+	certPEM, keyPEM, err := h.b.GetCertPEM(r.Context(), domain)
+	if err != nil {
+		h.logf("localapi: cert for %q: %v", domain, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	switch r.FormValue("type") {
+	case "", "pair":
+		w.Write(keyPEM)
+		w.Write(certPEM)
+	case "cert":
+		w.Write(certPEM)
+	case "key":
+		w.Write(keyPEM)
+	default:
+		http.Error(w, `invalid type; want "pair", "cert" or "key"`, http.StatusBadRequest)
+	}
+}
+
+func (h *Handler) serveFileTargets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	fts, err := h.b.FileTargets()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if fts == nil {
+		fts = []*ipn.FileTarget{}
+	}
+	writeJSON(w, fts)
+}
+
+// serveFiles serves the inbox of received files:
+//
+//	GET /localapi/v0/files/        JSON list of ipn.WaitingFile
+//	GET /localapi/v0/files/<name>  contents of the file
+//	DELETE /localapi/v0/files/<name>
+func (h *Handler) serveFiles(w http.ResponseWriter, r *http.Request) {
+	suffix := strings.TrimPrefix(r.URL.EscapedPath(), "/localapi/v0/files/")
+	if suffix == "" {
+		if r.Method != "GET" {
+			http.Error(w, "want GET", http.StatusMethodNotAllowed)
+			return
+		}
+		wfs, err := h.b.WaitingFiles()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if wfs == nil {
+			wfs = []ipn.WaitingFile{}
+		}
+		writeJSON(w, wfs)
+		return
+	}
+	name, err := url.PathUnescape(suffix)
+	if err != nil {
+		http.Error(w, "bad filename", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		rc, size, err := h.b.OpenFile(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		defer rc.Close()
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.Copy(w, rc)
+	case "DELETE":
+		if !h.PermitWrite {
+			http.Error(w, "file access denied", http.StatusForbidden)
+			return
+		}
+		if err := h.b.DeleteFile(name); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "want GET or DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveFilePut proxies a file transfer to a peer's peer API:
+//
+//	GET /localapi/v0/file-put/<peer-ip>/<name>  JSON ipn.PartialFile
+//	PUT /localapi/v0/file-put/<peer-ip>/<name>?offset=N&sha256=H
+//
+// The peer must be one of the FileTargets.
+func (h *Handler) serveFilePut(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "file access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" && r.Method != "PUT" {
+		http.Error(w, "want GET or PUT", http.StatusMethodNotAllowed)
+		return
+	}
+	rest := strings.TrimPrefix(r.URL.EscapedPath(), "/localapi/v0/file-put/")
+	i := strings.Index(rest, "/")
+	if i == -1 {
+		http.Error(w, "bad URL; want /localapi/v0/file-put/<peer-ip>/<name>", http.StatusBadRequest)
+		return
+	}
+	ip, err := netaddr.ParseIP(rest[:i])
+	if err != nil {
+		http.Error(w, "bad peer IP", http.StatusBadRequest)
+		return
+	}
+	escapedName := rest[i+1:]
+	fts, err := h.b.FileTargets()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var ft *ipn.FileTarget
+	for _, cand := range fts {
+		if strings.HasPrefix(cand.PeerAPIURL, "http://"+ip.String()+":") {
+			ft = cand
+			break
+		}
+	}
+	if ft == nil {
+		http.Error(w, "not a file target", http.StatusNotFound)
+		return
+	}
+
+	u := ft.PeerAPIURL + "/v0/put/" + escapedName
+	if q := r.URL.RawQuery; q != "" {
+		u += "?" + q
+	}
+	outReq, err := http.NewRequestWithContext(r.Context(), r.Method, u, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Method == "PUT" {
+		outReq.Body = r.Body
+		outReq.ContentLength = r.ContentLength
+	}
+	res, err := http.DefaultClient.Do(outReq)
+	if err != nil {
+		h.logf("localapi: file-put to %v: %v", ft.Node.Name, err)
+		http.Error(w, fmt.Sprintf("sending to peer: %v", err), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	w.WriteHeader(res.StatusCode)
+	io.Copy(w, res.Body)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(v)
+}
@@ -0,0 +1,294 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"tailscale.com/atomicfile"
+	"tailscale.com/control/controlclient"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tka"
+)
+
+// Files under the TailscaleVarRoot holding network lock state.
+const (
+	lockStateFile = "tka-state.json" // the authority's chain of AUMs
+	lockKeyFile   = "tka-key"        // this node's signing key
+)
+
+// NetworkLockStatus is the state of network lock on a node.
+type NetworkLockStatus struct {
+	// Enabled is whether the node only accepts peers whose node
+	// keys are signed by a trusted key.
+	Enabled bool
+
+	// Head is the hash of the last authority update applied, and
+	// TrustedKeys the keys trusted after it, if Enabled.
+	Head        string    `json:",omitempty"`
+	TrustedKeys []tka.Key `json:",omitempty"`
+
+	// PublicKey is this node's signing key, which signs other
+	// nodes' keys with "tailscale lock sign" once it's trusted. It's
+	// the zero key if the node has no TailscaleVarRoot to keep it in.
+	PublicKey tka.Key
+
+	// NodeKey is this node's node key, and NodeKeySigned whether
+	// it's signed by a trusted key, so that locked peers accept it.
+	NodeKey       tailcfg.NodeKey
+	NodeKeySigned bool
+
+	// Error, if non-empty, is why the saved network lock state
+	// couldn't be loaded, which refuses all peers.
+	Error string `json:",omitempty"`
+
+	// Rejected are the peers refused for lack of a valid signature.
+	Rejected []RejectedPeer `json:",omitempty"`
+}
+
+// RejectedPeer is a peer that network lock refuses to connect to.
+type RejectedPeer struct {
+	Name    string
+	NodeKey tailcfg.NodeKey
+	Reason  string
+}
+
+// loadLockLocked loads the network lock state kept in dir, if any.
+//
+// b.mu must be held.
+func (b *LocalBackend) loadLockLocked(dir string) {
+	a, err := tka.Load(filepath.Join(dir, lockStateFile))
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		// Failing open would silently drop the lock, so instead
+		// refuse all peers until it's fixed.
+		b.logf("network lock: %v; refusing all peers", err)
+		b.lockErr = err
+		return
+	}
+	b.lock = a
+	b.logf("network lock: enabled at %v with %d trusted keys", a.Head(), len(a.Keys()))
+}
+
+// applyLockLocked syncs the network lock authority with the updates
+// in nm and returns nm without the peers it refuses.
+//
+// b.mu must be held.
+func (b *LocalBackend) applyLockLocked(nm *controlclient.NetworkMap) *controlclient.NetworkMap {
+	b.lockPeers = nm.Peers
+	if b.lock == nil && b.lockErr == nil {
+		return nm
+	}
+	if b.lock != nil {
+		b.syncLockLocked(nm.KeyAuthority)
+	}
+	ret := *nm
+	ret.Peers = b.lockFilterLocked(nm.Peers)
+	return &ret
+}
+
+// syncLockLocked applies the authority updates in chain, in their
+// encoded form, that the authority hasn't yet, saving it if any.
+//
+// b.mu must be held.
+func (b *LocalBackend) syncLockLocked(chain []string) {
+	aums := make([]tka.AUM, 0, len(chain))
+	for _, s := range chain {
+		u, err := tka.DecodeAUM(s)
+		if err != nil {
+			b.logf("network lock: %v", err)
+			break
+		}
+		aums = append(aums, u)
+	}
+	n, err := b.lock.Sync(aums)
+	if err != nil {
+		b.logf("network lock: ignoring update: %v", err)
+	}
+	if n == 0 {
+		return
+	}
+	b.logf("network lock: applied %d updates; head %v, %d trusted keys", n, b.lock.Head(), len(b.lock.Keys()))
+	b.auditf(AuditLock, "applied %d updates; trusted keys: %v", n, b.lock.Keys())
+	if err := b.lock.Save(filepath.Join(b.varRoot, lockStateFile)); err != nil {
+		b.logf("network lock: %v", err)
+	}
+}
+
+// lockFilterLocked returns the peers whose node keys are signed by
+// a trusted key, recording the others in b.lockRejected. If the
+// saved state failed to load, it returns none.
+//
+// b.mu must be held.
+func (b *LocalBackend) lockFilterLocked(peers []*tailcfg.Node) []*tailcfg.Node {
+	ret := make([]*tailcfg.Node, 0, len(peers))
+	rejected := make(map[tailcfg.NodeKey]string)
+	for _, p := range peers {
+		err := b.lockErr
+		if err == nil {
+			err = b.lock.VerifyNodeKey(p.Key, p.KeySignature)
+		}
+		if err == nil {
+			ret = append(ret, p)
+			continue
+		}
+		rejected[p.Key] = err.Error()
+		if _, ok := b.lockRejected[p.Key]; !ok {
+			b.logf("network lock: refusing peer %v (%s): %v", p.Key.ShortString(), p.Name, err)
+		}
+	}
+	b.lockRejected = rejected
+	return ret
+}
+
+// NetworkLockStatus returns the state of network lock.
+func (b *LocalBackend) NetworkLockStatus() *NetworkLockStatus {
+	key, err := b.lockKey()
+	if err != nil {
+		b.logf("network lock: %v", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := new(NetworkLockStatus)
+	if key != nil {
+		st.PublicKey = tka.PublicKey(key)
+	}
+	if nm := b.netMap; nm != nil {
+		st.NodeKey = nm.NodeKey
+	}
+	if b.lockErr != nil {
+		st.Enabled = true
+		st.Error = b.lockErr.Error()
+	}
+	if b.lock == nil {
+		return st
+	}
+	st.Enabled = true
+	st.Head = b.lock.Head().String()
+	st.TrustedKeys = b.lock.Keys()
+	if nm := b.netMap; nm != nil {
+		st.NodeKeySigned = b.lock.VerifyNodeKey(nm.NodeKey, nm.KeySignature) == nil
+	}
+	for _, p := range b.lockPeers {
+		if reason, ok := b.lockRejected[p.Key]; ok {
+			st.Rejected = append(st.Rejected, RejectedPeer{Name: p.Name, NodeKey: p.Key, Reason: reason})
+		}
+	}
+	return st
+}
+
+// NetworkLockInit enables network lock, trusting keys, and refuses
+// the current peers whose keys they haven't signed. Every node of the
+// tailnet that enables it must be given the same keys, so that they
+// agree on later updates; the control server can't change them.
+func (b *LocalBackend) NetworkLockInit(keys []tka.Key) error {
+	if len(keys) == 0 {
+		return errors.New("no trusted keys given")
+	}
+	a, err := tka.New(tka.Genesis(keys))
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	if b.lock != nil || b.lockErr != nil {
+		b.mu.Unlock()
+		return errors.New("network lock is already enabled")
+	}
+	if b.varRoot == "" {
+		b.mu.Unlock()
+		return errors.New("no state directory to keep network lock state in")
+	}
+	if err := a.Save(filepath.Join(b.varRoot, lockStateFile)); err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	b.lock = a
+	b.auditf(AuditLock, "enabled; trusted keys: %v", a.Keys())
+	b.logf("network lock: enabled with %d trusted keys", len(keys))
+	var nm *controlclient.NetworkMap
+	if b.netMap != nil {
+		b.syncLockLocked(b.netMap.KeyAuthority)
+		m := *b.netMap
+		m.Peers = b.lockFilterLocked(b.lockPeers)
+		b.setNetMapLocked(&m)
+		nm = b.netMap
+	}
+	prefs := b.prefs
+	b.mu.Unlock()
+
+	if nm != nil {
+		b.updateFilter(nm, prefs)
+		b.e.SetNetworkMap(nm)
+		b.send(Notify{NetMap: nm})
+		b.authReconfigSoon()
+	}
+	return nil
+}
+
+// NetworkLockSign signs the node key nk with this node's signing key,
+// which must be trusted, and sends the signature to the control
+// server to hand out with that node. It returns the signature.
+func (b *LocalBackend) NetworkLockSign(ctx context.Context, nk tailcfg.NodeKey) (string, error) {
+	key, err := b.lockKey()
+	if err != nil {
+		return "", err
+	}
+	b.mu.Lock()
+	a := b.lock
+	trusted := a != nil && a.Trusted(tka.PublicKey(key))
+	cc := b.c
+	b.mu.Unlock()
+
+	if a == nil {
+		return "", errors.New("network lock is not enabled")
+	}
+	if !trusted {
+		return "", fmt.Errorf("this node's signing key %v is not trusted", tka.PublicKey(key))
+	}
+	if cc == nil {
+		return "", errors.New("not connected to control")
+	}
+	sig := tka.SignNodeKey(key, nk)
+	if err := cc.SubmitKeySignature(ctx, nk, sig); err != nil {
+		return "", err
+	}
+	b.auditf(AuditLock, "signed node key %v", nk)
+	return sig, nil
+}
+
+// lockKey returns this node's signing key, kept in the
+// TailscaleVarRoot, creating it the first time.
+func (b *LocalBackend) lockKey() (ed25519.PrivateKey, error) {
+	dir := b.TailscaleVarRoot()
+	if dir == "" {
+		return nil, errors.New("no state directory to keep a signing key in")
+	}
+	path := filepath.Join(dir, lockKeyFile)
+	buf, err := ioutil.ReadFile(path)
+	if err == nil {
+		if len(buf) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("%s: invalid signing key", path)
+		}
+		return ed25519.PrivateKey(buf), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key := tka.NewPrivateKey()
+	if err := atomicfile.WriteFile(path, key, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,44 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"testing"
+
+	"tailscale.com/control/controlclient"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tka"
+)
+
+func TestLockFilter(t *testing.T) {
+	signer := tka.NewPrivateKey()
+	a, err := tka.New(tka.Genesis([]tka.Key{tka.PublicKey(signer)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := &tailcfg.Node{Name: "signed", Key: tailcfg.NodeKey{1}}
+	signed.KeySignature = tka.SignNodeKey(signer, signed.Key)
+	unsigned := &tailcfg.Node{Name: "unsigned", Key: tailcfg.NodeKey{2}}
+	forged := &tailcfg.Node{Name: "forged", Key: tailcfg.NodeKey{3}}
+	forged.KeySignature = tka.SignNodeKey(tka.NewPrivateKey(), forged.Key)
+	nm := &controlclient.NetworkMap{Peers: []*tailcfg.Node{signed, unsigned, forged}}
+
+	b := &LocalBackend{logf: t.Logf}
+	if got := b.applyLockLocked(nm); got != nm {
+		t.Errorf("netmap changed without network lock")
+	}
+
+	b.lock = a
+	got := b.applyLockLocked(nm)
+	if len(got.Peers) != 1 || got.Peers[0] != signed {
+		t.Errorf("peers = %v; want only the signed one", got.Peers)
+	}
+	if len(nm.Peers) != 3 {
+		t.Errorf("original netmap modified")
+	}
+	if len(b.lockRejected) != 2 || b.lockRejected[unsigned.Key] == "" || b.lockRejected[forged.Key] == "" {
+		t.Errorf("rejected = %v; want unsigned and forged", b.lockRejected)
+	}
+}
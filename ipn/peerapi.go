@@ -0,0 +1,499 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"inet.af/netaddr"
+	"tailscale.com/control/controlclient"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/empty"
+	"tailscale.com/wgengine/filter"
+)
+
+// PeerAPIServiceProto is the tailcfg.Service protocol under which a
+// node advertises the TCP port of its peer API on its Tailscale IPv4
+// address.
+const PeerAPIServiceProto = tailcfg.ServiceProto("peerapi4")
+
+// partialSuffix is the suffix appended to files in the inbox
+// directory while they're still being received.
+const partialSuffix = ".partial"
+
+// WaitingFile is a file that was received from a peer and is waiting
+// in the inbox directory to be picked up by a frontend.
+type WaitingFile struct {
+	Name string
+	Size int64
+}
+
+// FileTarget is a peer that this node can send files to.
+type FileTarget struct {
+	Node *tailcfg.Node
+
+	// PeerAPIURL is the http://ip:port URL base of the peer's
+	// peer API, without a trailing slash.
+	PeerAPIURL string
+}
+
+// PartialFile is the peer API response to a GET of
+// /v0/put/<name>, describing how much of a previous, interrupted
+// transfer of that file the receiver already has.
+type PartialFile struct {
+	Name   string
+	Offset int64 // number of bytes already received
+
+	// Sha256 is the hex SHA-256 of the Offset bytes received, for
+	// the sender to check against the start of its file before
+	// resuming.
+	Sha256 string `json:",omitempty"`
+}
+
+// peerAPIListener is a listener on one of the node's Tailscale IPs
+// that serves the peer API: the HTTP interface that other nodes in
+// the tailnet use to talk to this one. For now it only implements
+// receiving files.
+type peerAPIListener struct {
+	b    *LocalBackend
+	ip   netaddr.IP
+	ln   net.Listener
+	port int
+}
+
+func (pln *peerAPIListener) Close() error {
+	return pln.ln.Close()
+}
+
+func (pln *peerAPIListener) serve() {
+	hs := &http.Server{
+		Handler: pln,
+		// Generous, as files can be large; it only exists so
+		// a stalled peer doesn't hold the connection forever.
+		ReadTimeout: 30 * time.Minute,
+	}
+	err := hs.Serve(pln.ln)
+	pln.b.logf("peerapi: %v listener closed: %v", pln.ip, err)
+}
+
+// ServeHTTP serves the peer API. The remote address is used to
+// identify the peer node, since connections only reach the listener
+// via WireGuard, which has already authenticated the peer's key.
+func (pln *peerAPIListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	remote, err := netaddr.ParseIPPort(r.RemoteAddr)
+	if err != nil {
+		http.Error(w, "bad remote address", http.StatusBadRequest)
+		return
+	}
+	peer, nm, ok := pln.b.peerForIP(remote.IP)
+	if !ok {
+		http.Error(w, "unknown peer", http.StatusForbidden)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/v0/put/") {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err := pln.b.checkPeerCanPutFile(nm, peer, remote.IP, pln.ip, uint16(pln.port)); err != nil {
+		pln.b.logf("peerapi: denied file from %v (%v): %v", peer.Name, remote.IP, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	pln.b.serveFilePut(w, r, peer, strings.TrimPrefix(r.URL.Path, "/v0/put/"))
+}
+
+// peerForIP returns the netmap peer that owns ip as one of its
+// Tailscale addresses, along with the netmap it was found in.
+func (b *LocalBackend) peerForIP(ip netaddr.IP) (peer *tailcfg.Node, nm *controlclient.NetworkMap, ok bool) {
+	b.mu.Lock()
+	nm = b.netMap
+	b.mu.Unlock()
+	if nm == nil {
+		return nil, nil, false
+	}
+	for _, p := range nm.Peers {
+		for _, pfx := range wgCIDRsToNetaddr(p.Addresses) {
+			if pfx.IP == ip {
+				return p, nm, true
+			}
+		}
+	}
+	return nil, nil, false
+}
+
+// checkPeerCanPutFile reports whether peer, connecting from srcIP,
+// may send files to this node's peer API on dstIP:dstPort.
+//
+// The packet filter must allow the connection (so ACLs and
+// ShieldsUp are honored the same as for any other inbound TCP
+// connection), and files are only accepted between nodes owned by
+// the same user.
+func (b *LocalBackend) checkPeerCanPutFile(nm *controlclient.NetworkMap, peer *tailcfg.Node, srcIP, dstIP netaddr.IP, dstPort uint16) error {
+	if b.inboxDir() == "" {
+		return errors.New("file receiving not enabled on this node")
+	}
+	if peer.User != nm.User {
+		return errors.New("files are only accepted from the same user's nodes")
+	}
+	if f := b.e.GetFilter(); f == nil || f.CheckTCP(srcIP, dstIP, dstPort) != filter.Accept {
+		return errors.New("not permitted by packet filter")
+	}
+	return nil
+}
+
+// serveFilePut handles a peer's GET or PUT of /v0/put/<name>.
+//
+// A GET reports how much of name was already received from this peer
+// in an earlier, interrupted attempt, as a PartialFile. A PUT writes
+// the request body to the file starting at the "offset" query
+// parameter, which must be either zero or the offset reported by a
+// GET; this is how transfers are resumed. A nonzero offset must come
+// with a "sha256" parameter, the hex SHA-256 of the sender's first
+// offset bytes, which has to match the partial file's.
+func (b *LocalBackend) serveFilePut(w http.ResponseWriter, r *http.Request, peer *tailcfg.Node, escapedName string) {
+	baseName, err := url.PathUnescape(escapedName)
+	if err != nil || !validInboxFileName(baseName) {
+		http.Error(w, "bad file name", http.StatusBadRequest)
+		return
+	}
+	dir := b.inboxDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		b.logf("peerapi: creating inbox: %v", err)
+		http.Error(w, "inbox unavailable", http.StatusInternalServerError)
+		return
+	}
+	// Partial files are per-peer, so one peer can't append to (or
+	// learn about) another peer's half-sent file of the same name.
+	partPath := filepath.Join(dir, fmt.Sprintf("%s.%d%s", baseName, peer.ID, partialSuffix))
+
+	switch r.Method {
+	case "GET":
+		pf := PartialFile{Name: baseName}
+		if f, err := os.Open(partPath); err == nil {
+			pf.Offset, pf.Sha256, err = hashAll(f)
+			f.Close()
+			if err != nil {
+				b.logf("peerapi: reading %q: %v", partPath, err)
+				pf.Offset, pf.Sha256 = 0, ""
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pf)
+		return
+	case "PUT":
+	default:
+		http.Error(w, "expected GET or PUT", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var offset int64
+	if v := r.FormValue("offset"); v != "" {
+		offset, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || offset < 0 {
+			http.Error(w, "bad offset", http.StatusBadRequest)
+			return
+		}
+	}
+	flags := os.O_RDWR | os.O_CREATE
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(partPath, flags, 0600)
+	if err != nil {
+		b.logf("peerapi: opening %q: %v", partPath, err)
+		http.Error(w, "failed to create file", http.StatusInternalServerError)
+		return
+	}
+	if offset > 0 {
+		// Only append to bytes that are the start of the
+		// sender's file, or the result is a mix of two files.
+		n, sum, err := hashAll(f)
+		if err != nil || n != offset || sum != r.FormValue("sha256") {
+			f.Close()
+			http.Error(w, "offset does not match partial file; restart transfer", http.StatusConflict)
+			return
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	n, err := io.Copy(f, r.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// Leave the partial file in place so the sender can resume.
+		b.logf("peerapi: receiving %q from %v: %v after %d bytes", baseName, peer.Name, err, offset+n)
+		http.Error(w, "transfer interrupted", http.StatusInternalServerError)
+		return
+	}
+	finalPath, err := renameToUnused(partPath, filepath.Join(dir, baseName))
+	if err != nil {
+		b.logf("peerapi: finishing %q: %v", baseName, err)
+		http.Error(w, "failed to store file", http.StatusInternalServerError)
+		return
+	}
+	b.logf("peerapi: received %q (%d bytes) from %v", filepath.Base(finalPath), offset+n, peer.Name)
+	b.send(Notify{FilesWaiting: &empty.Message{}})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// hashAll reads r to the end and returns how many bytes it read and
+// their hex SHA-256.
+func hashAll(r io.Reader) (n int64, sum string, err error) {
+	h := sha256.New()
+	n, err = io.Copy(h, r)
+	if err != nil {
+		return n, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// renameToUnused renames src to dst, or if dst already exists, to
+// the first of "dst (1)", "dst (2)", etc. (keeping dst's extension
+// last) that doesn't. It returns the final path.
+func renameToUnused(src, dst string) (string, error) {
+	ext := filepath.Ext(dst)
+	stem := strings.TrimSuffix(dst, ext)
+	for i := 0; i < 1000; i++ {
+		cand := dst
+		if i > 0 {
+			cand = fmt.Sprintf("%s (%d)%s", stem, i, ext)
+		}
+		if _, err := os.Lstat(cand); !os.IsNotExist(err) {
+			continue
+		}
+		return cand, os.Rename(src, cand)
+	}
+	return "", fmt.Errorf("too many files named like %q", filepath.Base(dst))
+}
+
+// validInboxFileName reports whether name is acceptable as the base
+// name of a file in the inbox directory.
+func validInboxFileName(name string) bool {
+	if name == "" || len(name) > 255 || !utf8.ValidString(name) {
+		return false
+	}
+	if strings.HasPrefix(name, ".") || strings.HasSuffix(name, partialSuffix) {
+		return false
+	}
+	if strings.ContainsAny(name, `/\:`) {
+		return false
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// SetInboxDir sets the directory in which files received from peers
+// are stored until a frontend picks them up. If dir is empty (the
+// default), this node doesn't accept files.
+func (b *LocalBackend) SetInboxDir(dir string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inbox = dir
+}
+
+func (b *LocalBackend) inboxDir() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.inbox
+}
+
+// WaitingFiles returns the completely received files in the inbox
+// directory.
+func (b *LocalBackend) WaitingFiles() ([]WaitingFile, error) {
+	dir := b.inboxDir()
+	if dir == "" {
+		return nil, errors.New("file receiving not enabled")
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ret []WaitingFile
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || !validInboxFileName(fi.Name()) {
+			continue
+		}
+		ret = append(ret, WaitingFile{Name: fi.Name(), Size: fi.Size()})
+	}
+	return ret, nil
+}
+
+// OpenFile opens the waiting file baseName from the inbox directory.
+func (b *LocalBackend) OpenFile(baseName string) (rc io.ReadCloser, size int64, err error) {
+	dir := b.inboxDir()
+	if dir == "" {
+		return nil, 0, errors.New("file receiving not enabled")
+	}
+	if !validInboxFileName(baseName) {
+		return nil, 0, errors.New("bad file name")
+	}
+	f, err := os.Open(filepath.Join(dir, baseName))
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
+
+// DeleteFile removes the waiting file baseName from the inbox
+// directory, typically after a frontend has copied it out.
+func (b *LocalBackend) DeleteFile(baseName string) error {
+	dir := b.inboxDir()
+	if dir == "" {
+		return errors.New("file receiving not enabled")
+	}
+	if !validInboxFileName(baseName) {
+		return errors.New("bad file name")
+	}
+	return os.Remove(filepath.Join(dir, baseName))
+}
+
+// FileTargets returns the peers this node can send files to: those
+// owned by the same user that advertise a peer API.
+func (b *LocalBackend) FileTargets() ([]*FileTarget, error) {
+	b.mu.Lock()
+	nm := b.netMap
+	b.mu.Unlock()
+	if nm == nil {
+		return nil, errors.New("not connected")
+	}
+	var ret []*FileTarget
+	for _, p := range nm.Peers {
+		if p.User != nm.User {
+			continue
+		}
+		u := peerAPIBase(p)
+		if u == "" {
+			continue
+		}
+		ret = append(ret, &FileTarget{Node: p, PeerAPIURL: u})
+	}
+	return ret, nil
+}
+
+// peerAPIBase returns the base URL of peer's peer API, or the empty
+// string if peer doesn't advertise one.
+func peerAPIBase(peer *tailcfg.Node) string {
+	var port uint16
+	for _, s := range peer.Hostinfo.Services {
+		if s.Proto == PeerAPIServiceProto {
+			port = s.Port
+			break
+		}
+	}
+	if port == 0 {
+		return ""
+	}
+	for _, pfx := range wgCIDRsToNetaddr(peer.Addresses) {
+		if pfx.IP.Is4() && pfx.Bits == 32 {
+			return fmt.Sprintf("http://%v", netaddr.IPPort{IP: pfx.IP, Port: port})
+		}
+	}
+	return ""
+}
+
+// initPeerAPIListenersLocked (re)starts the peer API listeners so
+// there's one on each of the node's Tailscale IPv4 addresses. It is a
+// no-op if they're already running on the current addresses. It
+// reports whether the set of listeners changed.
+//
+// It must be called after the engine has been configured with those
+// addresses, as the listen fails otherwise. b.mu must be held.
+func (b *LocalBackend) initPeerAPIListenersLocked() (changed bool) {
+	if b.inbox == "" || b.netMap == nil {
+		return b.closePeerAPIListenersLocked()
+	}
+	var ips []netaddr.IP
+	for _, pfx := range wgCIDRsToNetaddr(b.netMap.Addresses) {
+		if pfx.IP.Is4() {
+			ips = append(ips, pfx.IP)
+		}
+	}
+	if len(ips) == len(b.peerAPIListeners) {
+		same := true
+		for i, pln := range b.peerAPIListeners {
+			if pln.ip != ips[i] {
+				same = false
+				break
+			}
+		}
+		if same {
+			return false
+		}
+	}
+	b.closePeerAPIListenersLocked()
+
+	// Try to use the same port on all addresses, so the single
+	// advertised port is correct for each.
+	var port int
+	for _, ip := range ips {
+		ln, err := net.Listen("tcp4", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		if err != nil {
+			b.logf("peerapi: listen on %v: %v", ip, err)
+			continue
+		}
+		port = ln.Addr().(*net.TCPAddr).Port
+		pln := &peerAPIListener{b: b, ip: ip, ln: ln, port: port}
+		b.peerAPIListeners = append(b.peerAPIListeners, pln)
+		b.logf("peerapi: serving on %v", ln.Addr())
+		go pln.serve()
+	}
+	return true
+}
+
+// closePeerAPIListenersLocked closes any running peer API listeners
+// and reports whether there were any. b.mu must be held.
+func (b *LocalBackend) closePeerAPIListenersLocked() (changed bool) {
+	for _, pln := range b.peerAPIListeners {
+		pln.Close()
+	}
+	changed = len(b.peerAPIListeners) > 0
+	b.peerAPIListeners = nil
+	return changed
+}
+
+// peerAPIServicesLocked returns the tailcfg.Services with which to
+// advertise the running peer API listeners to peers.
+// b.mu must be held.
+func (b *LocalBackend) peerAPIServicesLocked() (ret []tailcfg.Service) {
+	if len(b.peerAPIListeners) == 0 {
+		return nil
+	}
+	return []tailcfg.Service{{
+		Proto: PeerAPIServiceProto,
+		Port:  uint16(b.peerAPIListeners[0].port),
+	}}
+}
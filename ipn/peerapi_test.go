@@ -0,0 +1,124 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestValidInboxFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"foo.txt", true},
+		{"IMG 1234.jpg", true},
+		{"résumé.pdf", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{".hidden", false},
+		{"a/b", false},
+		{`a\b`, false},
+		{"c:foo", false},
+		{"foo.txt.123.partial", false},
+		{"new\nline", false},
+		{"bad\xffutf8", false},
+	}
+	for _, tt := range tests {
+		if got := validInboxFileName(tt.name); got != tt.want {
+			t.Errorf("validInboxFileName(%q) = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRenameToUnused(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peerapi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dst := filepath.Join(dir, "foo.txt")
+	want := []string{"foo.txt", "foo (1).txt", "foo (2).txt"}
+	for i, w := range want {
+		src := filepath.Join(dir, "src.partial")
+		if err := ioutil.WriteFile(src, []byte{byte(i)}, 0600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := renameToUnused(src, dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Base(got) != w {
+			t.Errorf("rename %d: got %q; want %q", i, filepath.Base(got), w)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "src.partial")); !os.IsNotExist(err) {
+		t.Errorf("source file still exists: %v", err)
+	}
+}
+
+func TestServeFilePutResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peerapi-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b := &LocalBackend{logf: t.Logf, inbox: dir}
+	peer := &tailcfg.Node{ID: 1, Name: "peer"}
+	sum := func(s string) string {
+		_, sum, err := hashAll(strings.NewReader(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sum
+	}
+	put := func(target, body string) int {
+		rec := httptest.NewRecorder()
+		b.serveFilePut(rec, httptest.NewRequest("PUT", target, strings.NewReader(body)), peer, "foo.txt")
+		return rec.Code
+	}
+
+	part := filepath.Join(dir, "foo.txt.1.partial")
+	if err := ioutil.WriteFile(part, []byte("hello "), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	b.serveFilePut(rec, httptest.NewRequest("GET", "/v0/put/foo.txt", nil), peer, "foo.txt")
+	var pf PartialFile
+	if err := json.Unmarshal(rec.Body.Bytes(), &pf); err != nil {
+		t.Fatal(err)
+	}
+	if pf.Offset != 6 || pf.Sha256 != sum("hello ") {
+		t.Fatalf("GET = %+v; want offset 6 and the hash of the partial file", pf)
+	}
+
+	if code := put("/v0/put/foo.txt?offset=6&sha256="+sum("HELLO "), "world"); code != http.StatusConflict {
+		t.Errorf("resume of a different file: %d; want %d", code, http.StatusConflict)
+	}
+	if code := put("/v0/put/foo.txt?offset=6", "world"); code != http.StatusConflict {
+		t.Errorf("resume without a hash: %d; want %d", code, http.StatusConflict)
+	}
+	if code := put("/v0/put/foo.txt?offset=6&sha256="+sum("hello "), "world"); code != http.StatusNoContent {
+		t.Fatalf("resume: %d; want %d", code, http.StatusNoContent)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "foo.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello world" {
+		t.Errorf("received %q; want %q", got, "hello world")
+	}
+}
@@ -10,12 +10,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
 
 	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
 	"tailscale.com/atomicfile"
 	"tailscale.com/control/controlclient"
 	"tailscale.com/wgengine/router"
@@ -28,10 +30,55 @@ type Prefs struct {
 	// ControlURL is the URL of the control server to use.
 	ControlURL string
 
+	// ProxyURL, if non-empty, is the HTTP or HTTPS proxy through
+	// which to reach the control server and DERP servers,
+	// overriding the proxy settings of the environment (such as
+	// HTTPS_PROXY). It may contain a username and password for
+	// proxies that require authentication.
+	ProxyURL string `json:",omitempty"`
+
 	// RouteAll specifies whether to accept subnet and default routes
 	// advertised by other nodes on the Tailscale network.
 	RouteAll bool
 
+	// ExitNodeIP is the Tailscale IP of the peer through which to
+	// route all non-Tailscale traffic, using the default route it
+	// advertises. When it's set, default routes advertised by
+	// other peers are ignored. The zero value means no particular
+	// exit node, unless AutoExitNode is set.
+	ExitNodeIP netaddr.IP
+
+	// AutoExitNode specifies whether to use the lowest-latency
+	// peer that advertises a default route as the exit node,
+	// switching to another one when it goes offline. It's ignored
+	// if ExitNodeIP is set.
+	AutoExitNode bool
+
+	// ExitNodeAllowLANAccess specifies whether, while an exit node
+	// is in use, the subnets of this machine's network interfaces
+	// stay reachable directly instead of through the exit node, so
+	// that local printers and file servers keep working.
+	ExitNodeAllowLANAccess bool `json:",omitempty"`
+
+	// RouteMetrics are the metrics of routes accepted from peers,
+	// each "ROUTE=METRIC" with METRIC from 1 to 2^32-1: a subnet
+	// route gets that of the most specific ROUTE containing it, so
+	// "0.0.0.0/0=500" covers all IPv4 ones. The lower a route's
+	// metric, the more it's preferred to other routes to the same
+	// subnet, such as another VPN's. On Linux, routes with a metric
+	// are installed in the main routing table, where the kernel can
+	// compare them; other routes win over all others. macOS has no
+	// route metrics, so there a route with any metric yields to
+	// another interface's route to the same subnet.
+	RouteMetrics []string `json:",omitempty"`
+
+	// AllowRoutesOverLAN specifies whether accepted subnet routes
+	// that overlap this machine's LAN subnets are installed as they
+	// are. By default, the LAN stays reachable directly: routes
+	// within it are ignored, and it's excluded from routes
+	// containing it.
+	AllowRoutesOverLAN bool `json:",omitempty"`
+
 	// AllowSingleHosts specifies whether to install routes for each
 	// node IP on the tailscale network, in addition to a route for
 	// the whole network.
@@ -58,6 +105,76 @@ type Prefs struct {
 	// connections. This overrides tailcfg.Hostinfo's ShieldsUp.
 	ShieldsUp bool
 
+	// ShieldsUpAllowFrom and ShieldsUpAllowPorts are exceptions to
+	// ShieldsUp. If either is set, incoming connections the packet
+	// filter allows are still let in if they're from a peer with
+	// one of the ACL tags or Tailscale IPs in ShieldsUpAllowFrom,
+	// if set, and to one of ShieldsUpAllowPorts, if set.
+	ShieldsUpAllowFrom  []string `json:",omitempty"`
+	ShieldsUpAllowPorts []uint16 `json:",omitempty"`
+
+	// RunSSH specifies whether tailscaled should run its SSH
+	// server on port 22 of the node's Tailscale IPs. Peers are
+	// authenticated by their Tailscale identity rather than SSH
+	// keys, and are only admitted if the packet filter (that is,
+	// the tailnet's ACLs) allows them to reach port 22. They may
+	// only log in as the local users the tailnet's SSH policy
+	// grants them.
+	RunSSH bool
+
+	// AutoUpdate specifies whether tailscaled should update itself
+	// to the latest release of its release track, checking daily.
+	// See package clientupdate.
+	AutoUpdate bool `json:",omitempty"`
+
+	// ListenPort, if non-zero, is the UDP port to listen on for
+	// WireGuard and peer-to-peer traffic, overriding tailscaled's
+	// --port flag. A fixed port lets firewalls allow it and
+	// routers forward it. If it's in use, a random port is used
+	// until it's free.
+	ListenPort uint16 `json:",omitempty"`
+
+	// NoPrivateEndpoints specifies whether to keep this node's
+	// private addresses (RFC 1918 and IPv6 unique local addresses)
+	// from the endpoints advertised to peers, for networks whose
+	// internal addressing mustn't be revealed to other tailnet
+	// members. Peers on the same LAN then connect through the
+	// node's public endpoint, or DERP if there's none.
+	NoPrivateEndpoints bool `json:",omitempty"`
+
+	// NoEndpointInterfaces are network interfaces, such as "eth1",
+	// whose addresses aren't advertised to peers as endpoints.
+	NoEndpointInterfaces []string `json:",omitempty"`
+
+	// KeepAlivePeers are the Tailscale IPs of peers to send
+	// WireGuard keepalives to even when there's no traffic, so
+	// that stateful NATs and firewalls on the way keep the path
+	// open and the peers can reach this node at any time. Listed
+	// peers are never removed from the on-demand wireguard
+	// configuration for being idle.
+	KeepAlivePeers []netaddr.IP `json:",omitempty"`
+
+	// KeepAliveSeconds is how often keepalives are sent to
+	// KeepAlivePeers. Zero means 25 seconds, which suits most NATs.
+	KeepAliveSeconds int `json:",omitempty"`
+
+	// RelayOnlyPeers are the Tailscale IPs of peers only to be
+	// reached through DERP, never over a direct path, such as
+	// peers on networks this node mustn't send packets to. Control
+	// can also mark peers relay-only.
+	RelayOnlyPeers []netaddr.IP `json:",omitempty"`
+
+	// HardeningProfile names a set of local restrictions on incoming
+	// traffic, enforced after the tailnet's packet filter, which it
+	// can only narrow: HardeningServer only lets in nodes tagged with
+	// one of HardeningAdminTags, and HardeningIsolated lets in none.
+	// Empty means HardeningNone.
+	HardeningProfile string `json:",omitempty"`
+
+	// HardeningAdminTags are the ACL tags of the nodes that the
+	// HardeningServer profile lets in.
+	HardeningAdminTags []string `json:",omitempty"`
+
 	// AdvertiseTags specifies groups that this node wants to join, for
 	// purposes of ACL enforcement. These can be referenced from the ACL
 	// security policy. Note that advertising a tag doesn't guarantee that
@@ -95,6 +212,26 @@ type Prefs struct {
 	// for Linux/etc, which always operate in daemon mode.
 	ForceDaemon bool `json:"ForceDaemon,omitempty"`
 
+	// LowResource specifies whether to favor low memory and CPU
+	// use over throughput and debuggability, for routers and
+	// single-board computers: smaller buffers and caches, less
+	// logging and no packet hexdumps. Builds with the
+	// ts_lowresource tag are always in this mode.
+	LowResource bool `json:",omitempty"`
+
+	// SplitTunnelApps, if non-empty, are the only apps whose
+	// traffic is routed through Tailscale or, if
+	// SplitTunnelExclude, the apps whose traffic isn't. On Linux,
+	// apps are cgroup v2 paths, such as
+	// "system.slice/backup.service"; on Windows, executable paths,
+	// and only while no exit node or subnet routes are in use.
+	// Other platforms ignore them.
+	SplitTunnelApps []string `json:",omitempty"`
+
+	// SplitTunnelExclude specifies whether SplitTunnelApps are
+	// kept out of Tailscale rather than the only apps let in.
+	SplitTunnelExclude bool `json:",omitempty"`
+
 	// The following block of options only have an effect on Linux.
 
 	// AdvertiseRoutes specifies CIDR prefixes to advertise into the
@@ -102,6 +239,13 @@ type Prefs struct {
 	// node.
 	AdvertiseRoutes []wgcfg.CIDR
 
+	// AdvertiseRouteChecks are reachability checks of advertised
+	// routes, each "ROUTE=CHECK" with CHECK as parsed by
+	// routecheck.Parse, such as "10.0.0.0/24=tcp:10.0.0.1:22". A
+	// route whose check keeps failing is withdrawn until it passes
+	// again, so that peers fail over to another router for it.
+	AdvertiseRouteChecks []string `json:",omitempty"`
+
 	// NoSNAT specifies whether to source NAT traffic going to
 	// destinations in AdvertiseRoutes. The default is to apply source
 	// NAT, which makes the traffic appear to come from the router
@@ -111,7 +255,7 @@ type Prefs struct {
 	// network to route Tailscale traffic back to the subnet relay
 	// machine.
 	//
-	// Linux-only.
+	// Linux, FreeBSD and OpenBSD only.
 	NoSNAT bool
 
 	// NetfilterMode specifies how much to manage netfilter rules for
@@ -134,6 +278,20 @@ func (p *Prefs) pretty(goos string) string {
 	var sb strings.Builder
 	sb.WriteString("Prefs{")
 	fmt.Fprintf(&sb, "ra=%v ", p.RouteAll)
+	if !p.ExitNodeIP.IsZero() {
+		fmt.Fprintf(&sb, "exit=%v ", p.ExitNodeIP)
+	} else if p.AutoExitNode {
+		sb.WriteString("exit=auto ")
+	}
+	if p.ExitNodeAllowLANAccess {
+		sb.WriteString("lan=true ")
+	}
+	if len(p.RouteMetrics) > 0 {
+		fmt.Fprintf(&sb, "metrics=%s ", strings.Join(p.RouteMetrics, ","))
+	}
+	if p.AllowRoutesOverLAN {
+		sb.WriteString("routesoverlan=true ")
+	}
 	if !p.AllowSingleHosts {
 		sb.WriteString("mesh=false ")
 	}
@@ -147,12 +305,63 @@ func (p *Prefs) pretty(goos string) string {
 	if p.ShieldsUp {
 		sb.WriteString("shields=true ")
 	}
+	if len(p.ShieldsUpAllowFrom) > 0 {
+		fmt.Fprintf(&sb, "allowfrom=%s ", strings.Join(p.ShieldsUpAllowFrom, ","))
+	}
+	if len(p.ShieldsUpAllowPorts) > 0 {
+		fmt.Fprintf(&sb, "allowports=%v ", p.ShieldsUpAllowPorts)
+	}
+	if p.RunSSH {
+		sb.WriteString("ssh=true ")
+	}
+	if p.AutoUpdate {
+		sb.WriteString("autoupdate=true ")
+	}
+	if p.ListenPort != 0 {
+		fmt.Fprintf(&sb, "port=%d ", p.ListenPort)
+	}
+	if p.NoPrivateEndpoints {
+		sb.WriteString("privateeps=false ")
+	}
+	if len(p.NoEndpointInterfaces) > 0 {
+		fmt.Fprintf(&sb, "noepifs=%s ", strings.Join(p.NoEndpointInterfaces, ","))
+	}
+	if p.LowResource {
+		sb.WriteString("lowres=true ")
+	}
+	if len(p.SplitTunnelApps) > 0 {
+		verb := "only"
+		if p.SplitTunnelExclude {
+			verb = "exclude"
+		}
+		fmt.Fprintf(&sb, "apps=%s:%s ", verb, strings.Join(p.SplitTunnelApps, ","))
+	}
+	if len(p.KeepAlivePeers) > 0 {
+		fmt.Fprintf(&sb, "keepalive=%v", p.KeepAlivePeers)
+		if p.KeepAliveSeconds != 0 {
+			fmt.Fprintf(&sb, "/%ds", p.KeepAliveSeconds)
+		}
+		sb.WriteString(" ")
+	}
+	if len(p.RelayOnlyPeers) > 0 {
+		fmt.Fprintf(&sb, "relayonly=%v ", p.RelayOnlyPeers)
+	}
+	if prof := p.hardeningProfile(); prof != HardeningNone {
+		fmt.Fprintf(&sb, "hardening=%s", prof)
+		if len(p.HardeningAdminTags) > 0 {
+			fmt.Fprintf(&sb, ":%s", strings.Join(p.HardeningAdminTags, ","))
+		}
+		sb.WriteString(" ")
+	}
 	if len(p.AdvertiseRoutes) > 0 || goos == "linux" {
 		fmt.Fprintf(&sb, "routes=%v ", p.AdvertiseRoutes)
 	}
 	if len(p.AdvertiseRoutes) > 0 || p.NoSNAT {
 		fmt.Fprintf(&sb, "snat=%v ", !p.NoSNAT)
 	}
+	if len(p.AdvertiseRouteChecks) > 0 {
+		fmt.Fprintf(&sb, "routechecks=%s ", strings.Join(p.AdvertiseRouteChecks, ","))
+	}
 	if len(p.AdvertiseTags) > 0 {
 		fmt.Fprintf(&sb, "tags=%s ", strings.Join(p.AdvertiseTags, ","))
 	}
@@ -162,6 +371,9 @@ func (p *Prefs) pretty(goos string) string {
 	if p.ControlURL != "" && p.ControlURL != "https://login.tailscale.com" {
 		fmt.Fprintf(&sb, "url=%q ", p.ControlURL)
 	}
+	if p.ProxyURL != "" {
+		fmt.Fprintf(&sb, "proxy=%q ", redactProxyURL(p.ProxyURL))
+	}
 	if p.Persist != nil {
 		sb.WriteString(p.Persist.Pretty())
 	} else {
@@ -171,6 +383,39 @@ func (p *Prefs) pretty(goos string) string {
 	return sb.String()
 }
 
+// redactProxyURL returns proxyURL with any password removed, for
+// logging.
+func redactProxyURL(proxyURL string) string {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return "(invalid)"
+	}
+	return u.Redacted()
+}
+
+// Redacted returns a copy of p for frontends, with any proxy password
+// removed. SetPrefs puts the password back when a frontend hands the
+// copy back unchanged.
+func (p *Prefs) Redacted() *Prefs {
+	if p == nil {
+		return nil
+	}
+	p2 := p.Clone()
+	if p2.ProxyURL != "" {
+		p2.ProxyURL = redactProxyURL(p2.ProxyURL)
+	}
+	return p2
+}
+
+// unredactProxyURL returns proxyURL, or old if proxyURL is old with
+// its password removed, as a frontend got it from Redacted.
+func unredactProxyURL(proxyURL, old string) string {
+	if proxyURL != old && proxyURL == redactProxyURL(old) {
+		return old
+	}
+	return proxyURL
+}
+
 func (p *Prefs) ToBytes() []byte {
 	data, err := json.MarshalIndent(p, "", "\t")
 	if err != nil {
@@ -189,19 +434,41 @@ func (p *Prefs) Equals(p2 *Prefs) bool {
 
 	return p != nil && p2 != nil &&
 		p.ControlURL == p2.ControlURL &&
+		p.ProxyURL == p2.ProxyURL &&
 		p.RouteAll == p2.RouteAll &&
+		p.ExitNodeIP == p2.ExitNodeIP &&
+		p.AutoExitNode == p2.AutoExitNode &&
+		p.ExitNodeAllowLANAccess == p2.ExitNodeAllowLANAccess &&
+		compareStrings(p.RouteMetrics, p2.RouteMetrics) &&
+		p.AllowRoutesOverLAN == p2.AllowRoutesOverLAN &&
 		p.AllowSingleHosts == p2.AllowSingleHosts &&
 		p.CorpDNS == p2.CorpDNS &&
 		p.WantRunning == p2.WantRunning &&
 		p.NotepadURLs == p2.NotepadURLs &&
 		p.ShieldsUp == p2.ShieldsUp &&
+		compareStrings(p.ShieldsUpAllowFrom, p2.ShieldsUpAllowFrom) &&
+		comparePorts(p.ShieldsUpAllowPorts, p2.ShieldsUpAllowPorts) &&
+		p.RunSSH == p2.RunSSH &&
+		p.AutoUpdate == p2.AutoUpdate &&
+		p.ListenPort == p2.ListenPort &&
+		p.NoPrivateEndpoints == p2.NoPrivateEndpoints &&
+		compareStrings(p.NoEndpointInterfaces, p2.NoEndpointInterfaces) &&
+		compareIPs(p.KeepAlivePeers, p2.KeepAlivePeers) &&
+		p.KeepAliveSeconds == p2.KeepAliveSeconds &&
+		compareIPs(p.RelayOnlyPeers, p2.RelayOnlyPeers) &&
+		p.HardeningProfile == p2.HardeningProfile &&
+		compareStrings(p.HardeningAdminTags, p2.HardeningAdminTags) &&
 		p.NoSNAT == p2.NoSNAT &&
 		p.NetfilterMode == p2.NetfilterMode &&
 		p.Hostname == p2.Hostname &&
 		p.OSVersion == p2.OSVersion &&
 		p.DeviceModel == p2.DeviceModel &&
 		p.ForceDaemon == p2.ForceDaemon &&
+		p.LowResource == p2.LowResource &&
+		compareStrings(p.SplitTunnelApps, p2.SplitTunnelApps) &&
+		p.SplitTunnelExclude == p2.SplitTunnelExclude &&
 		compareIPNets(p.AdvertiseRoutes, p2.AdvertiseRoutes) &&
+		compareStrings(p.AdvertiseRouteChecks, p2.AdvertiseRouteChecks) &&
 		compareStrings(p.AdvertiseTags, p2.AdvertiseTags) &&
 		p.Persist.Equals(p2.Persist)
 }
@@ -218,6 +485,18 @@ func compareIPNets(a, b []wgcfg.CIDR) bool {
 	return true
 }
 
+func compareIPs(a, b []netaddr.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func compareStrings(a, b []string) bool {
 	if len(a) != len(b) {
 		return false
@@ -230,6 +509,18 @@ func compareStrings(a, b []string) bool {
 	return true
 }
 
+func comparePorts(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func NewPrefs() *Prefs {
 	return &Prefs{
 		// Provide default values for options which might be missing
@@ -8,6 +8,7 @@ package ipn
 
 import (
 	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
 	"tailscale.com/control/controlclient"
 	"tailscale.com/wgengine/router"
 )
@@ -20,8 +21,17 @@ func (src *Prefs) Clone() *Prefs {
 	}
 	dst := new(Prefs)
 	*dst = *src
+	dst.RouteMetrics = append(src.RouteMetrics[:0:0], src.RouteMetrics...)
+	dst.ShieldsUpAllowFrom = append(src.ShieldsUpAllowFrom[:0:0], src.ShieldsUpAllowFrom...)
+	dst.ShieldsUpAllowPorts = append(src.ShieldsUpAllowPorts[:0:0], src.ShieldsUpAllowPorts...)
+	dst.NoEndpointInterfaces = append(src.NoEndpointInterfaces[:0:0], src.NoEndpointInterfaces...)
+	dst.KeepAlivePeers = append(src.KeepAlivePeers[:0:0], src.KeepAlivePeers...)
+	dst.RelayOnlyPeers = append(src.RelayOnlyPeers[:0:0], src.RelayOnlyPeers...)
+	dst.HardeningAdminTags = append(src.HardeningAdminTags[:0:0], src.HardeningAdminTags...)
 	dst.AdvertiseTags = append(src.AdvertiseTags[:0:0], src.AdvertiseTags...)
+	dst.SplitTunnelApps = append(src.SplitTunnelApps[:0:0], src.SplitTunnelApps...)
 	dst.AdvertiseRoutes = append(src.AdvertiseRoutes[:0:0], src.AdvertiseRoutes...)
+	dst.AdvertiseRouteChecks = append(src.AdvertiseRouteChecks[:0:0], src.AdvertiseRouteChecks...)
 	if dst.Persist != nil {
 		dst.Persist = new(controlclient.Persist)
 		*dst.Persist = *src.Persist
@@ -32,20 +42,42 @@ func (src *Prefs) Clone() *Prefs {
 // A compilation failure here means this code must be regenerated, with command:
 //   tailscale.com/cmd/cloner -type Prefs
 var _PrefsNeedsRegeneration = Prefs(struct {
-	ControlURL       string
-	RouteAll         bool
-	AllowSingleHosts bool
-	CorpDNS          bool
-	WantRunning      bool
-	ShieldsUp        bool
-	AdvertiseTags    []string
-	Hostname         string
-	OSVersion        string
-	DeviceModel      string
-	NotepadURLs      bool
-	ForceDaemon      bool
-	AdvertiseRoutes  []wgcfg.CIDR
-	NoSNAT           bool
-	NetfilterMode    router.NetfilterMode
-	Persist          *controlclient.Persist
+	ControlURL             string
+	ProxyURL               string
+	RouteAll               bool
+	ExitNodeIP             netaddr.IP
+	AutoExitNode           bool
+	ExitNodeAllowLANAccess bool
+	RouteMetrics           []string
+	AllowRoutesOverLAN     bool
+	AllowSingleHosts       bool
+	CorpDNS                bool
+	WantRunning            bool
+	ShieldsUp              bool
+	ShieldsUpAllowFrom     []string
+	ShieldsUpAllowPorts    []uint16
+	RunSSH                 bool
+	AutoUpdate             bool
+	ListenPort             uint16
+	NoPrivateEndpoints     bool
+	NoEndpointInterfaces   []string
+	KeepAlivePeers         []netaddr.IP
+	KeepAliveSeconds       int
+	RelayOnlyPeers         []netaddr.IP
+	HardeningProfile       string
+	HardeningAdminTags     []string
+	AdvertiseTags          []string
+	Hostname               string
+	OSVersion              string
+	DeviceModel            string
+	NotepadURLs            bool
+	ForceDaemon            bool
+	LowResource            bool
+	SplitTunnelApps        []string
+	SplitTunnelExclude     bool
+	AdvertiseRoutes        []wgcfg.CIDR
+	AdvertiseRouteChecks   []string
+	NoSNAT                 bool
+	NetfilterMode          router.NetfilterMode
+	Persist                *controlclient.Persist
 }{})
@@ -0,0 +1,71 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"tailscale.com/health"
+)
+
+// Ready reports whether the node is ready to carry traffic: it's
+// logged in and running, has a network map, and the engine and OS
+// router took the configuration from it. It returns nil if so, or
+// otherwise why not.
+func (b *LocalBackend) Ready() error {
+	b.mu.Lock()
+	state := b.state
+	haveNetMap := b.netMap != nil
+	reconfigured := b.reconfigured
+	b.mu.Unlock()
+
+	switch {
+	case state != Running:
+		return fmt.Errorf("state is %v, not Running", state)
+	case !haveNetMap:
+		return errors.New("no network map")
+	case !reconfigured:
+		return errors.New("routes not programmed yet")
+	}
+	if msg, ok := health.Get().Problems[health.SysRouter]; ok {
+		return fmt.Errorf("router: %s", msg)
+	}
+	return nil
+}
+
+// engineStatusStale is how long the engine can go without posting a
+// status before Live reports it wedged. b asks it for one every
+// trafficPollInterval.
+const engineStatusStale = 3 * trafficPollInterval
+
+// Live reports whether b is working, for a liveness probe: the engine
+// has posted a status recently and the node's login hasn't expired.
+// It returns nil if so, or otherwise what's wrong. Unlike Ready, it
+// doesn't fail while b is still starting up or waiting for its first
+// login.
+func (b *LocalBackend) Live() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.liveLocked(time.Now())
+}
+
+func (b *LocalBackend) liveLocked(now time.Time) error {
+	if d := now.Sub(b.lastEngineStatus); d > engineStatusStale {
+		return fmt.Errorf("no status from the engine in %v", d.Round(time.Second))
+	}
+	if nm := b.netMap; nm != nil {
+		// Logged in once, so NeedsLogin means the login expired
+		// or was revoked.
+		if !nm.Expiry.IsZero() && now.After(nm.Expiry) {
+			return fmt.Errorf("node key expired at %v", nm.Expiry.Format(time.RFC3339))
+		}
+		if b.state == NeedsLogin {
+			return errors.New("login expired; state is NeedsLogin")
+		}
+	}
+	return nil
+}
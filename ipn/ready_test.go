@@ -0,0 +1,52 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"testing"
+	"time"
+
+	"tailscale.com/control/controlclient"
+)
+
+func TestLive(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		b        *LocalBackend
+		wantLive bool
+	}{
+		{"starting", &LocalBackend{state: NoState, lastEngineStatus: now}, true},
+		{"awaiting_first_login", &LocalBackend{state: NeedsLogin, lastEngineStatus: now}, true},
+		{"running", &LocalBackend{
+			state:            Running,
+			netMap:           &controlclient.NetworkMap{Expiry: now.Add(time.Hour)},
+			lastEngineStatus: now.Add(-trafficPollInterval),
+		}, true},
+		{"engine_wedged", &LocalBackend{
+			state:            Running,
+			netMap:           &controlclient.NetworkMap{},
+			lastEngineStatus: now.Add(-engineStatusStale - time.Second),
+		}, false},
+		{"key_expired", &LocalBackend{
+			state:            Running,
+			netMap:           &controlclient.NetworkMap{Expiry: now.Add(-time.Second)},
+			lastEngineStatus: now,
+		}, false},
+		{"login_expired", &LocalBackend{
+			state:            NeedsLogin,
+			netMap:           &controlclient.NetworkMap{},
+			lastEngineStatus: now,
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.b.liveLocked(now)
+			if (err == nil) != tt.wantLive {
+				t.Errorf("liveLocked = %v; want live=%v", err, tt.wantLive)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"inet.af/netaddr"
+	"tailscale.com/health"
+	"tailscale.com/wgengine/router"
+)
+
+// prefixesOverlap reports whether a and b have addresses in common.
+func prefixesOverlap(a, b netaddr.IPPrefix) bool {
+	if a.IP.Is4() != b.IP.Is4() {
+		return false
+	}
+	if a.Bits > b.Bits {
+		a, b = b, a
+	}
+	return a.Contains(b.IP)
+}
+
+// keepLANsLocal changes rs so that accepted subnet routes don't take
+// over the addresses of this machine's LAN subnets lans, which would
+// cut it off from its printers and gateway: a route within a LAN
+// isn't installed, and a LAN within a route is added to
+// rs.LocalRoutes. Default routes, which ExitNodeAllowLANAccess
+// governs, and routes to Tailscale addresses are left alone. It
+// returns a description of each conflict, sorted.
+func keepLANsLocal(rs *router.Config, lans []netaddr.IPPrefix) (conflicts []string) {
+	local := make(map[netaddr.IPPrefix]bool)
+	for _, r := range rs.LocalRoutes {
+		local[r] = true
+	}
+	routes := rs.Routes[:0]
+	for _, r := range rs.Routes {
+		keep := true
+		if r.Bits != 0 && !isTailscaleRoute(r) {
+			for _, lan := range lans {
+				if !prefixesOverlap(r, lan) {
+					continue
+				}
+				conflicts = append(conflicts, fmt.Sprintf("%v overlaps %v", r, lan))
+				if r.Bits >= lan.Bits {
+					keep = false
+				} else if !local[lan] {
+					local[lan] = true
+					rs.LocalRoutes = append(rs.LocalRoutes, lan)
+				}
+			}
+		}
+		if keep {
+			routes = append(routes, r)
+		} else {
+			delete(rs.RouteMetrics, r)
+		}
+	}
+	rs.Routes = routes
+	sort.Strings(conflicts)
+	return conflicts
+}
+
+// setRouteConflictHealth reports conflicts, as returned by
+// keepLANsLocal, to the health package.
+func setRouteConflictHealth(conflicts []string) {
+	if len(conflicts) == 0 {
+		health.Set(health.SysRouteConflicts, nil)
+		return
+	}
+	health.Set(health.SysRouteConflicts, fmt.Errorf("accepted routes overlap local networks, which stay local (use --allow-routes-over-lan to route them anyway): %s", strings.Join(conflicts, ", ")))
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/wgengine/router"
+)
+
+func TestKeepLANsLocal(t *testing.T) {
+	rs := &router.Config{
+		Routes: mustPrefixes(t,
+			"100.64.0.0/10", "100.100.100.100/32", "0.0.0.0/0",
+			"10.0.0.0/8", "192.168.1.0/24", "192.168.1.128/25", "172.16.0.0/12"),
+		LocalRoutes: mustPrefixes(t, "10.1.2.0/24"),
+		RouteMetrics: map[netaddr.IPPrefix]uint32{
+			mustPrefixes(t, "192.168.1.0/24")[0]: 500,
+			mustPrefixes(t, "10.0.0.0/8")[0]:     500,
+		},
+	}
+	lans := mustPrefixes(t, "10.1.2.0/24", "192.168.1.0/24", "fd00::/64")
+	conflicts := keepLANsLocal(rs, lans)
+
+	wantConflicts := []string{
+		"10.0.0.0/8 overlaps 10.1.2.0/24",
+		"192.168.1.0/24 overlaps 192.168.1.0/24",
+		"192.168.1.128/25 overlaps 192.168.1.0/24",
+	}
+	if !reflect.DeepEqual(conflicts, wantConflicts) {
+		t.Errorf("conflicts = %q; want %q", conflicts, wantConflicts)
+	}
+	wantRoutes := mustPrefixes(t, "100.64.0.0/10", "100.100.100.100/32", "0.0.0.0/0", "10.0.0.0/8", "172.16.0.0/12")
+	if !reflect.DeepEqual(rs.Routes, wantRoutes) {
+		t.Errorf("Routes = %v; want %v", rs.Routes, wantRoutes)
+	}
+	if want := mustPrefixes(t, "10.1.2.0/24"); !reflect.DeepEqual(rs.LocalRoutes, want) {
+		t.Errorf("LocalRoutes = %v; want %v", rs.LocalRoutes, want)
+	}
+	wantMetrics := map[netaddr.IPPrefix]uint32{mustPrefixes(t, "10.0.0.0/8")[0]: 500}
+	if !reflect.DeepEqual(rs.RouteMetrics, wantMetrics) {
+		t.Errorf("RouteMetrics = %v; want %v", rs.RouteMetrics, wantMetrics)
+	}
+
+	rs = &router.Config{Routes: mustPrefixes(t, "10.0.0.0/8")}
+	keepLANsLocal(rs, lans)
+	if want := mustPrefixes(t, "10.1.2.0/24"); !reflect.DeepEqual(rs.LocalRoutes, want) {
+		t.Errorf("LocalRoutes = %v; want %v", rs.LocalRoutes, want)
+	}
+}
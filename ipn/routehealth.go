@@ -0,0 +1,206 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/health"
+	"tailscale.com/net/routecheck"
+)
+
+const (
+	// routeCheckInterval is how often the checks in
+	// Prefs.AdvertiseRouteChecks are run.
+	routeCheckInterval = 15 * time.Second
+
+	// routeCheckTimeout is how long a check may take before it's
+	// counted as failed.
+	routeCheckTimeout = 5 * time.Second
+
+	// routeCheckMaxFailures is how many checks in a row a route
+	// may fail before it's withdrawn. A single passing check
+	// restores it.
+	routeCheckMaxFailures = 3
+)
+
+// ParseRouteCheck parses s, an element of Prefs.AdvertiseRouteChecks.
+func ParseRouteCheck(s string) (wgcfg.CIDR, routecheck.Check, error) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return wgcfg.CIDR{}, routecheck.Check{}, fmt.Errorf("route check %q: want ROUTE=CHECK", s)
+	}
+	route, err := wgcfg.ParseCIDR(s[:i])
+	if err != nil {
+		return wgcfg.CIDR{}, routecheck.Check{}, fmt.Errorf("route check %q: %v", s, err)
+	}
+	c, err := routecheck.Parse(s[i+1:])
+	if err != nil {
+		return wgcfg.CIDR{}, routecheck.Check{}, err
+	}
+	return route, c, nil
+}
+
+// routeChecks returns the valid checks of p.AdvertiseRouteChecks by
+// route. Invalid ones are logged and ignored.
+func (b *LocalBackend) routeChecks(p *Prefs) map[wgcfg.CIDR][]routecheck.Check {
+	if p == nil || len(p.AdvertiseRouteChecks) == 0 {
+		return nil
+	}
+	ret := make(map[wgcfg.CIDR][]routecheck.Check)
+	for _, s := range p.AdvertiseRouteChecks {
+		route, c, err := ParseRouteCheck(s)
+		if err != nil {
+			b.logf("ignoring %v", err)
+			continue
+		}
+		ret[route] = append(ret[route], c)
+	}
+	return ret
+}
+
+// routeWithdrawnLocked reports whether the route r has failed its
+// checks and shouldn't be advertised. b.mu must be held.
+func (b *LocalBackend) routeWithdrawnLocked(r wgcfg.CIDR) bool {
+	return b.routeFailures[r] >= routeCheckMaxFailures
+}
+
+// startRouteChecksLocked starts routeCheckLoop if p has route checks
+// and it's not already running. b.mu must be held.
+func (b *LocalBackend) startRouteChecksLocked(p *Prefs) {
+	if p == nil || len(p.AdvertiseRouteChecks) == 0 || b.routeChecking {
+		return
+	}
+	b.routeChecking = true
+	go b.routeCheckLoop()
+}
+
+// routeCheckLoop periodically runs the checks of the advertised
+// routes while there are any, and withdraws the routes that keep
+// failing them, or restores them once they pass again.
+func (b *LocalBackend) routeCheckLoop() {
+	t := time.NewTicker(routeCheckInterval)
+	defer t.Stop()
+	for {
+		b.mu.Lock()
+		checks := b.routeChecks(b.prefs)
+		withdrawn := false
+		if len(checks) == 0 {
+			for r := range b.routeFailures {
+				withdrawn = withdrawn || b.routeWithdrawnLocked(r)
+			}
+			b.routeChecking = false
+			b.routeFailures = nil
+		}
+		b.mu.Unlock()
+		if len(checks) == 0 {
+			health.Set(health.SysSubnetRoutes, nil)
+			if withdrawn {
+				b.routesHealthChanged()
+			}
+			return
+		}
+
+		if b.runRouteChecks(checks) {
+			b.routesHealthChanged()
+		}
+
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// runRouteChecks runs checks concurrently and records the results. A
+// route passes if any of its checks does. It reports whether that
+// changed which routes are withdrawn.
+func (b *LocalBackend) runRouteChecks(checks map[wgcfg.CIDR][]routecheck.Check) (changed bool) {
+	type result struct {
+		route wgcfg.CIDR
+		err   error
+	}
+	results := make(chan result, len(checks))
+	for route, cs := range checks {
+		go func(route wgcfg.CIDR, cs []routecheck.Check) {
+			ctx, cancel := context.WithTimeout(b.ctx, routeCheckTimeout)
+			defer cancel()
+			var err error
+			for _, c := range cs {
+				if err = c.Run(ctx); err == nil {
+					break
+				}
+			}
+			results <- result{route, err}
+		}(route, cs)
+	}
+	errs := make(map[wgcfg.CIDR]error, len(checks))
+	for range checks {
+		r := <-results
+		errs[r.route] = r.err
+	}
+	if b.ctx.Err() != nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	old := b.routeFailures
+	b.routeFailures = make(map[wgcfg.CIDR]int, len(errs))
+	for route, err := range errs {
+		if err != nil {
+			b.routeFailures[route] = old[route] + 1
+		}
+	}
+	var down []string
+	for route, err := range errs {
+		was := old[route] >= routeCheckMaxFailures
+		now := b.routeWithdrawnLocked(route)
+		switch {
+		case now && !was:
+			b.logf("route %v failed %d checks in a row; withdrawing it: %v", route, b.routeFailures[route], err)
+			changed = true
+		case was && !now:
+			b.logf("route %v passed its check; advertising it again", route)
+			changed = true
+		}
+		if now {
+			down = append(down, fmt.Sprintf("%v (%v)", route, err))
+		}
+	}
+	if len(down) == 0 {
+		health.Set(health.SysSubnetRoutes, nil)
+	} else {
+		sort.Strings(down)
+		health.Set(health.SysSubnetRoutes, fmt.Errorf("withdrawn unreachable routes: %s", strings.Join(down, ", ")))
+	}
+	return changed
+}
+
+// routesHealthChanged tells the control server and the engine about a
+// change in which advertised routes are withdrawn.
+func (b *LocalBackend) routesHealthChanged() {
+	b.mu.Lock()
+	if b.prefs == nil || b.hostinfo == nil {
+		b.mu.Unlock()
+		return
+	}
+	prefs := b.prefs.Clone()
+	netMap := b.netMap
+	newHi := b.hostinfo.Clone()
+	newHi.RoutableIPs = b.hostinfoRoutesLocked(b.prefs)
+	b.hostinfo = newHi
+	b.mu.Unlock()
+
+	b.doSetHostinfoFilterServices(newHi)
+	b.updateFilter(netMap, prefs)
+	b.authReconfig()
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
+	"tailscale.com/health"
+	"tailscale.com/net/routecheck"
+)
+
+func TestParseRouteCheck(t *testing.T) {
+	tests := []struct {
+		in      string
+		route   string
+		check   string
+		wantErr bool
+	}{
+		{in: "10.0.0.0/24=tcp:10.0.0.1:22", route: "10.0.0.0/24", check: "tcp:10.0.0.1:22"},
+		{in: "fd00::/64=ping:fd00::1", route: "fd00::/64", check: "ping:fd00::1"},
+		{in: "10.0.0.0/24", wantErr: true},
+		{in: "10.0.0.0=ping:10.0.0.1", wantErr: true},
+		{in: "10.0.0.0/24=http:10.0.0.1", wantErr: true},
+	}
+	for _, tt := range tests {
+		route, c, err := ParseRouteCheck(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRouteCheck(%q) error = %v; want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if route.String() != tt.route || c.String() != tt.check {
+			t.Errorf("ParseRouteCheck(%q) = %v, %v; want %v, %v", tt.in, route, c, tt.route, tt.check)
+		}
+	}
+}
+
+func TestRouteChecks(t *testing.T) {
+	defer health.Set(health.SysSubnetRoutes, nil)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	cidr := func(s string) wgcfg.CIDR {
+		c, err := wgcfg.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	tcpCheck := func(addr net.Addr) routecheck.Check {
+		return routecheck.Check{
+			Kind: "tcp",
+			IP:   netaddr.IPv4(127, 0, 0, 1),
+			Port: uint16(addr.(*net.TCPAddr).Port),
+		}
+	}
+	up, down := cidr("10.1.0.0/16"), cidr("10.2.0.0/16")
+	checks := map[wgcfg.CIDR][]routecheck.Check{
+		up:   {tcpCheck(ln.Addr())},
+		down: {tcpCheck(closed.Addr())},
+	}
+
+	b := &LocalBackend{ctx: context.Background(), logf: t.Logf}
+	p := NewPrefs()
+	p.AdvertiseRoutes = []wgcfg.CIDR{up, down}
+	for i := 1; i <= routeCheckMaxFailures; i++ {
+		changed := b.runRouteChecks(checks)
+		if want := i == routeCheckMaxFailures; changed != want {
+			t.Errorf("run %d: changed = %v; want %v", i, changed, want)
+		}
+	}
+	if got, want := fmt.Sprint(b.advertiseRoutesLocked(p)), "[10.1.0.0/16]"; got != want {
+		t.Errorf("routes after failures = %s; want %s", got, want)
+	}
+	if health.Get().Problems[health.SysSubnetRoutes] == "" {
+		t.Errorf("withdrawn route not reported in health")
+	}
+
+	// One passing check restores the route.
+	checks[down] = append(checks[down], tcpCheck(ln.Addr()))
+	if !b.runRouteChecks(checks) {
+		t.Errorf("restoring run: changed = false")
+	}
+	if got, want := fmt.Sprint(b.advertiseRoutesLocked(p)), "[10.1.0.0/16 10.2.0.0/16]"; got != want {
+		t.Errorf("routes after recovery = %s; want %s", got, want)
+	}
+	if msg := health.Get().Problems[health.SysSubnetRoutes]; msg != "" {
+		t.Errorf("health still reports %q", msg)
+	}
+}
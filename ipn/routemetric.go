@@ -0,0 +1,90 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/tsaddr"
+)
+
+// ParseRouteMetric parses s, an element of Prefs.RouteMetrics.
+func ParseRouteMetric(s string) (netaddr.IPPrefix, uint32, error) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return netaddr.IPPrefix{}, 0, fmt.Errorf("route metric %q: want ROUTE=METRIC", s)
+	}
+	route, err := netaddr.ParseIPPrefix(s[:i])
+	if err != nil {
+		return netaddr.IPPrefix{}, 0, fmt.Errorf("route metric %q: %v", s, err)
+	}
+	if route != route.Masked() {
+		return netaddr.IPPrefix{}, 0, fmt.Errorf("route metric %q: %v has non-address bits set; expected %v", s, route, route.Masked())
+	}
+	metric, err := strconv.ParseUint(s[i+1:], 10, 32)
+	if err != nil || metric == 0 {
+		return netaddr.IPPrefix{}, 0, fmt.Errorf("route metric %q: metric must be a number from 1 to %d", s, uint32(1<<32-1))
+	}
+	return route, uint32(metric), nil
+}
+
+// routeMetrics returns the metrics that metrics, the value of
+// Prefs.RouteMetrics, gives routes: each subnet route gets that of
+// the most specific ROUTE containing it, if any. Routes to Tailscale
+// addresses keep the platform's default. Invalid elements of metrics
+// are ignored.
+func routeMetrics(routes []netaddr.IPPrefix, metrics []string) map[netaddr.IPPrefix]uint32 {
+	if len(metrics) == 0 {
+		return nil
+	}
+	type rm struct {
+		route  netaddr.IPPrefix
+		metric uint32
+	}
+	var rms []rm
+	for _, s := range metrics {
+		route, metric, err := ParseRouteMetric(s)
+		if err == nil {
+			rms = append(rms, rm{route, metric})
+		}
+	}
+	var ret map[netaddr.IPPrefix]uint32
+	for _, r := range routes {
+		if isTailscaleRoute(r) {
+			continue
+		}
+		best := -1
+		for i, m := range rms {
+			if m.route.IP.Is4() != r.IP.Is4() || m.route.Bits > r.Bits || !m.route.Contains(r.IP) {
+				continue
+			}
+			if best < 0 || m.route.Bits > rms[best].route.Bits {
+				best = i
+			}
+		}
+		if best < 0 {
+			continue
+		}
+		if ret == nil {
+			ret = make(map[netaddr.IPPrefix]uint32)
+		}
+		ret[r] = rms[best].metric
+	}
+	return ret
+}
+
+// isTailscaleRoute reports whether r is within the addresses
+// Tailscale assigns to nodes.
+func isTailscaleRoute(r netaddr.IPPrefix) bool {
+	for _, ts := range []netaddr.IPPrefix{tsaddr.CGNATRange(), tsaddr.TailscaleULARange()} {
+		if ts.IP.Is4() == r.IP.Is4() && ts.Bits <= r.Bits && ts.Contains(r.IP) {
+			return true
+		}
+	}
+	return false
+}
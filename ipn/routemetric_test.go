@@ -0,0 +1,64 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestParseRouteMetric(t *testing.T) {
+	tests := []struct {
+		in     string
+		route  string
+		metric uint32
+		ok     bool
+	}{
+		{"10.0.0.0/8=500", "10.0.0.0/8", 500, true},
+		{"::/0=1", "::/0", 1, true},
+		{"10.0.0.0/8=4294967295", "10.0.0.0/8", 4294967295, true},
+		{"10.0.0.0/8", "", 0, false},
+		{"10.0.0.1/8=500", "", 0, false},
+		{"10.0.0.0/8=0", "", 0, false},
+		{"10.0.0.0/8=4294967296", "", 0, false},
+		{"10.0.0.0/8=-1", "", 0, false},
+		{"bogus=500", "", 0, false},
+	}
+	for _, tt := range tests {
+		route, metric, err := ParseRouteMetric(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseRouteMetric(%q) error = %v; want success %v", tt.in, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if route.String() != tt.route || metric != tt.metric {
+			t.Errorf("ParseRouteMetric(%q) = %v, %d; want %s, %d", tt.in, route, metric, tt.route, tt.metric)
+		}
+	}
+}
+
+func TestRouteMetrics(t *testing.T) {
+	routes := mustPrefixes(t,
+		"100.64.0.0/10", "100.100.100.100/32", "fd7a:115c:a1e0::/48",
+		"0.0.0.0/0", "10.0.0.0/8", "10.1.0.0/16", "192.168.1.0/24", "2001:db8::/32")
+	got := routeMetrics(routes, []string{"0.0.0.0/0=500", "10.0.0.0/8=50", "bogus", "2001:db8::/32=5"})
+	want := map[netaddr.IPPrefix]uint32{
+		mustPrefixes(t, "0.0.0.0/0")[0]:      500,
+		mustPrefixes(t, "10.0.0.0/8")[0]:     50,
+		mustPrefixes(t, "10.1.0.0/16")[0]:    50,
+		mustPrefixes(t, "192.168.1.0/24")[0]: 500,
+		mustPrefixes(t, "2001:db8::/32")[0]:  5,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("routeMetrics = %v; want %v", got, want)
+	}
+	if got := routeMetrics(routes, nil); got != nil {
+		t.Errorf("routeMetrics without metrics = %v; want nil", got)
+	}
+}
@@ -0,0 +1,412 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// ServeConfigStateKey is the StateKey under which the ServeConfig is
+// persisted.
+const ServeConfigStateKey = StateKey("_serve")
+
+// servePort is the TCP port on which the node's Tailscale IPs serve
+// the ServeConfig's web handlers over HTTPS.
+const servePort = 443
+
+// ServeConfig is the configuration of the services that the node
+// publishes to its tailnet over HTTPS, under its MagicDNS name.
+type ServeConfig struct {
+	// Web maps URL path prefixes (mount points, starting and, for
+	// anything but "/", not ending with a slash) to their handlers.
+	// Requests go to the handler with the longest matching mount
+	// point.
+	Web map[string]*HTTPHandler `json:",omitempty"`
+}
+
+// HTTPHandler is a ServeConfig web handler. Exactly one of its fields
+// must be set.
+type HTTPHandler struct {
+	// Proxy is the http:// or https:// URL base of a local server
+	// to reverse proxy requests to.
+	Proxy string `json:",omitempty"`
+
+	// Path is the absolute path of a file, or a directory of
+	// files, to serve.
+	Path string `json:",omitempty"`
+
+	// Text is a static plain text response.
+	Text string `json:",omitempty"`
+}
+
+// Clone returns a deep copy of sc.
+func (sc *ServeConfig) Clone() *ServeConfig {
+	if sc == nil {
+		return nil
+	}
+	ret := &ServeConfig{}
+	if sc.Web != nil {
+		ret.Web = make(map[string]*HTTPHandler, len(sc.Web))
+		for k, h := range sc.Web {
+			h2 := *h
+			ret.Web[k] = &h2
+		}
+	}
+	return ret
+}
+
+// Check reports whether sc is a valid ServeConfig.
+func (sc *ServeConfig) Check() error {
+	for mount, h := range sc.Web {
+		if !validMountPoint(mount) {
+			return fmt.Errorf("invalid mount point %q", mount)
+		}
+		if err := h.check(); err != nil {
+			return fmt.Errorf("%s: %v", mount, err)
+		}
+	}
+	return nil
+}
+
+func validMountPoint(mount string) bool {
+	if mount == "/" {
+		return true
+	}
+	return strings.HasPrefix(mount, "/") && !strings.HasSuffix(mount, "/") &&
+		!strings.Contains(mount, "//") && !strings.Contains(mount, "/../") &&
+		!strings.HasSuffix(mount, "/..")
+}
+
+func (h *HTTPHandler) check() error {
+	n := 0
+	for _, s := range []string{h.Proxy, h.Path, h.Text} {
+		if s != "" {
+			n++
+		}
+	}
+	if n != 1 {
+		return errors.New("handler must have exactly one of Proxy, Path or Text")
+	}
+	if h.Proxy != "" {
+		u, err := url.Parse(h.Proxy)
+		if err != nil {
+			return err
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("proxy target %q is not an http or https URL", h.Proxy)
+		}
+	}
+	if h.Path != "" && !strings.HasPrefix(h.Path, "/") {
+		return fmt.Errorf("path %q is not absolute", h.Path)
+	}
+	return nil
+}
+
+// ServeConfig returns a copy of the current ServeConfig, which is
+// empty if nothing is being served.
+func (b *LocalBackend) ServeConfig() *ServeConfig {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.serveConfig == nil {
+		return &ServeConfig{}
+	}
+	return b.serveConfig.Clone()
+}
+
+// SetServeConfig replaces the ServeConfig with sc, persists it, and
+// starts or stops serving as needed.
+func (b *LocalBackend) SetServeConfig(sc *ServeConfig) error {
+	if sc == nil {
+		sc = &ServeConfig{}
+	}
+	if err := sc.Check(); err != nil {
+		return err
+	}
+	sc = sc.Clone()
+	j, err := json.Marshal(sc)
+	if err != nil {
+		return err
+	}
+	if err := b.store.WriteState(ServeConfigStateKey, j); err != nil {
+		return fmt.Errorf("saving serve config: %v", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.serveConfig = sc
+	b.initServeListenersLocked()
+	return nil
+}
+
+// loadServeConfigLocked reads the persisted ServeConfig, if any.
+// b.mu must be held.
+func (b *LocalBackend) loadServeConfigLocked() {
+	j, err := b.store.ReadState(ServeConfigStateKey)
+	if err == ErrStateNotExist {
+		return
+	}
+	if err != nil {
+		b.logf("serve: reading config: %v", err)
+		return
+	}
+	sc := new(ServeConfig)
+	if err := json.Unmarshal(j, sc); err != nil {
+		b.logf("serve: invalid stored config: %v", err)
+		return
+	}
+	b.serveConfig = sc
+}
+
+// serveListener is a listener on one of the node's Tailscale IPs
+// serving the ServeConfig's web handlers.
+type serveListener struct {
+	ip  netaddr.IP
+	ln  net.Listener
+	srv *http.Server
+}
+
+// initServeListenersLocked starts or stops the HTTPS listeners
+// according to the ServeConfig and the node's current Tailscale IPs.
+// b.mu must be held.
+func (b *LocalBackend) initServeListenersLocked() {
+	if b.serveConfig == nil || len(b.serveConfig.Web) == 0 || b.netMap == nil || b.netMap.Name == "" {
+		b.closeServeListenersLocked()
+		return
+	}
+	ips := make([]netaddr.IP, 0, len(b.netMap.Addresses))
+	for _, pfx := range wgCIDRsToNetaddr(b.netMap.Addresses) {
+		ips = append(ips, pfx.IP)
+	}
+	if len(ips) == len(b.serveListeners) {
+		same := true
+		for i, sl := range b.serveListeners {
+			if sl.ip != ips[i] {
+				same = false
+				break
+			}
+		}
+		if same {
+			return
+		}
+	}
+	b.closeServeListenersLocked()
+
+	for _, ip := range ips {
+		addr := netaddr.IPPort{IP: ip, Port: servePort}
+		ln, err := net.Listen("tcp", addr.String())
+		if err != nil {
+			b.logf("serve: listen on %v: %v", addr, err)
+			continue
+		}
+		srv := &http.Server{
+			Handler: http.HandlerFunc(b.serveWeb),
+			TLSConfig: &tls.Config{
+				GetCertificate: b.getServeCert,
+			},
+		}
+		sl := &serveListener{ip: ip, ln: ln, srv: srv}
+		b.serveListeners = append(b.serveListeners, sl)
+		b.logf("serve: serving on %v", addr)
+		go func() {
+			err := sl.srv.ServeTLS(sl.ln, "", "")
+			b.logf("serve: %v listener closed: %v", sl.ip, err)
+		}()
+	}
+}
+
+func (b *LocalBackend) closeServeListenersLocked() {
+	for _, sl := range b.serveListeners {
+		sl.srv.Close()
+	}
+	b.serveListeners = nil
+}
+
+// serveWeb dispatches a request to the ServeConfig web handler with
+// the longest mount point matching the request path.
+func (b *LocalBackend) serveWeb(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	sc := b.serveConfig
+	b.mu.Unlock()
+	if sc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	mount, h, ok := sc.handlerForPath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case h.Text != "":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, h.Text)
+	case h.Path != "":
+		b.serveFileHandler(w, r, mount, h.Path)
+	case h.Proxy != "":
+		u, err := url.Parse(h.Proxy)
+		if err != nil {
+			http.Error(w, "bad proxy config", http.StatusInternalServerError)
+			return
+		}
+		rp := httputil.NewSingleHostReverseProxy(u)
+		http.StripPrefix(strings.TrimSuffix(mount, "/"), rp).ServeHTTP(w, r)
+	}
+}
+
+func (b *LocalBackend) serveFileHandler(w http.ResponseWriter, r *http.Request, mount, path string) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		b.logf("serve: %v", err)
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if !fi.IsDir() {
+		http.ServeFile(w, r, path)
+		return
+	}
+	http.StripPrefix(strings.TrimSuffix(mount, "/"), http.FileServer(http.Dir(path))).ServeHTTP(w, r)
+}
+
+// handlerForPath returns the web handler for the request path p.
+func (sc *ServeConfig) handlerForPath(p string) (mount string, h *HTTPHandler, ok bool) {
+	mounts := make([]string, 0, len(sc.Web))
+	for m := range sc.Web {
+		mounts = append(mounts, m)
+	}
+	// Longest first.
+	sort.Slice(mounts, func(i, j int) bool { return len(mounts[i]) > len(mounts[j]) })
+	for _, m := range mounts {
+		if m == "/" || p == m || strings.HasPrefix(p, m+"/") {
+			return m, sc.Web[m], true
+		}
+	}
+	return "", nil, false
+}
+
+// getServeCert returns the TLS certificate for the node's MagicDNS
+// name.
+//
+// It's a certificate from GetCertPEM if possible. Otherwise, such as
+// when the tailnet doesn't support certificates, it's a self-signed
+// certificate, and getting a real one is retried every
+// serveCertRetry.
+func (b *LocalBackend) getServeCert(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	b.mu.Lock()
+	if b.netMap == nil || b.netMap.Name == "" {
+		b.mu.Unlock()
+		return nil, errors.New("no MagicDNS name")
+	}
+	name := strings.TrimSuffix(b.netMap.Name, ".")
+	now := time.Now()
+	c := b.serveCert
+	retry := now.After(b.serveCertFailed.Add(serveCertRetry))
+	b.mu.Unlock()
+
+	if c != nil && c.Leaf.Subject.CommonName == name {
+		selfSigned := c.Leaf.Issuer.CommonName == c.Leaf.Subject.CommonName
+		if now.Add(certRenewWindow).Before(c.Leaf.NotAfter) && (!selfSigned || !retry) {
+			return c, nil
+		}
+	}
+
+	if retry {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+		defer cancel()
+		certPEM, keyPEM, err := b.GetCertPEM(ctx, name)
+		if err == nil {
+			c, err = parseCertPair(certPEM, keyPEM)
+		}
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if err == nil {
+			b.serveCert = c
+			return c, nil
+		}
+		b.logf("serve: using self-signed certificate: %v", err)
+		b.serveCertFailed = now
+	} else {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+	}
+	if c := b.serveCert; c != nil && c.Leaf.Subject.CommonName == name && now.Before(c.Leaf.NotAfter) {
+		return c, nil
+	}
+	c, err := selfSignedCert(name)
+	if err != nil {
+		return nil, err
+	}
+	b.serveCert = c
+	return c, nil
+}
+
+// serveCertRetry is how often getServeCert retries getting a
+// certificate from GetCertPEM after a failure.
+const serveCertRetry = 10 * time.Minute
+
+func parseCertPair(certPEM, keyPEM []byte) (*tls.Certificate, error) {
+	c, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	c.Leaf, err = x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func selfSignedCert(name string) (*tls.Certificate, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  priv,
+		Leaf:        leaf,
+	}, nil
+}
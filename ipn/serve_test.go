@@ -0,0 +1,64 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import "testing"
+
+func TestServeConfigCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		sc   *ServeConfig
+		ok   bool
+	}{
+		{"empty", &ServeConfig{}, true},
+		{"root_proxy", &ServeConfig{Web: map[string]*HTTPHandler{"/": {Proxy: "http://127.0.0.1:3000"}}}, true},
+		{"sub_path", &ServeConfig{Web: map[string]*HTTPHandler{"/docs": {Path: "/srv/docs"}}}, true},
+		{"trailing_slash", &ServeConfig{Web: map[string]*HTTPHandler{"/docs/": {Path: "/srv/docs"}}}, false},
+		{"relative_mount", &ServeConfig{Web: map[string]*HTTPHandler{"docs": {Text: "hi"}}}, false},
+		{"dotdot", &ServeConfig{Web: map[string]*HTTPHandler{"/a/../b": {Text: "hi"}}}, false},
+		{"no_handler", &ServeConfig{Web: map[string]*HTTPHandler{"/": {}}}, false},
+		{"two_handlers", &ServeConfig{Web: map[string]*HTTPHandler{"/": {Text: "hi", Path: "/tmp"}}}, false},
+		{"relative_path", &ServeConfig{Web: map[string]*HTTPHandler{"/": {Path: "www"}}}, false},
+		{"bad_proxy_scheme", &ServeConfig{Web: map[string]*HTTPHandler{"/": {Proxy: "ftp://foo"}}}, false},
+	}
+	for _, tt := range tests {
+		err := tt.sc.Check()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: Check = %v; want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestServeHandlerForPath(t *testing.T) {
+	sc := &ServeConfig{Web: map[string]*HTTPHandler{
+		"/":        {Text: "root"},
+		"/api":     {Proxy: "http://127.0.0.1:8080"},
+		"/api/v2":  {Proxy: "http://127.0.0.1:8082"},
+		"/apidocs": {Path: "/srv/apidocs"},
+	}}
+	tests := []struct {
+		path, want string
+	}{
+		{"/", "/"},
+		{"/foo", "/"},
+		{"/api", "/api"},
+		{"/api/", "/api"},
+		{"/api/v1/users", "/api"},
+		{"/api/v2/users", "/api/v2"},
+		{"/apidocs/index.html", "/apidocs"},
+		{"/apix", "/"},
+	}
+	for _, tt := range tests {
+		mount, _, ok := sc.handlerForPath(tt.path)
+		if !ok || mount != tt.want {
+			t.Errorf("handlerForPath(%q) = %q, %v; want %q", tt.path, mount, ok, tt.want)
+		}
+	}
+
+	sc = &ServeConfig{Web: map[string]*HTTPHandler{"/api": {Text: "api"}}}
+	if _, _, ok := sc.handlerForPath("/other"); ok {
+		t.Errorf("handlerForPath(/other) matched without a root handler")
+	}
+}
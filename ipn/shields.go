@@ -0,0 +1,70 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"fmt"
+	"strings"
+
+	"inet.af/netaddr"
+	"tailscale.com/control/controlclient"
+	"tailscale.com/tailcfg"
+	"tailscale.com/wgengine/filter"
+)
+
+// CheckShieldsUpAllowFrom reports whether s is a valid entry of
+// Prefs.ShieldsUpAllowFrom: an ACL tag or a Tailscale IP.
+func CheckShieldsUpAllowFrom(s string) error {
+	if strings.HasPrefix(s, "tag:") {
+		return tailcfg.CheckTag(s)
+	}
+	if _, err := netaddr.ParseIP(s); err != nil {
+		return fmt.Errorf("%q is neither an ACL tag nor an IP address", s)
+	}
+	return nil
+}
+
+// shieldsUpRules returns the rules letting in the exceptions to
+// shields up in prefs, for filter.Intersect with the netmap's packet
+// filter, or nil if there are none. Tags are matched against the tags
+// control assigned the peers (see taggedPeerSrcs).
+func shieldsUpRules(prefs *Prefs, nm *controlclient.NetworkMap) []filter.Match {
+	if prefs == nil || (len(prefs.ShieldsUpAllowFrom) == 0 && len(prefs.ShieldsUpAllowPorts) == 0) {
+		return nil
+	}
+	srcs := allIPs
+	if len(prefs.ShieldsUpAllowFrom) > 0 {
+		var tags []string
+		srcs = nil
+		for _, s := range prefs.ShieldsUpAllowFrom {
+			if strings.HasPrefix(s, "tag:") {
+				tags = append(tags, s)
+				continue
+			}
+			ip, err := netaddr.ParseIP(s)
+			if err != nil {
+				continue // rejected by CheckShieldsUpAllowFrom
+			}
+			bits := uint8(32)
+			if ip.Is6() {
+				bits = 128
+			}
+			srcs = append(srcs, netaddr.IPPrefix{IP: ip, Bits: bits})
+		}
+		srcs = append(srcs, taggedPeerSrcs(nm, tags)...)
+	}
+	dsts := allDsts
+	if len(prefs.ShieldsUpAllowPorts) > 0 {
+		dsts = nil
+		for _, port := range prefs.ShieldsUpAllowPorts {
+			dsts = append(dsts, portDsts(filter.PortRange{First: port, Last: port})...)
+		}
+	}
+	rules := []filter.Match{} // non-nil: with no srcs, nothing gets in
+	if len(srcs) > 0 {
+		rules = append(rules, filter.Match{Srcs: srcs, Dsts: dsts})
+	}
+	return rules
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/control/controlclient"
+	"tailscale.com/tailcfg"
+)
+
+func TestShieldsUpRules(t *testing.T) {
+	node := func(addr string) *tailcfg.Node {
+		c, err := wgcfg.ParseCIDR(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &tailcfg.Node{Addresses: []wgcfg.CIDR{c}}
+	}
+	admin := node("100.64.0.1/32")
+	admin.Tags = []string{"tag:admin"}
+	claimer := node("100.64.0.2/32") // asks for tag:admin, but doesn't have it
+	claimer.Hostinfo.RequestTags = []string{"tag:admin"}
+	nm := &controlclient.NetworkMap{Peers: []*tailcfg.Node{admin, claimer}}
+
+	tests := []struct {
+		name  string
+		prefs *Prefs
+		want  string // the rule, or "nil"
+	}{
+		{"none", &Prefs{ShieldsUp: true}, "nil"},
+		{
+			// Both exceptions narrow the one rule: only that IP, and
+			// only to those ports.
+			name:  "ip_and_ports",
+			prefs: &Prefs{ShieldsUp: true, ShieldsUpAllowFrom: []string{"100.64.0.9"}, ShieldsUpAllowPorts: []uint16{22, 443}},
+			want:  "[100.64.0.9/32=>[0.0.0.0/0:22,::/0:22,0.0.0.0/0:443,::/0:443]]",
+		},
+		{
+			name:  "ipv6",
+			prefs: &Prefs{ShieldsUp: true, ShieldsUpAllowFrom: []string{"fd7a:115c:a1e0::9"}},
+			want:  "[fd7a:115c:a1e0::9/128=>[0.0.0.0/0:*,::/0:*]]",
+		},
+		{
+			name:  "tag_and_ip",
+			prefs: &Prefs{ShieldsUp: true, ShieldsUpAllowFrom: []string{"tag:admin", "100.64.0.9"}, ShieldsUpAllowPorts: []uint16{22}},
+			want:  "[[100.64.0.9/32,100.64.0.1/32]=>[0.0.0.0/0:22,::/0:22]]",
+		},
+		{
+			name:  "port_from_anyone",
+			prefs: &Prefs{ShieldsUp: true, ShieldsUpAllowPorts: []uint16{22}},
+			want:  "[[0.0.0.0/0,::/0]=>[0.0.0.0/0:22,::/0:22]]",
+		},
+		{
+			// A tag no peer has lets nobody in, rather than
+			// dropping the source restriction.
+			name:  "unknown_tag_with_port",
+			prefs: &Prefs{ShieldsUp: true, ShieldsUpAllowFrom: []string{"tag:nobody"}, ShieldsUpAllowPorts: []uint16{22}},
+			want:  "[]",
+		},
+		{
+			name:  "invalid_entry_ignored",
+			prefs: &Prefs{ShieldsUp: true, ShieldsUpAllowFrom: []string{"bogus", "100.64.0.9"}},
+			want:  "[100.64.0.9/32=>[0.0.0.0/0:*,::/0:*]]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := shieldsUpRules(tt.prefs, nm)
+			got := "nil"
+			if rules != nil {
+				got = fmt.Sprint(rules)
+			}
+			if got != tt.want {
+				t.Errorf("rules = %s; want %s", got, tt.want)
+			}
+		})
+	}
+
+	if err := CheckShieldsUpAllowFrom("tag:admin"); err != nil {
+		t.Error(err)
+	}
+	if err := CheckShieldsUpAllowFrom("100.64.0.1"); err != nil {
+		t.Error(err)
+	}
+	if err := CheckShieldsUpAllowFrom("admin"); err == nil {
+		t.Error("bare name accepted")
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/filter"
+)
+
+// SSHServer is an SSH server run by LocalBackend on the node's
+// Tailscale IPs while Prefs.RunSSH is set.
+type SSHServer interface {
+	// Serve serves SSH connections accepted from ln until ln is
+	// closed. LocalBackend only hands it connections from peers
+	// the packet filter allows to reach port 22; the server
+	// should use LocalBackend.WhoIs to identify the user, and
+	// LocalBackend.CheckSSHLogin before logging them in.
+	Serve(ln net.Listener) error
+}
+
+// newSSHServer is non-nil if an SSH server implementation is linked
+// into the binary.
+var newSSHServer func(logger.Logf, *LocalBackend) (SSHServer, error)
+
+// RegisterNewSSHServer is called by the SSH server package (which
+// can't be imported from here without an import cycle) from its init
+// func to make LocalBackend able to run it.
+func RegisterNewSSHServer(fn func(logger.Logf, *LocalBackend) (SSHServer, error)) {
+	newSSHServer = fn
+}
+
+// WhoIs returns the peer node that owns the Tailscale IP ip and the
+// profile of the user who owns that node.
+func (b *LocalBackend) WhoIs(ip netaddr.IP) (n *tailcfg.Node, u tailcfg.UserProfile, ok bool) {
+	n, nm, ok := b.peerForIP(ip)
+	if !ok {
+		return nil, u, false
+	}
+	u, ok = nm.UserProfiles[n.User]
+	return n, u, ok
+}
+
+// CheckSSHLogin returns an error unless the tailnet's SSH policy lets
+// the user owning the peer at ip log in as the local user localUser.
+// Root is only allowed if the policy names it.
+func (b *LocalBackend) CheckSSHLogin(ip netaddr.IP, localUser string) error {
+	peer, nm, ok := b.peerForIP(ip)
+	if !ok {
+		return errors.New("not a known peer")
+	}
+	u, ok := nm.UserProfiles[peer.User]
+	if !ok {
+		return errors.New("unknown user")
+	}
+	if !nm.SSHPolicy.AllowsLogin(u.LoginName, localUser) {
+		return fmt.Errorf("%s may not log in as %q", u.LoginName, localUser)
+	}
+	return nil
+}
+
+// sshPort is the TCP port the SSH server listens on.
+const sshPort = 22
+
+// sshListener is a listener on one of the node's Tailscale IPs that
+// only accepts connections the backend permits to reach its SSH
+// server.
+type sshListener struct {
+	net.Listener
+	b  *LocalBackend
+	ip netaddr.IP
+}
+
+func (ln *sshListener) Accept() (net.Conn, error) {
+	for {
+		c, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if err := ln.b.checkSSHConn(c, ln.ip); err != nil {
+			ln.b.logf("ssh: rejecting connection from %v: %v", c.RemoteAddr(), err)
+			c.Close()
+			continue
+		}
+		return c, nil
+	}
+}
+
+// checkSSHConn reports whether the peer at the remote end of c may
+// use the SSH server on localIP. The packet filter must allow the
+// connection, the peer must be owned by the same user as this node,
+// and the tailnet must have an SSH policy granting that user some
+// local user; which one is checked by CheckSSHLogin.
+func (b *LocalBackend) checkSSHConn(c net.Conn, localIP netaddr.IP) error {
+	remote, err := netaddr.ParseIPPort(c.RemoteAddr().String())
+	if err != nil {
+		return err
+	}
+	peer, nm, ok := b.peerForIP(remote.IP)
+	if !ok {
+		return errors.New("not a known peer")
+	}
+	if peer.User != nm.User {
+		return errors.New("peer is owned by a different user")
+	}
+	if !sshPolicyGrantsAny(nm.SSHPolicy, nm.UserProfiles[peer.User].LoginName) {
+		return errors.New("no SSH policy grants the peer's user any login")
+	}
+	if f := b.e.GetFilter(); f == nil || f.CheckTCP(remote.IP, localIP, sshPort) != filter.Accept {
+		return errors.New("not permitted by packet filter")
+	}
+	return nil
+}
+
+// initSSHListenersLocked starts, updates or stops the SSH listeners
+// according to Prefs.RunSSH and the node's current Tailscale IPs.
+// b.mu must be held.
+func (b *LocalBackend) initSSHListenersLocked() {
+	if newSSHServer == nil || b.prefs == nil || !b.prefs.RunSSH || b.netMap == nil {
+		b.closeSSHListenersLocked()
+		return
+	}
+	ips := make([]netaddr.IP, 0, len(b.netMap.Addresses))
+	for _, pfx := range wgCIDRsToNetaddr(b.netMap.Addresses) {
+		ips = append(ips, pfx.IP)
+	}
+	if len(ips) == len(b.sshListeners) {
+		same := true
+		for i, ln := range b.sshListeners {
+			if ln.ip != ips[i] {
+				same = false
+				break
+			}
+		}
+		if same {
+			return
+		}
+	}
+	b.closeSSHListenersLocked()
+
+	if b.sshServer == nil {
+		srv, err := newSSHServer(logger.WithPrefix(b.logf, "ssh: "), b)
+		if err != nil {
+			b.logf("ssh: starting server: %v", err)
+			return
+		}
+		b.sshServer = srv
+	}
+	for _, ip := range ips {
+		addr := netaddr.IPPort{IP: ip, Port: sshPort}
+		ln, err := net.Listen("tcp", addr.String())
+		if err != nil {
+			// Most likely the system sshd is listening on
+			// all addresses.
+			b.logf("ssh: listen on %v: %v", addr, err)
+			continue
+		}
+		sln := &sshListener{Listener: ln, b: b, ip: ip}
+		b.sshListeners = append(b.sshListeners, sln)
+		b.logf("ssh: serving on %v", addr)
+		go func() {
+			err := b.sshServer.Serve(sln)
+			b.logf("ssh: %v listener closed: %v", sln.ip, err)
+		}()
+	}
+}
+
+func (b *LocalBackend) closeSSHListenersLocked() {
+	for _, ln := range b.sshListeners {
+		ln.Close()
+	}
+	b.sshListeners = nil
+}
+
+// sshPolicyGrantsAny reports whether pol grants the tailnet user
+// loginName a login as any local user.
+func sshPolicyGrantsAny(pol *tailcfg.SSHPolicy, loginName string) bool {
+	if pol == nil || loginName == "" {
+		return false
+	}
+	for _, r := range pol.Rules {
+		if r == nil || len(r.LocalUsers) == 0 {
+			continue
+		}
+		for _, p := range r.Principals {
+			if p == loginName || p == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
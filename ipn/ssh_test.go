@@ -0,0 +1,75 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"testing"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
+	"tailscale.com/control/controlclient"
+	"tailscale.com/tailcfg"
+)
+
+func TestCheckSSHLogin(t *testing.T) {
+	addr, err := wgcfg.ParseCIDR("100.101.102.103/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := netaddr.IPv4(100, 101, 102, 103)
+	nm := &controlclient.NetworkMap{
+		Peers: []*tailcfg.Node{{Name: "peer.", User: 2, Addresses: []wgcfg.CIDR{addr}}},
+		UserProfiles: map[tailcfg.UserID]tailcfg.UserProfile{
+			2: {ID: 2, LoginName: "bob@example.com"},
+		},
+	}
+	b := &LocalBackend{netMap: nm}
+
+	if err := b.CheckSSHLogin(ip, "bob"); err == nil {
+		t.Error("login allowed without an SSH policy")
+	}
+
+	nm.SSHPolicy = &tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		{Principals: []string{"bob@example.com"}, LocalUsers: []string{"bob"}},
+		{Principals: []string{"*"}, LocalUsers: []string{"guest"}},
+	}}
+	tests := []struct {
+		localUser string
+		ok        bool
+	}{
+		{"bob", true},
+		{"guest", true},
+		{"alice", false}, // not mapped to bob
+		{"root", false},
+	}
+	for _, tt := range tests {
+		err := b.CheckSSHLogin(ip, tt.localUser)
+		if (err == nil) != tt.ok {
+			t.Errorf("CheckSSHLogin(%q) = %v; want ok=%v", tt.localUser, err, tt.ok)
+		}
+	}
+
+	// A wildcard never grants root; naming it does.
+	nm.SSHPolicy = &tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		{Principals: []string{"bob@example.com"}, LocalUsers: []string{"*"}},
+	}}
+	if err := b.CheckSSHLogin(ip, "alice"); err != nil {
+		t.Errorf("wildcard login as alice: %v", err)
+	}
+	if err := b.CheckSSHLogin(ip, "root"); err == nil {
+		t.Error("wildcard granted root")
+	}
+	nm.SSHPolicy.Rules = append(nm.SSHPolicy.Rules, &tailcfg.SSHRule{
+		Principals: []string{"bob@example.com"}, LocalUsers: []string{"root"},
+	})
+	if err := b.CheckSSHLogin(ip, "root"); err != nil {
+		t.Errorf("login as root granted by name: %v", err)
+	}
+
+	// Unknown peers get nothing.
+	if err := b.CheckSSHLogin(netaddr.IPv4(100, 1, 2, 3), "guest"); err == nil {
+		t.Error("login allowed from an unknown peer")
+	}
+}
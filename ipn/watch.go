@@ -0,0 +1,159 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/version"
+	"tailscale.com/wgengine/filter"
+)
+
+// watchQueueLen is how many notifications a watcher buffers before
+// dropping them, so that a slow watcher doesn't hold up the backend.
+const watchQueueLen = 64
+
+// peerOnlineWindow is how long after its last handshake a peer counts
+// as online: WireGuard's REJECT_AFTER_TIME, after which a session is
+// dead. Sessions in use are rekeyed every two minutes.
+const peerOnlineWindow = 3 * time.Minute
+
+// PeerChange is a change in how a peer is reached, in
+// Notify.PeerChanges.
+type PeerChange struct {
+	NodeKey tailcfg.NodeKey
+	// Online is whether there's a live WireGuard session with the
+	// peer: whether it's handshaken within peerOnlineWindow.
+	Online bool
+	// Path is how the peer is reached while online: its
+	// ip:port if directly, or "derp-" and the DERP region it's
+	// relayed through. It's empty while offline.
+	Path string `json:",omitempty"`
+}
+
+// FilterUpdate is the packet filter, in Notify.PacketFilter.
+type FilterUpdate struct {
+	// Rules are the packet filter's rules, which allow incoming
+	// traffic. None are in effect while ShieldsUp.
+	Rules []filter.Match
+	// ShieldsUp is whether all incoming traffic is blocked.
+	ShieldsUp bool
+}
+
+// WatchNotifications calls fn with every notification the backend
+// sends its frontend from now until ctx is done, in order, starting
+// with one of the current state and engine status. Unlike the
+// frontend, watchers also get PeerChanges.
+//
+// fn is called from its own goroutine; if it falls behind by
+// watchQueueLen notifications, later ones are dropped until it
+// catches up. The Notify must not be modified.
+func (b *LocalBackend) WatchNotifications(ctx context.Context, fn func(*Notify)) {
+	q := make(chan *Notify, watchQueueLen)
+	b.mu.Lock()
+	state, es := b.state, b.engineStatus
+	b.mu.Unlock()
+	q <- &Notify{Version: version.Long, State: &state, Engine: &es}
+
+	b.watchMu.Lock()
+	if b.watchers == nil {
+		b.watchers = make(map[chan *Notify]bool)
+	}
+	b.watchers[q] = true
+	b.watchMu.Unlock()
+
+	defer func() {
+		b.watchMu.Lock()
+		defer b.watchMu.Unlock()
+		delete(b.watchers, q)
+		if len(b.watchers) == 0 {
+			b.watchedPeers = nil
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-q:
+			fn(n)
+		}
+	}
+}
+
+// sendToWatchers hands n to every watcher with room for it.
+func (b *LocalBackend) sendToWatchers(n *Notify) {
+	b.watchMu.Lock()
+	defer b.watchMu.Unlock()
+	for q := range b.watchers {
+		select {
+		case q <- n:
+		default:
+		}
+	}
+}
+
+// peerChange returns how the peer k, whose status is ps, is reached
+// at now.
+func peerChange(k tailcfg.NodeKey, ps *ipnstate.PeerStatus, now time.Time) PeerChange {
+	pc := PeerChange{NodeKey: k}
+	if ps.LastHandshake.IsZero() || now.Sub(ps.LastHandshake) > peerOnlineWindow {
+		return pc
+	}
+	pc.Online = true
+	switch {
+	case ps.CurAddr != "":
+		pc.Path = ps.CurAddr
+	case ps.Relay != "":
+		pc.Path = "derp-" + ps.Relay
+	}
+	return pc
+}
+
+// sendPeerChanges sends watchers the changes in the peers' paths
+// since the last call, if there are any watchers.
+func (b *LocalBackend) sendPeerChanges() {
+	b.watchMu.Lock()
+	watching := len(b.watchers) > 0
+	b.watchMu.Unlock()
+	if !watching {
+		return
+	}
+
+	peers := make(map[tailcfg.NodeKey]PeerChange)
+	now := time.Now()
+	for pk, ps := range b.Status().Peer {
+		k := tailcfg.NodeKey(pk)
+		peers[k] = peerChange(k, ps, now)
+	}
+
+	b.watchMu.Lock()
+	var changes []PeerChange
+	for k, pc := range peers {
+		if old, ok := b.watchedPeers[k]; ok && old == pc || !ok && !pc.Online {
+			continue
+		}
+		changes = append(changes, pc)
+	}
+	for k, old := range b.watchedPeers {
+		if _, ok := peers[k]; !ok && old.Online {
+			changes = append(changes, PeerChange{NodeKey: k})
+		}
+	}
+	b.watchedPeers = peers
+	b.watchMu.Unlock()
+
+	if len(changes) == 0 {
+		return
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].NodeKey.String() < changes[j].NodeKey.String()
+	})
+	b.sendToWatchers(&Notify{Version: version.Long, PeerChanges: changes})
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/wgengine"
+)
+
+func TestWatchNotifications(t *testing.T) {
+	e, err := wgengine.NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &MemoryStore{cache: make(map[StateKey][]byte)}
+	lb, err := NewLocalBackend(t.Logf, "logid", store, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	got := make(chan *Notify, 10)
+	done := make(chan bool)
+	go func() {
+		lb.WatchNotifications(ctx, func(n *Notify) { got <- n })
+		close(done)
+	}()
+	next := func() *Notify {
+		t.Helper()
+		select {
+		case n := <-got:
+			return n
+		case <-time.After(5 * time.Second):
+			t.Fatal("no notification")
+			return nil
+		}
+	}
+
+	if n := next(); n.State == nil || n.Engine == nil {
+		t.Errorf("first notification = %+v; want the state and engine status", n)
+	}
+	// Wait for the watcher to be registered.
+	for {
+		lb.watchMu.Lock()
+		registered := len(lb.watchers) == 1
+		lb.watchMu.Unlock()
+		if registered {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	url := "https://example.com/login"
+	lb.send(Notify{BrowseToURL: &url})
+	for {
+		// Skip the engine's own notifications.
+		if n := next(); n.BrowseToURL != nil {
+			if *n.BrowseToURL != url {
+				t.Errorf("got URL %q; want %q", *n.BrowseToURL, url)
+			}
+			break
+		}
+	}
+
+	cancel()
+	<-done
+	lb.watchMu.Lock()
+	defer lb.watchMu.Unlock()
+	if len(lb.watchers) != 0 {
+		t.Error("watcher not removed")
+	}
+}
+
+func TestPeerChange(t *testing.T) {
+	now := time.Unix(10000, 0)
+	k := tailcfg.NodeKey{1}
+	tests := []struct {
+		name string
+		ps   ipnstate.PeerStatus
+		want PeerChange
+	}{
+		{"never", ipnstate.PeerStatus{CurAddr: "1.2.3.4:41641"}, PeerChange{NodeKey: k}},
+		{"direct", ipnstate.PeerStatus{LastHandshake: now.Add(-time.Minute), CurAddr: "1.2.3.4:41641"}, PeerChange{NodeKey: k, Online: true, Path: "1.2.3.4:41641"}},
+		{"relayed", ipnstate.PeerStatus{LastHandshake: now.Add(-time.Minute), Relay: "nyc"}, PeerChange{NodeKey: k, Online: true, Path: "derp-nyc"}},
+		{"stale", ipnstate.PeerStatus{LastHandshake: now.Add(-peerOnlineWindow - time.Second), Relay: "nyc"}, PeerChange{NodeKey: k}},
+	}
+	for _, tt := range tests {
+		if got := peerChange(k, &tt.ps, now); got != tt.want {
+			t.Errorf("%s: peerChange = %+v; want %+v", tt.name, got, tt.want)
+		}
+	}
+}
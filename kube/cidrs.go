@@ -0,0 +1,111 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kube
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ClusterCIDRs returns the CIDRs of the cluster's pods and Services,
+// sorted and without duplicates.
+//
+// Pod CIDRs are those the cluster allocates to its Nodes; clusters
+// whose network plugin does its own address management have none.
+// The Service CIDRs are read from the ServiceCIDR API where the
+// cluster has it. Elsewhere, the API server reveals them in the error
+// to a dry-run creation of a Service with an IP outside them.
+//
+// The service account needs to list Nodes and ServiceCIDRs, and to
+// create Services in the client's namespace.
+func (c *Client) ClusterCIDRs(ctx context.Context) ([]string, error) {
+	var nodes NodeList
+	if err := c.Do(ctx, "GET", "/api/v1/nodes", nil, &nodes); err != nil {
+		return nil, fmt.Errorf("listing nodes: %w", err)
+	}
+	var cidrs []string
+	for _, n := range nodes.Items {
+		cidrs = append(cidrs, n.Spec.PodCIDRs...)
+		if n.Spec.PodCIDR != "" {
+			cidrs = append(cidrs, n.Spec.PodCIDR)
+		}
+	}
+	svc, err := c.serviceCIDRs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cidrs = append(cidrs, svc...)
+
+	seen := make(map[string]bool)
+	var ret []string
+	for _, s := range cidrs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			continue
+		}
+		if s := n.String(); !seen[s] {
+			seen[s] = true
+			ret = append(ret, s)
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// validIPsRx matches the Service CIDRs in the API server's error for
+// a Service IP outside them.
+var validIPsRx = regexp.MustCompile(`range of valid IPs is ([0-9a-fA-F:./]+)(?:,\s*([0-9a-fA-F:./]+))?`)
+
+func (c *Client) serviceCIDRs(ctx context.Context) ([]string, error) {
+	for _, version := range []string{"v1", "v1beta1"} {
+		var l ServiceCIDRList
+		err := c.Do(ctx, "GET", "/apis/networking.k8s.io/"+version+"/servicecidrs", nil, &l)
+		if IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("listing service CIDRs: %w", err)
+		}
+		var ret []string
+		for _, it := range l.Items {
+			ret = append(ret, it.Spec.CIDRs...)
+		}
+		return ret, nil
+	}
+
+	probe := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata":   map[string]string{"generateName": "tailscale-cidr-probe-"},
+		"spec": map[string]interface{}{
+			"clusterIP": "1.1.1.1",
+			"ports":     []interface{}{map[string]int{"port": 443}},
+		},
+	}
+	err := c.Do(ctx, "POST", "/api/v1/namespaces/"+c.ns+"/services?dryRun=All", probe, nil)
+	if err == nil {
+		return nil, errors.New("finding service CIDRs: probe Service unexpectedly valid")
+	}
+	var st *Status
+	if !errors.As(err, &st) {
+		return nil, fmt.Errorf("finding service CIDRs: %w", err)
+	}
+	m := validIPsRx.FindStringSubmatch(st.Message)
+	if m == nil {
+		return nil, fmt.Errorf("finding service CIDRs: %w", err)
+	}
+	var ret []string
+	for _, s := range m[1:] {
+		if s = strings.TrimRight(s, "."); s != "" {
+			ret = append(ret, s)
+		}
+	}
+	return ret, nil
+}
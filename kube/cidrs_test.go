@@ -0,0 +1,62 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestClusterCIDRs(t *testing.T) {
+	nodes := `{"items":[
+		{"metadata":{"name":"a"},"spec":{"podCIDR":"10.244.0.0/24","podCIDRs":["10.244.0.0/24","fd00:10:244::/64"]}},
+		{"metadata":{"name":"b"},"spec":{"podCIDR":"10.244.1.0/24"}},
+		{"metadata":{"name":"c"},"spec":{}}
+	]}`
+	tests := []struct {
+		name         string
+		serviceCIDRs string // v1 ServiceCIDRList; empty for no ServiceCIDR API
+		want         []string
+	}{
+		{
+			name:         "servicecidr_api",
+			serviceCIDRs: `{"items":[{"spec":{"cidrs":["10.96.0.0/12","fd00:10:96::/112"]}}]}`,
+			want:         []string{"10.244.0.0/24", "10.244.1.0/24", "10.96.0.0/12", "fd00:10:244::/64", "fd00:10:96::/112"},
+		},
+		{
+			name: "dry_run_probe",
+			want: []string{"10.244.0.0/24", "10.244.1.0/24", "10.96.0.0/12", "fd00:10:244::/64"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.URL.Path == "/api/v1/nodes":
+					fmt.Fprint(w, nodes)
+				case r.URL.Path == "/apis/networking.k8s.io/v1/servicecidrs" && tt.serviceCIDRs != "":
+					fmt.Fprint(w, tt.serviceCIDRs)
+				case r.Method == "POST" && r.URL.Path == "/api/v1/namespaces/ns/services" && r.URL.Query().Get("dryRun") == "All":
+					w.WriteHeader(http.StatusUnprocessableEntity)
+					fmt.Fprint(w, `{"kind":"Status","message":"Service \"tailscale-cidr-probe-x\" is invalid: spec.clusterIPs: Invalid value: []string{\"1.1.1.1\"}: failed to allocate IP 1.1.1.1: the provided IP (1.1.1.1) is not in the valid range. The range of valid IPs is 10.96.0.0/12"}`)
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer ts.Close()
+			got, err := NewForTest(ts.URL, "ns").ClusterCIDRs(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package kube is a minimal client for the Kubernetes API, for use
+// from inside a cluster with the pod's service account.
+package kube
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// saDir is where Kubernetes mounts a pod's service account
+// credentials.
+const saDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Client talks to the Kubernetes API server.
+type Client struct {
+	url   string // API server base URL, without trailing slash
+	token string // bearer token
+	ns    string // the pod's namespace
+	httpc *http.Client
+}
+
+// New returns a Client for the API server of the cluster the program
+// is running in, authenticated as the pod's service account.
+func New() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes cluster: KUBERNETES_SERVICE_HOST or _PORT not set")
+	}
+	token, err := ioutil.ReadFile(filepath.Join(saDir, "token"))
+	if err != nil {
+		return nil, err
+	}
+	ns, err := ioutil.ReadFile(filepath.Join(saDir, "namespace"))
+	if err != nil {
+		return nil, err
+	}
+	caPEM, err := ioutil.ReadFile(filepath.Join(saDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("no certificates in service account ca.crt")
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &Client{
+		url:   "https://" + net.JoinHostPort(host, port),
+		token: strings.TrimSpace(string(token)),
+		ns:    strings.TrimSpace(string(ns)),
+		httpc: &http.Client{Transport: tr},
+	}, nil
+}
+
+// NewForTest returns a Client for the API server at url, such as an
+// httptest.Server, acting in namespace ns.
+func NewForTest(url, ns string) *Client {
+	return &Client{url: url, ns: ns, httpc: http.DefaultClient}
+}
+
+// Namespace returns the namespace of the pod the client runs in.
+func (c *Client) Namespace() string { return c.ns }
+
+// Status is a Kubernetes API error.
+type Status struct {
+	Code    int
+	Reason  string
+	Message string
+}
+
+func (s *Status) Error() string {
+	return fmt.Sprintf("kube: %d %s: %s", s.Code, s.Reason, s.Message)
+}
+
+// IsNotFound reports whether err is a Kubernetes "not found" error.
+func IsNotFound(err error) bool {
+	var st *Status
+	return errors.As(err, &st) && st.Code == http.StatusNotFound
+}
+
+// IsConflict reports whether err is a Kubernetes "conflict" error,
+// such as from creating an object that already exists or updating
+// one that changed since it was read.
+func IsConflict(err error) bool {
+	var st *Status
+	return errors.As(err, &st) && st.Code == http.StatusConflict
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path, contentType string, in interface{}) (*http.Request, error) {
+	var body io.Reader
+	if in != nil {
+		j, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(j)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.url+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return req, nil
+}
+
+func statusError(res *http.Response) error {
+	st := &Status{Code: res.StatusCode, Reason: res.Status}
+	slurp, _ := ioutil.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if err := json.Unmarshal(slurp, st); err != nil || st.Message == "" {
+		st.Message = strings.TrimSpace(string(slurp))
+	}
+	st.Code = res.StatusCode
+	return st
+}
+
+// Do sends a request with the JSON encoding of in, if non-nil, as
+// its body to the API server path, such as
+// "/api/v1/namespaces/default/secrets", and decodes the JSON response
+// into out, if non-nil.
+func (c *Client) Do(ctx context.Context, method, path string, in, out interface{}) error {
+	return c.do(ctx, method, path, "application/json", in, out)
+}
+
+// Patch applies the JSON merge patch (RFC 7386) patch to the object
+// at path, decoding the updated object into out, if non-nil. Unlike a
+// PUT of an object read with this package's types, it leaves the
+// fields it doesn't mention alone.
+func (c *Client) Patch(ctx context.Context, path string, patch, out interface{}) error {
+	return c.do(ctx, "PATCH", path, "application/merge-patch+json", patch, out)
+}
+
+func (c *Client) do(ctx context.Context, method, path, contentType string, in, out interface{}) error {
+	req, err := c.newRequest(ctx, method, path, contentType, in)
+	if err != nil {
+		return err
+	}
+	res, err := c.httpc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return statusError(res)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// WatchEvent is an event from Watch.
+type WatchEvent struct {
+	Type   string // "ADDED", "MODIFIED", "DELETED", "BOOKMARK" or "ERROR"
+	Object json.RawMessage
+}
+
+// Watch watches the objects of the collection at path, such as
+// "/api/v1/services", from resourceVersion on, calling fn for each
+// event. It returns when ctx is done, the server ends the watch, or
+// fn returns an error.
+func (c *Client) Watch(ctx context.Context, path, resourceVersion string, fn func(WatchEvent) error) error {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	path += sep + "watch=1"
+	if resourceVersion != "" {
+		path += "&resourceVersion=" + resourceVersion
+	}
+	req, err := c.newRequest(ctx, "GET", path, "", nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.httpc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return statusError(res)
+	}
+	dec := json.NewDecoder(bufio.NewReader(res.Body))
+	for {
+		var ev WatchEvent
+		if err := dec.Decode(&ev); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if ev.Type == "ERROR" {
+			st := new(Status)
+			json.Unmarshal(ev.Object, st)
+			return st
+		}
+		if err := fn(ev); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kube
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDo(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/namespaces/ns/secrets/s":
+			fmt.Fprintf(w, `{"kind":"Secret","metadata":{"name":"s"},"data":{"k":"aGk="}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"kind":"Status","reason":"NotFound","message":"not here"}`)
+		}
+	}))
+	defer ts.Close()
+	c := NewForTest(ts.URL, "ns")
+	ctx := context.Background()
+
+	var s Secret
+	if err := c.Do(ctx, "GET", "/api/v1/namespaces/ns/secrets/s", nil, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Metadata.Name != "s" || string(s.Data["k"]) != "hi" {
+		t.Errorf("got %+v", s)
+	}
+
+	err := c.Do(ctx, "GET", "/api/v1/namespaces/ns/secrets/missing", nil, &s)
+	if !IsNotFound(err) {
+		t.Fatalf("err = %v; want not found", err)
+	}
+	if st := err.(*Status); st.Message != "not here" {
+		t.Errorf("message = %q", st.Message)
+	}
+	if IsConflict(err) {
+		t.Error("not found error is a conflict")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") != "1" || r.URL.Query().Get("resourceVersion") != "5" {
+			t.Errorf("bad query %q", r.URL.RawQuery)
+		}
+		fmt.Fprintln(w, `{"type":"ADDED","object":{"metadata":{"name":"a"}}}`)
+		fmt.Fprintln(w, `{"type":"DELETED","object":{"metadata":{"name":"a"}}}`)
+		fmt.Fprintln(w, `{"type":"ERROR","object":{"code":410,"message":"too old"}}`)
+	}))
+	defer ts.Close()
+	c := NewForTest(ts.URL, "ns")
+
+	var types []string
+	err := c.Watch(context.Background(), "/api/v1/services", "5", func(ev WatchEvent) error {
+		types = append(types, ev.Type)
+		return nil
+	})
+	if st, ok := err.(*Status); !ok || st.Code != 410 {
+		t.Errorf("err = %v; want 410 status", err)
+	}
+	if fmt.Sprint(types) != "[ADDED DELETED]" {
+		t.Errorf("events = %v", types)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package leader elects one of several pods as the leader, with a
+// Kubernetes Lease, so that replicas of a subnet router can fail over
+// to each other while only one of them advertises the routes.
+package leader
+
+import (
+	"context"
+	"time"
+
+	"tailscale.com/kube"
+	"tailscale.com/types/logger"
+)
+
+// DefaultLeaseDuration is how long a leader that stops renewing its
+// lease, such as one that crashed, stays leader.
+const DefaultLeaseDuration = 15 * time.Second
+
+// Elector takes part in the election held with one Lease.
+type Elector struct {
+	kc       *kube.Client
+	name     string // of the Lease
+	coll     string // API path of the Lease's collection
+	path     string // API path of the Lease
+	id       string
+	duration time.Duration
+	logf     logger.Logf
+	now      func() time.Time
+}
+
+// New returns an Elector that competes for the Lease named lease, in
+// the namespace of kc, as id, which must be unique among the
+// candidates, such as the pod name. The pod's service account needs
+// to get, create and update the Lease.
+func New(kc *kube.Client, lease, id string, logf logger.Logf) *Elector {
+	coll := "/apis/coordination.k8s.io/v1/namespaces/" + kc.Namespace() + "/leases"
+	return &Elector{
+		kc:       kc,
+		name:     lease,
+		coll:     coll,
+		path:     coll + "/" + lease,
+		id:       id,
+		duration: DefaultLeaseDuration,
+		logf:     logger.WithPrefix(logf, "leader: "),
+		now:      time.Now,
+	}
+}
+
+// Run competes for the lease until ctx is done, calling onChange
+// whenever the Elector becomes or stops being the leader. When ctx is
+// done, a leader releases the lease, so that another candidate takes
+// over without waiting for it to expire, and Run calls
+// onChange(false) before it returns.
+func (e *Elector) Run(ctx context.Context, onChange func(leading bool)) {
+	leading := false
+	var lastRenew time.Time
+	t := time.NewTicker(e.duration / 3)
+	defer t.Stop()
+	for {
+		ok, err := e.tryAcquire(ctx)
+		if err != nil {
+			e.logf("%v", err)
+			// Keep leading while the lease can't have expired,
+			// as no one else can have taken it over.
+			ok = leading && e.now().Sub(lastRenew) < e.duration
+		} else if ok {
+			lastRenew = e.now()
+		}
+		if ok != leading {
+			leading = ok
+			if leading {
+				e.logf("%s is now the leader", e.id)
+			} else {
+				e.logf("%s is no longer the leader", e.id)
+			}
+			onChange(leading)
+		}
+		select {
+		case <-ctx.Done():
+			if leading {
+				e.release()
+				onChange(false)
+			}
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// tryAcquire acquires or renews the lease, and reports whether the
+// Elector holds it.
+func (e *Elector) tryAcquire(ctx context.Context) (bool, error) {
+	now := e.now()
+	var l kube.Lease
+	err := e.kc.Do(ctx, "GET", e.path, nil, &l)
+	if kube.IsNotFound(err) {
+		l.TypeMeta = kube.TypeMeta{Kind: "Lease", APIVersion: "coordination.k8s.io/v1"}
+		l.Metadata.Name = e.name
+		l.Spec = e.spec(now, 0)
+		err = e.kc.Do(ctx, "POST", e.coll, &l, nil)
+		if kube.IsConflict(err) {
+			return false, nil // another candidate created it first
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+	if holder := l.Spec.HolderIdentity; holder != e.id {
+		if holder != "" && !e.expired(l.Spec, now) {
+			return false, nil
+		}
+		l.Spec = e.spec(now, l.Spec.LeaseTransitions+1)
+	} else {
+		l.Spec.RenewTime = now.UTC().Format(kube.MicroTimeFormat)
+		l.Spec.LeaseDurationSeconds = int(e.duration / time.Second)
+	}
+	// The PUT is conditional on the resourceVersion read, so of
+	// several candidates taking over an expired lease, one wins.
+	err = e.kc.Do(ctx, "PUT", e.path, &l, nil)
+	if kube.IsConflict(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// spec returns the spec of a lease newly acquired at now.
+func (e *Elector) spec(now time.Time, transitions int) kube.LeaseSpec {
+	ts := now.UTC().Format(kube.MicroTimeFormat)
+	return kube.LeaseSpec{
+		HolderIdentity:       e.id,
+		LeaseDurationSeconds: int(e.duration / time.Second),
+		AcquireTime:          ts,
+		RenewTime:            ts,
+		LeaseTransitions:     transitions,
+	}
+}
+
+// expired reports whether a lease with spec hasn't been renewed in
+// time as of now. A lease with an unparsable renew time is expired.
+func (e *Elector) expired(spec kube.LeaseSpec, now time.Time) bool {
+	renewed, err := time.Parse(kube.MicroTimeFormat, spec.RenewTime)
+	if err != nil {
+		return true
+	}
+	return now.Sub(renewed) > time.Duration(spec.LeaseDurationSeconds)*time.Second
+}
+
+// release gives up the lease, if the Elector still holds it.
+func (e *Elector) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var l kube.Lease
+	if err := e.kc.Do(ctx, "GET", e.path, nil, &l); err != nil || l.Spec.HolderIdentity != e.id {
+		return
+	}
+	l.Spec.HolderIdentity = ""
+	if err := e.kc.Do(ctx, "PUT", e.path, &l, nil); err != nil {
+		e.logf("releasing lease: %v", err)
+		return
+	}
+	e.logf("released lease")
+}
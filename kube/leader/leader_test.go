@@ -0,0 +1,105 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package leader
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"tailscale.com/kube"
+)
+
+// fakeLeases is a fake API server holding the Lease
+// /apis/coordination.k8s.io/v1/namespaces/ns/leases/router.
+type fakeLeases struct {
+	mu    sync.Mutex
+	lease *kube.Lease // nil if it doesn't exist
+	rv    int
+}
+
+const (
+	leasesPath = "/apis/coordination.k8s.io/v1/namespaces/ns/leases"
+	leasePath  = leasesPath + "/router"
+)
+
+func (f *fakeLeases) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == "GET" && r.URL.Path == leasePath:
+		if f.lease == nil {
+			http.Error(w, `{"message":"not found"}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(f.lease)
+	case r.Method == "POST" && r.URL.Path == leasesPath:
+		if f.lease != nil {
+			http.Error(w, `{"message":"already exists"}`, http.StatusConflict)
+			return
+		}
+		f.lease = new(kube.Lease)
+		json.NewDecoder(r.Body).Decode(f.lease)
+		f.bump()
+	case r.Method == "PUT" && r.URL.Path == leasePath:
+		var l kube.Lease
+		json.NewDecoder(r.Body).Decode(&l)
+		if f.lease == nil || l.Metadata.ResourceVersion != f.lease.Metadata.ResourceVersion {
+			http.Error(w, `{"message":"conflict"}`, http.StatusConflict)
+			return
+		}
+		f.lease = &l
+		f.bump()
+	default:
+		http.Error(w, "unexpected "+r.Method+" "+r.URL.Path, http.StatusBadRequest)
+	}
+}
+
+func (f *fakeLeases) bump() {
+	f.rv++
+	f.lease.Metadata.ResourceVersion = strconv.Itoa(f.rv)
+}
+
+func TestElection(t *testing.T) {
+	ts := httptest.NewServer(new(fakeLeases))
+	defer ts.Close()
+
+	now := time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC)
+	elector := func(id string) *Elector {
+		e := New(kube.NewForTest(ts.URL, "ns"), "router", id, t.Logf)
+		e.now = func() time.Time { return now }
+		return e
+	}
+	a, b := elector("a"), elector("b")
+	ctx := context.Background()
+	acquire := func(e *Elector, want bool) {
+		t.Helper()
+		got, err := e.tryAcquire(ctx)
+		if err != nil || got != want {
+			t.Fatalf("%s: tryAcquire = %v, %v; want %v", e.id, got, err, want)
+		}
+	}
+
+	acquire(a, true)
+	acquire(b, false)
+	now = now.Add(DefaultLeaseDuration / 2)
+	acquire(a, true) // renews
+	now = now.Add(DefaultLeaseDuration / 2)
+	acquire(b, false)
+
+	// a stops renewing, so b takes over once the lease expires.
+	now = now.Add(DefaultLeaseDuration + time.Second)
+	acquire(b, true)
+	acquire(a, false)
+
+	// b releases the lease, so a takes over at once.
+	b.release()
+	acquire(a, true)
+}
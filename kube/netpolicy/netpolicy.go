@@ -0,0 +1,282 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package netpolicy compiles the Kubernetes NetworkPolicies that
+// select a pod into packet filter rules, so that a tailscale node
+// running in the pod, such as a sidecar, lets in from the tailnet
+// only what the cluster's policies let in to the pod.
+package netpolicy
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/kube"
+	"tailscale.com/logtail/backoff"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/filter"
+)
+
+// allPorts is the port range of a rule without ports.
+var allPorts = filter.PortRange{First: 0, Last: 65535}
+
+// everywhere are the prefixes of a rule without sources, and the
+// destinations of every rule. The rules are meant to be intersected
+// with the netmap's packet filter, which only lets traffic in to the
+// node's own addresses.
+var everywhere = []netaddr.IPPrefix{
+	{IP: netaddr.IPv4(0, 0, 0, 0), Bits: 0},
+	{IP: netaddr.IPv6Unspecified(), Bits: 0},
+}
+
+// Compile returns the packet filter rules allowing the ingress
+// traffic that the policies in pols selecting a pod with podLabels
+// allow, and whether any policy selects the pod at all. If none does,
+// Kubernetes doesn't restrict the pod's ingress traffic and neither
+// should the caller.
+//
+// Only ipBlock peers can match tailnet traffic; peers selecting pods
+// or namespaces are skipped, as are named ports, which would need the
+// pod's spec. The filter doesn't tell TCP from UDP, so a port allowed
+// for either protocol is allowed for both.
+func Compile(pols []kube.NetworkPolicy, podLabels map[string]string, logf logger.Logf) (rules []filter.Match, selected bool) {
+	rules = []filter.Match{}
+	for _, pol := range pols {
+		if !appliesToIngress(pol.Spec) || !pol.Spec.PodSelector.Matches(podLabels) {
+			continue
+		}
+		selected = true
+		for i, rule := range pol.Spec.Ingress {
+			m := filter.Match{Srcs: ruleSources(rule.From)}
+			for _, pr := range rulePorts(rule.Ports) {
+				for _, pfx := range everywhere {
+					m.Dsts = append(m.Dsts, filter.NetPortRange{Net: pfx, Ports: pr})
+				}
+			}
+			if len(m.Srcs) == 0 || len(m.Dsts) == 0 {
+				logf("NetworkPolicy %s/%s: ingress rule %d can't match tailnet traffic; skipped", pol.Metadata.Namespace, pol.Metadata.Name, i)
+				continue
+			}
+			rules = append(rules, m)
+		}
+	}
+	if !selected {
+		return nil, false
+	}
+	return rules, true
+}
+
+// appliesToIngress reports whether a policy with spec restricts
+// ingress traffic. Without explicit policy types, every policy does.
+func appliesToIngress(spec kube.NetworkPolicySpec) bool {
+	if len(spec.PolicyTypes) == 0 {
+		return true
+	}
+	for _, t := range spec.PolicyTypes {
+		if t == "Ingress" {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleSources returns the prefixes covering the ipBlock peers of a
+// rule. An empty list of peers allows everything.
+func ruleSources(peers []kube.NetworkPolicyPeer) []netaddr.IPPrefix {
+	if len(peers) == 0 {
+		return everywhere
+	}
+	var ret []netaddr.IPPrefix
+	for _, peer := range peers {
+		if peer.IPBlock == nil {
+			continue
+		}
+		pfx, err := netaddr.ParseIPPrefix(peer.IPBlock.CIDR)
+		if err != nil {
+			continue
+		}
+		var except []netaddr.IPPrefix
+		for _, s := range peer.IPBlock.Except {
+			if e, err := netaddr.ParseIPPrefix(s); err == nil {
+				except = append(except, e)
+			}
+		}
+		ret = append(ret, exclude(pfx, except)...)
+	}
+	return ret
+}
+
+// rulePorts returns the port ranges of a rule. An empty list of
+// ports allows all ports.
+func rulePorts(ports []kube.NetworkPolicyPort) []filter.PortRange {
+	if len(ports) == 0 {
+		return []filter.PortRange{allPorts}
+	}
+	var ret []filter.PortRange
+	for _, p := range ports {
+		switch {
+		case p.Protocol == "SCTP":
+			// Not something the filter handles.
+		case p.Port == nil:
+			ret = append(ret, allPorts)
+		case p.Port.IsString:
+			// Named port; skipped.
+		case p.Port.IntVal < 1 || p.Port.IntVal > 65535:
+		default:
+			pr := filter.PortRange{First: uint16(p.Port.IntVal), Last: uint16(p.Port.IntVal)}
+			if p.EndPort > p.Port.IntVal && p.EndPort <= 65535 {
+				pr.Last = uint16(p.EndPort)
+			}
+			ret = append(ret, pr)
+		}
+	}
+	return ret
+}
+
+// exclude returns the prefixes covering the addresses in pfx but not
+// in any of except.
+func exclude(pfx netaddr.IPPrefix, except []netaddr.IPPrefix) []netaddr.IPPrefix {
+	pfx = masked(pfx)
+	overlaps := false
+	for _, e := range except {
+		if e.Bits <= pfx.Bits && e.Contains(pfx.IP) {
+			return nil // entirely excluded
+		}
+		if pfx.Contains(e.IP) {
+			overlaps = true
+		}
+	}
+	if !overlaps {
+		return []netaddr.IPPrefix{pfx}
+	}
+	lo, hi := split(pfx)
+	return append(exclude(lo, except), exclude(hi, except)...)
+}
+
+// masked returns pfx with the bits of its IP past its length cleared.
+func masked(pfx netaddr.IPPrefix) netaddr.IPPrefix {
+	if pfx.IP.Is4() {
+		a := pfx.IP.As4()
+		for i := range a {
+			a[i] &= byteMask(int(pfx.Bits) - 8*i)
+		}
+		return netaddr.IPPrefix{IP: netaddr.IPv4(a[0], a[1], a[2], a[3]), Bits: pfx.Bits}
+	}
+	a := pfx.IP.As16()
+	for i := range a {
+		a[i] &= byteMask(int(pfx.Bits) - 8*i)
+	}
+	return netaddr.IPPrefix{IP: netaddr.IPFrom16(a), Bits: pfx.Bits}
+}
+
+// byteMask returns the mask of a byte whose first n bits are in a
+// prefix.
+func byteMask(n int) byte {
+	switch {
+	case n <= 0:
+		return 0
+	case n >= 8:
+		return 0xff
+	}
+	return ^byte(0xff >> uint(n))
+}
+
+// split returns the two halves of the masked prefix pfx, which must
+// not be a single address.
+func split(pfx netaddr.IPPrefix) (lo, hi netaddr.IPPrefix) {
+	bits := pfx.Bits + 1
+	lo = netaddr.IPPrefix{IP: pfx.IP, Bits: bits}
+	bit := int(pfx.Bits)
+	if pfx.IP.Is4() {
+		a := pfx.IP.As4()
+		a[bit/8] |= 0x80 >> uint(bit%8)
+		return lo, netaddr.IPPrefix{IP: netaddr.IPv4(a[0], a[1], a[2], a[3]), Bits: bits}
+	}
+	a := pfx.IP.As16()
+	a[bit/8] |= 0x80 >> uint(bit%8)
+	return lo, netaddr.IPPrefix{IP: netaddr.IPFrom16(a), Bits: bits}
+}
+
+// Run keeps the packet filter restriction of the pod named pod, in
+// the namespace of kc, in line with the NetworkPolicies selecting it
+// until ctx is done. It calls set with the rules from Compile, or nil
+// while no policy selects the pod. Until it has read the policies, it
+// blocks all incoming traffic, so that the pod isn't briefly more
+// exposed on the tailnet than in the cluster.
+func Run(ctx context.Context, kc *kube.Client, pod string, logf logger.Logf, set func([]filter.Match)) {
+	logf = logger.WithPrefix(logf, "netpolicy: ")
+	set([]filter.Match{})
+
+	ns := kc.Namespace()
+	polPath := "/apis/networking.k8s.io/v1/namespaces/" + ns + "/networkpolicies"
+	podPath := "/api/v1/namespaces/" + ns + "/pods"
+
+	changed := make(chan struct{}, 1)
+	notify := func(kube.WatchEvent) error {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+	go watch(ctx, kc, polPath, logf, notify)
+	go watch(ctx, kc, podPath+"?fieldSelector="+url.QueryEscape("metadata.name="+pod), logf, notify)
+
+	var last []filter.Match
+	first := true
+	bo := backoff.NewBackoff("netpolicy", logf, time.Minute)
+	t := time.NewTicker(5 * time.Minute)
+	defer t.Stop()
+	for {
+		rules, err := load(ctx, kc, polPath, podPath+"/"+pod, logf)
+		if err != nil {
+			logf("%v", err)
+		} else if first || !reflect.DeepEqual(rules, last) {
+			if rules == nil {
+				logf("no policy selects pod %s/%s; not restricting", ns, pod)
+			} else {
+				logf("restricting incoming traffic to %v", rules)
+			}
+			set(rules)
+			last, first = rules, false
+		}
+		bo.BackOff(ctx, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		case <-t.C:
+		}
+	}
+}
+
+// load reads the pod and the policies and compiles them.
+func load(ctx context.Context, kc *kube.Client, polPath, podPath string, logf logger.Logf) ([]filter.Match, error) {
+	var pod kube.Pod
+	if err := kc.Do(ctx, "GET", podPath, nil, &pod); err != nil {
+		return nil, fmt.Errorf("reading pod: %w", err)
+	}
+	var pols kube.NetworkPolicyList
+	if err := kc.Do(ctx, "GET", polPath, nil, &pols); err != nil {
+		return nil, fmt.Errorf("listing network policies: %w", err)
+	}
+	rules, selected := Compile(pols.Items, pod.Metadata.Labels, logf)
+	if !selected {
+		return nil, nil
+	}
+	return rules, nil
+}
+
+// watch watches the collection at path until ctx is done, calling fn
+// for every event and re-establishing the watch when it ends.
+func watch(ctx context.Context, kc *kube.Client, path string, logf logger.Logf, fn func(kube.WatchEvent) error) {
+	bo := backoff.NewBackoff("watch", logf, time.Minute)
+	for ctx.Err() == nil {
+		bo.BackOff(ctx, kc.Watch(ctx, path, "", fn))
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netpolicy
+
+import (
+	"fmt"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/kube"
+)
+
+func mustPrefix(s string) netaddr.IPPrefix {
+	p, err := netaddr.ParseIPPrefix(s)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func TestExclude(t *testing.T) {
+	tests := []struct {
+		pfx    string
+		except []string
+		want   string
+	}{
+		{"10.0.0.0/8", nil, "[10.0.0.0/8]"},
+		{"10.1.2.3/8", []string{"192.168.0.0/16"}, "[10.0.0.0/8]"},
+		{"10.0.0.0/8", []string{"10.0.0.0/8"}, "[]"},
+		{"10.0.0.0/8", []string{"0.0.0.0/0"}, "[]"},
+		{"10.0.0.0/30", []string{"10.0.0.1/32"}, "[10.0.0.0/32 10.0.0.2/31]"},
+		{"10.0.0.0/8", []string{"10.128.0.0/9", "10.0.0.0/9"}, "[]"},
+		{"10.0.0.0/8", []string{"10.64.0.0/10"}, "[10.0.0.0/10 10.128.0.0/9]"},
+		{"fd00::/8", []string{"fd80::/9"}, "[fd00::/9]"},
+		{"0.0.0.0/0", []string{"fd00::/8"}, "[0.0.0.0/0]"},
+	}
+	for _, tt := range tests {
+		var except []netaddr.IPPrefix
+		for _, s := range tt.except {
+			except = append(except, mustPrefix(s))
+		}
+		got := fmt.Sprint(exclude(mustPrefix(tt.pfx), except))
+		if got != tt.want {
+			t.Errorf("exclude(%s, %v) = %s; want %s", tt.pfx, tt.except, got, tt.want)
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	port := func(n int) *kube.IntOrString { return &kube.IntOrString{IntVal: n} }
+	pols := []kube.NetworkPolicy{
+		{
+			Metadata: kube.ObjectMeta{Namespace: "default", Name: "db"},
+			Spec: kube.NetworkPolicySpec{
+				PodSelector: kube.LabelSelector{MatchLabels: map[string]string{"app": "db"}},
+			},
+		},
+		{
+			Metadata: kube.ObjectMeta{Namespace: "default", Name: "web"},
+			Spec: kube.NetworkPolicySpec{
+				PodSelector: kube.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+				Ingress: []kube.NetworkPolicyIngressRule{
+					{
+						From: []kube.NetworkPolicyPeer{
+							{IPBlock: &kube.IPBlock{CIDR: "100.64.0.0/10", Except: []string{"100.64.0.0/11"}}},
+							{PodSelector: &kube.LabelSelector{}},
+						},
+						Ports: []kube.NetworkPolicyPort{
+							{Port: port(443)},
+							{Port: port(8000), EndPort: 8080},
+							{Port: &kube.IntOrString{IsString: true, StrVal: "http"}},
+						},
+					},
+					{
+						// Only pods; can't match tailnet traffic.
+						From: []kube.NetworkPolicyPeer{{NamespaceSelector: &kube.LabelSelector{}}},
+					},
+				},
+			},
+		},
+		{
+			Metadata: kube.ObjectMeta{Namespace: "default", Name: "egress-only"},
+			Spec: kube.NetworkPolicySpec{
+				PolicyTypes: []string{"Egress"},
+			},
+		},
+	}
+
+	if rules, selected := Compile(pols, map[string]string{"app": "other"}, t.Logf); selected || rules != nil {
+		t.Errorf("unselected pod: got %v, %v; want nil, false", rules, selected)
+	}
+
+	rules, selected := Compile(pols, map[string]string{"app": "db"}, t.Logf)
+	if !selected || rules == nil || len(rules) != 0 {
+		t.Errorf("pod with deny-all policy: got %v, %v; want empty, true", rules, selected)
+	}
+
+	rules, selected = Compile(pols, map[string]string{"app": "web"}, t.Logf)
+	if !selected {
+		t.Fatal("web pod not selected")
+	}
+	got := fmt.Sprint(rules)
+	want := "[100.96.0.0/11=>[0.0.0.0/0:443,::/0:443,0.0.0.0/0:8000-8080,::/0:8000-8080]]"
+	if got != want {
+		t.Errorf("rules = %s; want %s", got, want)
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kube
+
+// Matches reports whether an object with labels is selected by s.
+// The empty selector selects everything. An expression with an
+// unknown operator selects nothing.
+func (s LabelSelector) Matches(labels map[string]string) bool {
+	for k, v := range s.MatchLabels {
+		if lv, ok := labels[k]; !ok || lv != v {
+			return false
+		}
+	}
+	for _, req := range s.MatchExpressions {
+		v, ok := labels[req.Key]
+		switch req.Operator {
+		case "In":
+			if !ok || !contains(req.Values, v) {
+				return false
+			}
+		case "NotIn":
+			if ok && contains(req.Values, v) {
+				return false
+			}
+		case "Exists":
+			if !ok {
+				return false
+			}
+		case "DoesNotExist":
+			if ok {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func contains(vs []string, v string) bool {
+	for _, s := range vs {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
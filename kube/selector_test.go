@@ -0,0 +1,35 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kube
+
+import "testing"
+
+func TestLabelSelectorMatches(t *testing.T) {
+	labels := map[string]string{"app": "web", "tier": "front"}
+	tests := []struct {
+		name string
+		sel  LabelSelector
+		want bool
+	}{
+		{"empty", LabelSelector{}, true},
+		{"labels", LabelSelector{MatchLabels: map[string]string{"app": "web"}}, true},
+		{"labels_mismatch", LabelSelector{MatchLabels: map[string]string{"app": "db"}}, false},
+		{"labels_missing", LabelSelector{MatchLabels: map[string]string{"env": "prod"}}, false},
+		{"in", LabelSelector{MatchExpressions: []LabelSelectorRequirement{{Key: "tier", Operator: "In", Values: []string{"front", "back"}}}}, true},
+		{"in_missing", LabelSelector{MatchExpressions: []LabelSelectorRequirement{{Key: "env", Operator: "In", Values: []string{"prod"}}}}, false},
+		{"notin", LabelSelector{MatchExpressions: []LabelSelectorRequirement{{Key: "tier", Operator: "NotIn", Values: []string{"front"}}}}, false},
+		{"notin_missing", LabelSelector{MatchExpressions: []LabelSelectorRequirement{{Key: "env", Operator: "NotIn", Values: []string{"prod"}}}}, true},
+		{"exists", LabelSelector{MatchExpressions: []LabelSelectorRequirement{{Key: "app", Operator: "Exists"}}}, true},
+		{"doesnotexist", LabelSelector{MatchExpressions: []LabelSelectorRequirement{{Key: "app", Operator: "DoesNotExist"}}}, false},
+		{"bad_operator", LabelSelector{MatchExpressions: []LabelSelectorRequirement{{Key: "app", Operator: "Gt"}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.sel.Matches(labels); got != tt.want {
+				t.Errorf("Matches = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package kube
+
+import "encoding/json"
+
+// The types below are the subset of the Kubernetes API objects that
+// tailscale.com code uses. Unknown fields are dropped, so objects
+// read with them must not be written back with a PUT; use them only
+// for objects this package's users own entirely.
+
+// TypeMeta is the kind and API version of an object.
+type TypeMeta struct {
+	Kind       string `json:"kind,omitempty"`
+	APIVersion string `json:"apiVersion,omitempty"`
+}
+
+// ObjectMeta is the metadata of an object.
+type ObjectMeta struct {
+	Name            string            `json:"name,omitempty"`
+	Namespace       string            `json:"namespace,omitempty"`
+	UID             string            `json:"uid,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+// ListMeta is the metadata of a list of objects.
+type ListMeta struct {
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+// Secret is a v1 Secret. Data values are base64 encoded on the wire,
+// which encoding/json does for []byte.
+type Secret struct {
+	TypeMeta
+	Metadata ObjectMeta        `json:"metadata"`
+	Data     map[string][]byte `json:"data,omitempty"`
+}
+
+// SecretList is a v1 SecretList.
+type SecretList struct {
+	Metadata ListMeta `json:"metadata"`
+	Items    []Secret `json:"items"`
+}
+
+// Service is a v1 Service.
+type Service struct {
+	TypeMeta
+	Metadata ObjectMeta  `json:"metadata"`
+	Spec     ServiceSpec `json:"spec"`
+}
+
+// ServiceSpec is the spec of a Service.
+type ServiceSpec struct {
+	Type         string            `json:"type,omitempty"`
+	ClusterIP    string            `json:"clusterIP,omitempty"`
+	ExternalName string            `json:"externalName,omitempty"`
+	Selector     map[string]string `json:"selector,omitempty"`
+	Ports        []ServicePort     `json:"ports,omitempty"`
+}
+
+// ServicePort is a port of a Service.
+type ServicePort struct {
+	Name     string `json:"name,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	Port     int    `json:"port"`
+}
+
+// ServiceList is a v1 ServiceList.
+type ServiceList struct {
+	Metadata ListMeta  `json:"metadata"`
+	Items    []Service `json:"items"`
+}
+
+// Ingress is a networking.k8s.io/v1 Ingress, reduced to its default
+// backend.
+type Ingress struct {
+	TypeMeta
+	Metadata ObjectMeta  `json:"metadata"`
+	Spec     IngressSpec `json:"spec"`
+}
+
+// IngressSpec is the spec of an Ingress.
+type IngressSpec struct {
+	DefaultBackend *IngressBackend `json:"defaultBackend,omitempty"`
+}
+
+// IngressBackend is the backend of an Ingress.
+type IngressBackend struct {
+	Service *IngressServiceBackend `json:"service,omitempty"`
+}
+
+// IngressServiceBackend is a Service backend of an Ingress.
+type IngressServiceBackend struct {
+	Name string `json:"name"`
+}
+
+// IngressList is a networking.k8s.io/v1 IngressList.
+type IngressList struct {
+	Metadata ListMeta  `json:"metadata"`
+	Items    []Ingress `json:"items"`
+}
+
+// ObjectList is a list of objects of any kind, reduced to their
+// metadata.
+type ObjectList struct {
+	Metadata ListMeta `json:"metadata"`
+	Items    []struct {
+		Metadata ObjectMeta `json:"metadata"`
+	} `json:"items"`
+}
+
+// Pod is a v1 Pod, reduced to its metadata.
+type Pod struct {
+	TypeMeta
+	Metadata ObjectMeta `json:"metadata"`
+}
+
+// LabelSelector selects objects by their labels.
+type LabelSelector struct {
+	MatchLabels      map[string]string          `json:"matchLabels,omitempty"`
+	MatchExpressions []LabelSelectorRequirement `json:"matchExpressions,omitempty"`
+}
+
+// LabelSelectorRequirement is an expression of a LabelSelector.
+type LabelSelectorRequirement struct {
+	Key      string   `json:"key"`
+	Operator string   `json:"operator"` // "In", "NotIn", "Exists" or "DoesNotExist"
+	Values   []string `json:"values,omitempty"`
+}
+
+// IntOrString is a value that is either an integer or a string, such
+// as a port number or name.
+type IntOrString struct {
+	IsString bool
+	IntVal   int
+	StrVal   string
+}
+
+func (v IntOrString) MarshalJSON() ([]byte, error) {
+	if v.IsString {
+		return json.Marshal(v.StrVal)
+	}
+	return json.Marshal(v.IntVal)
+}
+
+func (v *IntOrString) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		*v = IntOrString{IsString: true}
+		return json.Unmarshal(b, &v.StrVal)
+	}
+	*v = IntOrString{}
+	return json.Unmarshal(b, &v.IntVal)
+}
+
+// NetworkPolicy is a networking.k8s.io/v1 NetworkPolicy, reduced to
+// its ingress rules.
+type NetworkPolicy struct {
+	TypeMeta
+	Metadata ObjectMeta        `json:"metadata"`
+	Spec     NetworkPolicySpec `json:"spec"`
+}
+
+// NetworkPolicySpec is the spec of a NetworkPolicy.
+type NetworkPolicySpec struct {
+	PodSelector LabelSelector              `json:"podSelector"`
+	Ingress     []NetworkPolicyIngressRule `json:"ingress,omitempty"`
+	PolicyTypes []string                   `json:"policyTypes,omitempty"` // "Ingress" and/or "Egress"
+}
+
+// NetworkPolicyIngressRule is an ingress rule of a NetworkPolicy. It
+// allows traffic that matches both From and Ports; an empty list
+// matches everything.
+type NetworkPolicyIngressRule struct {
+	Ports []NetworkPolicyPort `json:"ports,omitempty"`
+	From  []NetworkPolicyPeer `json:"from,omitempty"`
+}
+
+// NetworkPolicyPort is a port, or with EndPort a range of ports, of a
+// NetworkPolicy rule. A nil Port means all ports.
+type NetworkPolicyPort struct {
+	Protocol string       `json:"protocol,omitempty"` // "TCP" (the default), "UDP" or "SCTP"
+	Port     *IntOrString `json:"port,omitempty"`
+	EndPort  int          `json:"endPort,omitempty"`
+}
+
+// NetworkPolicyPeer is a source of traffic in a NetworkPolicy rule.
+type NetworkPolicyPeer struct {
+	PodSelector       *LabelSelector `json:"podSelector,omitempty"`
+	NamespaceSelector *LabelSelector `json:"namespaceSelector,omitempty"`
+	IPBlock           *IPBlock       `json:"ipBlock,omitempty"`
+}
+
+// IPBlock is a CIDR, minus the CIDRs in Except.
+type IPBlock struct {
+	CIDR   string   `json:"cidr"`
+	Except []string `json:"except,omitempty"`
+}
+
+// NetworkPolicyList is a networking.k8s.io/v1 NetworkPolicyList.
+type NetworkPolicyList struct {
+	Metadata ListMeta        `json:"metadata"`
+	Items    []NetworkPolicy `json:"items"`
+}
+
+// Node is a v1 Node, reduced to its pod CIDRs.
+type Node struct {
+	TypeMeta
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     NodeSpec   `json:"spec"`
+}
+
+// NodeSpec is the spec of a Node.
+type NodeSpec struct {
+	PodCIDR  string   `json:"podCIDR,omitempty"`
+	PodCIDRs []string `json:"podCIDRs,omitempty"`
+}
+
+// NodeList is a v1 NodeList.
+type NodeList struct {
+	Metadata ListMeta `json:"metadata"`
+	Items    []Node   `json:"items"`
+}
+
+// ServiceCIDRList is a networking.k8s.io ServiceCIDRList, reduced to
+// the CIDRs.
+type ServiceCIDRList struct {
+	Metadata ListMeta `json:"metadata"`
+	Items    []struct {
+		Spec struct {
+			CIDRs []string `json:"cidrs"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+// ConfigMap is a v1 ConfigMap.
+type ConfigMap struct {
+	TypeMeta
+	Metadata ObjectMeta        `json:"metadata"`
+	Data     map[string]string `json:"data,omitempty"`
+}
+
+// ConfigMapList is a v1 ConfigMapList.
+type ConfigMapList struct {
+	Metadata ListMeta    `json:"metadata"`
+	Items    []ConfigMap `json:"items"`
+}
+
+// Lease is a coordination.k8s.io/v1 Lease.
+type Lease struct {
+	TypeMeta
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     LeaseSpec  `json:"spec"`
+}
+
+// LeaseSpec is the spec of a Lease. Its times are in MicroTimeFormat.
+type LeaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+}
+
+// MicroTimeFormat is the time format of the API's MicroTime fields.
+const MicroTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
@@ -0,0 +1,207 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package auditlog provides an append-only, tamper-evident log of
+// configuration and policy changes.
+//
+// Each entry carries the hash of the entry before it, so editing or
+// removing an entry in the middle of the log breaks the chain, which
+// Verify detects. Rewriting the whole log from some entry on is not
+// detected by the log alone; operators who need that can record the
+// Hash of the latest entry somewhere else from time to time.
+package auditlog
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxMemEntries is how many entries a Log without a file keeps.
+const maxMemEntries = 1000
+
+// Entry is an event in the audit log.
+type Entry struct {
+	Seq     int64     // 1 for the first entry, then increasing by 1
+	Time    time.Time // when the event happened
+	Kind    string    // the type of event, such as "prefs" or "login"
+	Message string    // human-readable description of the event
+
+	// PrevHash is the Hash of the entry before this one, or empty
+	// for the first entry.
+	PrevHash string
+	// Hash is the hex SHA-256 of the fields above.
+	Hash string
+}
+
+func (e *Entry) computeHash() string {
+	h := sha256.New()
+	for _, s := range []string{
+		strconv.FormatInt(e.Seq, 10),
+		e.Time.UTC().Format(time.RFC3339Nano),
+		e.Kind,
+		e.Message,
+		e.PrevHash,
+	} {
+		fmt.Fprintf(h, "%d:%s\n", len(s), s)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Verify reports whether ents, a contiguous run of entries from an
+// audit log, is intact: each entry's hash matches its contents and
+// names the entry before it.
+func Verify(ents []Entry) error {
+	for i := range ents {
+		e := &ents[i]
+		if e.Hash != e.computeHash() {
+			return fmt.Errorf("entry %d: hash mismatch; entry was modified", e.Seq)
+		}
+		if i == 0 {
+			continue
+		}
+		prev := &ents[i-1]
+		if e.Seq != prev.Seq+1 {
+			return fmt.Errorf("entry %d follows entry %d; entries are missing", e.Seq, prev.Seq)
+		}
+		if e.PrevHash != prev.Hash {
+			return fmt.Errorf("entry %d: previous hash mismatch; entry %d was modified or replaced", e.Seq, prev.Seq)
+		}
+	}
+	return nil
+}
+
+// Log is an audit log. It's safe for concurrent use.
+//
+// A new Log keeps its entries in memory, the most recent
+// maxMemEntries of them, until SetFile gives it a file.
+type Log struct {
+	mu   sync.Mutex
+	path string   // or empty if in memory
+	f    *os.File // non-nil iff path is non-empty
+	mem  []Entry  // entries, if in memory
+	last Entry    // the latest entry; zero if none
+}
+
+// New returns a new, empty Log that keeps its entries in memory.
+func New() *Log {
+	return new(Log)
+}
+
+// SetFile makes l store its entries in the file at path, in JSON
+// lines, continuing the chain of any entries already there. Entries
+// l holds in memory are appended to the file.
+func (l *Log) SetFile(path string) error {
+	ents, err := readFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil {
+		l.f.Close()
+	}
+	mem := l.mem
+	l.path, l.f, l.mem, l.last = path, f, nil, Entry{}
+	if len(ents) > 0 {
+		l.last = ents[len(ents)-1]
+	}
+	for _, e := range mem {
+		if err := l.appendLocked(e.Time, e.Kind, e.Message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Append adds an event of the given kind to the log.
+func (l *Log) Append(kind, message string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.appendLocked(time.Now(), kind, message)
+}
+
+func (l *Log) appendLocked(t time.Time, kind, message string) error {
+	e := Entry{
+		Seq:      l.last.Seq + 1,
+		Time:     t.UTC(),
+		Kind:     kind,
+		Message:  message,
+		PrevHash: l.last.Hash,
+	}
+	e.Hash = e.computeHash()
+	if l.f == nil {
+		l.mem = append(l.mem, e)
+		if len(l.mem) > maxMemEntries {
+			l.mem = append(l.mem[:0], l.mem[len(l.mem)-maxMemEntries:]...)
+		}
+	} else {
+		j, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := l.f.Write(append(j, '\n')); err != nil {
+			return err
+		}
+	}
+	l.last = e
+	return nil
+}
+
+// Entries returns the entries of the log with a Seq greater than
+// since, oldest first.
+func (l *Log) Entries(since int64) ([]Entry, error) {
+	l.mu.Lock()
+	path := l.path
+	ents := append([]Entry(nil), l.mem...)
+	l.mu.Unlock()
+
+	if path != "" {
+		var err error
+		ents, err = readFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i, e := range ents {
+		if e.Seq > since {
+			return ents[i:], nil
+		}
+	}
+	return nil, nil
+}
+
+func readFile(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var ents []Entry
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		var e Entry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s: entry after %d: %v", path, len(ents), err)
+		}
+		ents = append(ents, e)
+	}
+	return ents, s.Err()
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package auditlog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auditlog-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	l := New()
+	if err := l.Append("prefs", "before SetFile"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.SetFile(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{"one", "two"} {
+		if err := l.Append("prefs", msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A new Log continues the chain in the same file.
+	l2 := New()
+	if err := l2.SetFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := l2.Append("logout", "three"); err != nil {
+		t.Fatal(err)
+	}
+
+	ents, err := l2.Entries(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgs []string
+	for i, e := range ents {
+		if e.Seq != int64(i+1) {
+			t.Errorf("entry %d has Seq %d", i, e.Seq)
+		}
+		msgs = append(msgs, e.Message)
+	}
+	if got, want := strings.Join(msgs, ","), "before SetFile,one,two,three"; got != want {
+		t.Errorf("messages = %q; want %q", got, want)
+	}
+	if err := Verify(ents); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+
+	since, err := l2.Entries(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(since) != 2 || since[0].Seq != 3 {
+		t.Errorf("Entries(2) = %+v; want entries 3 and 4", since)
+	}
+	if err := Verify(since); err != nil {
+		t.Errorf("Verify of suffix: %v", err)
+	}
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	l := New()
+	for _, msg := range []string{"a", "b", "c"} {
+		l.Append("prefs", msg)
+	}
+	ents, _ := l.Entries(0)
+
+	edited := append([]Entry(nil), ents...)
+	edited[1].Message = "B"
+	if err := Verify(edited); err == nil {
+		t.Error("edited entry not detected")
+	}
+
+	rehashed := append([]Entry(nil), ents...)
+	rehashed[1].Message = "B"
+	rehashed[1].Hash = rehashed[1].computeHash()
+	if err := Verify(rehashed); err == nil {
+		t.Error("rehashed entry not detected")
+	}
+
+	removed := []Entry{ents[0], ents[2]}
+	if err := Verify(removed); err == nil {
+		t.Error("removed entry not detected")
+	}
+}
@@ -12,17 +12,21 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/term"
@@ -44,14 +48,24 @@ type Config struct {
 	Collection string
 	PrivateID  logtail.PrivateID
 	PublicID   logtail.PublicID
+
+	// UploadDisabled is whether the user turned off log uploading
+	// with Policy.SetUploadDisabled. It persists across restarts.
+	UploadDisabled bool `json:",omitempty"`
 }
 
 // Policy is a logger and its public ID.
 type Policy struct {
-	// Logtail is the logger.
+	// Logtail is the logger. It's nil if uploading is disabled.
 	Logtail logtail.Logger
 	// PublicID is the logger's instance identifier.
 	PublicID logtail.PublicID
+
+	cfgPath string
+	local   io.Writer // where logs go when not uploading
+
+	mu     sync.Mutex
+	config Config
 }
 
 // ToBytes returns the JSON representation of c.
@@ -307,6 +321,84 @@ func tryFixLogStateLocation(dir, cmdname string) {
 	}
 }
 
+var uploadDisabled, _ = strconv.ParseBool(os.Getenv("TS_NO_LOGS_NO_SUPPORT"))
+
+// DisableUpload makes policies created later by New only log
+// locally, never uploading logs. It's for self-hosted deployments
+// that don't use Tailscale's log service; without the logs, Tailscale
+// can't help debug problems. Setting the environment variable
+// TS_NO_LOGS_NO_SUPPORT=true has the same effect.
+func DisableUpload() {
+	uploadDisabled = true
+}
+
+// LocalOptions configures where logs are written on the local
+// machine, in addition to stderr.
+type LocalOptions struct {
+	// File, if non-empty, is the path of a file to append logs to.
+	File string
+	// MaxSize is the size in bytes at which File is rotated. Zero
+	// means 10MB.
+	MaxSize int64
+	// MaxBackups is how many rotated files are kept, as File.1,
+	// File.2 and so on. Zero means 3.
+	MaxBackups int
+	// Syslog is whether to send logs to the local syslog daemon.
+	Syslog bool
+}
+
+var localOpts LocalOptions
+
+// SetLocalOutput makes policies created later by New also write logs
+// to the local file and syslog destinations in opts. Together with
+// DisableUpload, it keeps logs entirely on the machine.
+func SetLocalOutput(opts LocalOptions) {
+	localOpts = opts
+}
+
+// newLocalWriter returns the writer for logs that stay on this
+// machine: console and whatever localOpts asks for.
+func newLocalWriter(console *log.Logger, logf logger.Logf) io.Writer {
+	ws := []io.Writer{logWriter{console}}
+	if localOpts.File != "" {
+		maxSize, backups := localOpts.MaxSize, localOpts.MaxBackups
+		if maxSize <= 0 {
+			maxSize = 10 << 20
+		}
+		if backups <= 0 {
+			backups = 3
+		}
+		f, err := openRotatingFile(localOpts.File, maxSize, backups)
+		if err != nil {
+			logf("logpolicy: log file: %v", err)
+		} else {
+			ws = append(ws, logWriter{log.New(f, "", log.LstdFlags|log.Lmicroseconds)})
+		}
+	}
+	if localOpts.Syslog {
+		w, err := newSyslogWriter(version.CmdName())
+		if err != nil {
+			logf("logpolicy: syslog: %v", err)
+		} else {
+			ws = append(ws, w)
+		}
+	}
+	if len(ws) == 1 {
+		return ws[0]
+	}
+	return io.MultiWriter(ws...)
+}
+
+// logBaseURL returns the base URL to upload logs to: the value of
+// the TS_LOG_TARGET environment variable, if set, or else
+// Tailscale's log service.
+func logBaseURL() string {
+	if v := os.Getenv("TS_LOG_TARGET"); v != "" {
+		return strings.TrimRight(v, "/")
+	}
+	return "https://" + logtail.DefaultHost
+}
+
 // New returns a new log policy (a logger and its instance ID) for a
 // given collection name.
 func New(collection string) *Policy {
@@ -373,10 +465,39 @@ func New(collection string) *Policy {
 		}
 	}
 
+	local := newLocalWriter(console, earlyLogf)
+	pol := &Policy{
+		PublicID: newc.PublicID,
+		cfgPath:  cfgPath,
+		local:    local,
+		config:   newc,
+	}
+
+	if uploadDisabled || newc.UploadDisabled {
+		log.SetFlags(0) // other logflags are set on console, not here
+		log.SetOutput(local)
+		log.Printf("Program starting: v%v, Go %v: %#v",
+			version.Long,
+			goVersion(),
+			os.Args)
+		log.Printf("Log uploading disabled.")
+		if earlyErrBuf.Len() != 0 {
+			log.Printf("%s", earlyErrBuf.Bytes())
+		}
+		return pol
+	}
+
+	baseURL := logBaseURL()
+	logHost := logtail.DefaultHost
+	if u, err := url.Parse(baseURL); err == nil && u.Host != "" {
+		logHost = u.Hostname()
+	}
 	c := logtail.Config{
 		Collection: newc.Collection,
 		PrivateID:  newc.PrivateID,
-		Stderr:     logWriter{console},
+		BaseURL:    baseURL,
+		LowMemory:  version.IsLowResource(),
+		Stderr:     local,
 		NewZstdEncoder: func() logtail.Encoder {
 			w, err := smallzstd.NewEncoder(nil)
 			if err != nil {
@@ -384,7 +505,7 @@ func New(collection string) *Policy {
 			}
 			return w
 		},
-		HTTPC: &http.Client{Transport: newLogtailTransport(logtail.DefaultHost)},
+		HTTPC: &http.Client{Transport: newLogtailTransport(logHost)},
 	}
 
 	filchBuf, filchErr := filch.New(filepath.Join(dir, cmdName), filch.Options{})
@@ -407,10 +528,52 @@ func New(collection string) *Policy {
 		log.Printf("%s", earlyErrBuf.Bytes())
 	}
 
-	return &Policy{
-		Logtail:  lw,
-		PublicID: newc.PublicID,
+	pol.Logtail = lw
+	return pol
+}
+
+// Uploading reports whether p is uploading logs.
+func (p *Policy) Uploading() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.Logtail != nil
+}
+
+// UploadDisabled reports whether log uploading is turned off in p's
+// saved config, with SetUploadDisabled.
+func (p *Policy) UploadDisabled() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.config.UploadDisabled
+}
+
+// SetUploadDisabled turns log uploading off or on, saving the choice
+// for future runs. Turning it off stops uploading immediately,
+// dropping any logs not yet uploaded, and from then on logs only go
+// to the local destinations. Turning it back on takes effect the
+// next time the program starts.
+func (p *Policy) SetUploadDisabled(disabled bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cfgPath == "" {
+		return errors.New("logpolicy: no saved config")
+	}
+	c := p.config
+	c.UploadDisabled = disabled
+	if err := c.save(p.cfgPath); err != nil {
+		return err
 	}
+	p.config = c
+	if disabled && p.Logtail != nil {
+		lw := p.Logtail
+		p.Logtail = nil
+		log.SetOutput(p.local)
+		log.Printf("Log uploading disabled.")
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		lw.Shutdown(ctx)
+	}
+	return nil
 }
 
 // Close immediately shuts down the logger.
@@ -423,9 +586,12 @@ func (p *Policy) Close() {
 // Shutdown gracefully shuts down the logger, finishing any current
 // log upload if it can be done before ctx is canceled.
 func (p *Policy) Shutdown(ctx context.Context) error {
-	if p.Logtail != nil {
+	p.mu.Lock()
+	lw := p.Logtail
+	p.mu.Unlock()
+	if lw != nil {
 		log.Printf("flushing log.")
-		return p.Logtail.Shutdown(ctx)
+		return lw.Shutdown(ctx)
 	}
 	return nil
 }
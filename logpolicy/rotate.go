@@ -0,0 +1,79 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logpolicy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// rotatingFile is an io.Writer that appends to a log file. Once the
+// file grows past maxSize, it's renamed to path.1, path.1 to path.2
+// and so on, keeping at most backups old files, and a new file is
+// started.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	backups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, err
+	}
+	r := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := r.openLocked(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) openLocked() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotateLocked(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotateLocked() error {
+	r.f.Close()
+	backup := func(i int) string { return fmt.Sprintf("%s.%d", r.path, i) }
+	os.Remove(backup(r.backups))
+	for i := r.backups - 1; i >= 1; i-- {
+		os.Rename(backup(i), backup(i+1))
+	}
+	if r.backups > 0 {
+		os.Rename(r.path, backup(1))
+	} else {
+		os.Remove(r.path)
+	}
+	return r.openLocked()
+}
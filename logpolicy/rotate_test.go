@@ -0,0 +1,60 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logpolicy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logpolicy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tailscaled.log")
+
+	r, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"aaaa\n", "bbbb\n", "cccc\n", "dddd\n", "eeee\n", "ffff\n", "gggg\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.f.Close()
+
+	want := map[string]string{
+		"tailscaled.log":   "gggg\n",
+		"tailscaled.log.1": "eeee\nffff\n",
+		"tailscaled.log.2": "cccc\ndddd\n",
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != len(want) {
+		var names []string
+		for _, fi := range fis {
+			names = append(names, fi.Name())
+		}
+		t.Errorf("files = %s; want %d files", strings.Join(names, ", "), len(want))
+	}
+	for name, content := range want {
+		got, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(got) != content {
+			t.Errorf("%s = %q; want %q", name, got, content)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package logpolicy
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"user":     syslog.LOG_USER,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// newSyslogWriter returns a writer that sends each write to the
+// local syslog daemon as an informational daemon message.
+func newSyslogWriter(tag string) (io.Writer, error) {
+	return NewSyslogWriter(tag, "daemon")
+}
+
+// NewSyslogWriter returns a writer that sends each write to the local
+// syslog daemon, or journald, as an informational message with the
+// given tag and facility: "daemon", "auth", "authpriv", "user" or
+// "local0" through "local7".
+func NewSyslogWriter(tag, facility string) (io.Writer, error) {
+	f, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+	return syslog.New(syslog.LOG_INFO|f, tag)
+}
@@ -0,0 +1,19 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logpolicy
+
+import (
+	"errors"
+	"io"
+)
+
+func newSyslogWriter(tag string) (io.Writer, error) {
+	return nil, errors.New("syslog not supported on Windows")
+}
+
+// NewSyslogWriter returns an error: there's no syslog on Windows.
+func NewSyslogWriter(tag, facility string) (io.Writer, error) {
+	return newSyslogWriter(tag)
+}
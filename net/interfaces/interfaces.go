@@ -68,7 +68,8 @@ func isUp(nif *net.Interface) bool       { return nif.Flags&net.FlagUp != 0 }
 func isLoopback(nif *net.Interface) bool { return nif.Flags&net.FlagLoopback != 0 }
 
 // LocalAddresses returns the machine's IP addresses, separated by
-// whether they're loopback addresses.
+// whether they're loopback addresses. IPv6 link-local addresses and
+// Tailscale's own addresses are omitted.
 func LocalAddresses() (regular, loopback []string, err error) {
 	// TODO(crawshaw): don't serve interface addresses that we are routing
 	ifaces, err := net.Interfaces()
@@ -94,9 +95,8 @@ func LocalAddresses() (regular, loopback []string, err error) {
 				if !ok {
 					continue
 				}
-				if ip.Is6() {
-					// TODO(crawshaw): IPv6 support.
-					// Easy to do here, but we need good endpoint ordering logic.
+				if ip.Is6() && v.IP.IsLinkLocalUnicast() {
+					// Unusable without a zone.
 					continue
 				}
 				// TODO(apenwarr): don't special case cgNAT.
@@ -118,9 +118,59 @@ func LocalAddresses() (regular, loopback []string, err error) {
 			}
 		}
 	}
+	// IPv4 first, as those are more likely to work.
+	sortIPv4First(regular)
+	sortIPv4First(loopback)
 	return regular, loopback, nil
 }
 
+// LANPrefixes returns the subnets of the machine's up, non-loopback
+// interfaces: the networks whose hosts it can reach without a
+// router. Link-local and Tailscale subnets are omitted.
+func LANPrefixes() ([]netaddr.IPPrefix, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var ret []netaddr.IPPrefix
+	for i := range ifaces {
+		iface := &ifaces[i]
+		if !isUp(iface) || isLoopback(iface) || isTailscaleInterfaceName(iface.Name) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			v, ok := a.(*net.IPNet)
+			if !ok || v.IP.IsLinkLocalUnicast() || IsTailscaleIP(v.IP) {
+				continue
+			}
+			ones, bits := v.Mask.Size()
+			if bits == 0 || ones == bits {
+				// Non-canonical mask, or a point-to-point
+				// address with no neighbors.
+				continue
+			}
+			ip, ok := netaddr.FromStdIP(v.IP.Mask(v.Mask))
+			if !ok {
+				continue
+			}
+			ret = append(ret, netaddr.IPPrefix{IP: ip, Bits: uint8(ones)})
+		}
+	}
+	return ret, nil
+}
+
+// sortIPv4First stably sorts the IPv4 addresses in ips before the
+// IPv6 ones.
+func sortIPv4First(ips []string) {
+	sort.SliceStable(ips, func(i, j int) bool {
+		return !strings.Contains(ips[i], ":") && strings.Contains(ips[j], ":")
+	})
+}
+
 // Interface is a wrapper around Go's net.Interface with some extra methods.
 type Interface struct {
 	*net.Interface
@@ -376,6 +426,13 @@ func isPrivateIP(ip netaddr.IP) bool {
 	return private1.Contains(ip) || private2.Contains(ip) || private3.Contains(ip)
 }
 
+// IsPrivateIP reports whether ip is a private address, only
+// meaningful within its own network: an RFC 1918 IPv4 address or an
+// IPv6 unique local address.
+func IsPrivateIP(ip netaddr.IP) bool {
+	return isPrivateIP(ip) || privatev6.Contains(ip)
+}
+
 func isGlobalV6(ip netaddr.IP) bool {
 	return v6Global1.Contains(ip)
 }
@@ -393,6 +450,7 @@ var (
 	private2      = mustCIDR("172.16.0.0/12")
 	private3      = mustCIDR("192.168.0.0/16")
 	privatev4s    = []netaddr.IPPrefix{private1, private2, private3}
+	privatev6     = mustCIDR("fc00::/7")
 	linkLocalIPv4 = mustCIDR("169.254.0.0/16")
 	v6Global1     = mustCIDR("2000::/3")
 )
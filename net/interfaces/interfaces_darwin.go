@@ -30,8 +30,8 @@ default            link#14            UCSI         utun2
 
 */
 func likelyHomeRouterIPDarwinExec() (ret netaddr.IP, ok bool) {
-	if version.IsMobile() {
-		// Don't try to do subprocesses on iOS. Ends up with log spam like:
+	if version.IsSandboxed() {
+		// Don't try to do subprocesses in a Network Extension. Ends up with log spam like:
 		// kernel: "Sandbox: IPNExtension(86580) deny(1) process-fork"
 		// This is why we have likelyHomeRouterIPDarwinSyscall.
 		return ret, false
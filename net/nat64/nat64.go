@@ -0,0 +1,180 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package nat64 reaches IPv4 addresses from IPv6-only networks that
+// offer NAT64, by finding the network's NAT64 prefix through its DNS64
+// resolver (RFC 7050) and embedding IPv4 addresses in it (RFC 6052).
+//
+// Only /96 prefixes, by far the most common, are supported.
+package nat64
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// WellKnownPrefix is the NAT64 prefix reserved by RFC 6052,
+// 64:ff9b::/96, used until the network's own is known.
+var WellKnownPrefix = netaddr.IPPrefix{IP: netaddr.IPFrom16([16]byte{0, 0x64, 0xff, 0x9b}), Bits: 96}
+
+// wellKnownName is the name whose only records are the IPv4
+// addresses 192.0.0.170 and 192.0.0.171, so that any AAAA records a
+// DNS64 resolver returns for it reveal its NAT64 prefix.
+const wellKnownName = "ipv4only.arpa"
+
+// refreshInterval is how long a discovered prefix, or its absence,
+// is cached for.
+const refreshInterval = 5 * time.Minute
+
+// lookupMu serializes Refresh's lookups. It's held without mu, so
+// that Prefix never waits on DNS.
+var lookupMu sync.Mutex
+
+var (
+	mu         sync.Mutex
+	discovered netaddr.IPPrefix // zero if none found
+	lastLookup time.Time
+)
+
+// Discover returns the NAT64 prefix of the network r resolves names
+// on, if it has a DNS64 resolver. If r is nil, net.DefaultResolver is
+// used.
+func Discover(ctx context.Context, r *net.Resolver) (netaddr.IPPrefix, error) {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	addrs, err := r.LookupIPAddr(ctx, wellKnownName)
+	if err != nil {
+		return netaddr.IPPrefix{}, err
+	}
+	return prefixFromAddrs(addrs)
+}
+
+// prefixFromAddrs returns the NAT64 prefix embedded in addrs, the
+// addresses of wellKnownName.
+func prefixFromAddrs(addrs []net.IPAddr) (netaddr.IPPrefix, error) {
+	for _, a := range addrs {
+		if a.IP.To4() != nil || len(a.IP) != net.IPv6len {
+			continue
+		}
+		if tail := a.IP[12:]; tail[0] != 192 || tail[1] != 0 || tail[2] != 0 || (tail[3] != 170 && tail[3] != 171) {
+			continue
+		}
+		var b [16]byte
+		copy(b[:12], a.IP)
+		return netaddr.IPPrefix{IP: netaddr.IPFrom16(b), Bits: 96}, nil
+	}
+	return netaddr.IPPrefix{}, errors.New("no DNS64")
+}
+
+// Refresh looks for the current network's NAT64 prefix, if it's been
+// more than a few minutes since the last look, and records it for
+// Prefix and Synthesize. It reports whether there is one.
+func Refresh(ctx context.Context) bool {
+	lookupMu.Lock()
+	defer lookupMu.Unlock()
+	mu.Lock()
+	fresh := !lastLookup.IsZero() && time.Since(lastLookup) < refreshInterval
+	found := discovered != (netaddr.IPPrefix{})
+	mu.Unlock()
+	if fresh {
+		return found
+	}
+
+	p, err := Discover(ctx, nil)
+	if err != nil && ctx.Err() != nil {
+		// Don't cache our own impatience.
+		return false
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	discovered, lastLookup = p, time.Now()
+	return err == nil
+}
+
+// Forget drops the discovered prefix, as when the network changed,
+// so that the next Refresh looks again.
+func Forget() {
+	mu.Lock()
+	defer mu.Unlock()
+	discovered, lastLookup = netaddr.IPPrefix{}, time.Time{}
+}
+
+// Prefix returns the NAT64 prefix last found by Refresh, or
+// WellKnownPrefix if none was.
+func Prefix() netaddr.IPPrefix {
+	mu.Lock()
+	defer mu.Unlock()
+	if discovered == (netaddr.IPPrefix{}) {
+		return WellKnownPrefix
+	}
+	return discovered
+}
+
+// Synthesize returns the IPv6 address through which NAT64 reaches
+// the IPv4 address ip4, in Prefix.
+func Synthesize(ip4 netaddr.IP) netaddr.IP {
+	b := Prefix().IP.As16()
+	a := ip4.As4()
+	copy(b[12:], a[:])
+	return netaddr.IPFrom16(b)
+}
+
+// Unmap returns the IPv4 address that the IPv6 address ip stands
+// for, if it's in Prefix or WellKnownPrefix, or is a v4-mapped
+// address (::ffff:a.b.c.d).
+func Unmap(ip netaddr.IP) (_ netaddr.IP, ok bool) {
+	if !ip.Is6() {
+		return ip, false
+	}
+	b := ip.As16()
+	if !isV4Mapped(b) && !WellKnownPrefix.Contains(ip) && !Prefix().Contains(ip) {
+		return ip, false
+	}
+	return netaddr.IPv4(b[12], b[13], b[14], b[15]), true
+}
+
+func isV4Mapped(b [16]byte) bool {
+	for _, v := range b[:10] {
+		if v != 0 {
+			return false
+		}
+	}
+	return b[10] == 0xff && b[11] == 0xff
+}
+
+// DialContextFunc is the type of net.Dialer.DialContext.
+type DialContextFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Dialer returns a DialContextFunc like fwd, except that a TCP dial
+// of an IPv4 address that fails is retried over IPv6 through the
+// network's NAT64, if it has a DNS64 resolver to tell its prefix.
+// Control and DERP servers given by IPv4 address are thereby
+// reachable from IPv6-only networks.
+func Dialer(fwd DialContextFunc) DialContextFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		c, err := fwd(ctx, network, address)
+		if err == nil || (network != "tcp" && network != "tcp4") {
+			return c, err
+		}
+		host, port, serr := net.SplitHostPort(address)
+		if serr != nil {
+			return nil, err
+		}
+		ip, perr := netaddr.ParseIP(host)
+		if perr != nil || !ip.Is4() || !Refresh(ctx) {
+			return nil, err
+		}
+		c, err6 := fwd(ctx, "tcp6", net.JoinHostPort(Synthesize(ip).String(), port))
+		if err6 != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+}
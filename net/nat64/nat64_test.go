@@ -0,0 +1,84 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package nat64
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestPrefixFromAddrs(t *testing.T) {
+	addrs := func(ips ...string) (ret []net.IPAddr) {
+		for _, s := range ips {
+			ret = append(ret, net.IPAddr{IP: net.ParseIP(s)})
+		}
+		return ret
+	}
+	tests := []struct {
+		addrs []net.IPAddr
+		want  string // or empty for an error
+	}{
+		{addrs("192.0.0.170", "192.0.0.171"), ""},
+		{addrs("192.0.0.170", "64:ff9b::c000:aa"), "64:ff9b::/96"},
+		{addrs("2001:db8:64::c000:ab"), "2001:db8:64::/96"},
+		{addrs("2001:db8:64::1"), ""},
+	}
+	for i, tt := range tests {
+		p, err := prefixFromAddrs(tt.addrs)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%d. got %v; want error", i, p)
+			}
+			continue
+		}
+		if err != nil || p.String() != tt.want {
+			t.Errorf("%d. got %v, %v; want %v", i, p, err, tt.want)
+		}
+	}
+}
+
+func TestSynthesizeUnmap(t *testing.T) {
+	defer Forget()
+	ip4 := netaddr.IPv4(192, 0, 2, 33)
+	mustIP := func(s string) netaddr.IP {
+		ip, err := netaddr.ParseIP(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ip
+	}
+	check := func(want string) {
+		t.Helper()
+		ip6 := Synthesize(ip4)
+		if ip6.String() != want {
+			t.Errorf("Synthesize = %v; want %v", ip6, want)
+		}
+		if got, ok := Unmap(ip6); !ok || got != ip4 {
+			t.Errorf("Unmap(%v) = %v, %v; want %v, true", ip6, got, ok, ip4)
+		}
+	}
+	check("64:ff9b::c000:221")
+
+	mu.Lock()
+	discovered, lastLookup = netaddr.IPPrefix{IP: mustIP("2001:db8:64::"), Bits: 96}, time.Now()
+	mu.Unlock()
+	check("2001:db8:64::c000:221")
+	if got, ok := Unmap(mustIP("64:ff9b::c000:221")); !ok || got != ip4 {
+		t.Errorf("Unmap of well-known prefix = %v, %v; want %v, true", got, ok, ip4)
+	}
+
+	mapped := netaddr.IPFrom16([16]byte{10: 0xff, 11: 0xff, 12: 192, 13: 0, 14: 2, 15: 33}) // ::ffff:192.0.2.33
+	if got, ok := Unmap(mapped); !ok || got != ip4 {
+		t.Errorf("Unmap of v4-mapped = %v, %v; want %v, true", got, ok, ip4)
+	}
+	for _, s := range []string{"2001:db8::c000:221", "192.0.2.33"} {
+		if got, ok := Unmap(mustIP(s)); ok {
+			t.Errorf("Unmap(%v) = %v, true; want false", s, got)
+		}
+	}
+}
@@ -82,6 +82,7 @@ type Report struct {
 	IPv4                  bool     // IPv4 works
 	MappingVariesByDestIP opt.Bool // for IPv4
 	HairPinning           opt.Bool // for IPv4
+	BehindNAT             opt.Bool // for IPv4; whether GlobalV4 isn't the host's own
 
 	// UPnP is whether UPnP appears present on the LAN.
 	// Empty means not checked.
@@ -109,6 +110,67 @@ func (r *Report) AnyPortMappingChecked() bool {
 	return r.UPnP != "" || r.PMP != "" || r.PCP != ""
 }
 
+// anyPortMapping reports whether any of UPnP, PMP, or PCP are
+// available.
+func (r *Report) anyPortMapping() bool {
+	return r.UPnP.EqualBool(true) || r.PMP.EqualBool(true) || r.PCP.EqualBool(true)
+}
+
+// The NAT types of Report.NATType.
+//
+// NATs differ in how they map a host's local UDP port to a public
+// one, and in which packets they let in to it. Disco's hole punching
+// gets through whatever the filtering as long as the mapping is
+// endpoint-independent, so the types go by mapping alone; filtering
+// isn't classified, as it can't be measured: DERP's STUN servers
+// only reply from the address they were sent to.
+const (
+	// NATNone means there's no NAT: the host's IPv4 address is
+	// its global one.
+	NATNone = "none"
+	// NATEasy means the NAT maps a local port to the same public
+	// port whatever the destination (endpoint-independent
+	// mapping), or that the host can map a port with UPnP, NAT-PMP
+	// or PCP. Direct connections work to most peers.
+	NATEasy = "easy"
+	// NATHard means the NAT's mapping varies by destination
+	// (endpoint-dependent mapping). Connections to peers behind
+	// hard NATs too are relayed through DERP.
+	NATHard = "hard"
+	// NATUDPBlocked means no UDP gets out, so connections to all
+	// peers are relayed through DERP.
+	NATUDPBlocked = "udp-blocked"
+)
+
+// NATType classifies the host's IPv4 NAT as one of NATNone,
+// NATEasy, NATHard or NATUDPBlocked, or returns the empty string if
+// not enough is known. It describes the network r was made on, so
+// it isn't kept past the next report, nor across restarts.
+func (r *Report) NATType() string {
+	switch {
+	case len(r.RegionLatency) == 0:
+		// Nothing reached; the network's likely down.
+		return ""
+	case !r.UDP:
+		return NATUDPBlocked
+	case !r.IPv4:
+		return ""
+	case r.BehindNAT.EqualBool(false):
+		return NATNone
+	case r.anyPortMapping():
+		return NATEasy
+	}
+	varies, ok := r.MappingVariesByDestIP.Get()
+	switch {
+	case !ok:
+		return ""
+	case varies:
+		return NATHard
+	default:
+		return NATEasy
+	}
+}
+
 func (r *Report) Clone() *Report {
 	if r == nil {
 		return nil
@@ -974,6 +1036,16 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (*Report, e
 	}
 
 	rs.mu.Lock()
+	if rs.incremental && rs.report.MappingVariesByDestIP == "" {
+		// Incremental reports may hear from just one region
+		// over IPv4, but the NAT's the same as at the last.
+		rs.report.MappingVariesByDestIP = last.MappingVariesByDestIP
+	}
+	if ipp, err := netaddr.ParseIPPort(rs.report.GlobalV4); err == nil {
+		if local, ok := isLocalIP(ipp.IP); ok {
+			rs.report.BehindNAT.Set(!local)
+		}
+	}
 	report := rs.report.Clone()
 	rs.mu.Unlock()
 
@@ -983,6 +1055,17 @@ func (c *Client) GetReport(ctx context.Context, dm *tailcfg.DERPMap) (*Report, e
 	return report, nil
 }
 
+// isLocalIP reports whether ip is one of the host's interface
+// addresses, if the interfaces can be listed.
+func isLocalIP(ip netaddr.IP) (local, ok bool) {
+	err := interfaces.ForeachInterfaceAddress(func(_ interfaces.Interface, ifIP netaddr.IP) {
+		if ifIP == ip {
+			local = true
+		}
+	})
+	return local, err == nil
+}
+
 func (c *Client) measureHTTPSLatency(ctx context.Context, reg *tailcfg.DERPRegion) (time.Duration, netaddr.IP, error) {
 	var result httpstat.Result
 	ctx, cancel := context.WithTimeout(httpstat.WithHTTPStat(ctx, &result), overallProbeTimeout)
@@ -1102,6 +1185,10 @@ func (c *Client) addReportHistoryAndSetPreferredDERP(r *Report) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	var prevDERP int
+	if c.last != nil {
+		prevDERP = c.last.PreferredDERP
+	}
 	if c.prev == nil {
 		c.prev = map[time.Time]*Report{}
 	}
@@ -1136,6 +1223,28 @@ func (c *Client) addReportHistoryAndSetPreferredDERP(r *Report) {
 			r.PreferredDERP = hp
 		}
 	}
+
+	// If the previous home region is still reachable and the new
+	// best one isn't much better, stay put. Moving home disrupts
+	// DERP-relayed connections while peers learn the new region,
+	// so it's not worth doing for noise-level differences. Both
+	// are compared by their best recent latency, so that one slow
+	// sample doesn't move home.
+	if prevDERP != 0 && r.PreferredDERP != prevDERP {
+		if _, ok := r.RegionLatency[prevDERP]; ok && !muchBetterDERP(bestAny, bestRecent[prevDERP]) {
+			r.PreferredDERP = prevDERP
+		}
+	}
+}
+
+// muchBetterDERP reports whether a region with latency d is enough
+// better than the current home region, with latency cur, to move to.
+func muchBetterDERP(d, cur time.Duration) bool {
+	const (
+		minImprovementFraction = 3 // must be at least 1/3 faster
+		minImprovement         = 10 * time.Millisecond
+	)
+	return cur-d >= cur/minImprovementFraction && cur-d >= minImprovement
 }
 
 func updateLatency(m map[int]time.Duration, regionID int, d time.Duration) {
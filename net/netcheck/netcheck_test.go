@@ -76,6 +76,9 @@ func TestBasic(t *testing.T) {
 	if r.PreferredDERP != 1 {
 		t.Errorf("PreferredDERP = %v; want 1", r.PreferredDERP)
 	}
+	if got := r.NATType(); got != NATNone {
+		t.Errorf("NATType = %q; want %q, for STUN on localhost", got, NATNone)
+	}
 }
 
 func TestWorksWhenUDPBlocked(t *testing.T) {
@@ -110,6 +113,29 @@ func TestWorksWhenUDPBlocked(t *testing.T) {
 	}
 }
 
+func TestNATType(t *testing.T) {
+	reached := map[int]time.Duration{1: time.Millisecond}
+	tests := []struct {
+		name string
+		r    *Report
+		want string
+	}{
+		{"nothing_reached", &Report{}, ""},
+		{"udp_blocked", &Report{RegionLatency: reached, IPv4: true}, NATUDPBlocked},
+		{"no_nat", &Report{RegionLatency: reached, UDP: true, IPv4: true, BehindNAT: "false", MappingVariesByDestIP: "false"}, NATNone},
+		{"easy", &Report{RegionLatency: reached, UDP: true, IPv4: true, BehindNAT: "true", MappingVariesByDestIP: "false"}, NATEasy},
+		{"hard", &Report{RegionLatency: reached, UDP: true, IPv4: true, BehindNAT: "true", MappingVariesByDestIP: "true"}, NATHard},
+		{"hard_with_portmap", &Report{RegionLatency: reached, UDP: true, IPv4: true, MappingVariesByDestIP: "true", PMP: "true"}, NATEasy},
+		{"mapping_unknown", &Report{RegionLatency: reached, UDP: true, IPv4: true, BehindNAT: "true"}, ""},
+		{"ipv6_only", &Report{RegionLatency: reached, UDP: true, IPv6: true}, ""},
+	}
+	for _, tt := range tests {
+		if got := tt.r.NATType(); got != tt.want {
+			t.Errorf("%s: NATType = %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
 func TestAddReportHistoryAndSetPreferredDERP(t *testing.T) {
 	// report returns a *Report from (DERP host, time.Duration)+ pairs.
 	report := func(a ...interface{}) *Report {
@@ -195,6 +221,42 @@ func TestAddReportHistoryAndSetPreferredDERP(t *testing.T) {
 			wantPrevLen: 1, // t=[0123]s all gone. (too old, older than 10 min)
 			wantDERP:    3, // only option
 		},
+		{
+			name: "home_sticks_on_small_improvement",
+			steps: []step{
+				{0, report("d1", 4, "d2", 5)},
+				{10 * time.Minute, report("d1", 4, "d2", 3)},
+			},
+			wantPrevLen: 1,
+			wantDERP:    1, // d2 is better, but not by a third
+		},
+		{
+			name: "home_moves_on_big_improvement",
+			steps: []step{
+				{0, report("d1", 4, "d2", 5)},
+				{10 * time.Minute, report("d1", 4, "d2", 2)},
+			},
+			wantPrevLen: 1,
+			wantDERP:    2,
+		},
+		{
+			name: "home_sticks_on_tiny_absolute_improvement",
+			steps: []step{
+				{0, report("d1", 6*time.Millisecond, "d2", 9*time.Millisecond)},
+				{10 * time.Minute, report("d1", 6*time.Millisecond, "d2", 1*time.Millisecond)},
+			},
+			wantPrevLen: 1,
+			wantDERP:    1, // d2 is much faster, but only by 5ms
+		},
+		{
+			name: "home_sticks_on_one_slow_sample",
+			steps: []step{
+				{0, report("d1", 4, "d2", 5)},
+				{1 * time.Second, report("d1", 10, "d2", 3)},
+			},
+			wantPrevLen: 2,
+			wantDERP:    1, // d1's best recent 4 is about d2's 3
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -17,6 +17,7 @@ package netns
 import (
 	"context"
 	"net"
+	"syscall"
 )
 
 // Listener returns a new net.Listener with its Control hook func
@@ -26,6 +27,16 @@ func Listener() *net.ListenConfig {
 	return &net.ListenConfig{Control: control}
 }
 
+// ListenerOnInterface is like Listener, but the sockets it creates
+// send via the network interface ifName regardless of the routing
+// table, on systems that support that (Linux and Windows). Elsewhere
+// the socket's bind address alone determines its path.
+func ListenerOnInterface(ifName string) *net.ListenConfig {
+	return &net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		return controlOnInterface(ifName, network, address, c)
+	}}
+}
+
 // NewDialer returns a new Dialer using a net.Dialer with its Control
 // hook func initialized as necessary to run in a logical network
 // namespace that doesn't route back into Tailscale. It also handles
@@ -12,3 +12,8 @@ import "syscall"
 func control(network, address string, c syscall.RawConn) error {
 	return nil
 }
+
+// controlOnInterface does nothing to c.
+func controlOnInterface(ifName, network, address string, c syscall.RawConn) error {
+	return nil
+}
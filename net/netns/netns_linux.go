@@ -21,7 +21,8 @@ import (
 // table lookups.
 //
 // Keep this in sync with tailscaleBypassMark in
-// wgengine/router/router_linux.go.
+// wgengine/router/router_linux.go and kernelBypassMark in
+// wgengine/kernel_linux.go.
 const tailscaleBypassMark = 0x80000
 
 // ipRuleOnce is the sync.Once & cached value for ipRuleAvailable.
@@ -80,6 +81,27 @@ func control(network, address string, c syscall.RawConn) error {
 	return sockErr
 }
 
+// controlOnInterface marks c like control, but binds it to the
+// interface ifName.
+func controlOnInterface(ifName, network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if ipRuleAvailable() {
+			if sockErr = setBypassMark(fd); sockErr != nil {
+				return
+			}
+		}
+		sockErr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, ifName)
+	})
+	if err != nil {
+		return fmt.Errorf("RawConn.Control on %T: %w", c, err)
+	}
+	if sockErr != nil {
+		return fmt.Errorf("binding to %s: %w", ifName, sockErr)
+	}
+	return nil
+}
+
 func setBypassMark(fd uintptr) error {
 	if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, tailscaleBypassMark); err != nil {
 		return fmt.Errorf("setting SO_MARK bypass: %w", err)
@@ -6,6 +6,7 @@ package netns
 
 import (
 	"math/bits"
+	"net"
 	"strings"
 	"syscall"
 
@@ -69,6 +70,24 @@ func control(network, address string, c syscall.RawConn) error {
 	return nil
 }
 
+// controlOnInterface binds c to the Windows interface ifName.
+func controlOnInterface(ifName, network, address string, c syscall.RawConn) error {
+	ifc, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return err
+	}
+	switch network {
+	case "tcp4", "udp4":
+		return bindSocket4(c, uint32(ifc.Index))
+	case "tcp6", "udp6":
+		return bindSocket6(c, uint32(ifc.Index))
+	}
+	if err := bindSocket4(c, uint32(ifc.Index)); err != nil {
+		return err
+	}
+	return bindSocket6(c, uint32(ifc.Index))
+}
+
 // sockoptBoundInterface is the value of IP_UNICAST_IF and IPV6_UNICAST_IF.
 //
 // See https://docs.microsoft.com/en-us/windows/win32/winsock/ipproto-ip-socket-options
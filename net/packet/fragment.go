@@ -0,0 +1,63 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import "encoding/binary"
+
+const (
+	ip4FlagDF   = 0x4000 // Don't Fragment
+	ip4FlagMF   = 0x2000 // More Fragments
+	ip4FragOfs  = 0x1fff // fragment offset, in 8-byte units
+	ip4FragUnit = 8
+)
+
+// Fragment splits q, an IPv4 packet larger than mtu, into fragments
+// of at most mtu bytes each, as a router on its way would. q may
+// itself be a fragment.
+//
+// It returns nil if q can't be fragmented, in which case the sender
+// should get TooBig instead: if q isn't IPv4, has the Don't Fragment
+// bit or IP options, or mtu is too small for fragments that Decode
+// would let through, which it treats as attempts to hide the
+// transport header.
+func (q *Parsed) Fragment(mtu int) [][]byte {
+	if q.IPVersion != 4 || q.length <= mtu || q.subofs != ip4HeaderLength {
+		return nil
+	}
+	b := q.b[:q.length]
+	flags := binary.BigEndian.Uint16(b[6:8])
+	if flags&ip4FlagDF != 0 {
+		return nil
+	}
+	chunk := (mtu - ip4HeaderLength) &^ (ip4FragUnit - 1)
+	if chunk < minFrag*ip4FragUnit {
+		return nil
+	}
+	ofs := int(flags & ip4FragOfs)
+	payload := b[ip4HeaderLength:]
+	var frags [][]byte
+	for len(payload) > 0 {
+		n := chunk
+		if n > len(payload) {
+			n = len(payload)
+		}
+		f := make([]byte, ip4HeaderLength+n)
+		copy(f, b[:ip4HeaderLength])
+		copy(f[ip4HeaderLength:], payload[:n])
+		payload = payload[n:]
+
+		ff := uint16(ofs)
+		if len(payload) > 0 || flags&ip4FlagMF != 0 {
+			ff |= ip4FlagMF
+		}
+		ofs += n / ip4FragUnit
+		binary.BigEndian.PutUint16(f[2:4], uint16(len(f)))
+		binary.BigEndian.PutUint16(f[6:8], ff)
+		binary.BigEndian.PutUint16(f[10:12], 0)
+		binary.BigEndian.PutUint16(f[10:12], ip4Checksum(f[:ip4HeaderLength]))
+		frags = append(frags, f)
+	}
+	return frags
+}
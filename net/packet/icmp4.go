@@ -43,6 +43,10 @@ type ICMP4Code uint8
 
 const (
 	ICMP4NoCode ICMP4Code = 0
+
+	// ICMP4FragNeeded is the code of an ICMP4Unreachable saying
+	// the packet needed fragmenting but had the Don't Fragment bit.
+	ICMP4FragNeeded ICMP4Code = 4
 )
 
 // ICMP4Header is an IPv4+ICMPv4 header.
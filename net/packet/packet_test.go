@@ -6,6 +6,7 @@ package packet
 
 import (
 	"bytes"
+	"encoding/binary"
 	"reflect"
 	"testing"
 
@@ -500,3 +501,126 @@ func TestMarshalResponse(t *testing.T) {
 		})
 	}
 }
+
+func TestTooBig(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       []byte
+		wantType uint8
+		wantMTU  int
+	}{
+		{"udp4", udp4RequestBuffer, uint8(ICMP4Unreachable), 1280},
+		{"tcp6", tcp6RequestBuffer, uint8(ICMP6PacketTooBig), 1400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var q Parsed
+			q.Decode(tt.in)
+			b := q.TooBig(tt.wantMTU)
+			if b == nil {
+				t.Fatal("TooBig = nil")
+			}
+
+			var got Parsed
+			got.Decode(b)
+			if got.IPVersion != q.IPVersion || got.SrcIP4 != q.DstIP4 || got.DstIP4 != q.SrcIP4 || got.SrcIP6 != q.DstIP6 || got.DstIP6 != q.SrcIP6 {
+				t.Errorf("got %v; want a reply to %v", &got, &q)
+			}
+			if !got.IsError() {
+				t.Errorf("got %v; want an ICMP error", &got)
+			}
+			icmp := b[got.subofs:]
+			if icmp[0] != tt.wantType {
+				t.Errorf("type = %d; want %d", icmp[0], tt.wantType)
+			}
+			var mtu int
+			if q.IPVersion == 4 {
+				mtu = int(binary.BigEndian.Uint16(icmp[6:8]))
+				if ip4Checksum(icmp) != 0 {
+					t.Error("bad ICMPv4 checksum")
+				}
+			} else {
+				mtu = int(binary.BigEndian.Uint32(icmp[4:8]))
+				pseudo := append([]byte(nil), b...)
+				IP6Header{IPProto: ICMPv6, SrcIP: got.SrcIP6, DstIP: got.DstIP6}.marshalPseudo(pseudo)
+				if ip4Checksum(pseudo) != 0 {
+					t.Error("bad ICMPv6 checksum")
+				}
+			}
+			if mtu != tt.wantMTU {
+				t.Errorf("MTU = %d; want %d", mtu, tt.wantMTU)
+			}
+			if !bytes.Equal(icmp[8:], tt.in) {
+				t.Errorf("quoted %x; want %x", icmp[8:], tt.in)
+			}
+
+			if got.TooBig(1280) != nil {
+				t.Error("TooBig of an ICMP error isn't nil")
+			}
+		})
+	}
+}
+
+func TestFragment(t *testing.T) {
+	payload := make([]byte, 3000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	h := UDP4Header{
+		IP4Header: IP4Header{IPID: 0xbeef, SrcIP: IP4(0x01020304), DstIP: IP4(0x05060708)},
+		SrcPort:   1234,
+		DstPort:   5678,
+	}
+	pkt := Generate(&h, payload)
+
+	var q Parsed
+	q.Decode(pkt)
+	frags := q.Fragment(1280)
+	if len(frags) != 3 {
+		t.Fatalf("got %d fragments; want 3", len(frags))
+	}
+	var joined []byte
+	for i, f := range frags {
+		if len(f) > 1280 {
+			t.Errorf("fragment %d is %d bytes; want at most 1280", i, len(f))
+		}
+		if ip4Checksum(f[:ip4HeaderLength]) != 0 {
+			t.Errorf("fragment %d: bad header checksum", i)
+		}
+		if int(binary.BigEndian.Uint16(f[2:4])) != len(f) {
+			t.Errorf("fragment %d: bad total length", i)
+		}
+		if !bytes.Equal(f[4:6], pkt[4:6]) || !bytes.Equal(f[12:20], pkt[12:20]) {
+			t.Errorf("fragment %d: ID or addresses changed", i)
+		}
+		flags := binary.BigEndian.Uint16(f[6:8])
+		if got, want := flags&ip4FlagMF != 0, i < len(frags)-1; got != want {
+			t.Errorf("fragment %d: MF = %v; want %v", i, got, want)
+		}
+		if got := int(flags&ip4FragOfs) * ip4FragUnit; got != len(joined) {
+			t.Errorf("fragment %d: offset %d; want %d", i, got, len(joined))
+		}
+		var fq Parsed
+		fq.Decode(f)
+		if i == 0 && fq.IPProto != UDP || i > 0 && fq.IPProto != Fragment {
+			t.Errorf("fragment %d decodes as %v", i, fq.IPProto)
+		}
+		joined = append(joined, f[ip4HeaderLength:]...)
+	}
+	if !bytes.Equal(joined, pkt[ip4HeaderLength:]) {
+		t.Error("fragments don't add up to the packet")
+	}
+
+	if q.Fragment(len(pkt)) != nil {
+		t.Error("fragmented a packet that fits")
+	}
+	if q.Fragment(600) != nil {
+		t.Error("fragmented into fragments Decode would drop")
+	}
+	df := append([]byte(nil), pkt...)
+	binary.BigEndian.PutUint16(df[6:8], ip4FlagDF)
+	q.Decode(df)
+	if q.Fragment(1280) != nil {
+		t.Error("fragmented a packet with Don't Fragment")
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import "encoding/binary"
+
+const (
+	// minMTU4 is the size of IPv4 packets that every host must
+	// accept, and the most an ICMPv4 error may be.
+	minMTU4 = 576
+	// minMTU6 is the IPv6 minimum MTU, and the most an ICMPv6
+	// error may be.
+	minMTU6 = 1280
+)
+
+// TooBig returns an ICMP error telling the sender of q that q is
+// larger than mtu on its way to q's destination, which the error
+// comes from: a "fragmentation needed" Destination Unreachable for
+// IPv4, or a Packet Too Big for IPv6. The error quotes as much of q
+// as the minimum MTU allows.
+//
+// It returns nil if q isn't a packet to send such an error about,
+// such as an ICMP error itself.
+func (q *Parsed) TooBig(mtu int) []byte {
+	if q.IsError() || mtu > maxPacketLength {
+		return nil
+	}
+	switch q.IPVersion {
+	case 4:
+		h := ICMP4Header{
+			IP4Header: IP4Header{
+				IPID:  binary.BigEndian.Uint16(q.b[4:6]),
+				SrcIP: q.DstIP4,
+				DstIP: q.SrcIP4,
+			},
+			Type: ICMP4Unreachable,
+			Code: ICMP4FragNeeded,
+		}
+		quote := q.b[:q.length]
+		if limit := minMTU4 - h.Len() - 4; len(quote) > limit {
+			quote = quote[:limit]
+		}
+		payload := make([]byte, 4+len(quote))
+		binary.BigEndian.PutUint16(payload[2:4], uint16(mtu))
+		copy(payload[4:], quote)
+		return Generate(&h, payload)
+	case 6:
+		h := IP6Header{
+			IPProto: ICMPv6,
+			SrcIP:   q.DstIP6,
+			DstIP:   q.SrcIP6,
+		}
+		quote := q.b[:q.length]
+		if limit := minMTU6 - ip6HeaderLength - 8; len(quote) > limit {
+			quote = quote[:limit]
+		}
+		buf := make([]byte, ip6HeaderLength+8+len(quote))
+		icmp := buf[ip6HeaderLength:]
+		icmp[0] = uint8(ICMP6PacketTooBig)
+		icmp[1] = uint8(ICMP6NoCode)
+		binary.BigEndian.PutUint32(icmp[4:8], uint32(mtu))
+		copy(icmp[8:], quote)
+
+		// ICMPv6 checksum with IP pseudo header.
+		h.marshalPseudo(buf)
+		binary.BigEndian.PutUint16(icmp[2:4], ip4Checksum(buf))
+		h.Marshal(buf)
+		return buf
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package pcapng writes packet captures in the pcapng format read by
+// Wireshark and tcpdump.
+//
+// Only what's needed to capture one interface is implemented: a
+// section header, a single interface description and enhanced
+// packet blocks. See
+// https://datatracker.ietf.org/doc/draft-tuexen-opsawg-pcapng/.
+package pcapng
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// LinkTypeRaw is the link type of captures whose packets are bare
+// IPv4 or IPv6 packets, with no link-layer header, as on a TUN
+// device.
+const LinkTypeRaw = 101
+
+// Direction is the direction of a captured packet, relative to the
+// capturing interface.
+type Direction uint8
+
+const (
+	DirUnknown  Direction = 0
+	DirInbound  Direction = 1 // received by the interface
+	DirOutbound Direction = 2 // sent by the interface
+)
+
+const (
+	blockSectionHeader   = 0x0A0D0D0A
+	blockInterface       = 0x00000001
+	blockEnhancedPacket  = 0x00000006
+	byteOrderMagic       = 0x1A2B3C4D
+	optEndOfOpt          = 0
+	optComment           = 1
+	optIfName            = 2
+	optIfTSResol         = 9
+	optEPBFlags          = 2
+	tsResolMicroseconds  = 6
+	maxSnapLen           = 0 // no limit
+	sectionLengthUnknown = 0xFFFFFFFFFFFFFFFF
+)
+
+var le = binary.LittleEndian
+
+// Writer writes a pcapng capture of one interface.
+type Writer struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewWriter returns a Writer that writes a capture of the interface
+// named ifName, with the given link type, to w. The file header is
+// written immediately.
+func NewWriter(w io.Writer, linkType uint16, ifName string) (*Writer, error) {
+	pw := &Writer{w: w}
+
+	shb := make([]byte, 16)
+	le.PutUint32(shb[0:], byteOrderMagic)
+	le.PutUint16(shb[4:], 1) // major version
+	le.PutUint16(shb[6:], 0) // minor version
+	le.PutUint64(shb[8:], sectionLengthUnknown)
+	if err := pw.writeBlock(blockSectionHeader, shb); err != nil {
+		return nil, err
+	}
+
+	idb := make([]byte, 8)
+	le.PutUint16(idb[0:], linkType)
+	le.PutUint32(idb[4:], maxSnapLen)
+	if ifName != "" {
+		idb = appendOption(idb, optIfName, []byte(ifName))
+	}
+	idb = appendOption(idb, optIfTSResol, []byte{tsResolMicroseconds})
+	idb = appendOption(idb, optEndOfOpt, nil)
+	if err := pw.writeBlock(blockInterface, idb); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// WritePacket writes pkt, captured at time ts, to the capture. If
+// comment is non-empty, it's attached to the packet and shown by
+// Wireshark alongside it.
+func (pw *Writer) WritePacket(ts time.Time, pkt []byte, dir Direction, comment string) error {
+	b := pw.buf[:0]
+	b = append(b, make([]byte, 20)...)
+	us := uint64(ts.UnixNano() / 1000)
+	le.PutUint32(b[0:], 0) // interface ID
+	le.PutUint32(b[4:], uint32(us>>32))
+	le.PutUint32(b[8:], uint32(us))
+	le.PutUint32(b[12:], uint32(len(pkt))) // captured length
+	le.PutUint32(b[16:], uint32(len(pkt))) // original length
+	b = append(b, pkt...)
+	b = appendPadding(b)
+	if comment != "" {
+		b = appendOption(b, optComment, []byte(comment))
+	}
+	if dir != DirUnknown {
+		var flags [4]byte
+		le.PutUint32(flags[:], uint32(dir))
+		b = appendOption(b, optEPBFlags, flags[:])
+	}
+	b = appendOption(b, optEndOfOpt, nil)
+	pw.buf = b
+	return pw.writeBlock(blockEnhancedPacket, b)
+}
+
+// writeBlock writes a block of the given type with the given body,
+// which must be a multiple of 4 bytes long.
+func (pw *Writer) writeBlock(typ uint32, body []byte) error {
+	var hdr [8]byte
+	total := uint32(len(body) + 12)
+	le.PutUint32(hdr[0:], typ)
+	le.PutUint32(hdr[4:], total)
+	if _, err := pw.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := pw.w.Write(body); err != nil {
+		return err
+	}
+	_, err := pw.w.Write(hdr[4:])
+	return err
+}
+
+// appendOption appends the option with the given code and value to
+// b, padded to 32 bits.
+func appendOption(b []byte, code uint16, val []byte) []byte {
+	var hdr [4]byte
+	le.PutUint16(hdr[0:], code)
+	le.PutUint16(hdr[2:], uint16(len(val)))
+	b = append(b, hdr[:]...)
+	b = append(b, val...)
+	return appendPadding(b)
+}
+
+func appendPadding(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pcapng
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, LinkTypeRaw, "tailscale0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Unix(1600000000, 123456000)
+	pkt := []byte{0x45, 0, 0, 5, 0xff}
+	if err := w.WritePacket(ts, pkt, DirInbound, "from peer"); err != nil {
+		t.Fatal(err)
+	}
+
+	type block struct {
+		typ  uint32
+		body []byte
+	}
+	var blocks []block
+	b := buf.Bytes()
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("trailing %d bytes", len(b))
+		}
+		n := int(le.Uint32(b[4:]))
+		if n%4 != 0 || n > len(b) {
+			t.Fatalf("bad block length %d", n)
+		}
+		if got := int(le.Uint32(b[n-4:])); got != n {
+			t.Fatalf("trailing block length %d; want %d", got, n)
+		}
+		blocks = append(blocks, block{le.Uint32(b), b[8 : n-4]})
+		b = b[n:]
+	}
+	if len(blocks) != 3 {
+		t.Fatalf("got %d blocks; want 3", len(blocks))
+	}
+	if blocks[0].typ != blockSectionHeader || le.Uint32(blocks[0].body) != byteOrderMagic {
+		t.Errorf("bad section header %x", blocks[0].body)
+	}
+	if blocks[1].typ != blockInterface || le.Uint16(blocks[1].body) != LinkTypeRaw {
+		t.Errorf("bad interface description %x", blocks[1].body)
+	}
+	if !bytes.Contains(blocks[1].body, []byte("tailscale0")) {
+		t.Error("interface name missing")
+	}
+
+	epb := blocks[2].body
+	if blocks[2].typ != blockEnhancedPacket {
+		t.Fatalf("third block type %x; want enhanced packet", blocks[2].typ)
+	}
+	us := uint64(le.Uint32(epb[4:]))<<32 | uint64(le.Uint32(epb[8:]))
+	if want := uint64(ts.UnixNano() / 1000); us != want {
+		t.Errorf("timestamp %d; want %d", us, want)
+	}
+	if n := le.Uint32(epb[12:]); n != uint32(len(pkt)) {
+		t.Errorf("captured length %d; want %d", n, len(pkt))
+	}
+	if got := epb[20 : 20+len(pkt)]; !bytes.Equal(got, pkt) {
+		t.Errorf("packet %x; want %x", got, pkt)
+	}
+	opts := epb[28:] // after the packet, padded to 8 bytes
+	if code, n := le.Uint16(opts), le.Uint16(opts[2:]); code != optComment || string(opts[4:4+n]) != "from peer" {
+		t.Errorf("bad comment option %x", opts)
+	}
+	opts = opts[4+12:]
+	if code, flags := le.Uint16(opts), le.Uint32(opts[4:]); code != optEPBFlags || flags != uint32(DirInbound) {
+		t.Errorf("bad flags option %x", opts)
+	}
+	if end := opts[8:]; !bytes.Equal(end, []byte{0, 0, 0, 0}) {
+		t.Errorf("options end with %x; want end-of-options", end)
+	}
+}
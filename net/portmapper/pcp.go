@@ -0,0 +1,142 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package portmapper
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// pcpPort is the UDP port of PCP and NAT-PMP servers.
+const pcpPort = 5351
+
+// PCP constants, from RFC 6887.
+const (
+	pcpVersion    = 2
+	pcpOpMap      = 1
+	pcpOpReply    = 0x80
+	pcpUDPProto   = 17
+	pcpMapReqLen  = 24 + 36
+	pcpResultOK   = 0
+	pcpMapRespLen = 24 + 36
+)
+
+// pcpMapRequest returns a PCP MAP request asking for a mapping from
+// an external port (ideally prevExternal's) to internal for lifetime.
+// A zero lifetime deletes the mapping.
+func pcpMapRequest(internal netaddr.IPPort, prevExternal netaddr.IPPort, lifetime time.Duration, nonce [12]byte) []byte {
+	pkt := make([]byte, pcpMapReqLen)
+
+	// The header (https://tools.ietf.org/html/rfc6887#section-7.1)
+	pkt[0] = pcpVersion
+	pkt[1] = pcpOpMap
+	binary.BigEndian.PutUint32(pkt[4:8], uint32(lifetime/time.Second))
+	myIP16 := internal.IP.As16()
+	copy(pkt[8:24], myIP16[:])
+
+	// The MAP opcode body (https://tools.ietf.org/html/rfc6887#section-11.1)
+	mapOp := pkt[24:]
+	copy(mapOp[:12], nonce[:])
+	mapOp[12] = pcpUDPProto
+	binary.BigEndian.PutUint16(mapOp[16:18], internal.Port)
+	binary.BigEndian.PutUint16(mapOp[18:20], prevExternal.Port)
+	extIP := prevExternal.IP
+	if extIP.IsZero() {
+		extIP = netaddr.IPv4(0, 0, 0, 0)
+	}
+	extIP16 := extIP.As16()
+	copy(mapOp[20:36], extIP16[:])
+	return pkt
+}
+
+// pcpMapResponse is a parsed PCP MAP response.
+type pcpMapResponse struct {
+	resultCode byte
+	lifetime   time.Duration
+	epoch      uint32
+	nonce      [12]byte
+	internal   uint16
+	external   netaddr.IPPort
+}
+
+// parsePCPMapResponse parses b as a PCP MAP response.
+func parsePCPMapResponse(b []byte) (res pcpMapResponse, ok bool) {
+	if len(b) < pcpMapRespLen || b[0] != pcpVersion || b[1] != pcpOpReply|pcpOpMap {
+		return res, false
+	}
+	res.resultCode = b[3]
+	res.lifetime = time.Duration(binary.BigEndian.Uint32(b[4:8])) * time.Second
+	res.epoch = binary.BigEndian.Uint32(b[8:12])
+	mapOp := b[24:]
+	copy(res.nonce[:], mapOp[:12])
+	if mapOp[12] != pcpUDPProto {
+		return res, false
+	}
+	res.internal = binary.BigEndian.Uint16(mapOp[16:18])
+	res.external = netaddr.IPPort{
+		IP:   ipFromPCP(mapOp[20:36]),
+		Port: binary.BigEndian.Uint16(mapOp[18:20]),
+	}
+	return res, true
+}
+
+// ipFromPCP returns the IP address in the 16 byte field b, where
+// PCP represents IPv4 addresses as IPv4-mapped IPv6 addresses.
+func ipFromPCP(b []byte) netaddr.IP {
+	if bytes.Equal(b[:12], v4InV6Prefix) {
+		return netaddr.IPv4(b[12], b[13], b[14], b[15])
+	}
+	var ip16 [16]byte
+	copy(ip16[:], b)
+	return netaddr.IPFrom16(ip16)
+}
+
+var v4InV6Prefix = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
+
+func (c *Client) mapPCP(ctx context.Context, gw netaddr.IP, internal netaddr.IPPort, old *mapping) (*mapping, error) {
+	var nonce [12]byte
+	var prevExternal netaddr.IPPort
+	if old != nil && old.proto == "pcp" && old.internal == internal {
+		nonce = old.pcpNonce
+		prevExternal = old.external
+	} else if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	req := pcpMapRequest(internal, prevExternal, mapLifetime, nonce)
+	var res pcpMapResponse
+	_, err := roundTripUDP(ctx, gw, pcpPort, req, func(b []byte) bool {
+		var ok bool
+		res, ok = parsePCPMapResponse(b)
+		return ok && res.nonce == nonce
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.resultCode != pcpResultOK {
+		return nil, fmt.Errorf("PCP result code %d", res.resultCode)
+	}
+	if res.lifetime == 0 || res.external.Port == 0 {
+		return nil, errors.New("PCP mapping refused")
+	}
+	m := newMapping("pcp", gw, internal, res.external, res.lifetime)
+	m.pcpNonce = nonce
+	return m, nil
+}
+
+func (c *Client) releasePCP(ctx context.Context, m *mapping) error {
+	req := pcpMapRequest(m.internal, m.external, 0, m.pcpNonce)
+	_, err := roundTripUDP(ctx, m.gw, pcpPort, req, func(b []byte) bool {
+		res, ok := parsePCPMapResponse(b)
+		return ok && res.nonce == m.pcpNonce
+	})
+	return err
+}
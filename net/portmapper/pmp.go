@@ -0,0 +1,125 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package portmapper
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// NAT-PMP constants, from RFC 6886.
+const (
+	pmpVersion         = 0
+	pmpOpExternalAddr  = 0
+	pmpOpMapUDP        = 1
+	pmpOpReply         = 0x80
+	pmpResultOK        = 0
+	pmpExternalRespLen = 12
+	pmpMapRespLen      = 16
+)
+
+// pmpMapRequest returns a NAT-PMP request to map UDP port
+// internalPort, ideally from external port externalPort, for
+// lifetime. A zero lifetime (and externalPort) deletes the mapping.
+func pmpMapRequest(internalPort, externalPort uint16, lifetime time.Duration) []byte {
+	pkt := make([]byte, 12)
+	pkt[0] = pmpVersion
+	pkt[1] = pmpOpMapUDP
+	binary.BigEndian.PutUint16(pkt[4:6], internalPort)
+	binary.BigEndian.PutUint16(pkt[6:8], externalPort)
+	binary.BigEndian.PutUint32(pkt[8:12], uint32(lifetime/time.Second))
+	return pkt
+}
+
+// pmpResponse is a parsed NAT-PMP response.
+type pmpResponse struct {
+	op         byte
+	resultCode uint16
+	epoch      uint32
+
+	// For pmpOpExternalAddr:
+	externalIP netaddr.IP
+
+	// For pmpOpMapUDP:
+	internalPort uint16
+	externalPort uint16
+	lifetime     time.Duration
+}
+
+// parsePMPResponse parses b as a NAT-PMP response.
+func parsePMPResponse(b []byte) (res pmpResponse, ok bool) {
+	if len(b) < 8 || b[0] != pmpVersion || b[1]&pmpOpReply == 0 {
+		return res, false
+	}
+	res.op = b[1] &^ pmpOpReply
+	res.resultCode = binary.BigEndian.Uint16(b[2:4])
+	res.epoch = binary.BigEndian.Uint32(b[4:8])
+	switch res.op {
+	case pmpOpExternalAddr:
+		if len(b) < pmpExternalRespLen {
+			return res, false
+		}
+		res.externalIP = netaddr.IPv4(b[8], b[9], b[10], b[11])
+	case pmpOpMapUDP:
+		if len(b) < pmpMapRespLen {
+			return res, false
+		}
+		res.internalPort = binary.BigEndian.Uint16(b[8:10])
+		res.externalPort = binary.BigEndian.Uint16(b[10:12])
+		res.lifetime = time.Duration(binary.BigEndian.Uint32(b[12:16])) * time.Second
+	default:
+		return res, false
+	}
+	return res, true
+}
+
+// pmpRoundTrip sends req to gw and returns its reply to the opcode op.
+func pmpRoundTrip(ctx context.Context, gw netaddr.IP, req []byte, op byte) (pmpResponse, error) {
+	var res pmpResponse
+	_, err := roundTripUDP(ctx, gw, pcpPort, req, func(b []byte) bool {
+		var ok bool
+		res, ok = parsePMPResponse(b)
+		return ok && res.op == op
+	})
+	if err != nil {
+		return res, err
+	}
+	if res.resultCode != pmpResultOK {
+		return res, fmt.Errorf("NAT-PMP result code %d", res.resultCode)
+	}
+	return res, nil
+}
+
+func (c *Client) mapPMP(ctx context.Context, gw netaddr.IP, internal netaddr.IPPort, old *mapping) (*mapping, error) {
+	// NAT-PMP doesn't say which external address a mapping is on,
+	// so ask for that separately.
+	extRes, err := pmpRoundTrip(ctx, gw, []byte{pmpVersion, pmpOpExternalAddr}, pmpOpExternalAddr)
+	if err != nil {
+		return nil, err
+	}
+	var prevPort uint16
+	if old != nil && old.proto == "pmp" {
+		prevPort = old.external.Port
+	}
+	mapRes, err := pmpRoundTrip(ctx, gw, pmpMapRequest(internal.Port, prevPort, mapLifetime), pmpOpMapUDP)
+	if err != nil {
+		return nil, err
+	}
+	if mapRes.internalPort != internal.Port || mapRes.externalPort == 0 || mapRes.lifetime == 0 {
+		return nil, errors.New("NAT-PMP mapping refused")
+	}
+	external := netaddr.IPPort{IP: extRes.externalIP, Port: mapRes.externalPort}
+	return newMapping("pmp", gw, internal, external, mapRes.lifetime), nil
+}
+
+func (c *Client) releasePMP(ctx context.Context, m *mapping) error {
+	_, err := pmpRoundTrip(ctx, m.gw, pmpMapRequest(m.internal.Port, 0, 0), pmpOpMapUDP)
+	return err
+}
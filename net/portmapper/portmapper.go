@@ -0,0 +1,402 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package portmapper asks the local gateway to map an external port
+// to a local UDP port, using PCP, NAT-PMP or UPnP IGD, whichever the
+// gateway speaks.
+package portmapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/interfaces"
+	"tailscale.com/net/netns"
+	"tailscale.com/types/logger"
+)
+
+const (
+	// mapLifetime is the lifetime requested for mappings. The
+	// gateway may grant a shorter one.
+	mapLifetime = 2 * time.Hour
+
+	// createTimeout bounds how long a single attempt to create or
+	// renew a mapping may take, across all protocols.
+	createTimeout = 5 * time.Second
+
+	// protoTimeout is how long to wait for a reply from the gateway
+	// to one PCP or NAT-PMP request, or for SSDP replies.
+	protoTimeout = 250 * time.Millisecond
+
+	// retryAfterFail is how long to wait after failing to create a
+	// mapping before trying again.
+	retryAfterFail = 5 * time.Minute
+)
+
+// ErrNoPortMappingServices is returned by CreateOrGetMapping when the
+// gateway doesn't speak any of the supported protocols.
+var ErrNoPortMappingServices = errors.New("no port mapping services were found")
+
+// ErrGatewayNotFound is returned when there's no gateway to ask.
+var ErrGatewayNotFound = errors.New("failed to locate gateway")
+
+// Client maintains a port mapping on the local gateway for one local
+// UDP port.
+type Client struct {
+	logf         logger.Logf
+	ipAndGateway func() (gw, ip netaddr.IP, ok bool)
+	onChange     func() // or nil
+
+	mu         sync.Mutex // guards the following
+	closed     bool
+	localPort  uint16
+	mapping    *mapping    // or nil
+	renewTimer *time.Timer // or nil
+	creating   bool        // whether a background createOrGetMapping is running
+	lastFail   time.Time   // time of last failed attempt, if the last one failed
+	upnpURL    string      // control URL of the last UPnP gateway found, or empty
+	upnpSvc    string      // service type at upnpURL
+	upnpGW     netaddr.IP  // gateway upnpURL was found on
+
+	// releasing, if non-nil, is closed once the last mapping
+	// being released in the background is gone. Creating a
+	// mapping waits for it, lest the release of an old mapping
+	// for the same port delete the new one.
+	releasing chan struct{}
+}
+
+// mapping is a port mapping granted by the gateway.
+type mapping struct {
+	proto      string         // "pcp", "pmp" or "upnp"
+	gw         netaddr.IP     // gateway that granted it
+	internal   netaddr.IPPort // our LAN address
+	external   netaddr.IPPort // the gateway's external address
+	goodUntil  time.Time
+	renewAfter time.Time
+
+	pcpNonce [12]byte // for pcp, to renew or delete the same mapping
+
+	upnpURL string // for upnp, the control URL
+	upnpSvc string // for upnp, the service type
+}
+
+// NewClient returns a new portmapping client. onChange, if non-nil,
+// is called in a new goroutine whenever the mapping changes, such as
+// when a mapping is first created in the background or renewed with a
+// different external address.
+func NewClient(logf logger.Logf, onChange func()) *Client {
+	return &Client{
+		logf:         logger.WithPrefix(logf, "portmapper: "),
+		ipAndGateway: interfaces.LikelyHomeRouterIP,
+		onChange:     onChange,
+	}
+}
+
+// SetGatewayLookupFunc sets the func that returns the LAN gateway
+// and this node's IP on its network. It's for use by tests.
+func (c *Client) SetGatewayLookupFunc(f func() (gw, myIP netaddr.IP, ok bool)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ipAndGateway = f
+}
+
+// SetLocalPort updates the local UDP port to map. Changing it drops
+// (and releases) any existing mapping.
+func (c *Client) SetLocalPort(port uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.localPort == port {
+		return
+	}
+	c.localPort = port
+	c.invalidateMappingLocked(true)
+}
+
+// NoteNetworkDown should be called when the network has changed, so
+// the mapping, which was made by a gateway that may no longer be ours,
+// is dropped. It's released in the background, in case that gateway
+// is still reachable, so that it doesn't linger there until it
+// expires.
+func (c *Client) NoteNetworkDown() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.invalidateMappingLocked(true)
+	c.lastFail = time.Time{}
+	c.upnpURL, c.upnpSvc, c.upnpGW = "", "", netaddr.IP{}
+}
+
+// Close releases the current mapping, if any, and stops renewing it.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.invalidateMappingLocked(true)
+	return nil
+}
+
+// invalidateMappingLocked forgets the current mapping, releasing it on
+// the gateway in the background if release is set. See c.releasing.
+func (c *Client) invalidateMappingLocked(release bool) {
+	if c.renewTimer != nil {
+		c.renewTimer.Stop()
+		c.renewTimer = nil
+	}
+	m := c.mapping
+	c.mapping = nil
+	if m == nil || !release {
+		return
+	}
+	prev, done := c.releasing, make(chan struct{})
+	c.releasing = done
+	go func() {
+		defer close(done)
+		if prev != nil {
+			<-prev
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), createTimeout)
+		defer cancel()
+		if err := c.release(ctx, m); err != nil {
+			c.logf("releasing %s mapping %v: %v", m.proto, m.external, err)
+		}
+	}()
+}
+
+// GetCachedMappingOrStartCreatingOne returns the external address of
+// the current mapping, if it's still valid. Otherwise, or if it's due
+// for renewal, it starts creating or renewing one in the background
+// (reporting completion via the onChange callback) and returns the
+// current mapping, if still valid, or ok false.
+func (c *Client) GetCachedMappingOrStartCreatingOne() (external netaddr.IPPort, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	m := c.mapping
+	if m != nil && now.Before(m.renewAfter) {
+		return m.external, true
+	}
+	c.maybeStartCreateLocked(now)
+	if m != nil && now.Before(m.goodUntil) {
+		return m.external, true
+	}
+	return netaddr.IPPort{}, false
+}
+
+func (c *Client) maybeStartCreateLocked(now time.Time) {
+	if c.closed || c.creating || c.localPort == 0 {
+		return
+	}
+	if !c.lastFail.IsZero() && now.Sub(c.lastFail) < retryAfterFail {
+		return
+	}
+	c.creating = true
+	releasing := c.releasing
+	go func() {
+		if releasing != nil {
+			<-releasing
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), createTimeout)
+		defer cancel()
+		c.createOrGetMapping(ctx, true)
+	}()
+}
+
+// CreateOrGetMapping returns the external address of the current
+// mapping if it doesn't need renewing yet, and otherwise creates or
+// renews one, blocking until done or ctx expires.
+func (c *Client) CreateOrGetMapping(ctx context.Context) (external netaddr.IPPort, err error) {
+	c.mu.Lock()
+	if m := c.mapping; m != nil && time.Now().Before(m.renewAfter) {
+		c.mu.Unlock()
+		return m.external, nil
+	}
+	releasing := c.releasing
+	c.mu.Unlock()
+	if releasing != nil {
+		select {
+		case <-releasing:
+		case <-ctx.Done():
+			return netaddr.IPPort{}, ctx.Err()
+		}
+	}
+	return c.createOrGetMapping(ctx, false)
+}
+
+func (c *Client) createOrGetMapping(ctx context.Context, background bool) (external netaddr.IPPort, err error) {
+	c.mu.Lock()
+	localPort := c.localPort
+	old := c.mapping
+	ipAndGateway := c.ipAndGateway
+	c.mu.Unlock()
+	gw, myIP, ok := ipAndGateway()
+
+	defer func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if background {
+			c.creating = false
+		}
+		if err != nil {
+			c.lastFail = time.Now()
+		} else {
+			c.lastFail = time.Time{}
+		}
+	}()
+
+	if localPort == 0 {
+		return netaddr.IPPort{}, errors.New("no local port set")
+	}
+	if !ok {
+		return netaddr.IPPort{}, ErrGatewayNotFound
+	}
+	if old != nil && old.gw != gw {
+		old = nil // made by a different gateway; start over
+	}
+	internal := netaddr.IPPort{IP: myIP, Port: localPort}
+
+	m, err := c.requestMapping(ctx, gw, internal, old)
+	if err != nil {
+		if background {
+			c.logf("creating mapping for %v via %v: %v", internal, gw, err)
+		}
+		return netaddr.IPPort{}, err
+	}
+
+	c.mu.Lock()
+	if c.closed || c.localPort != localPort {
+		// Raced with Close or SetLocalPort; this mapping is stale.
+		c.mu.Unlock()
+		c.release(ctx, m)
+		return netaddr.IPPort{}, errors.New("mapping no longer wanted")
+	}
+	changed := c.mapping == nil || c.mapping.external != m.external
+	c.mapping = m
+	if c.renewTimer != nil {
+		c.renewTimer.Stop()
+	}
+	c.renewTimer = time.AfterFunc(time.Until(m.renewAfter), c.renew)
+	c.mu.Unlock()
+
+	if changed {
+		c.logf("mapped %v to %v via %s on %v, valid for %v", internal, m.external, m.proto, gw, time.Until(m.goodUntil).Round(time.Second))
+		if c.onChange != nil {
+			go c.onChange()
+		}
+	}
+	return m.external, nil
+}
+
+// renew is called by renewTimer when the mapping is due for renewal.
+func (c *Client) renew() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.renewTimer = nil
+	c.maybeStartCreateLocked(time.Now())
+}
+
+// requestMapping asks gw for a mapping to internal using each
+// protocol in turn, renewing old with its own protocol first if it's
+// non-nil.
+func (c *Client) requestMapping(ctx context.Context, gw netaddr.IP, internal netaddr.IPPort, old *mapping) (*mapping, error) {
+	protos := []string{"pcp", "pmp", "upnp"}
+	if old != nil {
+		protos = append([]string{old.proto}, protos...)
+	}
+	tried := map[string]bool{}
+	var errs []string
+	for _, proto := range protos {
+		if tried[proto] {
+			continue
+		}
+		tried[proto] = true
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var m *mapping
+		var err error
+		switch proto {
+		case "pcp":
+			m, err = c.mapPCP(ctx, gw, internal, old)
+		case "pmp":
+			m, err = c.mapPMP(ctx, gw, internal, old)
+		case "upnp":
+			m, err = c.mapUPnP(ctx, gw, internal, old)
+		}
+		if err == nil {
+			return m, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", proto, err))
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%w (%v)", ErrNoPortMappingServices, errs)
+	}
+	return nil, ErrNoPortMappingServices
+}
+
+// release deletes m on the gateway that granted it.
+func (c *Client) release(ctx context.Context, m *mapping) error {
+	switch m.proto {
+	case "pcp":
+		return c.releasePCP(ctx, m)
+	case "pmp":
+		return c.releasePMP(ctx, m)
+	case "upnp":
+		return c.releaseUPnP(ctx, m)
+	}
+	return fmt.Errorf("unknown mapping protocol %q", m.proto)
+}
+
+// newMapping returns a mapping with the given lifetime, to be renewed
+// halfway through it.
+func newMapping(proto string, gw netaddr.IP, internal, external netaddr.IPPort, lifetime time.Duration) *mapping {
+	now := time.Now()
+	return &mapping{
+		proto:      proto,
+		gw:         gw,
+		internal:   internal,
+		external:   external,
+		goodUntil:  now.Add(lifetime),
+		renewAfter: now.Add(lifetime / 2),
+	}
+}
+
+// roundTripUDP sends req to gw:port from a new socket and returns the
+// first reply from it for which accept returns true.
+func roundTripUDP(ctx context.Context, gw netaddr.IP, port uint16, req []byte, accept func([]byte) bool) ([]byte, error) {
+	uc, err := netns.Listener().ListenPacket(ctx, "udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer uc.Close()
+	deadline := time.Now().Add(protoTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	uc.SetReadDeadline(deadline)
+	dst := netaddr.IPPort{IP: gw, Port: port}.UDPAddr()
+	if _, err := uc.WriteTo(req, dst); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := uc.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+		ua, ok := addr.(*net.UDPAddr)
+		if !ok || !ua.IP.Equal(dst.IP) || ua.Port != int(port) {
+			continue
+		}
+		if accept(buf[:n]) {
+			return buf[:n], nil
+		}
+	}
+}
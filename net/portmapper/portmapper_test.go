@@ -0,0 +1,242 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package portmapper
+
+import (
+	"encoding/binary"
+	"net/url"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestPCPRoundTrip(t *testing.T) {
+	internal := netaddr.IPPort{IP: netaddr.IPv4(192, 168, 1, 10), Port: 41641}
+	nonce := [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	req := pcpMapRequest(internal, netaddr.IPPort{}, time.Hour, nonce)
+	if len(req) != pcpMapReqLen {
+		t.Fatalf("request length = %d; want %d", len(req), pcpMapReqLen)
+	}
+	if req[0] != pcpVersion || req[1] != pcpOpMap {
+		t.Fatalf("bad request header % x", req[:4])
+	}
+	if got := binary.BigEndian.Uint32(req[4:8]); got != 3600 {
+		t.Errorf("lifetime = %d; want 3600", got)
+	}
+
+	// Turn the request into the gateway's reply.
+	res := append([]byte(nil), req...)
+	res[1] = pcpOpReply | pcpOpMap
+	binary.BigEndian.PutUint32(res[4:8], 1800)
+	binary.BigEndian.PutUint16(res[24+18:], 55555)
+	copy(res[24+20:], []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 1, 2, 3, 4})
+
+	got, ok := parsePCPMapResponse(res)
+	if !ok {
+		t.Fatal("failed to parse response")
+	}
+	if got.nonce != nonce {
+		t.Errorf("nonce = %x; want %x", got.nonce, nonce)
+	}
+	if got.internal != internal.Port {
+		t.Errorf("internal port = %d; want %d", got.internal, internal.Port)
+	}
+	if got.lifetime != 30*time.Minute {
+		t.Errorf("lifetime = %v; want 30m", got.lifetime)
+	}
+	want := netaddr.IPPort{IP: netaddr.IPv4(1, 2, 3, 4), Port: 55555}
+	if got.external != want {
+		t.Errorf("external = %v; want %v", got.external, want)
+	}
+
+	if _, ok := parsePCPMapResponse(req); ok {
+		t.Error("parsed a request as a response")
+	}
+	if _, ok := parsePCPMapResponse(res[:40]); ok {
+		t.Error("parsed a short response")
+	}
+}
+
+func TestParsePMPResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		pkt    []byte
+		wantOK bool
+		want   pmpResponse
+	}{
+		{
+			name:   "external_addr",
+			pkt:    []byte{0, 128, 0, 0, 0, 0, 0, 5, 1, 2, 3, 4},
+			wantOK: true,
+			want:   pmpResponse{op: pmpOpExternalAddr, epoch: 5, externalIP: netaddr.IPv4(1, 2, 3, 4)},
+		},
+		{
+			name:   "map_udp",
+			pkt:    []byte{0, 129, 0, 0, 0, 0, 0, 5, 0xa2, 0x69, 0xd9, 0x03, 0, 0, 0x1c, 0x20},
+			wantOK: true,
+			want:   pmpResponse{op: pmpOpMapUDP, epoch: 5, internalPort: 41577, externalPort: 55555, lifetime: 2 * time.Hour},
+		},
+		{
+			name:   "error",
+			pkt:    []byte{0, 129, 0, 3, 0, 0, 0, 5, 0xa2, 0x69, 0, 0, 0, 0, 0, 0},
+			wantOK: true,
+			want:   pmpResponse{op: pmpOpMapUDP, resultCode: 3, epoch: 5, internalPort: 41577},
+		},
+		{
+			name: "request",
+			pkt:  pmpMapRequest(41641, 0, time.Hour),
+		},
+		{
+			name: "short",
+			pkt:  []byte{0, 129, 0, 0, 0, 0, 0, 5, 0xa2, 0x69},
+		},
+		{
+			name: "pcp",
+			pkt:  make([]byte, pcpMapRespLen),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parsePMPResponse(tt.pkt)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v; want %v", ok, tt.wantOK)
+			}
+			if ok && got != tt.want {
+				t.Errorf("got %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSSDPResponse(t *testing.T) {
+	res := []byte("HTTP/1.1 200 OK\r\n" +
+		"CACHE-CONTROL: max-age=120\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+		"USN: uuid:e5f2c0a0-0000-0000-0000-000000000000::urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+		"EXT:\r\n" +
+		"SERVER: Linux UPnP/1.1 MiniUPnPd/2.1\r\n" +
+		"LOCATION: http://192.168.1.1:5000/rootDesc.xml\r\n" +
+		"\r\n")
+	loc, ok := parseSSDPResponse(res)
+	if !ok || loc != "http://192.168.1.1:5000/rootDesc.xml" {
+		t.Errorf("got %q, %v", loc, ok)
+	}
+	if _, ok := parseSSDPResponse([]byte("M-SEARCH * HTTP/1.1\r\n\r\n")); ok {
+		t.Error("parsed a request")
+	}
+}
+
+const testRootDesc = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<specVersion><major>1</major><minor>0</minor></specVersion>
+<device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<serviceList><service>
+<serviceType>urn:schemas-upnp-org:service:Layer3Forwarding:1</serviceType>
+<controlURL>/ctl/L3F</controlURL>
+</service></serviceList>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+<deviceList><device>
+<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<serviceList>
+<service>
+<serviceType>urn:schemas-upnp-org:service:WANPPPConnection:1</serviceType>
+<controlURL>/ctl/PPPConn</controlURL>
+</service>
+<service>
+<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+<controlURL>/ctl/IPConn</controlURL>
+</service>
+</serviceList>
+</device></deviceList>
+</device></deviceList>
+</device>
+</root>`
+
+func TestFindUPnPService(t *testing.T) {
+	loc, _ := url.Parse("http://192.168.1.1:5000/rootDesc.xml")
+	controlURL, serviceType, err := findUPnPService([]byte(testRootDesc), loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://192.168.1.1:5000/ctl/IPConn"; controlURL != want {
+		t.Errorf("controlURL = %q; want %q", controlURL, want)
+	}
+	if want := "urn:schemas-upnp-org:service:WANIPConnection:1"; serviceType != want {
+		t.Errorf("serviceType = %q; want %q", serviceType, want)
+	}
+
+	if _, _, err := findUPnPService([]byte(`<root><device></device></root>`), loc); err == nil {
+		t.Error("found a service in an empty description")
+	}
+}
+
+func TestCheckUPnPURL(t *testing.T) {
+	gw := netaddr.IPv4(192, 168, 1, 1)
+	tests := []struct {
+		url    string
+		wantOK bool
+	}{
+		{"http://192.168.1.1:5000/rootDesc.xml", true},
+		{"http://192.168.1.2:5000/rootDesc.xml", false},
+		{"https://192.168.1.1:5000/rootDesc.xml", false},
+		{"http://router.local:5000/rootDesc.xml", false},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		if err := checkUPnPURL(u, gw); (err == nil) != tt.wantOK {
+			t.Errorf("checkUPnPURL(%q) = %v; want ok %v", tt.url, err, tt.wantOK)
+		}
+	}
+}
+
+func TestSOAP(t *testing.T) {
+	const svc = "urn:schemas-upnp-org:service:WANIPConnection:1"
+	body := string(soapRequestBody(svc, "AddPortMapping", "NewProtocol", "UDP", "NewPortMappingDescription", "a<b"))
+	want := `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>` +
+		`<u:AddPortMapping xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"><NewProtocol>UDP</NewProtocol><NewPortMappingDescription>a&lt;b</NewPortMappingDescription></u:AddPortMapping>` +
+		`</s:Body></s:Envelope>`
+	if body != want {
+		t.Errorf("request body:\n got %s\nwant %s", body, want)
+	}
+
+	res := []byte(`<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>
+<u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">
+<NewExternalIPAddress> 1.2.3.4 </NewExternalIPAddress>
+</u:GetExternalIPAddressResponse></s:Body></s:Envelope>`)
+	if v, ok := soapValue(res, "NewExternalIPAddress"); !ok || v != "1.2.3.4" {
+		t.Errorf("soapValue = %q, %v", v, ok)
+	}
+	if _, ok := soapValue(res, "errorCode"); ok {
+		t.Error("found errorCode in success response")
+	}
+}
+
+func TestNoteNetworkDownReleases(t *testing.T) {
+	c := NewClient(t.Logf, nil)
+	c.mu.Lock()
+	c.localPort = 41641
+	c.mapping = &mapping{proto: "test", gw: netaddr.IPv4(192, 168, 1, 1)}
+	c.mu.Unlock()
+
+	c.NoteNetworkDown()
+	c.mu.Lock()
+	m, releasing := c.mapping, c.releasing
+	c.mu.Unlock()
+	if m != nil {
+		t.Error("mapping kept after NoteNetworkDown")
+	}
+	if releasing == nil {
+		t.Fatal("mapping not released")
+	}
+	select {
+	case <-releasing:
+	case <-time.After(10 * time.Second):
+		t.Fatal("release didn't finish")
+	}
+}
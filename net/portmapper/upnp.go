@@ -0,0 +1,341 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package portmapper
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// ssdpPort is the UDP port of UPnP's discovery protocol.
+const ssdpPort = 1900
+
+// upnpSearchRequest is the SSDP request for Internet Gateway Devices.
+// It's sent directly to the gateway rather than multicast.
+var upnpSearchRequest = []byte("M-SEARCH * HTTP/1.1\r\n" +
+	"HOST: 239.255.255.250:1900\r\n" +
+	"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+	"MAN: \"ssdp:discover\"\r\n" +
+	"MX: 1\r\n\r\n")
+
+// upnpErrOnlyPermanentLeases is the UPnP error code gateways return
+// from AddPortMapping when they don't support lease durations.
+const upnpErrOnlyPermanentLeases = 725
+
+// upnpPermanentLifetime is how long a mapping without a lease
+// duration is assumed to last before it's renewed.
+const upnpPermanentLifetime = 10 * time.Minute
+
+// parseSSDPResponse returns the LOCATION header of the SSDP response b.
+func parseSSDPResponse(b []byte) (location string, ok bool) {
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), nil)
+	if err != nil {
+		return "", false
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", false
+	}
+	location = res.Header.Get("Location")
+	return location, location != ""
+}
+
+// upnpRoot is the subset of a UPnP device description document
+// needed to find the port mapping service.
+type upnpRoot struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+type upnpDevice struct {
+	DeviceType string        `xml:"deviceType"`
+	Services   []upnpService `xml:"serviceList>service"`
+	Devices    []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// findUPnPService returns the absolute control URL and service type of
+// the WANIPConnection (or failing that, WANPPPConnection) service in
+// the device description doc, which was fetched from location.
+func findUPnPService(doc []byte, location *url.URL) (controlURL, serviceType string, err error) {
+	var root upnpRoot
+	if err := xml.Unmarshal(doc, &root); err != nil {
+		return "", "", err
+	}
+	base := location
+	if root.URLBase != "" {
+		if u, err := location.Parse(root.URLBase); err == nil {
+			base = u
+		}
+	}
+	var ppp *upnpService
+	var walk func(d *upnpDevice) *upnpService
+	walk = func(d *upnpDevice) *upnpService {
+		for i := range d.Services {
+			s := &d.Services[i]
+			switch {
+			case strings.HasPrefix(s.ServiceType, "urn:schemas-upnp-org:service:WANIPConnection:"):
+				return s
+			case strings.HasPrefix(s.ServiceType, "urn:schemas-upnp-org:service:WANPPPConnection:"):
+				if ppp == nil {
+					ppp = s
+				}
+			}
+		}
+		for i := range d.Devices {
+			if s := walk(&d.Devices[i]); s != nil {
+				return s
+			}
+		}
+		return nil
+	}
+	s := walk(&root.Device)
+	if s == nil {
+		s = ppp
+	}
+	if s == nil {
+		return "", "", errors.New("no WAN connection service")
+	}
+	u, err := base.Parse(s.ControlURL)
+	if err != nil {
+		return "", "", err
+	}
+	return u.String(), s.ServiceType, nil
+}
+
+// upnpHTTPClient is used to talk to the gateway, which is on the LAN,
+// so it never uses a proxy.
+var upnpHTTPClient = &http.Client{
+	Transport: &http.Transport{Proxy: nil},
+	Timeout:   createTimeout,
+}
+
+// upnpGet fetches u.
+func upnpGet(ctx context.Context, u *url.URL) ([]byte, error) {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := upnpHTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, errors.New(res.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+}
+
+// checkUPnPURL checks that u, from an untrusted SSDP response or
+// device description, points at the gateway itself.
+func checkUPnPURL(u *url.URL, gw netaddr.IP) error {
+	if u.Scheme != "http" {
+		return fmt.Errorf("unexpected UPnP URL scheme %q", u.Scheme)
+	}
+	ip, err := netaddr.ParseIP(u.Hostname())
+	if err != nil || ip != gw {
+		return fmt.Errorf("UPnP URL host %q isn't the gateway %v", u.Host, gw)
+	}
+	return nil
+}
+
+// discoverUPnP finds the port mapping service of the UPnP IGD on gw.
+func (c *Client) discoverUPnP(ctx context.Context, gw netaddr.IP) (controlURL, serviceType string, err error) {
+	c.mu.Lock()
+	if c.upnpURL != "" && c.upnpGW == gw {
+		defer c.mu.Unlock()
+		return c.upnpURL, c.upnpSvc, nil
+	}
+	c.mu.Unlock()
+
+	var location string
+	_, err = roundTripUDP(ctx, gw, ssdpPort, upnpSearchRequest, func(b []byte) bool {
+		var ok bool
+		location, ok = parseSSDPResponse(b)
+		return ok
+	})
+	if err != nil {
+		return "", "", err
+	}
+	locURL, err := url.Parse(location)
+	if err != nil {
+		return "", "", err
+	}
+	if err := checkUPnPURL(locURL, gw); err != nil {
+		return "", "", err
+	}
+	doc, err := upnpGet(ctx, locURL)
+	if err != nil {
+		return "", "", err
+	}
+	controlURL, serviceType, err = findUPnPService(doc, locURL)
+	if err != nil {
+		return "", "", err
+	}
+	u, _ := url.Parse(controlURL)
+	if err := checkUPnPURL(u, gw); err != nil {
+		return "", "", err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.upnpURL, c.upnpSvc, c.upnpGW = controlURL, serviceType, gw
+	return controlURL, serviceType, nil
+}
+
+// upnpSOAPError is an error response from a UPnP action.
+type upnpSOAPError struct {
+	code int
+	desc string
+}
+
+func (e upnpSOAPError) Error() string {
+	return fmt.Sprintf("UPnP error %d: %s", e.code, e.desc)
+}
+
+// soapRequestBody returns the SOAP envelope invoking action of
+// serviceType with args, which are alternating names and values.
+func soapRequestBody(serviceType, action string, args ...string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body>`)
+	fmt.Fprintf(&buf, `<u:%s xmlns:u="`, action)
+	xml.EscapeText(&buf, []byte(serviceType))
+	buf.WriteString(`">`)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&buf, "<%s>", args[i])
+		xml.EscapeText(&buf, []byte(args[i+1]))
+		fmt.Fprintf(&buf, "</%s>", args[i])
+	}
+	fmt.Fprintf(&buf, "</u:%s></s:Body></s:Envelope>", action)
+	return buf.Bytes()
+}
+
+// soapValue returns the text of the first element named name in the
+// SOAP response body.
+func soapValue(body []byte, name string) (string, bool) {
+	d := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return "", false
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok || se.Name.Local != name {
+			continue
+		}
+		var v string
+		if err := d.DecodeElement(&v, &se); err != nil {
+			return "", false
+		}
+		return strings.TrimSpace(v), true
+	}
+}
+
+// soapCall invokes action on the UPnP service at controlURL and
+// returns the response body.
+func soapCall(ctx context.Context, controlURL, serviceType, action string, args ...string) ([]byte, error) {
+	req, err := http.NewRequest("POST", controlURL, bytes.NewReader(soapRequestBody(serviceType, action, args...)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, serviceType, action))
+	res, err := upnpHTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		if v, ok := soapValue(body, "errorCode"); ok {
+			code, _ := strconv.Atoi(v)
+			desc, _ := soapValue(body, "errorDescription")
+			return nil, upnpSOAPError{code, desc}
+		}
+		return nil, fmt.Errorf("UPnP %s: %s", action, res.Status)
+	}
+	return body, nil
+}
+
+func (c *Client) mapUPnP(ctx context.Context, gw netaddr.IP, internal netaddr.IPPort, old *mapping) (*mapping, error) {
+	controlURL, serviceType, err := c.discoverUPnP(ctx, gw)
+	if err != nil {
+		return nil, err
+	}
+	body, err := soapCall(ctx, controlURL, serviceType, "GetExternalIPAddress")
+	if err != nil {
+		return nil, err
+	}
+	extIPStr, _ := soapValue(body, "NewExternalIPAddress")
+	extIP, err := netaddr.ParseIP(extIPStr)
+	if err != nil {
+		return nil, fmt.Errorf("bad UPnP external address %q", extIPStr)
+	}
+
+	// UPnP doesn't pick an external port for us, so ask for the same
+	// one as before, or as the internal port.
+	extPort := internal.Port
+	if old != nil && old.proto == "upnp" {
+		extPort = old.external.Port
+	}
+	lifetime := mapLifetime
+	add := func(lease time.Duration) error {
+		_, err := soapCall(ctx, controlURL, serviceType, "AddPortMapping",
+			"NewRemoteHost", "",
+			"NewExternalPort", strconv.Itoa(int(extPort)),
+			"NewProtocol", "UDP",
+			"NewInternalPort", strconv.Itoa(int(internal.Port)),
+			"NewInternalClient", internal.IP.String(),
+			"NewEnabled", "1",
+			"NewPortMappingDescription", "tailscale",
+			"NewLeaseDuration", strconv.Itoa(int(lease/time.Second)),
+		)
+		return err
+	}
+	err = add(lifetime)
+	if se, ok := err.(upnpSOAPError); ok && se.code == upnpErrOnlyPermanentLeases {
+		lifetime = upnpPermanentLifetime
+		err = add(0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := newMapping("upnp", gw, internal, netaddr.IPPort{IP: extIP, Port: extPort}, lifetime)
+	m.upnpURL = controlURL
+	m.upnpSvc = serviceType
+	return m, nil
+}
+
+func (c *Client) releaseUPnP(ctx context.Context, m *mapping) error {
+	_, err := soapCall(ctx, m.upnpURL, m.upnpSvc, "DeletePortMapping",
+		"NewRemoteHost", "",
+		"NewExternalPort", strconv.Itoa(int(m.external.Port)),
+		"NewProtocol", "UDP",
+	)
+	return err
+}
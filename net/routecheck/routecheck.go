@@ -0,0 +1,155 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package routecheck probes whether a subnet that a subnet router
+// advertises is reachable from it, so that the router can withdraw
+// the route when it's not.
+package routecheck
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// Check is a reachability probe of a host in an advertised subnet.
+type Check struct {
+	// Kind is "ping" for an ICMP echo, "tcp" for a TCP connection,
+	// or "arp" for a resolved link-layer address (Linux only).
+	Kind string
+	IP   netaddr.IP
+	Port uint16 // for "tcp"
+}
+
+// Parse parses a check in the form "ping:IP", "arp:IP" or
+// "tcp:IP:PORT", with IPv6 addresses in brackets for "tcp".
+func Parse(s string) (Check, error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return Check{}, fmt.Errorf("route check %q: want KIND:ADDRESS", s)
+	}
+	kind, addr := s[:i], s[i+1:]
+	c := Check{Kind: kind}
+	switch kind {
+	case "ping", "arp":
+		if kind == "arp" && runtime.GOOS != "linux" {
+			return Check{}, fmt.Errorf("route check %q: %v", s, errNoARP)
+		}
+		ip, err := netaddr.ParseIP(addr)
+		if err != nil {
+			return Check{}, fmt.Errorf("route check %q: %v", s, err)
+		}
+		if kind == "arp" && !ip.Is4() {
+			return Check{}, fmt.Errorf("route check %q: arp checks need an IPv4 address", s)
+		}
+		c.IP = ip
+	case "tcp":
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return Check{}, fmt.Errorf("route check %q: %v", s, err)
+		}
+		ip, err := netaddr.ParseIP(host)
+		if err != nil {
+			return Check{}, fmt.Errorf("route check %q: %v", s, err)
+		}
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || p == 0 {
+			return Check{}, fmt.Errorf("route check %q: invalid port %q", s, port)
+		}
+		c.IP, c.Port = ip, uint16(p)
+	default:
+		return Check{}, fmt.Errorf("route check %q: unknown kind %q; want ping, tcp or arp", s, kind)
+	}
+	return c, nil
+}
+
+// String returns c in the form Parse accepts.
+func (c Check) String() string {
+	if c.Kind == "tcp" {
+		return "tcp:" + net.JoinHostPort(c.IP.String(), strconv.Itoa(int(c.Port)))
+	}
+	return c.Kind + ":" + c.IP.String()
+}
+
+// Run runs the check once, returning nil if the host responded
+// before ctx was done.
+func (c Check) Run(ctx context.Context) error {
+	switch c.Kind {
+	case "ping":
+		return ping(ctx, c.IP)
+	case "tcp":
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(c.IP.String(), strconv.Itoa(int(c.Port))))
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		return nil
+	case "arp":
+		return arp(ctx, c.IP)
+	}
+	return fmt.Errorf("unknown route check kind %q", c.Kind)
+}
+
+// ping sends ip one ICMP echo request with the system's ping
+// command, which unlike a raw socket needs no privileges.
+func ping(ctx context.Context, ip netaddr.IP) error {
+	cmd, args := "ping", []string{"-c", "1"}
+	switch runtime.GOOS {
+	case "windows":
+		args = []string{"-n", "1"}
+	case "darwin", "freebsd", "openbsd":
+		if ip.Is6() {
+			cmd = "ping6"
+		}
+	}
+	out, err := exec.CommandContext(ctx, cmd, append(args, ip.String())...).CombinedOutput()
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("ping %v: no reply", ip)
+		}
+		return fmt.Errorf("ping %v: %v: %s", ip, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// arpPollInterval is how often the ARP table is read while waiting
+// for an entry to resolve.
+const arpPollInterval = 100 * time.Millisecond
+
+// errNoARP is returned by arp where the ARP table can't be read.
+var errNoARP = errors.New("arp checks are only supported on Linux")
+
+// arpComplete reports whether the ARP table r, in the format of
+// Linux's /proc/net/arp, has a resolved entry for ip.
+func arpComplete(r io.Reader, ip netaddr.IP) bool {
+	s := ip.String()
+	bs := bufio.NewScanner(r)
+	for bs.Scan() {
+		f := strings.Fields(bs.Text())
+		// IP address, HW type, Flags, HW address, Mask, Device
+		if len(f) < 4 || f[0] != s {
+			continue
+		}
+		flags, err := strconv.ParseUint(strings.TrimPrefix(f[2], "0x"), 16, 32)
+		if err != nil {
+			continue
+		}
+		const atfCom = 0x2 // ATF_COM: the entry is complete
+		if flags&atfCom != 0 && f[3] != "00:00:00:00:00:00" {
+			return true
+		}
+	}
+	return false
+}
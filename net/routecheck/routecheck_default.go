@@ -0,0 +1,17 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package routecheck
+
+import (
+	"context"
+
+	"inet.af/netaddr"
+)
+
+func arp(ctx context.Context, ip netaddr.IP) error {
+	return errNoARP
+}
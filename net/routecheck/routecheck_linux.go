@@ -0,0 +1,47 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package routecheck
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// arp makes the kernel resolve ip's link-layer address, by sending it
+// a UDP datagram to the discard port, and waits for the ARP table to
+// have it.
+func arp(ctx context.Context, ip netaddr.IP) error {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "udp4", net.JoinHostPort(ip.String(), "9"))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.Write([]byte{0})
+
+	t := time.NewTicker(arpPollInterval)
+	defer t.Stop()
+	for {
+		f, err := os.Open("/proc/net/arp")
+		if err != nil {
+			return err
+		}
+		ok := arpComplete(f, ip)
+		f.Close()
+		if ok {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("arp %v: unresolved", ip)
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package routecheck
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string // String of the result; empty for an error
+		linuxOK bool   // valid only on Linux
+	}{
+		{in: "ping:10.0.0.1", want: "ping:10.0.0.1"},
+		{in: "ping:fd00::1", want: "ping:fd00::1"},
+		{in: "tcp:10.0.0.1:22", want: "tcp:10.0.0.1:22"},
+		{in: "tcp:[fd00::1]:443", want: "tcp:[fd00::1]:443"},
+		{in: "arp:192.168.1.1", want: "arp:192.168.1.1", linuxOK: true},
+		{in: "arp:fd00::1"},
+		{in: "tcp:10.0.0.1"},
+		{in: "tcp:10.0.0.1:0"},
+		{in: "tcp:host:22"},
+		{in: "ping:"},
+		{in: "http:10.0.0.1"},
+		{in: "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		want := tt.want
+		if tt.linuxOK && runtime.GOOS != "linux" {
+			want = ""
+		}
+		c, err := Parse(tt.in)
+		if want == "" {
+			if err == nil {
+				t.Errorf("Parse(%q) = %v; want error", tt.in, c)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.in, err)
+			continue
+		}
+		if got := c.String(); got != want {
+			t.Errorf("Parse(%q) = %q; want %q", tt.in, got, want)
+		}
+	}
+}
+
+func TestARPComplete(t *testing.T) {
+	const table = `IP address       HW type     Flags       HW address            Mask     Device
+192.168.1.1      0x1         0x2         52:54:00:12:34:56     *        eth0
+192.168.1.2      0x1         0x0         00:00:00:00:00:00     *        eth0
+`
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"192.168.1.1", true},
+		{"192.168.1.2", false},
+		{"192.168.1.3", false},
+	}
+	for _, tt := range tests {
+		ip, err := netaddr.ParseIP(tt.ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := arpComplete(strings.NewReader(table), ip); got != tt.want {
+			t.Errorf("arpComplete(%s) = %v; want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestTCPCheck(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := Check{Kind: "tcp", IP: netaddr.IPv4(127, 0, 0, 1), Port: uint16(port)}
+	if err := c.Run(ctx); err != nil {
+		t.Errorf("check of listening port: %v", err)
+	}
+	ln.Close()
+	if err := c.Run(ctx); err == nil {
+		t.Errorf("check of closed port succeeded")
+	}
+}
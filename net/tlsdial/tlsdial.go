@@ -15,9 +15,47 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
 	"time"
 )
 
+var (
+	rootsMu sync.Mutex
+	roots   *x509.CertPool // nil means the system roots
+)
+
+// SetRootCAsFromFile makes the configs returned by Config trust the
+// PEM-encoded CA certificates in the file at path, in addition to
+// the system's roots. It's for self-hosted control and DERP servers
+// whose certificates come from a private CA.
+func SetRootCAsFromFile(path string) error {
+	pemCerts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		// Not available on all platforms (e.g. Windows);
+		// trust just the bundle there.
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pemCerts) {
+		return fmt.Errorf("no PEM certificates found in %s", path)
+	}
+	rootsMu.Lock()
+	defer rootsMu.Unlock()
+	roots = pool
+	return nil
+}
+
+func rootCAs() *x509.CertPool {
+	rootsMu.Lock()
+	defer rootsMu.Unlock()
+	return roots
+}
+
 // Config returns a tls.Config for connecting to a server.
 // If base is non-nil, it's cloned as the base config before
 // being configured and returned.
@@ -29,6 +67,9 @@ func Config(host string, base *tls.Config) *tls.Config {
 		conf = base.Clone()
 	}
 	conf.ServerName = host
+	if conf.RootCAs == nil {
+		conf.RootCAs = rootCAs()
+	}
 
 	return conf
 }
@@ -63,6 +104,7 @@ func SetConfigExpectedCert(c *tls.Config, certDNSName string) {
 			certs[i] = cert
 		}
 		opts := x509.VerifyOptions{
+			Roots:         c.RootCAs,
 			CurrentTime:   time.Now(),
 			DNSName:       certDNSName,
 			Intermediates: x509.NewCertPool(),
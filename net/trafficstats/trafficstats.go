@@ -0,0 +1,216 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package trafficstats keeps a rolling record of how many bytes were
+// sent to and received from each peer and through each advertised
+// route, in 5 minute buckets covering the last day, so that recent
+// traffic can be reported across restarts.
+package trafficstats
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"tailscale.com/atomicfile"
+)
+
+const (
+	// BucketDuration is the granularity of the record.
+	BucketDuration = 5 * time.Minute
+	// Window is how far back the record goes.
+	Window = 24 * time.Hour
+)
+
+// Counts are byte counts in each direction.
+type Counts struct {
+	RxBytes int64 `json:",omitempty"`
+	TxBytes int64 `json:",omitempty"`
+}
+
+func (c Counts) add(o Counts) Counts {
+	return Counts{RxBytes: c.RxBytes + o.RxBytes, TxBytes: c.TxBytes + o.TxBytes}
+}
+
+// bucket is the traffic in the BucketDuration from Start.
+type bucket struct {
+	Start  time.Time
+	Peers  map[string]Counts `json:",omitempty"`
+	Routes map[string]Counts `json:",omitempty"`
+}
+
+// Totals is the traffic summed over a span of the record.
+type Totals struct {
+	Since  time.Time         // start of the earliest bucket included
+	Peers  map[string]Counts // keyed as given to Observe
+	Routes map[string]Counts // keyed as given to Observe
+}
+
+// Store is a rolling record of traffic. It's safe for concurrent use.
+//
+// A new Store keeps its record in memory until SetFile gives it a
+// file, which it then rewrites each time a bucket is completed.
+type Store struct {
+	mu      sync.Mutex
+	path    string    // or empty if in memory
+	buckets []*bucket // oldest first, covering at most Window
+
+	// lastPeers and lastRoutes are the cumulative counts last
+	// passed to Observe, to turn the next ones into deltas.
+	lastPeers  map[string]Counts
+	lastRoutes map[string]Counts
+}
+
+// New returns a new, empty Store that keeps its record in memory.
+func New() *Store {
+	return new(Store)
+}
+
+// SetFile makes s store its record in the file at path, merging any
+// record already there with the one s holds.
+func (s *Store) SetFile(path string) error {
+	var saved []*bucket
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(b, &saved); err != nil {
+			return err
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+	for _, sb := range saved {
+		cur := s.bucketLocked(sb.Start)
+		for k, c := range sb.Peers {
+			cur.Peers[k] = cur.Peers[k].add(c)
+		}
+		for k, c := range sb.Routes {
+			cur.Routes[k] = cur.Routes[k].add(c)
+		}
+	}
+	s.trimLocked(time.Now())
+	return s.saveLocked()
+}
+
+// bucketLocked returns the bucket starting at start, inserting it in
+// order if there's none.
+func (s *Store) bucketLocked(start time.Time) *bucket {
+	start = start.UTC()
+	i := len(s.buckets)
+	for i > 0 && s.buckets[i-1].Start.After(start) {
+		i--
+	}
+	if i > 0 && s.buckets[i-1].Start.Equal(start) {
+		return s.buckets[i-1]
+	}
+	nb := &bucket{
+		Start:  start,
+		Peers:  make(map[string]Counts),
+		Routes: make(map[string]Counts),
+	}
+	s.buckets = append(s.buckets, nil)
+	copy(s.buckets[i+1:], s.buckets[i:])
+	s.buckets[i] = nb
+	return nb
+}
+
+// trimLocked drops the buckets that ended more than Window before now.
+func (s *Store) trimLocked(now time.Time) {
+	cutoff := now.Add(-Window)
+	n := 0
+	for n < len(s.buckets) && !s.buckets[n].Start.Add(BucketDuration).After(cutoff) {
+		n++
+	}
+	s.buckets = s.buckets[n:]
+}
+
+// Observe records the traffic since the last call, given the
+// cumulative counts of each peer and route as of now. A count lower
+// than the last one is taken to have restarted from zero. Peers and
+// routes missing from a call are forgotten until they reappear.
+//
+// If now starts a new bucket and s has a file, the completed record
+// is saved to it.
+func (s *Store) Observe(now time.Time, peers, routes map[string]Counts) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rolled := len(s.buckets) > 0 && !s.buckets[len(s.buckets)-1].Start.Equal(now.Truncate(BucketDuration).UTC())
+	cur := s.bucketLocked(now.Truncate(BucketDuration))
+	addDeltas(cur.Peers, s.lastPeers, peers)
+	addDeltas(cur.Routes, s.lastRoutes, routes)
+	s.lastPeers, s.lastRoutes = peers, routes
+	s.trimLocked(now)
+	if rolled {
+		return s.saveLocked()
+	}
+	return nil
+}
+
+// addDeltas adds to dst the increase of each count in cur over last.
+func addDeltas(dst, last, cur map[string]Counts) {
+	for k, c := range cur {
+		d := c
+		if l, ok := last[k]; ok && c.RxBytes >= l.RxBytes && c.TxBytes >= l.TxBytes {
+			d = Counts{RxBytes: c.RxBytes - l.RxBytes, TxBytes: c.TxBytes - l.TxBytes}
+		}
+		if d != (Counts{}) {
+			dst[k] = dst[k].add(d)
+		}
+	}
+}
+
+// Totals returns the traffic in the buckets overlapping the span d
+// before now.
+func (s *Store) Totals(now time.Time, d time.Duration) Totals {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := Totals{
+		Peers:  make(map[string]Counts),
+		Routes: make(map[string]Counts),
+	}
+	cutoff := now.Add(-d)
+	for _, b := range s.buckets {
+		if !b.Start.Add(BucketDuration).After(cutoff) {
+			continue
+		}
+		if t.Since.IsZero() {
+			t.Since = b.Start
+		}
+		for k, c := range b.Peers {
+			t.Peers[k] = t.Peers[k].add(c)
+		}
+		for k, c := range b.Routes {
+			t.Routes[k] = t.Routes[k].add(c)
+		}
+	}
+	return t
+}
+
+// Save writes the record to s's file, if it has one.
+func (s *Store) Save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.saveLocked()
+}
+
+func (s *Store) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	b, err := json.Marshal(s.buckets)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(s.path, b, 0600)
+}
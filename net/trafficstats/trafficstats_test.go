@@ -0,0 +1,75 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package trafficstats
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trafficstats-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "traffic-stats.json")
+
+	now := time.Now().Truncate(BucketDuration)
+	s := New()
+	if err := s.SetFile(path); err != nil {
+		t.Fatal(err)
+	}
+	observe := func(s *Store, at time.Duration, peer, route Counts) {
+		t.Helper()
+		err := s.Observe(now.Add(at),
+			map[string]Counts{"p": peer},
+			map[string]Counts{"10.0.0.0/24": route})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	observe(s, 0, Counts{RxBytes: 100, TxBytes: 10}, Counts{RxBytes: 5})
+	observe(s, time.Minute, Counts{RxBytes: 150, TxBytes: 10}, Counts{RxBytes: 7})
+	// The next bucket saves the first.
+	observe(s, BucketDuration, Counts{RxBytes: 200, TxBytes: 20}, Counts{RxBytes: 7})
+
+	tot := s.Totals(now.Add(BucketDuration), Window)
+	if got, want := tot.Peers["p"], (Counts{RxBytes: 200, TxBytes: 20}); got != want {
+		t.Errorf("peer totals = %+v; want %+v", got, want)
+	}
+	if got, want := tot.Routes["10.0.0.0/24"], (Counts{RxBytes: 7}); got != want {
+		t.Errorf("route totals = %+v; want %+v", got, want)
+	}
+	if !tot.Since.Equal(now) {
+		t.Errorf("Since = %v; want %v", tot.Since, now)
+	}
+	if got, want := s.Totals(now.Add(2*BucketDuration), BucketDuration).Peers["p"], (Counts{RxBytes: 50, TxBytes: 10}); got != want {
+		t.Errorf("last bucket peer totals = %+v; want %+v", got, want)
+	}
+
+	// A restarted node's counters start again from zero, and its
+	// record continues from the file.
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	s2 := New()
+	if err := s2.SetFile(path); err != nil {
+		t.Fatal(err)
+	}
+	observe(s2, BucketDuration+time.Minute, Counts{RxBytes: 30}, Counts{})
+	if got, want := s2.Totals(now.Add(BucketDuration+time.Minute), Window).Peers["p"], (Counts{RxBytes: 230, TxBytes: 20}); got != want {
+		t.Errorf("totals after restart = %+v; want %+v", got, want)
+	}
+
+	// A day later, the old buckets are gone.
+	observe(s2, Window+2*BucketDuration, Counts{RxBytes: 31}, Counts{})
+	if got, want := s2.Totals(now.Add(Window+2*BucketDuration), Window).Peers["p"], (Counts{RxBytes: 1}); got != want {
+		t.Errorf("totals a day later = %+v; want %+v", got, want)
+	}
+}
@@ -6,6 +6,8 @@
 package tsaddr
 
 import (
+	"encoding/binary"
+	"fmt"
 	"sync"
 
 	"inet.af/netaddr"
@@ -34,6 +36,7 @@ var (
 	cgnatRange   oncePrefix
 	ulaRange     oncePrefix
 	ula4To6Range oncePrefix
+	viaRange     oncePrefix
 )
 
 // TailscaleServiceIP returns the listen address of services
@@ -84,6 +87,41 @@ func Tailscale4To6(ipv4 netaddr.IP) netaddr.IP {
 	return netaddr.IPFrom16(ret)
 }
 
+// TailscaleViaRange returns the subset of TailscaleULARange used for
+// 4via6 routes, which give the IPv4 subnets of sites that may
+// overlap each other unique IPv6 subnets. See MapVia.
+func TailscaleViaRange() netaddr.IPPrefix {
+	viaRange.Do(func() { mustPrefix(&viaRange.v, "fd7a:115c:a1e0:b1a::/64") })
+	return viaRange.v
+}
+
+// MapVia returns the 4via6 route of the IPv4 subnet v4 at the site
+// with the given ID: fd7a:115c:a1e0:b1a:0:SITE:a.b.c.d with the
+// prefix length of v4 plus 96.
+func MapVia(siteID uint16, v4 netaddr.IPPrefix) (netaddr.IPPrefix, error) {
+	if !v4.IP.Is4() || v4.Bits > 32 {
+		return netaddr.IPPrefix{}, fmt.Errorf("%v is not an IPv4 prefix", v4)
+	}
+	ret := TailscaleViaRange().IP.As16()
+	binary.BigEndian.PutUint16(ret[10:12], siteID)
+	ip4 := v4.IP.As4()
+	copy(ret[12:], ip4[:])
+	return netaddr.IPPrefix{IP: netaddr.IPFrom16(ret), Bits: v4.Bits + 96}, nil
+}
+
+// UnmapVia returns the site ID and IPv4 address that the 4via6
+// address ip maps. It reports false if ip isn't a 4via6 address.
+func UnmapVia(ip netaddr.IP) (siteID uint16, v4 netaddr.IP, ok bool) {
+	if !TailscaleViaRange().Contains(ip) {
+		return 0, netaddr.IP{}, false
+	}
+	a := ip.As16()
+	if a[8] != 0 || a[9] != 0 {
+		return 0, netaddr.IP{}, false
+	}
+	return binary.BigEndian.Uint16(a[10:12]), netaddr.IPv4(a[12], a[13], a[14], a[15]), true
+}
+
 func mustPrefix(v *netaddr.IPPrefix, prefix string) {
 	var err error
 	*v, err = netaddr.ParseIPPrefix(prefix)
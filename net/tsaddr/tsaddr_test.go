@@ -4,7 +4,11 @@
 
 package tsaddr
 
-import "testing"
+import (
+	"testing"
+
+	"inet.af/netaddr"
+)
 
 func TestChromeOSVMRange(t *testing.T) {
 	if got, want := ChromeOSVMRange().String(), "100.115.92.0/23"; got != want {
@@ -17,3 +21,50 @@ func TestCGNATRange(t *testing.T) {
 		t.Errorf("got %q; want %q", got, want)
 	}
 }
+
+func TestMapVia(t *testing.T) {
+	tests := []struct {
+		site uint16
+		v4   string
+		want string
+	}{
+		{7, "10.1.1.0/24", "fd7a:115c:a1e0:b1a:0:7:a01:100/120"},
+		{0xffff, "192.168.0.0/16", "fd7a:115c:a1e0:b1a:0:ffff:c0a8:0/112"},
+		{1, "10.1.1.16/32", "fd7a:115c:a1e0:b1a:0:1:a01:110/128"},
+	}
+	for _, tt := range tests {
+		v4, err := netaddr.ParseIPPrefix(tt.v4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := MapVia(tt.site, v4)
+		if err != nil {
+			t.Errorf("MapVia(%d, %v): %v", tt.site, v4, err)
+			continue
+		}
+		if got.String() != tt.want {
+			t.Errorf("MapVia(%d, %v) = %v; want %v", tt.site, v4, got, tt.want)
+		}
+		site, ip, ok := UnmapVia(got.IP)
+		if !ok || site != tt.site || ip != v4.IP {
+			t.Errorf("UnmapVia(%v) = %d, %v, %v; want %d, %v, true", got.IP, site, ip, ok, tt.site, v4.IP)
+		}
+	}
+
+	v6, err := netaddr.ParseIPPrefix("fd00::/64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MapVia(1, v6); err == nil {
+		t.Error("MapVia accepted an IPv6 prefix")
+	}
+	for _, s := range []string{"fd7a:115c:a1e0::1", "fd7a:115c:a1e0:b1a:1:7:a01:110", "10.1.1.16"} {
+		ip, err := netaddr.ParseIP(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, ok := UnmapVia(ip); ok {
+			t.Errorf("UnmapVia(%v) = true; want false", s)
+		}
+	}
+}
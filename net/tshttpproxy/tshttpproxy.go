@@ -7,6 +7,8 @@
 package tshttpproxy
 
 import (
+	"encoding/base64"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -24,10 +26,23 @@ func InvalidateCache() {
 }
 
 var (
-	mu           sync.Mutex
-	noProxyUntil time.Time // if non-zero, time at which ProxyFromEnvironment should check again
+	mu            sync.Mutex
+	noProxyUntil  time.Time // if non-zero, time at which ProxyFromEnvironment should check again
+	proxyOverride *url.URL  // if non-nil, proxy to use instead of the environment's
 )
 
+// SetProxyOverride sets the proxy that ProxyFromEnvironment returns
+// for all non-loopback requests, instead of consulting the
+// environment and system settings. A nil u removes the override.
+//
+// The URL may contain a username and password, which are sent to
+// the proxy with Basic authentication.
+func SetProxyOverride(u *url.URL) {
+	mu.Lock()
+	defer mu.Unlock()
+	proxyOverride = u
+}
+
 func setNoProxyUntil(d time.Duration) {
 	mu.Lock()
 	defer mu.Unlock()
@@ -44,7 +59,14 @@ var sysProxyFromEnv func(*http.Request) (*url.URL, error)
 func ProxyFromEnvironment(req *http.Request) (*url.URL, error) {
 	mu.Lock()
 	noProxyTime := noProxyUntil
+	override := proxyOverride
 	mu.Unlock()
+	if override != nil {
+		if isLoopbackHost(req.URL.Hostname()) {
+			return nil, nil
+		}
+		return override, nil
+	}
 	if time.Now().Before(noProxyTime) {
 		return nil, nil
 	}
@@ -64,13 +86,29 @@ func ProxyFromEnvironment(req *http.Request) (*url.URL, error) {
 	return nil, err
 }
 
+// isLoopbackHost reports whether host is localhost or a loopback IP,
+// which are never proxied.
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 var sysAuthHeader func(*url.URL) (string, error)
 
 // GetAuthHeader returns the Authorization header value to send to proxy u.
+//
+// If u contains a username, Basic authentication is used.
 func GetAuthHeader(u *url.URL) (string, error) {
 	if fake := os.Getenv("TS_DEBUG_FAKE_PROXY_AUTH"); fake != "" {
 		return fake, nil
 	}
+	if u.User != nil && u.User.Username() != "" {
+		pass, _ := u.User.Password()
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+pass)), nil
+	}
 	if sysAuthHeader != nil {
 		return sysAuthHeader(u)
 	}
@@ -33,8 +33,9 @@ type Poller struct {
 // NewPoller returns a new portlist Poller. It returns an error
 // if the portlist couldn't be obtained.
 func NewPoller() (*Poller, error) {
-	if version.OS() == "iOS" {
-		return nil, errors.New("not available on iOS")
+	if version.IsSandboxed() {
+		// Listing ports means running netstat or lsof.
+		return nil, errors.New("not available in a sandbox")
 	}
 	p := &Poller{
 		c:      make(chan List),
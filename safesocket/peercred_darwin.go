@@ -0,0 +1,34 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package safesocket
+
+import (
+	"net"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// connPeerCreds returns the uid of the process at the other end of a
+// Unix socket connection, from LOCAL_PEERCRED. Its pid is left zero.
+func connPeerCreds(c net.Conn) (PeerCreds, bool) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return PeerCreds{}, false
+	}
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return PeerCreds{}, false
+	}
+	var cred *unix.Xucred
+	var credErr error
+	err = rc.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptXucred(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return PeerCreds{}, false
+	}
+	return PeerCreds{UID: strconv.FormatUint(uint64(cred.Uid), 10)}, true
+}
@@ -0,0 +1,32 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package safesocket
+
+import (
+	"net"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+func connPeerCreds(c net.Conn) (PeerCreds, bool) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return PeerCreds{}, false
+	}
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return PeerCreds{}, false
+	}
+	var cred *unix.Ucred
+	var credErr error
+	err = rc.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return PeerCreds{}, false
+	}
+	return PeerCreds{Pid: int(cred.Pid), UID: strconv.FormatUint(uint64(cred.Uid), 10)}, true
+}
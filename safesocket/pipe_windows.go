@@ -8,15 +8,44 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"reflect"
+	"sync"
 	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/tailscale/wireguard-go/ipc/winpipe"
+	"golang.org/x/sys/windows"
+)
+
+// PipeName is the named pipe that, besides the localhost TCP port,
+// tailscaled listens on for frontends. Only administrators can
+// create pipes under ProtectedPrefix\Administrators, so a process
+// that reaches it is talking to the real tailscaled.
+const PipeName = `\\.\pipe\ProtectedPrefix\Administrators\Tailscale\tailscaled`
+
+// pipeSDDL is the security descriptor of PipeName. SYSTEM and
+// administrators get full access, and interactively logged-on users
+// read and write access; network logons and services running as
+// other accounts can't open it at all.
+const pipeSDDL = "O:SYD:P(A;;GA;;;SY)(A;;GA;;;BA)(A;;GRGW;;;IU)"
+
+var (
+	kernel32                        = windows.NewLazySystemDLL("kernel32.dll")
+	getNamedPipeClientProcessIdProc = kernel32.NewProc("GetNamedPipeClientProcessId")
 )
 
 func path(vendor, name string, port uint16) string {
 	return fmt.Sprintf("127.0.0.1:%v", port)
 }
 
-// TODO(apenwarr): handle magic cookie auth
+// connect connects to PipeName, falling back to the localhost TCP
+// port if the pipe isn't there, as with tailscaled versions that
+// don't listen on it.
 func connect(path string, port uint16) (net.Conn, error) {
+	if c, err := dialPipe(); err == nil {
+		return c, nil
+	}
 	pipe, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
 	if err != nil {
 		return nil, err
@@ -24,6 +53,16 @@ func connect(path string, port uint16) (net.Conn, error) {
 	return pipe, err
 }
 
+// dialPipe connects to PipeName, if it's owned by SYSTEM.
+func dialPipe() (net.Conn, error) {
+	system, err := windows.CreateWellKnownSid(windows.WinLocalSystemSid)
+	if err != nil {
+		return nil, err
+	}
+	timeout := time.Second
+	return winpipe.Dial(PipeName, &timeout, system)
+}
+
 func setFlags(network, address string, c syscall.RawConn) error {
 	return c.Control(func(fd uintptr) {
 		syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET,
@@ -31,19 +70,155 @@ func setFlags(network, address string, c syscall.RawConn) error {
 	})
 }
 
-// TODO(apenwarr): use named pipes instead of sockets?
-//   I tried to use winio.ListenPipe() here, but that code is a disaster,
-//   built on top of an API that's a disaster. So for now we'll hack it by
-//   just always using a TCP session on a fixed port on localhost. As a
-//   result, on Windows we ignore the vendor and name strings.
-// TODO(apenwarr): handle magic cookie auth
+// listen listens on the localhost TCP port, for existing frontends,
+// and on PipeName, whose ACL keeps out the processes that can reach
+// any localhost port. Failing to create the pipe isn't fatal: the
+// TCP port is then all there is.
 func listen(path string, port uint16) (_ net.Listener, gotPort uint16, _ error) {
 	lc := net.ListenConfig{
 		Control: setFlags,
 	}
-	pipe, err := lc.Listen(context.Background(), "tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	tcp, err := lc.Listen(context.Background(), "tcp", fmt.Sprintf("127.0.0.1:%d", port))
 	if err != nil {
 		return nil, 0, err
 	}
-	return pipe, uint16(pipe.Addr().(*net.TCPAddr).Port), err
+	gotPort = uint16(tcp.Addr().(*net.TCPAddr).Port)
+	sd, err := windows.SecurityDescriptorFromString(pipeSDDL)
+	if err != nil {
+		return tcp, gotPort, nil
+	}
+	pipe, err := winpipe.Listen(PipeName, &winpipe.ListenConfig{SecurityDescriptor: sd})
+	if err != nil {
+		return tcp, gotPort, nil
+	}
+	return newMultiListener(tcp, pipe), gotPort, nil
+}
+
+// connPeerCreds returns the pid of the client of a named pipe
+// connection.
+func connPeerCreds(c net.Conn) (PeerCreds, bool) {
+	h, ok := pipeHandle(c)
+	if !ok {
+		return PeerCreds{}, false
+	}
+	var pid uint32
+	ret, _, _ := getNamedPipeClientProcessIdProc.Call(uintptr(h), uintptr(unsafe.Pointer(&pid)))
+	if ret == 0 || pid == 0 {
+		return PeerCreds{}, false
+	}
+	return PeerCreds{Pid: int(pid)}, true
+}
+
+// pipeHandle returns the handle of c, if it's a winpipe connection.
+// winpipe doesn't export it, so it's read from the handle field of
+// the file its connection types embed.
+func pipeHandle(c net.Conn) (h windows.Handle, ok bool) {
+	if fc, ok := c.(interface{ Fd() uintptr }); ok {
+		return windows.Handle(fc.Fd()), true
+	}
+	v := reflect.ValueOf(c)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return 0, false
+	}
+	if v.Elem().Type().PkgPath() != reflect.TypeOf(winpipe.ListenConfig{}).PkgPath() {
+		return 0, false
+	}
+	defer func() {
+		// FieldByName panics on a nil embedded pointer.
+		if recover() != nil {
+			h, ok = 0, false
+		}
+	}()
+	f := v.Elem().FieldByName("handle")
+	if !f.IsValid() || f.Kind() != reflect.Uintptr {
+		return 0, false
+	}
+	return windows.Handle(f.Uint()), true
+}
+
+// multiListener is a net.Listener accepting connections from several
+// listeners. Its Addr is the first's.
+type multiListener struct {
+	lns   []net.Listener
+	conns chan net.Conn
+	errc  chan error
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newMultiListener(lns ...net.Listener) *multiListener {
+	ml := &multiListener{
+		lns:    lns,
+		conns:  make(chan net.Conn),
+		errc:   make(chan error),
+		closed: make(chan struct{}),
+	}
+	for _, ln := range lns {
+		go ml.acceptLoop(ln)
+	}
+	return ml
+}
+
+func (ml *multiListener) acceptLoop(ln net.Listener) {
+	var delay time.Duration
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			select {
+			case ml.errc <- err:
+			case <-ml.closed:
+				return
+			}
+			// Back off, so a listener that keeps failing doesn't
+			// spin, or crowd out the other listeners' connections.
+			delay *= 2
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay > time.Second {
+				delay = time.Second
+			}
+			select {
+			case <-time.After(delay):
+				continue
+			case <-ml.closed:
+				return
+			}
+		}
+		delay = 0
+		select {
+		case ml.conns <- c:
+		case <-ml.closed:
+			c.Close()
+			return
+		}
+	}
+}
+
+func (ml *multiListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-ml.conns:
+		return c, nil
+	case err := <-ml.errc:
+		return nil, err
+	case <-ml.closed:
+		return nil, fmt.Errorf("listener closed")
+	}
+}
+
+func (ml *multiListener) Close() error {
+	var firstErr error
+	ml.closeOnce.Do(func() {
+		close(ml.closed)
+		for _, ln := range ml.lns {
+			if err := ln.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	})
+	return firstErr
+}
+
+func (ml *multiListener) Addr() net.Addr {
+	return ml.lns[0].Addr()
 }
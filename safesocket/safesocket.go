@@ -38,3 +38,18 @@ func Connect(path string, port uint16) (net.Conn, error) {
 func Listen(path string, port uint16) (_ net.Listener, gotPort uint16, _ error) {
 	return listen(path, port)
 }
+
+// PeerCreds identifies the process at the other end of a connection.
+type PeerCreds struct {
+	Pid int
+	// UID is the process's numeric user ID, or empty if the OS only
+	// reports the pid, as for Windows named pipes.
+	UID string
+}
+
+// ConnPeerCreds returns the credentials of the process at the other
+// end of c, if c is a Unix socket connection on Linux or macOS or a
+// named pipe connection on Windows. Otherwise, ok is false.
+func ConnPeerCreds(c net.Conn) (_ PeerCreds, ok bool) {
+	return connPeerCreds(c)
+}
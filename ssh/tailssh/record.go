@@ -0,0 +1,152 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin
+
+package tailssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// SessionInfo describes an SSH session that is about to start.
+type SessionInfo struct {
+	LocalUser  string     // local user the session runs as
+	LoginName  string     // Tailscale login name of the connecting user
+	NodeName   string     // Tailscale name of the connecting node
+	RemoteAddr netaddr.IP // Tailscale IP of the connecting node
+	Command    []string   // command requested; empty for a shell
+	Start      time.Time
+
+	// Term, Width and Height describe the session's terminal.
+	// Term is empty if the client didn't request a pty.
+	Term          string
+	Width, Height int
+}
+
+// A SessionRecorder records SSH sessions.
+type SessionRecorder interface {
+	// StartSession is called before a session's command starts.
+	// The returned writer receives everything the command writes
+	// to its stdout (or its terminal) and is closed when the
+	// session ends. If StartSession returns an error, the session
+	// is refused.
+	StartSession(*SessionInfo) (io.WriteCloser, error)
+}
+
+var (
+	recorderMu sync.Mutex
+	recorder   SessionRecorder
+)
+
+// SetSessionRecorder sets the recorder used for new SSH sessions. A
+// nil r (the default) disables recording.
+func SetSessionRecorder(r SessionRecorder) {
+	recorderMu.Lock()
+	defer recorderMu.Unlock()
+	recorder = r
+}
+
+func sessionRecorder() SessionRecorder {
+	recorderMu.Lock()
+	defer recorderMu.Unlock()
+	return recorder
+}
+
+// NewDirRecorder returns a SessionRecorder that writes each session
+// to its own file in dir, in asciinema's asciicast v2 format.
+func NewDirRecorder(dir string) SessionRecorder {
+	return dirRecorder(dir)
+}
+
+type dirRecorder string
+
+func (dir dirRecorder) StartSession(si *SessionInfo) (io.WriteCloser, error) {
+	if err := os.MkdirAll(string(dir), 0700); err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("%s-%s.cast", si.Start.UTC().Format("20060102T150405Z"), si.LocalUser)
+	f, err := os.OpenFile(filepath.Join(string(dir), name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	w := &castWriter{f: f, start: si.Start}
+	if err := w.writeHeader(si); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// castWriter writes an asciicast v2 recording.
+// See https://github.com/asciinema/asciinema/blob/develop/doc/asciicast-v2.md
+type castWriter struct {
+	mu    sync.Mutex
+	f     *os.File
+	start time.Time
+}
+
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Command   string            `json:"command,omitempty"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+func (w *castWriter) writeHeader(si *SessionInfo) error {
+	hdr := castHeader{
+		Version:   2,
+		Width:     si.Width,
+		Height:    si.Height,
+		Timestamp: si.Start.Unix(),
+		Title:     fmt.Sprintf("%s from %s (%s)", si.LocalUser, si.NodeName, si.LoginName),
+	}
+	if len(si.Command) > 0 {
+		hdr.Command = shellQuote(si.Command)
+	}
+	if si.Term != "" {
+		hdr.Env = map[string]string{"TERM": si.Term}
+	}
+	j, err := json.Marshal(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = w.f.Write(append(j, '\n'))
+	return err
+}
+
+// Write writes p as a single output event.
+func (w *castWriter) Write(p []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ev, err := json.Marshal([]interface{}{
+		time.Since(w.start).Seconds(),
+		"o",
+		string(p),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.f.Write(append(ev, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *castWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Close()
+}
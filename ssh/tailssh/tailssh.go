@@ -0,0 +1,318 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin
+
+// Package tailssh is an SSH server integrated into Tailscale.
+//
+// Clients don't authenticate with passwords or SSH keys. Instead,
+// tailscaled only hands the server connections from peers owned by
+// the same user that the packet filter allows to reach port 22, and
+// the server identifies the connecting node and user from their
+// Tailscale IP. Which local users they may log in as is up to the
+// tailnet's SSH policy from the control server.
+package tailssh
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/kr/pty"
+	gossh "golang.org/x/crypto/ssh"
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/types/logger"
+)
+
+func init() {
+	ipn.RegisterNewSSHServer(func(logf logger.Logf, lb *ipn.LocalBackend) (ipn.SSHServer, error) {
+		return newServer(logf, lb)
+	})
+}
+
+type server struct {
+	lb   *ipn.LocalBackend
+	logf logger.Logf
+	srv  *ssh.Server
+}
+
+func newServer(logf logger.Logf, lb *ipn.LocalBackend) (*server, error) {
+	signer, err := hostKeySigner(lb.TailscaleVarRoot())
+	if err != nil {
+		return nil, err
+	}
+	s := &server{lb: lb, logf: logf}
+	s.srv = &ssh.Server{Handler: s.handleSSH}
+	s.srv.AddHostKey(signer)
+	return s, nil
+}
+
+func (s *server) Serve(ln net.Listener) error {
+	return s.srv.Serve(ln)
+}
+
+// hostKeySigner returns the SSH host key stored under varRoot,
+// generating it first if needed. If varRoot is empty, the key is
+// ephemeral and clients will see a new one each time tailscaled
+// starts.
+func hostKeySigner(varRoot string) (gossh.Signer, error) {
+	if varRoot == "" {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return gossh.NewSignerFromKey(priv)
+	}
+	path := filepath.Join(varRoot, "ssh", "ssh_host_ed25519_seed")
+	seed, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		seed = make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		err = ioutil.WriteFile(path, seed, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s: bad host key length %d", path, len(seed))
+	}
+	return gossh.NewSignerFromKey(ed25519.NewKeyFromSeed(seed))
+}
+
+func (s *server) handleSSH(sess ssh.Session) {
+	ta, ok := sess.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		s.logf("rejecting non-TCP addr %T %v", sess.RemoteAddr(), sess.RemoteAddr())
+		sess.Exit(1)
+		return
+	}
+	ip, ok := netaddr.FromStdIP(ta.IP)
+	if !ok {
+		sess.Exit(1)
+		return
+	}
+	node, uprof, ok := s.lb.WhoIs(ip)
+	if !ok {
+		fmt.Fprintf(sess.Stderr(), "unknown Tailscale identity from %v\r\n", ip)
+		sess.Exit(1)
+		return
+	}
+	if err := s.lb.CheckSSHLogin(ip, sess.User()); err != nil {
+		s.logf("rejecting session for %q from %v (%v): %v", sess.User(), node.Name, uprof.LoginName, err)
+		fmt.Fprintf(sess.Stderr(), "%v\r\n", err)
+		sess.Exit(1)
+		return
+	}
+	localUser, err := lookupLocalUser(sess.User())
+	if err != nil {
+		s.logf("rejecting session for %q from %v (%v): %v", sess.User(), node.Name, uprof.LoginName, err)
+		fmt.Fprintf(sess.Stderr(), "%v\r\n", err)
+		sess.Exit(1)
+		return
+	}
+
+	s.logf("new session for %q from %v (%v, %v)", localUser.Username, node.Name, uprof.LoginName, ip)
+	defer s.logf("closing session for %q from %v", localUser.Username, node.Name)
+
+	ptyReq, winCh, isPty := sess.Pty()
+	info := &SessionInfo{
+		LocalUser:  localUser.Username,
+		LoginName:  uprof.LoginName,
+		NodeName:   node.Name,
+		RemoteAddr: ip,
+		Command:    sess.Command(),
+		Start:      time.Now(),
+	}
+	if isPty {
+		info.Term = ptyReq.Term
+		info.Width = ptyReq.Window.Width
+		info.Height = ptyReq.Window.Height
+	}
+
+	var out io.Writer = sess
+	if rec := sessionRecorder(); rec != nil {
+		w, err := rec.StartSession(info)
+		if err != nil {
+			// Refuse rather than run a session that's supposed to
+			// be recorded but isn't.
+			s.logf("starting session recording: %v", err)
+			fmt.Fprintf(sess.Stderr(), "session recording failed\r\n")
+			sess.Exit(1)
+			return
+		}
+		defer w.Close()
+		out = io.MultiWriter(sess, w)
+	}
+
+	cmd, err := newCommand(localUser, sess.Command())
+	if err != nil {
+		fmt.Fprintf(sess.Stderr(), "%v\r\n", err)
+		sess.Exit(1)
+		return
+	}
+	if isPty {
+		cmd.Env = append(cmd.Env, "TERM="+ptyReq.Term)
+		f, err := pty.Start(cmd)
+		if err != nil {
+			s.logf("starting pty: %v", err)
+			sess.Exit(1)
+			return
+		}
+		defer f.Close()
+		setWinsize(f, ptyReq.Window.Width, ptyReq.Window.Height)
+		go func() {
+			for win := range winCh {
+				setWinsize(f, win.Width, win.Height)
+			}
+		}()
+		go func() {
+			io.Copy(f, sess) // stdin
+		}()
+		io.Copy(out, f) // stdout
+	} else {
+		cmd.Stdin = sess
+		cmd.Stdout = out
+		cmd.Stderr = sess.Stderr()
+		if err := cmd.Start(); err != nil {
+			fmt.Fprintf(sess.Stderr(), "%v\r\n", err)
+			sess.Exit(1)
+			return
+		}
+	}
+	sess.Exit(exitCode(cmd.Wait()))
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		if st, ok := ee.Sys().(syscall.WaitStatus); ok && st.Exited() {
+			return st.ExitStatus()
+		}
+	}
+	return 1
+}
+
+// lookupLocalUser returns the local user that an SSH client asked to
+// log in as. Unless tailscaled runs as root, that can only be the
+// user running tailscaled.
+func lookupLocalUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown user %q", name)
+	}
+	if os.Getuid() != 0 && u.Uid != strconv.Itoa(os.Getuid()) {
+		return nil, fmt.Errorf("can't log in as %q: tailscaled is not running as root", name)
+	}
+	return u, nil
+}
+
+// newCommand returns a command that runs args (or, if args is
+// empty, a login shell) as u with u's shell.
+func newCommand(u *user.User, args []string) (*exec.Cmd, error) {
+	shell := loginShell(u.Username)
+	var cmd *exec.Cmd
+	if len(args) == 0 {
+		cmd = exec.Command(shell, "-l")
+	} else {
+		cmd = exec.Command(shell, "-c", shellQuote(args))
+	}
+	cmd.Dir = u.HomeDir
+	cmd.Env = []string{
+		"HOME=" + u.HomeDir,
+		"USER=" + u.Username,
+		"LOGNAME=" + u.Username,
+		"SHELL=" + shell,
+		"PATH=/usr/local/bin:/usr/bin:/bin:/usr/sbin:/sbin",
+	}
+	if strconv.Itoa(os.Getuid()) == u.Uid {
+		return cmd, nil
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	cred := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	if gids, err := u.GroupIds(); err == nil {
+		for _, g := range gids {
+			if n, err := strconv.ParseUint(g, 10, 32); err == nil {
+				cred.Groups = append(cred.Groups, uint32(n))
+			}
+		}
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	return cmd, nil
+}
+
+// loginShell returns the login shell of the named user from
+// /etc/passwd, or /bin/sh if it can't be found.
+func loginShell(username string) string {
+	f, err := os.Open("/etc/passwd")
+	if err != nil {
+		return "/bin/sh"
+	}
+	defer f.Close()
+	bs := bufio.NewScanner(f)
+	for bs.Scan() {
+		fields := strings.Split(bs.Text(), ":")
+		if len(fields) == 7 && fields[0] == username && fields[6] != "" {
+			return fields[6]
+		}
+	}
+	return "/bin/sh"
+}
+
+// shellQuote joins args into a single string that a POSIX shell
+// splits back into args.
+func shellQuote(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		if a != "" && strings.IndexFunc(a, needsQuote) == -1 {
+			quoted[i] = a
+			continue
+		}
+		quoted[i] = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+func needsQuote(r rune) bool {
+	switch {
+	case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		return false
+	}
+	return !strings.ContainsRune("-_./=:,+@%", r)
+}
+
+func setWinsize(f *os.File, w, h int) {
+	syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(syscall.TIOCSWINSZ),
+		uintptr(unsafe.Pointer(&struct{ h, w, x, y uint16 }{uint16(h), uint16(w), 0, 0})))
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin
+
+package tailssh
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		in   []string
+		want string
+	}{
+		{[]string{"ls", "-l"}, "ls -l"},
+		{[]string{"echo", ""}, "echo ''"},
+		{[]string{"echo", "a b"}, "echo 'a b'"},
+		{[]string{"echo", "it's"}, `echo 'it'\''s'`},
+		{[]string{"echo", "$HOME"}, "echo '$HOME'"},
+		{[]string{"cat", "/etc/os-release"}, "cat /etc/os-release"},
+	}
+	for _, tt := range tests {
+		if got := shellQuote(tt.in); got != tt.want {
+			t.Errorf("shellQuote(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestDirRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tailssh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rec := NewDirRecorder(dir)
+	w, err := rec.StartSession(&SessionInfo{
+		LocalUser: "alice",
+		NodeName:  "laptop.example.com.",
+		LoginName: "alice@example.com",
+		Start:     time.Now(),
+		Term:      "xterm",
+		Width:     80,
+		Height:    24,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("hello\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*-alice.cast"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("recordings = %q, %v; want 1", files, err)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	bs := bufio.NewScanner(f)
+	if !bs.Scan() {
+		t.Fatal("missing header")
+	}
+	var hdr castHeader
+	if err := json.Unmarshal(bs.Bytes(), &hdr); err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Version != 2 || hdr.Width != 80 || hdr.Height != 24 || hdr.Env["TERM"] != "xterm" {
+		t.Errorf("bad header %+v", hdr)
+	}
+	if !bs.Scan() {
+		t.Fatal("missing event")
+	}
+	var ev []interface{}
+	if err := json.Unmarshal(bs.Bytes(), &ev); err != nil {
+		t.Fatal(err)
+	}
+	if len(ev) != 3 || ev[1] != "o" || ev[2] != "hello\r\n" {
+		t.Errorf("bad event %q", bs.Bytes())
+	}
+}
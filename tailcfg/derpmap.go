@@ -14,6 +14,12 @@ type DERPMap struct {
 	//
 	// The numbers are not necessarily contiguous.
 	Regions map[int]*DERPRegion
+
+	// OmitDefaultRegions, in a DERP map supplied locally to
+	// tailscaled, specifies that the regions from the control
+	// server aren't used, only the ones in this map. Control
+	// servers don't set it.
+	OmitDefaultRegions bool `json:",omitempty"`
 }
 
 /// RegionIDs returns the sorted region IDs.
@@ -4,7 +4,7 @@
 
 package tailcfg
 
-//go:generate go run tailscale.com/cmd/cloner --type=User,Node,Hostinfo,NetInfo,Group,Role,Capability,Login,DNSConfig,RegisterResponse --clonefunc=true --output=tailcfg_clone.go
+//go:generate go run tailscale.com/cmd/cloner --type=User,Node,Hostinfo,NetInfo,Group,Role,Capability,Login,DNSConfig,RegisterResponse,AuthKeyInfo --clonefunc=true --output=tailcfg_clone.go
 
 import (
 	"bytes"
@@ -139,6 +139,7 @@ type Node struct {
 	ID         NodeID
 	Name       string // DNS
 	User       UserID
+	Tags       []string `json:",omitempty"` // ACL tags, which own the node in place of User if set
 	Key        NodeKey
 	KeyExpiry  time.Time
 	Machine    MachineKey
@@ -151,9 +152,22 @@ type Node struct {
 	Created    time.Time
 	LastSeen   *time.Time `json:",omitempty"`
 
+	// Online is whether the node is connected to the control
+	// server, or nil if the control server doesn't say.
+	Online *bool `json:",omitempty"`
+
 	KeepAlive bool `json:",omitempty"` // open and keep open a connection to this peer
 
+	// RelayOnly is whether this peer is only to be reached through
+	// DERP: no direct path to it is tried or accepted.
+	RelayOnly bool `json:",omitempty"`
+
 	MachineAuthorized bool `json:",omitempty"` // TODO(crawshaw): replace with MachineStatus
+
+	// KeySignature, if non-empty, is a network lock signing key's
+	// signature of Key, as submitted in a TKASignRequest. Nodes with
+	// network lock enabled only accept peers with a valid one.
+	KeySignature string `json:",omitempty"`
 }
 
 type MachineStatus int
@@ -314,6 +328,11 @@ type NetInfo struct {
 	// WorkingUDP is whether UDP works.
 	WorkingUDP opt.Bool
 
+	// NATType classifies the host's IPv4 NAT: "none", "easy",
+	// "hard" or "udp-blocked", as by netcheck.Report.NATType.
+	// Empty means unknown.
+	NATType string `json:",omitempty"`
+
 	// UPnP is whether UPnP appears present on the LAN.
 	// Empty means not checked.
 	UPnP opt.Bool
@@ -354,9 +373,9 @@ func (ni *NetInfo) String() string {
 	if ni == nil {
 		return "NetInfo(nil)"
 	}
-	return fmt.Sprintf("NetInfo{varies=%v hairpin=%v ipv6=%v udp=%v derp=#%v portmap=%v link=%q}",
+	return fmt.Sprintf("NetInfo{varies=%v hairpin=%v ipv6=%v udp=%v nat=%v derp=#%v portmap=%v link=%q}",
 		ni.MappingVariesByDestIP, ni.HairPinning, ni.WorkingIPv6,
-		ni.WorkingUDP, ni.PreferredDERP,
+		ni.WorkingUDP, ni.NATType, ni.PreferredDERP,
 		ni.portMapSummary(),
 		ni.LinkType)
 }
@@ -395,6 +414,7 @@ func (ni *NetInfo) BasicallyEqual(ni2 *NetInfo) bool {
 		ni.HairPinning == ni2.HairPinning &&
 		ni.WorkingIPv6 == ni2.WorkingIPv6 &&
 		ni.WorkingUDP == ni2.WorkingUDP &&
+		ni.NATType == ni2.NATType &&
 		ni.UPnP == ni2.UPnP &&
 		ni.PMP == ni2.PMP &&
 		ni.PCP == ni2.PCP &&
@@ -432,6 +452,12 @@ type RegisterRequest struct {
 	Expiry   time.Time // requested key expiry, server policy may override
 	Followup string    // response waits until AuthURL is visited
 	Hostinfo *Hostinfo
+
+	// Ephemeral is whether the node should be deleted when it
+	// logs out or goes offline, rather than kept for it to come
+	// back later. It's used by short-lived nodes that don't keep
+	// their keys, such as CI runners and containers.
+	Ephemeral bool `json:",omitempty"`
 }
 
 // Clone makes a deep copy of RegisterRequest.
@@ -458,6 +484,37 @@ type RegisterResponse struct {
 	NodeKeyExpired    bool   // if true, the NodeKey needs to be replaced
 	MachineAuthorized bool   // TODO(crawshaw): move to using MachineStatus
 	AuthURL           string // if set, authorization pending
+
+	// AuthKey, if non-nil, describes the auth key the node
+	// registered with.
+	AuthKey *AuthKeyInfo `json:",omitempty"`
+
+	// Error, if non-empty, is why the registration was refused,
+	// such as an invalid or already used auth key. The client
+	// should show it to the user rather than retry.
+	Error string `json:",omitempty"`
+}
+
+// AuthKeyInfo describes the properties of an auth key.
+type AuthKeyInfo struct {
+	// Reusable is whether the key can register more than one
+	// node. A single-use key is consumed by registering with it.
+	Reusable bool `json:",omitempty"`
+
+	// Ephemeral is whether nodes registered with the key are
+	// ephemeral (see RegisterRequest.Ephemeral).
+	Ephemeral bool `json:",omitempty"`
+
+	// Preauthorized is whether nodes registered with the key are
+	// authorized without an admin approving them.
+	Preauthorized bool `json:",omitempty"`
+
+	// Tags are the ACL tags nodes registered with the key get, in
+	// place of being owned by the key's creator.
+	Tags []string `json:",omitempty"`
+
+	// Expires is when the key stops being valid, if it does.
+	Expires time.Time `json:",omitempty"`
 }
 
 // MapRequest is sent by a client to start a long-poll network map updates.
@@ -477,6 +534,7 @@ type MapRequest struct {
 	//     4: opt-in keep-alives via KeepAlive field, opt-in compression via Compress
 	//     5: 2020-10-19, implies IncludeIPv6, delta Peers/UserProfiles, supports MagicDNS
 	//     6: 2020-12-07: means MapResponse.PacketFilter nil means unchanged
+	//     7: 2020-12-15: supports MapResponse.PeersChangedPatch
 	Version     int
 	Compress    string // "zstd" or "" (no compression)
 	KeepAlive   bool   // whether server should send keep-alives back to us
@@ -501,6 +559,12 @@ type MapRequest struct {
 	// start up using ReadOnly to get the DERP map.)
 	OmitPeers bool `json:",omitempty"`
 
+	// GoingOffline is whether the node is about to shut down on
+	// purpose. The control server can then fail its routes over
+	// and tell peers it's offline right away, rather than when its
+	// long poll times out. Such a request is not a long poll.
+	GoingOffline bool `json:",omitempty"`
+
 	// DebugFlags is a list of strings specifying debugging and
 	// development features to enable in handling this map
 	// request. The values are deliberately unspecified, as they get
@@ -586,6 +650,81 @@ type DNSConfig struct {
 	// Proxied indicates whether DNS requests are proxied through a tsdns.Resolver.
 	// This enables Magic DNS. It is togglable independently of PerDomain.
 	Proxied bool
+	// CertDomains are the DNS names of this node for which it may
+	// request TLS certificates, completing the ACME DNS-01
+	// challenges with SetDNSRequest.
+	CertDomains []string `json:",omitempty"`
+}
+
+// SetDNSRequest is a request to add a DNS record.
+//
+// It's used for ACME DNS-01 challenges, so nodes can get TLS
+// certificates for their names in CertDomains.
+//
+// The request is encoded to JSON, encrypted with golang.org/x/crypto/nacl/box,
+// using the local machine key, and sent to:
+//	https://login.tailscale.com/machine/<mkey hex>/set-dns
+type SetDNSRequest struct {
+	// Version is the client's MapRequest.Version.
+	Version int
+
+	NodeKey NodeKey
+
+	// Name is the domain name for which to create a record,
+	// such as "_acme-challenge.foo.bar.beta.tailscale.net".
+	Name string
+
+	// Type is the DNS record type. Only "TXT" is supported.
+	Type string
+
+	// Value is the record's value.
+	Value string
+}
+
+// TKASignRequest is sent by a node holding a network lock signing
+// key, so that the control server attaches the signature of another
+// node's key to that node's Node.KeySignature.
+//
+// The request is encoded to JSON, encrypted with golang.org/x/crypto/nacl/box,
+// using the local machine key, and sent to:
+//
+//	https://login.tailscale.com/machine/<mkey hex>/tka-sign
+type TKASignRequest struct {
+	// Version is the client's MapRequest.Version.
+	Version int
+
+	// NodeKey is the key of the node sending the request.
+	NodeKey NodeKey
+
+	// SignedKey is the node key that Signature signs.
+	SignedKey NodeKey
+
+	// Signature is the signature, in the form of
+	// Node.KeySignature.
+	Signature string
+}
+
+// PeerChange is an update to a single peer's Node, sent in
+// MapResponse.PeersChangedPatch. Only the non-nil (or non-zero)
+// fields changed; the rest of the Node stays as it was.
+type PeerChange struct {
+	// NodeID is the peer to change.
+	NodeID NodeID
+
+	// DERPRegion, if non-zero, is the peer's new home DERP region.
+	DERPRegion int `json:",omitempty"`
+
+	// Endpoints, if non-nil, replaces the peer's Endpoints.
+	Endpoints []string `json:",omitempty"`
+
+	// DiscoKey, if non-nil, is the peer's new discovery key.
+	DiscoKey *DiscoKey `json:",omitempty"`
+
+	// LastSeen, if non-nil, is when the peer was last online.
+	LastSeen *time.Time `json:",omitempty"`
+
+	// Online, if non-nil, is whether the peer is now online.
+	Online *bool `json:",omitempty"`
 }
 
 type MapResponse struct {
@@ -610,6 +749,12 @@ type MapResponse struct {
 	PeersChanged []*Node `json:",omitempty"`
 	// PeersRemoved are the NodeIDs that are no longer in the peer list.
 	PeersRemoved []NodeID `json:",omitempty"`
+	// PeersChangedPatch, if non-nil, are small changes to peers
+	// that the client already has, sent instead of the whole Node
+	// in PeersChanged. A peer appears at most once in
+	// PeersChanged and PeersChangedPatch combined. It's not used
+	// by the server if MapRequest.Version < 7.
+	PeersChangedPatch []*PeerChange `json:",omitempty"`
 
 	// DNS is the same as DNSConfig.Nameservers.
 	//
@@ -643,11 +788,73 @@ type MapResponse struct {
 	// TODO: Groups       []Group
 	// TODO: Capabilities []Capability
 
+	// KeyAuthority, if non-nil, is the chain of network lock
+	// updates (tka.AUMs, each in its encoded form) the control server
+	// holds for the tailnet, in order. Nodes with network lock enabled
+	// apply those they haven't yet, if signed by a trusted key.
+	KeyAuthority []string `json:",omitempty"`
+
+	// KeyRenewal is whether the control server accepts a new node
+	// key from this node before its current one expires without the
+	// user logging in again.
+	KeyRenewal bool `json:",omitempty"`
+
+	// SSHPolicy, if non-nil, is the tailnet's policy for which local
+	// users its users may log in as over the node's SSH server. A
+	// nil value means the most recent non-nil one within the same
+	// HTTP response; without any, nobody may log in.
+	SSHPolicy *SSHPolicy `json:",omitempty"`
+
 	// Debug is normally nil, except for when the control server
 	// is setting debug settings on a node.
 	Debug *Debug `json:",omitempty"`
 }
 
+// SSHPolicy maps the tailnet's users to the local users they may log
+// in as over a node's SSH server.
+type SSHPolicy struct {
+	// Rules grant logins. A login is allowed if any rule grants it.
+	Rules []*SSHRule `json:",omitempty"`
+}
+
+// SSHRule lets some of the tailnet's users log in as some local
+// users.
+type SSHRule struct {
+	// Principals are the login names (as in UserProfile.LoginName)
+	// of the users the rule applies to. "*" matches every user.
+	Principals []string
+
+	// LocalUsers are the local users that Principals may log in as.
+	// "*" matches every local user but root, which is only granted
+	// by naming it.
+	LocalUsers []string
+}
+
+// AllowsLogin reports whether p lets the tailnet user loginName log
+// in as the local user localUser.
+func (p *SSHPolicy) AllowsLogin(loginName, localUser string) bool {
+	if p == nil || loginName == "" || localUser == "" {
+		return false
+	}
+	for _, r := range p.Rules {
+		if r != nil && sshRuleMatch(r.Principals, loginName, "") && sshRuleMatch(r.LocalUsers, localUser, "root") {
+			return true
+		}
+	}
+	return false
+}
+
+// sshRuleMatch reports whether list names s, or has a "*" and s isn't
+// notWild.
+func sshRuleMatch(list []string, s, notWild string) bool {
+	for _, v := range list {
+		if v == s || (v == "*" && s != notWild) {
+			return true
+		}
+	}
+	return false
+}
+
 // Debug are instructions from the control server to the client
 // to adjust debug settings.
 type Debug struct {
@@ -676,6 +883,12 @@ type Debug struct {
 	// wireguard configuration of peers.
 	TrimWGConfig opt.Bool `json:",omitempty"`
 
+	// LazyPeerIdleSeconds, if non-zero, is how long a peer may go
+	// without traffic before it's removed from the on-demand
+	// wireguard configuration (see TrimWGConfig), overriding the
+	// client's default.
+	LazyPeerIdleSeconds int `json:",omitempty"`
+
 	// DisableSubnetsIfPAC controls whether subnet routers should be
 	// disabled if WPAD is present on the network.
 	DisableSubnetsIfPAC opt.Bool `json:",omitempty"`
@@ -741,6 +954,7 @@ func (n *Node) Equal(n2 *Node) bool {
 		n.ID == n2.ID &&
 		n.Name == n2.Name &&
 		n.User == n2.User &&
+		eqStrings(n.Tags, n2.Tags) &&
 		n.Key == n2.Key &&
 		n.KeyExpiry.Equal(n2.KeyExpiry) &&
 		n.Machine == n2.Machine &&
@@ -752,7 +966,10 @@ func (n *Node) Equal(n2 *Node) bool {
 		n.Hostinfo.Equal(&n2.Hostinfo) &&
 		n.Created.Equal(n2.Created) &&
 		eqTimePtr(n.LastSeen, n2.LastSeen) &&
-		n.MachineAuthorized == n2.MachineAuthorized
+		eqBoolPtr(n.Online, n2.Online) &&
+		n.RelayOnly == n2.RelayOnly &&
+		n.MachineAuthorized == n2.MachineAuthorized &&
+		n.KeySignature == n2.KeySignature
 }
 
 func eqStrings(a, b []string) bool {
@@ -782,3 +999,7 @@ func eqCIDRs(a, b []wgcfg.CIDR) bool {
 func eqTimePtr(a, b *time.Time) bool {
 	return ((a == nil) == (b == nil)) && (a == nil || a.Equal(*b))
 }
+
+func eqBoolPtr(a, b *bool) bool {
+	return ((a == nil) == (b == nil)) && (a == nil || *a == *b)
+}
@@ -187,7 +187,7 @@ func TestHostinfoEqual(t *testing.T) {
 }
 
 func TestNodeEqual(t *testing.T) {
-	nodeHandles := []string{"ID", "Name", "User", "Key", "KeyExpiry", "Machine", "DiscoKey", "Addresses", "AllowedIPs", "Endpoints", "DERP", "Hostinfo", "Created", "LastSeen", "KeepAlive", "MachineAuthorized"}
+	nodeHandles := []string{"ID", "Name", "User", "Tags", "Key", "KeyExpiry", "Machine", "DiscoKey", "Addresses", "AllowedIPs", "Endpoints", "DERP", "Hostinfo", "Created", "LastSeen", "Online", "KeepAlive", "RelayOnly", "MachineAuthorized", "KeySignature"}
 	if have := fieldsOf(reflect.TypeOf(Node{})); !reflect.DeepEqual(have, nodeHandles) {
 		t.Errorf("Node.Equal check might be out of sync\nfields: %q\nhandled: %q\n",
 			have, nodeHandles)
@@ -203,6 +203,7 @@ func TestNodeEqual(t *testing.T) {
 	}
 	n1 := newPublicKey(t)
 	now := time.Now()
+	yes, no := true, false
 
 	tests := []struct {
 		a, b *Node
@@ -233,6 +234,16 @@ func TestNodeEqual(t *testing.T) {
 			&Node{User: 1},
 			true,
 		},
+		{
+			&Node{Tags: []string{"tag:server"}},
+			&Node{Tags: []string{"tag:prod"}},
+			false,
+		},
+		{
+			&Node{Tags: []string{"tag:server"}},
+			&Node{Tags: []string{"tag:server"}},
+			true,
+		},
 		{
 			&Node{Key: NodeKey(n1)},
 			&Node{Key: NodeKey(newPublicKey(t))},
@@ -323,11 +334,31 @@ func TestNodeEqual(t *testing.T) {
 			&Node{LastSeen: &now},
 			true,
 		},
+		{
+			&Node{Online: &yes},
+			&Node{Online: nil},
+			false,
+		},
+		{
+			&Node{Online: &yes},
+			&Node{Online: &no},
+			false,
+		},
+		{
+			&Node{Online: &no},
+			&Node{Online: new(bool)},
+			true,
+		},
 		{
 			&Node{DERP: "foo"},
 			&Node{DERP: "bar"},
 			false,
 		},
+		{
+			&Node{RelayOnly: true},
+			&Node{},
+			false,
+		},
 	}
 	for i, tt := range tests {
 		got := tt.a.Equal(tt.b)
@@ -343,6 +374,7 @@ func TestNetInfoFields(t *testing.T) {
 		"HairPinning",
 		"WorkingIPv6",
 		"WorkingUDP",
+		"NATType",
 		"UPnP",
 		"PMP",
 		"PCP",
@@ -0,0 +1,367 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package tka implements the tailnet key authority behind network
+// lock: a set of trusted signing keys, changed only by updates signed
+// with one of them, that must sign a node's key before other locked
+// nodes accept it as a peer. The control server relays updates and
+// signatures but, holding no signing key, can't forge either.
+package tka
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"tailscale.com/atomicfile"
+	"tailscale.com/tailcfg"
+)
+
+// Key is the public half of an ed25519 signing key.
+type Key [ed25519.PublicKeySize]byte
+
+const keyPrefix = "tlpub:"
+
+func (k Key) String() string { return keyPrefix + hex.EncodeToString(k[:]) }
+
+func (k Key) MarshalText() ([]byte, error) { return []byte(k.String()), nil }
+
+func (k *Key) UnmarshalText(text []byte) error {
+	pk, err := ParseKey(string(text))
+	if err != nil {
+		return err
+	}
+	*k = pk
+	return nil
+}
+
+// ParseKey parses a Key in its "tlpub:<hex>" form.
+func ParseKey(s string) (Key, error) {
+	var k Key
+	if !strings.HasPrefix(s, keyPrefix) {
+		return k, fmt.Errorf("key %q: missing %q prefix", s, keyPrefix)
+	}
+	b, err := hex.DecodeString(s[len(keyPrefix):])
+	if err != nil || len(b) != len(k) {
+		return k, fmt.Errorf("key %q: want %d hex bytes", s, len(k))
+	}
+	copy(k[:], b)
+	return k, nil
+}
+
+// NewPrivateKey returns a new random signing key.
+func NewPrivateKey() ed25519.PrivateKey {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err) // only if crypto/rand fails
+	}
+	return priv
+}
+
+// PublicKey returns the Key of the signing key priv.
+func PublicKey(priv ed25519.PrivateKey) Key {
+	var k Key
+	copy(k[:], priv.Public().(ed25519.PublicKey))
+	return k
+}
+
+// AUMHash is the hash identifying an AUM.
+type AUMHash [sha256.Size]byte
+
+func (h AUMHash) String() string { return hex.EncodeToString(h[:]) }
+
+func (h AUMHash) IsZero() bool { return h == AUMHash{} }
+
+func (h AUMHash) MarshalText() ([]byte, error) { return []byte(h.String()), nil }
+
+func (h *AUMHash) UnmarshalText(text []byte) error {
+	b, err := hex.DecodeString(string(text))
+	if err != nil || len(b) != len(h) {
+		return fmt.Errorf("invalid AUM hash %q", text)
+	}
+	copy(h[:], b)
+	return nil
+}
+
+// AUMKind is the kind of an AUM.
+type AUMKind string
+
+const (
+	// AUMGenesis starts an authority trusting its Keys. It's not
+	// signed: nodes trust it because their owner initialized the
+	// lock with it.
+	AUMGenesis AUMKind = "genesis"
+	// AUMAddKey trusts its one key too.
+	AUMAddKey AUMKind = "add-key"
+	// AUMRemoveKey stops trusting its one key.
+	AUMRemoveKey AUMKind = "remove-key"
+)
+
+// An AUM (authority update message) changes the trusted keys. Each
+// but the genesis one follows the AUM whose hash is its Prev, and
+// must be signed by a key trusted after that one.
+type AUM struct {
+	Kind       AUMKind        `json:"kind"`
+	Prev       AUMHash        `json:"prev"` // zero for AUMGenesis
+	Keys       []Key          `json:"keys"`
+	Signatures []AUMSignature `json:"signatures,omitempty"`
+}
+
+// AUMSignature is the signature of an AUM's hash by Key.
+type AUMSignature struct {
+	Key       Key    `json:"key"`
+	Signature []byte `json:"signature"`
+}
+
+// Genesis returns the genesis AUM of an authority trusting keys.
+// Every node given the same keys gets the same AUM, so later updates
+// apply on all of them.
+func Genesis(keys []Key) AUM {
+	keys = append([]Key(nil), keys...)
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i][:], keys[j][:]) < 0 })
+	return AUM{Kind: AUMGenesis, Keys: keys}
+}
+
+// Hash returns the hash of a, which doesn't cover its signatures.
+func (a AUM) Hash() AUMHash {
+	a.Signatures = nil
+	b, err := json.Marshal(a)
+	if err != nil {
+		panic(err) // can't happen
+	}
+	return sha256.Sum256(b)
+}
+
+// Sign adds a signature of a by priv.
+func (a *AUM) Sign(priv ed25519.PrivateKey) {
+	h := a.Hash()
+	a.Signatures = append(a.Signatures, AUMSignature{
+		Key:       PublicKey(priv),
+		Signature: ed25519.Sign(priv, h[:]),
+	})
+}
+
+// Encode returns a in the base64 form in which the control server
+// relays it.
+func (a AUM) Encode() string {
+	b, err := json.Marshal(a)
+	if err != nil {
+		panic(err) // can't happen
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// DecodeAUM decodes an AUM from the form returned by Encode.
+func DecodeAUM(s string) (AUM, error) {
+	var a AUM
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return a, fmt.Errorf("AUM: %v", err)
+	}
+	if err := json.Unmarshal(b, &a); err != nil {
+		return a, fmt.Errorf("AUM: %v", err)
+	}
+	return a, nil
+}
+
+// Authority is the state of a tailnet key authority: the chain of
+// AUMs applied since the genesis one, and the keys they leave trusted.
+type Authority struct {
+	chain []AUM
+	head  AUMHash
+	keys  map[Key]bool
+}
+
+// New returns the authority started by the genesis AUM g.
+func New(g AUM) (*Authority, error) {
+	if g.Kind != AUMGenesis || !g.Prev.IsZero() {
+		return nil, errors.New("not a genesis AUM")
+	}
+	if len(g.Keys) == 0 {
+		return nil, errors.New("genesis AUM trusts no keys")
+	}
+	a := &Authority{keys: make(map[Key]bool)}
+	for _, k := range g.Keys {
+		a.keys[k] = true
+	}
+	a.chain = []AUM{g}
+	a.head = g.Hash()
+	return a, nil
+}
+
+// Head returns the hash of the last AUM applied.
+func (a *Authority) Head() AUMHash { return a.head }
+
+// Keys returns the trusted keys, sorted.
+func (a *Authority) Keys() []Key {
+	ret := make([]Key, 0, len(a.keys))
+	for k := range a.keys {
+		ret = append(ret, k)
+	}
+	sort.Slice(ret, func(i, j int) bool { return bytes.Compare(ret[i][:], ret[j][:]) < 0 })
+	return ret
+}
+
+// Trusted reports whether k is a trusted key.
+func (a *Authority) Trusted(k Key) bool { return a.keys[k] }
+
+// Apply applies the AUM u, which must follow the head and be signed
+// by a trusted key.
+func (a *Authority) Apply(u AUM) error {
+	if u.Prev != a.head {
+		return fmt.Errorf("AUM follows %v, not the head %v", u.Prev, a.head)
+	}
+	if err := a.verify(u); err != nil {
+		return err
+	}
+	if len(u.Keys) != 1 {
+		return fmt.Errorf("%s AUM has %d keys; want 1", u.Kind, len(u.Keys))
+	}
+	k := u.Keys[0]
+	switch u.Kind {
+	case AUMAddKey:
+		a.keys[k] = true
+	case AUMRemoveKey:
+		if !a.keys[k] {
+			return fmt.Errorf("removing %v, which isn't trusted", k)
+		}
+		if len(a.keys) == 1 {
+			return fmt.Errorf("removing %v, the last trusted key", k)
+		}
+		delete(a.keys, k)
+	default:
+		return fmt.Errorf("unexpected AUM kind %q", u.Kind)
+	}
+	a.chain = append(a.chain, u)
+	a.head = u.Hash()
+	return nil
+}
+
+// verify reports an error unless u is signed by a trusted key.
+func (a *Authority) verify(u AUM) error {
+	h := u.Hash()
+	for _, s := range u.Signatures {
+		if a.keys[s.Key] && ed25519.Verify(s.Key[:], h[:], s.Signature) {
+			return nil
+		}
+	}
+	return errors.New("AUM not signed by a trusted key")
+}
+
+// Sync applies the updates in chain, a run of AUMs in order that may
+// start with ones already applied, as relayed by the control server.
+// It returns how many it applied. On error, those before the failing
+// one stay applied.
+func (a *Authority) Sync(chain []AUM) (applied int, err error) {
+	have := make(map[AUMHash]bool, len(a.chain))
+	for _, u := range a.chain {
+		have[u.Hash()] = true
+	}
+	for _, u := range chain {
+		if have[u.Hash()] {
+			continue
+		}
+		if err := a.Apply(u); err != nil {
+			return applied, err
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+// nodeKeySigPrefix is prepended to node keys before signing them, so
+// their signatures can't be mistaken for those of AUMs.
+const nodeKeySigPrefix = "tka-node-key-v1:"
+
+// NodeKeySignature is a trusted key's signature of a node key.
+type NodeKeySignature struct {
+	NodeKey   tailcfg.NodeKey `json:"nodeKey"`
+	Key       Key             `json:"key"`
+	Signature []byte          `json:"signature"`
+}
+
+// SignNodeKey signs nk with priv, returning the signature in the
+// base64 form carried in tailcfg.Node.KeySignature.
+func SignNodeKey(priv ed25519.PrivateKey, nk tailcfg.NodeKey) string {
+	s := NodeKeySignature{
+		NodeKey:   nk,
+		Key:       PublicKey(priv),
+		Signature: ed25519.Sign(priv, append([]byte(nodeKeySigPrefix), nk[:]...)),
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		panic(err) // can't happen
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// VerifyNodeKey reports an error unless sig, as returned by
+// SignNodeKey, is a trusted key's signature of nk.
+func (a *Authority) VerifyNodeKey(nk tailcfg.NodeKey, sig string) error {
+	if sig == "" {
+		return errors.New("node key not signed")
+	}
+	b, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("node key signature: %v", err)
+	}
+	var s NodeKeySignature
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("node key signature: %v", err)
+	}
+	if s.NodeKey != nk {
+		return errors.New("node key signature is for another key")
+	}
+	if !a.keys[s.Key] {
+		return fmt.Errorf("node key signed by %v, which isn't trusted", s.Key)
+	}
+	if !ed25519.Verify(s.Key[:], append([]byte(nodeKeySigPrefix), nk[:]...), s.Signature) {
+		return errors.New("invalid node key signature")
+	}
+	return nil
+}
+
+// Load reads the authority saved at path by Save, checking each AUM
+// again.
+func Load(path string) (*Authority, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var chain []AUM
+	if err := json.Unmarshal(b, &chain); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("%s: no genesis AUM", path)
+	}
+	a, err := New(chain[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, u := range chain[1:] {
+		if err := a.Apply(u); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return a, nil
+}
+
+// Save writes the authority's chain of AUMs to path.
+func (a *Authority) Save(path string) error {
+	b, err := json.MarshalIndent(a.chain, "", "\t")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, b, 0600)
+}
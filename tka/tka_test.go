@@ -0,0 +1,122 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tka
+
+import (
+	"crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestAuthority(t *testing.T) {
+	k1, k2, k3 := NewPrivateKey(), NewPrivateKey(), NewPrivateKey()
+	a, err := New(Genesis([]Key{PublicKey(k1)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := func(kind AUMKind, k Key, signer ...ed25519.PrivateKey) AUM {
+		u := AUM{Kind: kind, Prev: a.Head(), Keys: []Key{k}}
+		for _, priv := range signer {
+			u.Sign(priv)
+		}
+		return u
+	}
+
+	// Only a trusted key can add another.
+	if err := a.Apply(update(AUMAddKey, PublicKey(k3), k3)); err == nil {
+		t.Error("applied AUM signed by untrusted key")
+	}
+	if err := a.Apply(update(AUMAddKey, PublicKey(k2))); err == nil {
+		t.Error("applied unsigned AUM")
+	}
+	add := update(AUMAddKey, PublicKey(k2), k1)
+	if err := a.Apply(add); err != nil {
+		t.Fatal(err)
+	}
+	if !a.Trusted(PublicKey(k2)) {
+		t.Error("k2 not trusted after adding it")
+	}
+	if err := a.Apply(add); err == nil {
+		t.Error("applied AUM twice")
+	}
+
+	// Node keys verify only while their signer is trusted.
+	nk := tailcfg.NodeKey{1}
+	sig := SignNodeKey(k2, nk)
+	if err := a.VerifyNodeKey(nk, sig); err != nil {
+		t.Errorf("VerifyNodeKey: %v", err)
+	}
+	if err := a.VerifyNodeKey(tailcfg.NodeKey{2}, sig); err == nil {
+		t.Error("verified signature of another node key")
+	}
+	if err := a.VerifyNodeKey(nk, SignNodeKey(k3, nk)); err == nil {
+		t.Error("verified node key signed by untrusted key")
+	}
+	if err := a.VerifyNodeKey(nk, ""); err == nil {
+		t.Error("verified unsigned node key")
+	}
+	remove := update(AUMRemoveKey, PublicKey(k2), k1)
+	if err := a.Apply(remove); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.VerifyNodeKey(nk, sig); err == nil {
+		t.Error("verified node key signed by removed key")
+	}
+	if err := a.Apply(update(AUMRemoveKey, PublicKey(k1), k1)); err == nil {
+		t.Error("removed the last trusted key")
+	}
+
+	// Another node syncs the chain relayed by control, and saves it.
+	b, err := New(Genesis([]Key{PublicKey(k1)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := []AUM{Genesis([]Key{PublicKey(k1)}), add, remove}
+	if n, err := b.Sync(chain); n != 2 || err != nil {
+		t.Fatalf("Sync = %d, %v; want 2, nil", n, err)
+	}
+	if n, err := b.Sync(chain); n != 0 || err != nil {
+		t.Fatalf("second Sync = %d, %v; want 0, nil", n, err)
+	}
+	if b.Head() != a.Head() {
+		t.Errorf("head after Sync = %v; want %v", b.Head(), a.Head())
+	}
+
+	dir, err := ioutil.TempDir("", "tka")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	if err := b.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Head() != a.Head() || len(c.Keys()) != 1 || !c.Trusted(PublicKey(k1)) {
+		t.Errorf("loaded head %v, keys %v; want %v, [%v]", c.Head(), c.Keys(), a.Head(), PublicKey(k1))
+	}
+}
+
+func TestEncodeAUM(t *testing.T) {
+	u := AUM{Kind: AUMAddKey, Prev: AUMHash{1}, Keys: []Key{{2}}}
+	u.Sign(NewPrivateKey())
+	got, err := DecodeAUM(u.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Hash() != u.Hash() || len(got.Signatures) != 1 {
+		t.Errorf("DecodeAUM = %+v; want %+v", got, u)
+	}
+	if _, err := ParseKey(PublicKey(NewPrivateKey()).String()); err != nil {
+		t.Errorf("ParseKey: %v", err)
+	}
+}
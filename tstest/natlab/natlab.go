@@ -105,6 +105,15 @@ type Network struct {
 	Prefix4 netaddr.IPPrefix
 	Prefix6 netaddr.IPPrefix
 
+	// Latency is how long packets take to cross the network.
+	Latency time.Duration
+	// Jitter, if non-zero, adds a random extra delay of up to
+	// Jitter to each packet, which may reorder them.
+	Jitter time.Duration
+	// LossRate is the fraction of packets, from 0 to 1, that the
+	// network drops at random.
+	LossRate float64
+
 	mu        sync.Mutex
 	machine   map[netaddr.IP]*Interface
 	defaultGW *Interface // optional
@@ -203,13 +212,32 @@ func (n *Network) write(p *Packet) (num int, err error) {
 		iface = n.defaultGW
 	}
 
+	if n.LossRate > 0 && rand.Float64() < n.LossRate {
+		// Lost packets still count as sent, as on a real network.
+		p.Trace("dropped, simulated loss")
+		return len(p.Payload), nil
+	}
+
 	// Pretend it went across the network. Make a copy so nobody
 	// can later mess with caller's memory.
 	p.Trace("-> mach=%s if=%s", iface.machine.Name, iface.name)
-	go iface.machine.deliverIncomingPacket(p, iface)
+	if delay := n.delay(); delay > 0 {
+		time.AfterFunc(delay, func() { iface.machine.deliverIncomingPacket(p, iface) })
+	} else {
+		go iface.machine.deliverIncomingPacket(p, iface)
+	}
 	return len(p.Payload), nil
 }
 
+// delay returns how long the next packet takes to cross n.
+func (n *Network) delay() time.Duration {
+	d := n.Latency
+	if n.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(n.Jitter)))
+	}
+	return d
+}
+
 type Interface struct {
 	machine *Machine
 	net     *Network
@@ -81,6 +81,57 @@ func TestSendPacket(t *testing.T) {
 	}
 }
 
+func TestLatencyAndLoss(t *testing.T) {
+	internet := NewInternet()
+	internet.Latency = 50 * time.Millisecond
+
+	foo := &Machine{Name: "foo"}
+	bar := &Machine{Name: "bar"}
+	foo.Attach("eth0", internet)
+	ifBar := bar.Attach("eth0", internet)
+
+	ctx := context.Background()
+	fooPC, err := foo.ListenPacket(ctx, "udp4", ":123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	barPC, err := bar.ListenPacket(ctx, "udp4", ":456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	barAddr := netaddr.IPPort{IP: ifBar.V4(), Port: 456}
+
+	start := time.Now()
+	if _, err := fooPC.WriteTo([]byte("slow"), barAddr.UDPAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, _, err := barPC.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < internet.Latency {
+		t.Errorf("packet %q arrived after %v; want at least %v", buf[:n], d, internet.Latency)
+	}
+
+	internet.Latency = 0
+	internet.LossRate = 1
+	if _, err := fooPC.WriteTo([]byte("lost"), barAddr.UDPAddr()); err != nil {
+		t.Fatal(err)
+	}
+	internet.LossRate = 0
+	if _, err := fooPC.WriteTo([]byte("found"), barAddr.UDPAddr()); err != nil {
+		t.Fatal(err)
+	}
+	n, _, err = barPC.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "found" {
+		t.Errorf("read %q; want %q", got, "found")
+	}
+}
+
 func TestMultiNetwork(t *testing.T) {
 	lan := &Network{
 		Name:    "lan",
@@ -43,7 +43,7 @@ func registerCommonDebug(mux *http.ServeMux) {
 	expvar.Publish("counter_uptime_sec", expvar.Func(func() interface{} { return int64(Uptime().Seconds()) }))
 	mux.Handle("/debug/pprof/", Protected(http.DefaultServeMux)) // to net/http/pprof
 	mux.Handle("/debug/vars", Protected(http.DefaultServeMux))   // to expvar
-	mux.Handle("/debug/varz", Protected(http.HandlerFunc(varzHandler)))
+	mux.Handle("/debug/varz", Protected(http.HandlerFunc(VarzHandler)))
 	mux.Handle("/debug/gc", Protected(http.HandlerFunc(gcHandler)))
 }
 
@@ -371,7 +371,7 @@ func Error(code int, msg string, err error) HTTPError {
 	return HTTPError{Code: code, Msg: msg, Err: err}
 }
 
-// varzHandler is an HTTP handler to write expvar values into the
+// VarzHandler is an HTTP handler to write expvar values into the
 // prometheus export format:
 //
 //   https://github.com/prometheus/docs/blob/master/content/docs/instrumenting/exposition_formats.md
@@ -384,11 +384,11 @@ func Error(code int, msg string, err error) HTTPError {
 //   * an expvar named starting with "gauge_" or "counter_" is of that
 //     Prometheus type, and has that prefix stripped.
 //   * anything else is untyped and thus not exported.
-//   * expvar.Func can return an int or int64 (for now) and anything else
-//     is not exported.
+//   * expvar.Func can return an int, int64 or *metrics.LabelMap (for
+//     now) and anything else is not exported.
 //
 // This will evolve over time, or perhaps be replaced.
-func varzHandler(w http.ResponseWriter, r *http.Request) {
+func VarzHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
 
 	var dump func(prefix string, kv expvar.KeyValue)
@@ -437,20 +437,17 @@ func varzHandler(w http.ResponseWriter, r *http.Request) {
 		switch v := kv.Value.(type) {
 		case expvar.Func:
 			val := v()
-			switch val.(type) {
+			switch val := val.(type) {
 			case int64, int:
 				fmt.Fprintf(w, "# TYPE %s %s\n%s %v\n", name, typ, name, val)
+			case *metrics.LabelMap:
+				writeLabelMap(w, name, typ, val)
 			default:
 				fmt.Fprintf(w, "# skipping expvar func %q returning unknown type %T\n", name, val)
 			}
 
 		case *metrics.LabelMap:
-			fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
-			// IntMap uses expvar.Map on the inside, which presorts
-			// keys. The output ordering is deterministic.
-			v.Do(func(kv expvar.KeyValue) {
-				fmt.Fprintf(w, "%s{%s=%q} %v\n", name, v.Label, kv.Key, kv.Value)
-			})
+			writeLabelMap(w, name, typ, v)
 		}
 	}
 	expvar.Do(func(kv expvar.KeyValue) {
@@ -458,6 +455,15 @@ func varzHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func writeLabelMap(w io.Writer, name, typ string, m *metrics.LabelMap) {
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+	// IntMap uses expvar.Map on the inside, which presorts
+	// keys. The output ordering is deterministic.
+	m.Do(func(kv expvar.KeyValue) {
+		fmt.Fprintf(w, "%s{%s=%q} %v\n", name, m.Label, kv.Key, kv.Value)
+	})
+}
+
 func writeMemstats(w io.Writer, ms *runtime.MemStats) {
 	out := func(name, typ string, v uint64, help string) {
 		if help != "" {
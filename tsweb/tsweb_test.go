@@ -8,13 +8,16 @@ import (
 	"bufio"
 	"context"
 	"errors"
+	"expvar"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"tailscale.com/metrics"
 	"tailscale.com/tstest"
 )
 
@@ -302,3 +305,21 @@ func BenchmarkLog(b *testing.B) {
 		h.ServeHTTP(rw, req)
 	}
 }
+
+func TestVarzHandlerLabelMapFunc(t *testing.T) {
+	expvar.Publish("counter_test_varz_client_bytes", expvar.Func(func() interface{} {
+		m := &metrics.LabelMap{Label: "client"}
+		m.Add("b", 2)
+		m.Add("a", 1)
+		return m
+	}))
+	rec := httptest.NewRecorder()
+	VarzHandler(rec, httptest.NewRequest("GET", "/", nil))
+	want := `# TYPE test_varz_client_bytes counter
+test_varz_client_bytes{client="a"} 1
+test_varz_client_bytes{client="b"} 2
+`
+	if got := rec.Body.String(); !strings.Contains(got, want) {
+		t.Errorf("output doesn't contain:\n%s\ngot:\n%s", want, got)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logger
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Level is how much a logging component logs.
+type Level int32
+
+const (
+	// LevelOff discards all of a component's logs.
+	LevelOff Level = -1
+	// LevelInfo is the default: everything but debug logs.
+	LevelInfo Level = 0
+	// LevelDebug adds the debug logs, and lifts some rate limits.
+	LevelDebug Level = 1
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelOff:
+		return "off"
+	case LevelInfo:
+		return "info"
+	case LevelDebug:
+		return "debug"
+	}
+	return fmt.Sprintf("Level(%d)", int32(l))
+}
+
+// ParseLevel parses the name of a Level, as returned by its String
+// method.
+func ParseLevel(s string) (Level, error) {
+	switch s {
+	case "off":
+		return LevelOff, nil
+	case "info":
+		return LevelInfo, nil
+	case "debug":
+		return LevelDebug, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+func (l Level) MarshalText() ([]byte, error) { return []byte(l.String()), nil }
+
+func (l *Level) UnmarshalText(b []byte) error {
+	v, err := ParseLevel(string(b))
+	if err != nil {
+		return err
+	}
+	*l = v
+	return nil
+}
+
+// components maps component names to their *int32 Level, which is
+// accessed atomically. It's read on packet paths, so it's a sync.Map
+// rather than a mutex-guarded map.
+var components sync.Map
+
+// componentLevel returns the level of the named component,
+// registering the component if it's new.
+func componentLevel(name string) *int32 {
+	p, _ := components.LoadOrStore(name, new(int32))
+	return p.(*int32)
+}
+
+// Component returns a Logf for the named component of the program,
+// such as "magicsock", that passes messages on to logf unless the
+// component's level is LevelOff. The level can be changed at run
+// time with SetLevel.
+func Component(logf Logf, name string) Logf {
+	lvl := componentLevel(name)
+	return func(format string, args ...interface{}) {
+		if Level(atomic.LoadInt32(lvl)) > LevelOff {
+			logf(format, args...)
+		}
+	}
+}
+
+// ComponentDebug is like Component, but for the component's debug
+// logs: it only passes messages on at LevelDebug.
+func ComponentDebug(logf Logf, name string) Logf {
+	lvl := componentLevel(name)
+	return func(format string, args ...interface{}) {
+		if Level(atomic.LoadInt32(lvl)) >= LevelDebug {
+			logf(format, args...)
+		}
+	}
+}
+
+// ComponentLevel returns the current level of the named component,
+// LevelInfo if it's unknown.
+func ComponentLevel(name string) Level {
+	p, ok := components.Load(name)
+	if !ok {
+		return LevelInfo
+	}
+	return Level(atomic.LoadInt32(p.(*int32)))
+}
+
+// SetLevel sets the level of the named component, which must have
+// been registered by Component or ComponentDebug.
+func SetLevel(name string, l Level) error {
+	if l < LevelOff || l > LevelDebug {
+		return fmt.Errorf("invalid log level %v", l)
+	}
+	p, ok := components.Load(name)
+	if !ok {
+		return fmt.Errorf("unknown log component %q", name)
+	}
+	atomic.StoreInt32(p.(*int32), int32(l))
+	return nil
+}
+
+// PresetLevel is like SetLevel, but registers the named component if
+// it's new, so that its level can be configured before it starts
+// logging.
+func PresetLevel(name string, l Level) error {
+	if l < LevelOff || l > LevelDebug {
+		return fmt.Errorf("invalid log level %v", l)
+	}
+	atomic.StoreInt32(componentLevel(name), int32(l))
+	return nil
+}
+
+// Levels returns the levels of all registered components.
+func Levels() map[string]Level {
+	m := make(map[string]Level)
+	components.Range(func(k, v interface{}) bool {
+		m[k.(string)] = Level(atomic.LoadInt32(v.(*int32)))
+		return true
+	})
+	return m
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logger
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestComponentLevels(t *testing.T) {
+	var got []string
+	logf := func(format string, args ...interface{}) {
+		got = append(got, fmt.Sprintf(format, args...))
+	}
+	info := Component(logf, "test-component")
+	debug := ComponentDebug(logf, "test-component")
+	defer SetLevel("test-component", LevelInfo)
+
+	info("info 1")
+	debug("debug 1")
+	if err := SetLevel("test-component", LevelDebug); err != nil {
+		t.Fatal(err)
+	}
+	info("info 2")
+	debug("debug 2")
+	if err := SetLevel("test-component", LevelOff); err != nil {
+		t.Fatal(err)
+	}
+	info("info 3")
+	debug("debug 3")
+
+	want := []string{"info 1", "info 2", "debug 2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("logged %q; want %q", got, want)
+	}
+	if l := Levels()["test-component"]; l != LevelOff {
+		t.Errorf("Levels()[test-component] = %v; want off", l)
+	}
+	if err := SetLevel("no-such-component", LevelDebug); err == nil {
+		t.Error("SetLevel of unknown component succeeded")
+	}
+}
+
+func TestPresetLevel(t *testing.T) {
+	if err := PresetLevel("test-preset", LevelDebug); err != nil {
+		t.Fatal(err)
+	}
+	defer SetLevel("test-preset", LevelInfo)
+	var got []string
+	debug := ComponentDebug(func(format string, args ...interface{}) {
+		got = append(got, fmt.Sprintf(format, args...))
+	}, "test-preset")
+	debug("debug")
+	if len(got) != 1 {
+		t.Errorf("logged %q after preset to debug; want the debug log", got)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, l := range []Level{LevelOff, LevelInfo, LevelDebug} {
+		got, err := ParseLevel(l.String())
+		if err != nil || got != l {
+			t.Errorf("ParseLevel(%q) = %v, %v; want %v", l.String(), got, err, l)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("ParseLevel(verbose) succeeded")
+	}
+}
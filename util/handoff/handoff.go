@@ -0,0 +1,236 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+// Package handoff passes open files and state from a running process
+// to its replacement over a unix socket, for in-place upgrades of
+// tailscaled that keep its TUN device and sockets open.
+//
+// The old process listens; the new one connects and receives the
+// state, as JSON, and the files. Once the new process has taken
+// over, it acks, and the old one exits without tearing anything
+// down. The new process waits for the connection to close, as it
+// does when the old process exits, before going on.
+package handoff
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// maxState is the size limit of the state passed.
+const maxState = 4 << 20
+
+// ack is what the new process sends once it's taken over.
+const ack = "ok\n"
+
+// Listener listens for a new process to hand off to.
+type Listener struct {
+	ln   *net.UnixListener
+	path string
+}
+
+// Listen listens on the unix socket path, which only the process's
+// user may connect to.
+//
+// The socket is created in a new directory beside path that only the
+// user can enter, and only moved to path once it's mode 0600, so no
+// one else can connect to it in between.
+func Listen(path string) (*Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".handoff")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The socket file is path's once moved; Close removes it.
+	ln.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	os.Remove(path)
+	if err := os.Rename(tmp, path); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return &Listener{ln: ln, path: path}, nil
+}
+
+// Accept waits for a new process to connect.
+func (l *Listener) Accept() (*Conn, error) {
+	c, err := l.ln.AcceptUnix()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{c: c}, nil
+}
+
+// Close stops listening and removes the socket.
+func (l *Listener) Close() error {
+	err := l.ln.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// Conn is a connection between the old and new processes.
+type Conn struct {
+	c *net.UnixConn
+}
+
+// Dial connects to the old process listening on the unix socket path.
+func Dial(path string) (*Conn, error) {
+	c, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{c: c}, nil
+}
+
+// UnixConn returns c's underlying connection, such as for checking
+// who's at the other end.
+func (c *Conn) UnixConn() *net.UnixConn {
+	return c.c
+}
+
+// Close closes c.
+func (c *Conn) Close() error {
+	return c.c.Close()
+}
+
+// Send sends state, as JSON, and files to the new process. The files
+// stay open in this one.
+func (c *Conn) Send(state interface{}, files []*os.File) error {
+	j, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if len(j) > maxState {
+		return fmt.Errorf("state too large (%d bytes)", len(j))
+	}
+	fds := make([]int, len(files))
+	for i, f := range files {
+		// Not f.Fd, which would put the file, shared with this
+		// process's copy, in blocking mode.
+		rc, err := f.SyscallConn()
+		if err != nil {
+			return err
+		}
+		rc.Control(func(fd uintptr) { fds[i] = int(fd) })
+	}
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(j)))
+	// The files go with the length alone, as a stream socket's
+	// sendmsg might not send all of a larger message.
+	if _, _, err := c.c.WriteMsgUnix(hdr[:], syscall.UnixRights(fds...), nil); err != nil {
+		return err
+	}
+	_, err = c.c.Write(j)
+	return err
+}
+
+// Receive receives the old process's state into state, which is
+// unmarshaled from JSON, and returns its files.
+func (c *Conn) Receive(state interface{}) ([]*os.File, error) {
+	var hdr [4]byte
+	oob := make([]byte, syscall.CmsgSpace(64*4))
+	n, oobn, _, _, err := c.c.ReadMsgUnix(hdr[:], oob)
+	if err != nil {
+		return nil, err
+	}
+	files, err := parseRights(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	closeFiles := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	if _, err := io.ReadFull(c.c, hdr[n:]); err != nil {
+		closeFiles()
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr[:])
+	if size > maxState {
+		closeFiles()
+		return nil, fmt.Errorf("state too large (%d bytes)", size)
+	}
+	j := make([]byte, size)
+	if _, err := io.ReadFull(c.c, j); err != nil {
+		closeFiles()
+		return nil, err
+	}
+	if err := json.Unmarshal(j, state); err != nil {
+		closeFiles()
+		return nil, err
+	}
+	return files, nil
+}
+
+// parseRights returns the files passed in the control messages oob.
+func parseRights(oob []byte) ([]*os.File, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	var files []*os.File
+	for _, m := range msgs {
+		fds, err := syscall.ParseUnixRights(&m)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			syscall.CloseOnExec(fd)
+			files = append(files, os.NewFile(uintptr(fd), fmt.Sprintf("handoff-%d", len(files))))
+		}
+	}
+	return files, nil
+}
+
+// Ack tells the old process that this one has taken over, and so it
+// should exit.
+func (c *Conn) Ack() error {
+	_, err := io.WriteString(c.c, ack)
+	return err
+}
+
+// WaitAck waits up to timeout for the new process to Ack. An error
+// means it gave up, and this process should carry on.
+func (c *Conn) WaitAck(timeout time.Duration) error {
+	c.c.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, len(ack))
+	if _, err := io.ReadFull(c.c, buf); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errors.New("new process gave up")
+		}
+		return err
+	}
+	if string(buf) != ack {
+		return fmt.Errorf("unexpected ack %q", buf)
+	}
+	return nil
+}
+
+// WaitClose waits up to timeout for the old process to exit, after
+// Ack.
+func (c *Conn) WaitClose(timeout time.Duration) error {
+	c.c.SetReadDeadline(time.Now().Add(timeout))
+	_, err := io.Copy(ioutil.Discard, c.c)
+	return err
+}
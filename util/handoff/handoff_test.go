@@ -0,0 +1,162 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package handoff
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHandoff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "handoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "handoff.sock")
+
+	ln, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	type state struct {
+		Name string
+	}
+	sent := make(chan error, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			sent <- err
+			return
+		}
+		if err := c.Send(state{Name: "tailscale0"}, []*os.File{r, w}); err != nil {
+			sent <- err
+			return
+		}
+		err = c.WaitAck(5 * time.Second)
+		c.Close() // as on exit
+		sent <- err
+	}()
+
+	c, err := Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var st state
+	files, err := c.Receive(&st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Name != "tailscale0" {
+		t.Errorf("state = %+v", st)
+	}
+	if len(files) != 2 {
+		t.Fatalf("got %d files, want 2", len(files))
+	}
+	defer files[0].Close()
+	defer files[1].Close()
+
+	// The received files are the same pipe.
+	if _, err := files[1].Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	if _, err := r.Read(buf); err != nil || string(buf) != "hi" {
+		t.Fatalf("read %q, %v; want hi", buf, err)
+	}
+
+	if err := c.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("sender: %v", err)
+	}
+	if err := c.WaitClose(5 * time.Second); err != nil {
+		t.Fatalf("WaitClose: %v", err)
+	}
+}
+
+func TestHandoffGiveUp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "handoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "handoff.sock")
+
+	ln, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		c, err := Dial(path)
+		if err != nil {
+			return
+		}
+		var st struct{}
+		c.Receive(&st)
+		c.Close() // without Ack
+	}()
+
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Send(struct{}{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WaitAck(5 * time.Second); err == nil {
+		t.Fatal("WaitAck succeeded without Ack")
+	}
+}
+
+func TestListenPrivate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "handoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "handoff.sock")
+
+	ln, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v; want 0600", fi.Mode())
+	}
+	// Only the socket is left beside path, not the directory it
+	// was created in.
+	if fis, err := ioutil.ReadDir(dir); err != nil || len(fis) != 1 {
+		t.Errorf("dir has %d entries, %v; want 1", len(fis), err)
+	}
+
+	ln.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket not removed on Close: %v", err)
+	}
+}
@@ -0,0 +1,9 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package privdrop runs the current process without root on Linux:
+// by re-running it as another user with only some capabilities, and
+// by forbidding the system calls a network daemon has no business
+// making.
+package privdrop
@@ -0,0 +1,26 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package privdrop
+
+import "errors"
+
+var errNotLinux = errors.New("privdrop: only supported on Linux")
+
+// NetworkCaps are the capabilities to configure the network, on Linux.
+var NetworkCaps []uintptr
+
+// RunAsUser runs the current executable again as the named user. It's
+// only supported on Linux.
+func RunAsUser(username string, caps []uintptr, dirs ...string) (exitCode int, err error) {
+	return 0, errNotLinux
+}
+
+// Seccomp forbids the process the system calls it doesn't need. It's
+// only supported on Linux.
+func Seccomp() error {
+	return errNotLinux
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package privdrop
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// NetworkCaps are the capabilities to configure the network: to manage
+// interfaces, routes and firewall rules, and to mark sockets.
+var NetworkCaps = []uintptr{unix.CAP_NET_ADMIN, unix.CAP_NET_RAW}
+
+// RunAsUser runs the current executable again, with the same
+// arguments, as the named user, with only the capabilities caps (such
+// as NetworkCaps), which are also passed on to the programs it
+// runs. It returns the exit code of the process once it exits;
+// SIGINT, SIGTERM and SIGHUP are forwarded to it meanwhile.
+//
+// The directories in dirs are created if need be and, along with
+// everything in them, handed over to the user first. They must be the
+// process's own, such as /var/lib/tailscale: shared system directories
+// such as /var/lib or /run are refused.
+//
+// Go can't change the user of a running process, as that only changes
+// the thread calling setuid, so RunAsUser must be called early on, by
+// a process started as root; the process it starts is running as the
+// user.
+func RunAsUser(username string, caps []uintptr, dirs ...string) (exitCode int, err error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return 0, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	if uid == 0 {
+		return 0, errors.New("privdrop: user is root")
+	}
+	cred := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	gids, err := u.GroupIds()
+	if err != nil {
+		return 0, err
+	}
+	for _, g := range gids {
+		id, err := strconv.ParseUint(g, 10, 32)
+		if err != nil {
+			return 0, err
+		}
+		cred.Groups = append(cred.Groups, uint32(id))
+	}
+
+	var owned []string
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return 0, err
+		}
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			return 0, err
+		}
+		if sharedDir(resolved) {
+			return 0, fmt.Errorf("privdrop: %s is a shared directory; use one of the process's own, such as /var/lib/tailscale", dir)
+		}
+		owned = append(owned, resolved)
+	}
+	for _, dir := range owned {
+		err := filepath.Walk(dir, func(path string, _ os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Lchown(path, int(uid), int(gid))
+		})
+		if err != nil {
+			return 0, fmt.Errorf("privdrop: handing over %s: %w", dir, err)
+		}
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential:  cred,
+		AmbientCaps: caps,
+		Pdeathsig:   syscall.SIGTERM,
+	}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer close(sigc)
+	defer signal.Stop(sigc)
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	go func() {
+		for sig := range sigc {
+			cmd.Process.Signal(sig)
+		}
+	}()
+	err = cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), nil
+	}
+	return 0, err
+}
+
+// sharedDirs are system directories that hold other programs' files
+// too, which RunAsUser mustn't hand over.
+var sharedDirs = map[string]bool{
+	"/":          true,
+	"/dev":       true,
+	"/dev/shm":   true,
+	"/etc":       true,
+	"/home":      true,
+	"/opt":       true,
+	"/root":      true,
+	"/run":       true,
+	"/run/user":  true,
+	"/srv":       true,
+	"/tmp":       true,
+	"/usr":       true,
+	"/usr/local": true,
+	"/var":       true,
+	"/var/cache": true,
+	"/var/lib":   true,
+	"/var/log":   true,
+	"/var/run":   true,
+	"/var/tmp":   true,
+}
+
+// sharedDir reports whether dir, with symlinks resolved, is a system
+// directory shared with other programs: one of sharedDirs, or one
+// with the sticky bit set, as world-writable ones like /tmp have.
+func sharedDir(dir string) bool {
+	if sharedDirs[filepath.Clean(dir)] {
+		return true
+	}
+	fi, err := os.Stat(dir)
+	return err == nil && fi.Mode()&os.ModeSticky != 0
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package privdrop
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSharedDir(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "privdrop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	sticky := filepath.Join(tmp, "sticky")
+	if err := os.Mkdir(sticky, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(sticky, 0777|os.ModeSticky); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		dir  string
+		want bool
+	}{
+		{"/", true},
+		{"/var/lib", true},
+		{"/var/lib/", true},
+		{"/run", true},
+		{sticky, true},
+		{"/var/lib/tailscale", false},
+		{"/run/tailscale", false},
+		{tmp, false},
+	}
+	for _, tt := range tests {
+		if got := sharedDir(tt.dir); got != tt.want {
+			t.Errorf("sharedDir(%q) = %v; want %v", tt.dir, got, tt.want)
+		}
+	}
+}
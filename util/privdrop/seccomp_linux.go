@@ -0,0 +1,93 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package privdrop
+
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTSync = 1
+
+	seccompRetAllow = 0x7fff0000
+	seccompRetErrno = 0x00050000
+
+	// Offsets in struct seccomp_data.
+	seccompDataNr   = 0
+	seccompDataArch = 4
+
+	// x32SyscallBit is set in the numbers of x32 ABI system calls,
+	// which are otherwise the same as x86-64's.
+	x32SyscallBit = 0x40000000
+)
+
+// Seccomp forbids the process, and the programs it runs from then on,
+// system calls that only debuggers, container runtimes and system
+// administration tools make, such as ptrace, mount and init_module:
+// they fail with EPERM. It also sets no_new_privs, so that running a
+// setuid program can't lift them.
+//
+// It applies to all threads, and can't be undone.
+func Seccomp() error {
+	if auditArch == 0 {
+		return fmt.Errorf("privdrop: seccomp not supported on %s", runtime.GOARCH)
+	}
+	prog := filterProgram(auditArch, deniedSyscalls)
+	fprog := unix.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+
+	// no_new_privs is per thread, and copied to the others by
+	// seccomp's TSYNC, so both must be on this thread.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("privdrop: setting no_new_privs: %w", err)
+	}
+	ret, _, errno := unix.Syscall(unix.SYS_SECCOMP, seccompSetModeFilter, seccompFilterFlagTSync, uintptr(unsafe.Pointer(&fprog)))
+	if errno != 0 {
+		return fmt.Errorf("privdrop: seccomp: %w", errno)
+	}
+	if ret != 0 {
+		return fmt.Errorf("privdrop: seccomp: thread %d can't be synchronized", ret)
+	}
+	return nil
+}
+
+// filterProgram returns a seccomp BPF program failing the system
+// calls denied, and any of another architecture than arch, with
+// EPERM.
+func filterProgram(arch uint32, denied []uint32) []unix.SockFilter {
+	stmt := func(code uint16, k uint32) unix.SockFilter {
+		return unix.SockFilter{Code: code, K: k}
+	}
+	jump := func(code uint16, k uint32, jt uint8) unix.SockFilter {
+		return unix.SockFilter{Code: code, Jt: jt, K: k}
+	}
+	const (
+		load = unix.BPF_LD | unix.BPF_W | unix.BPF_ABS
+		jeq  = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+		jge  = unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K
+		ret  = unix.BPF_RET | unix.BPF_K
+	)
+	deny := seccompRetErrno | uint32(unix.EPERM)
+	n := len(denied)
+
+	prog := []unix.SockFilter{
+		stmt(load, seccompDataArch),
+		jump(jeq, arch, 1),
+		stmt(ret, deny),
+		stmt(load, seccompDataNr),
+		// The jumps skip to the final, denying, return.
+		jump(jge, x32SyscallBit, uint8(n+1)),
+	}
+	for i, nr := range denied {
+		prog = append(prog, jump(jeq, nr, uint8(n-i)))
+	}
+	return append(prog, stmt(ret, seccompRetAllow), stmt(ret, deny))
+}
@@ -0,0 +1,15 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package privdrop
+
+import "golang.org/x/sys/unix"
+
+const auditArch = unix.AUDIT_ARCH_X86_64
+
+var deniedSyscalls = append(commonDeniedSyscalls,
+	unix.SYS_IOPL,
+	unix.SYS_IOPERM,
+	unix.SYS_MODIFY_LDT,
+)
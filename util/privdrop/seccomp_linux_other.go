@@ -0,0 +1,12 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux,!amd64,!arm64
+
+package privdrop
+
+// auditArch is zero where Seccomp isn't supported (yet).
+const auditArch = 0
+
+var deniedSyscalls []uint32
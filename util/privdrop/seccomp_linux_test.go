@@ -0,0 +1,70 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package privdrop
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestFilterProgram(t *testing.T) {
+	const arch = 0xc000003e
+	prog := filterProgram(arch, []uint32{101, 165, 175})
+
+	// run interprets prog, with the few instructions it uses.
+	run := func(arch, nr uint32) uint32 {
+		var a uint32
+		for pc := 0; pc < len(prog); pc++ {
+			ins := prog[pc]
+			switch ins.Code {
+			case unix.BPF_LD | unix.BPF_W | unix.BPF_ABS:
+				if ins.K == seccompDataArch {
+					a = arch
+				} else {
+					a = nr
+				}
+			case unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K:
+				if a == ins.K {
+					pc += int(ins.Jt)
+				} else {
+					pc += int(ins.Jf)
+				}
+			case unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K:
+				if a >= ins.K {
+					pc += int(ins.Jt)
+				} else {
+					pc += int(ins.Jf)
+				}
+			case unix.BPF_RET | unix.BPF_K:
+				return ins.K
+			default:
+				t.Fatalf("unexpected instruction %+v", ins)
+			}
+		}
+		t.Fatal("program ran off its end")
+		return 0
+	}
+
+	deny := seccompRetErrno | uint32(unix.EPERM)
+	tests := []struct {
+		name     string
+		arch, nr uint32
+		want     uint32
+	}{
+		{"allowed", arch, 0, seccompRetAllow},
+		{"allowed2", arch, 166, seccompRetAllow},
+		{"first", arch, 101, deny},
+		{"middle", arch, 165, deny},
+		{"last", arch, 175, deny},
+		{"x32", arch, x32SyscallBit | 0, deny},
+		{"other_arch", 0x40000003, 0, deny},
+	}
+	for _, tt := range tests {
+		if got := run(tt.arch, tt.nr); got != tt.want {
+			t.Errorf("%s: got %#x; want %#x", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build amd64 arm64
+
+package privdrop
+
+import "golang.org/x/sys/unix"
+
+// commonDeniedSyscalls are the system calls Seccomp forbids on both
+// amd64 and arm64.
+var commonDeniedSyscalls = []uint32{
+	// Debugging and reading other processes' memory.
+	unix.SYS_PTRACE,
+	unix.SYS_PROCESS_VM_READV,
+	unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_PERF_EVENT_OPEN,
+	unix.SYS_BPF,
+	unix.SYS_USERFAULTFD,
+
+	// Filesystems and namespaces.
+	unix.SYS_MOUNT,
+	unix.SYS_UMOUNT2,
+	unix.SYS_PIVOT_ROOT,
+	unix.SYS_CHROOT,
+	unix.SYS_UNSHARE,
+	unix.SYS_SETNS,
+	unix.SYS_OPEN_BY_HANDLE_AT,
+	unix.SYS_SWAPON,
+	unix.SYS_SWAPOFF,
+	unix.SYS_ACCT,
+
+	// The kernel and its modules.
+	unix.SYS_REBOOT,
+	unix.SYS_KEXEC_LOAD,
+	unix.SYS_KEXEC_FILE_LOAD,
+	unix.SYS_INIT_MODULE,
+	unix.SYS_FINIT_MODULE,
+	unix.SYS_DELETE_MODULE,
+
+	// Keyrings.
+	unix.SYS_KEYCTL,
+	unix.SYS_ADD_KEY,
+	unix.SYS_REQUEST_KEY,
+
+	// The clock.
+	unix.SYS_SETTIMEOFDAY,
+	unix.SYS_CLOCK_SETTIME,
+	unix.SYS_CLOCK_ADJTIME,
+	unix.SYS_ADJTIMEX,
+}
@@ -0,0 +1,505 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package qrcode encodes short text, such as login URLs, as QR codes
+// for printing to a terminal. It only does what that needs: byte
+// mode, error correction level M and versions 1 to 10, which hold up
+// to 213 bytes.
+package qrcode
+
+import (
+	"errors"
+	"strings"
+)
+
+// Code is an encoded QR code.
+type Code struct {
+	size    int
+	modules []bool // dark modules, row by row
+	isFunc  []bool // modules of function patterns, not data
+}
+
+// Size returns the width and height of c in modules, not counting
+// the quiet zone around it.
+func (c *Code) Size() int { return c.size }
+
+// Dark reports whether the module in column x and row y of c is dark.
+// It's false outside of c.
+func (c *Code) Dark(x, y int) bool {
+	if x < 0 || y < 0 || x >= c.size || y >= c.size {
+		return false
+	}
+	return c.modules[y*c.size+x]
+}
+
+// quietZone is the width in modules of the light border scanners need
+// around a code.
+const quietZone = 2
+
+// Terminal returns c drawn with Unicode block characters, two rows of
+// modules to a line, dark on a light terminal background. Use
+// TerminalInverted for dark backgrounds.
+func (c *Code) Terminal() string {
+	return c.terminal(false)
+}
+
+// TerminalInverted is like Terminal, for terminals with light text on
+// a dark background.
+func (c *Code) TerminalInverted() string {
+	return c.terminal(true)
+}
+
+func (c *Code) terminal(invert bool) string {
+	var sb strings.Builder
+	for y := -quietZone; y < c.size+quietZone; y += 2 {
+		for x := -quietZone; x < c.size+quietZone; x++ {
+			top, bottom := c.Dark(x, y), c.Dark(x, y+1)
+			if invert {
+				top, bottom = !top, !bottom
+			}
+			switch {
+			case top && bottom:
+				sb.WriteString("█")
+			case top:
+				sb.WriteString("▀")
+			case bottom:
+				sb.WriteString("▄")
+			default:
+				sb.WriteString(" ")
+			}
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// version describes the error correction blocks of a QR code version
+// at level M.
+type version struct {
+	ecLen     int // error correction codewords per block
+	blocks1   int // blocks of data1 data codewords
+	data1     int
+	blocks2   int // blocks of data1+1 data codewords
+	alignment []int
+}
+
+// versions are versions 1 to 10 at error correction level M.
+var versions = []version{
+	1:  {10, 1, 16, 0, nil},
+	2:  {16, 1, 28, 0, []int{6, 18}},
+	3:  {26, 1, 44, 0, []int{6, 22}},
+	4:  {18, 2, 32, 0, []int{6, 26}},
+	5:  {24, 2, 43, 0, []int{6, 30}},
+	6:  {16, 4, 27, 0, []int{6, 34}},
+	7:  {18, 4, 31, 0, []int{6, 22, 38}},
+	8:  {22, 2, 38, 2, []int{6, 24, 42}},
+	9:  {22, 3, 36, 2, []int{6, 26, 46}},
+	10: {26, 4, 43, 1, []int{6, 28, 50}},
+}
+
+func (v version) dataLen() int {
+	return v.blocks1*v.data1 + v.blocks2*(v.data1+1)
+}
+
+// countBits returns the length of the byte count in version n.
+func countBits(n int) int {
+	if n < 10 {
+		return 8
+	}
+	return 16
+}
+
+// ErrTooLong is returned by Encode for text that doesn't fit in a
+// version 10 code.
+var ErrTooLong = errors.New("qrcode: text too long")
+
+// Encode returns the smallest QR code holding text.
+func Encode(text string) (*Code, error) {
+	n := 1
+	for ; n < len(versions); n++ {
+		if 4+countBits(n)+8*len(text) <= 8*versions[n].dataLen() {
+			break
+		}
+	}
+	if n == len(versions) {
+		return nil, ErrTooLong
+	}
+	v := versions[n]
+
+	var bb bitBuffer
+	bb.append(0x4, 4) // byte mode
+	bb.append(uint32(len(text)), countBits(n))
+	for i := 0; i < len(text); i++ {
+		bb.append(uint32(text[i]), 8)
+	}
+	capBits := 8 * v.dataLen()
+	term := capBits - len(bb)
+	if term > 4 {
+		term = 4
+	}
+	bb.append(0, term)
+	bb.append(0, (8-len(bb)%8)%8)
+	for pad := uint32(0xEC); len(bb) < capBits; pad ^= 0xEC ^ 0x11 {
+		bb.append(pad, 8)
+	}
+
+	c := newCode(n)
+	c.drawData(interleave(bb.bytes(), v))
+	c.applyBestMask()
+	return c, nil
+}
+
+// bitBuffer is a sequence of bits, one per byte.
+type bitBuffer []byte
+
+// append appends the n low bits of v, most significant first.
+func (bb *bitBuffer) append(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*bb = append(*bb, byte(v>>uint(i)&1))
+	}
+}
+
+// bytes returns the bits of bb packed into bytes.
+func (bb bitBuffer) bytes() []byte {
+	b := make([]byte, len(bb)/8)
+	for i, bit := range bb {
+		b[i/8] |= bit << uint(7-i%8)
+	}
+	return b
+}
+
+// interleave splits data into v's blocks, adds their error correction
+// codewords and returns the codewords in the order they're drawn.
+func interleave(data []byte, v version) []byte {
+	div := rsDivisor(v.ecLen)
+	var blocks, ecs [][]byte
+	for i := 0; i < v.blocks1+v.blocks2; i++ {
+		n := v.data1
+		if i >= v.blocks1 {
+			n++
+		}
+		blocks = append(blocks, data[:n])
+		ecs = append(ecs, rsRemainder(data[:n], div))
+		data = data[n:]
+	}
+	var out []byte
+	for i := 0; i <= v.data1; i++ {
+		for _, b := range blocks {
+			if i < len(b) {
+				out = append(out, b[i])
+			}
+		}
+	}
+	for i := 0; i < v.ecLen; i++ {
+		for _, ec := range ecs {
+			out = append(out, ec[i])
+		}
+	}
+	return out
+}
+
+// gfMul multiplies x and y in GF(2^8) modulo x^8+x^4+x^3+x^2+1.
+func gfMul(x, y byte) byte {
+	var z uint
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= uint(y>>uint(i)&1) * uint(x)
+	}
+	return byte(z)
+}
+
+// rsDivisor returns the Reed-Solomon generator polynomial of degree
+// n, without its leading 1, highest degree first.
+func rsDivisor(n int) []byte {
+	div := make([]byte, n)
+	div[n-1] = 1
+	root := byte(1)
+	for i := 0; i < n; i++ {
+		for j := range div {
+			div[j] = gfMul(div[j], root)
+			if j+1 < n {
+				div[j] ^= div[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	return div
+}
+
+// rsRemainder returns the error correction codewords of data.
+func rsRemainder(data, div []byte) []byte {
+	res := make([]byte, len(div))
+	for _, b := range data {
+		factor := b ^ res[0]
+		copy(res, res[1:])
+		res[len(res)-1] = 0
+		for i, d := range div {
+			res[i] ^= gfMul(d, factor)
+		}
+	}
+	return res
+}
+
+// newCode returns a code of version n with its function patterns
+// drawn, and room reserved for the format bits.
+func newCode(n int) *Code {
+	size := 17 + 4*n
+	c := &Code{
+		size:    size,
+		modules: make([]bool, size*size),
+		isFunc:  make([]bool, size*size),
+	}
+	for i := 0; i < size; i++ {
+		c.setFunc(6, i, i%2 == 0)
+		c.setFunc(i, 6, i%2 == 0)
+	}
+	c.drawFinder(3, 3)
+	c.drawFinder(size-4, 3)
+	c.drawFinder(3, size-4)
+	pos := versions[n].alignment
+	last := len(pos) - 1
+	for i, x := range pos {
+		for j, y := range pos {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue // overlaps a finder
+			}
+			c.drawAlignment(x, y)
+		}
+	}
+	c.drawFormat(0)
+	if n >= 7 {
+		bits := versionBits(n)
+		for i := 0; i < 18; i++ {
+			dark := bits>>uint(i)&1 != 0
+			a, b := size-11+i%3, i/3
+			c.setFunc(a, b, dark)
+			c.setFunc(b, a, dark)
+		}
+	}
+	return c
+}
+
+// versionBits returns the 18 bits of version information of version
+// n, with their BCH error correction.
+func versionBits(n int) int {
+	rem := n
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	return n<<12 | rem
+}
+
+// formatBits returns the 15 format bits for level M and mask, with
+// their BCH error correction, masked as the specification requires.
+func formatBits(mask int) int {
+	data := mask // level M is 0
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+func (c *Code) setFunc(x, y int, dark bool) {
+	c.modules[y*c.size+x] = dark
+	c.isFunc[y*c.size+x] = true
+}
+
+// drawFinder draws a finder pattern centered on x, y, and its
+// separator.
+func (c *Code) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || yy < 0 || xx >= c.size || yy >= c.size {
+				continue
+			}
+			d := ringDist(dx, dy)
+			c.setFunc(xx, yy, d != 2 && d != 4)
+		}
+	}
+}
+
+func (c *Code) drawAlignment(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			c.setFunc(x+dx, y+dy, ringDist(dx, dy) != 1)
+		}
+	}
+}
+
+// drawFormat draws both copies of the format bits for level M and
+// the given mask.
+func (c *Code) drawFormat(mask int) {
+	bits := formatBits(mask)
+	bit := func(i int) bool { return bits>>uint(i)&1 != 0 }
+
+	for i := 0; i <= 5; i++ {
+		c.setFunc(8, i, bit(i))
+	}
+	c.setFunc(8, 7, bit(6))
+	c.setFunc(8, 8, bit(7))
+	c.setFunc(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.setFunc(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		c.setFunc(c.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.setFunc(8, c.size-15+i, bit(i))
+	}
+	c.setFunc(8, c.size-8, true) // always dark
+}
+
+// drawData draws the codewords in the zigzag order of the data area,
+// two columns at a time from the bottom right. Modules left over are
+// light, as the remainder bits are zero.
+func (c *Code) drawData(codewords []byte) {
+	i := 0
+	for right := c.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		for vert := 0; vert < c.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				upward := (right+1)&2 == 0
+				y := vert
+				if upward {
+					y = c.size - 1 - vert
+				}
+				if c.isFunc[y*c.size+x] || i >= 8*len(codewords) {
+					continue
+				}
+				c.modules[y*c.size+x] = codewords[i/8]>>uint(7-i%8)&1 != 0
+				i++
+			}
+		}
+	}
+}
+
+// masked reports whether mask inverts the module at x, y.
+func masked(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+// applyMask inverts the data modules selected by mask. Applying it
+// again undoes it.
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.size; y++ {
+		for x := 0; x < c.size; x++ {
+			if !c.isFunc[y*c.size+x] && masked(mask, x, y) {
+				c.modules[y*c.size+x] = !c.modules[y*c.size+x]
+			}
+		}
+	}
+}
+
+// applyBestMask applies the mask with the lowest penalty, which is
+// easiest for scanners to read.
+func (c *Code) applyBestMask() {
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		c.applyMask(mask)
+		c.drawFormat(mask)
+		if p := c.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		c.applyMask(mask)
+	}
+	c.applyMask(best)
+	c.drawFormat(best)
+}
+
+// penalty scores c by the four rules of the QR code specification:
+// runs of modules of one color, 2x2 blocks of one color, patterns
+// that look like finders, and imbalance of dark and light.
+func (c *Code) penalty() int {
+	p := 0
+	line := func(at func(i int) bool) {
+		run := 0
+		for i := 0; i < c.size; i++ {
+			if i > 0 && at(i) == at(i-1) {
+				run++
+			} else {
+				run = 1
+			}
+			if run == 5 {
+				p += 3
+			} else if run > 5 {
+				p++
+			}
+		}
+		// 1:1:3:1:1 with 4 light modules on either side.
+		for i := 0; i+11 <= c.size; i++ {
+			var b uint
+			for k := 0; k < 11; k++ {
+				b <<= 1
+				if at(i + k) {
+					b |= 1
+				}
+			}
+			if b == 0x5D0 || b == 0x05D {
+				p += 40
+			}
+		}
+	}
+	for y := 0; y < c.size; y++ {
+		line(func(x int) bool { return c.Dark(x, y) })
+	}
+	for x := 0; x < c.size; x++ {
+		line(func(y int) bool { return c.Dark(x, y) })
+	}
+
+	dark := 0
+	for y := 0; y < c.size; y++ {
+		for x := 0; x < c.size; x++ {
+			d := c.Dark(x, y)
+			if d {
+				dark++
+			}
+			if x+1 < c.size && y+1 < c.size &&
+				d == c.Dark(x+1, y) && d == c.Dark(x, y+1) && d == c.Dark(x+1, y+1) {
+				p += 3
+			}
+		}
+	}
+	total := c.size * c.size
+	p += abs(dark*20-total*10) / total * 10
+	return p
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// ringDist returns which square ring around a pattern's center the
+// module at offset dx, dy is on.
+func ringDist(dx, dy int) int {
+	if abs(dx) > abs(dy) {
+		return abs(dx)
+	}
+	return abs(dy)
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package qrcode
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	// The "HELLO WORLD" example at level M, version 1.
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := rsRemainder(data, rsDivisor(10)); !bytes.Equal(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestFormatBits(t *testing.T) {
+	// From the specification's table of format information for
+	// level M.
+	want := []int{
+		0x5412, 0x5125, 0x5E7C, 0x5B4B, 0x45F9, 0x40CE, 0x4F97, 0x4AA0,
+	}
+	for mask, w := range want {
+		if got := formatBits(mask); got != w {
+			t.Errorf("mask %d: got %#x; want %#x", mask, got, w)
+		}
+	}
+}
+
+func TestVersionBits(t *testing.T) {
+	want := map[int]int{7: 0x07C94, 8: 0x085BC, 9: 0x09A99, 10: 0x0A4D3}
+	for n, w := range want {
+		if got := versionBits(n); got != w {
+			t.Errorf("version %d: got %#x; want %#x", n, got, w)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		text    string
+		version int
+	}{
+		{"", 1},
+		{"hello", 1},
+		{"https://login.tailscale.com/a/1234567890ab", 3},
+		{strings.Repeat("x", 106), 6},
+		{strings.Repeat("x", 107), 7},
+		{strings.Repeat("x", 213), 10},
+	}
+	for _, tt := range tests {
+		c, err := Encode(tt.text)
+		if err != nil {
+			t.Errorf("Encode(%d bytes): %v", len(tt.text), err)
+			continue
+		}
+		if got, want := c.Size(), 17+4*tt.version; got != want {
+			t.Errorf("Encode(%d bytes): size %d; want %d", len(tt.text), got, want)
+			continue
+		}
+		if got, err := decode(c, tt.version); err != "" {
+			t.Errorf("decoding %d bytes: %s", len(tt.text), err)
+		} else if got != tt.text {
+			t.Errorf("decoded %q; want %q", got, tt.text)
+		}
+	}
+	if _, err := Encode(strings.Repeat("x", 214)); err != ErrTooLong {
+		t.Errorf("Encode(214 bytes) = %v; want ErrTooLong", err)
+	}
+}
+
+// decode reads the text back out of c, a version n code, or returns
+// what's wrong with it.
+func decode(c *Code, n int) (text, problem string) {
+	// The first copy of the format bits.
+	format := 0
+	bit := func(x, y, i int) {
+		if c.Dark(x, y) {
+			format |= 1 << uint(i)
+		}
+	}
+	for i := 0; i <= 5; i++ {
+		bit(8, i, i)
+	}
+	bit(8, 7, 6)
+	bit(8, 8, 7)
+	bit(7, 8, 8)
+	for i := 9; i < 15; i++ {
+		bit(14-i, 8, i)
+	}
+	mask := -1
+	for m := 0; m < 8; m++ {
+		if formatBits(m) == format {
+			mask = m
+		}
+	}
+	if mask < 0 {
+		return "", "bad format bits"
+	}
+
+	// Undo the mask and read the codewords, using a fresh code of
+	// the same version for the function patterns.
+	fresh := newCode(n)
+	for i := range fresh.modules {
+		if fresh.isFunc[i] {
+			continue
+		}
+		x, y := i%c.size, i/c.size
+		fresh.modules[i] = c.modules[i] != masked(mask, x, y)
+	}
+	v := versions[n]
+	total := v.dataLen() + v.ecLen*(v.blocks1+v.blocks2)
+	codewords := make([]byte, 0, total)
+	var cur byte
+	nbits := 0
+	for right := c.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < c.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = c.size - 1 - vert
+				}
+				if fresh.isFunc[y*c.size+x] || len(codewords) == total {
+					continue
+				}
+				cur <<= 1
+				if fresh.modules[y*c.size+x] {
+					cur |= 1
+				}
+				if nbits++; nbits == 8 {
+					codewords = append(codewords, cur)
+					cur, nbits = 0, 0
+				}
+			}
+		}
+	}
+	if len(codewords) != total {
+		return "", "too few codewords"
+	}
+
+	// Deinterleave, and check each block's error correction.
+	nblocks := v.blocks1 + v.blocks2
+	blocks := make([][]byte, nblocks)
+	i := 0
+	for k := 0; k <= v.data1; k++ {
+		for b := range blocks {
+			if k < v.data1 || b >= v.blocks1 {
+				blocks[b] = append(blocks[b], codewords[i])
+				i++
+			}
+		}
+	}
+	div := rsDivisor(v.ecLen)
+	for k := 0; k < v.ecLen; k++ {
+		for b := range blocks {
+			if codewords[i] != rsRemainder(blocks[b], div)[k] {
+				return "", "bad error correction"
+			}
+			i++
+		}
+	}
+	var data []byte
+	for _, b := range blocks {
+		data = append(data, b...)
+	}
+
+	// Parse the byte mode segment.
+	var bits []byte
+	for _, b := range data {
+		for k := 7; k >= 0; k-- {
+			bits = append(bits, b>>uint(k)&1)
+		}
+	}
+	read := func(n int) int {
+		v := 0
+		for k := 0; k < n; k++ {
+			v = v<<1 | int(bits[k])
+		}
+		bits = bits[n:]
+		return v
+	}
+	if read(4) != 4 {
+		return "", "not byte mode"
+	}
+	length := read(countBits(n))
+	var sb strings.Builder
+	for k := 0; k < length; k++ {
+		sb.WriteByte(byte(read(8)))
+	}
+	return sb.String(), ""
+}
+
+func TestTerminal(t *testing.T) {
+	c, err := Encode("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(c.Terminal(), "\n"), "\n")
+	if got, want := len(lines), (c.Size()+2*quietZone+1)/2; got != want {
+		t.Errorf("got %d lines; want %d", got, want)
+	}
+	// The top left finder pattern's top edge is dark.
+	if got := []rune(lines[1])[quietZone]; got != '█' && got != '▀' {
+		t.Errorf("finder corner drawn as %q", got)
+	}
+}
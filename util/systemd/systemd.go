@@ -0,0 +1,40 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package systemd implements the parts of systemd's service protocol
+// tailscaled uses: socket activation, and notifying systemd of
+// readiness and liveness with sd_notify messages. Everything is a
+// no-op when not running under systemd, or not on Linux.
+package systemd
+
+import (
+	"strconv"
+	"time"
+)
+
+// Notify messages.
+const (
+	Ready    = "READY=1"
+	Stopping = "STOPPING=1"
+	Watchdog = "WATCHDOG=1"
+)
+
+// Status returns the Notify message setting the service's status line
+// shown by "systemctl status".
+func Status(s string) string {
+	return "STATUS=" + s
+}
+
+// MainPID returns the Notify message making pid the service's main
+// process, as when another process takes over from this one.
+func MainPID(pid int) string {
+	return "MAINPID=" + strconv.Itoa(pid)
+}
+
+// WatchdogInterval returns how often Watchdog must be sent for systemd
+// to consider the service alive, or 0 if the service has no watchdog.
+// Sending it at half the interval is recommended.
+func WatchdogInterval() time.Duration {
+	return watchdogInterval()
+}
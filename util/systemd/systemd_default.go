@@ -0,0 +1,25 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package systemd
+
+import (
+	"net"
+	"time"
+)
+
+// Listeners returns the listeners passed by systemd socket activation,
+// which is only supported on Linux.
+func Listeners() ([]net.Listener, error) { return nil, nil }
+
+// PassListeners hands the listeners passed by systemd socket
+// activation to a child process, which is only supported on Linux.
+func PassListeners() {}
+
+// Notify sends systemd messages, which is only supported on Linux.
+func Notify(msgs ...string) error { return nil }
+
+func watchdogInterval() time.Duration { return 0 }
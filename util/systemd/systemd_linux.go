@@ -0,0 +1,110 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor passed by socket
+// activation.
+const listenFDsStart = 3
+
+// listenParentEnv is the environment variable by which PassListeners
+// hands a child process the listeners passed to its parent, whose PID
+// it holds.
+const listenParentEnv = "TS_LISTEN_PARENT_PID"
+
+// Listeners returns the listeners passed by systemd socket activation,
+// in the order of the socket unit's Listen lines, or none if the
+// process wasn't socket activated. The environment variables passing
+// them are unset, so that they're not inherited by child processes.
+//
+// Listeners passed to the parent process and handed down with
+// PassListeners are returned too.
+func Listeners() ([]net.Listener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	parent := os.Getenv(listenParentEnv)
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	os.Unsetenv(listenParentEnv)
+	passed := parent != "" && parent == pid && pid == strconv.Itoa(os.Getppid())
+	if pid != strconv.Itoa(os.Getpid()) && !passed {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("systemd: invalid LISTEN_FDS %q", fds)
+	}
+	var lns []net.Listener
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "systemd-listener-"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f)
+		f.Close() // FileListener dups it
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, fmt.Errorf("systemd: passed fd %d: %w", fd, err)
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+// PassListeners hands the listeners passed by systemd socket
+// activation, if any, to the next child process started, as when the
+// process restarts itself as another user. The child inherits their
+// file descriptors, which socket activation leaves open across exec,
+// and its Listeners returns them.
+func PassListeners() {
+	if pid := strconv.Itoa(os.Getpid()); os.Getenv("LISTEN_PID") == pid {
+		os.Setenv(listenParentEnv, pid)
+	}
+}
+
+// Notify sends systemd the messages msgs, such as Ready, over the
+// socket in $NOTIFY_SOCKET. It does nothing if that's unset, as when
+// not started by systemd or not as a Type=notify service.
+func Notify(msgs ...string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	if path[0] == '@' {
+		path = "\x00" + path[1:] // abstract socket
+	}
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("systemd: %w", err)
+	}
+	defer c.Close()
+	var b []byte
+	for _, m := range msgs {
+		b = append(append(b, m...), '\n')
+	}
+	if _, err := c.Write(b); err != nil {
+		return fmt.Errorf("systemd: %w", err)
+	}
+	return nil
+}
+
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify")
+	c, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	os.Setenv("NOTIFY_SOCKET", path)
+
+	if err := Notify(Ready, Status("Running")); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 100)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf[:n]), "READY=1\nSTATUS=Running\n"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+	if iv := WatchdogInterval(); iv != 0 {
+		t.Errorf("interval without watchdog = %v; want 0", iv)
+	}
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	if iv := WatchdogInterval(); iv != 30*time.Second {
+		t.Errorf("interval = %v; want 30s", iv)
+	}
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if iv := WatchdogInterval(); iv != 0 {
+		t.Errorf("interval for another process = %v; want 0", iv)
+	}
+}
+
+func TestListenersNotActivated(t *testing.T) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	lns, err := Listeners()
+	if err != nil || len(lns) != 0 {
+		t.Errorf("Listeners = %v, %v; want none", lns, err)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("LISTEN_FDS not unset")
+	}
+}
+
+func TestPassListeners(t *testing.T) {
+	defer os.Unsetenv(listenParentEnv)
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	PassListeners()
+	if got, want := os.Getenv(listenParentEnv), strconv.Itoa(os.Getpid()); got != want {
+		t.Fatalf("%s = %q; want %q", listenParentEnv, got, want)
+	}
+
+	// As the child: an invalid LISTEN_FDS shows the passed
+	// listeners are taken rather than ignored.
+	ppid := strconv.Itoa(os.Getppid())
+	os.Setenv("LISTEN_PID", ppid)
+	os.Setenv(listenParentEnv, ppid)
+	os.Setenv("LISTEN_FDS", "bogus")
+	if _, err := Listeners(); err == nil {
+		t.Error("Listeners ignored listeners passed by the parent")
+	}
+
+	// Not the parent's.
+	os.Setenv("LISTEN_PID", ppid)
+	os.Setenv(listenParentEnv, strconv.Itoa(os.Getppid()+1))
+	os.Setenv("LISTEN_FDS", "bogus")
+	if lns, err := Listeners(); err != nil || len(lns) != 0 {
+		t.Errorf("Listeners = %v, %v; want none", lns, err)
+	}
+}
@@ -4,7 +4,10 @@
 
 package version
 
-import "runtime"
+import (
+	"runtime"
+	"sync/atomic"
+)
 
 // IsMobile reports whether this is a mobile client build.
 func IsMobile() bool {
@@ -24,3 +27,51 @@ func OS() string {
 	}
 	return runtime.GOOS
 }
+
+// lowResource is whether SetLowResource turned on low-resource mode.
+// It's accessed atomically.
+var lowResource int32
+
+// IsLowResource reports whether to favor low memory and CPU use over
+// throughput and debuggability, for routers and single-board
+// computers. It's always true in builds with the ts_lowresource tag,
+// and otherwise set by SetLowResource.
+func IsLowResource() bool {
+	return lowResourceBuild || atomic.LoadInt32(&lowResource) != 0
+}
+
+// SetLowResource turns low-resource mode on or off at run time. It
+// can't be turned off in ts_lowresource builds.
+//
+// Memory set aside at startup, such as log buffers, is only sized for
+// low-resource mode in ts_lowresource builds.
+func SetLowResource(v bool) {
+	var n int32
+	if v {
+		n = 1
+	}
+	atomic.StoreInt32(&lowResource, n)
+}
+
+// sandboxed is whether SetSandboxed marked the process as sandboxed.
+// It's accessed atomically.
+var sandboxed int32
+
+// IsSandboxed reports whether the process may not fork or exec other
+// programs, as in an iOS or macOS Network Extension, so that whatever
+// would shell out to find something out must do without. It's always
+// true on iOS, and otherwise set by SetSandboxed.
+func IsSandboxed() bool {
+	return isIOS || atomic.LoadInt32(&sandboxed) != 0
+}
+
+// SetSandboxed sets whether the process is sandboxed, for hosts such
+// as a macOS Network Extension. It should be called before anything
+// else in the process uses this module.
+func SetSandboxed(v bool) {
+	var n int32
+	if v {
+		n = 1
+	}
+	atomic.StoreInt32(&sandboxed, n)
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package acltest runs declarative ACL tests, saying which sources
+// can and cannot reach which destinations, against compiled packet
+// filter rules, so that policy changes can be checked before they're
+// rolled out.
+package acltest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+
+	"inet.af/netaddr"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/filter"
+)
+
+// Test is one ACL test: Src must reach each destination in Accept
+// and must not reach any in Deny. Src is an IP address, and
+// destinations are "ip:port", such as "100.101.102.103:22" or
+// "[fd7a:115c:a1e0::1]:443".
+type Test struct {
+	Src    string   `json:"src"`
+	Accept []string `json:"accept,omitempty"`
+	Deny   []string `json:"deny,omitempty"`
+}
+
+// Failure is a check of a Test that didn't hold.
+type Failure struct {
+	Src  string `json:"src"`
+	Dst  string `json:"dst"`
+	Want bool   `json:"want"` // whether Src should have reached Dst
+}
+
+func (f Failure) String() string {
+	if f.Want {
+		return fmt.Sprintf("%s cannot reach %s, but should", f.Src, f.Dst)
+	}
+	return fmt.Sprintf("%s can reach %s, but shouldn't", f.Src, f.Dst)
+}
+
+// Parse parses tests from JSON: either an array of them or an object
+// whose "tests" field is, such as a policy file's, whose other fields
+// are ignored.
+func Parse(b []byte) ([]Test, error) {
+	var tests []Test
+	if err := json.Unmarshal(b, &tests); err == nil {
+		return tests, nil
+	}
+	var policy struct {
+		Tests []Test `json:"tests"`
+	}
+	if err := json.Unmarshal(b, &policy); err != nil {
+		return nil, err
+	}
+	return policy.Tests, nil
+}
+
+// Run runs tests against matches, returning the checks that failed.
+// It returns an error, and no failures, if a test is malformed.
+func Run(matches []filter.Match, tests []Test) ([]Failure, error) {
+	type check struct {
+		src, dst  string
+		srcIP, ip netaddr.IP
+		port      uint16
+		want      bool
+	}
+	var checks []check
+	for i, t := range tests {
+		src, err := netaddr.ParseIP(t.Src)
+		if err != nil {
+			return nil, fmt.Errorf("test %d: src %q: want an IP address", i, t.Src)
+		}
+		add := func(dsts []string, want bool) error {
+			for _, d := range dsts {
+				ip, port, err := parseDst(d)
+				if err != nil {
+					return fmt.Errorf("test %d: %v", i, err)
+				}
+				checks = append(checks, check{t.Src, d, src, ip, port, want})
+			}
+			return nil
+		}
+		if err := add(t.Accept, true); err != nil {
+			return nil, err
+		}
+		if err := add(t.Deny, false); err != nil {
+			return nil, err
+		}
+	}
+	f := newFilter(matches)
+	var failures []Failure
+	for _, c := range checks {
+		if allowed(f, c.srcIP, c.ip, c.port) != c.want {
+			failures = append(failures, Failure{Src: c.src, Dst: c.dst, Want: c.want})
+		}
+	}
+	return failures, nil
+}
+
+// Allowed reports whether matches let src reach dst on port, as a
+// packet filter with them would decide for a new TCP connection.
+func Allowed(matches []filter.Match, src, dst netaddr.IP, port uint16) bool {
+	return allowed(newFilter(matches), src, dst, port)
+}
+
+func allowed(f *filter.Filter, src, dst netaddr.IP, port uint16) bool {
+	return f.CheckTCP(src, dst, port) == filter.Accept
+}
+
+// allNets is every address, so that a filter doesn't drop packets for
+// not being to one of its own.
+var allNets = []netaddr.IPPrefix{
+	{IP: netaddr.IPv4(0, 0, 0, 0), Bits: 0},
+	{IP: netaddr.IPFrom16([16]byte{}), Bits: 0},
+}
+
+// newFilter returns a packet filter with matches, as the node whose
+// packet filter they are would run, for any destination.
+func newFilter(matches []filter.Match) *filter.Filter {
+	return filter.New(matches, allNets, nil, logger.Discard)
+}
+
+// parseDst parses a destination of the form "ip:port".
+func parseDst(s string) (netaddr.IP, uint16, error) {
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return netaddr.IP{}, 0, fmt.Errorf("dst %q: want ip:port", s)
+	}
+	ip, err := netaddr.ParseIP(host)
+	if err != nil {
+		return netaddr.IP{}, 0, fmt.Errorf("dst %q: want an IP address", s)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return netaddr.IP{}, 0, fmt.Errorf("dst %q: invalid port", s)
+	}
+	return ip, uint16(port), nil
+}
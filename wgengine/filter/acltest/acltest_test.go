@@ -0,0 +1,68 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package acltest
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/wgengine/filter"
+)
+
+func TestRun(t *testing.T) {
+	var rules []tailcfg.FilterRule
+	err := json.Unmarshal([]byte(`[
+		{"SrcIPs": ["100.64.0.1"], "DstPorts": [{"IP": "100.64.0.2", "Ports": {"First": 22, "Last": 22}}]},
+		{"SrcIPs": ["*"], "DstPorts": [{"IP": "100.64.0.2", "Ports": {"First": 443, "Last": 443}}]},
+		{"SrcIPs": ["fd7a:115c:a1e0::1"], "DstPorts": [{"IP": "fd7a:115c:a1e0::2", "Ports": {"First": 0, "Last": 65535}}]}
+	]`), &rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches, err := filter.MatchesFromFilterRules(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests, err := Parse([]byte(`{
+		"acls": [],
+		"tests": [
+			{"src": "100.64.0.1", "accept": ["100.64.0.2:22", "100.64.0.2:443"], "deny": ["100.64.0.2:80"]},
+			{"src": "100.64.0.3", "accept": ["100.64.0.2:443", "100.64.0.2:22"]},
+			{"src": "100.64.0.3", "deny": ["100.64.0.2:443"]},
+			{"src": "fd7a:115c:a1e0::1", "accept": ["[fd7a:115c:a1e0::2]:8080"]}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Run(matches, tests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Failure{
+		{Src: "100.64.0.3", Dst: "100.64.0.2:22", Want: true},
+		{Src: "100.64.0.3", Dst: "100.64.0.2:443", Want: false},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("failures = %v; want %v", got, want)
+	}
+
+	for _, bad := range []string{
+		`[{"src": "alice@example.com", "accept": ["100.64.0.2:22"]}]`,
+		`[{"src": "100.64.0.1", "accept": ["100.64.0.2"]}]`,
+		`[{"src": "100.64.0.1", "deny": ["100.64.0.2:http"]}]`,
+	} {
+		tests, err := Parse([]byte(bad))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Run(matches, tests); err == nil {
+			t.Errorf("Run(%s) succeeded; want error", bad)
+		}
+	}
+}
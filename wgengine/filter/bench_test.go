@@ -0,0 +1,150 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"fmt"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+	"tailscale.com/types/logger"
+)
+
+// benchSrc returns the source of the i'th rule of benchFilter, in
+// the given IP version.
+func benchSrc(i, ipVersion int) netaddr.IP {
+	if ipVersion == 4 {
+		return netaddr.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+	}
+	return netaddr.IPFrom16([16]byte{0: 0xfd, 1: 0x7a, 13: byte(i >> 16), 14: byte(i >> 8), 15: byte(i)})
+}
+
+const (
+	benchDst4 = "100.64.0.1"
+	benchDst6 = "fd7a:115c:a1e0::1"
+)
+
+// benchFilter returns a filter of n rules, each letting a different
+// IPv4 and IPv6 source reach port 22 of this node.
+func benchFilter(logf logger.Logf, n int) *Filter {
+	var ms []Match
+	for i := 0; i < n; i++ {
+		ms = append(ms, Match{
+			Srcs: []netaddr.IPPrefix{
+				{IP: benchSrc(i, 4), Bits: 32},
+				{IP: benchSrc(i, 6), Bits: 128},
+			},
+			Dsts: netports(benchDst4+":22", benchDst6+":22"),
+		})
+	}
+	return New(ms, nets(benchDst4, benchDst6), nil, logf)
+}
+
+// benchPacket returns a parsed packet of proto from the source of
+// the i'th rule of benchFilter to port 22.
+func benchPacket(proto packet.IPProto, i, ipVersion int) *packet.Parsed {
+	var b []byte
+	src := benchSrc(i, ipVersion).String()
+	if ipVersion == 4 {
+		b = raw4(proto, src, benchDst4, 999, 22, 0)
+	} else {
+		b = raw6(proto, src, benchDst6, 999, 22, 0)
+	}
+	q := new(packet.Parsed)
+	q.Decode(b)
+	return q
+}
+
+// BenchmarkRunInRules measures the cost of a TCP SYN that only the
+// last rule allows, by the number of rules.
+func BenchmarkRunInRules(b *testing.B) {
+	for _, ipVersion := range []int{4, 6} {
+		for _, n := range []int{1, 10, 100, 1000, 10000} {
+			b.Run(fmt.Sprintf("v%d/%d", ipVersion, n), func(b *testing.B) {
+				f := benchFilter(logger.Discard, n)
+				q := benchPacket(packet.TCP, n-1, ipVersion)
+				if r := f.RunIn(q, nil, 0); r != Accept {
+					b.Fatalf("RunIn = %v; want Accept", r)
+				}
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					f.RunIn(q, nil, 0)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkRunInUDP measures the cost of an inbound UDP packet that
+// replies to a flow sent out (cached), or that a rule allows
+// (uncached), with 100 rules.
+func BenchmarkRunInUDP(b *testing.B) {
+	for _, ipVersion := range []int{4, 6} {
+		for _, cached := range []bool{true, false} {
+			name := fmt.Sprintf("v%d/uncached", ipVersion)
+			if cached {
+				name = fmt.Sprintf("v%d/cached", ipVersion)
+			}
+			b.Run(name, func(b *testing.B) {
+				f := benchFilter(logger.Discard, 100)
+				defer f.Close()
+				q := benchPacket(packet.UDP, 99, ipVersion)
+				if cached {
+					var reply *packet.Parsed
+					if ipVersion == 4 {
+						reply = ptr(parsed(packet.UDP, benchDst4, benchSrc(99, 4).String(), 22, 999))
+					} else {
+						reply = ptr(parsed(packet.UDP, benchDst6, benchSrc(99, 6).String(), 22, 999))
+					}
+					f.RunOut(reply, 0)
+				}
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					f.RunIn(q, nil, 0)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkRunInParallel measures RunIn on many goroutines at once,
+// as for packets from several peers, where the flow table's lock is
+// contended.
+func BenchmarkRunInParallel(b *testing.B) {
+	for _, proto := range []packet.IPProto{packet.TCP, packet.UDP} {
+		b.Run(proto.String(), func(b *testing.B) {
+			f := benchFilter(logger.Discard, 100)
+			q := benchPacket(proto, 99, 4)
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				q := *q
+				for pb.Next() {
+					f.RunIn(&q, nil, 0)
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkRunInSrcSet measures the cost of checking packets'
+// sources against peers' allowed IPs, for a tailnet of 1000 peers.
+func BenchmarkRunInSrcSet(b *testing.B) {
+	f := benchFilter(logger.Discard, 1000)
+	var prefixes []netaddr.IPPrefix
+	for i := 0; i < 1000; i++ {
+		prefixes = append(prefixes, netaddr.IPPrefix{IP: benchSrc(i, 4), Bits: 32})
+	}
+	srcs := NewSrcSet(prefixes)
+	q := benchPacket(packet.TCP, 999, 4)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.RunIn(q, srcs, 0)
+	}
+}
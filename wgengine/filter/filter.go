@@ -10,11 +10,11 @@ import (
 	"sync"
 	"time"
 
-	"github.com/golang/groupcache/lru"
 	"golang.org/x/time/rate"
 	"inet.af/netaddr"
 	"tailscale.com/net/packet"
 	"tailscale.com/types/logger"
+	"tailscale.com/version"
 )
 
 // Filter is a stateful packet filter.
@@ -34,12 +34,20 @@ type Filter struct {
 	// match is to drop the packet.
 	matches4 matches4
 	matches6 matches6
+	// matches and localNets are the values New was called with,
+	// for NFTables and Matches.
+	matches   []Match
+	localNets []netaddr.IPPrefix
 	// state is the connection tracking state attached to this
 	// filter. It is used to allow incoming traffic that is a response
 	// to an outbound connection that this node made, even if those
 	// incoming packets don't get accepted by matches above.
 	state4 *filterState
 	state6 *filterState
+
+	housekeepOnce sync.Once
+	closeOnce     sync.Once
+	closed        chan struct{} // closed by Close
 }
 
 // tuple4 is a 4-tuple of source and destination IPv4 and port. It's
@@ -62,12 +70,16 @@ type tuple6 struct {
 
 // filterState is a state cache of past seen packets.
 type filterState struct {
-	mu  sync.Mutex
-	lru *lru.Cache // of tuple4 or tuple6
+	mu    sync.Mutex
+	flows *flowTable // of tuple4 or tuple6
 }
 
-// lruMax is the size of the LRU cache in filterState.
-const lruMax = 512
+// lruMax is the size of the flow table in filterState, and
+// lruMaxLowResource its size in low-resource mode.
+const (
+	lruMax            = 512
+	lruMaxLowResource = 128
+)
 
 // Response is a verdict from the packet filter.
 type Response int
@@ -101,6 +113,48 @@ const (
 	HexdumpAccepts                      // print packet hexdump when logging accepts
 )
 
+// SrcSet is a set of IP prefixes that incoming packets' sources must
+// be in: the WireGuard allowed IPs of the peer they arrived from.
+// Checking it guards against a compromised peer sending as another
+// tailnet IP, independently of the WireGuard implementation's own
+// checks. A nil *SrcSet allows any source.
+type SrcSet struct {
+	nets4 []net4
+	nets6 []net6
+}
+
+// NewSrcSet returns a SrcSet of prefixes.
+func NewSrcSet(prefixes []netaddr.IPPrefix) *SrcSet {
+	return &SrcSet{
+		nets4: nets4FromIPPrefixes(prefixes),
+		nets6: nets6FromIPPrefixes(prefixes),
+	}
+}
+
+// UnionSrcSets returns a SrcSet of the sources in any of sets.
+func UnionSrcSets(sets ...*SrcSet) *SrcSet {
+	ret := new(SrcSet)
+	for _, s := range sets {
+		ret.nets4 = append(ret.nets4, s.nets4...)
+		ret.nets6 = append(ret.nets6, s.nets6...)
+	}
+	return ret
+}
+
+// contains reports whether q's source is in s.
+func (s *SrcSet) contains(q *packet.Parsed) bool {
+	if s == nil {
+		return true
+	}
+	switch q.IPVersion {
+	case 4:
+		return ip4InList(q.SrcIP4, s.nets4)
+	case 6:
+		return ip6InList(q.SrcIP6, s.nets6)
+	}
+	return false
+}
+
 // NewAllowAllForTest returns a packet filter that accepts
 // everything. Use in tests only, as it permits some kinds of spoofing
 // attacks to reach the OS network stack.
@@ -153,11 +207,15 @@ func New(matches []Match, localNets []netaddr.IPPrefix, shareStateWith *Filter,
 		state4 = shareStateWith.state4
 		state6 = shareStateWith.state6
 	} else {
+		n := lruMax
+		if version.IsLowResource() {
+			n = lruMaxLowResource
+		}
 		state4 = &filterState{
-			lru: lru.New(lruMax),
+			flows: newFlowTable(n),
 		}
 		state6 = &filterState{
-			lru: lru.New(lruMax),
+			flows: newFlowTable(n),
 		}
 	}
 	f := &Filter{
@@ -168,12 +226,22 @@ func New(matches []Match, localNets []netaddr.IPPrefix, shareStateWith *Filter,
 		local6:   nets6FromIPPrefixes(localNets),
 		state4:   state4,
 		state6:   state6,
+
+		matches:   matches,
+		localNets: localNets,
+
+		closed: make(chan struct{}),
 	}
 	return f
 }
 
+// Matches returns the rules f was created with.
+func (f *Filter) Matches() []Match {
+	return append([]Match(nil), f.matches...)
+}
+
 func maybeHexdump(flag RunFlags, b []byte) string {
-	if flag == 0 {
+	if flag == 0 || version.IsLowResource() {
 		return ""
 	}
 	return packet.Hexdump(b) + "\n"
@@ -187,6 +255,13 @@ func maybeHexdump(flag RunFlags, b []byte) string {
 var acceptBucket = rate.NewLimiter(rate.Every(10*time.Second), 3)
 var dropBucket = rate.NewLimiter(rate.Every(5*time.Second), 10)
 
+// logAll reports whether every verdict should be logged, rather
+// than a rate-limited sample: when the filter's log component is at
+// debug level.
+func logAll() bool {
+	return logger.ComponentLevel("filter") >= logger.LevelDebug
+}
+
 func (f *Filter) logRateLimit(runflags RunFlags, q *packet.Parsed, dir direction, r Response, why string) {
 	var verdict string
 
@@ -194,10 +269,10 @@ func (f *Filter) logRateLimit(runflags RunFlags, q *packet.Parsed, dir direction
 		return
 	}
 
-	if r == Drop && (runflags&LogDrops) != 0 && dropBucket.Allow() {
+	if r == Drop && (runflags&LogDrops) != 0 && (logAll() || dropBucket.Allow()) {
 		verdict = "Drop"
 		runflags &= HexdumpDrops
-	} else if r == Accept && (runflags&LogAccepts) != 0 && acceptBucket.Allow() {
+	} else if r == Accept && (runflags&LogAccepts) != 0 && !version.IsLowResource() && (logAll() || acceptBucket.Allow()) {
 		verdict = "Accept"
 		runflags &= HexdumpAccepts
 	}
@@ -243,19 +318,31 @@ func (f *Filter) CheckTCP(srcIP, dstIP netaddr.IP, dstPort uint16) Response {
 	pkt.SrcPort = 0
 	pkt.DstPort = dstPort
 
-	return f.RunIn(pkt, 0)
+	return f.RunIn(pkt, nil, 0)
 }
 
 // RunIn determines whether this node is allowed to receive q from a
-// Tailscale peer.
-func (f *Filter) RunIn(q *packet.Parsed, rf RunFlags) Response {
+// Tailscale peer whose allowed IPs are srcs. If srcs is nil, q's
+// source isn't checked.
+func (f *Filter) RunIn(q *packet.Parsed, srcs *SrcSet, rf RunFlags) Response {
+	if profileLabels {
+		defer setStage(stageNone)
+	}
+	setStage(stagePre)
 	dir := in
 	r := f.pre(q, rf, dir)
 	if r == Accept || r == Drop {
 		// already logged
 		return r
 	}
+	if !srcs.contains(q) {
+		// A peer sending from an IP that isn't its own, as
+		// if it were another node.
+		f.logRateLimit(rf, q, dir, Drop, "source not allowed from peer")
+		return Drop
+	}
 
+	setStage(stageIn)
 	var why string
 	switch q.IPVersion {
 	case 4:
@@ -269,15 +356,63 @@ func (f *Filter) RunIn(q *packet.Parsed, rf RunFlags) Response {
 	return r
 }
 
+// RunInBatch is like RunIn for a batch of packets received together,
+// setting rs[i] to the verdict on qs[i], from a peer whose allowed IPs
+// are srcs[i]. If srcs is nil, no packet's source is checked. A packet
+// of the same TCP or UDP flow and peer as the one before it, such as
+// the next segment of a TCP stream, gets the same verdict without
+// being checked again.
+func (f *Filter) RunInBatch(qs []*packet.Parsed, srcs []*SrcSet, rf RunFlags, rs []Response) {
+	srcsOf := func(i int) *SrcSet {
+		if srcs == nil {
+			return nil
+		}
+		return srcs[i]
+	}
+	for i, q := range qs {
+		if i > 0 && srcsOf(i-1) == srcsOf(i) && sameFlowVerdict(qs[i-1], q) {
+			rs[i] = rs[i-1]
+			continue
+		}
+		rs[i] = f.RunIn(q, srcsOf(i), rf)
+	}
+}
+
+// sameFlowVerdict reports whether RunIn would decide the same about q
+// as about prev, because they're of the same TCP or UDP flow.
+func sameFlowVerdict(prev, q *packet.Parsed) bool {
+	if q.IPProto != prev.IPProto || q.IPVersion != prev.IPVersion {
+		return false
+	}
+	switch q.IPProto {
+	case packet.TCP:
+		// Only SYNs are checked against the rules.
+		if q.IsTCPSyn() || prev.IsTCPSyn() {
+			return false
+		}
+	case packet.UDP:
+	default:
+		return false
+	}
+	return q.SrcIP4 == prev.SrcIP4 && q.DstIP4 == prev.DstIP4 &&
+		q.SrcIP6 == prev.SrcIP6 && q.DstIP6 == prev.DstIP6 &&
+		q.SrcPort == prev.SrcPort && q.DstPort == prev.DstPort
+}
+
 // RunOut determines whether this node is allowed to send q to a
 // Tailscale peer.
 func (f *Filter) RunOut(q *packet.Parsed, rf RunFlags) Response {
+	if profileLabels {
+		defer setStage(stageNone)
+	}
+	setStage(stagePre)
 	dir := out
 	r := f.pre(q, rf, dir)
 	if r == Drop || r == Accept {
 		// already logged
 		return r
 	}
+	setStage(stageOut)
 	r, why := f.runOut(q)
 	f.logRateLimit(rf, q, dir, r, why)
 	return r
@@ -323,7 +458,7 @@ func (f *Filter) runIn4(q *packet.Parsed) (r Response, why string) {
 		t := tuple4{q.SrcIP4, q.DstIP4, q.SrcPort, q.DstPort}
 
 		f.state4.mu.Lock()
-		_, ok := f.state4.lru.Get(t)
+		ok := f.state4.flows.get(t)
 		f.state4.mu.Unlock()
 
 		if ok {
@@ -378,7 +513,7 @@ func (f *Filter) runIn6(q *packet.Parsed) (r Response, why string) {
 		t := tuple6{q.SrcIP6, q.DstIP6, q.SrcPort, q.DstPort}
 
 		f.state6.mu.Lock()
-		_, ok := f.state6.lru.Get(t)
+		ok := f.state6.flows.get(t)
 		f.state6.mu.Unlock()
 
 		if ok {
@@ -398,19 +533,20 @@ func (f *Filter) runOut(q *packet.Parsed) (r Response, why string) {
 	if q.IPProto != packet.UDP {
 		return Accept, "ok out"
 	}
+	f.startHousekeeping()
 
 	switch q.IPVersion {
 	case 4:
 		t := tuple4{q.DstIP4, q.SrcIP4, q.DstPort, q.SrcPort}
-		var ti interface{} = t // allocate once, rather than twice inside mutex
+		var ti interface{} = t // allocate outside the mutex
 		f.state4.mu.Lock()
-		f.state4.lru.Add(ti, ti)
+		f.state4.flows.add(ti)
 		f.state4.mu.Unlock()
 	case 6:
 		t := tuple6{q.DstIP6, q.SrcIP6, q.DstPort, q.SrcPort}
-		var ti interface{} = t // allocate once, rather than twice inside mutex
+		var ti interface{} = t // allocate outside the mutex
 		f.state6.mu.Lock()
-		f.state6.lru.Add(ti, ti)
+		f.state6.flows.add(ti)
 		f.state6.mu.Unlock()
 	}
 	return Accept, "ok out"
@@ -120,7 +120,7 @@ func TestUDPState(t *testing.T) {
 	b4 := parsed(packet.UDP, "102.102.102.102", "119.119.119.119", 4343, 4242)
 
 	// Unsollicited UDP traffic gets dropped
-	if got := acl.RunIn(&a4, flags); got != Drop {
+	if got := acl.RunIn(&a4, nil, flags); got != Drop {
 		t.Fatalf("incoming initial packet not dropped, got=%v: %v", got, a4)
 	}
 	// We talk to that peer
@@ -128,7 +128,7 @@ func TestUDPState(t *testing.T) {
 		t.Fatalf("outbound packet didn't egress, got=%v: %v", got, b4)
 	}
 	// Now, the same packet as before is allowed back.
-	if got := acl.RunIn(&a4, flags); got != Accept {
+	if got := acl.RunIn(&a4, nil, flags); got != Accept {
 		t.Fatalf("incoming response packet not accepted, got=%v: %v", got, a4)
 	}
 
@@ -136,7 +136,7 @@ func TestUDPState(t *testing.T) {
 	b6 := parsed(packet.UDP, "2001::1", "2001::2", 4343, 4242)
 
 	// Unsollicited UDP traffic gets dropped
-	if got := acl.RunIn(&a6, flags); got != Drop {
+	if got := acl.RunIn(&a6, nil, flags); got != Drop {
 		t.Fatalf("incoming initial packet not dropped: %v", a4)
 	}
 	// We talk to that peer
@@ -144,11 +144,74 @@ func TestUDPState(t *testing.T) {
 		t.Fatalf("outbound packet didn't egress: %v", b4)
 	}
 	// Now, the same packet as before is allowed back.
-	if got := acl.RunIn(&a6, flags); got != Accept {
+	if got := acl.RunIn(&a6, nil, flags); got != Accept {
 		t.Fatalf("incoming response packet not accepted: %v", a4)
 	}
 }
 
+func TestRunInBatch(t *testing.T) {
+	acl := newFilter(t.Logf)
+
+	ack := func(p packet.Parsed) packet.Parsed {
+		p.TCPFlags = packet.TCPAck
+		return p
+	}
+	syn := parsed(packet.TCP, "8.1.1.1", "1.2.3.4", 999, 22)
+	badSyn := parsed(packet.TCP, "8.1.1.1", "1.2.3.4", 999, 21)
+	udp := parsed(packet.UDP, "119.119.119.119", "102.102.102.102", 4242, 4343)
+	qs := []*packet.Parsed{&syn, ptr(ack(syn)), &badSyn, ptr(ack(badSyn)), &udp, &udp}
+	want := []Response{Accept, Accept, Drop, Accept, Drop, Drop}
+
+	got := make([]Response, len(qs))
+	acl.RunInBatch(qs, nil, 0, got)
+	for i := range qs {
+		if got[i] != want[i] {
+			t.Errorf("#%d got=%v want=%v packet:%v", i, got[i], want[i], qs[i])
+		}
+		if one := acl.RunIn(qs[i], nil, 0); one != got[i] {
+			t.Errorf("#%d got=%v but RunIn=%v packet:%v", i, got[i], one, qs[i])
+		}
+	}
+}
+
+func ptr(p packet.Parsed) *packet.Parsed { return &p }
+
+func TestSrcSet(t *testing.T) {
+	acl := newFilter(t.Logf)
+	syn4 := parsed(packet.TCP, "8.1.1.1", "1.2.3.4", 999, 22)
+	syn6 := parsed(packet.TCP, "::1", "2001::1", 999, 22)
+
+	tests := []struct {
+		name string
+		srcs *SrcSet
+		q    *packet.Parsed
+		want Response
+	}{
+		{"nil_v4", nil, &syn4, Accept},
+		{"nil_v6", nil, &syn6, Accept},
+		{"own_v4", NewSrcSet(nets("100.64.0.2", "8.1.0.0/16")), &syn4, Accept},
+		{"own_v6", NewSrcSet(nets("100.64.0.2", "::1")), &syn6, Accept},
+		{"spoofed_v4", NewSrcSet(nets("100.64.0.2", "::1")), &syn4, Drop},
+		{"spoofed_v6", NewSrcSet(nets("100.64.0.2", "8.1.0.0/16")), &syn6, Drop},
+		{"empty", NewSrcSet(nil), &syn4, Drop},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := acl.RunIn(tt.q, tt.srcs, 0); got != tt.want {
+				t.Errorf("RunIn = %v; want %v", got, tt.want)
+			}
+		})
+	}
+
+	// The same flow from another peer is checked again in a batch.
+	owner, other := NewSrcSet(nets("8.1.0.0/16")), NewSrcSet(nets("100.64.0.2"))
+	rs := make([]Response, 2)
+	acl.RunInBatch([]*packet.Parsed{&syn4, &syn4}, []*SrcSet{owner, other}, 0, rs)
+	if rs[0] != Accept || rs[1] != Drop {
+		t.Errorf("RunInBatch = %v; want [Accept Drop]", rs)
+	}
+}
+
 func TestNoAllocs(t *testing.T) {
 	acl := newFilter(t.Logf)
 
@@ -181,7 +244,7 @@ func TestNoAllocs(t *testing.T) {
 				q.Decode(test.packet)
 				switch test.dir {
 				case in:
-					acl.RunIn(q, 0)
+					acl.RunIn(q, nil, 0)
 				case out:
 					acl.RunOut(q, 0)
 				}
@@ -262,7 +325,7 @@ func BenchmarkFilter(b *testing.B) {
 				q.Decode(bench.packet)
 				// This branch seems to have no measurable impact on performance.
 				if bench.dir == in {
-					acl.RunIn(q, 0)
+					acl.RunIn(q, nil, 0)
 				} else {
 					acl.RunOut(q, 0)
 				}
@@ -0,0 +1,193 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"container/list"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+)
+
+const (
+	// housekeepingInterval is how often a Filter's housekeeping
+	// runs, once it has flows to look after.
+	housekeepingInterval = 30 * time.Second
+
+	// flowIdleTimeout is how long a UDP flow may go unseen before
+	// it's forgotten, as for Linux conntrack's UDP streams.
+	flowIdleTimeout = 3 * time.Minute
+)
+
+// flowTable is the set of UDP flows recently sent out, whose replies
+// are let back in. It's an LRU cache of at most max flows that also
+// forgets flows idle for flowIdleTimeout. Its owner does the locking.
+//
+// Flows are timestamped with the time of the last housekeeping run
+// rather than the time they're seen, which would cost a clock read
+// per packet; they're forgotten up to a housekeepingInterval late.
+type flowTable struct {
+	max int
+	now time.Time                     // of the last housekeeping run
+	ll  *list.List                    // of *flowEntry, most recently seen first
+	m   map[interface{}]*list.Element // tuple4 or tuple6 => element in ll
+}
+
+type flowEntry struct {
+	key      interface{} // tuple4 or tuple6
+	lastSeen time.Time   // flowTable.now when last seen
+}
+
+func newFlowTable(max int) *flowTable {
+	return &flowTable{
+		max: max,
+		ll:  list.New(),
+		m:   make(map[interface{}]*list.Element),
+	}
+}
+
+// get reports whether k is in t, noting it as seen if so.
+func (t *flowTable) get(k interface{}) bool {
+	e, ok := t.m[k]
+	if !ok {
+		return false
+	}
+	e.Value.(*flowEntry).lastSeen = t.now
+	t.ll.MoveToFront(e)
+	return true
+}
+
+// add adds k to t, or notes it as seen if already there, evicting
+// the least recently seen flow if t is full.
+func (t *flowTable) add(k interface{}) {
+	if e, ok := t.m[k]; ok {
+		e.Value.(*flowEntry).lastSeen = t.now
+		t.ll.MoveToFront(e)
+		return
+	}
+	t.m[k] = t.ll.PushFront(&flowEntry{key: k, lastSeen: t.now})
+	if t.ll.Len() > t.max {
+		t.remove(t.ll.Back())
+	}
+}
+
+func (t *flowTable) remove(e *list.Element) {
+	t.ll.Remove(e)
+	delete(t.m, e.Value.(*flowEntry).key)
+}
+
+func (t *flowTable) len() int { return t.ll.Len() }
+
+// expire is called on each housekeeping run, at now. It forgets the
+// flows idle for flowIdleTimeout.
+func (t *flowTable) expire(now time.Time) {
+	if now.Sub(t.now) > 2*housekeepingInterval {
+		// Housekeeping wasn't running, so the timestamps are
+		// stale. Start them afresh.
+		for e := t.ll.Front(); e != nil; e = e.Next() {
+			e.Value.(*flowEntry).lastSeen = now
+		}
+	}
+	t.now = now
+	for e := t.ll.Back(); e != nil; e = t.ll.Back() {
+		if now.Sub(e.Value.(*flowEntry).lastSeen) < flowIdleTimeout {
+			break // the rest are more recent
+		}
+		t.remove(e)
+	}
+}
+
+// startHousekeeping starts f's housekeeping, unless it's already
+// running. It's called when f first has flow state to look after, so
+// that filters never used to send packets don't run it.
+func (f *Filter) startHousekeeping() {
+	f.housekeepOnce.Do(func() {
+		go f.housekeep()
+	})
+}
+
+// housekeep runs every housekeepingInterval until Close, forgetting
+// idle flows.
+func (f *Filter) housekeep() {
+	t := time.NewTicker(housekeepingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-f.closed:
+			return
+		case <-t.C:
+		}
+		f.expireFlows(time.Now())
+	}
+}
+
+// expireFlows forgets the flows that have been idle too long at now.
+func (f *Filter) expireFlows(now time.Time) {
+	for _, st := range []*filterState{f.state4, f.state6} {
+		st.mu.Lock()
+		st.flows.expire(now)
+		st.mu.Unlock()
+	}
+}
+
+// Close stops f's housekeeping. f still filters packets afterwards,
+// as a filter that shares its state might still be in use, but its
+// flow state is no longer expired except by LRU eviction.
+func (f *Filter) Close() error {
+	f.closeOnce.Do(func() { close(f.closed) })
+	return nil
+}
+
+// Flow is a UDP flow whose replies a Filter lets in, given as the
+// addresses and ports of the replies.
+type Flow struct {
+	Src, Dst         netaddr.IP
+	SrcPort, DstPort uint16
+}
+
+// Flows returns the UDP flows whose replies f lets in, most recently
+// seen first. It's for handing f's state to another process; see
+// AddFlows.
+func (f *Filter) Flows() []Flow {
+	var flows []Flow
+	for _, st := range []*filterState{f.state4, f.state6} {
+		st.mu.Lock()
+		for e := st.flows.ll.Front(); e != nil; e = e.Next() {
+			switch k := e.Value.(*flowEntry).key.(type) {
+			case tuple4:
+				flows = append(flows, Flow{k.SrcIP.Netaddr(), k.DstIP.Netaddr(), k.SrcPort, k.DstPort})
+			case tuple6:
+				flows = append(flows, Flow{k.SrcIP.Netaddr(), k.DstIP.Netaddr(), k.SrcPort, k.DstPort})
+			}
+		}
+		st.mu.Unlock()
+	}
+	return flows
+}
+
+// AddFlows adds flows, as returned by another Filter's Flows, to f's
+// state, as if their packets had just been sent out.
+func (f *Filter) AddFlows(flows []Flow) {
+	if len(flows) == 0 {
+		return
+	}
+	f.startHousekeeping()
+	// Add the least recently seen first, so that they stay in order.
+	for i := len(flows) - 1; i >= 0; i-- {
+		fl := flows[i]
+		if fl.Src.Is4() && fl.Dst.Is4() {
+			var k interface{} = tuple4{packet.IP4FromNetaddr(fl.Src), packet.IP4FromNetaddr(fl.Dst), fl.SrcPort, fl.DstPort}
+			f.state4.mu.Lock()
+			f.state4.flows.add(k)
+			f.state4.mu.Unlock()
+		} else if fl.Src.Is6() && fl.Dst.Is6() {
+			var k interface{} = tuple6{packet.IP6FromNetaddr(fl.Src), packet.IP6FromNetaddr(fl.Dst), fl.SrcPort, fl.DstPort}
+			f.state6.mu.Lock()
+			f.state6.flows.add(k)
+			f.state6.mu.Unlock()
+		}
+	}
+}
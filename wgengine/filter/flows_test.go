@@ -0,0 +1,108 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"testing"
+	"time"
+
+	"tailscale.com/net/packet"
+)
+
+func TestFlowTable(t *testing.T) {
+	ft := newFlowTable(2)
+	now := time.Now()
+	ft.expire(now)
+
+	ft.add(1)
+	ft.add(2)
+	ft.add(3) // evicts 1
+	if ft.get(1) || !ft.get(2) || !ft.get(3) {
+		t.Fatalf("LRU eviction: have %d flows", ft.len())
+	}
+
+	// 3 keeps being seen; 2 goes idle.
+	for d := housekeepingInterval; d <= flowIdleTimeout; d += housekeepingInterval {
+		ft.expire(now.Add(d))
+		ft.get(3)
+	}
+	if ft.get(2) {
+		t.Error("idle flow not expired")
+	}
+	if !ft.get(3) {
+		t.Error("active flow expired")
+	}
+
+	// After a gap in housekeeping, flows aren't judged idle by
+	// their stale timestamps.
+	ft.expire(now.Add(time.Hour))
+	if !ft.get(3) {
+		t.Error("flow expired after housekeeping gap")
+	}
+}
+
+func TestFilterExpireFlows(t *testing.T) {
+	acl := newFilter(t.Logf)
+	defer acl.Close()
+
+	a4 := parsed(packet.UDP, "119.119.119.119", "102.102.102.102", 4242, 4343)
+	b4 := parsed(packet.UDP, "102.102.102.102", "119.119.119.119", 4343, 4242)
+
+	now := time.Now()
+	acl.expireFlows(now)
+	if got := acl.RunOut(&b4, 0); got != Accept {
+		t.Fatalf("outbound packet didn't egress, got=%v", got)
+	}
+	acl.expireFlows(now.Add(housekeepingInterval))
+	if got := acl.RunIn(&a4, nil, 0); got != Accept {
+		t.Fatalf("response to recent flow not accepted, got=%v", got)
+	}
+	for d := housekeepingInterval; d <= flowIdleTimeout+housekeepingInterval; d += housekeepingInterval {
+		acl.expireFlows(now.Add(housekeepingInterval + d))
+	}
+	if got := acl.RunIn(&a4, nil, 0); got != Drop {
+		t.Fatalf("response to idle flow not dropped, got=%v", got)
+	}
+
+	// Close is idempotent, and the filter keeps working.
+	acl.Close()
+	if got := acl.RunOut(&b4, 0); got != Accept {
+		t.Fatalf("outbound packet after Close didn't egress, got=%v", got)
+	}
+}
+
+func TestFilterFlowsHandoff(t *testing.T) {
+	acl := newFilter(t.Logf)
+	defer acl.Close()
+
+	a4 := parsed(packet.UDP, "119.119.119.119", "102.102.102.102", 4242, 4343)
+	b4 := parsed(packet.UDP, "102.102.102.102", "119.119.119.119", 4343, 4242)
+	a6 := parsed(packet.UDP, "2001::2", "2001::1", 53, 5353)
+	b6 := parsed(packet.UDP, "2001::1", "2001::2", 5353, 53)
+	acl.RunOut(&b4, 0)
+	acl.RunOut(&b6, 0)
+
+	flows := acl.Flows()
+	if len(flows) != 2 {
+		t.Fatalf("Flows = %v; want 2", flows)
+	}
+	want := Flow{mustIP("119.119.119.119"), mustIP("102.102.102.102"), 4242, 4343}
+	if flows[0] != want {
+		t.Errorf("Flows()[0] = %v; want %v", flows[0], want)
+	}
+
+	acl2 := newFilter(t.Logf)
+	defer acl2.Close()
+	if got := acl2.RunIn(&a4, nil, 0); got != Drop {
+		t.Fatalf("reply without flow not dropped, got=%v", got)
+	}
+	acl2.AddFlows(flows)
+	if got := acl2.RunIn(&a4, nil, 0); got != Accept {
+		t.Errorf("IPv4 reply to handed-off flow not accepted, got=%v", got)
+	}
+	if got := acl2.RunIn(&a6, nil, 0); got != Accept {
+		t.Errorf("IPv6 reply to handed-off flow not accepted, got=%v", got)
+	}
+}
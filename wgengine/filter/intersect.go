@@ -0,0 +1,79 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import "inet.af/netaddr"
+
+// Intersect returns rules that match exactly the packets matched by
+// both a and b.
+func Intersect(a, b []Match) []Match {
+	var ret []Match
+	for _, ma := range a {
+		for _, mb := range b {
+			m := Match{
+				Srcs: intersectPrefixes(ma.Srcs, mb.Srcs),
+			}
+			if len(m.Srcs) == 0 {
+				continue
+			}
+			for _, da := range ma.Dsts {
+				for _, db := range mb.Dsts {
+					if d, ok := intersectNetPortRange(da, db); ok {
+						m.Dsts = append(m.Dsts, d)
+					}
+				}
+			}
+			if len(m.Dsts) > 0 {
+				ret = append(ret, m)
+			}
+		}
+	}
+	return ret
+}
+
+// intersectPrefixes returns the prefixes covering the addresses in
+// both a and b.
+func intersectPrefixes(a, b []netaddr.IPPrefix) []netaddr.IPPrefix {
+	var ret []netaddr.IPPrefix
+	for _, pa := range a {
+		for _, pb := range b {
+			if p, ok := intersectPrefix(pa, pb); ok {
+				ret = append(ret, p)
+			}
+		}
+	}
+	return ret
+}
+
+// intersectPrefix returns the intersection of a and b. Two prefixes
+// either don't overlap or one contains the other, so the intersection
+// is the more specific one, if any.
+func intersectPrefix(a, b netaddr.IPPrefix) (netaddr.IPPrefix, bool) {
+	switch {
+	case a.Bits <= b.Bits && a.Contains(b.IP):
+		return b, true
+	case b.Bits <= a.Bits && b.Contains(a.IP):
+		return a, true
+	}
+	return netaddr.IPPrefix{}, false
+}
+
+func intersectNetPortRange(a, b NetPortRange) (NetPortRange, bool) {
+	n, ok := intersectPrefix(a.Net, b.Net)
+	if !ok {
+		return NetPortRange{}, false
+	}
+	pr := a.Ports
+	if b.Ports.First > pr.First {
+		pr.First = b.Ports.First
+	}
+	if b.Ports.Last < pr.Last {
+		pr.Last = b.Ports.Last
+	}
+	if pr.First > pr.Last {
+		return NetPortRange{}, false
+	}
+	return NetPortRange{Net: n, Ports: pr}, true
+}
@@ -0,0 +1,36 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"inet.af/netaddr"
+)
+
+func TestIntersect(t *testing.T) {
+	acl := []Match{
+		{Srcs: nets("100.64.0.0/10"), Dsts: netports("100.101.102.103:*")},
+		{Srcs: nets("100.1.2.3"), Dsts: netports("100.101.102.103:22")},
+		{Srcs: nets("fd7a:115c:a1e0::/48"), Dsts: netports("fd7a:115c:a1e0::1:80-90")},
+	}
+	policy := []Match{
+		{Srcs: nets("100.100.0.0/16", "100.1.2.3"), Dsts: netports("0.0.0.0/0:80-8080", "::/0:80-8080")},
+		{Srcs: nets("::/0"), Dsts: netports("::/0:85-100")},
+	}
+	want := []Match{
+		{Srcs: nets("100.100.0.0/16"), Dsts: netports("100.101.102.103:80-8080")},
+		{Srcs: nets("fd7a:115c:a1e0::/48"), Dsts: netports("fd7a:115c:a1e0::1:85-90")},
+	}
+	got := Intersect(acl, policy)
+	if diff := cmp.Diff(want, got, cmp.Comparer(func(a, b netaddr.IP) bool { return a == b })); diff != "" {
+		t.Errorf("Intersect wrong (-want +got):\n%s", diff)
+	}
+
+	if got := Intersect(acl, nil); len(got) != 0 {
+		t.Errorf("Intersect with nothing = %v; want nothing", got)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"fmt"
+	"strings"
+
+	"inet.af/netaddr"
+)
+
+// NFTables returns an nft(8) script that enforces f on packets
+// arriving on the network interface ifName, for a data plane that
+// doesn't pass packets through f itself, such as in-kernel WireGuard.
+//
+// The script (re)creates the inet table named table, so running it
+// again with a new filter replaces the old rules atomically. Unlike
+// f, which tracks only UDP flows, it uses conntrack to let replies
+// to outbound connections back in.
+func (f *Filter) NFTables(table, ifName string) string {
+	var b strings.Builder
+	// Declaring the table first makes the delete succeed even if
+	// it didn't exist yet.
+	fmt.Fprintf(&b, "table inet %s\ndelete table inet %s\n", table, table)
+	fmt.Fprintf(&b, "table inet %s {\n", table)
+	for _, hook := range []string{"input", "forward"} {
+		fmt.Fprintf(&b, "\tchain %s {\n", hook)
+		fmt.Fprintf(&b, "\t\ttype filter hook %s priority 0; policy accept;\n", hook)
+		fmt.Fprintf(&b, "\t\tiifname %q jump ts-filter\n", ifName)
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("\tchain ts-filter {\n")
+	b.WriteString("\t\tct state established,related accept\n")
+	for _, fam := range []nftFamily{nftIPv4, nftIPv6} {
+		fam.writeRules(&b, f.matches, f.localNets)
+	}
+	b.WriteString("\t\tdrop\n")
+	b.WriteString("\t}\n}\n")
+	return b.String()
+}
+
+// nftFamily is the nft vocabulary for one IP version.
+type nftFamily struct {
+	is      func(netaddr.IP) bool
+	proto   string // "ip" or "ip6"
+	nfproto string // for meta nfproto
+	icmp    string // "icmp" or "icmpv6"
+	// icmpResponses are the ICMP types f always lets in.
+	icmpResponses string
+	echoRequest   string
+}
+
+var (
+	nftIPv4 = nftFamily{
+		is:            netaddr.IP.Is4,
+		proto:         "ip",
+		nfproto:       "ipv4",
+		icmp:          "icmp",
+		icmpResponses: "echo-reply, destination-unreachable, time-exceeded, parameter-problem",
+		echoRequest:   "echo-request",
+	}
+	nftIPv6 = nftFamily{
+		is:            netaddr.IP.Is6,
+		proto:         "ip6",
+		nfproto:       "ipv6",
+		icmp:          "icmpv6",
+		icmpResponses: "echo-reply, destination-unreachable, packet-too-big, time-exceeded, parameter-problem",
+		echoRequest:   "echo-request",
+	}
+)
+
+// writeRules writes the ts-filter rules for fam's packets to b.
+func (fam nftFamily) writeRules(b *strings.Builder, matches []Match, localNets []netaddr.IPPrefix) {
+	local := fam.prefixes(localNets)
+	if len(local) == 0 {
+		fmt.Fprintf(b, "\t\tmeta nfproto %s drop\n", fam.nfproto)
+		return
+	}
+	fmt.Fprintf(b, "\t\t%s daddr != %s drop\n", fam.proto, nftSet(local))
+	fmt.Fprintf(b, "\t\t%s type { %s } accept\n", fam.icmp, fam.icmpResponses)
+	for _, m := range matches {
+		srcs := fam.prefixes(m.Srcs)
+		if len(srcs) == 0 {
+			continue
+		}
+		var saddr string
+		if !isAll(srcs) {
+			saddr = fmt.Sprintf("%s saddr %s ", fam.proto, nftSet(srcs))
+		}
+		for _, dst := range m.Dsts {
+			if !fam.is(dst.Net.IP) {
+				continue
+			}
+			var daddr string
+			if dst.Net.Bits != 0 {
+				daddr = fmt.Sprintf("%s daddr %s ", fam.proto, nftPrefix(dst.Net))
+			}
+			// Like runIn, allow pings to any address with an
+			// open port.
+			fmt.Fprintf(b, "\t\t%s%s%s type %s accept\n", saddr, daddr, fam.icmp, fam.echoRequest)
+			if dst.Ports.First == 0 && dst.Ports.Last == 65535 {
+				fmt.Fprintf(b, "\t\t%s%smeta l4proto { tcp, udp } accept\n", saddr, daddr)
+				continue
+			}
+			for _, proto := range []string{"tcp", "udp"} {
+				fmt.Fprintf(b, "\t\t%s%s%s dport %s accept\n", saddr, daddr, proto, nftPorts(dst.Ports))
+			}
+		}
+	}
+}
+
+// prefixes returns the prefixes in pfxs of fam's IP version.
+func (fam nftFamily) prefixes(pfxs []netaddr.IPPrefix) []netaddr.IPPrefix {
+	var ret []netaddr.IPPrefix
+	for _, p := range pfxs {
+		if fam.is(p.IP) {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// isAll reports whether pfxs includes a /0.
+func isAll(pfxs []netaddr.IPPrefix) bool {
+	for _, p := range pfxs {
+		if p.Bits == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// nftSet formats pfxs as an nft anonymous set.
+func nftSet(pfxs []netaddr.IPPrefix) string {
+	if len(pfxs) == 1 {
+		return nftPrefix(pfxs[0])
+	}
+	s := make([]string, len(pfxs))
+	for i, p := range pfxs {
+		s[i] = nftPrefix(p)
+	}
+	return "{ " + strings.Join(s, ", ") + " }"
+}
+
+// nftPrefix formats p, leaving off the length of single addresses.
+func nftPrefix(p netaddr.IPPrefix) string {
+	if (p.IP.Is4() && p.Bits == 32) || p.Bits == 128 {
+		return p.IP.String()
+	}
+	return p.String()
+}
+
+func nftPorts(pr PortRange) string {
+	if pr.First == pr.Last {
+		return fmt.Sprint(pr.First)
+	}
+	return fmt.Sprintf("%d-%d", pr.First, pr.Last)
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNFTables(t *testing.T) {
+	matches := []Match{
+		{Srcs: nets("100.101.102.103", "100.64.0.0/10"), Dsts: netports("100.100.1.1:22", "10.0.0.0/8:80-81")},
+		{Srcs: nets("0.0.0.0/0", "::/0"), Dsts: netports("100.100.1.1:*", "fd7a:115c:a1e0::1:443")},
+	}
+	f := New(matches, nets("100.100.1.1", "10.0.0.0/8"), nil, t.Logf)
+
+	want := `table inet ts-test
+delete table inet ts-test
+table inet ts-test {
+	chain input {
+		type filter hook input priority 0; policy accept;
+		iifname "wg0" jump ts-filter
+	}
+	chain forward {
+		type filter hook forward priority 0; policy accept;
+		iifname "wg0" jump ts-filter
+	}
+	chain ts-filter {
+		ct state established,related accept
+		ip daddr != { 100.100.1.1, 10.0.0.0/8 } drop
+		icmp type { echo-reply, destination-unreachable, time-exceeded, parameter-problem } accept
+		ip saddr { 100.101.102.103, 100.64.0.0/10 } ip daddr 100.100.1.1 icmp type echo-request accept
+		ip saddr { 100.101.102.103, 100.64.0.0/10 } ip daddr 100.100.1.1 tcp dport 22 accept
+		ip saddr { 100.101.102.103, 100.64.0.0/10 } ip daddr 100.100.1.1 udp dport 22 accept
+		ip saddr { 100.101.102.103, 100.64.0.0/10 } ip daddr 10.0.0.0/8 icmp type echo-request accept
+		ip saddr { 100.101.102.103, 100.64.0.0/10 } ip daddr 10.0.0.0/8 tcp dport 80-81 accept
+		ip saddr { 100.101.102.103, 100.64.0.0/10 } ip daddr 10.0.0.0/8 udp dport 80-81 accept
+		ip daddr 100.100.1.1 icmp type echo-request accept
+		ip daddr 100.100.1.1 meta l4proto { tcp, udp } accept
+		meta nfproto ipv6 drop
+		drop
+	}
+}
+`
+	if diff := cmp.Diff(want, f.NFTables("ts-test", "wg0")); diff != "" {
+		t.Errorf("NFTables mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"context"
+	"os"
+	"runtime/pprof"
+	"strconv"
+)
+
+// profileLabels is whether the filter labels the goroutines it runs
+// on with the stage it's in, so that CPU profiles attribute its cost
+// to stages: pre-checks, the inbound rules and conntrack, or the
+// outbound conntrack update. It's off by default, as it replaces any
+// labels those goroutines had, and costs a little per packet.
+var profileLabels, _ = strconv.ParseBool(os.Getenv("TS_DEBUG_FILTER_PPROF_LABELS"))
+
+// Contexts carrying the pprof labels of the filter's stages, made
+// once so that setting them doesn't allocate.
+var (
+	stagePre  = pprof.WithLabels(context.Background(), pprof.Labels("filter", "pre"))
+	stageIn   = pprof.WithLabels(context.Background(), pprof.Labels("filter", "in"))
+	stageOut  = pprof.WithLabels(context.Background(), pprof.Labels("filter", "out"))
+	stageNone = context.Background()
+)
+
+// setStage labels the current goroutine as running the filter stage
+// whose labels are in ctx, if profileLabels is set.
+func setStage(ctx context.Context) {
+	if profileLabels {
+		pprof.SetGoroutineLabels(ctx)
+	}
+}
@@ -0,0 +1,28 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"testing"
+
+	"tailscale.com/net/packet"
+)
+
+func TestProfileLabelsNoAllocs(t *testing.T) {
+	old := profileLabels
+	profileLabels = true
+	defer func() { profileLabels = old }()
+
+	acl := newFilter(t.Logf)
+	var q packet.Parsed
+	q.Decode(raw4(packet.TCP, "8.1.1.1", "1.2.3.4", 999, 22, 0))
+	got := testing.AllocsPerRun(1000, func() {
+		acl.RunIn(&q, nil, 0)
+		acl.RunOut(&q, 0)
+	})
+	if got != 0 {
+		t.Errorf("got %v allocs per run; want 0", got)
+	}
+}
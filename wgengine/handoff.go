@@ -0,0 +1,74 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"fmt"
+	"os"
+
+	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/router"
+)
+
+// Handoff is what an engine passes to its successor in an in-place
+// upgrade of tailscaled: its TUN device and UDP sockets, which stay
+// open throughout, so that the host's connections over the tunnel
+// and peers' paths to it survive, and its packet filter's UDP flows.
+// WireGuard sessions can't be handed off; peers handshake afresh
+// with the new engine.
+//
+// The files are passed between processes separately from the rest,
+// which is JSON; see Files and SetFiles.
+type Handoff struct {
+	TUNName string
+	MTU     int
+	Offload bool // TUN has virtio-net headers; see tstun.HandoffFile
+	Flows   []filter.Flow
+
+	// Router is the config the engine's router last applied to the
+	// TUN device, for the new router to adopt; see router.Adopter.
+	// It's nil if there's none or the last Set failed.
+	Router *router.Config `json:",omitempty"`
+
+	// Networks are the networks of UDP, "udp4" and maybe "udp6",
+	// in the order of Files.
+	Networks []string
+
+	TUN *os.File            `json:"-"`
+	UDP map[string]*os.File `json:"-"` // keyed by network
+}
+
+// Files returns h's files, the TUN device's first.
+func (h *Handoff) Files() []*os.File {
+	fs := []*os.File{h.TUN}
+	for _, n := range h.Networks {
+		fs = append(fs, h.UDP[n])
+	}
+	return fs
+}
+
+// SetFiles sets h's files to fs, as returned by Files in the
+// engine that made h.
+func (h *Handoff) SetFiles(fs []*os.File) error {
+	if len(fs) != 1+len(h.Networks) {
+		return fmt.Errorf("got %d files, want %d", len(fs), 1+len(h.Networks))
+	}
+	h.TUN = fs[0]
+	h.UDP = make(map[string]*os.File)
+	for i, n := range h.Networks {
+		h.UDP[n] = fs[1+i]
+	}
+	return nil
+}
+
+// Close closes h's files.
+func (h *Handoff) Close() error {
+	for _, f := range h.Files() {
+		if f != nil {
+			f.Close()
+		}
+	}
+	return nil
+}
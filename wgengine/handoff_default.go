@@ -0,0 +1,16 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package wgengine
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func (e *userspaceEngine) Handoff() (*Handoff, error) {
+	return nil, fmt.Errorf("handoff not supported on %s", runtime.GOOS)
+}
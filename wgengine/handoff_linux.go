@@ -0,0 +1,109 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"net"
+	"os"
+
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/router"
+	"tailscale.com/wgengine/tstun"
+)
+
+func (e *userspaceEngine) Handoff() (_ *Handoff, reterr error) {
+	name, err := e.tundev.Name()
+	if err != nil {
+		return nil, err
+	}
+	mtu, err := e.tundev.MTU()
+	if err != nil {
+		return nil, err
+	}
+	e.wgLock.Lock()
+	routerCfg := e.lastRouterCfg
+	e.wgLock.Unlock()
+	h := &Handoff{
+		TUNName: name,
+		MTU:     mtu,
+		Router:  routerCfg,
+		UDP:     make(map[string]*os.File),
+	}
+	defer func() {
+		if reterr != nil {
+			h.Close()
+		}
+	}()
+	h.TUN, h.Offload, err = tstun.HandoffFile(e.tundev.Unwrap())
+	if err != nil {
+		return nil, err
+	}
+	udp4, udp6, err := e.magicConn.SocketFiles()
+	if err != nil {
+		return nil, err
+	}
+	h.Networks = append(h.Networks, "udp4")
+	h.UDP["udp4"] = udp4
+	if udp6 != nil {
+		h.Networks = append(h.Networks, "udp6")
+		h.UDP["udp6"] = udp6
+	}
+	if f := e.tundev.GetFilter(); f != nil {
+		h.Flows = f.Flows()
+	}
+	return h, nil
+}
+
+// NewHandoffEngine returns a Tailscale Engine carrying on with the
+// TUN device, UDP sockets and packet filter flows of the engine of
+// another tailscaled, which made h. It takes ownership of h's files.
+//
+// The new engine's router adopts the addresses and routes the other
+// engine gave the TUN device, which stay in place until the first
+// Reconfig changes them.
+func NewHandoffEngine(logf logger.Logf, h *Handoff, listenPort uint16) (Engine, error) {
+	logf("Starting userspace wireguard engine with handed-off tun device %q", h.TUNName)
+
+	conns := make(map[string]net.PacketConn)
+	for n, f := range h.UDP {
+		pc, err := net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			for _, pc := range conns {
+				pc.Close()
+			}
+			h.TUN.Close()
+			return nil, err
+		}
+		conns[n] = pc
+	}
+	tun, err := tstun.TUNFromHandoff(h.TUN, h.Offload, h.MTU)
+	if err != nil {
+		for _, pc := range conns {
+			pc.Close()
+		}
+		h.TUN.Close()
+		return nil, err
+	}
+
+	conf := EngineConfig{
+		Logf:            logf,
+		TUN:             tun,
+		RouterGen:       router.New,
+		ListenPort:      listenPort,
+		MTU:             h.MTU,
+		InheritedConns:  conns,
+		InheritedRouter: h.Router,
+	}
+	e, err := NewUserspaceEngineAdvanced(conf)
+	if err != nil {
+		return nil, err
+	}
+	filt := filter.NewAllowNone(logger.Component(logf, "filter"))
+	filt.AddFlows(h.Flows)
+	e.SetFilter(filt)
+	return e, nil
+}
@@ -0,0 +1,302 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
+	"tailscale.com/control/controlclient"
+	"tailscale.com/net/packet"
+)
+
+const (
+	// rekeyAfterTime is WireGuard's REKEY_AFTER_TIME: traffic to a
+	// peer whose session is older than this starts a new handshake.
+	rekeyAfterTime = 120 * time.Second
+
+	// handshakeAlarmTimeout is how long traffic to a peer may wait
+	// for a WireGuard handshake before the peer's alarm is raised:
+	// enough for WireGuard to retry the handshake once.
+	handshakeAlarmTimeout = 10 * time.Second
+
+	// handshakeIdleTimeout is how long after the last packet to a
+	// peer it no longer counts as having traffic pending, clearing
+	// its alarm.
+	handshakeIdleTimeout = 30 * time.Second
+
+	// handshakeCheckInterval is how often the alarms are checked.
+	handshakeCheckInterval = time.Second
+
+	// handshakeRecentWindow is how long after a handshake a peer
+	// still counts as reachable, and so may have its alarm raised,
+	// even if the network map doesn't say it's online.
+	handshakeRecentWindow = 10 * time.Minute
+)
+
+// handshakeRecovery is whether a peer's alarm also makes the engine
+// drop its WireGuard session, so the next packet starts a fresh
+// handshake, and reprobe its endpoints.
+var handshakeRecovery, _ = strconv.ParseBool(os.Getenv("TS_HANDSHAKE_RECOVERY"))
+
+// peerHandshake is the WireGuard handshake state of a peer. Its times
+// are in Unix nanoseconds, and accessed atomically, as the data path
+// updates them.
+type peerHandshake struct {
+	// The int64s come first to be 64-bit aligned on 32-bit
+	// platforms.
+	lastHandshake int64
+	lastSent      int64
+	// pendingSince is when traffic to the peer first needed a new
+	// handshake, or 0 if none is needed.
+	pendingSince int64
+
+	key wgcfg.Key
+}
+
+// noteSent records that a packet was sent to the peer at now.
+func (ph *peerHandshake) noteSent(now int64) {
+	if now-atomic.LoadInt64(&ph.lastSent) >= int64(time.Second) {
+		atomic.StoreInt64(&ph.lastSent, now)
+	}
+	if atomic.LoadInt64(&ph.pendingSince) != 0 {
+		return
+	}
+	if hs := atomic.LoadInt64(&ph.lastHandshake); hs == 0 || now-hs >= int64(rekeyAfterTime) {
+		atomic.CompareAndSwapInt64(&ph.pendingSince, 0, now)
+	}
+}
+
+// handshakeIndex finds the peer a packet is sent to. It holds the
+// peers' allowed IPs by prefix length, longest first, each length's
+// keyed by their masked address; so a lookup takes at most one map
+// lookup per distinct length, however many routes there are.
+type handshakeIndex struct {
+	v4 []handshakeRoutes4
+	v6 []handshakeRoutes6
+}
+
+type handshakeRoutes4 struct {
+	bits  uint8
+	peers map[packet.IP4]*peerHandshake
+}
+
+type handshakeRoutes6 struct {
+	bits  uint8
+	peers map[packet.IP6]*peerHandshake
+}
+
+// mask4 returns ip with all but its first bits bits zeroed.
+func mask4(ip packet.IP4, bits uint8) packet.IP4 {
+	return ip & packet.IP4(^uint32(0)<<(32-bits))
+}
+
+// mask6 returns ip with all but its first bits bits zeroed.
+func mask6(ip packet.IP6, bits uint8) packet.IP6 {
+	if bits <= 64 {
+		return packet.IP6{Hi: ip.Hi & (^uint64(0) << (64 - bits))}
+	}
+	ip.Lo &= ^uint64(0) << (128 - bits)
+	return ip
+}
+
+// add adds the allowed IPs pfx of peer ph to ix, unless a peer added
+// earlier has them.
+func (ix *handshakeIndex) add(pfx netaddr.IPPrefix, ph *peerHandshake) {
+	if pfx.IP.Is4() {
+		i := sort.Search(len(ix.v4), func(i int) bool { return ix.v4[i].bits <= pfx.Bits })
+		if i == len(ix.v4) || ix.v4[i].bits != pfx.Bits {
+			ix.v4 = append(ix.v4, handshakeRoutes4{})
+			copy(ix.v4[i+1:], ix.v4[i:])
+			ix.v4[i] = handshakeRoutes4{pfx.Bits, make(map[packet.IP4]*peerHandshake)}
+		}
+		k := mask4(packet.IP4FromNetaddr(pfx.IP), pfx.Bits)
+		if ix.v4[i].peers[k] == nil {
+			ix.v4[i].peers[k] = ph
+		}
+		return
+	}
+	i := sort.Search(len(ix.v6), func(i int) bool { return ix.v6[i].bits <= pfx.Bits })
+	if i == len(ix.v6) || ix.v6[i].bits != pfx.Bits {
+		ix.v6 = append(ix.v6, handshakeRoutes6{})
+		copy(ix.v6[i+1:], ix.v6[i:])
+		ix.v6[i] = handshakeRoutes6{pfx.Bits, make(map[packet.IP6]*peerHandshake)}
+	}
+	k := mask6(packet.IP6FromNetaddr(pfx.IP), pfx.Bits)
+	if ix.v6[i].peers[k] == nil {
+		ix.v6[i].peers[k] = ph
+	}
+}
+
+// lookup returns the peer that packets to p's destination go to, or
+// nil if none.
+func (ix *handshakeIndex) lookup(p *packet.Parsed) *peerHandshake {
+	switch p.IPVersion {
+	case 4:
+		for _, r := range ix.v4 {
+			if ph := r.peers[mask4(p.DstIP4, r.bits)]; ph != nil {
+				return ph
+			}
+		}
+	case 6:
+		for _, r := range ix.v6 {
+			if ph := r.peers[mask6(p.DstIP6, r.bits)]; ph != nil {
+				return ph
+			}
+		}
+	}
+	return nil
+}
+
+// handshakeWatcher detects the peers that WireGuard can't complete a
+// handshake with while there's traffic for them.
+type handshakeWatcher struct {
+	index atomic.Value // of *handshakeIndex
+
+	mu      sync.Mutex
+	peers   map[wgcfg.Key]*peerHandshake
+	online  map[wgcfg.Key]bool // peers the network map says are online
+	alarmed map[wgcfg.Key]bool
+	dropped bool // whether setPeers dropped a peer with an alarm
+}
+
+func newHandshakeWatcher() *handshakeWatcher {
+	w := &handshakeWatcher{
+		peers:   make(map[wgcfg.Key]*peerHandshake),
+		alarmed: make(map[wgcfg.Key]bool),
+	}
+	w.index.Store(&handshakeIndex{})
+	return w
+}
+
+// setPeers sets the peers to watch to those of cfg, keeping the state
+// of those already watched.
+func (w *handshakeWatcher) setPeers(cfg *wgcfg.Config) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	peers := make(map[wgcfg.Key]*peerHandshake, len(cfg.Peers))
+	ix := new(handshakeIndex)
+	for _, p := range cfg.Peers {
+		ph := w.peers[p.PublicKey]
+		if ph == nil {
+			ph = &peerHandshake{key: p.PublicKey}
+		}
+		peers[p.PublicKey] = ph
+		for _, cidr := range p.AllowedIPs {
+			pfx, ok := netaddr.FromStdIPNet(cidr.IPNet())
+			if !ok {
+				continue
+			}
+			pfx.IP = pfx.IP.Unmap()
+			if pfx.IP.Is4() && pfx.Bits > 32 {
+				pfx.Bits -= 96 // was an IPv4-mapped IPv6 prefix
+			}
+			ix.add(pfx, ph)
+		}
+	}
+	for k := range w.alarmed {
+		if peers[k] == nil {
+			delete(w.alarmed, k)
+			w.dropped = true
+		}
+	}
+	w.peers = peers
+	w.index.Store(ix)
+}
+
+// setOnline sets the peers that may have their alarm raised without
+// a recent handshake to those nm says are online.
+func (w *handshakeWatcher) setOnline(nm *controlclient.NetworkMap) {
+	online := make(map[wgcfg.Key]bool)
+	if nm != nil {
+		for _, n := range nm.Peers {
+			if n.Online != nil && *n.Online {
+				online[wgcfg.Key(n.Key)] = true
+			}
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.online = online
+}
+
+// noteSent records that p was sent at now, if it's to a peer.
+func (w *handshakeWatcher) noteSent(p *packet.Parsed, now time.Time) {
+	if ph := w.index.Load().(*handshakeIndex).lookup(p); ph != nil {
+		ph.noteSent(now.UnixNano())
+	}
+}
+
+// noteHandshake records that a handshake with the peer k completed at
+// now.
+func (w *handshakeWatcher) noteHandshake(k wgcfg.Key, now time.Time) {
+	w.mu.Lock()
+	ph := w.peers[k]
+	w.mu.Unlock()
+	if ph == nil {
+		return
+	}
+	atomic.StoreInt64(&ph.lastHandshake, now.UnixNano())
+	atomic.StoreInt64(&ph.pendingSince, 0)
+}
+
+// check updates the alarms at now. It returns the peers whose alarm
+// was just raised, and whether the set of peers with an alarm
+// changed. Only peers that are online per the network map, or that
+// completed a handshake within handshakeRecentWindow, have their
+// alarm raised: others are expected not to answer.
+func (w *handshakeWatcher) check(now time.Time) (raised []wgcfg.Key, changed bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	changed, w.dropped = w.dropped, false
+	nowNano := now.UnixNano()
+	for k, ph := range w.peers {
+		pending := atomic.LoadInt64(&ph.pendingSince)
+		idle := nowNano-atomic.LoadInt64(&ph.lastSent) > int64(handshakeIdleTimeout)
+		if pending != 0 && idle {
+			// No more traffic waiting for the handshake.
+			atomic.CompareAndSwapInt64(&ph.pendingSince, pending, 0)
+			pending = 0
+		}
+		hs := atomic.LoadInt64(&ph.lastHandshake)
+		reachable := w.online[k] || hs != 0 && nowNano-hs < int64(handshakeRecentWindow)
+		alarm := pending != 0 && nowNano-pending >= int64(handshakeAlarmTimeout) && reachable
+		switch {
+		case alarm && !w.alarmed[k]:
+			w.alarmed[k] = true
+			raised = append(raised, k)
+			changed = true
+		case !alarm && w.alarmed[k]:
+			delete(w.alarmed, k)
+			changed = true
+		}
+	}
+	return raised, changed
+}
+
+// err returns the health problem of the peers with an alarm, or nil
+// if there are none.
+func (w *handshakeWatcher) err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.alarmed) == 0 {
+		return nil
+	}
+	var keys []string
+	for k := range w.alarmed {
+		keys = append(keys, k.ShortString())
+	}
+	sort.Strings(keys)
+	return fmt.Errorf("no WireGuard handshake for %v with peers with traffic pending: %s", handshakeAlarmTimeout, strings.Join(keys, ", "))
+}
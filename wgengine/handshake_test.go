@@ -0,0 +1,182 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
+	"tailscale.com/control/controlclient"
+	"tailscale.com/net/packet"
+	"tailscale.com/tailcfg"
+)
+
+func mustCIDR(t *testing.T, s string) wgcfg.CIDR {
+	c, err := wgcfg.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func udpTo(t *testing.T, s string) *packet.Parsed {
+	ip, err := netaddr.ParseIP(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := packet.Generate(&packet.UDP4Header{
+		IP4Header: packet.IP4Header{
+			SrcIP: packet.IP4(0x64400001), // 100.64.0.1
+			DstIP: packet.IP4FromNetaddr(ip),
+		},
+		SrcPort: 1234,
+		DstPort: 80,
+	}, []byte("hi"))
+	p := new(packet.Parsed)
+	p.Decode(b)
+	return p
+}
+
+// onlineMap returns a network map of the peers with keys, all online.
+func onlineMap(keys ...wgcfg.Key) *controlclient.NetworkMap {
+	nm := new(controlclient.NetworkMap)
+	online := true
+	for _, k := range keys {
+		nm.Peers = append(nm.Peers, &tailcfg.Node{Key: tailcfg.NodeKey(k), Online: &online})
+	}
+	return nm
+}
+
+func TestHandshakeWatcher(t *testing.T) {
+	udpTo := func(s string) *packet.Parsed { return udpTo(t, s) }
+
+	peer := wgcfg.Key{2}
+	w := newHandshakeWatcher()
+	w.setPeers(&wgcfg.Config{
+		Peers: []wgcfg.Peer{{
+			PublicKey:  peer,
+			AllowedIPs: []wgcfg.CIDR{mustCIDR(t, "100.64.0.2/32"), mustCIDR(t, "10.0.0.0/8")},
+		}},
+	})
+	w.setOnline(onlineMap(peer))
+
+	start := time.Unix(1000, 0)
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+	check := func(now time.Time, wantRaised, wantChanged bool) {
+		t.Helper()
+		raised, changed := w.check(now)
+		if got := len(raised) == 1 && raised[0] == peer; got != wantRaised || changed != wantChanged {
+			t.Fatalf("check(%v) = %v, %v; want raised=%v, changed=%v", now.Sub(start), raised, changed, wantRaised, wantChanged)
+		}
+	}
+
+	// Traffic to an unknown address isn't tracked.
+	w.noteSent(udpTo("192.168.0.1"), at(0))
+	check(at(time.Minute), false, false)
+
+	// Traffic through the peer's subnet route without a handshake
+	// raises the alarm after handshakeAlarmTimeout.
+	w.noteSent(udpTo("10.1.2.3"), at(0))
+	check(at(5*time.Second), false, false)
+	w.noteSent(udpTo("10.1.2.3"), at(6*time.Second))
+	check(at(11*time.Second), true, true)
+	check(at(12*time.Second), false, false)
+	if w.err() == nil {
+		t.Fatal("err() = nil with an alarm raised")
+	}
+
+	// A handshake clears it.
+	w.noteHandshake(peer, at(13*time.Second))
+	check(at(14*time.Second), false, true)
+	if err := w.err(); err != nil {
+		t.Fatalf("err() = %v after handshake", err)
+	}
+	w.noteSent(udpTo("100.64.0.2"), at(33*time.Second))
+	check(at(60*time.Second), false, false)
+
+	// Once the session is due to be rekeyed, traffic needs a new
+	// handshake again.
+	rekey := 13*time.Second + rekeyAfterTime
+	w.noteSent(udpTo("100.64.0.2"), at(rekey))
+	check(at(rekey+handshakeAlarmTimeout), true, true)
+
+	// Traffic stopping clears the alarm too.
+	check(at(rekey+handshakeIdleTimeout+time.Second), false, true)
+
+	// As does the peer going away.
+	w.noteSent(udpTo("100.64.0.2"), at(rekey+time.Minute))
+	check(at(rekey+time.Minute+handshakeAlarmTimeout), true, true)
+	w.setPeers(&wgcfg.Config{})
+	check(at(rekey+time.Minute+handshakeAlarmTimeout+time.Second), false, true)
+	if err := w.err(); err != nil {
+		t.Fatalf("err() = %v after peer removal", err)
+	}
+}
+
+func TestHandshakeWatcherReachable(t *testing.T) {
+	peer := wgcfg.Key{2}
+	w := newHandshakeWatcher()
+	w.setPeers(&wgcfg.Config{
+		Peers: []wgcfg.Peer{{
+			PublicKey:  peer,
+			AllowedIPs: []wgcfg.CIDR{mustCIDR(t, "100.64.0.2/32")},
+		}},
+	})
+	start := time.Unix(1000, 0)
+	pending := func(at time.Duration) bool {
+		t.Helper()
+		w.noteSent(udpTo(t, "100.64.0.2"), start.Add(at))
+		raised, _ := w.check(start.Add(at + handshakeAlarmTimeout))
+		return len(raised) > 0 || w.err() != nil
+	}
+
+	// A peer neither online nor recently handshaken with is
+	// expected not to answer.
+	if pending(0) {
+		t.Error("alarm raised for peer not known to be reachable")
+	}
+
+	// One recently handshaken with isn't.
+	w.noteHandshake(peer, start.Add(time.Minute))
+	if !pending(time.Minute + rekeyAfterTime) {
+		t.Error("no alarm for peer handshaken with recently")
+	}
+	if pending(time.Minute + handshakeRecentWindow + time.Hour) {
+		t.Error("alarm raised for peer handshaken with long ago")
+	}
+
+	// Nor is one the network map says is online.
+	w.setOnline(onlineMap(peer))
+	if !pending(2 * time.Hour) {
+		t.Error("no alarm for online peer")
+	}
+}
+
+func TestHandshakeIndex(t *testing.T) {
+	a, b, c := wgcfg.Key{1}, wgcfg.Key{2}, wgcfg.Key{3}
+	w := newHandshakeWatcher()
+	w.setPeers(&wgcfg.Config{
+		Peers: []wgcfg.Peer{
+			{PublicKey: a, AllowedIPs: []wgcfg.CIDR{mustCIDR(t, "100.64.0.1/32"), mustCIDR(t, "0.0.0.0/0")}},
+			{PublicKey: b, AllowedIPs: []wgcfg.CIDR{mustCIDR(t, "10.0.0.0/8"), mustCIDR(t, "10.1.2.0/24")}},
+			{PublicKey: c, AllowedIPs: []wgcfg.CIDR{mustCIDR(t, "10.1.0.0/16"), mustCIDR(t, "10.0.0.0/8")}},
+		},
+	})
+	ix := w.index.Load().(*handshakeIndex)
+	for ip, want := range map[string]wgcfg.Key{
+		"100.64.0.1": a,
+		"10.1.2.3":   b,
+		"10.1.3.4":   c,
+		"10.2.0.1":   b, // first peer with 10.0.0.0/8
+		"8.8.8.8":    a,
+	} {
+		ph := ix.lookup(udpTo(t, ip))
+		if ph == nil || ph.key != want {
+			t.Errorf("lookup(%s) = %v; want peer %v", ip, ph, want.ShortString())
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os/exec"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/router"
+)
+
+// ReconfigHook is called before and after an Engine changes the
+// host's addresses, routes, DNS settings or packet filter.
+//
+// Hooks run synchronously with the change, so they hold it up until
+// they return.
+type ReconfigHook func(*ReconfigChange)
+
+// ReconfigChange describes a change for ReconfigHooks. Its JSON form
+// is what ExecReconfigHook feeds to executables.
+type ReconfigChange struct {
+	// Phase is "pre" before the change is applied, and "post"
+	// after.
+	Phase string
+	// Changed lists which parts of the state change, as the
+	// ReconfigState JSON field names.
+	Changed []string
+	// Old and New are the states before and after the change.
+	Old, New ReconfigState
+	// Err is why the change failed, in the "post" phase. If it's
+	// set, the host may be left in between Old and New.
+	Err string `json:",omitempty"`
+}
+
+// ReconfigState is the state of the host that ReconfigHooks see
+// change.
+type ReconfigState struct {
+	LocalAddrs   []string     // addresses of the Tailscale interface
+	Routes       []string     // routes into the Tailscale interface
+	SubnetRoutes []string     // subnets advertised to other nodes
+	Nameservers  []netaddr.IP // DNS servers
+	Domains      []string     // DNS search domains
+	Filter       []string     // packet filter rules
+}
+
+// WithReconfigHooks wraps e so that hooks are called around every
+// change it makes to the host's network configuration.
+func WithReconfigHooks(e Engine, hooks ...ReconfigHook) Engine {
+	return &hookEngine{Engine: e, hooks: hooks}
+}
+
+type hookEngine struct {
+	Engine
+	hooks []ReconfigHook
+
+	mu  sync.Mutex    // guards cur
+	cur ReconfigState // as of the last successful change
+}
+
+func (e *hookEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config) error {
+	e.mu.Lock()
+	old := e.cur
+	e.mu.Unlock()
+
+	next := old
+	next.LocalAddrs = prefixStrings(routerCfg.LocalAddrs)
+	next.Routes = prefixStrings(routerCfg.Routes)
+	next.SubnetRoutes = prefixStrings(routerCfg.SubnetRoutes)
+	next.Nameservers = routerCfg.DNS.Nameservers
+	next.Domains = routerCfg.DNS.Domains
+
+	var err error
+	e.change(old, next, func() error {
+		err = e.Engine.Reconfig(cfg, routerCfg)
+		if err == ErrNoChanges {
+			return nil
+		}
+		return err
+	})
+	return err
+}
+
+func (e *hookEngine) SetFilter(filt *filter.Filter) {
+	e.mu.Lock()
+	old := e.cur
+	e.mu.Unlock()
+
+	next := old
+	next.Filter = nil
+	if filt != nil {
+		for _, m := range filt.Matches() {
+			next.Filter = append(next.Filter, m.String())
+		}
+	}
+
+	e.change(old, next, func() error {
+		e.Engine.SetFilter(filt)
+		return nil
+	})
+}
+
+// change runs apply, calling the hooks around it if the state
+// changes from old to next.
+func (e *hookEngine) change(old, next ReconfigState, apply func() error) {
+	changed := old.diff(next)
+	if len(changed) == 0 {
+		apply()
+		return
+	}
+
+	c := &ReconfigChange{Phase: "pre", Changed: changed, Old: old, New: next}
+	for _, hook := range e.hooks {
+		hook(c)
+	}
+	err := apply()
+
+	e.mu.Lock()
+	e.cur.update(changed, next)
+	e.mu.Unlock()
+
+	post := *c
+	post.Phase = "post"
+	if err != nil {
+		post.Err = err.Error()
+	}
+	for _, hook := range e.hooks {
+		hook(&post)
+	}
+}
+
+// diff returns the names of the fields of s and s2 that differ.
+func (s ReconfigState) diff(s2 ReconfigState) []string {
+	var ret []string
+	v, v2 := reflect.ValueOf(s), reflect.ValueOf(s2)
+	for i := 0; i < v.NumField(); i++ {
+		a, b := v.Field(i), v2.Field(i)
+		if a.Len() == 0 && b.Len() == 0 {
+			// Nil and empty are the same here.
+			continue
+		}
+		if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+			ret = append(ret, v.Type().Field(i).Name)
+		}
+	}
+	return ret
+}
+
+// update sets the named fields of s to those of next.
+func (s *ReconfigState) update(fields []string, next ReconfigState) {
+	v, v2 := reflect.ValueOf(s).Elem(), reflect.ValueOf(next)
+	for _, f := range fields {
+		v.FieldByName(f).Set(v2.FieldByName(f))
+	}
+}
+
+func prefixStrings(pp []netaddr.IPPrefix) []string {
+	var ret []string
+	for _, p := range pp {
+		ret = append(ret, p.String())
+	}
+	return ret
+}
+
+// reconfigHookTimeout is how long ExecReconfigHook lets an executable
+// run before killing it.
+const reconfigHookTimeout = 10 * time.Second
+
+// ExecReconfigHook returns a ReconfigHook that runs the executable at
+// path with the phase ("pre" or "post") as its argument and the
+// ReconfigChange as JSON on its standard input. Failures are logged
+// and otherwise ignored.
+func ExecReconfigHook(logf logger.Logf, path string) ReconfigHook {
+	return func(c *ReconfigChange) {
+		j, err := json.Marshal(c)
+		if err != nil {
+			logf("reconfig hook: %v", err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), reconfigHookTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, path, c.Phase)
+		cmd.Stdin = bytes.NewReader(j)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			logf("reconfig hook %s %s: %v\n%s", path, c.Phase, err, out)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
+	"tailscale.com/wgengine/router"
+)
+
+func TestReconfigHooks(t *testing.T) {
+	e, err := NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []ReconfigChange
+	e = WithReconfigHooks(e, func(c *ReconfigChange) {
+		got = append(got, *c)
+	})
+	defer e.Close()
+
+	pfx, err := netaddr.ParseIPPrefix("100.101.102.103/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routerCfg := &router.Config{LocalAddrs: []netaddr.IPPrefix{pfx}}
+	e.Reconfig(&wgcfg.Config{}, routerCfg)
+	if len(got) != 2 {
+		t.Fatalf("got %d hook calls; want 2: %+v", len(got), got)
+	}
+	want := ReconfigChange{
+		Phase:   "pre",
+		Changed: []string{"LocalAddrs"},
+		New:     ReconfigState{LocalAddrs: []string{"100.101.102.103/32"}},
+	}
+	if !reflect.DeepEqual(got[0], want) {
+		t.Errorf("pre change = %+v; want %+v", got[0], want)
+	}
+	if got[1].Phase != "post" || got[1].Err != "" || !reflect.DeepEqual(got[1].New, want.New) {
+		t.Errorf("post change = %+v", got[1])
+	}
+
+	// Nothing the hooks care about changes, so they're not called.
+	got = nil
+	e.Reconfig(&wgcfg.Config{}, routerCfg)
+	e.SetFilter(nil)
+	if len(got) != 0 {
+		t.Errorf("got %d hook calls; want none: %+v", len(got), got)
+	}
+}
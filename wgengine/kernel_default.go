@@ -0,0 +1,20 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package wgengine
+
+import (
+	"fmt"
+	"runtime"
+
+	"tailscale.com/types/logger"
+)
+
+// NewKernelEngine returns an error: in-kernel WireGuard is only
+// supported on Linux.
+func NewKernelEngine(logf logger.Logf, ifName string, listenPort uint16) (Engine, error) {
+	return nil, fmt.Errorf("in-kernel wireguard not supported on %s", runtime.GOOS)
+}
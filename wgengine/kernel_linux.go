@@ -0,0 +1,678 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tailscale/wireguard-go/conn"
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
+	"tailscale.com/control/controlclient"
+	"tailscale.com/health"
+	"tailscale.com/internal/deepprint"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/interfaces"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/magicsock"
+	"tailscale.com/wgengine/monitor"
+	"tailscale.com/wgengine/router"
+	"tailscale.com/wgengine/tsdns"
+	"tailscale.com/wgengine/tstun"
+)
+
+// nftTable is the nftables table the kernel engine enforces its
+// packet filter with.
+const nftTable = "tailscale-filter"
+
+// kernelEngine is an Engine whose data plane is the Linux kernel's
+// WireGuard module, configured with wg(8), instead of wireguard-go.
+//
+// Packets never pass through this process, so the kernel engine
+// can't do everything userspaceEngine does:
+//
+//   - it takes part as a pre-discovery peer: it has no disco key and
+//     peers reach it only at its direct UDP endpoints, not via DERP,
+//     so peers behind NAT can't reach it;
+//   - the packet filter is enforced by nftables rules generated from
+//     it (see filter.Filter.NFTables);
+//   - there's no in-process DNS resolver, so MagicDNS isn't served.
+//
+// The packet filter fails closed: until a filter has been installed
+// with nft, and whenever installing one fails, the interface has no
+// peers.
+//
+// magicsock still runs, on its own port, for netcheck and to find the
+// node's endpoints. Only those on the machine's own interface
+// addresses are advertised, with the kernel interface's listen port:
+// a STUN-discovered address says nothing about how a NAT maps that
+// other port. That suits servers with a public IP, which is where the
+// extra throughput matters.
+type kernelEngine struct {
+	logf      logger.Logf
+	ifName    string
+	reqCh     chan struct{}
+	waitCh    chan struct{} // closed when Close completes
+	router    router.Router
+	magicConn *magicsock.Conn
+	linkMon   *monitor.Mon
+
+	wgLock        sync.Mutex // serializes wg(8) configuration
+	lastCfg       *wgcfg.Config
+	lastEngineSig string // of the generated wg config
+	lastRouterSig string // of router.Config
+	filterOK      bool   // whether the last SetFilter was installed
+
+	mu                 sync.Mutex // guards following
+	closing            bool
+	listenPort         uint16 // of the kernel interface
+	filt               *filter.Filter
+	dnsMap             *tsdns.Map
+	statusCallback     StatusCallback
+	linkChangeCallback func(major bool, newState *interfaces.State)
+	linkState          *interfaces.State
+	endpoints          []string                     // magicsock's, with the port rewritten
+	peerSequence       []wgcfg.Key                  // as of last Reconfig
+	peerEndpoints      map[tailcfg.NodeKey][]string // from the last network map
+}
+
+// NewKernelEngine creates the in-kernel WireGuard interface ifName
+// and returns an Engine running on it. It fails if the kernel or the
+// wg tool doesn't support WireGuard, or if nft can't install the
+// packet filter; callers can then fall back to NewUserspaceEngine.
+func NewKernelEngine(logf logger.Logf, ifName string, listenPort uint16) (_ Engine, reterr error) {
+	if ifName == "" {
+		return nil, errors.New("interface name must not be blank")
+	}
+	if listenPort == 0 {
+		// wg(8) would pick a random port, but peers need to
+		// know it before the first handshake.
+		listenPort = magicsock.DefaultPort
+	}
+	if _, err := exec.LookPath("wg"); err != nil {
+		return nil, fmt.Errorf("wg tool not found: %w", err)
+	}
+	if _, err := exec.LookPath("nft"); err != nil {
+		return nil, fmt.Errorf("nft tool not found, needed for the packet filter: %w", err)
+	}
+	logf("Starting in-kernel wireguard engine with interface %q", ifName)
+
+	// Remove any interface left behind by a previous run.
+	exec.Command("ip", "link", "del", "dev", ifName).Run()
+	if out, err := exec.Command("ip", "link", "add", "dev", ifName, "type", "wireguard").CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("creating wireguard interface (is the wireguard module available?): %v: %s", err, bytes.TrimSpace(out))
+	}
+	defer func() {
+		if reterr != nil {
+			exec.Command("ip", "link", "del", "dev", ifName).Run()
+		}
+	}()
+	// Drop everything from the interface before it has any peers.
+	if err := runNFT(filter.NewAllowNone(logf).NFTables(nftTable, ifName)); err != nil {
+		return nil, fmt.Errorf("installing packet filter: %w", err)
+	}
+	defer func() {
+		if reterr != nil {
+			runNFT(nftDeleteScript)
+		}
+	}()
+
+	e := &kernelEngine{
+		logf:       logf,
+		ifName:     ifName,
+		reqCh:      make(chan struct{}, 1),
+		waitCh:     make(chan struct{}),
+		listenPort: listenPort,
+	}
+	e.linkState, _ = getLinkState()
+	logf("link state: %+v", e.linkState)
+
+	var err error
+	e.linkMon, err = monitor.New(logf, func() { e.LinkChange(false) })
+	if err != nil {
+		return nil, err
+	}
+
+	endpointsFn := func(endpoints []string) {
+		local := map[string]bool{}
+		if ips, _, err := interfaces.LocalAddresses(); err == nil {
+			for _, ip := range ips {
+				local[ip] = true
+			}
+		}
+		e.mu.Lock()
+		e.endpoints = e.endpoints[:0]
+		for _, ep := range endpoints {
+			// Only the machine's own addresses are known to
+			// reach the kernel's port.
+			if host, _, err := net.SplitHostPort(ep); err == nil && local[host] {
+				e.endpoints = append(e.endpoints, net.JoinHostPort(host, strconv.Itoa(int(e.listenPort))))
+			}
+		}
+		e.mu.Unlock()
+
+		e.RequestStatus()
+	}
+	e.magicConn, err = magicsock.NewConn(magicsock.Options{
+		Logf:           logf,
+		EndpointsFunc:  endpointsFn,
+		DERPActiveFunc: e.RequestStatus,
+	})
+	if err != nil {
+		e.linkMon.Close()
+		return nil, fmt.Errorf("wgengine: %v", err)
+	}
+	e.magicConn.SetNetworkUp(e.linkState.AnyInterfaceUp())
+
+	e.router, err = router.NewForInterface(logf, ifName)
+	if err != nil {
+		e.magicConn.Close()
+		e.linkMon.Close()
+		return nil, err
+	}
+	if err := e.router.Up(); err != nil {
+		e.magicConn.Close()
+		e.linkMon.Close()
+		return nil, err
+	}
+
+	e.linkMon.Start()
+	e.magicConn.Start()
+	// magicsock handles STUN replies and DERP messages as they're
+	// read, which userspaceEngine's wireguard-go does for it.
+	go e.drainMagicsock(e.magicConn.ReceiveIPv4)
+	go e.drainMagicsock(e.magicConn.ReceiveIPv6)
+
+	e.logf("Engine created.")
+	return e, nil
+}
+
+// drainMagicsock reads from magicsock with receive until it's
+// closed, discarding the WireGuard packets, which kernelEngine has
+// nowhere to send.
+func (e *kernelEngine) drainMagicsock(receive func([]byte) (int, conn.Endpoint, *net.UDPAddr, error)) {
+	buf := make([]byte, 64<<10)
+	for {
+		if _, _, _, err := receive(buf); err != nil {
+			return
+		}
+	}
+}
+
+func (e *kernelEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config) error {
+	if routerCfg == nil {
+		panic("routerCfg must not be nil")
+	}
+
+	e.wgLock.Lock()
+	defer e.wgLock.Unlock()
+
+	e.mu.Lock()
+	e.peerSequence = e.peerSequence[:0]
+	for _, p := range cfg.Peers {
+		e.peerSequence = append(e.peerSequence, p.PublicKey)
+	}
+	e.mu.Unlock()
+
+	peerSet := make(map[key.Public]struct{}, len(cfg.Peers))
+	for _, p := range cfg.Peers {
+		peerSet[key.Public(p.PublicKey)] = struct{}{}
+	}
+	// magicsock needs the key for DERP, which netcheck reports on.
+	if err := e.magicConn.SetPrivateKey(cfg.PrivateKey); err != nil {
+		e.logf("wgengine: Reconfig: SetPrivateKey: %v", err)
+	}
+	e.magicConn.UpdatePeers(peerSet)
+
+	e.lastCfg = cfg.Copy()
+	engineErr := e.applyWireguardLocked()
+
+	// There's no in-process resolver to proxy DNS through, so
+	// point the OS at the upstream nameservers directly.
+	routerCfg.DNS.Proxied = false
+	routerChanged := deepprint.UpdateHash(&e.lastRouterSig, routerCfg)
+	if engineErr == ErrNoChanges && !routerChanged {
+		return ErrNoChanges
+	}
+	if engineErr != nil && engineErr != ErrNoChanges {
+		return engineErr
+	}
+	if routerChanged {
+		e.logf("wgengine: Reconfig: configuring router")
+		err := e.router.Set(routerCfg)
+		health.Set(health.SysRouter, err)
+		if err != nil {
+			return err
+		}
+	}
+	e.logf("wgengine: Reconfig done")
+	return nil
+}
+
+// applyWireguardLocked configures the kernel interface from
+// e.lastCfg and the peer endpoints in the last network map, without
+// any peers unless the packet filter is installed. It returns
+// ErrNoChanges if that config was already applied.
+//
+// e.wgLock must be held.
+func (e *kernelEngine) applyWireguardLocked() error {
+	if e.lastCfg == nil {
+		return ErrNoChanges
+	}
+	cfg := e.lastCfg
+	if !e.filterOK {
+		cfg = &wgcfg.Config{PrivateKey: cfg.PrivateKey}
+	}
+	e.mu.Lock()
+	conf := kernelWGConfig(cfg, e.listenPort, e.peerEndpoints)
+	e.mu.Unlock()
+	if !deepprint.UpdateHash(&e.lastEngineSig, conf) {
+		return ErrNoChanges
+	}
+	e.logf("wgengine: Reconfig: configuring kernel wireguard (%d peers)", len(cfg.Peers))
+	cmd := exec.Command("wg", "setconf", e.ifName, "/dev/stdin")
+	cmd.Stdin = strings.NewReader(conf)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		e.lastEngineSig = ""
+		return fmt.Errorf("wg setconf: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// kernelBypassMark is the fwmark the kernel WireGuard interface puts
+// on its encrypted packets, so the router's policy routing rules send
+// them via the main table rather than back into the tunnel.
+//
+// Keep this in sync with tailscaleBypassMark in
+// wgengine/router/router_linux.go and net/netns/netns_linux.go.
+const kernelBypassMark = "0x80000"
+
+// kernelWGConfig returns cfg in the format of wg(8)'s setconf,
+// listening on listenPort. Peers are sent to their first direct
+// endpoint: from cfg for pre-discovery peers, or else from
+// nodeEndpoints, as the endpoints of discovery-capable peers in cfg
+// are only placeholders for magicsock.
+func kernelWGConfig(cfg *wgcfg.Config, listenPort uint16, nodeEndpoints map[tailcfg.NodeKey][]string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Interface]\nPrivateKey = %s\nListenPort = %d\nFwMark = %s\n", base64.StdEncoding.EncodeToString(cfg.PrivateKey[:]), listenPort, kernelBypassMark)
+	for _, p := range cfg.Peers {
+		fmt.Fprintf(&b, "\n[Peer]\nPublicKey = %s\n", base64.StdEncoding.EncodeToString(p.PublicKey[:]))
+		if len(p.AllowedIPs) > 0 {
+			ips := make([]string, len(p.AllowedIPs))
+			for i, cidr := range p.AllowedIPs {
+				ips[i] = cidr.IPNet().String()
+			}
+			fmt.Fprintf(&b, "AllowedIPs = %s\n", strings.Join(ips, ", "))
+		}
+		var eps []string
+		for _, ep := range p.Endpoints {
+			if strings.HasSuffix(ep.Host, ".disco.tailscale") {
+				eps = nodeEndpoints[tailcfg.NodeKey(p.PublicKey)]
+				break
+			}
+			eps = append(eps, net.JoinHostPort(ep.Host, strconv.Itoa(int(ep.Port))))
+		}
+		if ep := firstDirectEndpoint(eps); ep != "" {
+			fmt.Fprintf(&b, "Endpoint = %s\n", ep)
+		}
+		if p.PersistentKeepalive != 0 {
+			fmt.Fprintf(&b, "PersistentKeepalive = %d\n", p.PersistentKeepalive)
+		}
+	}
+	return b.String()
+}
+
+// firstDirectEndpoint returns the first of eps that's an IP:port
+// other than a DERP pseudo-address, or the empty string.
+func firstDirectEndpoint(eps []string) string {
+	for _, ep := range eps {
+		ipp, err := netaddr.ParseIPPort(ep)
+		if err != nil || ipp.IP.String() == magicsock.DerpMagicIP {
+			continue
+		}
+		return ep
+	}
+	return ""
+}
+
+func (e *kernelEngine) GetFilter() *filter.Filter {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.filt
+}
+
+// SetFilter installs filt's nftables rules; a nil filt drops all
+// packets. If nft fails, all peers are removed from the interface
+// until a later SetFilter succeeds, as nothing else would stop their
+// packets.
+func (e *kernelEngine) SetFilter(filt *filter.Filter) {
+	e.mu.Lock()
+	e.filt = filt
+	e.mu.Unlock()
+
+	nftFilt := filt
+	if nftFilt == nil {
+		nftFilt = filter.NewAllowNone(e.logf)
+	}
+
+	e.wgLock.Lock()
+	defer e.wgLock.Unlock()
+	err := runNFT(nftFilt.NFTables(nftTable, e.ifName))
+	if err != nil {
+		e.logf("wgengine: applying packet filter, removing all peers: %v", err)
+	}
+	e.filterOK = err == nil
+	if err := e.applyWireguardLocked(); err != nil && err != ErrNoChanges {
+		e.logf("wgengine: SetFilter: %v", err)
+	}
+}
+
+// nftDeleteScript is an nft(8) script removing nftTable. Declaring the
+// table first makes the delete succeed even if it didn't exist.
+var nftDeleteScript = fmt.Sprintf("table inet %s\ndelete table inet %s\n", nftTable, nftTable)
+
+// runNFT runs the nft(8) script.
+func runNFT(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft: %v: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func (e *kernelEngine) SetDNSMap(dm *tsdns.Map) {
+	// Nothing resolves from it; see the kernelEngine docs.
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.dnsMap = dm
+}
+
+func (e *kernelEngine) SetStatusCallback(cb StatusCallback) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.statusCallback = cb
+}
+
+func (e *kernelEngine) getStatus() (*Status, error) {
+	derpConns := e.magicConn.DERPs()
+
+	e.mu.Lock()
+	closing := e.closing
+	e.mu.Unlock()
+	if closing {
+		return nil, errors.New("engine closing; no status")
+	}
+
+	out, err := exec.Command("wg", "show", e.ifName, "dump").Output()
+	if err != nil {
+		return nil, fmt.Errorf("wg show: %w", err)
+	}
+	pp, err := parseWGDump(out)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var peers []PeerStatus
+	for _, pk := range e.peerSequence {
+		if p, ok := pp[pk]; ok {
+			peers = append(peers, *p)
+		}
+	}
+	return &Status{
+		LocalAddrs: append([]string(nil), e.endpoints...),
+		Peers:      peers,
+		DERPs:      derpConns,
+	}, nil
+}
+
+// parseWGDump parses the peers in the output of "wg show IFACE dump".
+func parseWGDump(out []byte) (map[wgcfg.Key]*PeerStatus, error) {
+	pp := make(map[wgcfg.Key]*PeerStatus)
+	bs := bufio.NewScanner(bytes.NewReader(out))
+	first := true
+	for bs.Scan() {
+		if first {
+			first = false // the interface line
+			continue
+		}
+		// public-key, preshared-key, endpoint, allowed-ips,
+		// latest-handshake, transfer-rx, transfer-tx,
+		// persistent-keepalive
+		f := strings.Split(bs.Text(), "\t")
+		if len(f) != 8 {
+			return nil, fmt.Errorf("wg show: unexpected line %q", bs.Text())
+		}
+		kb, err := base64.StdEncoding.DecodeString(f[0])
+		if err != nil || len(kb) != 32 {
+			return nil, fmt.Errorf("wg show: invalid key %q", f[0])
+		}
+		var k wgcfg.Key
+		copy(k[:], kb)
+		hs, err1 := strconv.ParseInt(f[4], 10, 64)
+		rx, err2 := strconv.ParseInt(f[5], 10, 64)
+		tx, err3 := strconv.ParseInt(f[6], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			return nil, fmt.Errorf("wg show: unexpected line %q", bs.Text())
+		}
+		p := &PeerStatus{
+			NodeKey: tailcfg.NodeKey(k),
+			RxBytes: ByteCount(rx),
+			TxBytes: ByteCount(tx),
+		}
+		if hs != 0 {
+			p.LastHandshake = time.Unix(hs, 0)
+		}
+		pp[k] = p
+	}
+	return pp, bs.Err()
+}
+
+func (e *kernelEngine) RequestStatus() {
+	// Like userspaceEngine.RequestStatus, run at most one status
+	// request at a time.
+	select {
+	case e.reqCh <- struct{}{}:
+	default:
+	}
+	select {
+	case <-e.reqCh:
+		s, err := e.getStatus()
+		e.mu.Lock()
+		cb := e.statusCallback
+		e.mu.Unlock()
+		if cb != nil {
+			cb(s, err)
+		}
+	default:
+	}
+}
+
+func (e *kernelEngine) Close() {
+	e.mu.Lock()
+	if e.closing {
+		e.mu.Unlock()
+		return
+	}
+	e.closing = true
+	e.mu.Unlock()
+
+	e.magicConn.Close()
+	e.linkMon.Close()
+	e.router.Close()
+	// Remove the interface, and with it its peers, before the
+	// filter.
+	if out, err := exec.Command("ip", "link", "del", "dev", e.ifName).CombinedOutput(); err != nil {
+		e.logf("wgengine: deleting %s: %v: %s", e.ifName, err, bytes.TrimSpace(out))
+	}
+	runNFT(nftDeleteScript)
+	close(e.waitCh)
+}
+
+func (e *kernelEngine) Wait() {
+	<-e.waitCh
+}
+
+func (e *kernelEngine) LinkChange(isExpensive bool) {
+	cur, err := getLinkState()
+	if err != nil {
+		e.logf("LinkChange: interfaces.GetState: %v", err)
+		return
+	}
+	cur.IsExpensive = isExpensive
+
+	e.mu.Lock()
+	major := e.linkState == nil || !cur.Equal(e.linkState)
+	e.linkState = cur
+	cb := e.linkChangeCallback
+	e.mu.Unlock()
+
+	// The kernel picks new routes for WireGuard by itself; magicsock
+	// only needs to find the new endpoints.
+	e.magicConn.SetNetworkUp(cur.AnyInterfaceUp())
+	why := "link-change-minor"
+	if major {
+		why = "link-change-major"
+		e.magicConn.Rebind()
+	}
+	e.magicConn.ReSTUN(why)
+	if cb != nil {
+		go cb(major, cur)
+	}
+}
+
+func (e *kernelEngine) SetLinkChangeCallback(cb func(major bool, newState *interfaces.State)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.linkChangeCallback = cb
+	if e.linkState != nil {
+		go cb(false, e.linkState)
+	}
+}
+
+func (e *kernelEngine) SetDERPMap(dm *tailcfg.DERPMap) {
+	e.magicConn.SetDERPMap(dm)
+}
+
+func (e *kernelEngine) SetNetworkMap(nm *controlclient.NetworkMap) {
+	eps := make(map[tailcfg.NodeKey][]string, len(nm.Peers))
+	for _, p := range nm.Peers {
+		eps[p.Key] = p.Endpoints
+	}
+	e.mu.Lock()
+	e.peerEndpoints = eps
+	e.mu.Unlock()
+
+	e.wgLock.Lock()
+	defer e.wgLock.Unlock()
+	if err := e.applyWireguardLocked(); err != nil && err != ErrNoChanges {
+		e.logf("wgengine: updating peer endpoints: %v", err)
+	}
+}
+
+func (e *kernelEngine) SetNetInfoCallback(cb NetInfoCallback) {
+	e.magicConn.SetNetInfoCallback(cb)
+}
+
+// DiscoPublicKey returns the zero key: the kernel engine can't
+// answer disco pings, so peers must treat it as a pre-discovery node.
+func (e *kernelEngine) DiscoPublicKey() tailcfg.DiscoKey {
+	return tailcfg.DiscoKey{}
+}
+
+func (e *kernelEngine) UpdateStatus(sb *ipnstate.StatusBuilder) {
+	st, err := e.getStatus()
+	if err != nil {
+		e.logf("wgengine: getStatus: %v", err)
+		return
+	}
+	for _, ps := range st.Peers {
+		sb.AddPeer(key.Public(ps.NodeKey), &ipnstate.PeerStatus{
+			RxBytes:       int64(ps.RxBytes),
+			TxBytes:       int64(ps.TxBytes),
+			LastHandshake: ps.LastHandshake,
+			InEngine:      true,
+		})
+	}
+	e.magicConn.UpdateStatus(sb)
+}
+
+func (e *kernelEngine) Ping(ip netaddr.IP, cb func(*ipnstate.PingResult)) {
+	cb(&ipnstate.PingResult{IP: ip.String(), Err: "ping not supported with in-kernel wireguard"})
+}
+
+func (e *kernelEngine) PeerPath(ip netaddr.IP) (*ipnstate.PeerPath, error) {
+	return nil, errors.New("peer paths not supported with in-kernel wireguard")
+}
+
+func (e *kernelEngine) SetImpairments(m map[netaddr.IP]tstun.Impairment) {
+	if len(m) > 0 {
+		e.logf("wgengine: packet impairments not supported with in-kernel wireguard")
+	}
+}
+
+func (e *kernelEngine) SetShapes(m map[netaddr.IPPrefix]tstun.Shape) {
+	if len(m) > 0 {
+		e.logf("wgengine: bandwidth shaping not supported with in-kernel wireguard")
+	}
+}
+
+func (e *kernelEngine) SetCaptureHook(fn tstun.CaptureFunc) {
+	if fn != nil {
+		e.logf("wgengine: packet capture not supported with in-kernel wireguard; capture on the WireGuard interface instead")
+	}
+}
+
+func (e *kernelEngine) SetConnHook(fn tstun.ConnFunc) {
+	if fn != nil {
+		e.logf("wgengine: connection events not supported with in-kernel wireguard")
+	}
+}
+
+func (e *kernelEngine) Handoff() (*Handoff, error) {
+	return nil, errors.New("handoff not supported with in-kernel wireguard")
+}
+
+func (e *kernelEngine) SetEndpointPrivacy(p magicsock.EndpointPrivacy) {
+	e.magicConn.SetEndpointPrivacy(p)
+}
+
+func (e *kernelEngine) SetRelayOnlyPeers(ips []netaddr.IP) {
+	if len(ips) > 0 {
+		e.logf("wgengine: relay-only peers not supported with in-kernel wireguard, which can't use DERP")
+	}
+}
+
+func (e *kernelEngine) SetListenPort(port uint16) {
+	if port == 0 {
+		port = magicsock.DefaultPort
+	}
+	e.wgLock.Lock()
+	defer e.wgLock.Unlock()
+	if out, err := exec.Command("wg", "set", e.ifName, "listen-port", strconv.Itoa(int(port))).CombinedOutput(); err != nil {
+		e.logf("wgengine: setting listen port %d: %v: %s", port, err, bytes.TrimSpace(out))
+		return
+	}
+	e.mu.Lock()
+	e.listenPort = port
+	e.mu.Unlock()
+	e.lastEngineSig = "" // the port is part of the config
+	e.magicConn.ReSTUN("listen-port-change")
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/tailcfg"
+)
+
+func TestKernelWGConfig(t *testing.T) {
+	mustCIDR := func(s string) wgcfg.CIDR {
+		c, err := wgcfg.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	cfg := &wgcfg.Config{
+		PrivateKey: wgcfg.PrivateKey{1},
+		Peers: []wgcfg.Peer{
+			{
+				// Pre-discovery peer: a DERP endpoint, then direct ones.
+				PublicKey:           wgcfg.Key{2},
+				AllowedIPs:          []wgcfg.CIDR{mustCIDR("100.64.0.2/32"), mustCIDR("10.0.0.0/8")},
+				Endpoints:           []wgcfg.Endpoint{{Host: "127.3.3.40", Port: 1}, {Host: "1.2.3.4", Port: 41641}},
+				PersistentKeepalive: 25,
+			},
+			{
+				// Discovery peer, whose endpoints come from the netmap.
+				PublicKey:  wgcfg.Key{3},
+				AllowedIPs: []wgcfg.CIDR{mustCIDR("100.64.0.3/32")},
+				Endpoints:  []wgcfg.Endpoint{{Host: "0303.disco.tailscale", Port: 12345}},
+			},
+		},
+	}
+	nodeEndpoints := map[tailcfg.NodeKey][]string{
+		{3}: {"127.3.3.40:2", "5.6.7.8:1234"},
+	}
+	got := kernelWGConfig(cfg, 41641, nodeEndpoints)
+	want := `[Interface]
+PrivateKey = AQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+ListenPort = 41641
+FwMark = 0x80000
+
+[Peer]
+PublicKey = AgAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+AllowedIPs = 100.64.0.2/32, 10.0.0.0/8
+Endpoint = 1.2.3.4:41641
+PersistentKeepalive = 25
+
+[Peer]
+PublicKey = AwAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+AllowedIPs = 100.64.0.3/32
+Endpoint = 5.6.7.8:1234
+`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestParseWGDump(t *testing.T) {
+	dump := "AQAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\tAgAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\t41641\toff\n" +
+		"AgAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\t(none)\t1.2.3.4:41641\t100.64.0.2/32\t1600000000\t100\t200\t25\n" +
+		"AwAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\t(none)\t(none)\t100.64.0.3/32\t0\t0\t0\toff\n"
+	pp, err := parseWGDump([]byte(dump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pp) != 2 {
+		t.Fatalf("got %d peers; want 2", len(pp))
+	}
+	p := pp[wgcfg.Key{2}]
+	if p == nil {
+		t.Fatal("missing peer 2")
+	}
+	if p.NodeKey != (tailcfg.NodeKey{2}) || p.RxBytes != 100 || p.TxBytes != 200 || !p.LastHandshake.Equal(time.Unix(1600000000, 0)) {
+		t.Errorf("peer 2 = %+v", p)
+	}
+	if p := pp[wgcfg.Key{3}]; p == nil || !p.LastHandshake.IsZero() {
+		t.Errorf("peer 3 = %+v", p)
+	}
+
+	if _, err := parseWGDump([]byte("iface\nshort\tline\n")); err == nil {
+		t.Error("parsed a malformed dump")
+	}
+}
@@ -0,0 +1,23 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package magicsock
+
+import "net"
+
+// batchReader would read packets a batch at a time, but only Linux
+// has recvmmsg, so elsewhere it reads one at a time.
+type batchReader struct{}
+
+func (*batchReader) readFrom(pc net.PacketConn, b []byte) (int, net.Addr, error) {
+	return pc.ReadFrom(b)
+}
+
+// writeBatch writes b to each of addrs on pc. Only Linux has
+// sendmmsg, so elsewhere it's a write per address.
+func writeBatch(pc net.PacketConn, b []byte, addrs []*net.UDPAddr) (int, error) {
+	return writeEach(pc, b, addrs)
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"tailscale.com/syncs"
+	"tailscale.com/util/endian"
+	"tailscale.com/version"
+)
+
+// recvBatchSize is how many packets a batchReader asks the kernel for
+// per recvmmsg call.
+const recvBatchSize = 8
+
+// udpGRO is the UDP_GRO socket option and control message type from
+// linux/udp.h (Linux 5.0+), which syscall doesn't have.
+const udpGRO = 104
+
+// batchConn is the batch methods shared by ipv4.PacketConn and
+// ipv6.PacketConn.
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// newBatchConn returns the batchConn for uc, by the family of its
+// local address.
+func newBatchConn(uc *net.UDPConn) batchConn {
+	if la, ok := uc.LocalAddr().(*net.UDPAddr); ok && la.IP.To4() != nil {
+		return ipv4.NewPacketConn(uc)
+	}
+	return ipv6.NewPacketConn(uc)
+}
+
+// batchReader reads packets from a UDP socket with recvmmsg, a batch
+// at a time, and hands them out one per readFrom call. It's not safe
+// for concurrent use; each RebindingUDPConn has a single reader.
+//
+// Where the kernel supports it, it also turns on UDP_GRO, so that a
+// burst of packets from one sender can arrive as a single coalesced
+// datagram, which readFrom splits back into its segments.
+//
+// wireguard-go's Bind only takes one packet per receive call, so this
+// still costs a copy per packet, but it saves a syscall for all but
+// the first packet of each burst.
+type batchReader struct {
+	pc       net.PacketConn // socket that bc wraps
+	bc       batchConn      // nil if pc can't batch
+	gro      bool           // UDP_GRO is on for pc
+	disabled bool           // recvmmsg failed as unsupported
+	msgs     []ipv4.Message
+	n        int // number of msgs filled by the last ReadBatch
+	next     int // index into msgs of the next packet to return
+
+	// segs is what remains of a coalesced datagram after the
+	// segments already returned, each segSize bytes except
+	// perhaps the last, from segAddr.
+	segs    []byte
+	segSize int
+	segAddr net.Addr
+}
+
+// readFrom reads the next packet from pc into b.
+func (br *batchReader) readFrom(pc net.PacketConn, b []byte) (int, net.Addr, error) {
+	if pc != br.pc {
+		br.reset(pc)
+	}
+	if len(br.segs) > 0 {
+		return br.nextSegment(b)
+	}
+	if br.next < br.n {
+		m := &br.msgs[br.next]
+		br.next++
+		return br.deliver(m, b)
+	}
+	if !br.batching() {
+		// Low-resource mode saves the memory for the batch
+		// buffers at the cost of a syscall per packet.
+		return pc.ReadFrom(b)
+	}
+	if len(br.msgs) == 0 || len(br.msgs[0].Buffers[0]) < len(b) {
+		br.msgs = make([]ipv4.Message, recvBatchSize)
+		for i := range br.msgs {
+			br.msgs[i].Buffers = [][]byte{make([]byte, len(b))}
+			br.msgs[i].OOB = make([]byte, syscall.CmsgSpace(4))
+		}
+	}
+	n, err := br.bc.ReadBatch(br.msgs, 0)
+	if err != nil {
+		if errors.Is(err, syscall.ENOSYS) {
+			// Kernel too old for recvmmsg. (It's also too
+			// old for UDP_GRO, but make sure.)
+			br.disabled = true
+			br.setGRO(false)
+			return pc.ReadFrom(b)
+		}
+		return 0, nil, err
+	}
+	br.n, br.next = n, 1
+	return br.deliver(&br.msgs[0], b)
+}
+
+// batching reports whether br reads its socket with recvmmsg.
+func (br *batchReader) batching() bool {
+	return br.bc != nil && !br.disabled && !debugDisableRecvBatch && !version.IsLowResource()
+}
+
+// deliver copies the packet in m into b. If m is a coalesced
+// datagram, it copies the first segment and keeps the rest for later
+// calls.
+func (br *batchReader) deliver(m *ipv4.Message, b []byte) (int, net.Addr, error) {
+	pkt := m.Buffers[0][:m.N]
+	if br.gro {
+		if size := groSegmentSize(m.OOB[:m.NN]); size > 0 && len(pkt) > size {
+			br.segs, br.segSize, br.segAddr = pkt, size, m.Addr
+			return br.nextSegment(b)
+		}
+	}
+	return copy(b, pkt), m.Addr, nil
+}
+
+// nextSegment copies the next segment of br.segs into b.
+func (br *batchReader) nextSegment(b []byte) (int, net.Addr, error) {
+	seg := br.segs
+	if len(seg) > br.segSize {
+		seg = seg[:br.segSize]
+	}
+	br.segs = br.segs[len(seg):]
+	addr := br.segAddr
+	if len(br.segs) == 0 {
+		br.segs, br.segAddr = nil, nil
+	}
+	return copy(b, seg), addr, nil
+}
+
+// groSegmentSize returns the segment size in the UDP_GRO control
+// message in oob, or 0 if there isn't one.
+func groSegmentSize(oob []byte) int {
+	if len(oob) == 0 {
+		return 0
+	}
+	cms, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, cm := range cms {
+		if cm.Header.Level == syscall.IPPROTO_UDP && cm.Header.Type == udpGRO && len(cm.Data) >= 4 {
+			return int(endian.Native.Uint32(cm.Data))
+		}
+	}
+	return 0
+}
+
+// reset switches br to reading from pc, discarding any packets
+// buffered from the previous socket.
+func (br *batchReader) reset(pc net.PacketConn) {
+	br.pc, br.bc, br.gro = pc, nil, false
+	br.n, br.next = 0, 0
+	br.segs, br.segAddr = nil, nil
+	uc, ok := pc.(*net.UDPConn)
+	if !ok {
+		// Such as a simulated network in tests.
+		return
+	}
+	br.bc = newBatchConn(uc)
+	// Set UDP_GRO either way: a socket handed over from another
+	// process may have it on, and only the batch path splits what
+	// it coalesces.
+	br.setGRO(br.batching())
+}
+
+// setGRO turns UDP_GRO on or off for br's socket, recording whether
+// it's on. Kernels before 5.0 don't have it, which leaves it off.
+func (br *batchReader) setGRO(on bool) {
+	uc, ok := br.pc.(*net.UDPConn)
+	if !ok {
+		return
+	}
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return
+	}
+	v := 0
+	if on {
+		v = 1
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_UDP, udpGRO, v)
+	}); err != nil {
+		serr = err
+	}
+	br.gro = on && serr == nil
+}
+
+// sendBatchUnsupported is whether sendmmsg failed as unsupported, so
+// writeBatch should stop trying it.
+var sendBatchUnsupported syncs.AtomicBool
+
+// writeBatch writes b to each of addrs on pc, with sendmmsg when pc is
+// a UDP socket, and returns how many it wrote before any error.
+//
+// It doesn't use UDP_SEGMENT (GSO): that sends equal-sized segments
+// of one buffer to one destination, while magicsock's sends are one
+// packet, or the same packet to several destinations.
+func writeBatch(pc net.PacketConn, b []byte, addrs []*net.UDPAddr) (int, error) {
+	uc, ok := pc.(*net.UDPConn)
+	if !ok || len(addrs) == 1 || debugDisableSendBatch || sendBatchUnsupported.Get() {
+		return writeEach(pc, b, addrs)
+	}
+	msgs := make([]ipv4.Message, len(addrs))
+	for i, addr := range addrs {
+		msgs[i].Buffers = [][]byte{b}
+		msgs[i].Addr = addr
+	}
+	bc := newBatchConn(uc)
+	sent := 0
+	for sent < len(msgs) {
+		n, err := bc.WriteBatch(msgs[sent:], 0)
+		if err != nil {
+			if sent == 0 && errors.Is(err, syscall.ENOSYS) {
+				sendBatchUnsupported.Set(true)
+				return writeEach(pc, b, addrs)
+			}
+			return sent, err
+		}
+		sent += n
+	}
+	return sent, nil
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+	"tailscale.com/util/endian"
+)
+
+func TestBatchReaderGROSplit(t *testing.T) {
+	oob := make([]byte, syscall.CmsgSpace(4))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = syscall.IPPROTO_UDP
+	h.Type = udpGRO
+	h.SetLen(syscall.CmsgLen(4))
+	endian.Native.PutUint32(oob[syscall.CmsgLen(0):], 3)
+	if got := groSegmentSize(oob); got != 3 {
+		t.Fatalf("groSegmentSize = %d; want 3", got)
+	}
+
+	from := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5}
+	m := &ipv4.Message{
+		Buffers: [][]byte{[]byte("aaabbbcc")},
+		OOB:     oob,
+		Addr:    from,
+		N:       8,
+		NN:      len(oob),
+	}
+	br := &batchReader{gro: true}
+	b := make([]byte, 100)
+	n, addr, _ := br.deliver(m, b)
+	var got []string
+	for {
+		if addr != from {
+			t.Fatalf("addr = %v; want %v", addr, from)
+		}
+		got = append(got, string(b[:n]))
+		if len(br.segs) == 0 {
+			break
+		}
+		n, addr, _ = br.readFrom(nil, b)
+	}
+	if want := []string{"aaa", "bbb", "cc"}; len(got) != 3 || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("segments = %q; want %q", got, want)
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	var addrs []*net.UDPAddr
+	for i := 0; i < 3; i++ {
+		rc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		rc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		addrs = append(addrs, rc.LocalAddr().(*net.UDPAddr))
+		defer func() {
+			b := make([]byte, 10)
+			n, _, err := rc.ReadFrom(b)
+			if err != nil || string(b[:n]) != "hello" {
+				t.Errorf("read %q, %v; want hello", b[:n], err)
+			}
+		}()
+	}
+	n, err := writeBatch(pc, []byte("hello"), addrs)
+	if n != len(addrs) || err != nil {
+		t.Fatalf("writeBatch = %d, %v; want %d, nil", n, err, len(addrs))
+	}
+}
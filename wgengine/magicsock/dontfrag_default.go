@@ -0,0 +1,19 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package magicsock
+
+import (
+	"errors"
+	"net"
+)
+
+// canSetDontFragment is whether setDontFragment is implemented.
+const canSetDontFragment = false
+
+func setDontFragment(pc net.PacketConn, network string) error {
+	return errors.New("unsupported")
+}
@@ -0,0 +1,43 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"errors"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// canSetDontFragment is whether setDontFragment is implemented.
+const canSetDontFragment = true
+
+// setDontFragment makes pc, a UDP socket of the given network ("udp4"
+// or "udp6"), send all packets with the Don't Fragment bit set, or
+// unfragmented for IPv6, and ignore the path MTUs the kernel learns:
+// too large packets are dropped along the way, rather than fragmented
+// or refused locally.
+func setDontFragment(pc net.PacketConn, network string) error {
+	uc, ok := pc.(*net.UDPConn)
+	if !ok {
+		return errors.New("not a UDP socket")
+	}
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if network == "udp6" {
+			serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_PROBE)
+		} else {
+			serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_PROBE)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -8,10 +8,12 @@ package magicsock
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	crand "crypto/rand"
 	"encoding/binary"
 	"errors"
+	"expvar"
 	"fmt"
 	"hash/fnv"
 	"math"
@@ -19,6 +21,7 @@ import (
 	"net"
 	"os"
 	"reflect"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
@@ -39,12 +42,16 @@ import (
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
 	"tailscale.com/disco"
+	"tailscale.com/health"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/logtail/backoff"
+	"tailscale.com/metrics"
 	"tailscale.com/net/dnscache"
 	"tailscale.com/net/interfaces"
+	"tailscale.com/net/nat64"
 	"tailscale.com/net/netcheck"
 	"tailscale.com/net/netns"
+	"tailscale.com/net/portmapper"
 	"tailscale.com/net/stun"
 	"tailscale.com/syncs"
 	"tailscale.com/tailcfg"
@@ -81,8 +88,65 @@ var (
 	// on mobile devices, lowers the shutdown interval, and logs more
 	// verbosely about idle measurements.
 	debugReSTUNStopOnIdle, _ = strconv.ParseBool(os.Getenv("TS_DEBUG_RESTUN_STOP_ON_IDLE"))
+	// derpWebSocket makes DERP connections always use WebSockets,
+	// rather than only after a plain DERP connection fails.
+	derpWebSocket, _ = strconv.ParseBool(os.Getenv("TS_DERP_WEBSOCKET"))
+	// derpLongPoll makes DERP connections always use HTTPS
+	// long-poll requests, rather than only after WebSockets fail.
+	derpLongPoll, _ = strconv.ParseBool(os.Getenv("TS_DERP_LONGPOLL"))
+	// debugDisablePortMapper stops magicsock from asking the LAN
+	// gateway for a port mapping with UPnP, NAT-PMP or PCP.
+	debugDisablePortMapper, _ = strconv.ParseBool(os.Getenv("TS_DEBUG_DISABLE_PORTMAPPER"))
+	// multipathMode, if "failover" (or "1" or "true") or "spray",
+	// enables a socket per local interface. See multipath.go.
+	multipathMode = os.Getenv("TS_MULTIPATH")
+	// debugDisableRecvBatch makes the main UDP sockets read one
+	// packet per syscall, rather than using recvmmsg on Linux.
+	debugDisableRecvBatch, _ = strconv.ParseBool(os.Getenv("TS_DEBUG_DISABLE_RECV_BATCH"))
+	// debugDisableSendBatch makes the main UDP sockets send a
+	// packet bound for several addresses with a syscall per
+	// address, rather than using sendmmsg on Linux.
+	debugDisableSendBatch, _ = strconv.ParseBool(os.Getenv("TS_DEBUG_DISABLE_SEND_BATCH"))
+	// derpIdleTimeoutEnv, if set, is the default duration of
+	// Options.DERPIdleTimeout, such as "5m", or "0" for never.
+	derpIdleTimeoutEnv = os.Getenv("TS_DERP_IDLE_TIMEOUT")
 )
 
+// Metrics across all Conns; see ExpVar.
+var (
+	derpConnsCurrent    expvar.Int
+	derpConnsOpened     expvar.Int
+	derpConnsIdleClosed expvar.Int
+	derpConnsReopened   expvar.Int // redialed after an idle close
+
+	derpRecvSpoofed expvar.Int // see Conn.DERPSpoofedPackets
+
+	discoRecvLimited  expvar.Int // see Conn.DiscoDrops
+	discoRecvReplayed expvar.Int
+)
+
+// ExpVar returns an expvar variable of the DERP connection, DERP
+// receive and disco metrics, suitable for registering with
+// expvar.Publish.
+func ExpVar() expvar.Var {
+	m := new(metrics.Set)
+	m.Set("gauge_derp_connections", &derpConnsCurrent)
+	m.Set("counter_derp_connections_opened", &derpConnsOpened)
+	m.Set("counter_derp_connections_idle_closed", &derpConnsIdleClosed)
+	m.Set("counter_derp_connections_reopened", &derpConnsReopened)
+	m.Set("counter_derp_recv_spoofed", &derpRecvSpoofed)
+	m.Set("counter_disco_recv_rate_limited", &discoRecvLimited)
+	m.Set("counter_disco_recv_replayed", &discoRecvReplayed)
+	return m
+}
+
+// discoVerbose reports whether to log verbosely about discovery:
+// with TS_DEBUG_DISCO set, or while the magicsock component is at
+// debug level.
+func discoVerbose() bool {
+	return debugDisco || logger.ComponentLevel("magicsock") >= logger.LevelDebug
+}
+
 // useDerpRoute reports whether magicsock should enable the DERP
 // return path optimization (Issue 150).
 func useDerpRoute() bool {
@@ -110,17 +174,38 @@ func inTest() bool {
 // A Conn routes UDP packets and actively manages a list of its endpoints.
 // It implements wireguard/conn.Bind.
 type Conn struct {
-	pconnPort        uint16 // the preferred port from opts.Port; 0 means auto
+	// derpSpoofed is the number of packets dropped because their
+	// claimed sender didn't match the DERP sender; see
+	// derpSourceOK. It's accessed atomically, so it's first for
+	// 64-bit alignment on 32-bit platforms.
+	derpSpoofed uint64
+	// discoLimited and discoReplayed are the number of disco
+	// messages dropped for being over their sender's rate limit
+	// and for replaying an earlier message; see DiscoDrops. They're
+	// accessed atomically.
+	discoLimited  uint64
+	discoReplayed uint64
+
+	pconnPort        uint32           // atomic; the preferred port, initially opts.Port; 0 means auto
+	optsPort         uint16           // opts.Port, restored by SetPreferredPort(0)
+	portBusy         syncs.AtomicBool // whether the preferred port was in use at last attempt
 	pconn4           *RebindingUDPConn
 	pconn6           *RebindingUDPConn // non-nil if IPv6 available
+	pathList         atomic.Value      // of []*pathConn; the values of pathConns, for use without mu
 	epFunc           func(endpoints []string)
 	derpActiveFunc   func()
 	logf             logger.Logf
 	sendLogLimit     *rate.Limiter
+	spoofLogLimit    *rate.Limiter
 	netChecker       *netcheck.Client
+	portMapper       *portmapper.Client
 	idleFunc         func() time.Duration   // nil means unknown
 	noteRecvActivity func(tailcfg.DiscoKey) // or nil, see Options.NoteRecvActivity
 	simulatedNetwork bool
+	lowMemory        bool                       // see Options.LowMemory
+	maxPeerMTU       int                        // 0 unless path MTU discovery is on; see Options.MaxPeerMTU
+	peerMTUFunc      func(tailcfg.NodeKey, int) // or nil, see Options.PeerMTUFunc
+	derpIdleTimeout  time.Duration              // 0 means never; see Options.DERPIdleTimeout
 
 	// bufferedIPv4From and bufferedIPv4Packet are owned by
 	// ReceiveIPv4, and used when both a DERP and IPv4 packet arrive
@@ -135,12 +220,40 @@ type Conn struct {
 	// Its Loaded value is always non-nil.
 	stunReceiveFunc atomic.Value // of func(p []byte, fromAddr *net.UDPAddr)
 
+	// relayOnlyAddrs holds the network map endpoints of the peers
+	// only reached through DERP, whose packets from them are
+	// dropped, and relayOnlyKeys those peers' keys, whose sessions'
+	// packets are dropped whatever address they come from. See
+	// updateRelayOnlyLocked.
+	relayOnlyAddrs atomic.Value // of map[netaddr.IPPort]bool
+	relayOnlyKeys  atomic.Value // of map[key.Public]bool
+
+	// lanInfo describes the local network, for finding peers on
+	// it. See updateLANInfo.
+	lanInfo atomic.Value // of *lanInfo
+
 	udpRecvCh  chan udpReadResult
 	derpRecvCh chan derpReadResult
+	pathRecvCh chan pathReadResult
 
 	// packetListener optionally specifies a test hook to open a PacketConn.
 	packetListener nettype.PacketListener
 
+	// inheritedConns are Options.InheritedConns not yet used by
+	// initialBind.
+	inheritedConns map[string]net.PacketConn
+
+	// derpStatsMu guards derpStats. It's a leaf lock, and may be
+	// acquired while holding mu.
+	derpStatsMu sync.Mutex
+	derpStats   map[key.Public]*derpPeerStats // netmap peer => traffic relayed via DERP
+
+	// sessionsMu guards sessions and sessionsPruned. It's a leaf
+	// lock.
+	sessionsMu     sync.RWMutex
+	sessions       map[uint32]sessionPeer // our WireGuard session index => peer; see SessionPeer
+	sessionsPruned time.Time              // when expired sessions were last removed
+
 	// ============================================================
 	mu     sync.Mutex // guards all following fields; see userspaceEngine lock ordering rules
 	muCond *sync.Cond
@@ -152,6 +265,8 @@ type Conn struct {
 	wantEndpointsUpdate   string // true if non-empty; string is reason
 	lastEndpoints         []string
 	peerSet               map[key.Public]struct{}
+	endpointPrivacy       EndpointPrivacy
+	relayOnlyIPs          map[netaddr.IP]bool // see SetRelayOnlyPeers
 
 	discoPrivate    key.Private
 	discoPublic     tailcfg.DiscoKey // public of discoPrivate
@@ -161,6 +276,7 @@ type Conn struct {
 	discoOfAddr     map[netaddr.IPPort]tailcfg.DiscoKey // validated non-DERP paths only
 	endpointOfDisco map[tailcfg.DiscoKey]*discoEndpoint // those with activity only
 	sharedDiscoKey  map[tailcfg.DiscoKey]*[32]byte      // nacl/box precomputed key
+	discoRecv       map[tailcfg.DiscoKey]*discoRecvState
 
 	// addrsByUDP is a map of every remote ip:port to a priority
 	// list of endpoint addresses for a peer.
@@ -190,6 +306,7 @@ type Conn struct {
 	derpStarted chan struct{}      // closed on first connection to DERP; for tests & cleaner Close
 	activeDerp  map[int]activeDerp // DERP regionID -> connection to a node in that region
 	prevDerp    map[int]*syncs.WaitGroupChan
+	idleDerp    map[int]bool // regions whose connection was closed for being idle
 
 	// derpRoute contains optional alternate routes to use as an
 	// optimization instead of contacting a peer via their home
@@ -204,6 +321,10 @@ type Conn struct {
 	// peer. It's only used to quiet logging, so we only log on change.
 	peerLastDerp map[key.Public]int
 
+	// pathConns are the extra sockets bound to each non-default
+	// interface in multipath mode, keyed by their local address.
+	pathConns map[netaddr.IP]*pathConn
+
 	// noV4 and noV6 are whether IPv4 and IPv6 are known to be
 	// missing.  They're only used to suppress log spam. The name
 	// is named negatively because in early start-up, we don't yet
@@ -301,6 +422,12 @@ type Options struct {
 	// It's meant for testing.
 	PacketListener nettype.PacketListener
 
+	// InheritedConns optionally holds UDP sockets to use at first
+	// instead of binding new ones, keyed by network ("udp4" or
+	// "udp6"): those of a previous tailscaled, in an in-place
+	// upgrade. See Conn.SocketFiles.
+	InheritedConns map[string]net.PacketConn
+
 	// NoteRecvActivity, if provided, is a func for magicsock to
 	// call whenever it receives a packet from a a
 	// discovery-capable peer if it's been more than ~10 seconds
@@ -320,6 +447,31 @@ type Options struct {
 	// triggering macOS and Windows firwall dialog boxes during
 	// "go test").
 	SimulatedNetwork bool
+
+	// MaxPeerMTU, if more than 1280, turns on path MTU discovery
+	// where it's supported (Linux): the paths to active peers are
+	// probed for the largest packets, up to MaxPeerMTU bytes, that
+	// they carry through the tunnel.
+	MaxPeerMTU int
+
+	// PeerMTUFunc optionally provides a func to be called when
+	// path MTU discovery finds a new MTU for the path to a peer.
+	// It's called with magicsock's locks held, so must not call
+	// back into the Conn.
+	PeerMTUFunc func(peer tailcfg.NodeKey, mtu int)
+
+	// LowMemory, if true, makes the Conn favor memory use over
+	// throughput, as in low-resource mode (see
+	// version.IsLowResource), whatever the process-wide mode.
+	LowMemory bool
+
+	// DERPIdleTimeout is how long a connection to a DERP region
+	// other than the home one may go without packets to send
+	// before it's closed, to be dialed again when next needed.
+	// Zero means the duration in the TS_DERP_IDLE_TIMEOUT
+	// environment variable or, if unset, derpIdleTimeoutDefault.
+	// Negative means never.
+	DERPIdleTimeout time.Duration
 }
 
 func (o *Options) logf() logger.Logf {
@@ -343,19 +495,45 @@ func (o *Options) derpActiveFunc() func() {
 	return o.DERPActiveFunc
 }
 
+// derpIdleTimeout returns the DERP idle timeout to use, or 0 for
+// never.
+func (o *Options) derpIdleTimeout(logf logger.Logf) time.Duration {
+	d := o.DERPIdleTimeout
+	if d == 0 && derpIdleTimeoutEnv != "" {
+		var err error
+		d, err = time.ParseDuration(derpIdleTimeoutEnv)
+		if err != nil {
+			logf("magicsock: invalid TS_DERP_IDLE_TIMEOUT %q; using %v: %v", derpIdleTimeoutEnv, derpIdleTimeoutDefault, err)
+			d = 0
+		} else if d == 0 {
+			return 0
+		}
+	}
+	switch {
+	case d == 0:
+		return derpIdleTimeoutDefault
+	case d < 0:
+		return 0
+	}
+	return d
+}
+
 // newConn is the error-free, network-listening-side-effect-free based
 // of NewConn. Mostly for tests.
 func newConn() *Conn {
 	c := &Conn{
 		sendLogLimit:    rate.NewLimiter(rate.Every(1*time.Minute), 1),
+		spoofLogLimit:   rate.NewLimiter(rate.Every(1*time.Minute), 1),
 		addrsByUDP:      make(map[netaddr.IPPort]*AddrSet),
 		addrsByKey:      make(map[key.Public]*AddrSet),
 		derpRecvCh:      make(chan derpReadResult),
 		udpRecvCh:       make(chan udpReadResult),
+		pathRecvCh:      make(chan pathReadResult),
 		derpStarted:     make(chan struct{}),
 		peerLastDerp:    make(map[key.Public]int),
 		endpointOfDisco: make(map[tailcfg.DiscoKey]*discoEndpoint),
 		sharedDiscoKey:  make(map[tailcfg.DiscoKey]*[32]byte),
+		discoRecv:       make(map[tailcfg.DiscoKey]*discoRecvState),
 		discoOfAddr:     make(map[netaddr.IPPort]tailcfg.DiscoKey),
 	}
 	c.muCond = sync.NewCond(&c.mu)
@@ -370,14 +548,26 @@ func newConn() *Conn {
 // It doesn't start doing anything until Start is called.
 func NewConn(opts Options) (*Conn, error) {
 	c := newConn()
-	c.pconnPort = opts.Port
+	c.pconnPort = uint32(opts.Port)
+	c.optsPort = opts.Port
 	c.logf = opts.logf()
 	c.epFunc = opts.endpointsFunc()
 	c.derpActiveFunc = opts.derpActiveFunc()
 	c.idleFunc = opts.IdleFunc
 	c.packetListener = opts.PacketListener
+	c.inheritedConns = opts.InheritedConns
 	c.noteRecvActivity = opts.NoteRecvActivity
 	c.simulatedNetwork = opts.SimulatedNetwork
+	c.lowMemory = opts.LowMemory
+	c.peerMTUFunc = opts.PeerMTUFunc
+	c.derpIdleTimeout = opts.derpIdleTimeout(c.logf)
+	if opts.MaxPeerMTU > minPathMTU {
+		if canSetDontFragment {
+			c.maxPeerMTU = opts.MaxPeerMTU
+		} else {
+			c.logf("magicsock: path MTU discovery is unsupported on %s", runtime.GOOS)
+		}
+	}
 
 	if err := c.initialBind(); err != nil {
 		return nil, err
@@ -393,6 +583,8 @@ func NewConn(opts Options) (*Conn, error) {
 		c.netChecker.GetSTUNConn6 = func() netcheck.STUNConn { return c.pconn6 }
 	}
 
+	c.portMapper = portmapper.NewClient(c.logf, c.onPortMapChanged)
+
 	c.ignoreSTUNPackets()
 
 	return c, nil
@@ -510,6 +702,11 @@ func (c *Conn) updateNetInfo(ctx context.Context) (*netcheck.Report, error) {
 
 	c.noV4.Set(!report.IPv4)
 	c.noV6.Set(!report.IPv6)
+	if !report.IPv4 && report.IPv6 {
+		// An IPv6-only network; find its NAT64 prefix, if any,
+		// for sendUDPStd.
+		go nat64.Refresh(c.connCtx)
+	}
 
 	ni := &tailcfg.NetInfo{
 		DERPLatency:           map[string]float64{},
@@ -527,6 +724,7 @@ func (c *Conn) updateNetInfo(ctx context.Context) (*netcheck.Report, error) {
 	}
 	ni.WorkingIPv6.Set(report.IPv6)
 	ni.WorkingUDP.Set(report.UDP)
+	ni.NATType = report.NATType()
 	ni.PreferredDERP = report.PreferredDERP
 
 	if ni.PreferredDERP == 0 {
@@ -762,8 +960,14 @@ func (c *Conn) setNearestDERP(derpNum int) (wantDERP bool) {
 	defer c.mu.Unlock()
 	if !c.wantDerpLocked() {
 		c.myDerp = 0
+		health.Set(health.SysDERP, nil)
 		return false
 	}
+	if derpNum == 0 {
+		health.Set(health.SysDERP, errors.New("no home DERP region; peers that can't be reached directly are unreachable"))
+	} else {
+		health.Set(health.SysDERP, nil)
+	}
 	if derpNum == c.myDerp {
 		// No change.
 		return true
@@ -812,14 +1016,19 @@ func (c *Conn) determineEndpoints(ctx context.Context) (ipPorts []string, reason
 		c.logf("magicsock.Conn.determineEndpoints: updateNetInfo: %v", err)
 		return nil, nil, err
 	}
+	c.updateLANInfo(nr)
 
 	already := make(map[string]string) // endpoint -> how it was found
 	var eps []string                   // unique endpoints
 
+	hidden := c.hiddenEndpointFunc()
 	addAddr := func(s, reason string) {
 		if debugOmitLocalAddresses && (reason == "localAddresses" || reason == "socket") {
 			return
 		}
+		if hidden != nil && hidden(s, reason) {
+			return
+		}
 		if _, ok := already[s]; !ok {
 			already[s] = reason
 			eps = append(eps, s)
@@ -834,9 +1043,9 @@ func (c *Conn) determineEndpoints(ctx context.Context) (ipPorts []string, reason
 		// port mapping on their router to the same explicit
 		// port that tailscaled is running with. Worst case
 		// it's an invalid candidate mapping.
-		if nr.MappingVariesByDestIP.EqualBool(true) && c.pconnPort != 0 {
+		if port := c.preferredPort(); nr.MappingVariesByDestIP.EqualBool(true) && port != 0 {
 			if ip, _, err := net.SplitHostPort(nr.GlobalV4); err == nil {
-				addAddr(net.JoinHostPort(ip, strconv.Itoa(int(c.pconnPort))), "port_in")
+				addAddr(net.JoinHostPort(ip, strconv.Itoa(int(port))), "port_in")
 			}
 		}
 	}
@@ -844,6 +1053,18 @@ func (c *Conn) determineEndpoints(ctx context.Context) (ipPorts []string, reason
 		addAddr(nr.GlobalV6, "stun")
 	}
 
+	if c.shouldPortMap() {
+		c.portMapper.SetLocalPort(c.LocalPort())
+		if ext, ok := c.portMapper.GetCachedMappingOrStartCreatingOne(); ok {
+			addAddr(ext.String(), "portmap")
+		}
+	}
+
+	c.updatePaths()
+	for _, ep := range c.pathEndpoints() {
+		addAddr(ep, "multipath")
+	}
+
 	c.ignoreSTUNPackets()
 
 	if localAddr := c.pconn4.LocalAddr(); localAddr.IP.IsUnspecified() {
@@ -861,8 +1082,21 @@ func (c *Conn) determineEndpoints(ctx context.Context) (ipPorts []string, reason
 			ips = loopback
 			reason = "loopback"
 		}
+		var port6 int
+		if c.pconn6 != nil {
+			port6 = c.pconn6.LocalAddr().Port
+		}
 		for _, ipStr := range ips {
-			addAddr(net.JoinHostPort(ipStr, fmt.Sprint(localAddr.Port)), reason)
+			port := localAddr.Port
+			if strings.Contains(ipStr, ":") {
+				// IPv6, which is sent and received on its
+				// own socket.
+				if port6 == 0 {
+					continue
+				}
+				port = port6
+			}
+			addAddr(net.JoinHostPort(ipStr, fmt.Sprint(port)), reason)
 		}
 	} else {
 		// Our local endpoint is bound to a particular address.
@@ -883,6 +1117,247 @@ func (c *Conn) determineEndpoints(ctx context.Context) (ipPorts []string, reason
 	return eps, already, nil
 }
 
+// EndpointPrivacy limits the endpoints a Conn advertises to peers,
+// for networks whose internal addresses mustn't be revealed to other
+// tailnet members. Peers that can't reach the Conn at the endpoints
+// left reach it through DERP.
+type EndpointPrivacy struct {
+	// NoPrivate hides private addresses; see interfaces.IsPrivateIP.
+	NoPrivate bool
+	// NoInterfaces hides the addresses of these network interfaces.
+	NoInterfaces []string
+}
+
+// SetEndpointPrivacy sets which endpoints c keeps from peers, and
+// re-determines the ones it advertises.
+func (c *Conn) SetEndpointPrivacy(p EndpointPrivacy) {
+	c.mu.Lock()
+	c.endpointPrivacy = p
+	started := c.started && !c.closed
+	c.mu.Unlock()
+	if started {
+		c.ReSTUN("endpoint-privacy")
+	}
+}
+
+// hiddenEndpointFunc returns a func reporting whether the endpoint
+// ipPort, found the way reason says, is kept from peers by c's
+// EndpointPrivacy, or nil if none are.
+func (c *Conn) hiddenEndpointFunc() func(ipPort, reason string) bool {
+	c.mu.Lock()
+	p := c.endpointPrivacy
+	c.mu.Unlock()
+	if !p.NoPrivate && len(p.NoInterfaces) == 0 {
+		return nil
+	}
+
+	hiddenIP := map[netaddr.IP]bool{}
+	hideLocal := false
+	if len(p.NoInterfaces) > 0 {
+		err := interfaces.ForeachInterfaceAddress(func(ifc interfaces.Interface, ip netaddr.IP) {
+			for _, name := range p.NoInterfaces {
+				if ifc.Name == name {
+					hiddenIP[ip] = true
+				}
+			}
+		})
+		if err != nil {
+			// Without knowing which addresses are the
+			// interfaces', keep all local addresses quiet.
+			c.logf("magicsock: listing interface addresses: %v; advertising no local endpoints", err)
+			hideLocal = true
+		}
+	}
+	return func(ipPort, reason string) bool {
+		if hideLocal && (reason == "localAddresses" || reason == "socket" || reason == "multipath") {
+			return true
+		}
+		ipp, err := netaddr.ParseIPPort(ipPort)
+		if err != nil {
+			return false
+		}
+		return hiddenIP[ipp.IP] || p.NoPrivate && interfaces.IsPrivateIP(ipp.IP)
+	}
+}
+
+// SetRelayOnlyPeers sets the Tailscale IPs of the peers that c only
+// reaches through DERP, besides those whose Node is RelayOnly. c
+// neither tries direct paths to them nor accepts packets from them
+// other than through DERP. Peers without discovery keys only pick up a change the
+// next time their WireGuard endpoints are set.
+func (c *Conn) SetRelayOnlyPeers(ips []netaddr.IP) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.relayOnlyIPs = make(map[netaddr.IP]bool, len(ips))
+	for _, ip := range ips {
+		c.relayOnlyIPs[ip] = true
+	}
+	for dk, de := range c.endpointOfDisco {
+		de.updateFromNode(c.nodeOfDisco[dk])
+	}
+	c.updateRelayOnlyLocked()
+}
+
+// isRelayOnlyLocked reports whether n is only to be reached through
+// DERP, because control says so or one of its addresses is among
+// c.relayOnlyIPs.
+//
+// c.mu must be held.
+func (c *Conn) isRelayOnlyLocked(n *tailcfg.Node) bool {
+	if n.RelayOnly {
+		return true
+	}
+	if len(c.relayOnlyIPs) == 0 {
+		return false
+	}
+	for _, a := range n.Addresses {
+		if ip, ok := netaddr.FromStdIP(a.IP.IP()); ok && c.relayOnlyIPs[ip] {
+			return true
+		}
+	}
+	return false
+}
+
+// updateRelayOnlyLocked sets c.relayOnlyAddrs and c.relayOnlyKeys
+// to the endpoints and keys of the relay-only peers in the network
+// map, and forgets the direct paths to them in c.discoOfAddr.
+//
+// c.mu must be held.
+func (c *Conn) updateRelayOnlyLocked() {
+	var addrs map[netaddr.IPPort]bool
+	var keys map[key.Public]bool
+	relayOnlyDisco := map[tailcfg.DiscoKey]bool{}
+	if c.netMap != nil {
+		for _, n := range c.netMap.Peers {
+			if !c.isRelayOnlyLocked(n) {
+				continue
+			}
+			if addrs == nil {
+				addrs = map[netaddr.IPPort]bool{}
+				keys = map[key.Public]bool{}
+			}
+			keys[key.Public(n.Key)] = true
+			for _, ep := range n.Endpoints {
+				if ipp, err := parseEndpoint(ep); err == nil {
+					addrs[ipp] = true
+				}
+			}
+			if !n.DiscoKey.IsZero() {
+				relayOnlyDisco[n.DiscoKey] = true
+			}
+		}
+	}
+	for ipp, dk := range c.discoOfAddr {
+		if relayOnlyDisco[dk] {
+			delete(c.discoOfAddr, ipp)
+		}
+	}
+	c.relayOnlyAddrs.Store(addrs)
+	c.relayOnlyKeys.Store(keys)
+}
+
+// isRelayOnlyAddr reports whether ipp is an endpoint of a peer only
+// reached through DERP, whose packets are to be dropped.
+func (c *Conn) isRelayOnlyAddr(ipp netaddr.IPPort) bool {
+	m, _ := c.relayOnlyAddrs.Load().(map[netaddr.IPPort]bool)
+	return m[ipp]
+}
+
+// isRelayOnlyPacket reports whether the WireGuard packet b, received
+// directly from ipp rather than through DERP, is to be dropped for
+// coming from a peer only reached through DERP: because ipp is one of
+// those peers' endpoints, or because b belongs to a session with one
+// of them, whatever address it came from. A handshake initiation from
+// another address can't be told apart without decrypting it, but the
+// response to it only goes through DERP, and what the peer then sends
+// directly in the session it starts is dropped here.
+func (c *Conn) isRelayOnlyPacket(b []byte, ipp netaddr.IPPort) bool {
+	if c.isRelayOnlyAddr(ipp) {
+		return true
+	}
+	keys, _ := c.relayOnlyKeys.Load().(map[key.Public]bool)
+	if len(keys) == 0 {
+		return false
+	}
+	idx, ok := receiverIndex(b)
+	if !ok {
+		return false
+	}
+	peer, ok := c.SessionPeer(idx)
+	return ok && keys[peer]
+}
+
+// lanInfo is what a Conn knows of its local network.
+type lanInfo struct {
+	prefixes []netaddr.IPPrefix // subnets of the local interfaces; see interfaces.LANPrefixes
+	publicIP netaddr.IP         // public IPv4 address of our NAT per STUN, or zero
+}
+
+func (li *lanInfo) equal(o *lanInfo) bool {
+	if li.publicIP != o.publicIP || len(li.prefixes) != len(o.prefixes) {
+		return false
+	}
+	for i, p := range li.prefixes {
+		if p != o.prefixes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// updateLANInfo refreshes c.lanInfo from the local interfaces and the
+// latest netcheck report. If it changed, as after moving networks,
+// every peer's LAN path is picked anew.
+func (c *Conn) updateLANInfo(nr *netcheck.Report) {
+	prefixes, err := interfaces.LANPrefixes()
+	if err != nil {
+		c.logf("magicsock: LANPrefixes: %v", err)
+	}
+	li := &lanInfo{prefixes: prefixes}
+	if ipp, err := netaddr.ParseIPPort(nr.GlobalV4); err == nil {
+		li.publicIP = ipp.IP
+	}
+	if old, _ := c.lanInfo.Load().(*lanInfo); old != nil && old.equal(li) {
+		return
+	}
+	c.lanInfo.Store(li)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, de := range c.endpointOfDisco {
+		de.mu.Lock()
+		de.updateLANLocked(true)
+		de.mu.Unlock()
+	}
+}
+
+// isLANAddr reports whether ipp is on the subnet of a local interface.
+func (c *Conn) isLANAddr(ipp netaddr.IPPort) bool {
+	li, _ := c.lanInfo.Load().(*lanInfo)
+	if li == nil {
+		return false
+	}
+	for _, p := range li.prefixes {
+		if p.Contains(ipp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldPortMap reports whether c should ask the LAN gateway to map
+// a port to it.
+func (c *Conn) shouldPortMap() bool {
+	return !debugDisablePortMapper && !inTest()
+}
+
+// onPortMapChanged is called by the port mapper when its mapping
+// changes, so the new endpoint is advertised.
+func (c *Conn) onPortMapChanged() {
+	c.ReSTUN("portmap-changed")
+}
+
 func stringsEqual(x, y []string) bool {
 	if len(x) != len(y) {
 		return false
@@ -900,6 +1375,72 @@ func (c *Conn) LocalPort() uint16 {
 	return uint16(laddr.Port)
 }
 
+// preferredPort returns the UDP port c wants to listen on, or 0 for
+// any port.
+func (c *Conn) preferredPort() uint16 {
+	return uint16(atomic.LoadUint32(&c.pconnPort))
+}
+
+// SetPreferredPort sets the UDP port c listens on, moving its sockets
+// to it. Zero restores Options.Port. If the port is in use, c stays
+// on its current port and tries again periodically.
+func (c *Conn) SetPreferredPort(port uint16) {
+	if port == 0 {
+		port = c.optsPort
+	}
+	if uint16(atomic.SwapUint32(&c.pconnPort, uint32(port))) == port {
+		return
+	}
+	c.logf("magicsock: preferred port set to %d", port)
+	c.portBusy.Set(false)
+	if !c.rebindPreferredPort() {
+		return
+	}
+	c.mu.Lock()
+	started := c.started && !c.closed
+	c.mu.Unlock()
+	if started {
+		c.ReSTUN("port-changed")
+	}
+}
+
+// rebindPreferredPort moves c's sockets to its preferred port, if one
+// is set and they're not already on it, and reports whether any moved.
+func (c *Conn) rebindPreferredPort() (moved bool) {
+	port := c.preferredPort()
+	if port == 0 {
+		return false
+	}
+	if c.rebindTo(c.pconn4, "udp4", port) {
+		moved = true
+	}
+	if c.pconn6 != nil && c.rebindTo(c.pconn6, "udp6", port) {
+		moved = true
+	}
+	return moved
+}
+
+// rebindTo moves ruc to port, unless it's already there or port is
+// in use.
+func (c *Conn) rebindTo(ruc *RebindingUDPConn, network string, port uint16) bool {
+	cur := ruc.LocalAddr().Port
+	if cur == int(port) {
+		return false
+	}
+	pc, err := c.listenPacket(context.Background(), network, net.JoinHostPort(bindHost(network, c.simulatedNetwork), fmt.Sprint(port)))
+	if err != nil {
+		if !c.portBusy.Get() {
+			c.logf("magicsock: preferred port %s/%d unavailable, staying on %d until it's free: %v", network, port, cur, err)
+			c.portBusy.Set(true)
+		}
+		return false
+	}
+	c.portBusy.Set(false)
+	c.logf("magicsock: moved %s from port %d to %d", network, cur, port)
+	ruc.Reset(pc)
+	return true
+}
+
 func shouldSprayPacket(b []byte) bool {
 	if len(b) < 4 {
 		return false
@@ -916,6 +1457,72 @@ func shouldSprayPacket(b []byte) bool {
 
 const sprayPeriod = 3 * time.Second
 
+// sessionLifetime is how long the peer of a WireGuard session index
+// is remembered after our handshake message naming it: longer than
+// wireguard-go accepts packets in a session (RejectAfterTime, three
+// minutes).
+const sessionLifetime = 4 * time.Minute
+
+// sessionPeer is the peer of a WireGuard session, and when we sent
+// the handshake message that began it.
+type sessionPeer struct {
+	peer key.Public
+	sent time.Time
+}
+
+// noteSentHandshake records, if b is a WireGuard handshake initiation
+// or response being sent to ep, the peer of the session index it
+// gives our side. The transport messages the peer sends in that
+// session carry the index, which lets SessionPeer attribute them.
+func (c *Conn) noteSentHandshake(b []byte, ep conn.Endpoint) {
+	if len(b) < 8 {
+		return
+	}
+	switch binary.LittleEndian.Uint32(b[:4]) {
+	case device.MessageInitiationType, device.MessageResponseType:
+	default:
+		return
+	}
+	var peer key.Public
+	switch v := ep.(type) {
+	case *discoEndpoint:
+		peer = key.Public(v.publicKey)
+	case *AddrSet:
+		peer = v.publicKey
+	default:
+		return
+	}
+	idx := binary.LittleEndian.Uint32(b[4:8])
+	now := time.Now()
+
+	c.sessionsMu.Lock()
+	defer c.sessionsMu.Unlock()
+	if c.sessions == nil {
+		c.sessions = make(map[uint32]sessionPeer)
+	}
+	if now.Sub(c.sessionsPruned) > sessionLifetime {
+		for idx, sp := range c.sessions {
+			if now.Sub(sp.sent) > sessionLifetime {
+				delete(c.sessions, idx)
+			}
+		}
+		c.sessionsPruned = now
+	}
+	c.sessions[idx] = sessionPeer{peer: peer, sent: now}
+}
+
+// SessionPeer returns the peer of the WireGuard session whose index
+// on our side is idx: the receiver index of the transport messages
+// the peer sends in it, which wireguard-go decrypts with that
+// session's keys. It reports false for sessions it doesn't know, such
+// as ones whose handshake was sent to an address that isn't a peer's.
+func (c *Conn) SessionPeer(idx uint32) (peer key.Public, ok bool) {
+	c.sessionsMu.RLock()
+	defer c.sessionsMu.RUnlock()
+	sp, ok := c.sessions[idx]
+	return sp.peer, ok
+}
+
 // appendDests appends to dsts the destinations that b should be
 // written to in order to reach as. Some of the returned IPPorts may
 // be fake addrs representing DERP servers.
@@ -1017,6 +1624,8 @@ func (c *Conn) Send(b []byte, ep conn.Endpoint) error {
 		return errNetworkDown
 	}
 
+	c.noteSentHandshake(b, ep)
+
 	var as *AddrSet
 	switch v := ep.(type) {
 	default:
@@ -1044,19 +1653,39 @@ func (c *Conn) Send(b []byte, ep conn.Endpoint) error {
 
 	var success bool
 	var ret error
-	for _, addr := range dsts {
-		sent, err := c.sendAddr(addr, as.publicKey, b)
+	note := func(sent bool, err error, logErr bool, dst interface{}) {
 		if sent {
 			success = true
 		} else if ret == nil {
 			ret = err
 		}
-		if err != nil && addr != roamAddr && c.sendLogLimit.Allow() {
+		if err != nil && logErr && c.sendLogLimit.Allow() {
 			if c.connCtx.Err() == nil { // don't log if we're closed
-				c.logf("magicsock: Conn.Send(%v): %v", addr, err)
+				c.logf("magicsock: Conn.Send(%v): %v", dst, err)
 			}
 		}
 	}
+	// Send to the DERP addrs now and the UDP ones together below,
+	// which while spraying are several.
+	var udpBuf [8]netaddr.IPPort
+	udpDsts := udpBuf[:0]
+	for _, addr := range dsts {
+		if addr.IP != derpMagicIPAddr {
+			udpDsts = append(udpDsts, addr)
+			continue
+		}
+		sent, err := c.sendAddr(addr, as.publicKey, b)
+		note(sent, err, true, addr)
+	}
+	switch len(udpDsts) {
+	case 0:
+	case 1:
+		sent, err := c.sendUDP(udpDsts[0], b)
+		note(sent, err, udpDsts[0] != roamAddr, udpDsts[0])
+	default:
+		sent, err := c.sendUDPBatch(udpDsts, b)
+		note(sent, err, true, udpDsts)
+	}
 	if success {
 		return nil
 	}
@@ -1080,6 +1709,15 @@ func (c *Conn) sendUDP(ipp netaddr.IPPort, b []byte) (sent bool, err error) {
 func (c *Conn) sendUDPStd(addr *net.UDPAddr, b []byte) (sent bool, err error) {
 	switch {
 	case addr.IP.To4() != nil:
+		if c.noV4.Get() && c.pconn6 != nil && !c.noV6.Get() {
+			// We have no IPv4 connectivity but do have
+			// IPv6; the network may offer NAT64.
+			_, err = c.pconn6.WriteTo(b, &net.UDPAddr{IP: nat64Addr(addr.IP), Port: addr.Port})
+			if err != nil {
+				return false, nil
+			}
+			return true, nil
+		}
 		_, err = c.pconn4.WriteTo(b, addr)
 		if err != nil && c.noV4.Get() {
 			return false, nil
@@ -1099,6 +1737,104 @@ func (c *Conn) sendUDPStd(addr *net.UDPAddr, b []byte) (sent bool, err error) {
 	return err == nil, err
 }
 
+// sendUDPBatch sends UDP packet b to each of dsts, with a sendmmsg
+// call per address family where the platform has it. It reports
+// sent if any of them were sent.
+// See sendAddr's docs on the return value meanings.
+func (c *Conn) sendUDPBatch(dsts []netaddr.IPPort, b []byte) (sent bool, err error) {
+	var v4, v6 []*net.UDPAddr
+	for _, ipp := range dsts {
+		if ipp.IP.Is4() && c.noV4.Get() && c.pconn6 != nil && !c.noV6.Get() {
+			// Via NAT64; see sendUDPStd.
+			if ok, err1 := c.sendUDP(ipp, b); ok {
+				sent = true
+			} else if err == nil {
+				err = err1
+			}
+			continue
+		}
+		ua := ipp.UDPAddr()
+		defer netaddr.PutUDPAddr(ua)
+		if ipp.IP.Is4() {
+			v4 = append(v4, ua)
+		} else {
+			v6 = append(v6, ua)
+		}
+	}
+	if len(v4) > 0 {
+		n, err4 := c.pconn4.WriteBatchTo(b, v4)
+		if n > 0 {
+			sent = true
+		}
+		if err4 != nil && !c.noV4.Get() && err == nil {
+			err = err4
+		}
+	}
+	if len(v6) > 0 && c.pconn6 != nil {
+		// (Without pconn6, there's no IPv6 to send with.)
+		n, err6 := c.pconn6.WriteBatchTo(b, v6)
+		if n > 0 {
+			sent = true
+		}
+		if err6 != nil && !c.noV6.Get() && err == nil {
+			err = err6
+		}
+	}
+	if sent {
+		return true, nil
+	}
+	return false, err
+}
+
+// writeEach writes b to each of addrs on pc, a write per address, and
+// returns how many it wrote before any error.
+func writeEach(pc net.PacketConn, b []byte, addrs []*net.UDPAddr) (int, error) {
+	for i, addr := range addrs {
+		if _, err := pc.WriteTo(b, addr); err != nil {
+			return i, err
+		}
+	}
+	return len(addrs), nil
+}
+
+// nat64Addr returns the IPv6 address through which NAT64 reaches the
+// IPv4 address ip4, in the network's NAT64 prefix if known or else
+// the well-known one.
+func nat64Addr(ip4 net.IP) net.IP {
+	ip, _ := netaddr.FromStdIP(ip4)
+	b := nat64.Synthesize(ip).As16()
+	return net.IP(b[:])
+}
+
+// unmapNAT64 returns the IPv4 ip:port that ipp represents if ipp's
+// IP is in the NAT64 prefix or is v4-mapped.
+func unmapNAT64(ipp netaddr.IPPort) (_ netaddr.IPPort, ok bool) {
+	ip, ok := nat64.Unmap(ipp.IP)
+	if !ok {
+		return ipp, false
+	}
+	return netaddr.IPPort{IP: ip, Port: ipp.Port}, true
+}
+
+// parseEndpoint parses the peer endpoint s, an ip:port. A v4-mapped
+// IPv6 address (::ffff:a.b.c.d) is returned as the IPv4 address it
+// is, which packets arrive from and are sent to over IPv4.
+func parseEndpoint(s string) (netaddr.IPPort, error) {
+	ipp, err := netaddr.ParseIPPort(s)
+	if err != nil {
+		return ipp, err
+	}
+	if ipp.IP.Is6() {
+		if b := ipp.IP.As16(); bytes.Equal(b[:12], v4MappedPrefix) {
+			ipp.IP = netaddr.IPv4(b[12], b[13], b[14], b[15])
+		}
+	}
+	return ipp, nil
+}
+
+// v4MappedPrefix is the first 12 bytes of v4-mapped IPv6 addresses.
+var v4MappedPrefix = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
+
 // sendAddr sends packet b to addr, which is either a real UDP address
 // or a fake UDP address representing a DERP server (see derpmap.go).
 // The provided public key identifies the recipient.
@@ -1145,6 +1881,10 @@ func (c *Conn) sendAddr(addr netaddr.IPPort, pubKey key.Public, b []byte) (sent
 // TODO: this is currently arbitrary. Figure out something better?
 const bufferedDerpWritesBeforeDrop = 32
 
+// bufferedDerpWritesLowResource is bufferedDerpWritesBeforeDrop in
+// low-resource mode.
+const bufferedDerpWritesLowResource = 8
+
 // derpWriteChanOfAddr returns a DERP client for fake UDP addresses that
 // represent DERP servers, creating them as necessary. For real UDP
 // addresses, it returns nil.
@@ -1203,6 +1943,10 @@ func (c *Conn) derpWriteChanOfAddr(addr netaddr.IPPort, peer key.Public) chan<-
 		why = peerShort(peer)
 	}
 	c.logf("magicsock: adding connection to derp-%v for %v", regionID, why)
+	if c.idleDerp[regionID] {
+		delete(c.idleDerp, regionID)
+		derpConnsReopened.Add(1)
+	}
 
 	firstDerp := false
 	if c.activeDerp == nil {
@@ -1232,9 +1976,15 @@ func (c *Conn) derpWriteChanOfAddr(addr netaddr.IPPort, peer key.Public) chan<-
 
 	dc.NotePreferred(c.myDerp == regionID)
 	dc.DNSCache = dnscache.Get()
+	dc.WebSocket = derpWebSocket
+	dc.LongPoll = derpLongPoll
 
 	ctx, cancel := context.WithCancel(c.connCtx)
-	ch := make(chan derpWriteRequest, bufferedDerpWritesBeforeDrop)
+	queueLen := bufferedDerpWritesBeforeDrop
+	if c.isLowResource() {
+		queueLen = bufferedDerpWritesLowResource
+	}
+	ch := make(chan derpWriteRequest, queueLen)
 
 	ad.c = dc
 	ad.writeCh = ch
@@ -1243,6 +1993,8 @@ func (c *Conn) derpWriteChanOfAddr(addr netaddr.IPPort, peer key.Public) chan<-
 	*ad.lastWrite = time.Now()
 	ad.createTime = time.Now()
 	c.activeDerp[regionID] = ad
+	derpConnsOpened.Add(1)
+	derpConnsCurrent.Add(1)
 	c.logActiveDerpLocked()
 	c.setPeerLastDerpLocked(peer, regionID, regionID)
 
@@ -1395,6 +2147,7 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netaddr.IPPort, d
 			pkt = m
 			res.n = len(m.Data)
 			res.src = m.Source
+			c.noteDERPBytes(m.Source, len(m.Data), 0)
 			if logDerpVerbose {
 				c.logf("magicsock: got derp-%v packet: %q", regionID, m.Data)
 			}
@@ -1447,11 +2200,175 @@ func (c *Conn) runDerpWriter(ctx context.Context, dc *derphttp.Client, ch <-chan
 			err := dc.Send(wr.pubKey, wr.b)
 			if err != nil {
 				c.logf("magicsock: derp.Send(%v): %v", wr.addr, err)
+			} else {
+				c.noteDERPBytes(wr.pubKey, 0, len(wr.b))
 			}
 		}
 	}
 }
 
+// derpRateWindow is how often the rate of a peer's traffic via DERP
+// is recomputed.
+const derpRateWindow = 10 * time.Second
+
+// derpPeerStats is the traffic exchanged with a peer via DERP.
+type derpPeerStats struct {
+	rxBytes int64
+	txBytes int64
+
+	// The rates are of the last rate window, which ended at
+	// windowStart, when the counts were windowRx and windowTx.
+	windowStart time.Time
+	windowRx    int64
+	windowTx    int64
+	rxRate      int64 // bytes per second
+	txRate      int64 // bytes per second
+}
+
+// roll ends st's rate window and starts a new one, if the current
+// one is at least derpRateWindow old at now.
+func (st *derpPeerStats) roll(now time.Time) {
+	d := now.Sub(st.windowStart)
+	if d < derpRateWindow {
+		return
+	}
+	st.rxRate = int64(float64(st.rxBytes-st.windowRx) / d.Seconds())
+	st.txRate = int64(float64(st.txBytes-st.windowTx) / d.Seconds())
+	st.windowStart = now
+	st.windowRx = st.rxBytes
+	st.windowTx = st.txBytes
+}
+
+// noteDERPBytes records that rx bytes were received from peer and tx
+// bytes sent to it via DERP. Only peers in the network map are
+// counted, so that other DERP clients can't grow the map.
+func (c *Conn) noteDERPBytes(peer key.Public, rx, tx int) {
+	c.derpStatsMu.Lock()
+	defer c.derpStatsMu.Unlock()
+	st := c.derpStats[peer]
+	if st == nil {
+		return
+	}
+	st.roll(time.Now())
+	st.rxBytes += int64(rx)
+	st.txBytes += int64(tx)
+}
+
+// setDERPStatsPeers sets the peers whose DERP traffic is counted,
+// forgetting the stats of others.
+func (c *Conn) setDERPStatsPeers(peers []*tailcfg.Node, now time.Time) {
+	c.derpStatsMu.Lock()
+	defer c.derpStatsMu.Unlock()
+	old := c.derpStats
+	c.derpStats = make(map[key.Public]*derpPeerStats, len(peers))
+	for _, n := range peers {
+		k := key.Public(n.Key)
+		st := old[k]
+		if st == nil {
+			st = &derpPeerStats{windowStart: now}
+		}
+		c.derpStats[k] = st
+	}
+}
+
+// fillDERPStats sets ps's DERP traffic stats to those of peer: the
+// bytes received from and sent to it via DERP since it was added to
+// the network map, and their rates.
+func (c *Conn) fillDERPStats(ps *ipnstate.PeerStatus, peer key.Public, now time.Time) {
+	c.derpStatsMu.Lock()
+	defer c.derpStatsMu.Unlock()
+	st := c.derpStats[peer]
+	if st == nil {
+		return
+	}
+	st.roll(now)
+	ps.DERPRxBytes, ps.DERPTxBytes = st.rxBytes, st.txBytes
+	ps.DERPRxRate, ps.DERPTxRate = st.rxRate, st.txRate
+}
+
+// derpSourceOK reports whether the packet pkt, which the DERP server
+// of regionID says src sent, claims no other sender. A relay could
+// otherwise pass off one peer's packets as another's: disco messages,
+// to have replies and path changes aimed at the wrong peer, and
+// WireGuard messages, to have the session's peer roam to the other
+// peer's DERP route. Packets failing the check are counted and
+// should be dropped.
+//
+// Handshake initiations name their sender only in encrypted form, so
+// they aren't checked, nor is anything with a zero src, from DERP
+// servers too old to send it.
+func (c *Conn) derpSourceOK(pkt []byte, src key.Public, regionID int) bool {
+	if src.IsZero() {
+		return true
+	}
+	claimed, ok := c.claimedSender(pkt)
+	if !ok || claimed == src {
+		return true
+	}
+	dropped := atomic.AddUint64(&c.derpSpoofed, 1)
+	derpRecvSpoofed.Add(1)
+	if c.spoofLogLimit.Allow() {
+		c.logf("magicsock: dropped packet from %v via derp-%d claiming to be from %v (%d dropped)",
+			src.ShortString(), regionID, claimed.ShortString(), dropped)
+	}
+	return false
+}
+
+// claimedSender returns the node key of the peer that pkt claims to
+// be from, if that can be told: for a disco message, by its sender's
+// disco key, and for a WireGuard message, by the session its receiver
+// index names.
+func (c *Conn) claimedSender(pkt []byte) (key.Public, bool) {
+	if sender, ok := discoSender(pkt); ok {
+		c.mu.Lock()
+		n, ok := c.nodeOfDisco[sender]
+		c.mu.Unlock()
+		if !ok {
+			// Messages from unknown disco keys are ignored anyway.
+			return key.Public{}, false
+		}
+		return key.Public(n.Key), true
+	}
+	idx, ok := receiverIndex(pkt)
+	if !ok {
+		return key.Public{}, false
+	}
+	return c.SessionPeer(idx)
+}
+
+// receiverIndex returns our index of the session that the WireGuard
+// message b belongs to, for the messages that carry it.
+func receiverIndex(b []byte) (idx uint32, ok bool) {
+	if len(b) < 12 {
+		return 0, false
+	}
+	switch binary.LittleEndian.Uint32(b[:4]) {
+	case device.MessageResponseType:
+		return binary.LittleEndian.Uint32(b[8:12]), true
+	case device.MessageCookieReplyType, device.MessageTransportType:
+		return binary.LittleEndian.Uint32(b[4:8]), true
+	}
+	return 0, false
+}
+
+// DERPSpoofedPackets returns the number of packets received via DERP
+// that were dropped because they claimed to be from another peer
+// than the one DERP said sent them.
+func (c *Conn) DERPSpoofedPackets() uint64 {
+	return atomic.LoadUint64(&c.derpSpoofed)
+}
+
+// discoSender returns the disco key that pkt claims to be from, if
+// it looks like a disco message.
+func discoSender(pkt []byte) (sender tailcfg.DiscoKey, ok bool) {
+	const headerLen = len(disco.Magic) + len(tailcfg.DiscoKey{}) + disco.NonceLen
+	if len(pkt) < headerLen || string(pkt[:len(disco.Magic)]) != disco.Magic {
+		return sender, false
+	}
+	copy(sender[:], pkt[len(disco.Magic):])
+	return sender, true
+}
+
 // findEndpoint maps from a UDP address to a WireGuard endpoint, for
 // ReceiveIPv4/ReceiveIPv6.
 // The provided addr and ipp must match.
@@ -1522,6 +2439,9 @@ func (c *Conn) awaitUDP4(b []byte) {
 		if c.handleDiscoMessage(b[:n], ipp) {
 			continue
 		}
+		if c.isRelayOnlyPacket(b[:n], ipp) {
+			continue
+		}
 
 		select {
 		case c.udpRecvCh <- udpReadResult{n: n, addr: addr, ipp: ipp}:
@@ -1560,6 +2480,37 @@ func (c *Conn) noteRecvActivityFromEndpoint(e conn.Endpoint) {
 	}
 }
 
+// stopAwaitUDP4 interrupts the awaitUDP4 goroutine started by
+// ReceiveIPv4 and waits for it to give up b, when a packet arrived
+// some other way first. If awaitUDP4 had already read a packet,
+// it's buffered for the next ReceiveIPv4 call.
+//
+// It reports false if c was closed while waiting.
+func (c *Conn) stopAwaitUDP4(b []byte) bool {
+	// Cancel the pconn read goroutine
+	c.pconn4.SetReadDeadline(aLongTimeAgo)
+	// Wait for the UDP-reading goroutine to be done, since it's currently
+	// the owner of the b []byte buffer:
+	select {
+	case um := <-c.udpRecvCh:
+		if um.err != nil {
+			// The normal case. The SetReadDeadline interrupted
+			// the read and we get an error which we now ignore.
+		} else {
+			// The pconn.ReadFrom succeeded and was about to send,
+			// but the other packet came first. So now we have both
+			// ready. Save the UDP packet away for use by the next
+			// ReceiveIPv4 call.
+			c.bufferedIPv4From = um.ipp
+			c.bufferedIPv4Packet = append(c.bufferedIPv4Packet[:0], b[:um.n]...)
+		}
+		c.pconn4.SetReadDeadline(time.Time{})
+		return true
+	case <-c.donec():
+		return false
+	}
+}
+
 func (c *Conn) ReceiveIPv4(b []byte) (n int, ep conn.Endpoint, addr *net.UDPAddr, err error) {
 Top:
 	// First, process any buffered packet from earlier.
@@ -1584,25 +2535,7 @@ Top:
 
 	select {
 	case dm := <-c.derpRecvCh:
-		// Cancel the pconn read goroutine
-		c.pconn4.SetReadDeadline(aLongTimeAgo)
-		// Wait for the UDP-reading goroutine to be done, since it's currently
-		// the owner of the b []byte buffer:
-		select {
-		case um := <-c.udpRecvCh:
-			if um.err != nil {
-				// The normal case. The SetReadDeadline interrupted
-				// the read and we get an error which we now ignore.
-			} else {
-				// The pconn.ReadFrom succeeded and was about to send,
-				// but DERP sent first. So now we have both ready.
-				// Save the UDP packet away for use by the next
-				// ReceiveIPv4 call.
-				c.bufferedIPv4From = um.ipp
-				c.bufferedIPv4Packet = append(c.bufferedIPv4Packet[:0], b[:um.n]...)
-			}
-			c.pconn4.SetReadDeadline(time.Time{})
-		case <-c.donec():
+		if !c.stopAwaitUDP4(b) {
 			return 0, nil, nil, errors.New("Conn closed")
 		}
 		var regionID int
@@ -1615,6 +2548,9 @@ Top:
 		}
 
 		ipp = netaddr.IPPort{IP: derpMagicIPAddr, Port: uint16(regionID)}
+		if !c.derpSourceOK(b[:n], dm.src, regionID) {
+			goto Top
+		}
 		if c.handleDiscoMessage(b[:n], ipp) {
 			goto Top
 		}
@@ -1657,6 +2593,18 @@ Top:
 		}
 		n, addr, ipp = um.n, um.addr, um.ipp
 
+	case pm := <-c.pathRecvCh:
+		if !c.stopAwaitUDP4(b) {
+			return 0, nil, nil, errors.New("Conn closed")
+		}
+		n, ipp = pm.n, pm.ipp
+		if ncopy := pm.copyBuf(b); ncopy != n {
+			err = fmt.Errorf("received multipath packet of length %d that's too big for WireGuard ReceiveIPv4 buf size %d", n, ncopy)
+			c.logf("magicsock: %v", err)
+			return 0, nil, nil, err
+		}
+		addr = ipp.UDPAddr()
+
 	case <-c.donec():
 		// Socket has been shut down. All the producers of packets
 		// respond to the context cancellation and go away, so we have
@@ -1698,6 +2646,11 @@ func (c *Conn) ReceiveIPv6(b []byte) (int, conn.Endpoint, *net.UDPAddr, error) {
 		if !ok {
 			continue
 		}
+		if ipp4, ok := unmapNAT64(ipp); ok {
+			// From an IPv4 peer via NAT64; see sendUDPStd.
+			ipp = ipp4
+			addr = ipp.UDPAddr()
+		}
 		if stun.Is(b[:n]) {
 			c.stunReceiveFunc.Load().(func([]byte, netaddr.IPPort))(b[:n], ipp)
 			continue
@@ -1705,6 +2658,9 @@ func (c *Conn) ReceiveIPv6(b []byte) (int, conn.Endpoint, *net.UDPAddr, error) {
 		if c.handleDiscoMessage(b[:n], ipp) {
 			continue
 		}
+		if c.isRelayOnlyPacket(b[:n], ipp) {
+			continue
+		}
 
 		ep := c.findEndpoint(ipp, addr)
 		c.noteRecvActivityFromEndpoint(ep)
@@ -1722,9 +2678,20 @@ const (
 	// discoVerboseLog means that a message should only be logged
 	// in TS_DEBUG_DISCO mode.
 	discoVerboseLog
+
+	// discoQuiet means that neither a message nor a failure to
+	// send it should be logged. Path MTU probes larger than the
+	// local link can carry fail to send by design.
+	discoQuiet
 )
 
 func (c *Conn) sendDiscoMessage(dst netaddr.IPPort, dstKey tailcfg.NodeKey, dstDisco tailcfg.DiscoKey, m disco.Message, logLevel discoLogLevel) (sent bool, err error) {
+	return c.sendDiscoMessageVia(nil, dst, dstKey, dstDisco, m, logLevel)
+}
+
+// sendDiscoMessageVia is like sendDiscoMessage, but sends a UDP
+// message out of multipath path via, if non-nil.
+func (c *Conn) sendDiscoMessageVia(via *pathConn, dst netaddr.IPPort, dstKey tailcfg.NodeKey, dstDisco tailcfg.DiscoKey, m disco.Message, logLevel discoLogLevel) (sent bool, err error) {
 	c.mu.Lock()
 	if c.closed {
 		c.mu.Unlock()
@@ -1742,15 +2709,23 @@ func (c *Conn) sendDiscoMessage(dst netaddr.IPPort, dstKey tailcfg.NodeKey, dstD
 	c.mu.Unlock()
 
 	pkt = box.SealAfterPrecomputation(pkt, m.AppendMarshal(nil), &nonce, sharedKey)
-	sent, err = c.sendAddr(dst, key.Public(dstKey), pkt)
+	if via != nil && dst.IP != derpMagicIPAddr {
+		sent, err = c.sendUDPVia(via, dst, pkt)
+	} else {
+		sent, err = c.sendAddr(dst, key.Public(dstKey), pkt)
+	}
 	if sent {
-		if logLevel == discoLog || (logLevel == discoVerboseLog && debugDisco) {
-			c.logf("magicsock: disco: %v->%v (%v, %v) sent %v", c.discoShort, dstDisco.ShortString(), dstKey.ShortString(), derpStr(dst.String()), disco.MessageSummary(m))
+		if logLevel == discoLog || (logLevel == discoVerboseLog && discoVerbose()) {
+			dstStr := derpStr(dst.String())
+			if via != nil {
+				dstStr += " via " + via.String()
+			}
+			c.logf("magicsock: disco: %v->%v (%v, %v) sent %v", c.discoShort, dstDisco.ShortString(), dstKey.ShortString(), dstStr, disco.MessageSummary(m))
 		}
 	} else if err == nil {
 		// Can't send. (e.g. no IPv6 locally)
 	} else {
-		if !c.networkDown() {
+		if !c.networkDown() && logLevel != discoQuiet {
 			c.logf("magicsock: disco: failed to send %T to %v: %v", m, dst, err)
 		}
 	}
@@ -1770,12 +2745,18 @@ func (c *Conn) sendDiscoMessage(dst netaddr.IPPort, dstKey tailcfg.NodeKey, dstD
 // For messages received over DERP, the addr will be derpMagicIP (with
 // port being the region)
 func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort) bool {
+	return c.handleDiscoMessageVia(msg, src, nil)
+}
+
+// handleDiscoMessageVia is like handleDiscoMessage, for a message
+// that arrived on multipath path via, if non-nil. Pings are answered
+// over the same path.
+func (c *Conn) handleDiscoMessageVia(msg []byte, src netaddr.IPPort, via *pathConn) bool {
 	const headerLen = len(disco.Magic) + len(tailcfg.DiscoKey{}) + disco.NonceLen
-	if len(msg) < headerLen || string(msg[:len(disco.Magic)]) != disco.Magic {
+	sender, ok := discoSender(msg)
+	if !ok {
 		return false
 	}
-	var sender tailcfg.DiscoKey
-	copy(sender[:], msg[len(disco.Magic):])
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -1783,7 +2764,7 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort) bool {
 	if c.closed {
 		return true
 	}
-	if debugDisco {
+	if discoVerbose() {
 		c.logf("magicsock: disco: got disco-looking frame from %v", sender.ShortString())
 	}
 	if c.privateKey.IsZero() {
@@ -1791,22 +2772,72 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort) bool {
 		return false
 	}
 	if c.discoPrivate.IsZero() {
-		if debugDisco {
+		if discoVerbose() {
 			c.logf("magicsock: disco: ignoring disco-looking frame, no local key")
 		}
-		return false
+		return false
+	}
+
+	peerNode, ok := c.nodeOfDisco[sender]
+	if !ok {
+		if discoVerbose() {
+			c.logf("magicsock: disco: ignoring disco-looking frame, don't know node for %v", sender.ShortString())
+		}
+		// Returning false keeps passing it down, to WireGuard.
+		// WireGuard will almost surely reject it, but give it a chance.
+		return false
+	}
+	if src.IP != derpMagicIPAddr && c.isRelayOnlyLocked(peerNode) {
+		if discoVerbose() {
+			c.logf("magicsock: disco: dropping direct frame from relay-only %v", sender.ShortString())
+		}
+		return true
+	}
+
+	// Drop replays before they cost a decryption.
+	var nonce [disco.NonceLen]byte
+	copy(nonce[:], msg[len(disco.Magic)+len(key.Public{}):])
+	rs := c.discoRecvStateLocked(sender)
+	if _, ok := rs.seen[nonce]; ok {
+		atomic.AddUint64(&c.discoReplayed, 1)
+		discoRecvReplayed.Add(1)
+		if discoVerbose() {
+			c.logf("magicsock: disco: dropping replayed frame from %v", sender.ShortString())
+		}
+		return true
 	}
 
-	peerNode, ok := c.nodeOfDisco[sender]
+	sealedBox := msg[headerLen:]
+	payload, ok := box.OpenAfterPrecomputation(nil, sealedBox, &nonce, c.sharedDiscoKeyLocked(sender))
 	if !ok {
-		if debugDisco {
-			c.logf("magicsock: disco: ignoring disco-looking frame, don't know node for %v", sender.ShortString())
+		// This might be have been intended for a previous
+		// disco key.  When we restart we get a new disco key
+		// and old packets might've still been in flight (or
+		// scheduled). This is particularly the case for LANs
+		// or non-NATed endpoints.
+		// Don't log in normal case. Pass on to wireguard, in case
+		// it's actually a a wireguard packet (super unlikely,
+		// but).
+		if discoVerbose() {
+			c.logf("magicsock: disco: failed to open naclbox from %v (wrong rcpt?)", sender)
 		}
-		// Returning false keeps passing it down, to WireGuard.
-		// WireGuard will almost surely reject it, but give it a chance.
+		// TODO(bradfitz): add some counter for this that logs rarely
 		return false
 	}
 
+	// Only authentic messages count against the sender's rate
+	// limit, so that forged ones can't use it up; floods are
+	// dropped before they wake up an idle peer.
+	if !rs.limit.Allow() {
+		atomic.AddUint64(&c.discoLimited, 1)
+		discoRecvLimited.Add(1)
+		if discoVerbose() {
+			c.logf("magicsock: disco: dropping frame from %v, over rate limit", sender.ShortString())
+		}
+		return true
+	}
+	rs.noteNonce(nonce, time.Now())
+
 	needsRecvActivityCall := false
 	de, endpointFound0 := c.endpointOfDisco[sender]
 	if !endpointFound0 {
@@ -1814,7 +2845,7 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort) bool {
 		// it's an idle endpoint that doesn't yet exist in the wireguard config. We now have
 		// to notify the userspace engine (via noteRecvActivity) so wireguard-go can create
 		// an Endpoint (ultimately calling our CreateEndpoint).
-		if debugDisco {
+		if discoVerbose() {
 			c.logf("magicsock: disco: got message from inactive peer %v", sender.ShortString())
 		}
 		if c.noteRecvActivity == nil {
@@ -1855,31 +2886,8 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort) bool {
 		}
 	}
 
-	// First, do we even know (and thus care) about this sender? If not,
-	// don't bother decrypting it.
-
-	var nonce [disco.NonceLen]byte
-	copy(nonce[:], msg[len(disco.Magic)+len(key.Public{}):])
-	sealedBox := msg[headerLen:]
-	payload, ok := box.OpenAfterPrecomputation(nil, sealedBox, &nonce, c.sharedDiscoKeyLocked(sender))
-	if !ok {
-		// This might be have been intended for a previous
-		// disco key.  When we restart we get a new disco key
-		// and old packets might've still been in flight (or
-		// scheduled). This is particularly the case for LANs
-		// or non-NATed endpoints.
-		// Don't log in normal case. Pass on to wireguard, in case
-		// it's actually a a wireguard packet (super unlikely,
-		// but).
-		if debugDisco {
-			c.logf("magicsock: disco: failed to open naclbox from %v (wrong rcpt?)", sender)
-		}
-		// TODO(bradfitz): add some counter for this that logs rarely
-		return false
-	}
-
 	dm, err := disco.Parse(payload)
-	if debugDisco {
+	if discoVerbose() {
 		c.logf("magicsock: disco: disco.Parse = %T, %v", dm, err)
 	}
 	if err != nil {
@@ -1894,7 +2902,7 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort) bool {
 
 	switch dm := dm.(type) {
 	case *disco.Ping:
-		c.handlePingLocked(dm, de, src, sender, peerNode)
+		c.handlePingLocked(dm, de, src, via, sender, peerNode)
 	case *disco.Pong:
 		if de == nil {
 			return true
@@ -1915,7 +2923,66 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort) bool {
 	return true
 }
 
-func (c *Conn) handlePingLocked(dm *disco.Ping, de *discoEndpoint, src netaddr.IPPort, sender tailcfg.DiscoKey, peerNode *tailcfg.Node) {
+// Limits on the disco messages received from each sender.
+const (
+	// discoRecvRate is how many disco messages per second a sender
+	// may send on average, and discoRecvBurst how many at once.
+	// That's well beyond what a peer sends for its pings, pongs,
+	// heartbeats and path MTU probes.
+	discoRecvRate  = 10
+	discoRecvBurst = 64
+
+	// discoReplayWindow is how long a sender's messages are
+	// remembered, to drop replays of them. At most discoRecvBurst
+	// plus discoRecvRate per second of it are remembered.
+	discoReplayWindow = 2 * time.Minute
+)
+
+// discoRecvState is what's kept about the disco messages received
+// from a sender, to rate limit them and drop replays.
+type discoRecvState struct {
+	limit *rate.Limiter
+	// seen holds the nonces of the sender's messages of the last
+	// discoReplayWindow, which were opened successfully, and when
+	// they were received. Every message is sealed with a fresh
+	// random nonce, so a repeat is a replay.
+	seen  map[[disco.NonceLen]byte]time.Time
+	order [][disco.NonceLen]byte // seen's keys, oldest first
+}
+
+// discoRecvStateLocked returns the discoRecvState of sender,
+// creating it if needed. c.mu must be held.
+func (c *Conn) discoRecvStateLocked(sender tailcfg.DiscoKey) *discoRecvState {
+	if rs, ok := c.discoRecv[sender]; ok {
+		return rs
+	}
+	rs := &discoRecvState{
+		limit: rate.NewLimiter(discoRecvRate, discoRecvBurst),
+		seen:  make(map[[disco.NonceLen]byte]time.Time),
+	}
+	c.discoRecv[sender] = rs
+	return rs
+}
+
+// noteNonce records that a message sealed with nonce was received at
+// now, forgetting those received more than discoReplayWindow before.
+func (rs *discoRecvState) noteNonce(nonce [disco.NonceLen]byte, now time.Time) {
+	for len(rs.order) > 0 && now.Sub(rs.seen[rs.order[0]]) > discoReplayWindow {
+		delete(rs.seen, rs.order[0])
+		rs.order = rs.order[1:]
+	}
+	rs.order = append(rs.order, nonce)
+	rs.seen[nonce] = now
+}
+
+// DiscoDrops returns the number of received disco messages that were
+// dropped because their sender was over its rate limit, and because
+// they were replays of earlier ones.
+func (c *Conn) DiscoDrops() (rateLimited, replayed uint64) {
+	return atomic.LoadUint64(&c.discoLimited), atomic.LoadUint64(&c.discoReplayed)
+}
+
+func (c *Conn) handlePingLocked(dm *disco.Ping, de *discoEndpoint, src netaddr.IPPort, via *pathConn, sender tailcfg.DiscoKey, peerNode *tailcfg.Node) {
 	if peerNode == nil {
 		c.logf("magicsock: disco: [unexpected] ignoring ping from unknown peer Node")
 		return
@@ -1923,17 +2990,21 @@ func (c *Conn) handlePingLocked(dm *disco.Ping, de *discoEndpoint, src netaddr.I
 	likelyHeartBeat := src == de.lastPingFrom && time.Since(de.lastPingTime) < 5*time.Second
 	de.lastPingFrom = src
 	de.lastPingTime = time.Now()
-	if !likelyHeartBeat || debugDisco {
+	// Padded pings are path MTU probes, which come in bunches.
+	if (!likelyHeartBeat && dm.Padding == 0) || discoVerbose() {
 		c.logf("magicsock: disco: %v<-%v (%v, %v)  got ping tx=%x", c.discoShort, de.discoShort, peerNode.Key.ShortString(), src, dm.TxID[:6])
 	}
 
-	// Remember this route if not present.
-	c.setAddrToDiscoLocked(src, sender, nil)
-	de.addCandidateEndpoint(src)
+	// Remember this route if not present, unless the peer is only
+	// to be reached through DERP.
+	if !c.isRelayOnlyLocked(peerNode) {
+		c.setAddrToDiscoLocked(src, sender, nil)
+		de.addCandidateEndpoint(src)
+	}
 
 	ipDst := src
 	discoDest := sender
-	go c.sendDiscoMessage(ipDst, peerNode.Key, discoDest, &disco.Pong{
+	go c.sendDiscoMessageVia(via, ipDst, peerNode.Key, discoDest, &disco.Pong{
 		TxID: dm.TxID,
 		Src:  src,
 	}, discoVerboseLog)
@@ -2156,6 +3227,11 @@ func (c *Conn) SetNetworkMap(nm *controlclient.NetworkMap) {
 			continue
 		}
 		numDisco++
+		if old, ok := c.nodeOfDisco[n.DiscoKey]; ok && old.Equal(n) {
+			// Unchanged since the last netmap; with delta
+			// updates, that's most peers.
+			continue
+		}
 		if ep, ok := c.endpointOfDisco[n.DiscoKey]; ok {
 			ep.updateFromNode(n)
 		}
@@ -2191,9 +3267,15 @@ func (c *Conn) SetNetworkMap(nm *controlclient.NetworkMap) {
 			de.stopAndReset()
 			delete(c.endpointOfDisco, dk)
 			delete(c.sharedDiscoKey, dk)
+			delete(c.discoRecv, dk)
 		}
 	}
 
+	// Count the DERP traffic of the new peers, and forget that of
+	// peers that are gone.
+	c.setDERPStatsPeers(nm.Peers, time.Now())
+
+	c.updateRelayOnlyLocked()
 }
 
 func (c *Conn) wantDerpLocked() bool { return c.derpMap != nil }
@@ -2217,6 +3299,7 @@ func (c *Conn) closeDerpLocked(node int, why string) {
 		go ad.c.Close()
 		ad.cancel()
 		delete(c.activeDerp, node)
+		derpConnsCurrent.Add(-1)
 	}
 }
 
@@ -2263,11 +3346,16 @@ func (c *Conn) foreachActiveDerpSortedLocked(fn func(regionID int, ad activeDerp
 	}
 }
 
+// cleanStaleDerp closes the connections to DERP regions other than
+// the home one that had nothing to send for c.derpIdleTimeout. They're
+// dialed again when there's something to send.
 func (c *Conn) cleanStaleDerp() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	const inactivityTime = 60 * time.Second
-	tooOld := time.Now().Add(-inactivityTime)
+	if c.derpIdleTimeout <= 0 {
+		return
+	}
+	tooOld := time.Now().Add(-c.derpIdleTimeout)
 	dirty := false
 	for i, ad := range c.activeDerp {
 		if i == c.myDerp {
@@ -2275,6 +3363,11 @@ func (c *Conn) cleanStaleDerp() {
 		}
 		if ad.lastWrite.Before(tooOld) {
 			c.closeDerpLocked(i, "idle")
+			if c.idleDerp == nil {
+				c.idleDerp = make(map[int]bool)
+			}
+			c.idleDerp[i] = true
+			derpConnsIdleClosed.Add(1)
 			dirty = true
 		}
 	}
@@ -2312,6 +3405,8 @@ func (c *Conn) Close() error {
 	c.closed = true
 	c.connCtxCancel()
 	c.closeAllDerpLocked("conn-close")
+	c.portMapper.Close()
+	c.closePathsLocked()
 	if c.pconn6 != nil {
 		c.pconn6.Close()
 	}
@@ -2324,9 +3419,44 @@ func (c *Conn) Close() error {
 	for c.goroutinesRunningLocked() {
 		c.muCond.Wait()
 	}
+
+	// Let the DERP readers and writers stopped above finish, so
+	// that the DERP connections are closed, and DERP servers can
+	// tell peers this node is gone, by the time Close returns
+	// rather than whenever the process exits.
+	wgs := make([]*syncs.WaitGroupChan, 0, len(c.prevDerp))
+	for _, wg := range c.prevDerp {
+		wgs = append(wgs, wg)
+	}
+	c.mu.Unlock()
+	timeout := time.NewTimer(derpCloseTimeout)
+	defer timeout.Stop()
+wait:
+	for _, wg := range wgs {
+		select {
+		case <-wg.DoneChan():
+		case <-timeout.C:
+			c.logf("magicsock: timed out waiting for DERP connections to close")
+			break wait
+		}
+	}
+	c.mu.Lock()
 	return err
 }
 
+// derpCloseTimeout is how long Close waits for DERP connections to
+// close.
+const derpCloseTimeout = 2 * time.Second
+
+const (
+	// derpIdleTimeoutDefault is the default Options.DERPIdleTimeout.
+	derpIdleTimeoutDefault = 60 * time.Second
+
+	// derpCleanStaleInterval is how often idle DERP connections
+	// are looked for, or half the idle timeout if that's less.
+	derpCleanStaleInterval = 15 * time.Second // arbitrary
+)
+
 func (c *Conn) goroutinesRunningLocked() bool {
 	if c.endpointsUpdateActive {
 		return true
@@ -2380,7 +3510,7 @@ func (c *Conn) shouldDoPeriodicReSTUN() bool {
 			c.logf("magicsock: periodicReSTUN: idle for %v", idleFor.Round(time.Second))
 		}
 		if idleFor > maxIdleBeforeSTUNShutdown() {
-			if debugReSTUNStopOnIdle || version.IsMobile() { // TODO: make this unconditional later
+			if debugReSTUNStopOnIdle || version.IsMobile() || c.isLowResource() { // TODO: make this unconditional later
 				return false
 			}
 		}
@@ -2388,6 +3518,12 @@ func (c *Conn) shouldDoPeriodicReSTUN() bool {
 	return true
 }
 
+// isLowResource reports whether c should favor memory and CPU use
+// over throughput.
+func (c *Conn) isLowResource() bool {
+	return c.lowMemory || version.IsLowResource()
+}
+
 func (c *Conn) periodicReSTUN() {
 	prand := rand.New(rand.NewSource(time.Now().UnixNano()))
 	dur := func() time.Duration {
@@ -2402,6 +3538,8 @@ func (c *Conn) periodicReSTUN() {
 		case <-c.donec():
 			return
 		case <-timer.C:
+			// If the preferred port was busy, try it again.
+			moved := c.rebindPreferredPort()
 			doReSTUN := c.shouldDoPeriodicReSTUN()
 			if !lastIdleState.EqualBool(doReSTUN) {
 				if doReSTUN {
@@ -2411,7 +3549,9 @@ func (c *Conn) periodicReSTUN() {
 				}
 				lastIdleState.Set(doReSTUN)
 			}
-			if doReSTUN {
+			if moved {
+				c.ReSTUN("port-changed")
+			} else if doReSTUN {
 				c.ReSTUN("periodic")
 			}
 			timer.Reset(dur())
@@ -2420,7 +3560,14 @@ func (c *Conn) periodicReSTUN() {
 }
 
 func (c *Conn) periodicDerpCleanup() {
-	ticker := time.NewTicker(15 * time.Second) // arbitrary
+	if c.derpIdleTimeout <= 0 {
+		return
+	}
+	interval := derpCleanStaleInterval
+	if d := c.derpIdleTimeout / 2; d < interval {
+		interval = d
+	}
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 	for {
 		select {
@@ -2485,32 +3632,52 @@ func (c *Conn) listenPacket(ctx context.Context, network, addr string) (net.Pack
 	if c.packetListener != nil {
 		return c.packetListener.ListenPacket(ctx, network, addr)
 	}
-	return netns.Listener().ListenPacket(ctx, network, addr)
+	pc, err := netns.Listener().ListenPacket(ctx, network, addr)
+	if err == nil && c.maxPeerMTU > 0 {
+		// Path MTU probes must be dropped, not fragmented, when
+		// too large for the path.
+		if err := setDontFragment(pc, network); err != nil {
+			c.logf("magicsock: setting don't fragment on %s socket: %v", network, err)
+		}
+	}
+	return pc, err
 }
 
-func (c *Conn) bind1(ruc **RebindingUDPConn, which string) error {
-	host := ""
-	if inTest() && !c.simulatedNetwork {
-		host = "127.0.0.1"
-		if which == "udp6" {
-			host = "::1"
-		}
+// bindHost returns the host to bind sockets of network ("udp4" or
+// "udp6") to: loopback in tests that don't use a simulated network,
+// and otherwise all addresses.
+func bindHost(network string, simulatedNetwork bool) string {
+	if !inTest() || simulatedNetwork {
+		return ""
 	}
+	if network == "udp6" {
+		return "::1"
+	}
+	return "127.0.0.1"
+}
+
+func (c *Conn) bind1(ruc **RebindingUDPConn, which string) error {
+	host := bindHost(which, c.simulatedNetwork)
+	port := c.preferredPort()
 	var pc net.PacketConn
 	var err error
+	if ipc, ok := c.inheritedConns[which]; ok {
+		delete(c.inheritedConns, which)
+		pc = ipc
+	}
 	listenCtx := context.Background() // unused without DNS name to resolve
-	if c.pconnPort == 0 && DefaultPort != 0 {
+	if pc == nil && port == 0 && DefaultPort != 0 {
 		pc, err = c.listenPacket(listenCtx, which, net.JoinHostPort(host, fmt.Sprint(DefaultPort)))
 		if err != nil {
 			c.logf("magicsock: bind: default port %s/%v unavailable; picking random", which, DefaultPort)
 		}
 	}
 	if pc == nil {
-		pc, err = c.listenPacket(listenCtx, which, net.JoinHostPort(host, fmt.Sprint(c.pconnPort)))
+		pc, err = c.listenPacket(listenCtx, which, net.JoinHostPort(host, fmt.Sprint(port)))
 	}
 	if err != nil {
-		c.logf("magicsock: bind(%s/%v): %v", which, c.pconnPort, err)
-		return fmt.Errorf("magicsock: bind: %s/%d: %v", which, c.pconnPort, err)
+		c.logf("magicsock: bind(%s/%v): %v", which, port, err)
+		return fmt.Errorf("magicsock: bind: %s/%d: %v", which, port, err)
 	}
 	if *ruc == nil {
 		*ruc = new(RebindingUDPConn)
@@ -2519,36 +3686,37 @@ func (c *Conn) bind1(ruc **RebindingUDPConn, which string) error {
 	return nil
 }
 
-// Rebind closes and re-binds the UDP sockets.
-// It should be followed by a call to ReSTUN.
-func (c *Conn) Rebind() {
-	host := ""
-	if inTest() && !c.simulatedNetwork {
-		host = "127.0.0.1"
+// SocketFiles returns duplicates of the files of c's UDP sockets, for
+// another process to carry on with; see Options.InheritedConns. udp6
+// is nil if c has no IPv6 socket.
+func (c *Conn) SocketFiles() (udp4, udp6 *os.File, err error) {
+	udp4, err = c.pconn4.file()
+	if err != nil {
+		return nil, nil, err
 	}
-	listenCtx := context.Background() // unused without DNS name to resolve
-	if c.pconnPort != 0 {
-		c.pconn4.mu.Lock()
-		if err := c.pconn4.pconn.Close(); err != nil {
-			c.logf("magicsock: link change close failed: %v", err)
-		}
-		packetConn, err := c.listenPacket(listenCtx, "udp4", fmt.Sprintf("%s:%d", host, c.pconnPort))
-		if err == nil {
-			c.logf("magicsock: link change rebound port: %d", c.pconnPort)
-			c.pconn4.pconn = packetConn.(*net.UDPConn)
-			c.pconn4.mu.Unlock()
-			return
+	if c.pconn6 != nil {
+		udp6, err = c.pconn6.file()
+		if err != nil {
+			udp4.Close()
+			return nil, nil, err
 		}
-		c.logf("magicsock: link change unable to bind fixed port %d: %v, falling back to random port", c.pconnPort, err)
-		c.pconn4.mu.Unlock()
 	}
-	c.logf("magicsock: link change, binding new port")
-	packetConn, err := c.listenPacket(listenCtx, "udp4", host+":0")
-	if err != nil {
-		c.logf("magicsock: link change failed to bind new port: %v", err)
-		return
+	return udp4, udp6, nil
+}
+
+// Rebind closes and re-binds the UDP sockets, reconnects to DERP, and
+// starts discovery afresh for peers with active sessions.
+// It should be followed by a call to ReSTUN.
+func (c *Conn) Rebind() {
+	start := time.Now()
+	// Release the port mapping, which points at the old socket's
+	// port on what may not be our gateway anymore.
+	c.portMapper.NoteNetworkDown()
+	nat64.Forget()
+	c.rebindSocket(c.pconn4, "udp4")
+	if c.pconn6 != nil {
+		c.rebindSocket(c.pconn6, "udp6")
 	}
-	c.pconn4.Reset(packetConn.(*net.UDPConn))
 
 	c.mu.Lock()
 	c.closeAllDerpLocked("rebind")
@@ -2559,10 +3727,40 @@ func (c *Conn) Rebind() {
 		c.goDerpConnect(c.myDerp)
 	}
 	c.resetAddrSetStates()
+	c.logf("magicsock: link change rebind done in %v", time.Since(start).Round(time.Millisecond))
+}
+
+// rebindSocket replaces ruc's socket with a new one of the given
+// network, on the preferred port if there is one and it's free.
+func (c *Conn) rebindSocket(ruc *RebindingUDPConn, network string) {
+	host := bindHost(network, c.simulatedNetwork)
+	listenCtx := context.Background() // unused without DNS name to resolve
+	if port := c.preferredPort(); port != 0 {
+		ruc.mu.Lock()
+		if err := ruc.pconn.Close(); err != nil {
+			c.logf("magicsock: link change close failed: %v", err)
+		}
+		packetConn, err := c.listenPacket(listenCtx, network, net.JoinHostPort(host, fmt.Sprint(port)))
+		if err == nil {
+			c.logf("magicsock: link change rebound %s port: %d", network, port)
+			ruc.pconn = packetConn
+			ruc.mu.Unlock()
+			return
+		}
+		c.logf("magicsock: link change unable to bind fixed port %s/%d: %v, falling back to random port", network, port, err)
+		ruc.mu.Unlock()
+	}
+	c.logf("magicsock: link change, binding new %s port", network)
+	packetConn, err := c.listenPacket(listenCtx, network, net.JoinHostPort(host, "0"))
+	if err != nil {
+		c.logf("magicsock: link change failed to bind new port: %v", err)
+		return
+	}
+	ruc.Reset(packetConn)
 }
 
-// resetAddrSetStates resets the preferred address for all peers and
-// re-enables spraying.
+// resetAddrSetStates resets the preferred address for all peers,
+// re-enables spraying, and restarts discovery for active disco peers.
 // This is called when connectivity changes enough that we no longer
 // trust the old routes.
 func (c *Conn) resetAddrSetStates() {
@@ -2573,7 +3771,25 @@ func (c *Conn) resetAddrSetStates() {
 		as.stopSpray = as.timeNow().Add(sprayPeriod)
 	}
 	for _, de := range c.endpointOfDisco {
-		de.noteConnectivityChange()
+		de.resumeAfterRebind()
+	}
+}
+
+// ReprobePeer distrusts the current path to the peer with node key k
+// and pings all of its endpoints right away, asking it via DERP to
+// ping back, such as when WireGuard handshakes with it stop
+// completing.
+func (c *Conn) ReprobePeer(k tailcfg.NodeKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if as, ok := c.addrsByKey[key.Public(k)]; ok {
+		as.curAddr = -1
+		as.stopSpray = as.timeNow().Add(sprayPeriod)
+	}
+	if dk, ok := c.discoOfNode[k]; ok {
+		if de, ok := c.endpointOfDisco[dk]; ok {
+			de.resumeAfterRebind()
+		}
 	}
 }
 
@@ -2594,6 +3810,11 @@ type AddrSet struct {
 	addrs   []net.UDPAddr
 	ipPorts []netaddr.IPPort // same as addrs, in different form
 
+	// relayOnly is whether the peer is only reached through DERP,
+	// in which case addrs has only DERP addresses and it never
+	// roams to another.
+	relayOnly bool
+
 	// clock, if non-nil, is used in tests instead of time.Now.
 	clock func() time.Time
 	Logf  logger.Logf // must not be nil
@@ -2716,6 +3937,9 @@ func (a *AddrSet) UpdateDst(new *net.UDPAddr) error {
 		// This is a hot path for established connections.
 		return nil
 	}
+	if a.relayOnly {
+		return nil
+	}
 
 	a.mu.Lock()
 	defer a.mu.Unlock()
@@ -2904,13 +4128,24 @@ func (c *Conn) CreateEndpoint(pubKey [32]byte, addrs string) (conn.Endpoint, err
 		publicKey: pk,
 		curAddr:   -1,
 	}
+	if c.netMap != nil {
+		for _, n := range c.netMap.Peers {
+			if n.Key == tailcfg.NodeKey(pk) {
+				a.relayOnly = c.isRelayOnlyLocked(n)
+				break
+			}
+		}
+	}
 
 	if addrs != "" {
 		for _, ep := range strings.Split(addrs, ",") {
-			ipp, err := netaddr.ParseIPPort(ep)
+			ipp, err := parseEndpoint(ep)
 			if err != nil {
 				return nil, fmt.Errorf("bogus address %q", ep)
 			}
+			if a.relayOnly && ipp.IP != derpMagicIPAddr {
+				continue
+			}
 			a.ipPorts = append(a.ipPorts, ipp)
 			a.addrs = append(a.addrs, *ipp.UDPAddr())
 		}
@@ -2971,6 +4206,10 @@ type RebindingUDPConn struct {
 	// This is used by ReceiveIPv6 and awaitUDP4 (called from ReceiveIPv4).
 	ippCache ippCache
 
+	// batch reads packets from pconn. Like ippCache, it's only
+	// used by the single reader.
+	batch batchReader
+
 	mu    sync.Mutex
 	pconn net.PacketConn
 }
@@ -2992,7 +4231,7 @@ func (c *RebindingUDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
 		pconn := c.pconn
 		c.mu.Unlock()
 
-		n, addr, err := pconn.ReadFrom(b)
+		n, addr, err := c.batch.readFrom(pconn, b)
 		if err != nil {
 			c.mu.Lock()
 			pconn2 := c.pconn
@@ -3006,6 +4245,17 @@ func (c *RebindingUDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
 	}
 }
 
+// file returns a duplicate of the file of c's socket.
+func (c *RebindingUDPConn) file() (*os.File, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fc, ok := c.pconn.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("%T has no file", c.pconn)
+	}
+	return fc.File()
+}
+
 func (c *RebindingUDPConn) LocalAddr() *net.UDPAddr {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -3064,6 +4314,31 @@ func (c *RebindingUDPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
 	}
 }
 
+// WriteBatchTo writes b to each of addrs, with sendmmsg on Linux, and
+// returns how many it wrote before any error.
+func (c *RebindingUDPConn) WriteBatchTo(b []byte, addrs []*net.UDPAddr) (int, error) {
+	sent := 0
+	for {
+		c.mu.Lock()
+		pconn := c.pconn
+		c.mu.Unlock()
+
+		n, err := writeBatch(pconn, b, addrs)
+		sent += n
+		if err != nil {
+			c.mu.Lock()
+			pconn2 := c.pconn
+			c.mu.Unlock()
+
+			if pconn != pconn2 {
+				addrs = addrs[n:]
+				continue
+			}
+		}
+		return sent, err
+	}
+}
+
 // simpleDur rounds d such that it stringifies to something short.
 func simpleDur(d time.Duration) time.Duration {
 	if d < time.Second {
@@ -3124,7 +4399,12 @@ func (c *Conn) UpdateStatus(sb *ipnstate.StatusBuilder) {
 	}
 	if c.netMap != nil {
 		ss.HostName = c.netMap.Hostinfo.Hostname
+		ss.DNSName = c.netMap.Name
 		ss.OS = c.netMap.Hostinfo.OS
+		if !c.netMap.Expiry.IsZero() {
+			exp := c.netMap.Expiry
+			ss.KeyExpiry = &exp
+		}
 	}
 	if c.derpMap != nil {
 		derpRegion, ok := c.derpMap.Regions[c.myDerp]
@@ -3145,11 +4425,14 @@ func (c *Conn) UpdateStatus(sb *ipnstate.StatusBuilder) {
 		}
 	}
 	sb.SetSelfStatus(ss)
+	sb.SetNAT(natType(c.netInfoLast))
 
+	now := time.Now()
 	for dk, n := range c.nodeOfDisco {
 		ps := &ipnstate.PeerStatus{InMagicSock: true}
 		ps.Addrs = append(ps.Addrs, n.Endpoints...)
 		ps.Relay = c.derpRegionCodeOfAddrLocked(n.DERP)
+		c.fillDERPStats(ps, key.Public(n.Key), now)
 		if de, ok := c.endpointOfDisco[dk]; ok {
 			de.populatePeerStatus(ps)
 		}
@@ -3161,6 +4444,7 @@ func (c *Conn) UpdateStatus(sb *ipnstate.StatusBuilder) {
 			InMagicSock: true,
 			Relay:       c.derpRegionCodeOfIDLocked(as.derpID()),
 		}
+		c.fillDERPStats(ps, k, now)
 		as.populatePeerStatus(ps)
 		sb.AddPeer(k, ps)
 	}
@@ -3204,8 +4488,12 @@ type discoEndpoint struct {
 	lastSend       time.Time      // last time there was outgoing packets sent to this peer (from wireguard-go)
 	lastFullPing   time.Time      // last time we pinged all endpoints
 	derpAddr       netaddr.IPPort // fallback/bootstrap path, if non-zero (non-zero for well-behaved clients)
+	relayOnly      bool           // only reached through derpAddr; see Conn.isRelayOnlyLocked
+	lanAddr        netaddr.IPPort // endpoint on our LAN to try before any pong; see updateLANLocked
+	sameNAT        bool           // peer is behind our NAT; see isLANLocked
 
 	bestAddr           netaddr.IPPort // best non-DERP path; zero if none
+	bestPath           *pathConn      // multipath path to reach bestAddr over; nil for the main sockets
 	bestAddrLatency    time.Duration
 	bestAddrAt         time.Time // time best address re-confirmed
 	trustBestAddrUntil time.Time // time when bestAddr expires
@@ -3213,6 +4501,13 @@ type discoEndpoint struct {
 	endpointState      map[netaddr.IPPort]*endpointState
 
 	pendingCLIPings []pendingCLIPing // any outstanding "tailscale ping" commands running
+
+	// Path MTU discovery state; see probeMTULocked.
+	mtuAddr      netaddr.IPPort // path pathMTU is of: bestAddr, or derpAddr if none
+	mtuPath      *pathConn      // multipath path of mtuAddr, or nil
+	pathMTU      int            // largest MTU confirmed on mtuAddr; 0 if never probed
+	lastMTUProbe time.Time      // start of the latest round of probes
+	mtuRoundMax  int            // largest MTU confirmed in the latest round
 }
 
 type pendingCLIPing struct {
@@ -3271,6 +4566,10 @@ type endpointState struct {
 	recentPong  uint16      // index into recentPongs of most recent; older before, wrapped
 
 	index int16 // index in nodecfg.Node.Endpoints; meaningless if lastGotPing non-zero
+
+	// notLAN is whether a ping to this endpoint as de.lanAddr
+	// went unanswered, so it's not tried as one again.
+	notLAN bool
 }
 
 // indexSentinelDeleted is the temporary value that endpointState.index takes while
@@ -3293,6 +4592,10 @@ func (de *discoEndpoint) deleteEndpointLocked(ep netaddr.IPPort) {
 	delete(de.endpointState, ep)
 	if de.bestAddr == ep {
 		de.bestAddr = netaddr.IPPort{}
+		de.bestPath = nil
+	}
+	if de.lanAddr == ep {
+		de.lanAddr = netaddr.IPPort{}
 	}
 }
 
@@ -3308,9 +4611,11 @@ type pongReply struct {
 
 type sentPing struct {
 	to      netaddr.IPPort
+	path    *pathConn // multipath path it was sent over, or nil
 	at      time.Time
 	timer   *time.Timer // timeout timer
 	purpose discoPingPurpose
+	size    int // for pingMTU, the MTU probed
 }
 
 // initFakeUDPAddr populates fakeWGAddr with a globally unique fake UDPAddr.
@@ -3382,7 +4687,12 @@ func (de *discoEndpoint) UpdateDst(addr *net.UDPAddr) error {
 // de.mu must be held.
 func (de *discoEndpoint) addrForSendLocked(now time.Time) (udpAddr, derpAddr netaddr.IPPort) {
 	udpAddr = de.bestAddr
-	if udpAddr.IsZero() || now.After(de.trustBestAddrUntil) {
+	if udpAddr.IsZero() {
+		// Until a pong says which path works, try the LAN
+		// one, if any, alongside DERP.
+		udpAddr = de.lanAddr
+	}
+	if de.bestAddr.IsZero() || now.After(de.trustBestAddrUntil) {
 		// We had a bestAddr but it expired so send both to it
 		// and DERP.
 		derpAddr = de.derpAddr
@@ -3413,12 +4723,28 @@ func (de *discoEndpoint) heartbeat() {
 	udpAddr, _ := de.addrForSendLocked(now)
 	if !udpAddr.IsZero() {
 		// We have a preferred path. Ping that every 2 seconds.
-		de.startPingLocked(udpAddr, now, pingHeartbeat)
+		de.startPingViaLocked(udpAddr, de.bestPath, now, pingHeartbeat)
+		if multipathSpray() {
+			// And keep the other local paths to it measured, so
+			// we can fail over without rediscovering.
+			if de.bestPath != nil {
+				de.startPingViaLocked(udpAddr, nil, now, pingHeartbeat)
+			}
+			for _, p := range de.c.paths() {
+				if p != de.bestPath {
+					de.startPingViaLocked(udpAddr, p, now, pingHeartbeat)
+				}
+			}
+		}
 	}
 
+	if !de.bestAddr.IsZero() && !de.isLANLocked(de.bestAddr) {
+		de.pingLANLocked(now)
+	}
 	if de.wantFullPingLocked(now) {
 		de.sendPingsLocked(now, true)
 	}
+	de.probeMTULocked(now)
 
 	de.heartBeatTimer = time.AfterFunc(heartbeatInterval, de.heartbeat)
 }
@@ -3486,6 +4812,7 @@ func (de *discoEndpoint) send(b []byte) error {
 		de.sendPingsLocked(now, true)
 	}
 	de.noteActiveLocked()
+	path := de.bestPath
 	de.mu.Unlock()
 
 	if udpAddr.IsZero() && derpAddr.IsZero() {
@@ -3493,7 +4820,11 @@ func (de *discoEndpoint) send(b []byte) error {
 	}
 	var err error
 	if !udpAddr.IsZero() {
-		_, err = de.c.sendAddr(udpAddr, key.Public(de.publicKey), b)
+		if path != nil {
+			_, err = de.c.sendUDPVia(path, udpAddr, b)
+		} else {
+			_, err = de.c.sendAddr(udpAddr, key.Public(de.publicKey), b)
+		}
 	}
 	if !derpAddr.IsZero() {
 		if ok, _ := de.c.sendAddr(derpAddr, key.Public(de.publicKey), b); ok && err != nil {
@@ -3511,9 +4842,18 @@ func (de *discoEndpoint) pingTimeout(txid stun.TxID) {
 	if !ok {
 		return
 	}
-	if debugDisco || de.bestAddr.IsZero() || time.Now().After(de.trustBestAddrUntil) {
+	if discoVerbose() || de.bestAddr.IsZero() || time.Now().After(de.trustBestAddrUntil) {
 		de.c.logf("magicsock: disco: timeout waiting for pong %x from %v (%v, %v)", txid[:6], sp.to, de.publicKey.ShortString(), de.discoShort)
 	}
+	if sp.to == de.lanAddr {
+		// It's not on our LAN after all, say on a subnet that
+		// only looks like ours. Stop sending to it unasked.
+		de.c.logf("magicsock: disco: LAN path %v to %v (%v) didn't answer", sp.to, de.publicKey.ShortString(), de.discoShort)
+		if st, ok := de.endpointState[sp.to]; ok {
+			st.notLAN = true
+		}
+		de.lanAddr = netaddr.IPPort{}
+	}
 	de.removeSentPingLocked(txid, sp)
 }
 
@@ -3534,12 +4874,13 @@ func (de *discoEndpoint) removeSentPingLocked(txid stun.TxID, sp sentPing) {
 	delete(de.sentPing, txid)
 }
 
-// sendDiscoPing sends a ping with the provided txid to ep.
+// sendDiscoPing sends a ping with the provided txid to ep, via the
+// multipath path if non-nil.
 //
-// The caller (startPingLocked) should've already been recorded the ping in
+// The caller (startPingViaLocked) should've already been recorded the ping in
 // sentPing and set up the timer.
-func (de *discoEndpoint) sendDiscoPing(ep netaddr.IPPort, txid stun.TxID, logLevel discoLogLevel) {
-	sent, _ := de.sendDiscoMessage(ep, &disco.Ping{TxID: [12]byte(txid)}, logLevel)
+func (de *discoEndpoint) sendDiscoPing(ep netaddr.IPPort, path *pathConn, txid stun.TxID, logLevel discoLogLevel) {
+	sent, _ := de.c.sendDiscoMessageVia(path, ep, de.publicKey, de.discoKey, &disco.Ping{TxID: [12]byte(txid)}, logLevel)
 	if !sent {
 		de.forgetPing(txid)
 	}
@@ -3561,9 +4902,20 @@ const (
 	// pingCLI means that the user is running "tailscale ping"
 	// from the CLI. These types of pings can go over DERP.
 	pingCLI
+
+	// pingMTU means that the purpose of a ping was to probe
+	// whether a path carries packets of a given size. These are
+	// padded and can go over DERP.
+	pingMTU
 )
 
 func (de *discoEndpoint) startPingLocked(ep netaddr.IPPort, now time.Time, purpose discoPingPurpose) {
+	de.startPingViaLocked(ep, nil, now, purpose)
+}
+
+// startPingViaLocked is like startPingLocked, but pings ep over the
+// multipath path if non-nil.
+func (de *discoEndpoint) startPingViaLocked(ep netaddr.IPPort, path *pathConn, now time.Time, purpose discoPingPurpose) {
 	if purpose != pingCLI {
 		st, ok := de.endpointState[ep]
 		if !ok {
@@ -3578,6 +4930,7 @@ func (de *discoEndpoint) startPingLocked(ep netaddr.IPPort, now time.Time, purpo
 	txid := stun.NewTxID()
 	de.sentPing[txid] = sentPing{
 		to:      ep,
+		path:    path,
 		at:      now,
 		timer:   time.AfterFunc(pingTimeoutDuration, func() { de.pingTimeout(txid) }),
 		purpose: purpose,
@@ -3586,7 +4939,7 @@ func (de *discoEndpoint) startPingLocked(ep netaddr.IPPort, now time.Time, purpo
 	if purpose == pingHeartbeat {
 		logLevel = discoVerboseLog
 	}
-	go de.sendDiscoPing(ep, txid, logLevel)
+	go de.sendDiscoPing(ep, path, txid, logLevel)
 }
 
 func (de *discoEndpoint) sendPingsLocked(now time.Time, sendCallMeMaybe bool) {
@@ -3609,6 +4962,11 @@ func (de *discoEndpoint) sendPingsLocked(now time.Time, sendCallMeMaybe bool) {
 		}
 
 		de.startPingLocked(ep, now, pingDiscovery)
+		if ep.IP.Is4() {
+			for _, p := range de.c.paths() {
+				de.startPingViaLocked(ep, p, now, pingDiscovery)
+			}
+		}
 	}
 	derpAddr := de.derpAddr
 	if sentAny && sendCallMeMaybe && !derpAddr.IsZero() {
@@ -3626,6 +4984,9 @@ func (de *discoEndpoint) sendDiscoMessage(dst netaddr.IPPort, dm disco.Message,
 	return de.c.sendDiscoMessage(dst, de.publicKey, de.discoKey, dm, logLevel)
 }
 
+// updateFromNode updates de's DERP address and endpoints from n.
+//
+// de.c.mu must be held.
 func (de *discoEndpoint) updateFromNode(n *tailcfg.Node) {
 	if n == nil {
 		// TODO: log, error, count? if this even happens.
@@ -3640,6 +5001,19 @@ func (de *discoEndpoint) updateFromNode(n *tailcfg.Node) {
 		de.derpAddr, _ = netaddr.ParseIPPort(n.DERP)
 	}
 
+	de.relayOnly = de.c.isRelayOnlyLocked(n)
+	if de.relayOnly {
+		// Forget all direct paths, including those learned
+		// from pings, so that only derpAddr is left.
+		for ep := range de.endpointState {
+			de.deleteEndpointLocked(ep)
+		}
+		de.bestAddr = netaddr.IPPort{}
+		de.bestPath = nil
+		de.trustBestAddrUntil = time.Time{}
+		return
+	}
+
 	for _, st := range de.endpointState {
 		st.index = indexSentinelDeleted // assume deleted until updated in next loop
 	}
@@ -3648,7 +5022,7 @@ func (de *discoEndpoint) updateFromNode(n *tailcfg.Node) {
 			// Seems unlikely.
 			continue
 		}
-		ipp, err := netaddr.ParseIPPort(epStr)
+		ipp, err := parseEndpoint(epStr)
 		if err != nil {
 			de.c.logf("magicsock: bogus netmap endpoint %q", epStr)
 			continue
@@ -3667,6 +5041,63 @@ func (de *discoEndpoint) updateFromNode(n *tailcfg.Node) {
 			de.deleteEndpointLocked(ep)
 		}
 	}
+	de.updateLANLocked(false)
+}
+
+// isLANLocked reports whether ep is a path to de over the local
+// network: on one of our subnets, or a private address of a peer
+// behind the same NAT as us, whose public address only works if the
+// NAT hairpins.
+//
+// de.mu must be held.
+func (de *discoEndpoint) isLANLocked(ep netaddr.IPPort) bool {
+	if ep.IsZero() {
+		return false
+	}
+	return de.c.isLANAddr(ep) || de.sameNAT && interfaces.IsPrivateIP(ep.IP)
+}
+
+// updateLANLocked works out whether de is behind our NAT and picks
+// lanAddr, its first network map endpoint on our LAN that hasn't
+// failed as one. If reset, past failures are forgotten.
+//
+// de.mu must be held.
+func (de *discoEndpoint) updateLANLocked(reset bool) {
+	li, _ := de.c.lanInfo.Load().(*lanInfo)
+	de.sameNAT = false
+	for ep, st := range de.endpointState {
+		if reset {
+			st.notLAN = false
+		}
+		if li != nil && !li.publicIP.IsZero() && st.lastGotPing.IsZero() && ep.IP == li.publicIP {
+			de.sameNAT = true
+		}
+	}
+
+	de.lanAddr = netaddr.IPPort{}
+	index := int16(math.MaxInt16)
+	for ep, st := range de.endpointState {
+		if st.lastGotPing.IsZero() && !st.notLAN && st.index < index && de.isLANLocked(ep) {
+			de.lanAddr, index = ep, st.index
+		}
+	}
+}
+
+// pingLANLocked pings de's LAN endpoints, at most every
+// discoPingInterval, so a LAN path is found and switched to within
+// seconds rather than at the next full ping round.
+//
+// de.mu must be held.
+func (de *discoEndpoint) pingLANLocked(now time.Time) {
+	for ep, st := range de.endpointState {
+		if st.notLAN || !de.isLANLocked(ep) {
+			continue
+		}
+		if !st.lastPing.IsZero() && now.Sub(st.lastPing) < discoPingInterval {
+			continue
+		}
+		de.startPingLocked(ep, now, pingDiscovery)
+	}
 }
 
 // addCandidateEndpoint adds ep as an endpoint to which we should send
@@ -3678,6 +5109,10 @@ func (de *discoEndpoint) addCandidateEndpoint(ep netaddr.IPPort) {
 	de.mu.Lock()
 	defer de.mu.Unlock()
 
+	if de.relayOnly {
+		return
+	}
+
 	if st, ok := de.endpointState[ep]; ok {
 		if st.lastGotPing.IsZero() {
 			// Already-known endpoint from the network map.
@@ -3715,6 +5150,25 @@ func (de *discoEndpoint) noteConnectivityChange() {
 	de.trustBestAddrUntil = time.Time{}
 }
 
+// resumeAfterRebind is called after a major link change. It distrusts
+// the current best path and, if there's an active session, pings all
+// of the peer's endpoints right away (asking the peer via DERP to ping
+// back), rather than waiting for the next heartbeat to notice the old
+// path is gone.
+func (de *discoEndpoint) resumeAfterRebind() {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+
+	de.trustBestAddrUntil = time.Time{}
+	if de.lastSend.IsZero() || time.Since(de.lastSend) > sessionActiveTimeout {
+		return
+	}
+	for _, st := range de.endpointState {
+		st.lastPing = time.Time{} // skip the discoPingInterval rate limit
+	}
+	de.sendPingsLocked(time.Now(), true)
+}
+
 // handlePongConnLocked handles a Pong message (a reply to an earlier ping).
 // It should be called with the Conn.mu held.
 func (de *discoEndpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort) {
@@ -3729,6 +5183,10 @@ func (de *discoEndpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort)
 		return
 	}
 	de.removeSentPingLocked(m.TxID, sp)
+	if sp.purpose == pingMTU {
+		de.handleMTUPongLocked(sp)
+		return
+	}
 
 	now := time.Now()
 	latency := now.Sub(sp.at)
@@ -3755,6 +5213,9 @@ func (de *discoEndpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort)
 			if sp.to != src {
 				fmt.Fprintf(bw, " ping.to=%v", sp.to)
 			}
+			if sp.path != nil {
+				fmt.Fprintf(bw, " via=%v", sp.path)
+			}
 		}))
 	}
 
@@ -3764,16 +5225,32 @@ func (de *discoEndpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort)
 	}
 	de.pendingCLIPings = nil
 
-	// Promote this pong response to our current best address if it's lower latency.
-	// TODO(bradfitz): decide how latency vs. preference order affects decision
+	// Promote this pong response to our current best address if it's better.
 	if !isDerp {
-		if de.bestAddr.IsZero() || latency < de.bestAddrLatency {
-			if de.bestAddr != sp.to {
-				de.c.logf("magicsock: disco: node %v %v now using %v", de.publicKey.ShortString(), de.discoShort, sp.to)
+		better := betterAddr(addrLatency{sp.to, latency}, addrLatency{de.bestAddr, de.bestAddrLatency})
+		if sp.to == de.bestAddr && sp.path != de.bestPath {
+			// The same endpoint over another local interface.
+			// Take it if it's faster, or if the current path
+			// has stopped answering.
+			better = latency < de.bestAddrLatency || now.After(de.trustBestAddrUntil)
+		} else if lan := de.isLANLocked(sp.to); !de.bestAddr.IsZero() && lan != de.isLANLocked(de.bestAddr) {
+			// A LAN path beats any other, however fast a
+			// hairpinned or routed one looks, for as long as
+			// it keeps answering.
+			better = lan || now.After(de.trustBestAddrUntil)
+		}
+		if better {
+			if de.bestAddr != sp.to || de.bestPath != sp.path {
+				if sp.path != nil {
+					de.c.logf("magicsock: disco: node %v %v now using %v via %v", de.publicKey.ShortString(), de.discoShort, sp.to, sp.path)
+				} else {
+					de.c.logf("magicsock: disco: node %v %v now using %v", de.publicKey.ShortString(), de.discoShort, sp.to)
+				}
 				de.bestAddr = sp.to
+				de.bestPath = sp.path
 			}
 		}
-		if de.bestAddr == sp.to {
+		if de.bestAddr == sp.to && de.bestPath == sp.path {
 			de.bestAddrLatency = latency
 			de.bestAddrAt = now
 			de.trustBestAddrUntil = now.Add(trustUDPAddrDuration)
@@ -3781,6 +5258,35 @@ func (de *discoEndpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort)
 	}
 }
 
+// addrLatency is an ip:port with its measured latency.
+type addrLatency struct {
+	addr    netaddr.IPPort
+	latency time.Duration
+}
+
+// betterAddr reports whether a is a better path than b. The one with
+// lower latency wins, except that IPv6 gets a 10% advantage: unlike
+// IPv4 paths, it usually doesn't depend on a NAT mapping that may be
+// dropped or changed.
+func betterAddr(a, b addrLatency) bool {
+	if a.addr == b.addr {
+		return false
+	}
+	if b.addr.IsZero() {
+		return true
+	}
+	if a.addr.IsZero() {
+		return false
+	}
+	aLat, bLat := a.latency, b.latency
+	if a.addr.IP.Is6() && b.addr.IP.Is4() {
+		aLat = aLat * 9 / 10
+	} else if b.addr.IP.Is6() && a.addr.IP.Is4() {
+		bLat = bLat * 9 / 10
+	}
+	return aLat < bLat
+}
+
 // discoEndpoint.mu must be held.
 func (st *endpointState) addPongReplyLocked(r pongReply) {
 	if n := len(st.recentPongs); n < pongHistoryCount {
@@ -3825,6 +5331,7 @@ func (de *discoEndpoint) populatePeerStatus(ps *ipnstate.PeerStatus) {
 	now := time.Now()
 	if udpAddr, derpAddr := de.addrForSendLocked(now); !udpAddr.IsZero() && derpAddr.IsZero() {
 		ps.CurAddr = udpAddr.String()
+		ps.LAN = de.isLANLocked(udpAddr)
 	}
 }
 
@@ -3842,6 +5349,7 @@ func (de *discoEndpoint) stopAndReset() {
 	de.lastSend = time.Time{}
 	de.lastFullPing = time.Time{}
 	de.bestAddr = netaddr.IPPort{}
+	de.bestPath = nil
 	de.bestAddrLatency = 0
 	de.bestAddrAt = time.Time{}
 	de.trustBestAddrUntil = time.Time{}
@@ -34,7 +34,9 @@ import (
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
 	"tailscale.com/derp/derpmap"
+	"tailscale.com/disco"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/stun"
 	"tailscale.com/net/stun/stuntest"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
@@ -387,6 +389,81 @@ func pickPort(t testing.TB) uint16 {
 	return uint16(conn.LocalAddr().(*net.UDPAddr).Port)
 }
 
+func TestSetPreferredPort(t *testing.T) {
+	conn, err := NewConn(Options{
+		EndpointsFunc: func(eps []string) {},
+		Logf:          t.Logf,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	port := pickPort(t)
+	conn.SetPreferredPort(port)
+	if got := conn.LocalPort(); got != port {
+		t.Fatalf("LocalPort = %d; want %d", got, port)
+	}
+
+	// A busy port leaves the socket where it is until it's free.
+	busy, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	busyPort := uint16(busy.LocalAddr().(*net.UDPAddr).Port)
+	conn.SetPreferredPort(busyPort)
+	if got := conn.LocalPort(); got != port {
+		t.Errorf("LocalPort = %d after busy port; want unchanged %d", got, port)
+	}
+	busy.Close()
+	if !conn.rebindPreferredPort() {
+		t.Error("rebindPreferredPort didn't move to the freed port")
+	}
+	if got := conn.LocalPort(); got != busyPort {
+		t.Errorf("LocalPort = %d; want %d", got, busyPort)
+	}
+}
+
+func TestRebindingUDPConnReadFrom(t *testing.T) {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ruc := new(RebindingUDPConn)
+	ruc.Reset(pc)
+	defer ruc.Close()
+
+	sender, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	want := []string{"a", "bb", "ccc"}
+	for _, p := range want {
+		if _, err := sender.WriteTo([]byte(p), ruc.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// However many of them a single recvmmsg gets, they come back
+	// one per read, in order.
+	ruc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	senderPort := sender.LocalAddr().(*net.UDPAddr).Port
+	for _, w := range want {
+		n, addr, err := ruc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != w {
+			t.Errorf("read %q; want %q", got, w)
+		}
+		if ua, ok := addr.(*net.UDPAddr); !ok || ua.Port != senderPort {
+			t.Errorf("read from %v; want port %d", addr, senderPort)
+		}
+	}
+}
+
 func TestDerpIPConstant(t *testing.T) {
 	tstest.PanicOnLog()
 	rc := tstest.NewResourceCheck()
@@ -450,6 +527,73 @@ func TestPickDERPFallback(t *testing.T) {
 	}
 }
 
+func TestCleanStaleDerp(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	c.derpIdleTimeout = time.Minute
+	c.myDerp = 1
+	c.activeDerp = map[int]activeDerp{}
+	addDerp := func(region int, lastWrite time.Time) {
+		_, cancel := context.WithCancel(context.Background())
+		c.activeDerp[region] = activeDerp{
+			c: derphttp.NewRegionClient(key.NewPrivate(), t.Logf, func() *tailcfg.DERPRegion {
+				return nil
+			}),
+			cancel:     cancel,
+			lastWrite:  &lastWrite,
+			createTime: lastWrite,
+		}
+	}
+	old := time.Now().Add(-2 * time.Minute)
+	addDerp(1, old)        // home, kept however idle
+	addDerp(2, old)        // idle
+	addDerp(3, time.Now()) // in use
+	idleClosed := derpConnsIdleClosed.Value()
+
+	c.cleanStaleDerp()
+	if _, ok := c.activeDerp[2]; ok || len(c.activeDerp) != 2 {
+		t.Errorf("after cleanup, active regions = %v; want 1 and 3", c.activeDerp)
+	}
+	if !c.idleDerp[2] {
+		t.Error("region 2 not noted as closed for being idle")
+	}
+	if got := derpConnsIdleClosed.Value() - idleClosed; got != 1 {
+		t.Errorf("idle closes = %d; want 1", got)
+	}
+
+	// With no idle timeout, nothing is closed.
+	c.derpIdleTimeout = 0
+	addDerp(2, old)
+	c.cleanStaleDerp()
+	if len(c.activeDerp) != 3 {
+		t.Errorf("with no idle timeout, active regions = %v; want 1, 2 and 3", c.activeDerp)
+	}
+}
+
+func TestDERPIdleTimeoutOption(t *testing.T) {
+	defer func(v string) { derpIdleTimeoutEnv = v }(derpIdleTimeoutEnv)
+	tests := []struct {
+		opt  time.Duration
+		env  string
+		want time.Duration
+	}{
+		{0, "", derpIdleTimeoutDefault},
+		{5 * time.Minute, "", 5 * time.Minute},
+		{-1, "", 0},
+		{0, "10m", 10 * time.Minute},
+		{0, "0", 0},
+		{0, "bogus", derpIdleTimeoutDefault},
+		{time.Minute, "10m", time.Minute},
+	}
+	for _, tt := range tests {
+		derpIdleTimeoutEnv = tt.env
+		opts := &Options{DERPIdleTimeout: tt.opt}
+		if got := opts.derpIdleTimeout(t.Logf); got != tt.want {
+			t.Errorf("DERPIdleTimeout %v, TS_DERP_IDLE_TIMEOUT %q: got %v; want %v", tt.opt, tt.env, got, tt.want)
+		}
+	}
+}
+
 func makeConfigs(t *testing.T, addrs []netaddr.IPPort) []wgcfg.Config {
 	t.Helper()
 
@@ -1304,6 +1448,506 @@ func TestDiscoMessage(t *testing.T) {
 	}
 }
 
+func TestDiscoReplayAndRateLimit(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	c.privateKey = key.NewPrivate()
+
+	peerPub := c.DiscoPublicKey()
+	peerPriv := c.discoPrivate
+	c.endpointOfDisco = map[tailcfg.DiscoKey]*discoEndpoint{
+		tailcfg.DiscoKey(peerPub): &discoEndpoint{},
+	}
+	c.nodeOfDisco = map[tailcfg.DiscoKey]*tailcfg.Node{
+		tailcfg.DiscoKey(peerPub): &tailcfg.Node{},
+	}
+	seal := func() []byte {
+		var nonce [24]byte
+		crand.Read(nonce[:])
+		pkt := append([]byte(disco.Magic), peerPub[:]...)
+		pkt = append(pkt, nonce[:]...)
+		return box.Seal(pkt, []byte("not a disco message"), &nonce, c.discoPrivate.Public().B32(), peerPriv.B32())
+	}
+
+	pkt := seal()
+	for i := 0; i < 2; i++ {
+		if !c.handleDiscoMessage(pkt, netaddr.IPPort{}) {
+			t.Fatalf("message %d not handled", i)
+		}
+	}
+	if limited, replayed := c.DiscoDrops(); limited != 0 || replayed != 1 {
+		t.Errorf("after replay, DiscoDrops = %d, %d; want 0, 1", limited, replayed)
+	}
+
+	// Forged messages don't use up the sender's rate limit.
+	for i := 0; i < 2*discoRecvBurst; i++ {
+		forged := seal()
+		forged[len(forged)-1]++
+		c.handleDiscoMessage(forged, netaddr.IPPort{})
+	}
+	if limited, _ := c.DiscoDrops(); limited != 0 {
+		t.Errorf("forged messages rate limited %d times", limited)
+	}
+
+	for i := 0; i < discoRecvBurst; i++ {
+		c.handleDiscoMessage(seal(), netaddr.IPPort{})
+	}
+	if limited, _ := c.DiscoDrops(); limited == 0 {
+		t.Error("burst of messages not rate limited")
+	}
+}
+
+func TestDiscoReplayWindow(t *testing.T) {
+	rs := &discoRecvState{seen: make(map[[disco.NonceLen]byte]time.Time)}
+	nonce := func(i int) (n [disco.NonceLen]byte) {
+		n[0], n[1] = byte(i), byte(i>>8)
+		return n
+	}
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		rs.noteNonce(nonce(i), start.Add(time.Duration(i)*time.Second))
+	}
+	// Received within the last discoReplayWindow, at 1000-120s on.
+	if len(rs.seen) != 121 {
+		t.Errorf("remembering %d nonces; want 121", len(rs.seen))
+	}
+	seen := func(i int) bool {
+		_, ok := rs.seen[nonce(i)]
+		return ok
+	}
+	if seen(878) || !seen(879) || !seen(999) {
+		t.Error("didn't forget the nonces older than the window")
+	}
+}
+
+func TestHiddenEndpoints(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	if c.hiddenEndpointFunc() != nil {
+		t.Fatal("endpoints hidden by default")
+	}
+
+	c.endpointPrivacy = EndpointPrivacy{NoPrivate: true}
+	hidden := c.hiddenEndpointFunc()
+	tests := []struct {
+		ep   string
+		want bool
+	}{
+		{"192.168.1.2:41641", true},
+		{"10.0.0.5:41641", true},
+		{"[fd00::1]:41641", true},
+		{"1.2.3.4:41641", false},
+		{"[2001:db8::1]:41641", false},
+	}
+	for _, tt := range tests {
+		if got := hidden(tt.ep, "localAddresses"); got != tt.want {
+			t.Errorf("hidden(%q) = %v; want %v", tt.ep, got, tt.want)
+		}
+	}
+}
+
+func TestDERPSourceOK(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+
+	peerKey := key.NewPrivate().Public()
+	otherKey := key.NewPrivate().Public()
+	peerDisco := tailcfg.DiscoKey(key.NewPrivate().Public())
+	c.nodeOfDisco = map[tailcfg.DiscoKey]*tailcfg.Node{
+		peerDisco: &tailcfg.Node{Key: tailcfg.NodeKey(peerKey)},
+	}
+	c.sessions = map[uint32]sessionPeer{7: {peer: peerKey, sent: time.Now()}}
+	pkt := append([]byte(disco.Magic), peerDisco[:]...)
+	pkt = append(pkt, make([]byte, disco.NonceLen+16)...)
+	transport := make([]byte, 32)
+	binary.LittleEndian.PutUint32(transport[:4], device.MessageTransportType)
+	binary.LittleEndian.PutUint32(transport[4:8], 7)
+	unknownSession := append([]byte(nil), transport...)
+	binary.LittleEndian.PutUint32(unknownSession[4:8], 8)
+	spoofedBefore := derpRecvSpoofed.Value()
+
+	tests := []struct {
+		name string
+		pkt  []byte
+		src  key.Public
+		want bool
+	}{
+		{"from_sender", pkt, peerKey, true},
+		{"from_other", pkt, otherKey, false},
+		{"no_source", pkt, key.Public{}, true},
+		{"not_disco", []byte("wireguard packet"), otherKey, true},
+		{"session_from_peer", transport, peerKey, true},
+		{"session_from_other", transport, otherKey, false},
+		{"unknown_session", unknownSession, otherKey, true},
+	}
+	for _, tt := range tests {
+		if got := c.derpSourceOK(tt.pkt, tt.src, 1); got != tt.want {
+			t.Errorf("%s: derpSourceOK = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+	if got := c.DERPSpoofedPackets(); got != 2 {
+		t.Errorf("DERPSpoofedPackets = %d; want 2", got)
+	}
+	if got := derpRecvSpoofed.Value() - spoofedBefore; got != 2 {
+		t.Errorf("counter_derp_recv_spoofed grew by %d; want 2", got)
+	}
+}
+
+func TestRelayOnlyPeers(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+
+	peerKey := key.NewPrivate().Public()
+	peerDisco := tailcfg.DiscoKey(key.NewPrivate().Public())
+	legacyKey := key.NewPrivate().Public()
+	c.SetNetworkMap(&controlclient.NetworkMap{
+		Peers: []*tailcfg.Node{
+			{
+				Key:       tailcfg.NodeKey(peerKey),
+				DiscoKey:  peerDisco,
+				Addresses: []wgcfg.CIDR{{IP: wgcfg.IPv4(100, 64, 0, 1), Mask: 32}},
+				Endpoints: []string{"1.2.3.4:41641"},
+				DERP:      "127.3.3.40:1",
+			},
+			{
+				Key:       tailcfg.NodeKey(legacyKey),
+				Endpoints: []string{"5.6.7.8:41641"},
+				RelayOnly: true,
+			},
+		},
+	})
+	ep, err := c.CreateEndpoint(peerKey, fmt.Sprintf("%x%s", peerDisco[:], controlclient.EndpointDiscoSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	de := ep.(*discoEndpoint)
+	direct := func() bool {
+		de.mu.Lock()
+		defer de.mu.Unlock()
+		return len(de.endpointState) > 0
+	}
+	if !direct() || c.isRelayOnlyAddr(mustIPPort("1.2.3.4:41641")) {
+		t.Fatal("peer relay-only by default")
+	}
+
+	c.SetRelayOnlyPeers([]netaddr.IP{netaddr.IPv4(100, 64, 0, 1)})
+	if direct() {
+		t.Error("relay-only peer kept direct endpoints")
+	}
+	de.addCandidateEndpoint(mustIPPort("1.2.3.4:41641"))
+	if direct() {
+		t.Error("relay-only peer got a candidate endpoint")
+	}
+	de.mu.Lock()
+	udpAddr, derpAddr := de.addrForSendLocked(time.Now())
+	de.mu.Unlock()
+	if !udpAddr.IsZero() || derpAddr != mustIPPort("127.3.3.40:1") {
+		t.Errorf("addrForSendLocked = %v, %v; want DERP only", udpAddr, derpAddr)
+	}
+	for _, s := range []string{"1.2.3.4:41641", "5.6.7.8:41641"} {
+		if !c.isRelayOnlyAddr(mustIPPort(s)) {
+			t.Errorf("packets from %v not dropped", s)
+		}
+	}
+
+	// Packets in a session with the peer are dropped from any
+	// address, unlike those of unknown sessions.
+	hs := make([]byte, device.MessageInitiationSize)
+	binary.LittleEndian.PutUint32(hs[:4], device.MessageInitiationType)
+	binary.LittleEndian.PutUint32(hs[4:8], 7)
+	c.noteSentHandshake(hs, de)
+	transport := func(idx uint32) []byte {
+		b := make([]byte, device.MessageTransportSize)
+		binary.LittleEndian.PutUint32(b[:4], device.MessageTransportType)
+		binary.LittleEndian.PutUint32(b[4:8], idx)
+		return b
+	}
+	elsewhere := mustIPPort("9.9.9.9:1")
+	if !c.isRelayOnlyPacket(transport(7), elsewhere) {
+		t.Error("packet of relay-only peer's session from another address not dropped")
+	}
+	if c.isRelayOnlyPacket(transport(8), elsewhere) {
+		t.Error("packet of unknown session dropped")
+	}
+
+	as, err := c.CreateEndpoint(legacyKey, "127.3.3.40:1,5.6.7.8:41641")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := as.(*AddrSet).ipPorts; len(got) != 1 || got[0] != mustIPPort("127.3.3.40:1") {
+		t.Errorf("relay-only AddrSet addresses = %v; want DERP only", got)
+	}
+
+	c.SetRelayOnlyPeers(nil)
+	if !direct() || c.isRelayOnlyAddr(mustIPPort("1.2.3.4:41641")) || c.isRelayOnlyPacket(transport(7), elsewhere) {
+		t.Error("peer still relay-only after clearing")
+	}
+}
+
+func mustIPPort(s string) netaddr.IPPort {
+	ipp, err := netaddr.ParseIPPort(s)
+	if err != nil {
+		panic(err)
+	}
+	return ipp
+}
+
+func TestBetterAddr(t *testing.T) {
+	const ms = time.Millisecond
+	al := func(ipps string, d time.Duration) addrLatency {
+		return addrLatency{mustIPPort(ipps), d}
+	}
+	zero := addrLatency{}
+	tests := []struct {
+		a, b addrLatency
+		want bool
+	}{
+		{a: zero, b: zero, want: false},
+		{a: al("10.0.0.2:123", 5*ms), b: zero, want: true},
+		{a: zero, b: al("10.0.0.2:123", 5*ms), want: false},
+		{a: al("10.0.0.2:123", 5*ms), b: al("1.2.3.4:555", 6*ms), want: true},
+		{a: al("10.0.0.2:123", 5*ms), b: al("10.0.0.2:123", 10*ms), want: false}, // same addr
+		{a: al("10.0.0.2:123", 5*ms), b: al("1.2.3.4:555", 4*ms), want: false},
+		{a: al("[2001:db8::1]:123", 105*ms), b: al("1.2.3.4:555", 100*ms), want: true},
+		{a: al("1.2.3.4:555", 100*ms), b: al("[2001:db8::1]:123", 105*ms), want: false},
+		{a: al("1.2.3.4:555", 80*ms), b: al("[2001:db8::1]:123", 100*ms), want: true},
+	}
+	for i, tt := range tests {
+		if got := betterAddr(tt.a, tt.b); got != tt.want {
+			t.Errorf("%d. betterAddr(%+v, %+v) = %v; want %v", i, tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestMultipathPong(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	ep := mustIPPort("1.2.3.4:41641")
+	lte := &pathConn{ifName: "wwan0", ip: netaddr.IPv4(10, 64, 0, 2)}
+	now := time.Now()
+	de := &discoEndpoint{
+		c:                  c,
+		sentPing:           map[stun.TxID]sentPing{},
+		endpointState:      map[netaddr.IPPort]*endpointState{ep: {}},
+		bestAddr:           ep,
+		bestAddrLatency:    50 * time.Millisecond,
+		trustBestAddrUntil: now.Add(time.Minute),
+	}
+	pong := func(path *pathConn, latency time.Duration) {
+		t.Helper()
+		txid := stun.NewTxID()
+		de.sentPing[txid] = sentPing{
+			to:    ep,
+			path:  path,
+			at:    time.Now().Add(-latency),
+			timer: time.AfterFunc(time.Hour, func() {}),
+		}
+		de.handlePongConnLocked(&disco.Pong{TxID: txid, Src: ep}, ep)
+	}
+
+	pong(lte, 20*time.Millisecond)
+	if de.bestPath != lte {
+		t.Fatalf("after faster pong via %v, bestPath = %v", lte, de.bestPath)
+	}
+	pong(nil, 30*time.Millisecond)
+	if de.bestPath != lte {
+		t.Fatalf("after slower pong via main socket, bestPath = %v; want %v", de.bestPath, lte)
+	}
+
+	// Once the LTE path stops answering, any working path wins.
+	de.trustBestAddrUntil = now.Add(-time.Second)
+	pong(nil, 40*time.Millisecond)
+	if de.bestPath != nil {
+		t.Fatalf("after failover, bestPath = %v; want main socket", de.bestPath)
+	}
+	if de.bestAddr != ep || !de.trustBestAddrUntil.After(time.Now()) {
+		t.Errorf("after failover, bestAddr = %v, trusted until %v", de.bestAddr, de.trustBestAddrUntil)
+	}
+}
+
+func TestLANPath(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	c.lanInfo.Store(&lanInfo{
+		prefixes: []netaddr.IPPrefix{mustIPPrefix("192.168.1.0/24")},
+		publicIP: netaddr.IPv4(1, 2, 3, 4),
+	})
+	public := mustIPPort("1.2.3.4:41641")   // same public IP as ours: a peer behind our NAT
+	private := mustIPPort("10.0.0.5:41641") // so its private addresses are on our LAN
+	subnet := mustIPPort("192.168.1.7:41641")
+	now := time.Now()
+	de := &discoEndpoint{
+		c:        c,
+		lastSend: now,
+		derpAddr: mustIPPort("127.3.3.40:1"),
+		sentPing: map[stun.TxID]sentPing{},
+		endpointState: map[netaddr.IPPort]*endpointState{
+			public:  {index: 0},
+			private: {index: 1},
+			subnet:  {index: 2},
+		},
+	}
+	sendPing := func(to netaddr.IPPort, latency time.Duration) stun.TxID {
+		txid := stun.NewTxID()
+		de.sentPing[txid] = sentPing{
+			to:    to,
+			at:    time.Now().Add(-latency),
+			timer: time.AfterFunc(time.Hour, func() {}),
+		}
+		return txid
+	}
+	pong := func(from netaddr.IPPort, latency time.Duration) {
+		t.Helper()
+		de.handlePongConnLocked(&disco.Pong{TxID: sendPing(from, latency), Src: from}, from)
+	}
+
+	de.updateLANLocked(false)
+	if !de.sameNAT || de.lanAddr != private {
+		t.Fatalf("sameNAT, lanAddr = %v, %v; want true, %v", de.sameNAT, de.lanAddr, private)
+	}
+	if udpAddr, derpAddr := de.addrForSendLocked(now); udpAddr != private || derpAddr.IsZero() {
+		t.Errorf("before any pong, addrForSendLocked = %v, %v; want %v and DERP", udpAddr, derpAddr, private)
+	}
+
+	// An unanswered LAN path isn't tried again, until the network changes.
+	de.pingTimeout(sendPing(private, 0))
+	if !de.lanAddr.IsZero() {
+		t.Fatalf("after timeout, lanAddr = %v; want none", de.lanAddr)
+	}
+	de.updateLANLocked(false)
+	if de.lanAddr != subnet {
+		t.Fatalf("after timeout, picked lanAddr %v; want %v", de.lanAddr, subnet)
+	}
+	de.updateLANLocked(true)
+	if de.lanAddr != private {
+		t.Fatalf("after reset, lanAddr = %v; want %v", de.lanAddr, private)
+	}
+
+	// A LAN path wins over a faster-looking hairpinned one.
+	pong(public, time.Millisecond)
+	if de.bestAddr != public {
+		t.Fatalf("bestAddr = %v; want %v", de.bestAddr, public)
+	}
+	pong(subnet, 3*time.Millisecond)
+	if de.bestAddr != subnet {
+		t.Fatalf("after LAN pong, bestAddr = %v; want %v", de.bestAddr, subnet)
+	}
+	pong(public, time.Millisecond)
+	if de.bestAddr != subnet {
+		t.Fatalf("after faster non-LAN pong, bestAddr = %v; want %v", de.bestAddr, subnet)
+	}
+
+	var ps ipnstate.PeerStatus
+	de.populatePeerStatus(&ps)
+	if ps.CurAddr != subnet.String() || !ps.LAN {
+		t.Errorf("status CurAddr, LAN = %q, %v; want %q, true", ps.CurAddr, ps.LAN, subnet)
+	}
+}
+
+func mustIPPrefix(s string) netaddr.IPPrefix {
+	p, err := netaddr.ParseIPPrefix(s)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func TestResumeAfterRebind(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	c.closed = true // so the pings aren't actually sent
+	ep := mustIPPort("1.2.3.4:41641")
+	now := time.Now()
+	pinged := now.Add(-time.Second) // recently enough to be rate limited
+	newEndpoint := func(lastSend time.Time) *discoEndpoint {
+		return &discoEndpoint{
+			c:                  c,
+			lastSend:           lastSend,
+			sentPing:           map[stun.TxID]sentPing{},
+			endpointState:      map[netaddr.IPPort]*endpointState{ep: {lastPing: pinged}},
+			bestAddr:           ep,
+			trustBestAddrUntil: now.Add(time.Minute),
+		}
+	}
+
+	active := newEndpoint(now.Add(-time.Second))
+	active.resumeAfterRebind()
+	if !active.trustBestAddrUntil.IsZero() {
+		t.Error("active endpoint still trusts its best address")
+	}
+	if st := active.endpointState[ep]; st.lastPing.Equal(pinged) {
+		t.Error("active endpoint wasn't pinged")
+	}
+
+	idle := newEndpoint(now.Add(-sessionActiveTimeout - time.Second))
+	idle.resumeAfterRebind()
+	if !idle.trustBestAddrUntil.IsZero() {
+		t.Error("idle endpoint still trusts its best address")
+	}
+	if st := idle.endpointState[ep]; !st.lastPing.Equal(pinged) {
+		t.Error("idle endpoint was pinged")
+	}
+}
+
+func TestNAT64(t *testing.T) {
+	ip6 := nat64Addr(net.ParseIP("192.0.2.33"))
+	if got, want := ip6.String(), "64:ff9b::c000:221"; got != want {
+		t.Errorf("nat64Addr = %v; want %v", got, want)
+	}
+	ipp6, _ := netaddr.FromStdAddr(ip6, 41641, "")
+	got, ok := unmapNAT64(ipp6)
+	if want := mustIPPort("192.0.2.33:41641"); !ok || got != want {
+		t.Errorf("unmapNAT64 = %v, %v; want %v, true", got, ok, want)
+	}
+	if _, ok := unmapNAT64(mustIPPort("[2001:db8::c000:221]:41641")); ok {
+		t.Error("unmapNAT64 of non-NAT64 address succeeded")
+	}
+	if _, ok := unmapNAT64(mustIPPort("192.0.2.33:41641")); ok {
+		t.Error("unmapNAT64 of IPv4 address succeeded")
+	}
+	if got, err := parseEndpoint("[::ffff:192.0.2.33]:41641"); err != nil || got != mustIPPort("192.0.2.33:41641") {
+		t.Errorf("parseEndpoint of v4-mapped address = %v, %v; want 192.0.2.33:41641", got, err)
+	}
+}
+
+func TestDERPStats(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	k1, k2 := key.NewPrivate().Public(), key.NewPrivate().Public()
+	stats := func(k key.Public, now time.Time) *ipnstate.PeerStatus {
+		ps := new(ipnstate.PeerStatus)
+		c.fillDERPStats(ps, k, now)
+		return ps
+	}
+
+	// Only peers in the network map are counted.
+	start := time.Now()
+	c.setDERPStatsPeers([]*tailcfg.Node{{Key: tailcfg.NodeKey(k1)}}, start)
+	c.noteDERPBytes(k1, 100, 0)
+	c.noteDERPBytes(k1, 0, 20)
+	c.noteDERPBytes(k2, 5, 5)
+	if ps := stats(k1, start); ps.DERPRxBytes != 100 || ps.DERPTxBytes != 20 {
+		t.Errorf("k1 stats = %v, %v; want 100, 20", ps.DERPRxBytes, ps.DERPTxBytes)
+	}
+	if _, ok := c.derpStats[k2]; ok {
+		t.Errorf("stats kept for k2, not in the network map")
+	}
+
+	// The rate is of the last full window.
+	ps := stats(k1, start.Add(derpRateWindow))
+	if want := int64(100 / derpRateWindow.Seconds()); ps.DERPRxRate != want {
+		t.Errorf("k1 rx rate = %v; want %v", ps.DERPRxRate, want)
+	}
+	if ps := stats(k1, start.Add(2*derpRateWindow)); ps.DERPRxRate != 0 || ps.DERPRxBytes != 100 {
+		t.Errorf("idle k1 rx = %v at %v/s; want 100 at 0/s", ps.DERPRxBytes, ps.DERPRxRate)
+	}
+
+	c.setDERPStatsPeers([]*tailcfg.Node{{Key: tailcfg.NodeKey(k2)}}, start)
+	if ps := stats(k1, start); ps.DERPRxBytes != 0 || ps.DERPTxBytes != 0 {
+		t.Errorf("removed peer stats = %v, %v; want 0, 0", ps.DERPRxBytes, ps.DERPTxBytes)
+	}
+}
+
 // tests that having a discoEndpoint.String prevents wireguard-go's
 // log.Printf("%v") of its conn.Endpoint values from using reflect to
 // walk into read mutex while they're being used and then causing data
@@ -0,0 +1,238 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"context"
+	"net"
+	"sort"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/interfaces"
+	"tailscale.com/net/netns"
+	"tailscale.com/net/stun"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/syncs"
+)
+
+// Multipath mode lets a Conn use several local interfaces at once,
+// such as Ethernet and LTE. Besides its main sockets, which send via
+// whatever interface the routing table picks, it binds an extra IPv4
+// socket (a "path") to each other interface with an address. Disco
+// pings go out of every path, so each combination of local interface
+// and peer endpoint is measured, and the best one that answers
+// carries the traffic. When it stops answering, the next full ping
+// moves traffic to another path that still works.
+//
+// In "spray" mode, every heartbeat also pings the peer's current
+// address over every path, so the spare paths stay measured and
+// failover doesn't have to wait for a new round of discovery.
+
+// multipathEnabled reports whether Conn should bind a socket per
+// interface.
+func multipathEnabled() bool {
+	switch multipathMode {
+	case "1", "true", "failover", "spray":
+		return true
+	}
+	return false
+}
+
+// multipathSpray reports whether heartbeats should ping over every
+// path.
+func multipathSpray() bool { return multipathMode == "spray" }
+
+// A pathConn is a UDP socket bound to one local interface.
+type pathConn struct {
+	ifName string
+	ip     netaddr.IP // local address it's bound to
+	pc     net.PacketConn
+	closed syncs.AtomicBool
+}
+
+func (p *pathConn) String() string { return p.ifName + "/" + p.ip.String() }
+
+func (p *pathConn) close() {
+	p.closed.Set(true)
+	p.pc.Close()
+}
+
+// pathReadResult is a WireGuard packet received on a pathConn. Like
+// derpReadResult, the receiver must call copyBuf to get the packet,
+// which releases the reader's buffer.
+type pathReadResult struct {
+	n       int
+	ipp     netaddr.IPPort
+	copyBuf func(dst []byte) int
+}
+
+// paths returns c's current pathConns.
+func (c *Conn) paths() []*pathConn {
+	ps, _ := c.pathList.Load().([]*pathConn)
+	return ps
+}
+
+// pathLocalAddrs returns the local addresses to find c's paths at,
+// keyed by address and naming the interface. The interface with
+// the default route is left out; the main sockets cover it.
+func pathLocalAddrs() map[netaddr.IP]string {
+	defIf, _ := interfaces.DefaultRouteInterface()
+	ret := map[netaddr.IP]string{}
+	interfaces.ForeachInterfaceAddress(func(i interfaces.Interface, ip netaddr.IP) {
+		if !i.IsUp() || i.IsLoopback() || i.Name == defIf || !ip.Is4() || tsaddr.IsTailscaleIP(ip) {
+			return
+		}
+		if a := ip.As4(); a[0] == 169 && a[1] == 254 {
+			return // link-local
+		}
+		ret[ip] = i.Name
+	})
+	return ret
+}
+
+// updatePaths binds a pathConn to each interface address that wants
+// one and closes those whose address is gone. It's a no-op unless
+// multipath is enabled.
+func (c *Conn) updatePaths() {
+	if !multipathEnabled() || inTest() {
+		return
+	}
+	want := pathLocalAddrs()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	var changed, removed bool
+	for ip, p := range c.pathConns {
+		if want[ip] != p.ifName {
+			c.logf("magicsock: multipath: closing path %v", p)
+			p.close()
+			delete(c.pathConns, ip)
+			changed, removed = true, true
+		}
+	}
+	for ip, ifName := range want {
+		if _, ok := c.pathConns[ip]; ok {
+			continue
+		}
+		addr := netaddr.IPPort{IP: ip}.UDPAddr().String()
+		pc, err := netns.ListenerOnInterface(ifName).ListenPacket(context.Background(), "udp4", addr)
+		if err != nil {
+			c.logf("magicsock: multipath: binding to %s/%v: %v", ifName, ip, err)
+			continue
+		}
+		p := &pathConn{ifName: ifName, ip: ip, pc: pc}
+		if c.pathConns == nil {
+			c.pathConns = map[netaddr.IP]*pathConn{}
+		}
+		c.pathConns[ip] = p
+		changed = true
+		c.logf("magicsock: multipath: added path %v on port %d", p, pc.LocalAddr().(*net.UDPAddr).Port)
+		go c.runPathReader(p)
+	}
+	if !changed {
+		return
+	}
+	ps := make([]*pathConn, 0, len(c.pathConns))
+	for _, p := range c.pathConns {
+		ps = append(ps, p)
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].ifName < ps[j].ifName })
+	c.pathList.Store(ps)
+	if removed {
+		// Some peers' best path may be gone; don't trust it.
+		for _, de := range c.endpointOfDisco {
+			de.noteConnectivityChange()
+		}
+	}
+}
+
+// closePathsLocked closes all of c's pathConns.
+//
+// c.mu must be held.
+func (c *Conn) closePathsLocked() {
+	for ip, p := range c.pathConns {
+		p.close()
+		delete(c.pathConns, ip)
+	}
+	c.pathList.Store([]*pathConn(nil))
+}
+
+// pathEndpoints returns the local ip:ports of c's paths, to
+// advertise as endpoints.
+func (c *Conn) pathEndpoints() []string {
+	var ret []string
+	for _, p := range c.paths() {
+		if !p.closed.Get() {
+			ret = append(ret, p.pc.LocalAddr().String())
+		}
+	}
+	return ret
+}
+
+// runPathReader reads packets from p until it's closed, handling
+// disco messages itself and passing WireGuard packets to ReceiveIPv4.
+func (c *Conn) runPathReader(p *pathConn) {
+	buf := make([]byte, 64<<10)
+	var n int
+	didCopy := make(chan struct{}, 1)
+	copyBuf := func(dst []byte) int {
+		ret := copy(dst, buf[:n])
+		didCopy <- struct{}{}
+		return ret
+	}
+	for {
+		var pAddr net.Addr
+		var err error
+		n, pAddr, err = p.pc.ReadFrom(buf)
+		if err != nil {
+			if !p.closed.Get() {
+				c.logf("magicsock: multipath: reading from %v: %v", p, err)
+			}
+			return
+		}
+		ua, ok := pAddr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		ipp, ok := netaddr.FromStdAddr(ua.IP, ua.Port, ua.Zone)
+		if !ok || stun.Is(buf[:n]) {
+			continue
+		}
+		if c.handleDiscoMessageVia(buf[:n], ipp, p) {
+			continue
+		}
+		if c.isRelayOnlyPacket(buf[:n], ipp) {
+			continue
+		}
+		select {
+		case c.pathRecvCh <- pathReadResult{n: n, ipp: ipp, copyBuf: copyBuf}:
+		case <-c.donec():
+			return
+		}
+		select {
+		case <-didCopy:
+		case <-c.donec():
+			return
+		}
+	}
+}
+
+// sendUDPVia sends b to ipp via path p, or via the main sockets if p
+// is nil. See sendAddr's docs on the return value meanings.
+func (c *Conn) sendUDPVia(p *pathConn, ipp netaddr.IPPort, b []byte) (sent bool, err error) {
+	if p == nil {
+		return c.sendUDP(ipp, b)
+	}
+	if p.closed.Get() || !ipp.IP.Is4() {
+		return false, nil
+	}
+	if _, err := p.pc.WriteTo(b, ipp.UDPAddr()); err != nil {
+		return false, err
+	}
+	return true, nil
+}
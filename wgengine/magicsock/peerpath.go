@@ -0,0 +1,152 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/netcheck"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// PeerPath reports the paths to the peer handling the Tailscale IP
+// ip that c knows about, and the likely reason if none of them is
+// direct.
+func (c *Conn) PeerPath(ip netaddr.IP) (*ipnstate.PeerPath, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.privateKey.IsZero() {
+		return nil, errors.New("local tailscaled stopped")
+	}
+	peer, ok := peerForIP(c.netMap, ip)
+	if !ok {
+		return nil, errors.New("no matching peer")
+	}
+	pp := &ipnstate.PeerPath{
+		PublicKey: key.Public(peer.Key),
+		NodeName:  peer.Name,
+		Relay:     c.derpRegionCodeOfAddrLocked(peer.DERP),
+		SelfNAT:   natType(c.netInfoLast),
+		PeerNAT:   natType(peer.Hostinfo.NetInfo),
+	}
+	if pp.NodeName == "" {
+		pp.NodeName = peer.Hostinfo.Hostname
+	}
+
+	dk, hasDisco := c.discoOfNode[peer.Key]
+	de := c.endpointOfDisco[dk]
+	if hasDisco && de != nil {
+		de.populatePeerPath(pp)
+	} else {
+		for _, ep := range peer.Endpoints {
+			pp.Endpoints = append(pp.Endpoints, &ipnstate.PeerPathEndpoint{Addr: ep})
+		}
+	}
+	pp.Reason = peerPathReason(pp, hasDisco, de != nil)
+	return pp, nil
+}
+
+func (de *discoEndpoint) populatePeerPath(pp *ipnstate.PeerPath) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+
+	pp.LastFullPing = de.lastFullPing
+	if udpAddr, derpAddr := de.addrForSendLocked(time.Now()); !udpAddr.IsZero() && derpAddr.IsZero() {
+		pp.CurAddr = udpAddr.String()
+		pp.CurAddrLatencySeconds = de.bestAddrLatency.Seconds()
+	}
+	pp.PathMTU = de.pathMTU
+	for ipp, st := range de.endpointState {
+		e := &ipnstate.PeerPathEndpoint{
+			Addr:     ipp.String(),
+			Learned:  !st.lastGotPing.IsZero(),
+			LastPing: st.lastPing,
+		}
+		if len(st.recentPongs) > 0 {
+			pong := st.recentPongs[st.recentPong]
+			e.LastPong = pong.pongAt
+			e.LatencySeconds = pong.latency.Seconds()
+			e.PongSrc = pong.pongSrc.String()
+		}
+		pp.Endpoints = append(pp.Endpoints, e)
+	}
+	sort.Slice(pp.Endpoints, func(i, j int) bool {
+		return pp.Endpoints[i].Addr < pp.Endpoints[j].Addr
+	})
+}
+
+// natType classifies the NAT described by ni for PeerPath. Nodes
+// that don't report a NATType are classified by mapping alone.
+func natType(ni *tailcfg.NetInfo) string {
+	if ni == nil {
+		return ""
+	}
+	if ni.NATType != "" {
+		return ni.NATType
+	}
+	varies, ok := ni.MappingVariesByDestIP.Get()
+	switch {
+	case !ok:
+		return ""
+	case varies:
+		return "hard"
+	default:
+		return "easy"
+	}
+}
+
+// peerPathReason returns the likely reason there's no direct path
+// to the peer described by pp, or the empty string if there is one.
+// hasDisco is whether the peer supports discovery, and active whether
+// there has been recent enough traffic to it for its paths to be
+// probed.
+func peerPathReason(pp *ipnstate.PeerPath, hasDisco, active bool) string {
+	if pp.CurAddr != "" {
+		return ""
+	}
+	if !hasDisco {
+		return "peer doesn't support path discovery (pre-0.100 version?)"
+	}
+	if pp.SelfNAT == netcheck.NATUDPBlocked {
+		return "UDP is blocked on this node's network, so all its peers are relayed"
+	}
+	if pp.PeerNAT == netcheck.NATUDPBlocked {
+		return "UDP is blocked on the peer's network, so it's always relayed"
+	}
+	if !active {
+		return "no recent traffic to peer; paths are only probed while it's in use"
+	}
+	if len(pp.Endpoints) == 0 {
+		return "peer reported no endpoints; it may have no UDP connectivity"
+	}
+	var pinged, ponged bool
+	for _, e := range pp.Endpoints {
+		if !e.LastPing.IsZero() {
+			pinged = true
+		}
+		if !e.LastPong.IsZero() {
+			ponged = true
+		}
+	}
+	switch {
+	case !pinged:
+		return "no endpoints pinged yet"
+	case ponged:
+		return "direct path worked before but its replies have stopped; will retry"
+	case pp.SelfNAT == "hard" && pp.PeerNAT == "hard":
+		return "no replies to pings; both sides are behind hard NATs (mapping varies by destination)"
+	case pp.SelfNAT == "hard":
+		return "no replies to pings; this node is behind a hard NAT (mapping varies by destination) and the peer's firewall may not allow unsolicited packets"
+	case pp.PeerNAT == "hard":
+		return "no replies to pings; the peer is behind a hard NAT (mapping varies by destination) and this node's firewall may not allow unsolicited packets"
+	default:
+		return "no replies to pings; UDP is probably blocked by a firewall on either side"
+	}
+}
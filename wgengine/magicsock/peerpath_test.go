@@ -0,0 +1,125 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+)
+
+func TestNATType(t *testing.T) {
+	tests := []struct {
+		ni   *tailcfg.NetInfo
+		want string
+	}{
+		{nil, ""},
+		{&tailcfg.NetInfo{}, ""},
+		{&tailcfg.NetInfo{MappingVariesByDestIP: "true"}, "hard"},
+		{&tailcfg.NetInfo{MappingVariesByDestIP: "false"}, "easy"},
+		{&tailcfg.NetInfo{MappingVariesByDestIP: "true", NATType: "easy"}, "easy"},
+		{&tailcfg.NetInfo{NATType: "udp-blocked"}, "udp-blocked"},
+	}
+	for i, tt := range tests {
+		if got := natType(tt.ni); got != tt.want {
+			t.Errorf("%d. natType = %q; want %q", i, got, tt.want)
+		}
+	}
+}
+
+func TestPeerPathReason(t *testing.T) {
+	now := time.Now()
+	pinged := []*ipnstate.PeerPathEndpoint{{Addr: "1.2.3.4:41641", LastPing: now}}
+	ponged := []*ipnstate.PeerPathEndpoint{{Addr: "1.2.3.4:41641", LastPing: now, LastPong: now}}
+	tests := []struct {
+		name     string
+		pp       ipnstate.PeerPath
+		hasDisco bool
+		active   bool
+		want     string // substring of reason; empty means no reason
+	}{
+		{
+			name:     "direct",
+			pp:       ipnstate.PeerPath{CurAddr: "1.2.3.4:41641", Endpoints: ponged},
+			hasDisco: true,
+			active:   true,
+			want:     "",
+		},
+		{
+			name: "no_disco",
+			want: "doesn't support path discovery",
+		},
+		{
+			name:     "idle",
+			hasDisco: true,
+			want:     "no recent traffic",
+		},
+		{
+			name:     "no_endpoints",
+			hasDisco: true,
+			active:   true,
+			want:     "no endpoints",
+		},
+		{
+			name:     "not_pinged",
+			pp:       ipnstate.PeerPath{Endpoints: []*ipnstate.PeerPathEndpoint{{Addr: "1.2.3.4:41641"}}},
+			hasDisco: true,
+			active:   true,
+			want:     "no endpoints pinged yet",
+		},
+		{
+			name:     "pongs_stopped",
+			pp:       ipnstate.PeerPath{Endpoints: ponged},
+			hasDisco: true,
+			active:   true,
+			want:     "replies have stopped",
+		},
+		{
+			name:     "self_udp_blocked",
+			pp:       ipnstate.PeerPath{Endpoints: pinged, SelfNAT: "udp-blocked"},
+			hasDisco: true,
+			active:   true,
+			want:     "UDP is blocked on this node's network",
+		},
+		{
+			name:     "both_hard",
+			pp:       ipnstate.PeerPath{Endpoints: pinged, SelfNAT: "hard", PeerNAT: "hard"},
+			hasDisco: true,
+			active:   true,
+			want:     "both sides are behind hard NATs",
+		},
+		{
+			name:     "self_hard",
+			pp:       ipnstate.PeerPath{Endpoints: pinged, SelfNAT: "hard", PeerNAT: "easy"},
+			hasDisco: true,
+			active:   true,
+			want:     "this node is behind a hard NAT",
+		},
+		{
+			name:     "firewall",
+			pp:       ipnstate.PeerPath{Endpoints: pinged},
+			hasDisco: true,
+			active:   true,
+			want:     "firewall",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := peerPathReason(&tt.pp, tt.hasDisco, tt.active)
+			if tt.want == "" {
+				if got != "" {
+					t.Errorf("reason = %q; want none", got)
+				}
+				return
+			}
+			if !strings.Contains(got, tt.want) {
+				t.Errorf("reason = %q; want it to contain %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/disco"
+	"tailscale.com/net/stun"
+)
+
+// Path MTU discovery finds, for each active peer, the largest packet
+// that fits through the tunnel on the path in use to it, whether
+// direct or via DERP. Every so often, and whenever the path changes,
+// it sends the peer a round of disco pings padded to the size
+// WireGuard would make packets of each candidate MTU, over a socket
+// that never fragments; the largest one answered is the path's MTU.
+
+const (
+	// minPathMTU is the MTU assumed of every path, as the TUN's
+	// MTU would be without path MTU discovery. It's the smallest
+	// MTU allowed for IPv6.
+	minPathMTU = 1280
+
+	// wgMessageOverhead is the bytes WireGuard adds to a packet
+	// in its transport message: a 16 byte header and a 16 byte
+	// authentication tag.
+	wgMessageOverhead = 32
+
+	// discoPingLen is the size of an unpadded disco ping: the
+	// magic, sender key and nonce, the secretbox tag, and the
+	// message type, version and TxID.
+	discoPingLen = len(disco.Magic) + 32 + disco.NonceLen + 16 + 2 + 12
+
+	// mtuProbeInterval is how often the path MTU to an active peer
+	// is probed again while its path stays the same.
+	mtuProbeInterval = 10 * time.Minute
+)
+
+// mtuProbeSizes are the MTUs probed for, below Options.MaxPeerMTU,
+// which is always probed too. They're the common ones of paths over
+// Ethernet, PPPoE and tunnels, less the outer headers, and of paths
+// with jumbo frames.
+var mtuProbeSizes = []int{1320, 1360, 1400, 1420, 1440, 1460, 1480, 1500, 4000, 8000, 8920}
+
+// probeMTULocked starts a round of path MTU probes of de's current
+// path if it changed or is due to be probed again.
+//
+// de.mu must be held.
+func (de *discoEndpoint) probeMTULocked(now time.Time) {
+	maxMTU := de.c.maxPeerMTU
+	if maxMTU <= minPathMTU {
+		return
+	}
+	// A DERP path has no MTU of its own, but it's still probed:
+	// DERP servers have a limit on the size of packets they relay.
+	to, path := de.bestAddr, de.bestPath
+	if to.IsZero() {
+		to, path = de.derpAddr, nil
+	}
+	if to.IsZero() {
+		return
+	}
+	if to != de.mtuAddr || path != de.mtuPath {
+		de.mtuAddr, de.mtuPath = to, path
+		de.lastMTUProbe = time.Time{}
+		de.setPathMTULocked(minPathMTU)
+	}
+	if !de.lastMTUProbe.IsZero() && now.Sub(de.lastMTUProbe) < mtuProbeInterval {
+		return
+	}
+	de.lastMTUProbe = now
+	de.mtuRoundMax = minPathMTU
+
+	for _, size := range mtuProbeSizes {
+		if size < maxMTU {
+			de.startMTUProbeLocked(to, path, size, now)
+		}
+	}
+	de.startMTUProbeLocked(to, path, maxMTU, now)
+	time.AfterFunc(pingTimeoutDuration, func() { de.endMTURound(now) })
+}
+
+// startMTUProbeLocked sends a ping the size of the WireGuard message
+// of a packet of the given size to ep, via the multipath path if
+// non-nil.
+//
+// de.mu must be held.
+func (de *discoEndpoint) startMTUProbeLocked(ep netaddr.IPPort, path *pathConn, size int, now time.Time) {
+	txid := stun.NewTxID()
+	de.sentPing[txid] = sentPing{
+		to:      ep,
+		path:    path,
+		at:      now,
+		timer:   time.AfterFunc(pingTimeoutDuration, func() { de.forgetPing(txid) }),
+		purpose: pingMTU,
+		size:    size,
+	}
+	ping := &disco.Ping{
+		TxID:    [12]byte(txid),
+		Padding: size + wgMessageOverhead - discoPingLen,
+	}
+	go func() {
+		sent, _ := de.c.sendDiscoMessageVia(path, ep, de.publicKey, de.discoKey, ping, discoQuiet)
+		if !sent {
+			de.forgetPing(txid)
+		}
+	}()
+}
+
+// handleMTUPongLocked handles the pong to the path MTU probe sp.
+//
+// de.mu must be held.
+func (de *discoEndpoint) handleMTUPongLocked(sp sentPing) {
+	if sp.to != de.mtuAddr || sp.path != de.mtuPath {
+		// A probe of an earlier path.
+		return
+	}
+	if sp.size > de.mtuRoundMax {
+		de.mtuRoundMax = sp.size
+	}
+	// Larger packets can be sent right away, but smaller ones
+	// wait for the end of the round, in case the larger probes'
+	// pongs are just slower.
+	if sp.size > de.pathMTU {
+		de.setPathMTULocked(sp.size)
+	}
+}
+
+// endMTURound sets the path MTU to the largest probed in the round
+// started at start, unless another round has started since.
+func (de *discoEndpoint) endMTURound(start time.Time) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	if !de.lastMTUProbe.Equal(start) {
+		return
+	}
+	de.setPathMTULocked(de.mtuRoundMax)
+}
+
+// setPathMTULocked records mtu as the MTU of the path to de and
+// reports changes to Options.PeerMTUFunc.
+//
+// de.mu must be held.
+func (de *discoEndpoint) setPathMTULocked(mtu int) {
+	old := de.pathMTU
+	if mtu == old {
+		return
+	}
+	de.pathMTU = mtu
+	if old != 0 || mtu != minPathMTU {
+		de.c.logf("magicsock: disco: path MTU to %v (%v) via %v now %d", de.publicKey.ShortString(), de.discoShort, derpStr(de.mtuAddr.String()), mtu)
+	}
+	if fn := de.c.peerMTUFunc; fn != nil {
+		fn(de.publicKey, mtu)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+	"inet.af/netaddr"
+	"tailscale.com/disco"
+	"tailscale.com/net/stun"
+	"tailscale.com/tailcfg"
+)
+
+func TestDiscoPingLen(t *testing.T) {
+	const mtu = 1400
+	var key [32]byte
+	var nonce [disco.NonceLen]byte
+	ping := &disco.Ping{Padding: mtu + wgMessageOverhead - discoPingLen}
+	pkt := make([]byte, len(disco.Magic)+32+disco.NonceLen)
+	pkt = box.SealAfterPrecomputation(pkt, ping.AppendMarshal(nil), &nonce, &key)
+	if want := mtu + wgMessageOverhead; len(pkt) != want {
+		t.Errorf("padded ping is %d bytes; want %d", len(pkt), want)
+	}
+}
+
+func TestPathMTU(t *testing.T) {
+	mustIPPort := func(s string) netaddr.IPPort {
+		ipp, err := netaddr.ParseIPPort(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ipp
+	}
+	var got []int
+	c := newConn()
+	c.logf = t.Logf
+	c.closed = true // so that probes fail to send
+	c.maxPeerMTU = 1440
+	c.peerMTUFunc = func(_ tailcfg.NodeKey, mtu int) { got = append(got, mtu) }
+	de := &discoEndpoint{
+		c:        c,
+		sentPing: map[stun.TxID]sentPing{},
+		bestAddr: mustIPPort("1.2.3.4:41641"),
+	}
+	pong := func(size int) {
+		de.handleMTUPongLocked(sentPing{to: de.bestAddr, purpose: pingMTU, size: size})
+	}
+
+	now := time.Now()
+	de.mu.Lock()
+	de.probeMTULocked(now)
+	if len(de.sentPing) != 5 {
+		t.Errorf("sent %d probes; want 5, for 1320 to 1440", len(de.sentPing))
+	}
+	pong(1400)
+	pong(1320)
+	de.mu.Unlock()
+	de.endMTURound(now)
+
+	// The next round finds a smaller MTU.
+	now = now.Add(mtuProbeInterval)
+	de.mu.Lock()
+	de.probeMTULocked(now)
+	pong(1360)
+	de.mu.Unlock()
+	de.endMTURound(now)
+
+	// A new path starts over.
+	de.mu.Lock()
+	de.bestAddr = mustIPPort("5.6.7.8:41641")
+	de.probeMTULocked(now)
+	de.mu.Unlock()
+
+	if want := []int{1280, 1400, 1360, 1280}; !reflect.DeepEqual(got, want) {
+		t.Errorf("path MTUs = %v; want %v", got, want)
+	}
+}
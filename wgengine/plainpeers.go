@@ -0,0 +1,155 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/router"
+)
+
+// PlainPeer is a plain WireGuard peer rather than a Tailscale node,
+// such as a site's existing WireGuard gateway. It has no discovery
+// key, so it's only reached at its static endpoints.
+type PlainPeer struct {
+	PublicKey           wgcfg.Key
+	Endpoints           []wgcfg.Endpoint
+	AllowedIPs          []wgcfg.CIDR
+	PersistentKeepalive uint16 // in seconds; 0 means off
+}
+
+// LoadPlainPeers reads plain WireGuard peers from the JSON file at
+// path, which is an array of them such as:
+//
+//	[{
+//		"PublicKey": "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=",
+//		"Endpoints": ["198.51.100.7:51820"],
+//		"AllowedIPs": ["10.9.0.0/16"],
+//		"PersistentKeepalive": 25
+//	}]
+//
+// PublicKey is base64, as wg(8) prints it.
+func LoadPlainPeers(path string) ([]PlainPeer, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var in []struct {
+		PublicKey           string
+		Endpoints           []string
+		AllowedIPs          []wgcfg.CIDR
+		PersistentKeepalive uint16
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&in); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	peers := make([]PlainPeer, 0, len(in))
+	for i, p := range in {
+		k, err := base64.StdEncoding.DecodeString(p.PublicKey)
+		if err != nil || len(k) != 32 {
+			return nil, fmt.Errorf("%s: peer %d: invalid PublicKey %q", path, i, p.PublicKey)
+		}
+		if len(p.AllowedIPs) == 0 {
+			return nil, fmt.Errorf("%s: peer %d: no AllowedIPs", path, i)
+		}
+		pp := PlainPeer{AllowedIPs: p.AllowedIPs, PersistentKeepalive: p.PersistentKeepalive}
+		copy(pp.PublicKey[:], k)
+		for _, ep := range p.Endpoints {
+			host, port, err := net.SplitHostPort(ep)
+			if err != nil {
+				return nil, fmt.Errorf("%s: peer %d: malformed endpoint %q", path, i, ep)
+			}
+			port16, err := strconv.ParseUint(port, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("%s: peer %d: invalid port in endpoint %q", path, i, ep)
+			}
+			pp.Endpoints = append(pp.Endpoints, wgcfg.Endpoint{Host: host, Port: uint16(port16)})
+		}
+		peers = append(peers, pp)
+	}
+	return peers, nil
+}
+
+// WithPlainPeers wraps e so that peers are added to the WireGuard
+// interface alongside the tailnet's, with routes to their AllowedIPs,
+// whenever e is configured to run. Their traffic goes through the
+// same packet filter as the tailnet's, so the filter rules must allow
+// their addresses for them to reach this node.
+//
+// An allowed IP that the tailnet config already routes to one of its
+// peers stays with that peer.
+func WithPlainPeers(e Engine, logf logger.Logf, peers []PlainPeer) Engine {
+	return &plainPeerEngine{Engine: e, logf: logf, peers: peers}
+}
+
+type plainPeerEngine struct {
+	Engine
+	logf  logger.Logf
+	peers []PlainPeer
+}
+
+func (e *plainPeerEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config) error {
+	if cfg.PrivateKey.IsZero() {
+		// Stopped, or not yet logged in.
+		return e.Engine.Reconfig(cfg, routerCfg)
+	}
+	cfg2, routerCfg2 := e.addPeers(cfg, routerCfg)
+	return e.Engine.Reconfig(cfg2, routerCfg2)
+}
+
+// addPeers returns copies of cfg and routerCfg with e.peers added.
+func (e *plainPeerEngine) addPeers(cfg *wgcfg.Config, routerCfg *router.Config) (*wgcfg.Config, *router.Config) {
+	taken := make(map[wgcfg.CIDR]bool)
+	keys := make(map[wgcfg.Key]bool)
+	for _, p := range cfg.Peers {
+		keys[p.PublicKey] = true
+		for _, ip := range p.AllowedIPs {
+			taken[ip] = true
+		}
+	}
+
+	c := *cfg
+	c.Peers = append([]wgcfg.Peer(nil), cfg.Peers...)
+	rc := *routerCfg
+	rc.Routes = append([]netaddr.IPPrefix(nil), routerCfg.Routes...)
+	for _, pp := range e.peers {
+		if keys[pp.PublicKey] {
+			e.logf("wgengine: plain WireGuard peer %v is also a tailnet node; skipping", pp.PublicKey.ShortString())
+			continue
+		}
+		p := wgcfg.Peer{
+			PublicKey:           pp.PublicKey,
+			Endpoints:           pp.Endpoints,
+			PersistentKeepalive: pp.PersistentKeepalive,
+		}
+		for _, ip := range pp.AllowedIPs {
+			if taken[ip] {
+				e.logf("wgengine: plain WireGuard peer %v: %v is routed to a tailnet node; skipping", pp.PublicKey.ShortString(), ip)
+				continue
+			}
+			taken[ip] = true
+			p.AllowedIPs = append(p.AllowedIPs, ip)
+			pfx, ok := netaddr.FromStdIPNet(ip.IPNet())
+			if !ok {
+				continue
+			}
+			pfx.IP = pfx.IP.Unmap()
+			rc.Routes = append(rc.Routes, pfx)
+		}
+		c.Peers = append(c.Peers, p)
+	}
+	return &c, &rc
+}
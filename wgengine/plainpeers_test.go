@@ -0,0 +1,59 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"testing"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
+	"tailscale.com/wgengine/router"
+)
+
+func TestPlainPeers(t *testing.T) {
+	mustCIDR := func(s string) wgcfg.CIDR {
+		c, err := wgcfg.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	mustPrefix := func(s string) netaddr.IPPrefix {
+		p, err := netaddr.ParseIPPrefix(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	tailnetPeer := wgcfg.Peer{PublicKey: wgcfg.Key{1}, AllowedIPs: []wgcfg.CIDR{mustCIDR("100.64.0.2/32"), mustCIDR("10.1.0.0/16")}}
+	cfg := &wgcfg.Config{Peers: []wgcfg.Peer{tailnetPeer}}
+	routerCfg := &router.Config{Routes: []netaddr.IPPrefix{mustPrefix("100.64.0.2/32")}}
+
+	e := &plainPeerEngine{logf: t.Logf, peers: []PlainPeer{
+		{
+			PublicKey:  wgcfg.Key{2},
+			Endpoints:  []wgcfg.Endpoint{{Host: "198.51.100.7", Port: 51820}},
+			AllowedIPs: []wgcfg.CIDR{mustCIDR("10.9.0.0/16"), mustCIDR("10.1.0.0/16")},
+		},
+		{PublicKey: wgcfg.Key{1}, AllowedIPs: []wgcfg.CIDR{mustCIDR("10.8.0.0/16")}},
+	}}
+	gotCfg, gotRouter := e.addPeers(cfg, routerCfg)
+	if len(cfg.Peers) != 1 || len(routerCfg.Routes) != 1 {
+		t.Fatalf("original configs modified")
+	}
+	if len(gotCfg.Peers) != 2 {
+		t.Fatalf("got %d peers; want the tailnet one and one plain one", len(gotCfg.Peers))
+	}
+	p := gotCfg.Peers[1]
+	if p.PublicKey != (wgcfg.Key{2}) || len(p.Endpoints) != 1 {
+		t.Errorf("plain peer = %+v", p)
+	}
+	if len(p.AllowedIPs) != 1 || p.AllowedIPs[0] != mustCIDR("10.9.0.0/16") {
+		t.Errorf("plain peer AllowedIPs = %v; want only 10.9.0.0/16", p.AllowedIPs)
+	}
+	if len(gotRouter.Routes) != 2 || gotRouter.Routes[1] != mustPrefix("10.9.0.0/16") {
+		t.Errorf("routes = %v; want 10.9.0.0/16 added", gotRouter.Routes)
+	}
+}
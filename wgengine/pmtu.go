@@ -0,0 +1,71 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"fmt"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+)
+
+// setPeerMTU is called by magicsock when path MTU discovery finds
+// the MTU of the path to peer. It's called with magicsock's locks
+// held.
+func (e *userspaceEngine) setPeerMTU(peer tailcfg.NodeKey, mtu int) {
+	e.peerMTUMu.Lock()
+	defer e.peerMTUMu.Unlock()
+	if e.peerMTU == nil {
+		e.peerMTU = make(map[tailcfg.NodeKey]int)
+	}
+	e.peerMTU[peer] = mtu
+	e.updatePeerMTUsLocked()
+}
+
+// setPeerRoutes records the AllowedIPs of cfg's peers, to limit the
+// packets to each to the MTU of the path to it.
+func (e *userspaceEngine) setPeerRoutes(cfg *wgcfg.Config) {
+	routes := make(map[tailcfg.NodeKey][]netaddr.IPPrefix, len(cfg.Peers))
+	for _, p := range cfg.Peers {
+		k := tailcfg.NodeKey(p.PublicKey)
+		for _, cidr := range p.AllowedIPs {
+			pfx, ok := netaddr.FromStdIPNet(cidr.IPNet())
+			if !ok {
+				panic(fmt.Sprintf("conversion of %s from wgcfg to netaddr IPNet failed", cidr))
+			}
+			pfx.IP = pfx.IP.Unmap()
+			routes[k] = append(routes[k], pfx)
+		}
+	}
+
+	e.peerMTUMu.Lock()
+	defer e.peerMTUMu.Unlock()
+	e.peerRoutes = routes
+	for k := range e.peerMTU {
+		if _, ok := routes[k]; !ok {
+			delete(e.peerMTU, k)
+		}
+	}
+	e.updatePeerMTUsLocked()
+}
+
+// updatePeerMTUsLocked sets the MTUs of the TUN's routes to peers: the
+// path MTU to each, or the minimal MTU until one is found.
+//
+// e.peerMTUMu must be held.
+func (e *userspaceEngine) updatePeerMTUsLocked() {
+	m := make(map[netaddr.IPPrefix]int)
+	for k, routes := range e.peerRoutes {
+		mtu := e.peerMTU[k]
+		if mtu == 0 {
+			mtu = minimalMTU
+		}
+		for _, pfx := range routes {
+			m[pfx] = mtu
+		}
+	}
+	e.tundev.SetPeerMTUs(m)
+}
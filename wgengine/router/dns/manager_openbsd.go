@@ -5,5 +5,10 @@
 package dns
 
 func newManager(mconfig ManagerConfig) managerImpl {
-	return newDirectManager(mconfig)
+	switch {
+	case isResolvconfActive():
+		return newResolvconfManager(mconfig)
+	default:
+		return newDirectManager(mconfig)
+	}
 }
@@ -153,6 +153,11 @@ func getDefaultRouteMTU() (uint32, error) {
 	return mtu, nil
 }
 
+// errNetworkCategoryLocked is returned by setPrivateNetwork when
+// Windows refuses to change the network's category, typically
+// because group policy fixes the category of unidentified networks.
+var errNetworkCategoryLocked = errors.New("network category can't be changed")
+
 // setPrivateNetwork marks the provided network adapter's category to private.
 // It returns (false, nil) if the adapter was not found.
 func setPrivateNetwork(ifcLUID winipcfg.LUID) (bool, error) {
@@ -214,7 +219,7 @@ func setPrivateNetwork(ifcLUID winipcfg.LUID) (bool, error) {
 
 		if cat != categoryPrivate {
 			if err := n.SetCategory(categoryPrivate); err != nil {
-				return false, fmt.Errorf("SetCategory: %v", err)
+				return true, fmt.Errorf("%w: SetCategory: %v", errNetworkCategoryLocked, err)
 			}
 		}
 		return true, nil
@@ -258,6 +263,12 @@ func configureInterface(cfg *Config, tun *tun.NativeTun) error {
 		const tries = 20
 		for i := 0; i < tries; i++ {
 			found, err := setPrivateNetwork(luid)
+			if errors.Is(err, errNetworkCategoryLocked) {
+				// Retrying won't help. The firewall rules
+				// cover the other profiles too.
+				log.Printf("setPrivateNetwork: %v; leaving the network unidentified", err)
+				return
+			}
 			if err != nil {
 				log.Printf("setPrivateNetwork(try=%d): %v", i, err)
 			} else {
@@ -306,7 +317,7 @@ func configureInterface(cfg *Config, tun *tun.NativeTun) error {
 				Mask: ipn.Mask,
 			},
 			NextHop: gateway,
-			Metric:  0,
+			Metric:  cfg.RouteMetrics[route],
 		}
 		if bytes.Compare(r.Destination.IP, gateway) == 0 {
 			// no need to add a route for the interface's
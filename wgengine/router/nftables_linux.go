@@ -0,0 +1,247 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// nftTable is the name of the nftables table, in each of the ip and
+// ip6 families, that holds all of Tailscale's netfilter rules when
+// the router uses nftables.
+const nftTable = "tailscale"
+
+// nftBaseChains maps the iptables built-in chains that linuxRouter
+// hooks into to the base chains standing in for them in nftTable.
+var nftBaseChains = map[string]string{
+	"INPUT":       "input { type filter hook input priority 0; }",
+	"OUTPUT":      "output { type route hook output priority -150; }",
+	"FORWARD":     "forward { type filter hook forward priority 0; }",
+	"POSTROUTING": "postrouting { type nat hook postrouting priority 100; }",
+}
+
+// useNFTables reports whether the router should manage netfilter
+// with nft(8) rather than iptables: when iptables is missing, or is
+// just the iptables-nft shim that translates to nftables anyway.
+func useNFTables() bool {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return false
+	}
+	if _, err := exec.LookPath("iptables"); err != nil {
+		return true
+	}
+	out, err := exec.Command("iptables", "--version").CombinedOutput()
+	return err == nil && bytes.Contains(out, []byte("nf_tables"))
+}
+
+// nftablesRunner is a netfilterRunner that keeps the rules in a
+// dedicated nftables table for one address family, rather than in
+// the shared iptables tables. The iptables built-in chains are
+// replaced by base chains of the same hooks in that table, and the
+// "filter" and "nat" tables are merged into it.
+//
+// It understands just the rule arguments linuxRouter uses. Each rule
+// gets its iptables arguments as its comment, which is how Exists and
+// Delete find it again.
+//
+// Note that an accept verdict in one nftables table doesn't stop
+// another table's chains on the same hook from dropping the packet,
+// so hosts with a restrictive firewall of their own still need to
+// let Tailscale traffic through it.
+type nftablesRunner struct {
+	family string // "ip" or "ip6"
+	cmd    commandRunner
+}
+
+func newNFTablesRunner(family string, cmd commandRunner) *nftablesRunner {
+	return &nftablesRunner{family: family, cmd: cmd}
+}
+
+func (n *nftablesRunner) nft(args ...string) error {
+	return n.cmd.run(append([]string{"nft"}, args...)...)
+}
+
+// chain returns the nftTable chain standing in for the iptables
+// chain, creating it first if it's a base chain.
+func (n *nftablesRunner) chain(chain string, create bool) (string, error) {
+	def, ok := nftBaseChains[chain]
+	if !ok {
+		return chain, nil
+	}
+	if create {
+		if err := n.nft("add", "table", n.family, nftTable); err != nil {
+			return "", err
+		}
+		if err := n.nft("add", "chain", n.family, nftTable, def); err != nil {
+			return "", err
+		}
+	}
+	return strings.ToLower(chain), nil
+}
+
+func (n *nftablesRunner) Insert(table, chain string, pos int, args ...string) error {
+	if pos != 1 {
+		return fmt.Errorf("nftables: inserting at position %d not supported", pos)
+	}
+	return n.addRule("insert", chain, args)
+}
+
+func (n *nftablesRunner) Append(table, chain string, args ...string) error {
+	return n.addRule("add", chain, args)
+}
+
+func (n *nftablesRunner) addRule(verb, chain string, args []string) error {
+	expr, err := n.expr(args)
+	if err != nil {
+		return err
+	}
+	chain, err = n.chain(chain, true)
+	if err != nil {
+		return err
+	}
+	return n.nft(append([]string{verb, "rule", n.family, nftTable, chain}, expr...)...)
+}
+
+func (n *nftablesRunner) Exists(table, chain string, args ...string) (bool, error) {
+	chain, _ = n.chain(chain, false)
+	handle, err := n.findRule(chain, args)
+	if err != nil {
+		// No table or chain, so no rule either.
+		return false, nil
+	}
+	return handle != "", nil
+}
+
+func (n *nftablesRunner) Delete(table, chain string, args ...string) error {
+	chain, _ = n.chain(chain, false)
+	handle, err := n.findRule(chain, args)
+	if err != nil {
+		return err
+	}
+	if handle == "" {
+		return fmt.Errorf("nftables: no rule %q in %s", strings.Join(args, " "), chain)
+	}
+	return n.nft("delete", "rule", n.family, nftTable, chain, "handle", handle)
+}
+
+// findRule returns the handle of the rule made from args in chain,
+// or the empty string if there's none.
+func (n *nftablesRunner) findRule(chain string, args []string) (handle string, err error) {
+	out, err := n.cmd.output("nft", "-a", "list", "chain", n.family, nftTable, chain)
+	if err != nil {
+		return "", err
+	}
+	comment := nftComment(args)
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		line := s.Text()
+		if !strings.Contains(line, "comment "+comment) {
+			continue
+		}
+		if i := strings.LastIndex(line, "# handle "); i != -1 {
+			return strings.TrimSpace(line[i+len("# handle "):]), nil
+		}
+	}
+	return "", s.Err()
+}
+
+func (n *nftablesRunner) ClearChain(table, chain string) error {
+	// Like iptables, this fails with exit code 1 if the chain
+	// doesn't exist.
+	return n.nft("flush", "chain", n.family, nftTable, chain)
+}
+
+func (n *nftablesRunner) NewChain(table, chain string) error {
+	if err := n.nft("add", "table", n.family, nftTable); err != nil {
+		return err
+	}
+	return n.nft("add", "chain", n.family, nftTable, chain)
+}
+
+func (n *nftablesRunner) DeleteChain(table, chain string) error {
+	return n.nft("delete", "chain", n.family, nftTable, chain)
+}
+
+// expr translates the iptables rule args to an nft rule expression,
+// as nft arguments.
+func (n *nftablesRunner) expr(args []string) ([]string, error) {
+	var ret []string
+	neg := false
+	// match appends the nft match of key against val.
+	match := func(val string, key ...string) {
+		ret = append(ret, key...)
+		if neg {
+			ret = append(ret, "!=")
+			neg = false
+		}
+		ret = append(ret, val)
+	}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		val := ""
+		if arg != "!" && i+1 < len(args) {
+			val = args[i+1]
+		}
+		switch arg {
+		case "!":
+			neg = true
+			continue
+		case "-i":
+			match(fmt.Sprintf("%q", val), "iifname")
+		case "-o":
+			match(fmt.Sprintf("%q", val), "oifname")
+		case "-s":
+			match(val, n.family, "saddr")
+		case "-d":
+			match(val, n.family, "daddr")
+		case "-m":
+			// Match modules need no loading in nft.
+		case "--mark":
+			match(val, "meta", "mark")
+		case "--ctdir":
+			match(strings.ToLower(val), "ct", "direction")
+		case "--path":
+			// A cgroup v2 path, which nft matches at its depth.
+			p := strings.Trim(val, "/")
+			level := strconv.Itoa(strings.Count(p, "/") + 1)
+			match(fmt.Sprintf("%q", p), "socket", "cgroupv2", "level", level)
+		case "--comment":
+			// Every rule gets a comment; see nftComment.
+		case "-j":
+			switch val {
+			case "ACCEPT", "DROP", "RETURN":
+				ret = append(ret, strings.ToLower(val))
+			case "MASQUERADE":
+				ret = append(ret, "masquerade")
+			case "MARK":
+				if i+3 >= len(args) || args[i+2] != "--set-mark" {
+					return nil, fmt.Errorf("nftables: MARK without --set-mark in %q", args)
+				}
+				ret = append(ret, "meta", "mark", "set", args[i+3])
+				i += 2
+			default:
+				ret = append(ret, "jump", val)
+			}
+		default:
+			return nil, fmt.Errorf("nftables: unsupported rule argument %q in %q", arg, args)
+		}
+		if val == "" {
+			return nil, fmt.Errorf("nftables: missing value for %q in %q", arg, args)
+		}
+		i++
+	}
+	return append(ret, "comment", nftComment(args)), nil
+}
+
+// nftComment returns the quoted comment that identifies the rule made
+// from the iptables rule args.
+func nftComment(args []string) string {
+	return fmt.Sprintf("%q", strings.Join(args, " "))
+}
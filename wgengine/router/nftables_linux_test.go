@@ -0,0 +1,121 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// recordingRunner is a commandRunner that records the commands it's
+// given and answers "nft list" with a canned listing.
+type recordingRunner struct {
+	cmds    []string
+	listing string
+}
+
+func (r *recordingRunner) run(args ...string) error {
+	_, err := r.output(args...)
+	return err
+}
+
+func (r *recordingRunner) output(args ...string) ([]byte, error) {
+	cmd := strings.Join(args, " ")
+	if strings.HasPrefix(cmd, "nft -a list ") {
+		if r.listing == "" {
+			return nil, errors.New("exitcode:1")
+		}
+		return []byte(r.listing), nil
+	}
+	r.cmds = append(r.cmds, cmd)
+	return nil, nil
+}
+
+func TestNFTablesExpr(t *testing.T) {
+	n := newNFTablesRunner("ip", nil)
+	tests := []struct {
+		args string
+		want string
+	}{
+		{"! -i tailscale0 -s 100.64.0.0/10 -j DROP", `iifname != "tailscale0" ip saddr 100.64.0.0/10 drop`},
+		{"-i tailscale0 -j MARK --set-mark 0x40000", `iifname "tailscale0" meta mark set 0x40000`},
+		{"-m mark --mark 0x40000 -j MASQUERADE", `meta mark 0x40000 masquerade`},
+		{"-o tailscale0 -j ACCEPT", `oifname "tailscale0" accept`},
+		{"-j ts-forward", `jump ts-forward`},
+		{"-m conntrack --ctdir REPLY -j RETURN", `ct direction reply return`},
+		{"-m cgroup --path /system.slice/foo.service -j RETURN", `socket cgroupv2 level 2 "system.slice/foo.service" return`},
+	}
+	for _, tt := range tests {
+		args := strings.Fields(tt.args)
+		got, err := n.expr(args)
+		if err != nil {
+			t.Errorf("expr(%q): %v", tt.args, err)
+			continue
+		}
+		want := tt.want + " comment " + nftComment(args)
+		if s := strings.Join(got, " "); s != want {
+			t.Errorf("expr(%q) = %s; want %s", tt.args, s, want)
+		}
+	}
+
+	for _, bad := range []string{"-p udp -j ACCEPT", "-i", "-j MARK"} {
+		if _, err := n.expr(strings.Fields(bad)); err == nil {
+			t.Errorf("expr(%q) succeeded; want error", bad)
+		}
+	}
+}
+
+func TestNFTablesRunner(t *testing.T) {
+	r := &recordingRunner{}
+	n := newNFTablesRunner("ip6", r)
+
+	if err := n.Insert("filter", "FORWARD", 1, "-j", "ts-forward"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Append("nat", "ts-postrouting", "-m", "mark", "--mark", "0x40000", "-j", "MASQUERADE"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"nft add table ip6 tailscale",
+		"nft add chain ip6 tailscale forward { type filter hook forward priority 0; }",
+		`nft insert rule ip6 tailscale forward jump ts-forward comment "-j ts-forward"`,
+		`nft add rule ip6 tailscale ts-postrouting meta mark 0x40000 masquerade comment "-m mark --mark 0x40000 -j MASQUERADE"`,
+	}
+	if diff := cmp.Diff(want, r.cmds); diff != "" {
+		t.Errorf("commands mismatch (-want +got):\n%s", diff)
+	}
+
+	if ok, err := n.Exists("filter", "FORWARD", "-j", "ts-forward"); ok || err != nil {
+		t.Errorf("Exists without table = %v, %v; want false, nil", ok, err)
+	}
+
+	r.cmds = nil
+	r.listing = `table ip6 tailscale {
+	chain forward { # handle 2
+		type filter hook forward priority filter; policy accept;
+		jump ts-forward comment "-j ts-forward" # handle 7
+	}
+}
+`
+	if ok, err := n.Exists("filter", "FORWARD", "-j", "ts-forward"); !ok || err != nil {
+		t.Errorf("Exists = %v, %v; want true, nil", ok, err)
+	}
+	if ok, _ := n.Exists("filter", "FORWARD", "-j", "ts-input"); ok {
+		t.Error("Exists found a missing rule")
+	}
+	if err := n.Delete("filter", "FORWARD", "-j", "ts-forward"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Delete("filter", "FORWARD", "-j", "ts-input"); err == nil {
+		t.Error("deleted a missing rule")
+	}
+	want = []string{"nft delete rule ip6 tailscale forward handle 7"}
+	if diff := cmp.Diff(want, r.cmds); diff != "" {
+		t.Errorf("commands mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/tailscale/wireguard-go/tun"
 	"inet.af/netaddr"
 	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/router/dns"
 )
 
@@ -30,6 +31,26 @@ type Router interface {
 	Close() error
 }
 
+// FilterSetter is implemented by Routers that mirror the packet
+// filter into the OS firewall, so that the OS doesn't block traffic
+// the filter accepts.
+type FilterSetter interface {
+	// SetFilter updates the OS firewall for the new packet filter,
+	// which may be nil.
+	SetFilter(*filter.Filter)
+}
+
+// Adopter is implemented by Routers that can take over the OS state
+// another process's Router left on the same interface, as in an
+// in-place upgrade of tailscaled.
+type Adopter interface {
+	// Adopt records cfg, which the other Router last Set, as the
+	// OS's current state without changing it, so that the next Set
+	// changes only what differs. It's called instead of the first
+	// Set after Up.
+	Adopt(*Config) error
+}
+
 // New returns a new Router for the current platform, using the
 // provided tun device.
 func New(logf logger.Logf, wgdev *device.Device, tundev tun.Device) (Router, error) {
@@ -54,7 +75,7 @@ func Cleanup(logf logger.Logf, interfaceName string) {
 }
 
 // NetfilterMode is the firewall management mode to use when
-// programming the Linux network stack.
+// programming the Linux network stack, or pf on the BSDs.
 type NetfilterMode int
 
 const (
@@ -82,9 +103,35 @@ type Config struct {
 	LocalAddrs []netaddr.IPPrefix
 	Routes     []netaddr.IPPrefix // routes to point into the Tailscale interface
 
+	// LocalRoutes are the machine's local subnets that stay off the
+	// Tailscale interface even though Routes covers them, such as
+	// the LAN while an exit node's default route is in use. Only
+	// Linux needs to act on them: elsewhere the OS's on-link routes
+	// are more specific than a default route and already win.
+	LocalRoutes []netaddr.IPPrefix
+
+	// RouteMetrics are the metrics of those of Routes that have
+	// one, which decide between them and other routes to the same
+	// subnet, such as another VPN's; lower is preferred. On Linux,
+	// routes with a metric go in the main routing table rather
+	// than Tailscale's, which takes precedence over it. macOS has
+	// no route metrics, so there a route with one yields to another
+	// interface's route to the same subnet.
+	RouteMetrics map[netaddr.IPPrefix]uint32
+
 	DNS dns.Config
 
-	// Linux-only things below, ignored on other platforms.
+	// SplitTunnelApps, if non-empty, are the only apps whose
+	// traffic goes through the Tailscale interface or, if
+	// SplitTunnelExclude, the apps whose traffic doesn't: cgroup v2
+	// paths on Linux and executable paths on Windows, where Routes
+	// must then stay within Tailscale's own addresses. Other
+	// platforms ignore them.
+	SplitTunnelApps    []string
+	SplitTunnelExclude bool
+
+	// Linux, FreeBSD and OpenBSD only things below, ignored on
+	// other platforms.
 
 	SubnetRoutes     []netaddr.IPPrefix // subnets being advertised to other Tailscale nodes
 	SNATSubnetRoutes bool               // SNAT traffic to local subnets
@@ -95,3 +142,15 @@ type Config struct {
 // state from the OS. It's the config used when callers pass in a nil
 // Config.
 var shutdownConfig = Config{}
+
+func strsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,350 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build freebsd openbsd
+
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+
+	"github.com/tailscale/wireguard-go/tun"
+	"inet.af/netaddr"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/router/dns"
+)
+
+// pfAnchor is the pf anchor holding Tailscale's firewall and NAT
+// rules. The main ruleset in pf.conf has to reference it (see
+// pfAnchorHint) for the rules to take effect.
+const pfAnchor = "tailscale"
+
+// bsdRouter is the Router for FreeBSD and OpenBSD. It programs
+// addresses and routes with ifconfig(8) and route(8), and the
+// firewall and subnet SNAT with rules in the pf anchor pfAnchor.
+// The OS-specific bits live in router_freebsd.go and
+// router_openbsd.go.
+type bsdRouter struct {
+	logf    logger.Logf
+	tunname string
+	local   map[netaddr.IPPrefix]bool
+	routes  map[netaddr.IPPrefix]bool
+
+	havePF       bool   // pfctl(8) is available
+	pfRules      string // ruleset last loaded into pfAnchor
+	warnedAnchor bool   // logged that pf.conf lacks the anchor
+
+	dns *dns.Manager
+}
+
+func newBSDRouter(logf logger.Logf, tundev tun.Device) (*bsdRouter, error) {
+	tunname, err := tundev.Name()
+	if err != nil {
+		return nil, err
+	}
+	_, err = exec.LookPath("pfctl")
+	if err != nil {
+		logf("pfctl not found; not managing pf rules")
+	}
+
+	mconfig := dns.ManagerConfig{
+		Logf:          logf,
+		InterfaceName: tunname,
+	}
+
+	return &bsdRouter{
+		logf:    logf,
+		tunname: tunname,
+		routes:  make(map[netaddr.IPPrefix]bool),
+		havePF:  err == nil,
+		dns:     dns.NewManager(mconfig),
+	}, nil
+}
+
+func cmd(args ...string) *exec.Cmd {
+	if len(args) == 0 {
+		log.Fatalf("exec.Cmd(%#v) invalid; need argv[0]", args)
+	}
+	return exec.Command(args[0], args[1:]...)
+}
+
+// run runs the command args, logging any failure.
+func (r *bsdRouter) run(args ...string) error {
+	if out, err := cmd(args...).CombinedOutput(); err != nil {
+		r.logf("%v failed: %v\n%s", args, err, out)
+		return err
+	}
+	return nil
+}
+
+func (r *bsdRouter) Up() error {
+	if err := r.run("ifconfig", r.tunname, "up"); err != nil {
+		return err
+	}
+	// Clear out rules left behind by a previous run that didn't
+	// shut down cleanly.
+	r.flushPF()
+	return nil
+}
+
+func (r *bsdRouter) Set(cfg *Config) error {
+	if cfg == nil {
+		cfg = &shutdownConfig
+	}
+
+	var errq error
+	setErr := func(err error) {
+		if errq == nil {
+			errq = err
+		}
+	}
+
+	newLocal := make(map[netaddr.IPPrefix]bool)
+	for _, addr := range cfg.LocalAddrs {
+		newLocal[addr] = true
+	}
+	localChanged := len(newLocal) != len(r.local)
+	for addr := range newLocal {
+		if !r.local[addr] {
+			localChanged = true
+		}
+	}
+	newRoutes := make(map[netaddr.IPPrefix]bool)
+	for _, route := range cfg.Routes {
+		newRoutes[route] = true
+	}
+
+	// Routes may point at the local addresses, so take them all
+	// down and put them back up if those change.
+	for route := range r.routes {
+		if localChanged || !newRoutes[route] {
+			if err := r.run("route", "-q", "-n", "delete", inetFlag(route), routeDst(route)); err != nil {
+				setErr(err)
+			}
+			delete(r.routes, route)
+		}
+	}
+
+	for addr := range r.local {
+		if !newLocal[addr] {
+			if err := r.delAddr(addr); err != nil {
+				setErr(err)
+			}
+		}
+	}
+	for addr := range newLocal {
+		if !r.local[addr] {
+			if err := r.addAddr(addr); err != nil {
+				setErr(err)
+			}
+		}
+	}
+	r.local = newLocal
+
+	// Only routes that went in are recorded, so the next Set tries
+	// the rest again.
+	for route := range newRoutes {
+		if r.routes[route] {
+			continue
+		}
+		gw := r.routeGateway(route)
+		if gw == "" {
+			setErr(fmt.Errorf("no local address for route %v", route))
+			continue
+		}
+		if err := r.run("route", "-q", "-n", "add", inetFlag(route), routeDst(route), "-iface", gw); err != nil {
+			setErr(err)
+			continue
+		}
+		r.routes[route] = true
+	}
+
+	if err := r.setPF(cfg); err != nil {
+		setErr(err)
+	}
+
+	if err := r.dns.Set(cfg.DNS); err != nil {
+		errq = fmt.Errorf("dns set: %v", err)
+	}
+
+	return errq
+}
+
+func (r *bsdRouter) Close() error {
+	if err := r.dns.Down(); err != nil {
+		return fmt.Errorf("dns down: %v", err)
+	}
+	cleanup(r.logf, r.tunname)
+	return nil
+}
+
+// inetFlag returns the route(8) address family flag for p.
+func inetFlag(p netaddr.IPPrefix) string {
+	if p.IP.Is4() {
+		return "-inet"
+	}
+	return "-inet6"
+}
+
+// pfFamily returns the pf.conf address family keyword for p.
+func pfFamily(p netaddr.IPPrefix) string {
+	if p.IP.Is4() {
+		return "inet"
+	}
+	return "inet6"
+}
+
+// routeDst returns route as route(8) wants it, with the host bits
+// masked off.
+func routeDst(route netaddr.IPPrefix) string {
+	net := route.IPNet()
+	nip := net.IP.Mask(net.Mask)
+	return fmt.Sprintf("%v/%d", nip, route.Bits)
+}
+
+// tailnetRange returns the range of Tailscale addresses in p's
+// address family.
+func tailnetRange(p netaddr.IPPrefix) netaddr.IPPrefix {
+	if p.IP.Is4() {
+		return tsaddr.CGNATRange()
+	}
+	return tsaddr.TailscaleULARange()
+}
+
+// pfNAT is a subnet route to SNAT traffic to, and the interface
+// that traffic leaves through.
+type pfNAT struct {
+	iface string
+	dst   netaddr.IPPrefix
+}
+
+// pfRuleset returns the contents of pfAnchor for the tun interface
+// tunname, source NATing tailnet traffic to the nats subnets.
+//
+// Besides the NAT, the anchor lets all traffic on the tun interface
+// through, since wgengine filters it already, and drops tailnet
+// source addresses arriving on any other interface but loopback.
+func pfRuleset(tunname string, nats []pfNAT) string {
+	var sb strings.Builder
+	for _, n := range nats {
+		sb.WriteString(pfNATRule(n.iface, pfFamily(n.dst), tailnetRange(n.dst), n.dst))
+		sb.WriteByte('\n')
+	}
+	fmt.Fprintf(&sb, "pass quick on %s all\n", tunname)
+	for _, p := range []netaddr.IPPrefix{tsaddr.CGNATRange(), tsaddr.TailscaleULARange()} {
+		fmt.Fprintf(&sb, "pass in quick on lo0 %s from %s to any\n", pfFamily(p), p)
+		fmt.Fprintf(&sb, "block drop in quick %s from %s to any\n", pfFamily(p), p)
+	}
+	return sb.String()
+}
+
+// setPF loads the pf ruleset for cfg into pfAnchor, or flushes the
+// anchor if cfg.NetfilterMode is NetfilterOff. NetfilterNoDivert is
+// the same as NetfilterOn, since pf.conf always has to call the
+// anchor itself.
+func (r *bsdRouter) setPF(cfg *Config) error {
+	if !r.havePF {
+		return nil
+	}
+	if cfg.NetfilterMode == NetfilterOff || len(cfg.LocalAddrs) == 0 {
+		r.flushPF()
+		return nil
+	}
+
+	var nats []pfNAT
+	if cfg.SNATSubnetRoutes {
+		for _, route := range cfg.SubnetRoutes {
+			if _, ip, ok := tsaddr.UnmapVia(route.IP); ok && route.Bits >= 96 {
+				// A 4via6 route, whose packets leave as IPv4
+				// ones to the subnet it maps.
+				route = netaddr.IPPrefix{IP: ip, Bits: route.Bits - 96}
+			}
+			iface, err := egressInterface(route)
+			if err != nil {
+				r.logf("no route to %v; not NATing it: %v", route, err)
+				continue
+			}
+			nats = append(nats, pfNAT{iface: iface, dst: route})
+		}
+	}
+	rules := pfRuleset(r.tunname, nats)
+	if rules == r.pfRules {
+		return nil
+	}
+
+	c := cmd("pfctl", "-a", pfAnchor, "-f", "-")
+	c.Stdin = strings.NewReader(rules)
+	if out, err := c.CombinedOutput(); err != nil {
+		r.logf("loading pf anchor %q failed: %v\n%s\nrules:\n%s", pfAnchor, err, out, rules)
+		return fmt.Errorf("loading pf anchor %q: %v", pfAnchor, err)
+	}
+	r.pfRules = rules
+
+	if !r.warnedAnchor {
+		out, err := cmd("pfctl", "-s", "rules").Output()
+		if err == nil && !bytes.Contains(out, []byte(fmt.Sprintf("anchor %q", pfAnchor))) {
+			r.logf("pf.conf doesn't reference the %q anchor, so its rules aren't used; add:\n%s", pfAnchor, pfAnchorHint)
+			r.warnedAnchor = true
+		}
+	}
+	return nil
+}
+
+// flushPF removes all rules from pfAnchor.
+func (r *bsdRouter) flushPF() {
+	if !r.havePF {
+		return
+	}
+	if out, err := cmd("pfctl", "-a", pfAnchor, "-F", "all").CombinedOutput(); err != nil {
+		r.logf("flushing pf anchor %q failed: %v\n%s", pfAnchor, err, out)
+	}
+	r.pfRules = ""
+}
+
+// cleanupPF removes all rules from pfAnchor, if pf is available.
+func cleanupPF(logf logger.Logf) {
+	if _, err := exec.LookPath("pfctl"); err != nil {
+		return
+	}
+	if out, err := cmd("pfctl", "-a", pfAnchor, "-F", "all").CombinedOutput(); err != nil {
+		logf("flushing pf anchor %q failed: %v\n%s", pfAnchor, err, out)
+	}
+}
+
+// egressInterface returns the name of the interface that traffic to
+// route leaves through, according to the routing table.
+func egressInterface(route netaddr.IPPrefix) (string, error) {
+	dst := route.IP.String()
+	if route.Bits == 0 {
+		dst = "default"
+	}
+	out, err := cmd("route", "-n", "get", inetFlag(route), dst).Output()
+	if err != nil {
+		return "", err
+	}
+	iface := parseRouteGetInterface(out)
+	if iface == "" {
+		return "", fmt.Errorf("no interface in route output %q", out)
+	}
+	return iface, nil
+}
+
+// parseRouteGetInterface returns the interface name from the output
+// of "route -n get", or the empty string if there's none.
+func parseRouteGetInterface(out []byte) string {
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) == 2 && f[0] == "interface:" {
+			return f[1]
+		}
+	}
+	return ""
+}
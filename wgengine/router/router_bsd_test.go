@@ -0,0 +1,69 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build freebsd openbsd
+
+package router
+
+import (
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestPFRuleset(t *testing.T) {
+	mustCIDR := func(s string) netaddr.IPPrefix {
+		pfx, err := netaddr.ParseIPPrefix(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pfx
+	}
+	nats := []pfNAT{
+		{iface: "em0", dst: mustCIDR("192.168.1.0/24")},
+		{iface: "em1", dst: mustCIDR("::/0")},
+	}
+	got := pfRuleset("tailscale0", nats)
+	want := pfNATRule("em0", "inet", mustCIDR("100.64.0.0/10"), mustCIDR("192.168.1.0/24")) + "\n" +
+		pfNATRule("em1", "inet6", mustCIDR("fd7a:115c:a1e0::/48"), mustCIDR("::/0")) + "\n" +
+		`pass quick on tailscale0 all
+pass in quick on lo0 inet from 100.64.0.0/10 to any
+block drop in quick inet from 100.64.0.0/10 to any
+pass in quick on lo0 inet6 from fd7a:115c:a1e0::/48 to any
+block drop in quick inet6 from fd7a:115c:a1e0::/48 to any
+`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	// With SNAT off, forwarded traffic keeps its tailnet source
+	// address and only the filtering rules remain.
+	got = pfRuleset("tailscale0", nil)
+	want = `pass quick on tailscale0 all
+pass in quick on lo0 inet from 100.64.0.0/10 to any
+block drop in quick inet from 100.64.0.0/10 to any
+pass in quick on lo0 inet6 from fd7a:115c:a1e0::/48 to any
+block drop in quick inet6 from fd7a:115c:a1e0::/48 to any
+`
+	if got != want {
+		t.Errorf("without NAT, got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestParseRouteGetInterface(t *testing.T) {
+	out := `   route to: default
+destination: default
+       mask: default
+    gateway: 192.168.1.1
+        fib: 0
+  interface: em0
+      flags: <UP,GATEWAY,DONE,STATIC>
+`
+	if got := parseRouteGetInterface([]byte(out)); got != "em0" {
+		t.Errorf("got %q; want em0", got)
+	}
+	if got := parseRouteGetInterface([]byte("route: writing to routing socket: not in table\n")); got != "" {
+		t.Errorf("got %q; want none", got)
+	}
+}
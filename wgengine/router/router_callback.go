@@ -0,0 +1,31 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+// CallbackRouter is a Router that hands each configuration to a
+// function, for hosts that apply it themselves through APIs Go can't
+// reach, such as a Network Extension's NEPacketTunnelNetworkSettings
+// on iOS and macOS. It neither runs nor execs anything itself.
+type CallbackRouter struct {
+	// SetConfig is called with every configuration, starting with
+	// an empty one when the engine starts. It may be called again
+	// with an identical one.
+	SetConfig func(*Config) error
+}
+
+func (r *CallbackRouter) Up() error {
+	return nil
+}
+
+func (r *CallbackRouter) Set(cfg *Config) error {
+	if cfg == nil {
+		cfg = &shutdownConfig
+	}
+	return r.SetConfig(cfg)
+}
+
+func (r *CallbackRouter) Close() error {
+	return nil
+}
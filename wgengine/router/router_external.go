@@ -0,0 +1,47 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"fmt"
+
+	"github.com/tailscale/wireguard-go/device"
+	"github.com/tailscale/wireguard-go/tun"
+	"tailscale.com/types/logger"
+)
+
+// NewExternal returns a Router that leaves the interface's addresses,
+// routes and DNS to something else, such as a reconfig hook run with
+// the privileges the process lacks. It only logs what they should be
+// when that changes.
+func NewExternal(logf logger.Logf, _ *device.Device, _ tun.Device) (Router, error) {
+	return &externalRouter{logf: logger.WithPrefix(logf, "router: ")}, nil
+}
+
+type externalRouter struct {
+	logf logger.Logf
+	last string // of the last Config logged
+}
+
+func (r *externalRouter) Up() error {
+	r.logf("leaving the interface's configuration to the system")
+	return nil
+}
+
+func (r *externalRouter) Set(cfg *Config) error {
+	if cfg == nil {
+		cfg = &shutdownConfig
+	}
+	s := fmt.Sprintf("addresses %v, routes %v, DNS servers %v", cfg.LocalAddrs, cfg.Routes, cfg.DNS.Nameservers)
+	if s != r.last {
+		r.last = s
+		r.logf("interface should have %s", s)
+	}
+	return nil
+}
+
+func (r *externalRouter) Close() error {
+	return nil
+}
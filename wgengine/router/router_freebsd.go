@@ -5,8 +5,11 @@
 package router
 
 import (
+	"fmt"
+
 	"github.com/tailscale/wireguard-go/device"
 	"github.com/tailscale/wireguard-go/tun"
+	"inet.af/netaddr"
 	"tailscale.com/types/logger"
 )
 
@@ -16,7 +19,37 @@ import (
 // https://svnweb.freebsd.org/base?view=revision&revision=357986
 
 func newUserspaceRouter(logf logger.Logf, _ *device.Device, tundev tun.Device) (Router, error) {
-	return newUserspaceBSDRouter(logf, nil, tundev)
+	return newBSDRouter(logf, tundev)
+}
+
+// pfAnchorHint is what pf.conf needs for the rules in pfAnchor to
+// apply. FreeBSD's pf keeps translation rules separately from
+// filter rules, so it takes two anchors.
+const pfAnchorHint = `nat-anchor "tailscale"
+anchor "tailscale"`
+
+// pfNATRule returns the pf.conf rule source NATing traffic from src
+// to dst that leaves through iface.
+func pfNATRule(iface, family string, src, dst netaddr.IPPrefix) string {
+	return fmt.Sprintf("nat on %s %s from %s to %s -> (%s)", iface, family, src, dst, iface)
+}
+
+func (r *bsdRouter) addAddr(addr netaddr.IPPrefix) error {
+	if addr.IP.Is4() {
+		// The tun interface is point-to-point, so it takes a
+		// destination address too; use our own.
+		return r.run("ifconfig", r.tunname, "inet", addr.String(), addr.IP.String(), "alias")
+	}
+	return r.run("ifconfig", r.tunname, "inet6", addr.String(), "alias")
+}
+
+func (r *bsdRouter) delAddr(addr netaddr.IPPrefix) error {
+	return r.run("ifconfig", r.tunname, pfFamily(addr), addr.IP.String(), "-alias")
+}
+
+// routeGateway returns the route(8) -iface gateway for route.
+func (r *bsdRouter) routeGateway(route netaddr.IPPrefix) string {
+	return r.tunname
 }
 
 func cleanup(logf logger.Logf, interfaceName string) {
@@ -28,4 +61,5 @@ func cleanup(logf logger.Logf, interfaceName string) {
 	if out, err := cmd(ifup...).CombinedOutput(); err != nil {
 		logf("ifconfig destroy: %v\n%s", err, out)
 	}
+	cleanupPF(logf)
 }
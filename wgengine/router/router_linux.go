@@ -49,10 +49,16 @@ const (
 	// routed over the Tailscale network.
 	//
 	// Keep this in sync with tailscaleBypassMark in
-	// net/netns/netns_linux.go.
+	// net/netns/netns_linux.go and kernelBypassMark in
+	// wgengine/kernel_linux.go.
 	tailscaleBypassMark = "0x80000"
 )
 
+// tailscaleFwmarkMask is the mark bits that Tailscale uses, the
+// third byte. Marks written as value/mask with it leave other
+// software's bits alone when set, and ignore them when matched.
+const tailscaleFwmarkMask = "0xff0000"
+
 // tailscaleRouteTable is the routing table number for Tailscale
 // network routes. See addIPRules for the detailed policy routing
 // logic that ends up doing lookups within that table.
@@ -69,9 +75,14 @@ const (
 // though linux itself supports larger numbers.
 const tailscaleRouteTable = "52"
 
+// tailscaleIfGroup is the interface group of the tunnel interface
+// while routes with metrics are in the main table, which lets policy
+// routing rules skip routes through it; see setMetricRules.
+const tailscaleIfGroup = "52"
+
 // netfilterRunner abstracts helpers to run netfilter commands. It
-// exists purely to swap out go-iptables for a fake implementation in
-// tests.
+// exists to swap out go-iptables for nftablesRunner on hosts using
+// nftables, and for a fake implementation in tests.
 type netfilterRunner interface {
 	Insert(table, chain string, pos int, args ...string) error
 	Append(table, chain string, args ...string) error
@@ -87,8 +98,14 @@ type linuxRouter struct {
 	tunname          string
 	addrs            map[netaddr.IPPrefix]bool
 	routes           map[netaddr.IPPrefix]bool
+	routeMetrics     map[netaddr.IPPrefix]uint32 // of routes, where nonzero
+	metricRules      bool                        // whether setMetricRules added its rules
+	localRoutes      map[netaddr.IPPrefix]bool
 	snatSubnetRoutes bool
 	netfilterMode    NetfilterMode
+	apps             []string // split tunneling's, as applied
+	appsExclude      bool
+	appsClean        bool // whether no split tunneling rules are known to be left
 
 	// Various feature checks for the network stack.
 	ipRuleAvailable bool
@@ -107,13 +124,38 @@ func newUserspaceRouter(logf logger.Logf, _ *device.Device, tunDev tun.Device) (
 	if err != nil {
 		return nil, err
 	}
+	return newRouterForInterface(logf, tunname)
+}
+
+// NewForInterface returns a Router for the existing network
+// interface ifName, such as an in-kernel WireGuard interface, rather
+// than for a TUN device.
+func NewForInterface(logf logger.Logf, ifName string) (Router, error) {
+	return newRouterForInterface(logger.WithPrefix(logf, "router: "), ifName)
+}
+
+func newRouterForInterface(logf logger.Logf, tunname string) (Router, error) {
+	if useNFTables() {
+		logf("using nftables")
+		cmd := osCommandRunner{}
+		nft4 := newNFTablesRunner("ip", cmd)
+		var nft6 netfilterRunner
+		supportsV6 := supportsV6()
+		if supportsV6 {
+			nft6 = newNFTablesRunner("ip6", cmd)
+		}
+		// nftables can NAT IPv6 whenever it can filter it.
+		return newUserspaceRouterAdvanced(logf, tunname, nft4, nft6, cmd, supportsV6, supportsV6)
+	}
 
 	ipt4, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
 	if err != nil {
 		return nil, err
 	}
 
-	supportsV6 := supportsV6()
+	// Some distros ship ip6tables separately from iptables.
+	_, err = exec.LookPath("ip6tables")
+	supportsV6 := err == nil && supportsV6()
 	supportsV6NAT := supportsV6 && supportsV6NAT()
 
 	var ipt6 netfilterRunner
@@ -177,19 +219,59 @@ func (r *linuxRouter) Close() error {
 	if err := r.downInterface(); err != nil {
 		return err
 	}
+	if _, err := cidrDiff("local route", r.localRoutes, nil, r.addThrowRoute, r.delThrowRoute, r.logf); err != nil {
+		return err
+	}
 	if err := r.delIPRules(); err != nil {
 		return err
 	}
+	if err := r.setSplitTunnel(nil, false); err != nil {
+		return err
+	}
 	if err := r.setNetfilterMode(NetfilterOff); err != nil {
 		return err
 	}
 
 	r.addrs = nil
 	r.routes = nil
+	r.routeMetrics = nil
+	r.localRoutes = nil
 
 	return nil
 }
 
+// Adopt implements the Adopter interface. The addresses and routes
+// of cfg are left in place, so that the host's traffic keeps going
+// through the tunnel rather than leaking onto the LAN until the first
+// Set, which then removes only those no longer wanted. Up has already
+// replaced the policy routing rules, except those for routes with
+// metrics, which are added back here.
+func (r *linuxRouter) Adopt(cfg *Config) error {
+	r.addrs = prefixSet(cfg.LocalAddrs)
+	r.routes = prefixSet(cfg.Routes)
+	r.localRoutes = prefixSet(cfg.LocalRoutes)
+	r.routeMetrics = nil
+	for cidr, metric := range cfg.RouteMetrics {
+		if metric == 0 || !r.routes[cidr] {
+			continue
+		}
+		if r.routeMetrics == nil {
+			r.routeMetrics = make(map[netaddr.IPPrefix]uint32)
+		}
+		r.routeMetrics[cidr] = metric
+	}
+	return r.setMetricRules(len(r.routeMetrics) > 0)
+}
+
+// prefixSet returns pfxs as a set, as cidrDiff takes them.
+func prefixSet(pfxs []netaddr.IPPrefix) map[netaddr.IPPrefix]bool {
+	m := make(map[netaddr.IPPrefix]bool, len(pfxs))
+	for _, p := range pfxs {
+		m[p] = true
+	}
+	return m
+}
+
 // Set implements the Router interface.
 func (r *linuxRouter) Set(cfg *Config) error {
 	var errs []error
@@ -204,12 +286,57 @@ func (r *linuxRouter) Set(cfg *Config) error {
 	if err := r.setNetfilterMode(cfg.NetfilterMode); err != nil {
 		errs = append(errs, err)
 	}
+	if err := r.setSplitTunnel(cfg.SplitTunnelApps, cfg.SplitTunnelExclude); err != nil {
+		errs = append(errs, err)
+	}
+
+	// Local routes go first, so that local subnets don't briefly
+	// go through a new default route.
+	newLocalRoutes, err := cidrDiff("local route", r.localRoutes, cfg.LocalRoutes, r.addThrowRoute, r.delThrowRoute, r.logf)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	r.localRoutes = newLocalRoutes
 
-	newRoutes, err := cidrDiff("route", r.routes, cfg.Routes, r.addRoute, r.delRoute, r.logf)
+	// tailscaled's own packets must skip routes with metrics
+	// before any are added, and until they're all gone.
+	wantMetricRules := false
+	for _, cidr := range cfg.Routes {
+		if cfg.RouteMetrics[cidr] != 0 {
+			wantMetricRules = true
+		}
+	}
+	if wantMetricRules {
+		if err := r.setMetricRules(true); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// A route whose metric changed is replaced, as the metric
+	// decides which table it's in.
+	for cidr := range r.routes {
+		if r.routeMetrics[cidr] == cfg.RouteMetrics[cidr] {
+			continue
+		}
+		if err := r.delRoute(cidr); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		delete(r.routes, cidr)
+	}
+	addRoute := func(cidr netaddr.IPPrefix) error {
+		return r.addRoute(cidr, cfg.RouteMetrics[cidr])
+	}
+	newRoutes, err := cidrDiff("route", r.routes, cfg.Routes, addRoute, r.delRoute, r.logf)
 	if err != nil {
 		errs = append(errs, err)
 	}
 	r.routes = newRoutes
+	if len(r.routeMetrics) == 0 {
+		if err := r.setMetricRules(false); err != nil {
+			errs = append(errs, err)
+		}
+	}
 
 	newAddrs, err := cidrDiff("addr", r.addrs, cfg.LocalAddrs, r.addAddress, r.delAddress, r.logf)
 	if err != nil {
@@ -426,33 +553,80 @@ func (r *linuxRouter) delLoopbackRule(addr netaddr.IP) error {
 }
 
 // addRoute adds a route for cidr, pointing to the tunnel
-// interface. Fails if the route already exists, or if adding the
-// route fails.
-func (r *linuxRouter) addRoute(cidr netaddr.IPPrefix) error {
-	args := []string{
-		"ip", "route", "add",
-		normalizeCIDR(cidr),
-		"dev", r.tunname,
+// interface, with metric if it's nonzero. Fails if the route already
+// exists, or if adding the route fails.
+func (r *linuxRouter) addRoute(cidr netaddr.IPPrefix, metric uint32) error {
+	if err := r.cmd.run(r.routeArgs("add", cidr, metric)...); err != nil {
+		return err
 	}
-	if r.ipRuleAvailable {
-		args = append(args, "table", tailscaleRouteTable)
+	if metric != 0 {
+		if r.routeMetrics == nil {
+			r.routeMetrics = make(map[netaddr.IPPrefix]uint32)
+		}
+		r.routeMetrics[cidr] = metric
 	}
-	return r.cmd.run(args...)
+	return nil
 }
 
 // delRoute removes the route for cidr pointing to the tunnel
 // interface. Fails if the route doesn't exist, or if removing the
 // route fails.
 func (r *linuxRouter) delRoute(cidr netaddr.IPPrefix) error {
+	if err := r.cmd.run(r.routeArgs("del", cidr, r.routeMetrics[cidr])...); err != nil {
+		return err
+	}
+	delete(r.routeMetrics, cidr)
+	return nil
+}
+
+// routeArgs returns the command that does op, "add" or "del", to the
+// route for cidr pointing to the tunnel interface. A route with a
+// metric is in the main table, where the kernel compares it to other
+// routes to cidr, and which setMetricRules keeps tailscaled's own
+// packets from using; others are in the Tailscale table, if there's
+// policy routing, which takes precedence over all of them.
+func (r *linuxRouter) routeArgs(op string, cidr netaddr.IPPrefix, metric uint32) []string {
 	args := []string{
-		"ip", "route", "del",
+		"ip", "route", op,
 		normalizeCIDR(cidr),
 		"dev", r.tunname,
 	}
-	if r.ipRuleAvailable {
+	switch {
+	case metric != 0:
+		args = append(args, "metric", strconv.FormatUint(uint64(metric), 10))
+	case r.ipRuleAvailable:
 		args = append(args, "table", tailscaleRouteTable)
 	}
-	return r.cmd.run(args...)
+	return args
+}
+
+// addThrowRoute adds a throw route for cidr to the Tailscale routing
+// table, which makes lookups of cidr's addresses skip it and go on to
+// the main table. Without policy routing, Tailscale's routes are in
+// the main table, where the on-link route to cidr is already more
+// specific, so there's nothing to do.
+func (r *linuxRouter) addThrowRoute(cidr netaddr.IPPrefix) error {
+	if !r.ipRuleAvailable {
+		return nil
+	}
+	return r.cmd.run(
+		"ip", "route", "add",
+		"throw", normalizeCIDR(cidr),
+		"table", tailscaleRouteTable,
+	)
+}
+
+// delThrowRoute removes the throw route for cidr added by
+// addThrowRoute.
+func (r *linuxRouter) delThrowRoute(cidr netaddr.IPPrefix) error {
+	if !r.ipRuleAvailable {
+		return nil
+	}
+	return r.cmd.run(
+		"ip", "route", "del",
+		"throw", normalizeCIDR(cidr),
+		"table", tailscaleRouteTable,
+	)
 }
 
 // upInterface brings up the tunnel interface.
@@ -546,6 +720,60 @@ func (r *linuxRouter) addIPRules() error {
 	return rg.ErrAcc
 }
 
+// metricRuleArgs returns the policy routing rules that setMetricRules
+// adds for each IP family, without their leading "ip rule add".
+func metricRuleArgs() [][]string {
+	return [][]string{
+		{"pref", tailscaleRouteTable + "02", "fwmark", tailscaleBypassMark, "table", "main", "suppress_ifgroup", tailscaleIfGroup},
+		{"pref", tailscaleRouteTable + "04", "fwmark", tailscaleBypassMark, "table", "default"},
+		{"pref", tailscaleRouteTable + "06", "fwmark", tailscaleBypassMark, "type", "unreachable"},
+	}
+}
+
+// setMetricRules adds or removes the policy routing rules needed while
+// routes with metrics are in the main table. tailscaled's own packets
+// look up the main table first, where they'd take those routes into
+// the tunnel and loop. These rules, ahead of the usual ones, have them
+// skip routes through the tunnel, by its interface group, and
+// otherwise do the same as the usual ones.
+func (r *linuxRouter) setMetricRules(on bool) error {
+	if !r.ipRuleAvailable || on == r.metricRules {
+		return nil
+	}
+	if !on {
+		if err := r.delMetricRules(); err != nil {
+			return err
+		}
+		r.metricRules = false
+		return r.cmd.run("ip", "link", "set", "dev", r.tunname, "group", "default")
+	}
+	if err := r.cmd.run("ip", "link", "set", "dev", r.tunname, "group", tailscaleIfGroup); err != nil {
+		return err
+	}
+	rg := newRunGroup(nil, r.cmd)
+	for _, family := range r.iprouteFamilies() {
+		for _, args := range metricRuleArgs() {
+			rg.Run(append([]string{"ip", family, "rule", "add"}, args...)...)
+		}
+	}
+	if rg.ErrAcc != nil {
+		return rg.ErrAcc
+	}
+	r.metricRules = true
+	return nil
+}
+
+// delMetricRules removes the rules setMetricRules adds, if they exist.
+func (r *linuxRouter) delMetricRules() error {
+	rg := newRunGroup([]int{2, 254}, r.cmd)
+	for _, family := range r.iprouteFamilies() {
+		for _, args := range metricRuleArgs() {
+			rg.Run(append([]string{"ip", family, "rule", "del"}, args...)...)
+		}
+	}
+	return rg.ErrAcc
+}
+
 // delBypassrule removes the policy routing rules that avoid
 // tailscaled routing loops, if it exists.
 func (r *linuxRouter) delIPRules() error {
@@ -599,8 +827,14 @@ func (r *linuxRouter) delIPRules() error {
 			"table", tailscaleRouteTable,
 		)
 	}
+	if rg.ErrAcc != nil {
+		return rg.ErrAcc
+	}
 
-	return rg.ErrAcc
+	// And those for routes with metrics, which a tailscaled that
+	// didn't shut down cleanly may have left.
+	r.metricRules = false
+	return r.delMetricRules()
 }
 
 func (r *linuxRouter) netfilterFamilies() []netfilterRunner {
@@ -1037,11 +1271,6 @@ func supportsV6() bool {
 		return false
 	}
 
-	// Some distros ship ip6tables separately from iptables.
-	if _, err := exec.LookPath("ip6tables"); err != nil {
-		return false
-	}
-
 	return true
 }
 
@@ -79,6 +79,22 @@ ip route add 100.100.100.100/32 dev tailscale0 table 52
 ip route add 192.168.16.0/24 dev tailscale0 table 52` + basic,
 		},
 
+		{
+			name: "exit node with LAN access",
+			in: &Config{
+				LocalAddrs:    mustCIDRs("100.101.102.103/10"),
+				Routes:        mustCIDRs("100.100.100.100/32", "0.0.0.0/0"),
+				LocalRoutes:   mustCIDRs("192.168.1.0/24"),
+				NetfilterMode: NetfilterOff,
+			},
+			want: `
+up
+ip addr add 100.101.102.103/10 dev tailscale0
+ip route add 0.0.0.0/0 dev tailscale0 table 52
+ip route add 100.100.100.100/32 dev tailscale0 table 52
+ip route add throw 192.168.1.0/24 table 52` + basic,
+		},
+
 		{
 			name: "addr and routes and subnet routes",
 			in: &Config{
@@ -94,6 +110,37 @@ ip route add 100.100.100.100/32 dev tailscale0 table 52
 ip route add 192.168.16.0/24 dev tailscale0 table 52` + basic,
 		},
 
+		{
+			name: "addr and routes with metric",
+			in: &Config{
+				LocalAddrs:    mustCIDRs("100.101.102.103/10"),
+				Routes:        mustCIDRs("100.100.100.100/32", "192.168.16.0/24"),
+				RouteMetrics:  map[netaddr.IPPrefix]uint32{mustCIDRs("192.168.16.0/24")[0]: 500},
+				NetfilterMode: NetfilterOff,
+			},
+			want: `
+up
+group 52
+ip addr add 100.101.102.103/10 dev tailscale0
+ip route add 100.100.100.100/32 dev tailscale0 table 52
+ip route add 192.168.16.0/24 dev tailscale0 metric 500
+ip rule add -4 pref 5202 fwmark 0x80000 table main suppress_ifgroup 52
+ip rule add -4 pref 5204 fwmark 0x80000 table default
+ip rule add -4 pref 5206 fwmark 0x80000 type unreachable
+ip rule add -4 pref 5210 fwmark 0x80000 table main
+ip rule add -4 pref 5230 fwmark 0x80000 table default
+ip rule add -4 pref 5250 fwmark 0x80000 type unreachable
+ip rule add -4 pref 5270 table 52
+ip rule add -6 pref 5202 fwmark 0x80000 table main suppress_ifgroup 52
+ip rule add -6 pref 5204 fwmark 0x80000 table default
+ip rule add -6 pref 5206 fwmark 0x80000 type unreachable
+ip rule add -6 pref 5210 fwmark 0x80000 table main
+ip rule add -6 pref 5230 fwmark 0x80000 table default
+ip rule add -6 pref 5250 fwmark 0x80000 type unreachable
+ip rule add -6 pref 5270 table 52
+`,
+		},
+
 		{
 			name: "addr and routes and subnet routes with netfilter",
 			in: &Config{
@@ -274,6 +321,61 @@ v6/filter/ts-forward -i tailscale0 -j MARK --set-mark 0x40000
 v6/filter/ts-forward -m mark --mark 0x40000 -j ACCEPT
 v6/filter/ts-forward -o tailscale0 -j ACCEPT
 v6/nat/POSTROUTING -j ts-postrouting
+`,
+		},
+		{
+			name: "addr and routes with netfilter and split tunneling",
+			in: &Config{
+				LocalAddrs:      mustCIDRs("100.101.102.104/10"),
+				Routes:          mustCIDRs("100.100.100.100/32", "10.0.0.0/8"),
+				NetfilterMode:   NetfilterOn,
+				SplitTunnelApps: []string{"system.slice/backup.service"},
+			},
+			want: `
+up
+ip addr add 100.101.102.104/10 dev tailscale0
+ip route add 10.0.0.0/8 dev tailscale0 table 52
+ip route add 100.100.100.100/32 dev tailscale0 table 52
+ip rule add -4 pref 5210 fwmark 0x80000 table main
+ip rule add -4 pref 5230 fwmark 0x80000 table default
+ip rule add -4 pref 5250 fwmark 0x80000 type unreachable
+ip rule add -4 pref 5260 fwmark 0x20000/0xff0000 table main
+ip rule add -4 pref 5265 fwmark 0x20000/0xff0000 type unreachable
+ip rule add -4 pref 5270 table 52
+ip rule add -6 pref 5210 fwmark 0x80000 table main
+ip rule add -6 pref 5230 fwmark 0x80000 table default
+ip rule add -6 pref 5250 fwmark 0x80000 type unreachable
+ip rule add -6 pref 5260 fwmark 0x20000/0xff0000 table main
+ip rule add -6 pref 5265 fwmark 0x20000/0xff0000 type unreachable
+ip rule add -6 pref 5270 table 52
+v4/filter/FORWARD -j ts-forward
+v4/filter/INPUT -j ts-input
+v4/filter/ts-forward -i tailscale0 -j MARK --set-mark 0x40000
+v4/filter/ts-forward -m mark --mark 0x40000 -j ACCEPT
+v4/filter/ts-forward -o tailscale0 -s 100.64.0.0/10 -j DROP
+v4/filter/ts-forward -o tailscale0 -j ACCEPT
+v4/filter/ts-input -i lo -s 100.101.102.104 -j ACCEPT
+v4/filter/ts-input ! -i tailscale0 -s 100.115.92.0/23 -j RETURN
+v4/filter/ts-input ! -i tailscale0 -s 100.64.0.0/10 -j DROP
+v4/mangle/OUTPUT -j ts-apps
+v4/mangle/ts-apps -m mark --mark 0x80000/0xff0000 -j RETURN
+v4/mangle/ts-apps -m conntrack --ctdir REPLY -j RETURN
+v4/mangle/ts-apps -m cgroup --path system.slice/backup.service -j RETURN
+v4/mangle/ts-apps -j MARK --set-mark 0x20000/0xff0000
+v4/nat/POSTROUTING -j ts-postrouting
+v4/nat/POSTROUTING -m mark --mark 0x20000/0xff0000 ! -o tailscale0 -j MASQUERADE
+v6/filter/FORWARD -j ts-forward
+v6/filter/INPUT -j ts-input
+v6/filter/ts-forward -i tailscale0 -j MARK --set-mark 0x40000
+v6/filter/ts-forward -m mark --mark 0x40000 -j ACCEPT
+v6/filter/ts-forward -o tailscale0 -j ACCEPT
+v6/mangle/OUTPUT -j ts-apps
+v6/mangle/ts-apps -m mark --mark 0x80000/0xff0000 -j RETURN
+v6/mangle/ts-apps -m conntrack --ctdir REPLY -j RETURN
+v6/mangle/ts-apps -m cgroup --path system.slice/backup.service -j RETURN
+v6/mangle/ts-apps -j MARK --set-mark 0x20000/0xff0000
+v6/nat/POSTROUTING -j ts-postrouting
+v6/nat/POSTROUTING -m mark --mark 0x20000/0xff0000 ! -o tailscale0 -j MASQUERADE
 `,
 		},
 	}
@@ -313,6 +415,66 @@ v6/nat/POSTROUTING -j ts-postrouting
 	}
 }
 
+func TestRouterAdopt(t *testing.T) {
+	fake := NewFakeOS(t)
+	newRouter := func() Router {
+		t.Helper()
+		r, err := newUserspaceRouterAdvanced(t.Logf, "tailscale0", fake.netfilter4, fake.netfilter6, fake, true, true)
+		if err != nil {
+			t.Fatalf("failed to create router: %v", err)
+		}
+		if err := r.Up(); err != nil {
+			t.Fatalf("failed to up router: %v", err)
+		}
+		return r
+	}
+	old := &Config{
+		LocalAddrs:    mustCIDRs("100.101.102.103/10"),
+		Routes:        mustCIDRs("100.100.100.100/32", "192.168.16.0/24"),
+		NetfilterMode: NetfilterOff,
+	}
+	if err := newRouter().Set(old); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new router for the same interface, as after an upgrade,
+	// leaves the old one's routes alone and changes only what
+	// differs. The fake fails on adding an existing route.
+	r := newRouter()
+	if err := r.(Adopter).Adopt(old); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.String(); !strings.Contains(got, "ip route add 192.168.16.0/24 dev tailscale0 table 52") {
+		t.Fatalf("route removed by Adopt:\n%s", got)
+	}
+	err := r.Set(&Config{
+		LocalAddrs:    mustCIDRs("100.101.102.103/10"),
+		Routes:        mustCIDRs("100.100.100.100/32", "10.0.0.0/8"),
+		NetfilterMode: NetfilterOff,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := fake.String()
+	want := strings.TrimSpace(`
+up
+ip addr add 100.101.102.103/10 dev tailscale0
+ip route add 10.0.0.0/8 dev tailscale0 table 52
+ip route add 100.100.100.100/32 dev tailscale0 table 52
+ip rule add -4 pref 5210 fwmark 0x80000 table main
+ip rule add -4 pref 5230 fwmark 0x80000 table default
+ip rule add -4 pref 5250 fwmark 0x80000 type unreachable
+ip rule add -4 pref 5270 table 52
+ip rule add -6 pref 5210 fwmark 0x80000 table main
+ip rule add -6 pref 5230 fwmark 0x80000 table default
+ip rule add -6 pref 5250 fwmark 0x80000 type unreachable
+ip rule add -6 pref 5270 table 52
+`)
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Fatalf("unexpected OS state (-got+want):\n%s", diff)
+	}
+}
+
 type fakeNetfilter struct {
 	t *testing.T
 	n map[string][]string
@@ -325,6 +487,7 @@ func newNetfilter(t *testing.T) *fakeNetfilter {
 			"filter/INPUT":    nil,
 			"filter/OUTPUT":   nil,
 			"filter/FORWARD":  nil,
+			"mangle/OUTPUT":   nil,
 			"nat/PREROUTING":  nil,
 			"nat/OUTPUT":      nil,
 			"nat/POSTROUTING": nil,
@@ -429,6 +592,7 @@ func (n *fakeNetfilter) DeleteChain(table, chain string) error {
 type fakeOS struct {
 	t          *testing.T
 	up         bool
+	group      string
 	ips        []string
 	routes     []string
 	rules      []string
@@ -453,6 +617,9 @@ func (o *fakeOS) String() string {
 	} else {
 		b.WriteString("down\n")
 	}
+	if o.group != "" {
+		fmt.Fprintf(&b, "group %s\n", o.group)
+	}
 
 	for _, ip := range o.ips {
 		fmt.Fprintf(&b, "ip addr add %s\n", ip)
@@ -524,7 +691,13 @@ func (o *fakeOS) run(args ...string) error {
 			o.up = true
 		case "set dev tailscale0 down":
 			o.up = false
+		case "set dev tailscale0 group default":
+			o.group = ""
 		default:
+			if strings.HasPrefix(got, "set dev tailscale0 group ") {
+				o.group = strings.TrimPrefix(got, "set dev tailscale0 group ")
+				return nil
+			}
 			return unexpected()
 		}
 		return nil
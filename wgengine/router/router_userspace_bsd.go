@@ -2,7 +2,7 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// +build darwin freebsd
+// +build darwin
 
 package router
 
@@ -10,7 +10,9 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os/exec"
+	"strings"
 
 	"github.com/tailscale/wireguard-go/device"
 	"github.com/tailscale/wireguard-go/tun"
@@ -24,7 +26,7 @@ type userspaceBSDRouter struct {
 	logf    logger.Logf
 	tunname string
 	local   netaddr.IPPrefix
-	routes  map[netaddr.IPPrefix]struct{}
+	routes  map[netaddr.IPPrefix]bsdRoute
 
 	dns *dns.Manager
 }
@@ -47,6 +49,52 @@ func newUserspaceBSDRouter(logf logger.Logf, _ *device.Device, tundev tun.Device
 	}, nil
 }
 
+// bsdRoute is the state of a route added by userspaceBSDRouter.
+type bsdRoute struct {
+	metric bool // the Config gave it a metric
+	scoped bool // added with -ifscope, as another interface routes its subnet
+}
+
+// bsdPrefixString returns route in the form route(8) takes.
+func bsdPrefixString(route netaddr.IPPrefix) string {
+	ipNet := route.IPNet()
+	return fmt.Sprintf("%v/%d", ipNet.IP.Mask(ipNet.Mask), route.Bits)
+}
+
+// otherRouteIface returns the interface of the route to exactly the
+// subnet route, if there's one on an interface other than the
+// tunnel's.
+func (r *userspaceBSDRouter) otherRouteIface(route netaddr.IPPrefix) (iface string, ok bool) {
+	out, err := cmd("route", "-n", "get", "-inet", bsdPrefixString(route)).Output()
+	if err != nil {
+		return "", false
+	}
+	ipNet := route.IPNet()
+	dst, mask := "", "255.255.255.255" // route(8) omits a host route's mask
+	for _, line := range strings.Split(string(out), "\n") {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		v := strings.TrimSpace(line[i+1:])
+		switch strings.TrimSpace(line[:i]) {
+		case "destination":
+			dst = v
+		case "mask":
+			mask = v
+		case "interface":
+			iface = v
+		}
+	}
+	if dst != ipNet.IP.Mask(ipNet.Mask).String() || mask != net.IP(ipNet.Mask).String() {
+		return "", false
+	}
+	if iface == "" || iface == r.tunname {
+		return "", false
+	}
+	return iface, true
+}
+
 func cmd(args ...string) *exec.Cmd {
 	if len(args) == 0 {
 		log.Fatalf("exec.Cmd(%#v) invalid; need argv[0]", args)
@@ -72,7 +120,7 @@ func (r *userspaceBSDRouter) Set(cfg *Config) error {
 	}
 	// TODO: support configuring multiple local addrs on interface.
 	if len(cfg.LocalAddrs) != 1 {
-		return errors.New("freebsd doesn't support setting multiple local addrs yet")
+		return errors.New("macOS doesn't support setting multiple local addrs yet")
 	}
 	localAddr := cfg.LocalAddrs[0]
 
@@ -105,47 +153,65 @@ func (r *userspaceBSDRouter) Set(cfg *Config) error {
 		}
 	}
 
-	newRoutes := make(map[netaddr.IPPrefix]struct{})
+	// macOS has no route metrics, and only uses the first route
+	// added to a subnet; a route added scoped to the tunnel
+	// interface doesn't displace another. So a route with a metric
+	// yields, as if its metric were higher, to another interface's
+	// route to the same subnet, if there is one; others are added as
+	// usual, and win over routes added later.
+	newRoutes := make(map[netaddr.IPPrefix]bsdRoute)
 	for _, route := range cfg.Routes {
-		newRoutes[route] = struct{}{}
-	}
-	// Delete any pre-existing routes.
-	for route := range r.routes {
-		if _, keep := newRoutes[route]; !keep {
-			net := route.IPNet()
-			nip := net.IP.Mask(net.Mask)
-			nstr := fmt.Sprintf("%v/%d", nip, route.Bits)
-			del := "del"
-			if version.OS() == "macOS" {
-				del = "delete"
-			}
-			routedel := []string{"route", "-q", "-n",
-				del, "-inet", nstr,
-				"-iface", r.tunname}
-			out, err := cmd(routedel...).CombinedOutput()
-			if err != nil {
-				r.logf("route del failed: %v: %v\n%s", routedel, err, out)
-				if errq == nil {
-					errq = err
-				}
+		newRoutes[route] = bsdRoute{metric: cfg.RouteMetrics[route] != 0}
+	}
+	// Delete any pre-existing routes, and those whose metric came or
+	// went, to add them afresh.
+	for route, old := range r.routes {
+		if nr, keep := newRoutes[route]; keep && nr.metric == old.metric {
+			continue
+		}
+		del := "del"
+		if version.OS() == "macOS" {
+			del = "delete"
+		}
+		routedel := []string{"route", "-q", "-n",
+			del, "-inet", bsdPrefixString(route),
+			"-iface", r.tunname}
+		if old.scoped {
+			routedel = append(routedel, "-ifscope", r.tunname)
+		}
+		out, err := cmd(routedel...).CombinedOutput()
+		if err != nil {
+			r.logf("route del failed: %v: %v\n%s", routedel, err, out)
+			if errq == nil {
+				errq = err
 			}
 		}
+		delete(r.routes, route)
 	}
 	// Add the routes.
-	for route := range newRoutes {
-		if _, exists := r.routes[route]; !exists {
-			net := route.IPNet()
-			nip := net.IP.Mask(net.Mask)
-			nstr := fmt.Sprintf("%v/%d", nip, route.Bits)
-			routeadd := []string{"route", "-q", "-n",
-				"add", "-inet", nstr,
-				"-iface", r.tunname}
-			out, err := cmd(routeadd...).CombinedOutput()
-			if err != nil {
-				r.logf("addr add failed: %v: %v\n%s", routeadd, err, out)
-				if errq == nil {
-					errq = err
-				}
+	for route, nr := range newRoutes {
+		if old, exists := r.routes[route]; exists {
+			newRoutes[route] = old
+			continue
+		}
+		if nr.metric {
+			if iface, ok := r.otherRouteIface(route); ok {
+				r.logf("route %v has a metric and %s already routes it; scoping ours to %s", route, iface, r.tunname)
+				nr.scoped = true
+				newRoutes[route] = nr
+			}
+		}
+		routeadd := []string{"route", "-q", "-n",
+			"add", "-inet", bsdPrefixString(route),
+			"-iface", r.tunname}
+		if nr.scoped {
+			routeadd = append(routeadd, "-ifscope", r.tunname)
+		}
+		out, err := cmd(routeadd...).CombinedOutput()
+		if err != nil {
+			r.logf("addr add failed: %v: %v\n%s", routeadd, err, out)
+			if errq == nil {
+				errq = err
 			}
 		}
 	}
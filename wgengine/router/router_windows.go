@@ -17,6 +17,7 @@ import (
 	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/router/dns"
 )
 
@@ -28,6 +29,7 @@ type winRouter struct {
 	routeChangeCallback *winipcfg.RouteChangeCallback
 	dns                 *dns.Manager
 	firewall            *firewallTweaker
+	wfp                 *wfpFirewall // or nil if WFP is unavailable
 }
 
 func newUserspaceRouter(logf logger.Logf, wgdev *device.Device, tundev tun.Device) (Router, error) {
@@ -48,6 +50,12 @@ func newUserspaceRouter(logf logger.Logf, wgdev *device.Device, tundev tun.Devic
 		InterfaceName: guid.String(),
 	}
 
+	wfp, err := newWFPFirewall(logf, uint64(luid))
+	if err != nil {
+		logf("WFP unavailable, falling back to netsh firewall rules: %v", err)
+		wfp = nil
+	}
+
 	return &winRouter{
 		logf:      logf,
 		wgdev:     wgdev,
@@ -55,6 +63,7 @@ func newUserspaceRouter(logf logger.Logf, wgdev *device.Device, tundev tun.Devic
 		nativeTun: nativeTun,
 		dns:       dns.NewManager(mconfig),
 		firewall:  &firewallTweaker{logf: logger.WithPrefix(logf, "firewall: ")},
+		wfp:       wfp,
 	}, nil
 }
 
@@ -77,9 +86,12 @@ func (r *winRouter) Set(cfg *Config) error {
 		cfg = &shutdownConfig
 	}
 
+	// With WFP, SetFilter's filters let the traffic in instead.
 	var localAddrs []string
-	for _, la := range cfg.LocalAddrs {
-		localAddrs = append(localAddrs, la.String())
+	if r.wfp == nil {
+		for _, la := range cfg.LocalAddrs {
+			localAddrs = append(localAddrs, la.String())
+		}
 	}
 	r.firewall.set(localAddrs)
 
@@ -93,11 +105,48 @@ func (r *winRouter) Set(cfg *Config) error {
 		return fmt.Errorf("dns set: %w", err)
 	}
 
+	if r.wfp == nil {
+		if len(cfg.SplitTunnelApps) > 0 {
+			return errNoWFP
+		}
+		return nil
+	}
+	apps := cfg.SplitTunnelApps
+	var routeErr error
+	if len(apps) > 0 {
+		if routeErr = splitTunnelRouteError(cfg.Routes); routeErr != nil {
+			apps = nil
+		}
+	}
+	if err := r.wfp.setApps(apps, cfg.SplitTunnelExclude); err != nil {
+		return fmt.Errorf("split tunneling: %w", err)
+	}
+	if routeErr != nil {
+		return fmt.Errorf("split tunneling: %w", routeErr)
+	}
+
 	return nil
 }
 
+// SetFilter implements FilterSetter.
+func (r *winRouter) SetFilter(f *filter.Filter) {
+	if r.wfp == nil {
+		return
+	}
+	var matches []filter.Match
+	if f != nil {
+		matches = f.Matches()
+	}
+	if err := r.wfp.set(matches); err != nil {
+		r.logf("wfp: %v", err)
+	}
+}
+
 func (r *winRouter) Close() error {
 	r.firewall.clear()
+	if r.wfp != nil {
+		r.wfp.close()
+	}
 
 	if err := r.dns.Down(); err != nil {
 		return fmt.Errorf("dns down: %w", err)
@@ -193,7 +242,11 @@ func (ft *firewallTweaker) doAsyncSet() {
 		for _, cidr := range val {
 			ft.logf("adding Tailscale-In rule to allow %v ...", cidr)
 			var d time.Duration
-			d, err = ft.runFirewall("add", "rule", "name=Tailscale-In", "dir=in", "action=allow", "localip="+cidr, "profile=private", "enable=yes")
+			// Windows may leave the Tailscale interface as an
+			// unidentified, public network if policy forbids
+			// making it private, so allow every profile. The
+			// rule only matches Tailscale's own addresses.
+			d, err = ft.runFirewall("add", "rule", "name=Tailscale-In", "dir=in", "action=allow", "localip="+cidr, "profile=any", "enable=yes")
 			if err != nil {
 				ft.logf("error adding Tailscale-In rule to allow %v: %v", cidr, err)
 				break
@@ -207,15 +260,3 @@ func (ft *firewallTweaker) doAsyncSet() {
 		ft.known = (err == nil)
 	}
 }
-
-func strsEqual(a, b []string) bool {
-	if len(a) != len(b) {
-		return false
-	}
-	for i := range a {
-		if a[i] != b[i] {
-			return false
-		}
-	}
-	return true
-}
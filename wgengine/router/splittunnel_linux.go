@@ -0,0 +1,177 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Split tunneling marks the packets of the apps kept out of Tailscale
+// in the mangle table's OUTPUT chain, by their cgroup, which reroutes
+// them; policy routing rules ahead of the one into Tailscale's table
+// then send them to the main table. They're masqueraded on the way
+// out, because the source address was picked when they were still
+// headed for the Tailscale interface.
+//
+// Packets answering connections that came in, such as over
+// Tailscale, are never marked, so that they go back the way the
+// connection came.
+
+// tailscaleAppBypassMark is the fwmark of packets from apps that
+// split tunneling keeps out of Tailscale, masked to Tailscale's mark
+// bits.
+const tailscaleAppBypassMark = "0x20000/" + tailscaleFwmarkMask
+
+// appsChain is the mangle chain that marks the packets of the apps
+// kept out of Tailscale.
+const appsChain = "ts-apps"
+
+// errSplitTunnel is returned when split tunneling is asked for but
+// netfilter is off or policy routing is unavailable.
+var errSplitTunnel = errors.New("split tunneling needs netfilter and policy routing")
+
+// setSplitTunnel routes only the traffic of apps, which are cgroup v2
+// paths, through Tailscale or, if exclude, everyone's but theirs. No
+// apps means no split tunneling.
+func (r *linuxRouter) setSplitTunnel(apps []string, exclude bool) error {
+	var err error
+	if len(apps) > 0 && (r.netfilterMode == NetfilterOff || !r.ipRuleAvailable) {
+		apps, err = nil, errSplitTunnel
+	}
+	if len(apps) == 0 {
+		exclude = false
+	}
+	if exclude == r.appsExclude && strsEqual(apps, r.apps) && (len(apps) > 0 || r.appsClean) {
+		return err
+	}
+	// This also clears out anything left behind by a previous
+	// tailscaled that didn't shut down cleanly, or by a partial
+	// failure.
+	r.delSplitTunnel()
+	r.appsClean = len(apps) == 0
+	r.apps, r.appsExclude = nil, false
+	if len(apps) == 0 {
+		return err
+	}
+	if err := r.addSplitTunnel(apps, exclude); err != nil {
+		r.delSplitTunnel()
+		r.appsClean = true
+		return fmt.Errorf("split tunneling: %w", err)
+	}
+	r.apps = append([]string(nil), apps...)
+	r.appsExclude = exclude
+	r.logf("split tunneling: %d apps (exclude=%v)", len(apps), exclude)
+	return nil
+}
+
+// splitTunnelRules returns the rules of appsChain.
+func splitTunnelRules(apps []string, exclude bool) [][]string {
+	rules := [][]string{
+		// tailscaled's own packets have their own bypass.
+		{"-m", "mark", "--mark", tailscaleBypassMark + "/" + tailscaleFwmarkMask, "-j", "RETURN"},
+		{"-m", "conntrack", "--ctdir", "REPLY", "-j", "RETURN"},
+	}
+	mark := []string{"-j", "MARK", "--set-mark", tailscaleAppBypassMark}
+	for _, app := range apps {
+		match := []string{"-m", "cgroup", "--path", app}
+		if exclude {
+			rules = append(rules, append(match, mark...))
+		} else {
+			rules = append(rules, append(match, "-j", "RETURN"))
+		}
+	}
+	if !exclude {
+		rules = append(rules, mark)
+	}
+	return rules
+}
+
+// splitTunnelMasq returns the nat POSTROUTING rule that masquerades
+// the marked packets.
+func (r *linuxRouter) splitTunnelMasq() []string {
+	return []string{"-m", "mark", "--mark", tailscaleAppBypassMark, "!", "-o", r.tunname, "-j", "MASQUERADE"}
+}
+
+// splitTunnelIPRules returns the policy routing rules, as "ip rule
+// add" arguments after the family, that route the marked packets.
+func splitTunnelIPRules() [][]string {
+	return [][]string{
+		{"pref", tailscaleRouteTable + "60", "fwmark", tailscaleAppBypassMark, "table", "main"},
+		{"pref", tailscaleRouteTable + "65", "fwmark", tailscaleAppBypassMark, "type", "unreachable"},
+	}
+}
+
+func (r *linuxRouter) addSplitTunnel(apps []string, exclude bool) error {
+	for _, ipt := range r.netfilterFamilies() {
+		err := ipt.ClearChain("mangle", appsChain)
+		if errCode(err) == 1 {
+			err = ipt.NewChain("mangle", appsChain)
+		}
+		if err != nil {
+			return fmt.Errorf("setting up mangle/%s: %w", appsChain, err)
+		}
+		for _, args := range splitTunnelRules(apps, exclude) {
+			if err := ipt.Append("mangle", appsChain, args...); err != nil {
+				return fmt.Errorf("adding %v in mangle/%s: %w", args, appsChain, err)
+			}
+		}
+		if err := ipt.Insert("mangle", "OUTPUT", 1, "-j", appsChain); err != nil {
+			return fmt.Errorf("adding -j %s in mangle/OUTPUT: %w", appsChain, err)
+		}
+	}
+	masq := r.splitTunnelMasq()
+	if err := r.ipt4.Append("nat", "POSTROUTING", masq...); err != nil {
+		return fmt.Errorf("adding %v in v4/nat/POSTROUTING: %w", masq, err)
+	}
+	if r.v6NATAvailable {
+		if err := r.ipt6.Append("nat", "POSTROUTING", masq...); err != nil {
+			return fmt.Errorf("adding %v in v6/nat/POSTROUTING: %w", masq, err)
+		}
+	}
+	rg := newRunGroup(nil, r.cmd)
+	for _, family := range r.iprouteFamilies() {
+		for _, rule := range splitTunnelIPRules() {
+			rg.Run(append([]string{"ip", family, "rule", "add"}, rule...)...)
+		}
+	}
+	return rg.ErrAcc
+}
+
+// delSplitTunnel removes what addSplitTunnel added, as far as it
+// exists.
+func (r *linuxRouter) delSplitTunnel() {
+	note := func(err error) {
+		if err != nil {
+			r.logf("note: split tunneling: %v", err)
+		}
+	}
+	for _, ipt := range r.netfilterFamilies() {
+		if ok, _ := ipt.Exists("mangle", "OUTPUT", "-j", appsChain); ok {
+			note(ipt.Delete("mangle", "OUTPUT", "-j", appsChain))
+		}
+		if err := ipt.ClearChain("mangle", appsChain); err == nil {
+			note(ipt.DeleteChain("mangle", appsChain))
+		}
+	}
+	masq := r.splitTunnelMasq()
+	if ok, _ := r.ipt4.Exists("nat", "POSTROUTING", masq...); ok {
+		note(r.ipt4.Delete("nat", "POSTROUTING", masq...))
+	}
+	if r.v6NATAvailable {
+		if ok, _ := r.ipt6.Exists("nat", "POSTROUTING", masq...); ok {
+			note(r.ipt6.Delete("nat", "POSTROUTING", masq...))
+		}
+	}
+	if r.ipRuleAvailable {
+		rg := newRunGroup([]int{2, 254}, r.cmd)
+		for _, family := range r.iprouteFamilies() {
+			for _, rule := range splitTunnelIPRules() {
+				rg.Run(append([]string{"ip", family, "rule", "del"}, rule...)...)
+			}
+		}
+		note(rg.ErrAcc)
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"inet.af/netaddr"
+	"tailscale.com/net/tsaddr"
+)
+
+// Split tunneling on Windows adds WFP filters that block the apps
+// kept out of Tailscale from connecting over the Tailscale interface,
+// by their executables' app IDs. WFP can't reroute their traffic
+// around Tailscale, as policy routing does on Linux, so split
+// tunneling is only allowed while Tailscale routes nothing but its
+// own addresses, which have no other route to take anyway. With an
+// exit node or subnet routes, the apps' traffic to those would fail
+// rather than go around Tailscale, so that's refused.
+
+var (
+	procFwpmGetAppIdFromFileName0 = fwpuclnt.NewProc("FwpmGetAppIdFromFileName0")
+	procFwpmFreeMemory0           = fwpuclnt.NewProc("FwpmFreeMemory0")
+)
+
+const (
+	fwpActionBlock = 0x1001 // FWP_ACTION_BLOCK
+	fwpByteBlobPtr = 12     // FWP_BYTE_BLOB_TYPE
+)
+
+var (
+	layerALEAuthConnectV4 = windows.GUID{Data1: 0xc38d57d1, Data2: 0x05a7, Data3: 0x4c33, Data4: [8]byte{0x90, 0x4f, 0x7f, 0xbc, 0xee, 0xe6, 0x0e, 0x82}}
+	layerALEAuthConnectV6 = windows.GUID{Data1: 0x4a72393b, Data2: 0x319f, Data3: 0x44bc, Data4: [8]byte{0x84, 0xc3, 0xba, 0x54, 0xdc, 0xb3, 0xb6, 0xb4}}
+
+	conditionALEAppID = windows.GUID{Data1: 0xd78e1e87, Data2: 0x8644, Data3: 0x4ea5, Data4: [8]byte{0x94, 0x37, 0xd8, 0x09, 0xec, 0xef, 0xc9, 0x71}}
+)
+
+// errNoWFP is returned when split tunneling is asked for without WFP.
+var errNoWFP = errors.New("split tunneling needs the Windows Filtering Platform, which is unavailable")
+
+// splitTunnelRouteError returns an error if routes include any to
+// addresses outside Tailscale's own, which split tunneling can't
+// route around Tailscale.
+func splitTunnelRouteError(routes []netaddr.IPPrefix) error {
+	own := []netaddr.IPPrefix{tsaddr.CGNATRange(), tsaddr.TailscaleULARange()}
+outer:
+	for _, r := range routes {
+		for _, p := range own {
+			if p.IP.Is4() == r.IP.Is4() && p.Bits <= r.Bits && p.Contains(r.IP) {
+				continue outer
+			}
+		}
+		return fmt.Errorf("route %v leaves Tailscale's own addresses, and Windows can't route apps around Tailscale; use split tunneling without an exit node or subnet routes", r)
+	}
+	return nil
+}
+
+// setApps replaces the split tunneling filters with ones that let
+// only apps, which are paths to executables, connect over the
+// Tailscale interface or, if exclude, everyone but them. No apps
+// means no split tunneling.
+func (w *wfpFirewall) setApps(apps []string, exclude bool) error {
+	if len(apps) == 0 {
+		exclude = false
+	}
+	sig := fmt.Sprint(apps, exclude)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.engine == 0 {
+		return nil
+	}
+	if sig == w.lastAppsSig {
+		return nil
+	}
+
+	var appIDs []*fwpByteBlob
+	defer func() {
+		for _, id := range appIDs {
+			procFwpmFreeMemory0.Call(uintptr(unsafe.Pointer(&id)))
+		}
+	}()
+	for _, app := range apps {
+		name, err := windows.UTF16PtrFromString(app)
+		if err != nil {
+			return err
+		}
+		var id *fwpByteBlob
+		if err := fwpmCall(procFwpmGetAppIdFromFileName0, uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(&id))); err != nil {
+			return fmt.Errorf("app %q: %w", app, err)
+		}
+		appIDs = append(appIDs, id)
+	}
+
+	if err := fwpmCall(procFwpmTransactionBegin0, uintptr(w.engine), 0); err != nil {
+		return err
+	}
+	ids, err := w.replaceAppFilters(appIDs, exclude)
+	if err != nil {
+		procFwpmTransactionAbort0.Call(uintptr(w.engine))
+		return err
+	}
+	if err := fwpmCall(procFwpmTransactionCommit0, uintptr(w.engine)); err != nil {
+		return err
+	}
+	w.appIDs = ids
+	w.lastAppsSig = sig
+	if len(apps) > 0 {
+		w.logf("split tunneling: %d apps (exclude=%v)", len(apps), exclude)
+	}
+	return nil
+}
+
+// replaceAppFilters deletes w's split tunneling filters and adds ones
+// for appIDs, within a transaction, returning the new filters' IDs.
+//
+// w.mu must be held.
+func (w *wfpFirewall) replaceAppFilters(appIDs []*fwpByteBlob, exclude bool) ([]uint64, error) {
+	for _, id := range w.appIDs {
+		args := append([]uintptr{uintptr(w.engine)}, filterIDArgs(id)...)
+		if err := fwpmCall(procFwpmFilterDeleteById0, args...); err != nil {
+			return nil, err
+		}
+	}
+	if len(appIDs) == 0 {
+		return nil, nil
+	}
+	name, err := windows.UTF16PtrFromString("Tailscale split tunneling")
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for _, layer := range []windows.GUID{layerALEAuthConnectV4, layerALEAuthConnectV6} {
+		add := func(action uint32, weight uintptr, appIDs []*fwpByteBlob) error {
+			id, err := w.addAppFilter(name, layer, action, weight, appIDs)
+			if err != nil {
+				return fmt.Errorf("adding split tunneling filter: %w", err)
+			}
+			ids = append(ids, id)
+			return nil
+		}
+		if exclude {
+			if err := add(fwpActionBlock, 15, appIDs); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// Block everyone, but permit the apps at a higher weight.
+		if err := add(fwpActionBlock, 1, nil); err != nil {
+			return nil, err
+		}
+		if err := add(fwpActionPermit, 15, appIDs); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// addAppFilter adds a filter in layer that applies action, at weight,
+// to the connections over the Tailscale interface of the apps with
+// appIDs, or of all apps if there are none, and returns its ID.
+func (w *wfpFirewall) addAppFilter(name *uint16, layer windows.GUID, action uint32, weight uintptr, appIDs []*fwpByteBlob) (uint64, error) {
+	luid := w.luid
+	conds := []fwpmFilterCondition0{{
+		fieldKey:  conditionIPLocalInterface,
+		matchType: fwpMatchEqual,
+		value:     fwpValue0{typ: fwpUint64, value: uintptr(unsafe.Pointer(&luid))},
+	}}
+	// Conditions on the same field are ORed together.
+	for _, id := range appIDs {
+		conds = append(conds, fwpmFilterCondition0{fieldKey: conditionALEAppID, matchType: fwpMatchEqual, value: fwpValue0{typ: fwpByteBlobPtr, value: uintptr(unsafe.Pointer(id))}})
+	}
+	f := fwpmFilter0{
+		displayData:         fwpmDisplayData0{name: name},
+		flags:               fwpmFilterFlagClearActionRight,
+		layerKey:            layer,
+		subLayerKey:         wfpSublayerKey,
+		weight:              fwpValue0{typ: fwpUint8, value: weight},
+		numFilterConditions: uint32(len(conds)),
+		filterCondition:     &conds[0],
+		action:              fwpmAction0{typ: action},
+	}
+	var id uint64
+	err := fwpmCall(procFwpmFilterAdd0, uintptr(w.engine), uintptr(unsafe.Pointer(&f)), 0, uintptr(unsafe.Pointer(&id)))
+	runtime.KeepAlive(&luid)
+	return id, err
+}
@@ -0,0 +1,392 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"inet.af/netaddr"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/filter"
+)
+
+// This file programs the Windows Filtering Platform (WFP), which
+// the Windows firewall and most third-party ones are built on, so
+// that traffic the Tailscale packet filter accepts isn't then
+// silently blocked by a firewall policy. Corporate policies often
+// block inbound connections on networks Windows can't identify,
+// which includes the Tailscale interface.
+//
+// For each rule of the packet filter, wfpFirewall adds a filter that
+// permits matching inbound connections on the Tailscale interface.
+// The filters live in a sublayer of the highest weight and clear the
+// action right, which keeps lower-weight sublayers, such as the
+// Windows firewall's, from overriding them with a block. Anything
+// else on the interface is left to the other firewalls; the packet
+// filter has dropped it before it reaches the OS anyway.
+//
+// The WFP session is dynamic, so its filters go away when tailscaled
+// exits, however it exits.
+
+var (
+	fwpuclnt                   = windows.NewLazySystemDLL("fwpuclnt.dll")
+	procFwpmEngineOpen0        = fwpuclnt.NewProc("FwpmEngineOpen0")
+	procFwpmEngineClose0       = fwpuclnt.NewProc("FwpmEngineClose0")
+	procFwpmSubLayerAdd0       = fwpuclnt.NewProc("FwpmSubLayerAdd0")
+	procFwpmFilterAdd0         = fwpuclnt.NewProc("FwpmFilterAdd0")
+	procFwpmFilterDeleteById0  = fwpuclnt.NewProc("FwpmFilterDeleteById0")
+	procFwpmTransactionBegin0  = fwpuclnt.NewProc("FwpmTransactionBegin0")
+	procFwpmTransactionCommit0 = fwpuclnt.NewProc("FwpmTransactionCommit0")
+	procFwpmTransactionAbort0  = fwpuclnt.NewProc("FwpmTransactionAbort0")
+)
+
+const (
+	rpcCAuthnWinNT = 10 // RPC_C_AUTHN_WINNT
+
+	fwpmSessionFlagDynamic         = 0x1 // FWPM_SESSION_FLAG_DYNAMIC
+	fwpmFilterFlagClearActionRight = 0x8 // FWPM_FILTER_FLAG_CLEAR_ACTION_RIGHT
+
+	fwpActionPermit = 0x1002 // FWP_ACTION_PERMIT
+
+	// FWP_MATCH_TYPE values.
+	fwpMatchEqual = 0
+	fwpMatchRange = 5
+
+	// FWP_DATA_TYPE values.
+	fwpUint8      = 1
+	fwpUint16     = 2
+	fwpUint64     = 4
+	fwpV4AddrMask = 0x100
+	fwpV6AddrMask = 0x101
+	fwpRangeType  = 0x102
+
+	ipprotoTCP = 6
+	ipprotoUDP = 17
+)
+
+var (
+	// wfpSublayerKey identifies Tailscale's WFP sublayer.
+	wfpSublayerKey = windows.GUID{Data1: 0x7e3b1c52, Data2: 0x2a4f, Data3: 0x4d6e, Data4: [8]byte{0x9b, 0x1e, 0x54, 0x53, 0x52, 0x0a, 0x3c, 0x11}}
+
+	layerALEAuthRecvAcceptV4 = windows.GUID{Data1: 0xe1cd9fe7, Data2: 0xf4b5, Data3: 0x4273, Data4: [8]byte{0x96, 0xc0, 0x59, 0x2e, 0x48, 0x7b, 0x86, 0x50}}
+	layerALEAuthRecvAcceptV6 = windows.GUID{Data1: 0xa3b42c97, Data2: 0x9f04, Data3: 0x4672, Data4: [8]byte{0xb8, 0x7e, 0xce, 0xe9, 0xc4, 0x83, 0x25, 0x7f}}
+
+	conditionIPLocalInterface = windows.GUID{Data1: 0x4cd62a49, Data2: 0x59c3, Data3: 0x4969, Data4: [8]byte{0xb7, 0xf3, 0xbd, 0xa5, 0xd3, 0x28, 0x90, 0xa4}}
+	conditionIPRemoteAddress  = windows.GUID{Data1: 0xb235ae9a, Data2: 0x1d64, Data3: 0x49b8, Data4: [8]byte{0xa4, 0x4c, 0x5f, 0xf3, 0xd9, 0x09, 0x50, 0x45}}
+	conditionIPLocalAddress   = windows.GUID{Data1: 0xd9ee00de, Data2: 0xc1ef, Data3: 0x4617, Data4: [8]byte{0xbf, 0xe3, 0xff, 0xd8, 0xf5, 0xa0, 0x89, 0x57}}
+	conditionIPLocalPort      = windows.GUID{Data1: 0x0c1ba1af, Data2: 0x5765, Data3: 0x453f, Data4: [8]byte{0xaf, 0x22, 0xa8, 0xf7, 0x91, 0xac, 0x77, 0x5b}}
+	conditionIPProtocol       = windows.GUID{Data1: 0x3971ef2b, Data2: 0x623e, Data3: 0x4f9a, Data4: [8]byte{0x8c, 0xb1, 0x6e, 0x79, 0xb8, 0x06, 0xb9, 0xa7}}
+)
+
+// FWPM_DISPLAY_DATA0
+type fwpmDisplayData0 struct {
+	name        *uint16
+	description *uint16
+}
+
+// FWPM_SESSION0
+type fwpmSession0 struct {
+	sessionKey           windows.GUID
+	displayData          fwpmDisplayData0
+	flags                uint32
+	txnWaitTimeoutInMSec uint32
+	processID            uint32
+	sid                  *windows.SID
+	username             *uint16
+	kernelMode           int32
+}
+
+// FWP_BYTE_BLOB
+type fwpByteBlob struct {
+	size uint32
+	data *uint8
+}
+
+// FWPM_SUBLAYER0
+type fwpmSublayer0 struct {
+	subLayerKey  windows.GUID
+	displayData  fwpmDisplayData0
+	flags        uint32
+	providerKey  *windows.GUID
+	providerData fwpByteBlob
+	weight       uint16
+}
+
+// fwpValue0 is FWP_VALUE0 and FWP_CONDITION_VALUE0: a data type and
+// a union of scalars of up to 32 bits and pointers to anything else.
+type fwpValue0 struct {
+	typ   uint32
+	value uintptr
+}
+
+// FWPM_FILTER_CONDITION0
+type fwpmFilterCondition0 struct {
+	fieldKey  windows.GUID
+	matchType uint32
+	value     fwpValue0
+}
+
+// FWPM_ACTION0
+type fwpmAction0 struct {
+	typ        uint32
+	filterType windows.GUID
+}
+
+// FWP_V4_ADDR_AND_MASK, in host byte order.
+type fwpV4AddrAndMask struct {
+	addr uint32
+	mask uint32
+}
+
+// FWP_V6_ADDR_AND_MASK
+type fwpV6AddrAndMask struct {
+	addr         [16]byte
+	prefixLength uint8
+}
+
+// FWP_RANGE0
+type fwpRange0 struct {
+	low  fwpValue0
+	high fwpValue0
+}
+
+func fwpmCall(proc *windows.LazyProc, args ...uintptr) error {
+	r, _, _ := proc.Call(args...)
+	if r != 0 {
+		return fmt.Errorf("%s: %w", proc.Name, windows.Errno(r))
+	}
+	return nil
+}
+
+// wfpRule is the set of connections one WFP filter permits.
+type wfpRule struct {
+	v6    bool
+	srcs  []netaddr.IPPrefix // remote addresses; any if empty
+	dst   netaddr.IPPrefix   // local addresses; any if zero bits
+	ports filter.PortRange   // local TCP and UDP ports
+}
+
+// allPorts reports whether r permits all protocols, not just TCP
+// and UDP to its ports.
+func (r wfpRule) allPorts() bool {
+	return r.ports.First == 0 && r.ports.Last == 65535
+}
+
+// wfpRules returns the rules mirroring the packet filter matches.
+func wfpRules(matches []filter.Match) []wfpRule {
+	var ret []wfpRule
+	for _, v6 := range []bool{false, true} {
+		for _, m := range matches {
+			var srcs []netaddr.IPPrefix
+			all := false
+			for _, src := range m.Srcs {
+				if src.IP.Is6() != v6 {
+					continue
+				}
+				srcs = append(srcs, src)
+				all = all || src.Bits == 0
+			}
+			if len(srcs) == 0 {
+				continue
+			}
+			if all {
+				srcs = nil
+			}
+			for _, dst := range m.Dsts {
+				if dst.Net.IP.Is6() != v6 {
+					continue
+				}
+				ret = append(ret, wfpRule{v6: v6, srcs: srcs, dst: dst.Net, ports: dst.Ports})
+			}
+		}
+	}
+	return ret
+}
+
+// wfpFirewall maintains WFP filters permitting the connections the
+// packet filter accepts on one interface.
+type wfpFirewall struct {
+	logf logger.Logf
+	luid uint64 // of the Tailscale interface
+
+	mu          sync.Mutex // guards following
+	engine      windows.Handle
+	ids         []uint64 // of the current filters
+	lastSig     string   // of the current rules
+	appIDs      []uint64 // of the current split tunneling filters
+	lastAppsSig string   // of the current split tunneling apps
+}
+
+// newWFPFirewall opens a dynamic WFP session and adds Tailscale's
+// sublayer to it.
+func newWFPFirewall(logf logger.Logf, luid uint64) (*wfpFirewall, error) {
+	name, err := windows.UTF16PtrFromString("Tailscale")
+	if err != nil {
+		return nil, err
+	}
+	session := fwpmSession0{
+		displayData: fwpmDisplayData0{name: name},
+		flags:       fwpmSessionFlagDynamic,
+	}
+	var engine windows.Handle
+	if err := fwpmCall(procFwpmEngineOpen0, 0, rpcCAuthnWinNT, 0, uintptr(unsafe.Pointer(&session)), uintptr(unsafe.Pointer(&engine))); err != nil {
+		return nil, err
+	}
+	sublayer := fwpmSublayer0{
+		subLayerKey: wfpSublayerKey,
+		displayData: fwpmDisplayData0{name: name},
+		weight:      0xffff,
+	}
+	if err := fwpmCall(procFwpmSubLayerAdd0, uintptr(engine), uintptr(unsafe.Pointer(&sublayer)), 0); err != nil {
+		procFwpmEngineClose0.Call(uintptr(engine))
+		return nil, err
+	}
+	return &wfpFirewall{
+		logf:   logger.WithPrefix(logf, "wfp: "),
+		luid:   luid,
+		engine: engine,
+	}, nil
+}
+
+// set replaces the filters with ones mirroring matches, atomically.
+func (w *wfpFirewall) set(matches []filter.Match) error {
+	rules := wfpRules(matches)
+	sig := fmt.Sprint(rules)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.engine == 0 {
+		return nil
+	}
+	if sig == w.lastSig {
+		return nil
+	}
+
+	if err := fwpmCall(procFwpmTransactionBegin0, uintptr(w.engine), 0); err != nil {
+		return err
+	}
+	ids, err := w.replaceFilters(rules)
+	if err != nil {
+		procFwpmTransactionAbort0.Call(uintptr(w.engine))
+		return err
+	}
+	if err := fwpmCall(procFwpmTransactionCommit0, uintptr(w.engine)); err != nil {
+		return err
+	}
+	w.ids = ids
+	w.lastSig = sig
+	w.logf("%d permit filters installed", len(ids))
+	return nil
+}
+
+// replaceFilters deletes w's filters and adds ones for rules, within
+// a transaction, returning the new filters' IDs.
+//
+// w.mu must be held.
+func (w *wfpFirewall) replaceFilters(rules []wfpRule) ([]uint64, error) {
+	for _, id := range w.ids {
+		args := append([]uintptr{uintptr(w.engine)}, filterIDArgs(id)...)
+		if err := fwpmCall(procFwpmFilterDeleteById0, args...); err != nil {
+			return nil, err
+		}
+	}
+	name, err := windows.UTF16PtrFromString("Tailscale packet filter")
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]uint64, 0, len(rules))
+	for _, r := range rules {
+		id, err := w.addFilter(name, r)
+		if err != nil {
+			return nil, fmt.Errorf("adding filter for %v:%v: %w", r.dst, r.ports, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// addFilter adds a filter permitting r's connections and returns its
+// ID.
+func (w *wfpFirewall) addFilter(name *uint16, r wfpRule) (uint64, error) {
+	// The conditions refer to their values by uintptr, which
+	// doesn't keep them alive; keep does until the call returns.
+	var keep []interface{}
+	addr := func(p netaddr.IPPrefix) fwpValue0 {
+		if p.IP.Is4() {
+			a := p.IP.As4()
+			v := &fwpV4AddrAndMask{addr: binary.BigEndian.Uint32(a[:]), mask: ^uint32(0) << (32 - p.Bits)}
+			keep = append(keep, v)
+			return fwpValue0{typ: fwpV4AddrMask, value: uintptr(unsafe.Pointer(v))}
+		}
+		v := &fwpV6AddrAndMask{addr: p.IP.As16(), prefixLength: p.Bits}
+		keep = append(keep, v)
+		return fwpValue0{typ: fwpV6AddrMask, value: uintptr(unsafe.Pointer(v))}
+	}
+
+	luid := w.luid
+	conds := []fwpmFilterCondition0{{
+		fieldKey:  conditionIPLocalInterface,
+		matchType: fwpMatchEqual,
+		value:     fwpValue0{typ: fwpUint64, value: uintptr(unsafe.Pointer(&luid))},
+	}}
+	// Conditions on the same field are ORed together; different
+	// fields are ANDed.
+	for _, src := range r.srcs {
+		conds = append(conds, fwpmFilterCondition0{fieldKey: conditionIPRemoteAddress, matchType: fwpMatchEqual, value: addr(src)})
+	}
+	if r.dst.Bits != 0 {
+		conds = append(conds, fwpmFilterCondition0{fieldKey: conditionIPLocalAddress, matchType: fwpMatchEqual, value: addr(r.dst)})
+	}
+	if !r.allPorts() {
+		for _, proto := range []uintptr{ipprotoTCP, ipprotoUDP} {
+			conds = append(conds, fwpmFilterCondition0{fieldKey: conditionIPProtocol, matchType: fwpMatchEqual, value: fwpValue0{typ: fwpUint8, value: proto}})
+		}
+		rng := &fwpRange0{
+			low:  fwpValue0{typ: fwpUint16, value: uintptr(r.ports.First)},
+			high: fwpValue0{typ: fwpUint16, value: uintptr(r.ports.Last)},
+		}
+		keep = append(keep, rng)
+		conds = append(conds, fwpmFilterCondition0{fieldKey: conditionIPLocalPort, matchType: fwpMatchRange, value: fwpValue0{typ: fwpRangeType, value: uintptr(unsafe.Pointer(rng))}})
+	}
+
+	f := fwpmFilter0{
+		displayData:         fwpmDisplayData0{name: name},
+		flags:               fwpmFilterFlagClearActionRight,
+		layerKey:            layerALEAuthRecvAcceptV4,
+		subLayerKey:         wfpSublayerKey,
+		weight:              fwpValue0{typ: fwpUint8, value: 15},
+		numFilterConditions: uint32(len(conds)),
+		filterCondition:     &conds[0],
+		action:              fwpmAction0{typ: fwpActionPermit},
+	}
+	if r.v6 {
+		f.layerKey = layerALEAuthRecvAcceptV6
+	}
+	var id uint64
+	err := fwpmCall(procFwpmFilterAdd0, uintptr(w.engine), uintptr(unsafe.Pointer(&f)), 0, uintptr(unsafe.Pointer(&id)))
+	runtime.KeepAlive(keep)
+	runtime.KeepAlive(&luid)
+	return id, err
+}
+
+// close closes the WFP session, which removes all its filters.
+func (w *wfpFirewall) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.engine == 0 {
+		return
+	}
+	procFwpmEngineClose0.Call(uintptr(w.engine))
+	w.engine = 0
+	w.ids = nil
+	w.lastSig = ""
+	w.appIDs = nil
+	w.lastAppsSig = ""
+}
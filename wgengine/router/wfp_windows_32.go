@@ -0,0 +1,36 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build windows
+// +build 386 arm
+
+package router
+
+import "golang.org/x/sys/windows"
+
+// FWPM_FILTER0, laid out for 32-bit Windows, where 64-bit fields are
+// 8-byte aligned unlike in Go.
+type fwpmFilter0 struct {
+	filterKey           windows.GUID
+	displayData         fwpmDisplayData0
+	flags               uint32
+	providerKey         *windows.GUID
+	providerData        fwpByteBlob
+	layerKey            windows.GUID
+	subLayerKey         windows.GUID
+	weight              fwpValue0
+	numFilterConditions uint32
+	filterCondition     *fwpmFilterCondition0
+	action              fwpmAction0
+	_                   [4]byte // the next union is 8-byte aligned
+	providerContextKey  windows.GUID
+	reserved            *windows.GUID
+	_                   [4]byte // filterID is 8-byte aligned
+	filterID            uint64
+	effectiveWeight     fwpValue0
+}
+
+// filterIDArgs returns id as syscall arguments, split into two
+// 32-bit halves.
+func filterIDArgs(id uint64) []uintptr { return []uintptr{uintptr(id), uintptr(id >> 32)} }
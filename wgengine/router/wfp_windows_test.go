@@ -0,0 +1,85 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package router
+
+import (
+	"testing"
+	"unsafe"
+
+	"inet.af/netaddr"
+	"tailscale.com/wgengine/filter"
+)
+
+func TestWFPRules(t *testing.T) {
+	pfx := func(s string) netaddr.IPPrefix {
+		p, err := netaddr.ParseIPPrefix(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	matches := []filter.Match{
+		{
+			Srcs: []netaddr.IPPrefix{pfx("100.101.102.103/32"), pfx("fd7a:115c:a1e0::1/128")},
+			Dsts: []filter.NetPortRange{
+				{Net: pfx("100.100.1.1/32"), Ports: filter.PortRange{First: 22, Last: 22}},
+				{Net: pfx("fd7a:115c:a1e0::2/128"), Ports: filter.PortRange{First: 0, Last: 65535}},
+			},
+		},
+		{
+			Srcs: []netaddr.IPPrefix{pfx("0.0.0.0/0"), pfx("10.0.0.0/8")},
+			Dsts: []filter.NetPortRange{{Net: pfx("0.0.0.0/0"), Ports: filter.PortRange{First: 80, Last: 81}}},
+		},
+		{
+			// No v4 sources, so no v4 rule for its v4 destination.
+			Srcs: []netaddr.IPPrefix{pfx("::/0")},
+			Dsts: []filter.NetPortRange{{Net: pfx("100.100.1.1/32"), Ports: filter.PortRange{First: 443, Last: 443}}},
+		},
+	}
+	rules := wfpRules(matches)
+	if len(rules) != 3 {
+		t.Fatalf("got %d rules, want 3: %+v", len(rules), rules)
+	}
+
+	if r := rules[0]; r.v6 || len(r.srcs) != 1 || r.srcs[0] != pfx("100.101.102.103/32") || r.dst != pfx("100.100.1.1/32") || r.allPorts() {
+		t.Errorf("rule 0 = %+v", r)
+	}
+	if r := rules[1]; r.v6 || r.srcs != nil || r.dst.Bits != 0 || r.ports != (filter.PortRange{First: 80, Last: 81}) {
+		t.Errorf("rule 1 = %+v; want any source", r)
+	}
+	if r := rules[2]; !r.v6 || len(r.srcs) != 1 || r.dst != pfx("fd7a:115c:a1e0::2/128") || !r.allPorts() {
+		t.Errorf("rule 2 = %+v", r)
+	}
+}
+
+func TestWFPStructSizes(t *testing.T) {
+	// Sizes from the Windows SDK headers.
+	ptr := unsafe.Sizeof(uintptr(0))
+	want := map[string]uintptr{
+		"FWPM_FILTER0":           200,
+		"FWPM_FILTER_CONDITION0": 40,
+		"FWPM_SUBLAYER0":         72,
+		"FWPM_SESSION0":          72,
+	}
+	if ptr == 4 {
+		want = map[string]uintptr{
+			"FWPM_FILTER0":           152,
+			"FWPM_FILTER_CONDITION0": 28,
+			"FWPM_SUBLAYER0":         44,
+			"FWPM_SESSION0":          48,
+		}
+	}
+	got := map[string]uintptr{
+		"FWPM_FILTER0":           unsafe.Sizeof(fwpmFilter0{}),
+		"FWPM_FILTER_CONDITION0": unsafe.Sizeof(fwpmFilterCondition0{}),
+		"FWPM_SUBLAYER0":         unsafe.Sizeof(fwpmSublayer0{}),
+		"FWPM_SESSION0":          unsafe.Sizeof(fwpmSession0{}),
+	}
+	for name, size := range want {
+		if got[name] != size {
+			t.Errorf("sizeof(%s) = %d; want %d", name, got[name], size)
+		}
+	}
+}
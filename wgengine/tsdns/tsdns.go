@@ -10,12 +10,14 @@ import (
 	"encoding/hex"
 	"errors"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	dns "golang.org/x/net/dns/dnsmessage"
 	"inet.af/netaddr"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/types/logger"
 )
 
@@ -205,6 +207,9 @@ func (r *Resolver) Resolve(domain string, tp dns.Type) (netaddr.IP, dns.RCode, e
 	}
 
 	addr, found := dnsMap.nameToIP[domain]
+	if !found {
+		addr, found = resolveVia(domain)
+	}
 	if !found {
 		return netaddr.IP{}, dns.RCodeNameError, nil
 	}
@@ -227,6 +232,32 @@ func (r *Resolver) Resolve(domain string, tp dns.Type) (netaddr.IP, dns.RCode, e
 	}
 }
 
+// resolveVia returns the 4via6 address named by the first label of
+// domain, such as "10-1-1-16-via-7" for 10.1.1.16 at site 7.
+func resolveVia(domain string) (netaddr.IP, bool) {
+	label := domain
+	if i := strings.IndexByte(label, '.'); i != -1 {
+		label = label[:i]
+	}
+	i := strings.Index(label, "-via-")
+	if i == -1 {
+		return netaddr.IP{}, false
+	}
+	site, err := strconv.ParseUint(label[i+len("-via-"):], 10, 16)
+	if err != nil {
+		return netaddr.IP{}, false
+	}
+	ip, err := netaddr.ParseIP(strings.Replace(label[:i], "-", ".", -1))
+	if err != nil || !ip.Is4() {
+		return netaddr.IP{}, false
+	}
+	via, err := tsaddr.MapVia(uint16(site), netaddr.IPPrefix{IP: ip, Bits: 32})
+	if err != nil {
+		return netaddr.IP{}, false
+	}
+	return via.IP, true
+}
+
 // ResolveReverse returns the unique domain name that maps to the given address.
 // The returned domain name is in canonical form (with a trailing period).
 func (r *Resolver) ResolveReverse(ip netaddr.IP) (string, dns.RCode, error) {
@@ -24,6 +24,14 @@ var testipv6 = netaddr.IPv6Raw([16]byte{
 	0x0c, 0x0d, 0x0e, 0x0f,
 })
 
+// testvia is the 4via6 address of 10.1.1.16 at site 7.
+var testvia = netaddr.IPv6Raw([16]byte{
+	0xfd, 0x7a, 0x11, 0x5c,
+	0xa1, 0xe0, 0x0b, 0x1a,
+	0x00, 0x00, 0x00, 0x07,
+	0x0a, 0x01, 0x01, 0x10,
+})
+
 var dnsMap = NewMap(
 	map[string]netaddr.IP{
 		"test1.ipn.dev.": testipv4,
@@ -214,6 +222,10 @@ func TestResolve(t *testing.T) {
 		{"no-ipv6", "test1.ipn.dev.", dns.TypeAAAA, netaddr.IP{}, dns.RCodeSuccess},
 		{"nxdomain", "test3.ipn.dev.", dns.TypeA, netaddr.IP{}, dns.RCodeNameError},
 		{"foreign domain", "google.com.", dns.TypeA, netaddr.IP{}, dns.RCodeRefused},
+		{"4via6", "10-1-1-16-via-7.ipn.dev.", dns.TypeAAAA, testvia, dns.RCodeSuccess},
+		{"4via6-no-ipv4", "10-1-1-16-via-7.ipn.dev.", dns.TypeA, netaddr.IP{}, dns.RCodeSuccess},
+		{"4via6-bad-site", "10-1-1-16-via-70000.ipn.dev.", dns.TypeAAAA, netaddr.IP{}, dns.RCodeNameError},
+		{"4via6-bad-ip", "10-1-1-via-7.ipn.dev.", dns.TypeAAAA, netaddr.IP{}, dns.RCodeNameError},
 	}
 
 	for _, tt := range tests {
@@ -0,0 +1,172 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"sync"
+
+	"tailscale.com/net/packet"
+	"tailscale.com/wgengine/filter"
+)
+
+// batchWriter is implemented by TUN devices that can write several
+// packets at once, such as to coalesce them; see offloadTUN.
+type batchWriter interface {
+	// WriteBatch writes the packets in pkts, each starting at
+	// offset in its buffer. It may modify the buffers, including
+	// appending to them up to their capacity.
+	WriteBatch(pkts [][]byte, offset int) error
+}
+
+// maxBatch is the most packets written to a batchWriter at once.
+const maxBatch = 64
+
+// lowMemoryMaxBatch is maxBatch for a TUN in low-memory mode; see
+// TUN.SetLowMemory.
+const lowMemoryMaxBatch = 8
+
+// batchBufPool holds the buffers packets are copied into by Write
+// until they're flushed.
+var batchBufPool = sync.Pool{New: func() interface{} { return new([maxBufferSize]byte) }}
+
+// writeBatch is the packets written to a TUN since it was last
+// flushed, for a batchWriter device.
+type writeBatch struct {
+	mu     sync.Mutex
+	max    int // flush at this many packets; at most maxBatch
+	bufs   []*[maxBufferSize]byte
+	pkts   [][]byte                 // the packets in bufs
+	srcs   [maxBatch]*filter.SrcSet // the sources each of pkts may have; see TUN.peerSrcsOf
+	parsed [maxBatch]packet.Parsed
+	qs     []*packet.Parsed // the parsed packets to filter
+	qi     []int            // the index in pkts of each of qs
+	qsrcs  []*filter.SrcSet // the sources each of qs may have
+	rs     [maxBatch]filter.Response
+	out    [][]byte
+}
+
+// SetLowMemory sets whether t holds fewer written packets before
+// flushing them, which bounds the buffers a batch takes at some cost
+// in throughput. It does nothing if the underlying device doesn't
+// batch writes.
+func (t *TUN) SetLowMemory(v bool) {
+	if t.batch == nil {
+		return
+	}
+	t.batch.mu.Lock()
+	defer t.batch.mu.Unlock()
+	if v {
+		t.batch.max = lowMemoryMaxBatch
+	} else {
+		t.batch.max = maxBatch
+	}
+}
+
+// writeBatched copies the packet at buf[offset:] into t's batch,
+// flushing the batch if it's full.
+func (t *TUN) writeBatched(buf []byte, offset int) (int, error) {
+	pkt := buf[offset:]
+	if len(pkt) > MaxPacketSize {
+		return 0, errPacketTooBig
+	}
+	b := t.batch
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.srcs[len(b.pkts)] = t.peerSrcsOf(buf, offset)
+	bb := batchBufPool.Get().(*[maxBufferSize]byte)
+	n := copy(bb[PacketStartOffset:], pkt)
+	b.bufs = append(b.bufs, bb)
+	b.pkts = append(b.pkts, bb[PacketStartOffset:PacketStartOffset+n])
+	if len(b.pkts) >= b.max {
+		if err := t.flushBatchLocked(); err != nil {
+			return 0, err
+		}
+	}
+	return len(pkt), nil
+}
+
+// flushBatch filters the packets in t's batch and writes those
+// accepted to t.tdev.
+func (t *TUN) flushBatch() error {
+	b := t.batch
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return t.flushBatchLocked()
+}
+
+// flushBatchLocked is flushBatch with t.batch.mu held. Holding it
+// while writing keeps concurrent flushes from reordering packets.
+func (t *TUN) flushBatchLocked() error {
+	b := t.batch
+	if len(b.pkts) == 0 {
+		return nil
+	}
+	defer func() {
+		for i, bb := range b.bufs {
+			batchBufPool.Put(bb)
+			b.bufs[i] = nil
+			b.pkts[i] = nil
+			b.srcs[i] = nil
+		}
+		for i := range b.out {
+			b.out[i] = nil
+		}
+		b.bufs = b.bufs[:0]
+		b.pkts = b.pkts[:0]
+	}()
+
+	b.qs, b.qi, b.qsrcs = b.qs[:0], b.qi[:0], b.qsrcs[:0]
+	for i, pkt := range b.pkts {
+		t.capture(CaptureFromPeer, pkt)
+		p := &b.parsed[i]
+		p.Decode(pkt)
+		if !t.disableFilter && t.PreFilterIn != nil && t.PreFilterIn(p, t) == filter.Drop {
+			continue
+		}
+		b.qs = append(b.qs, p)
+		b.qi = append(b.qi, i)
+		b.qsrcs = append(b.qsrcs, b.srcs[i])
+	}
+
+	rs := b.rs[:len(b.qs)]
+	filt, _ := t.filter.Load().(*filter.Filter)
+	switch {
+	case t.disableFilter:
+		for i := range rs {
+			rs[i] = filter.Accept
+		}
+	case filt == nil:
+		for i := range rs {
+			rs[i] = filter.Drop
+		}
+	default:
+		filt.RunInBatch(b.qs, b.qsrcs, t.filterFlags, rs)
+	}
+
+	b.out = b.out[:0]
+	for i, p := range b.qs {
+		if rs[i] != filter.Accept {
+			continue
+		}
+		if !t.disableFilter && t.PostFilterIn != nil && t.PostFilterIn(p, t) == filter.Drop {
+			continue
+		}
+		if !t.disableFilter {
+			t.noteConn(p)
+			t.countRoute(p, true)
+		}
+		pkt := b.pkts[b.qi[i]]
+		t.capture(CaptureFromPeerAccepted, pkt)
+		if !t.impair(pkt, false, t.InjectInboundCopy) {
+			continue
+		}
+		b.out = append(b.out, b.bufs[b.qi[i]][:PacketStartOffset+len(pkt)])
+	}
+	if len(b.out) == 0 {
+		return nil
+	}
+	t.noteActivity()
+	return t.tdev.(batchWriter).WriteBatch(b.out, PacketStartOffset)
+}
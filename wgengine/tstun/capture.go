@@ -0,0 +1,76 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import "time"
+
+// CapturePoint is where in a TUN a captured packet was seen.
+type CapturePoint uint8
+
+const (
+	// CaptureFromLocal is a packet from the host, before the
+	// outbound packet filter.
+	CaptureFromLocal CapturePoint = iota
+	// CaptureFromLocalAccepted is a packet from the host that the
+	// outbound packet filter accepted.
+	CaptureFromLocalAccepted
+	// CaptureFromPeer is a packet from a peer, before the inbound
+	// packet filter.
+	CaptureFromPeer
+	// CaptureFromPeerAccepted is a packet from a peer that the
+	// inbound packet filter accepted.
+	CaptureFromPeerAccepted
+)
+
+func (p CapturePoint) String() string {
+	switch p {
+	case CaptureFromLocal:
+		return "from local, pre-filter"
+	case CaptureFromLocalAccepted:
+		return "from local, post-filter"
+	case CaptureFromPeer:
+		return "from peer, pre-filter"
+	case CaptureFromPeerAccepted:
+		return "from peer, post-filter"
+	}
+	return "unknown"
+}
+
+// FromPeer reports whether p is on the path from peers to the host.
+func (p CapturePoint) FromPeer() bool {
+	return p == CaptureFromPeer || p == CaptureFromPeerAccepted
+}
+
+// A CaptureFunc is called with the decrypted packets passing through
+// a TUN. It must not retain pkt, and must be quick: it's called
+// inline on the packet path.
+type CaptureFunc func(where CapturePoint, when time.Time, pkt []byte)
+
+// SetCaptureHook sets the function called with every packet passing
+// through the TUN, once before and, if it's accepted, once after the
+// packet filter. A nil fn stops capturing.
+//
+// Packets injected with the Inject methods bypass the filters and
+// aren't captured, except by InjectInboundPacket and
+// InjectOutboundPacket with InjectOptions.Filter set.
+func (t *TUN) SetCaptureHook(fn CaptureFunc) {
+	t.captureHook.Store(fn)
+}
+
+// capture passes pkt to the capture hook and taps, if there are any.
+func (t *TUN) capture(where CapturePoint, pkt []byte) {
+	fn, _ := t.captureHook.Load().(CaptureFunc)
+	taps, _ := t.taps.Load().([]*tap)
+	if fn == nil && len(taps) == 0 {
+		return
+	}
+	now := time.Now()
+	if fn != nil {
+		fn(where, now, pkt)
+	}
+	for _, tp := range taps {
+		tp.fn(where, now, pkt)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCaptureHook(t *testing.T) {
+	chtun, tun := newChannelTUN(t.Logf, true)
+	defer tun.Close()
+	go func() {
+		for {
+			select {
+			case <-tun.closed:
+				return
+			case <-chtun.Inbound:
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	var got []CapturePoint
+	tun.SetCaptureHook(func(where CapturePoint, _ time.Time, _ []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, where)
+	})
+
+	var buf [MaxPacketSize]byte
+	tun.Write(udp(0x05060708, 0x01020304, 89, 89), 0) // accepted
+	tun.Write(udp(0x05060708, 0x01020304, 22, 22), 0) // dropped
+	chtun.Outbound <- udp(0x01020304, 0x05060708, 98, 98)
+	tun.Read(buf[:], 0)
+
+	tun.SetCaptureHook(nil)
+	tun.Write(udp(0x05060708, 0x01020304, 89, 89), 0)
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []CapturePoint{
+		CaptureFromPeer, CaptureFromPeerAccepted,
+		CaptureFromPeer,
+		CaptureFromLocal, CaptureFromLocalAccepted,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("captured at %v; want %v", got, want)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tailscale/wireguard-go/tun"
+)
+
+// outboundQueueLen is how many packets a ChannelTUN holds for
+// ReadOutbound before it starts dropping them.
+const outboundQueueLen = 128
+
+// ChannelTUN is a TUN device with no operating system behind it.
+// Instead, the program using it stands in for the host's network
+// stack, passing IP packets to and from wireguard-go through
+// InjectInbound and ReadOutbound. Inbound and outbound are from the
+// point of view of the engine using the device, the reverse of the
+// TUN Inject methods.
+//
+// It exists for tests, network simulators and programs embedding
+// wgengine.
+type ChannelTUN struct {
+	// dropped is the number of outbound packets dropped on a full
+	// queue. It's accessed atomically, so it's first for 64-bit
+	// alignment on 32-bit platforms.
+	dropped uint64
+
+	in     chan []byte // to wireguard-go
+	out    chan []byte // from wireguard-go
+	evchan chan tun.Event
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewChannelTUN returns a new ChannelTUN.
+func NewChannelTUN() *ChannelTUN {
+	return &ChannelTUN{
+		in:     make(chan []byte),
+		out:    make(chan []byte, outboundQueueLen),
+		evchan: make(chan tun.Event),
+		closed: make(chan struct{}),
+	}
+}
+
+// InjectInbound hands packet to the engine as if the host had sent
+// it into the tunnel: it's filtered and sent on to the peer it's
+// routed to. InjectInbound blocks until the engine takes the packet,
+// and doesn't keep hold of packet.
+func (t *ChannelTUN) InjectInbound(packet []byte) error {
+	if len(packet) > MaxPacketSize {
+		return errPacketTooBig
+	}
+	pkt := append([]byte(nil), packet...)
+	select {
+	case <-t.closed:
+		return ErrClosed
+	case t.in <- pkt:
+		return nil
+	}
+}
+
+// ReadOutbound returns the next packet the engine delivers to the
+// host, which has passed its packet filter. It blocks until there is
+// one.
+//
+// If ReadOutbound isn't called often enough to keep up, packets are
+// dropped, as on a real interface.
+func (t *ChannelTUN) ReadOutbound() ([]byte, error) {
+	select {
+	case <-t.closed:
+		return nil, ErrClosed
+	case pkt := <-t.out:
+		return pkt, nil
+	}
+}
+
+// Dropped returns the number of packets dropped because ReadOutbound
+// fell behind.
+func (t *ChannelTUN) Dropped() uint64 {
+	return atomic.LoadUint64(&t.dropped)
+}
+
+func (t *ChannelTUN) File() *os.File {
+	panic("ChannelTUN.File() called, which makes no sense")
+}
+
+func (t *ChannelTUN) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		close(t.evchan)
+	})
+	return nil
+}
+
+// Read implements tun.Device, returning packets from InjectInbound.
+func (t *ChannelTUN) Read(buf []byte, offset int) (int, error) {
+	select {
+	case <-t.closed:
+		return 0, io.EOF
+	case pkt := <-t.in:
+		return copy(buf[offset:], pkt), nil
+	}
+}
+
+// Write implements tun.Device, queueing the packet for ReadOutbound.
+func (t *ChannelTUN) Write(buf []byte, offset int) (int, error) {
+	select {
+	case <-t.closed:
+		return 0, ErrClosed
+	default:
+	}
+	pkt := append([]byte(nil), buf[offset:]...)
+	select {
+	case t.out <- pkt:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+	return len(buf), nil
+}
+
+func (t *ChannelTUN) Flush() error           { return nil }
+func (t *ChannelTUN) MTU() (int, error)      { return 1500, nil }
+func (t *ChannelTUN) Name() (string, error)  { return "ChannelTUN", nil }
+func (t *ChannelTUN) Events() chan tun.Event { return t.evchan }
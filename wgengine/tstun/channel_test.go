@@ -0,0 +1,52 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChannelTUN(t *testing.T) {
+	ct := NewChannelTUN()
+	pkt := []byte("some packet")
+
+	go ct.InjectInbound(pkt)
+	buf := make([]byte, PacketStartOffset+MaxPacketSize)
+	n, err := ct.Read(buf, PacketStartOffset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := buf[PacketStartOffset : PacketStartOffset+n]; !bytes.Equal(got, pkt) {
+		t.Errorf("Read = %q; want %q", got, pkt)
+	}
+
+	copy(buf[PacketStartOffset:], pkt)
+	if _, err := ct.Write(buf[:PacketStartOffset+len(pkt)], PacketStartOffset); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ct.ReadOutbound()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, pkt) {
+		t.Errorf("ReadOutbound = %q; want %q", got, pkt)
+	}
+
+	for i := 0; i < outboundQueueLen+3; i++ {
+		ct.Write(buf[:PacketStartOffset+len(pkt)], PacketStartOffset)
+	}
+	if d := ct.Dropped(); d != 3 {
+		t.Errorf("Dropped = %d; want 3", d)
+	}
+
+	ct.Close()
+	if err := ct.InjectInbound(pkt); err != ErrClosed {
+		t.Errorf("InjectInbound after Close = %v; want ErrClosed", err)
+	}
+	if _, err := ct.Write(buf, PacketStartOffset); err != ErrClosed {
+		t.Errorf("Write after Close = %v; want ErrClosed", err)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"time"
+
+	"github.com/golang/groupcache/lru"
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+)
+
+// connFlowsMax is how many recent inbound UDP flows a TUN remembers,
+// so as to report each as a new connection just once.
+const connFlowsMax = 512
+
+// ConnEvent is a new inbound connection accepted by the packet
+// filter: a TCP SYN, or the first UDP packet of a flow not seen in a
+// while.
+type ConnEvent struct {
+	Time  time.Time
+	Proto packet.IPProto // packet.TCP or packet.UDP
+	Src   netaddr.IPPort // the peer's end
+	Dst   netaddr.IPPort // our end
+}
+
+// A ConnFunc is called with each new inbound connection. It must be
+// quick: it's called inline on the packet path.
+type ConnFunc func(ConnEvent)
+
+// connFlow is the key of TUN.connFlows.
+type connFlow struct {
+	src, dst netaddr.IPPort
+}
+
+// SetConnHook sets the function called with each new inbound
+// connection the packet filter accepts. A nil fn stops the calls.
+func (t *TUN) SetConnHook(fn ConnFunc) {
+	t.connMu.Lock()
+	defer t.connMu.Unlock()
+	if fn == nil {
+		t.connFlows = nil
+	} else if t.connFlows == nil {
+		t.connFlows = lru.New(connFlowsMax)
+	}
+	t.connHook.Store(fn)
+}
+
+// noteConn is called with each inbound packet the filter accepted.
+// It calls the conn hook, if there is one, if p starts a connection.
+func (t *TUN) noteConn(p *packet.Parsed) {
+	fn, _ := t.connHook.Load().(ConnFunc)
+	if fn == nil {
+		return
+	}
+	switch p.IPProto {
+	case packet.TCP:
+		if !p.IsTCPSyn() {
+			return
+		}
+	case packet.UDP:
+	default:
+		return
+	}
+	var ev ConnEvent
+	switch p.IPVersion {
+	case 4:
+		ev.Src = netaddr.IPPort{IP: p.SrcIP4.Netaddr(), Port: p.SrcPort}
+		ev.Dst = netaddr.IPPort{IP: p.DstIP4.Netaddr(), Port: p.DstPort}
+	case 6:
+		ev.Src = netaddr.IPPort{IP: p.SrcIP6.Netaddr(), Port: p.SrcPort}
+		ev.Dst = netaddr.IPPort{IP: p.DstIP6.Netaddr(), Port: p.DstPort}
+	default:
+		return
+	}
+	if p.IPProto == packet.UDP && !t.isNewUDPFlow(connFlow{ev.Src, ev.Dst}) {
+		return
+	}
+	ev.Time = time.Now()
+	ev.Proto = p.IPProto
+	fn(ev)
+}
+
+// isNewUDPFlow reports whether k isn't among the recent UDP flows,
+// and makes it the most recent.
+func (t *TUN) isNewUDPFlow(k connFlow) bool {
+	t.connMu.Lock()
+	defer t.connMu.Unlock()
+	if t.connFlows == nil {
+		// The hook was just removed.
+		return false
+	}
+	_, ok := t.connFlows.Get(k)
+	if !ok {
+		t.connFlows.Add(k, true)
+	}
+	return !ok
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"sync"
+	"testing"
+
+	"tailscale.com/net/packet"
+)
+
+func TestConnHook(t *testing.T) {
+	_, tun := newFakeTUN(t.Logf, true)
+	defer tun.Close()
+
+	var mu sync.Mutex
+	var got []ConnEvent
+	tun.SetConnHook(func(ev ConnEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, ev)
+	})
+
+	tun.Write(udp(0x05060708, 0x01020304, 89, 89), 0) // new flow
+	tun.Write(udp(0x05060708, 0x01020304, 89, 89), 0) // same flow
+	tun.Write(udp(0x05060708, 0x01020304, 90, 90), 0) // new flow
+	tun.Write(udp(0x05060708, 0x01020304, 22, 22), 0) // dropped
+
+	tun.SetConnHook(nil)
+	tun.Write(udp(0x05060708, 0x01020304, 89, 90), 0)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 2 {
+		t.Fatalf("got %d events, want 2: %v", len(got), got)
+	}
+	for i, port := range []uint16{89, 90} {
+		ev := got[i]
+		if ev.Proto != packet.UDP || ev.Src.Port != port || ev.Dst.Port != port || ev.Dst.IP.String() != "1.2.3.4" {
+			t.Errorf("event %d = %+v; want UDP 5.6.7.8:%d -> 1.2.3.4:%d", i, ev, port, port)
+		}
+	}
+}
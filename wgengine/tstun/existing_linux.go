@@ -0,0 +1,73 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"os"
+	"sync"
+	"unsafe"
+
+	"github.com/tailscale/wireguard-go/tun"
+	"golang.org/x/sys/unix"
+)
+
+// OpenExistingTUN opens the TUN device name, which must already exist
+// and be usable by the process's user, such as one created with
+// "ip tuntap add name NAME mode tun user USER". Unlike CreateTUN, it
+// needs neither root nor CAP_NET_ADMIN, as it leaves the device's MTU
+// and state as they are; the device should already be up.
+func OpenExistingTUN(name string) (tun.Device, error) {
+	f, err := openDevTUN(name, unix.IFF_TUN|unix.IFF_NO_PI, 0)
+	if err != nil {
+		return nil, err
+	}
+	t := &existingTUN{
+		f:      f,
+		name:   name,
+		events: make(chan tun.Event, 1),
+	}
+	t.events <- tun.EventUp
+	return t, nil
+}
+
+// existingTUN is a tun.Device opened by OpenExistingTUN.
+type existingTUN struct {
+	f      *os.File
+	name   string
+	events chan tun.Event
+
+	closeOnce sync.Once
+}
+
+func (t *existingTUN) File() *os.File                          { return t.f }
+func (t *existingTUN) Flush() error                            { return nil }
+func (t *existingTUN) Name() (string, error)                   { return t.name, nil }
+func (t *existingTUN) Events() chan tun.Event                  { return t.events }
+func (t *existingTUN) Read(b []byte, offset int) (int, error)  { return t.f.Read(b[offset:]) }
+func (t *existingTUN) Write(b []byte, offset int) (int, error) { return t.f.Write(b[offset:]) }
+
+// MTU returns the device's MTU, which anyone can get.
+func (t *existingTUN) MTU() (int, error) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(fd)
+	var ifr [unix.IFNAMSIZ + 64]byte
+	copy(ifr[:], t.name)
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(unix.SIOCGIFMTU), uintptr(unsafe.Pointer(&ifr[0]))); errno != 0 {
+		return 0, errno
+	}
+	return int(*(*int32)(unsafe.Pointer(&ifr[unix.IFNAMSIZ]))), nil
+}
+
+func (t *existingTUN) Close() error {
+	var err error
+	t.closeOnce.Do(func() {
+		err = t.f.Close()
+		close(t.events)
+	})
+	return err
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/tailscale/wireguard-go/tun"
+	"golang.org/x/sys/unix"
+)
+
+// HandoffFile returns a duplicate of the file of dev, a TUN device
+// made by CreateTUN, for another process to carry on with; see
+// TUNFromHandoff. offload reports whether it was opened with
+// virtio-net headers. TAP devices can't be handed off.
+func HandoffFile(dev tun.Device) (f *os.File, offload bool, err error) {
+	var src *os.File
+	switch d := dev.(type) {
+	case *offloadTUN:
+		src, offload = d.f, true
+	case *tun.NativeTun:
+		src = d.File()
+	default:
+		return nil, false, fmt.Errorf("can't hand off %T device", dev)
+	}
+	f, err = dupFile(src)
+	return f, offload, err
+}
+
+// TUNFromHandoff returns the TUN device of f, a file from another
+// process's HandoffFile, setting its MTU to mtu.
+func TUNFromHandoff(f *os.File, offload bool, mtu int) (tun.Device, error) {
+	dev, err := tun.CreateTUNFromFile(f, mtu)
+	if err != nil {
+		return nil, err
+	}
+	if offload {
+		return newOffloadTUN(dev, f), nil
+	}
+	return dev, nil
+}
+
+// dupFile returns a duplicate of f. Unlike f.Fd, it leaves f in
+// non-blocking mode, which the duplicate shares.
+func dupFile(f *os.File) (*os.File, error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var fd int
+	var dupErr error
+	err = rc.Control(func(sysfd uintptr) {
+		fd, dupErr = unix.Dup(int(sysfd))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if dupErr != nil {
+		return nil, dupErr
+	}
+	syscall.CloseOnExec(fd)
+	return os.NewFile(uintptr(fd), f.Name()), nil
+}
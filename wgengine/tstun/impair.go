@@ -0,0 +1,197 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"container/heap"
+	"math/rand"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// Impairment is artificial packet loss and delay that a TUN applies
+// to the traffic to and from one peer, for testing how applications
+// cope with a degraded path. It's a debugging aid, not a traffic
+// shaper.
+type Impairment struct {
+	// LossPercent is the percentage of packets, from 0 to 100,
+	// dropped in each direction.
+	LossPercent float64 `json:",omitempty"`
+	// DelayMS is how many milliseconds each packet is held back in
+	// each direction.
+	DelayMS int `json:",omitempty"`
+}
+
+// maxDelayed is the most packets a TUN holds back for impairments at
+// once. Packets delayed beyond that are dropped, as by a router whose
+// queue is full.
+const maxDelayed = 1024
+
+// SetImpairments sets the impairments to apply to the traffic of
+// the peers with the given Tailscale IPs, IPv4 or IPv6, replacing
+// any set before.
+func (t *TUN) SetImpairments(m map[netaddr.IP]Impairment) {
+	active := make(map[netaddr.IP]Impairment)
+	for ip, imp := range m {
+		if imp.LossPercent > 0 || imp.DelayMS > 0 {
+			active[ip] = imp
+		}
+	}
+	t.impairments.Store(active)
+}
+
+// Impairments returns the impairments set by SetImpairments.
+func (t *TUN) Impairments() map[netaddr.IP]Impairment {
+	m, _ := t.impairments.Load().(map[netaddr.IP]Impairment)
+	ret := make(map[netaddr.IP]Impairment, len(m))
+	for ip, imp := range m {
+		ret[ip] = imp
+	}
+	return ret
+}
+
+// impair applies the impairment, if any, of the peer that pkt is to
+// (if out) or from to pkt. It reports whether pkt should go on as
+// usual. If not, pkt was either dropped, or copied and handed to
+// resend to finish its trip after the delay.
+func (t *TUN) impair(pkt []byte, out bool, resend func([]byte) error) bool {
+	m, _ := t.impairments.Load().(map[netaddr.IP]Impairment)
+	if len(m) == 0 {
+		return true
+	}
+	src, dst, ok := ipAddrs(pkt)
+	if !ok {
+		return true
+	}
+	peer := src
+	if out {
+		peer = dst
+	}
+	imp, ok := m[peer]
+	if !ok {
+		return true
+	}
+	if imp.LossPercent > 0 && rand.Float64()*100 < imp.LossPercent {
+		return false
+	}
+	if imp.DelayMS <= 0 {
+		return true
+	}
+	t.delayed.add(time.Now().Add(time.Duration(imp.DelayMS)*time.Millisecond), append([]byte(nil), pkt...), resend)
+	return false
+}
+
+// ipAddrs returns the source and destination addresses of pkt, if
+// it's an IP packet.
+func ipAddrs(pkt []byte) (src, dst netaddr.IP, ok bool) {
+	switch {
+	case len(pkt) >= 20 && pkt[0]>>4 == 4:
+		src = netaddr.IPv4(pkt[12], pkt[13], pkt[14], pkt[15])
+		dst = netaddr.IPv4(pkt[16], pkt[17], pkt[18], pkt[19])
+		return src, dst, true
+	case len(pkt) >= 40 && pkt[0]>>4 == 6:
+		var s, d [16]byte
+		copy(s[:], pkt[8:24])
+		copy(d[:], pkt[24:40])
+		return netaddr.IPFrom16(s), netaddr.IPFrom16(d), true
+	}
+	return netaddr.IP{}, netaddr.IP{}, false
+}
+
+// delayQueue holds the packets delayed by impairments until they're
+// due, at most maxDelayed of them.
+type delayQueue struct {
+	mu     sync.Mutex
+	pkts   delayHeap
+	seq    uint64      // of the last packet added, to keep order among equal times
+	timer  *time.Timer // fires when pkts[0] is due; nil before the first add
+	closed bool
+}
+
+type delayedPacket struct {
+	due    time.Time
+	seq    uint64
+	pkt    []byte
+	resend func([]byte) error
+}
+
+// add queues pkt for resend at due, or drops it if q is full.
+func (q *delayQueue) add(due time.Time, pkt []byte, resend func([]byte) error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || len(q.pkts) >= maxDelayed {
+		return
+	}
+	q.seq++
+	heap.Push(&q.pkts, delayedPacket{due: due, seq: q.seq, pkt: pkt, resend: resend})
+	if q.pkts[0].seq == q.seq {
+		q.scheduleLocked()
+	}
+}
+
+// scheduleLocked arranges for q.run to be called when the first
+// packet is due.
+func (q *delayQueue) scheduleLocked() {
+	d := time.Until(q.pkts[0].due)
+	if q.timer == nil {
+		q.timer = time.AfterFunc(d, q.run)
+	} else {
+		q.timer.Reset(d)
+	}
+}
+
+// run resends the packets that are due.
+func (q *delayQueue) run() {
+	for {
+		q.mu.Lock()
+		if q.closed || len(q.pkts) == 0 {
+			q.mu.Unlock()
+			return
+		}
+		if time.Now().Before(q.pkts[0].due) {
+			q.scheduleLocked()
+			q.mu.Unlock()
+			return
+		}
+		p := heap.Pop(&q.pkts).(delayedPacket)
+		q.mu.Unlock()
+		p.resend(p.pkt)
+	}
+}
+
+// close drops the queued packets and stops q.
+func (q *delayQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.pkts = nil
+	if q.timer != nil {
+		q.timer.Stop()
+	}
+}
+
+// delayHeap is a container/heap of delayed packets, the first due
+// first.
+type delayHeap []delayedPacket
+
+func (h delayHeap) Len() int { return len(h) }
+func (h delayHeap) Less(i, j int) bool {
+	if h[i].due.Equal(h[j].due) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].due.Before(h[j].due)
+}
+func (h delayHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *delayHeap) Push(x interface{}) { *h = append(*h, x.(delayedPacket)) }
+func (h *delayHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = delayedPacket{}
+	*h = old[:n-1]
+	return x
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+	"tailscale.com/types/logger"
+)
+
+func TestImpair(t *testing.T) {
+	tun := WrapTUN(logger.Discard, NewFakeTUN())
+	defer tun.Close()
+
+	lossy := netaddr.IPv4(100, 64, 0, 1)
+	slow := netaddr.IPv4(100, 64, 0, 2)
+	mustIP := func(s string) netaddr.IP {
+		ip, err := netaddr.ParseIP(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ip
+	}
+	lossy6 := mustIP("fd7a:115c:a1e0::1")
+	tun.SetImpairments(map[netaddr.IP]Impairment{
+		lossy:                      {LossPercent: 100},
+		slow:                       {DelayMS: 10},
+		lossy6:                     {LossPercent: 100},
+		netaddr.IPv4(100, 64, 0, 3): {},
+	})
+	if got := tun.Impairments(); len(got) != 3 {
+		t.Errorf("Impairments = %v; want the 3 non-zero ones", got)
+	}
+
+	resent := make(chan []byte, 1)
+	resend := func(b []byte) error {
+		resent <- b
+		return nil
+	}
+	me := packet.IP4FromNetaddr(netaddr.IPv4(100, 64, 0, 100))
+	from := func(ip netaddr.IP) []byte {
+		return udp(packet.IP4FromNetaddr(ip), me, 1, 2)
+	}
+
+	if tun.impair(from(lossy), false, resend) {
+		t.Error("packet from lossy peer not dropped")
+	}
+	if !tun.impair(from(lossy), true, resend) {
+		t.Error("packet to us, not the lossy peer, dropped")
+	}
+	if !tun.impair(from(netaddr.IPv4(100, 64, 0, 3)), false, resend) {
+		t.Error("packet from unimpaired peer held back")
+	}
+	pkt6 := packet.Generate(&packet.IP6Header{
+		IPProto: packet.UDP,
+		SrcIP:   packet.IP6FromNetaddr(mustIP("fd7a:115c:a1e0::100")),
+		DstIP:   packet.IP6FromNetaddr(lossy6),
+	}, []byte("payload"))
+	if tun.impair(pkt6, true, resend) {
+		t.Error("IPv6 packet to lossy peer not dropped")
+	}
+	pkt := from(slow)
+	if tun.impair(pkt, false, resend) {
+		t.Error("packet from slow peer not held back")
+	}
+	select {
+	case got := <-resent:
+		if !bytes.Equal(got, pkt) {
+			t.Errorf("resent %q; want %q", got, pkt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("delayed packet never resent")
+	}
+	if len(resent) != 0 {
+		t.Error("dropped packet was resent")
+	}
+}
+
+func TestDelayQueue(t *testing.T) {
+	var q delayQueue
+	defer q.close()
+
+	got := make(chan byte, maxDelayed+1)
+	resend := func(b []byte) error {
+		got <- b[0]
+		return nil
+	}
+	now := time.Now()
+	q.add(now.Add(40*time.Millisecond), []byte{2}, resend)
+	q.add(now.Add(20*time.Millisecond), []byte{1}, resend)
+	for i := 0; i < 2; i++ {
+		select {
+		case b := <-got:
+			if want := byte(i + 1); b != want {
+				t.Errorf("packet %d resent %dth; want the one due first", b, i+1)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("delayed packet never resent")
+		}
+	}
+
+	// A full queue drops packets.
+	later := time.Now().Add(time.Hour)
+	for i := 0; i < maxDelayed+1; i++ {
+		q.add(later, []byte{0}, resend)
+	}
+	q.mu.Lock()
+	n := len(q.pkts)
+	q.mu.Unlock()
+	if n != maxDelayed {
+		t.Errorf("queued %d packets; want %d", n, maxDelayed)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"tailscale.com/net/packet"
+	"tailscale.com/wgengine/filter"
+)
+
+// InjectOptions are the options of InjectInboundPacket and
+// InjectOutboundPacket.
+type InjectOptions struct {
+	// Filter is whether the packet goes through the packet filter,
+	// and is captured and tapped, like a packet in its direction
+	// would. If false, it goes straight through, as with the
+	// other Inject methods.
+	Filter bool
+}
+
+// InjectInboundPacket makes the TUN behave as if pkt, an IP packet,
+// was received from a peer: it's written to the host. It blocks until
+// it's written, and doesn't retain pkt.
+//
+// If opts.Filter is set and the packet filter drops pkt, it returns
+// ErrFiltered.
+//
+// It's the supported way for programs embedding the engine, such as
+// monitoring agents and tests, to insert packets; the Inject methods
+// with lower-level contracts are for the engine itself.
+func (t *TUN) InjectInboundPacket(pkt []byte, opts InjectOptions) error {
+	if len(pkt) > MaxPacketSize {
+		return errPacketTooBig
+	}
+	if len(pkt) == 0 {
+		return nil
+	}
+	buf := make([]byte, PacketStartOffset+len(pkt))
+	copy(buf[PacketStartOffset:], pkt)
+	pkt = buf[PacketStartOffset:]
+
+	if opts.Filter {
+		t.capture(CaptureFromPeer, pkt)
+		if !t.disableFilter && t.filterIn(pkt, t.peerSrcsOf(buf, PacketStartOffset)) != filter.Accept {
+			return ErrFiltered
+		}
+		t.capture(CaptureFromPeerAccepted, pkt)
+	}
+	t.noteActivity()
+	return t.InjectInboundDirect(buf, PacketStartOffset)
+}
+
+// InjectOutboundPacket makes the TUN behave as if pkt, an IP packet,
+// was sent by the host: it's sent on to the peer it's routed to. It
+// blocks until WireGuard takes it, and doesn't retain pkt.
+//
+// If opts.Filter is set and the packet filter drops pkt, it returns
+// ErrFiltered.
+func (t *TUN) InjectOutboundPacket(pkt []byte, opts InjectOptions) error {
+	if len(pkt) > MaxPacketSize {
+		return errPacketTooBig
+	}
+	if len(pkt) == 0 {
+		return nil
+	}
+	pkt = append([]byte(nil), pkt...)
+
+	if opts.Filter {
+		p := parsedPacketPool.Get().(*packet.Parsed)
+		defer parsedPacketPool.Put(p)
+		p.Decode(pkt)
+		t.capture(CaptureFromLocal, pkt)
+		if !t.disableFilter && t.filterOut(p) != filter.Accept {
+			return ErrFiltered
+		}
+		t.capture(CaptureFromLocalAccepted, pkt)
+	}
+	return t.InjectOutbound(pkt)
+}
+
+// A tap is a function added with AddTap.
+type tap struct {
+	fn CaptureFunc
+}
+
+// AddTap adds fn to the functions called with every packet passing
+// through the TUN, as the capture hook is (see SetCaptureHook), and
+// returns a func that removes it. Unlike the capture hook, any number
+// of taps can be added, each by a different observer.
+func (t *TUN) AddTap(fn CaptureFunc) (remove func()) {
+	tp := &tap{fn: fn}
+	t.tapsMu.Lock()
+	defer t.tapsMu.Unlock()
+	old, _ := t.taps.Load().([]*tap)
+	t.taps.Store(append(old[:len(old):len(old)], tp))
+	return func() {
+		t.tapsMu.Lock()
+		defer t.tapsMu.Unlock()
+		old, _ := t.taps.Load().([]*tap)
+		var taps []*tap
+		for _, o := range old {
+			if o != tp {
+				taps = append(taps, o)
+			}
+		}
+		t.taps.Store(taps)
+	}
+}
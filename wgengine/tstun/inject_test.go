@@ -0,0 +1,72 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"bytes"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInjectPacket(t *testing.T) {
+	chtun, tun := newChannelTUN(t.Logf, true)
+	defer tun.Close()
+
+	var mu sync.Mutex
+	var tapped []CapturePoint
+	remove := tun.AddTap(func(where CapturePoint, _ time.Time, _ []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		tapped = append(tapped, where)
+	})
+
+	accepted := udp(0x05060708, 0x01020304, 89, 89)
+	go tun.InjectInboundPacket(accepted, InjectOptions{Filter: true})
+	select {
+	case got := <-chtun.Inbound:
+		if !bytes.Equal(got, accepted) {
+			t.Errorf("inbound: got %x; want %x", got, accepted)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("accepted packet not written")
+	}
+	dropped := udp(0x05060708, 0x01020304, 22, 22)
+	if err := tun.InjectInboundPacket(dropped, InjectOptions{Filter: true}); err != ErrFiltered {
+		t.Errorf("inbound filtered packet: err = %v; want ErrFiltered", err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- tun.InjectOutboundPacket(udp(0x01020304, 0x05060708, 98, 98), InjectOptions{Filter: true})
+	}()
+	var buf [MaxPacketSize]byte
+	if n, err := tun.Read(buf[:], 0); n == 0 || err != nil {
+		t.Errorf("outbound packet: Read = %d, %v", n, err)
+	}
+	if err := <-errc; err != nil {
+		t.Errorf("outbound packet: %v", err)
+	}
+
+	// Unfiltered, the dropped packet goes through, untapped.
+	remove()
+	go tun.InjectInboundPacket(dropped, InjectOptions{})
+	select {
+	case <-chtun.Inbound:
+	case <-time.After(5 * time.Second):
+		t.Fatal("unfiltered packet not written")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []CapturePoint{
+		CaptureFromPeer, CaptureFromPeerAccepted,
+		CaptureFromPeer,
+		CaptureFromLocal, CaptureFromLocalAccepted,
+	}
+	if !reflect.DeepEqual(tapped, want) {
+		t.Errorf("tapped at %v; want %v", tapped, want)
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"tailscale.com/util/endian"
+)
+
+// A TUN opened with IFF_VNET_HDR prefixes each packet with a
+// virtio-net header, which lets the kernel hand over TCP segments of up
+// to 64 KiB for userspace to split (TSO) and leave checksums to be
+// finished, and lets userspace hand the kernel back large segments
+// coalesced from many small ones (GRO). Crossing the TUN once per 64
+// KiB instead of once per MTU is most of the cost of a single fast TCP
+// stream.
+//
+// The splitting and coalescing is done here, portably; the TUN itself
+// is only opened this way on Linux. See offload_linux.go.
+
+// virtioNetHdrLen is the size of struct virtio_net_hdr.
+const virtioNetHdrLen = 10
+
+// Values of virtioNetHdr.flags and gsoType.
+const (
+	virtioNetHdrFNeedsCsum = 1
+
+	virtioNetHdrGSONone  = 0
+	virtioNetHdrGSOTCPv4 = 1
+	virtioNetHdrGSOTCPv6 = 4
+	virtioNetHdrGSOECN   = 0x80
+)
+
+// virtioNetHdr is struct virtio_net_hdr from linux/virtio_net.h, which
+// is in the host's byte order.
+type virtioNetHdr struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16 // bytes of headers to copy into each segment
+	gsoSize    uint16 // bytes of payload per segment
+	csumStart  uint16 // offset to start checksumming from
+	csumOffset uint16 // offset after csumStart to put the checksum at
+}
+
+func (h *virtioNetHdr) decode(b []byte) bool {
+	if len(b) < virtioNetHdrLen {
+		return false
+	}
+	h.flags = b[0]
+	h.gsoType = b[1]
+	h.hdrLen = endian.Native.Uint16(b[2:])
+	h.gsoSize = endian.Native.Uint16(b[4:])
+	h.csumStart = endian.Native.Uint16(b[6:])
+	h.csumOffset = endian.Native.Uint16(b[8:])
+	return true
+}
+
+func (h *virtioNetHdr) encode(b []byte) {
+	b[0] = h.flags
+	b[1] = h.gsoType
+	endian.Native.PutUint16(b[2:], h.hdrLen)
+	endian.Native.PutUint16(b[4:], h.gsoSize)
+	endian.Native.PutUint16(b[6:], h.csumStart)
+	endian.Native.PutUint16(b[8:], h.csumOffset)
+}
+
+var (
+	errBadVirtioNetHdr = errors.New("bad virtio-net header")
+	errNotTCP          = errors.New("GSO packet not TCP")
+)
+
+// checksumAdd adds b, as big-endian 16-bit words, to the one's
+// complement sum sum.
+func checksumAdd(sum uint64, b []byte) uint64 {
+	for len(b) >= 2 {
+		sum += uint64(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint64(b[0]) << 8
+	}
+	return sum
+}
+
+// checksumFold folds sum to 16 bits.
+func checksumFold(sum uint64) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
+
+// pseudoHeaderSum returns the sum of the pseudo-header of the TCP
+// segment of length tcpLen in pkt, an IPv4 or IPv6 packet.
+func pseudoHeaderSum(pkt []byte, tcpLen int) uint64 {
+	var sum uint64
+	if pkt[0]>>4 == 4 {
+		sum = checksumAdd(0, pkt[12:20])
+	} else {
+		sum = checksumAdd(0, pkt[8:40])
+	}
+	return sum + 6 + uint64(tcpLen)
+}
+
+// setIP4Checksum sets the header checksum of pkt, an IPv4 packet.
+func setIP4Checksum(pkt []byte) {
+	ihl := int(pkt[0]&0xf) * 4
+	pkt[10], pkt[11] = 0, 0
+	binary.BigEndian.PutUint16(pkt[10:], ^checksumFold(checksumAdd(0, pkt[:ihl])))
+}
+
+// finishChecksum finishes the checksum the kernel left partial in pkt,
+// as described by h.
+func finishChecksum(pkt []byte, h virtioNetHdr) bool {
+	start, at := int(h.csumStart), int(h.csumStart)+int(h.csumOffset)
+	if at+2 > len(pkt) {
+		return false
+	}
+	// The checksum field holds the pseudo-header's sum, so it's
+	// summed along with the rest.
+	binary.BigEndian.PutUint16(pkt[at:], ^checksumFold(checksumAdd(0, pkt[start:])))
+	return true
+}
+
+// tcpHeaders returns the offset of the TCP header in pkt and the
+// length of its IP and TCP headers together, or ok false if pkt isn't
+// a TCP segment that can be split or coalesced: an unfragmented IPv4
+// packet, or an IPv6 packet without extension headers.
+func tcpHeaders(pkt []byte) (tcpStart, hdrLen int, ok bool) {
+	if len(pkt) < 20 {
+		return 0, 0, false
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		tcpStart = int(pkt[0]&0xf) * 4
+		if tcpStart < 20 || pkt[9] != 6 || binary.BigEndian.Uint16(pkt[6:])&0x3fff != 0 {
+			return 0, 0, false
+		}
+	case 6:
+		tcpStart = 40
+		if len(pkt) < tcpStart || pkt[6] != 6 {
+			return 0, 0, false
+		}
+	default:
+		return 0, 0, false
+	}
+	if len(pkt) < tcpStart+20 {
+		return 0, 0, false
+	}
+	hdrLen = tcpStart + int(pkt[tcpStart+12]>>4)*4
+	if hdrLen < tcpStart+20 || len(pkt) < hdrLen {
+		return 0, 0, false
+	}
+	return tcpStart, hdrLen, true
+}
+
+// TCP flags, for splitting and coalescing.
+const (
+	tcpFIN = 0x01
+	tcpPSH = 0x08
+	tcpACK = 0x10
+	tcpCWR = 0x80
+)
+
+// setLengths sets the IP length fields of pkt, a TCP segment with the
+// header at tcpStart, to len(pkt), and its TCP checksum to sum plus
+// its pseudo-header's sum, complemented if full.
+func setLengths(pkt []byte, tcpStart int, sum uint64, full bool) {
+	if pkt[0]>>4 == 4 {
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		setIP4Checksum(pkt)
+	} else {
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(pkt)-40))
+	}
+	csum := checksumFold(sum + pseudoHeaderSum(pkt, len(pkt)-tcpStart))
+	if full {
+		csum = ^csum
+	}
+	binary.BigEndian.PutUint16(pkt[tcpStart+16:], csum)
+}
+
+// tsoSplit splits pkt, a TCP segment the kernel left for userspace to
+// segment as described by h, into segments of at most h.gsoSize bytes
+// of payload, each with full checksums, and appends them to segs. The
+// segments are put in buf if it's large enough; the buffer used is
+// returned to be reused.
+func tsoSplit(pkt []byte, h virtioNetHdr, buf []byte, segs [][]byte) ([]byte, [][]byte, error) {
+	tcpStart, hdrLen, ok := tcpHeaders(pkt)
+	if !ok {
+		return buf, segs, errNotTCP
+	}
+	want := uint8(virtioNetHdrGSOTCPv4)
+	if pkt[0]>>4 == 6 {
+		want = virtioNetHdrGSOTCPv6
+	}
+	mss := int(h.gsoSize)
+	payload := pkt[hdrLen:]
+	if h.gsoType&^virtioNetHdrGSOECN != want || mss == 0 || len(payload) == 0 {
+		return buf, segs, errBadVirtioNetHdr
+	}
+	nseg := (len(payload) + mss - 1) / mss
+	if need := nseg*hdrLen + len(payload); cap(buf) < need {
+		buf = make([]byte, need)
+	}
+	buf = buf[:cap(buf)]
+
+	seq := binary.BigEndian.Uint32(pkt[tcpStart+4:])
+	var id uint16
+	if pkt[0]>>4 == 4 {
+		id = binary.BigEndian.Uint16(pkt[4:])
+	}
+	off := 0
+	for i := 0; i < nseg; i++ {
+		p := payload[i*mss:]
+		if len(p) > mss {
+			p = p[:mss]
+		}
+		seg := buf[off : off+hdrLen+len(p)]
+		off += len(seg)
+		copy(seg, pkt[:hdrLen])
+		copy(seg[hdrLen:], p)
+
+		if seg[0]>>4 == 4 {
+			binary.BigEndian.PutUint16(seg[4:], id+uint16(i))
+		}
+		tcp := seg[tcpStart:]
+		binary.BigEndian.PutUint32(tcp[4:], seq+uint32(i*mss))
+		if i < nseg-1 {
+			tcp[13] &^= tcpFIN | tcpPSH
+		}
+		if i > 0 {
+			tcp[13] &^= tcpCWR
+		}
+		tcp[16], tcp[17] = 0, 0
+		setLengths(seg, tcpStart, checksumAdd(0, tcp), true)
+		segs = append(segs, seg)
+	}
+	return buf, segs, nil
+}
+
+// groCoalesce appends to out the packets in pkts, each starting at
+// offset in its buffer, preceded by virtio-net headers, with runs of
+// consecutive segments of the same TCP stream coalesced into one large
+// segment for the kernel to split again. Coalescing appends to the
+// buffer of a run's first packet, up to its capacity.
+//
+// The returned packets start virtioNetHdrLen before offset.
+func groCoalesce(pkts [][]byte, offset int, out [][]byte) [][]byte {
+	for i := 0; i < len(pkts); {
+		buf := pkts[i]
+		var h virtioNetHdr
+		n := len(buf) - offset
+		j := i + 1
+		tcpStart, hdrLen, ok := tcpHeaders(buf[offset:])
+		if ok && buf[offset+tcpStart+13] == tcpACK && n > hdrLen {
+			mss := n - hdrLen
+			for ; j < len(pkts); j++ {
+				next := pkts[j][offset:]
+				first := buf[offset : offset+n]
+				if !canCoalesce(first, next, tcpStart, hdrLen, mss) || offset+n+len(next)-hdrLen > cap(buf) {
+					break
+				}
+				buf = append(buf[:offset+n], next[hdrLen:]...)
+				n = len(buf) - offset
+				if next[tcpStart+13]&tcpPSH != 0 {
+					// The kernel puts the push on the last
+					// segment when it splits them again.
+					buf[offset+tcpStart+13] |= tcpPSH
+					j++
+					break
+				}
+				if len(next)-hdrLen < mss {
+					j++
+					break
+				}
+			}
+			if j > i+1 {
+				pkt := buf[offset:]
+				setLengths(pkt, tcpStart, 0, false)
+				h = virtioNetHdr{
+					flags:      virtioNetHdrFNeedsCsum,
+					gsoType:    virtioNetHdrGSOTCPv4,
+					hdrLen:     uint16(hdrLen),
+					gsoSize:    uint16(mss),
+					csumStart:  uint16(tcpStart),
+					csumOffset: 16,
+				}
+				if pkt[0]>>4 == 6 {
+					h.gsoType = virtioNetHdrGSOTCPv6
+				}
+			}
+		}
+		h.encode(buf[offset-virtioNetHdrLen:])
+		out = append(out, buf[offset-virtioNetHdrLen:])
+		i = j
+	}
+	return out
+}
+
+// canCoalesce reports whether next, a TCP segment, directly follows
+// first, one of up to 64 KiB coalesced from segments of mss bytes of
+// payload, in the same stream, such that the kernel would split their
+// coalescing back into the same segments.
+func canCoalesce(first, next []byte, tcpStart, hdrLen, mss int) bool {
+	nextStart, nextHdrLen, ok := tcpHeaders(next)
+	if !ok || nextStart != tcpStart || nextHdrLen != hdrLen {
+		return false
+	}
+	plen := len(next) - hdrLen
+	if plen == 0 || plen > mss || len(first)+plen > 0xffff {
+		return false
+	}
+	if first[0]>>4 == 4 {
+		// Version, header length and TOS; flags, TTL and protocol;
+		// and addresses.
+		if !bytes.Equal(first[:2], next[:2]) || first[6] != next[6] || !bytes.Equal(first[8:10], next[8:10]) || !bytes.Equal(first[12:tcpStart], next[12:tcpStart]) {
+			return false
+		}
+	} else {
+		// Version, traffic class and flow label; and next header,
+		// hop limit and addresses.
+		if !bytes.Equal(first[:4], next[:4]) || !bytes.Equal(first[6:40], next[6:40]) {
+			return false
+		}
+	}
+	ft, nt := first[tcpStart:hdrLen], next[tcpStart:hdrLen]
+	// Ports, then acknowledgment, data offset, and window, then
+	// options.
+	if !bytes.Equal(ft[:4], nt[:4]) || !bytes.Equal(ft[8:13], nt[8:13]) || !bytes.Equal(ft[14:16], nt[14:16]) || !bytes.Equal(ft[20:], nt[20:]) {
+		return false
+	}
+	if nt[13]&^tcpPSH != tcpACK {
+		return false
+	}
+	seq := binary.BigEndian.Uint32(ft[4:]) + uint32(len(first)-hdrLen)
+	return binary.BigEndian.Uint32(nt[4:]) == seq
+}
@@ -0,0 +1,34 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package tstun
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/tailscale/wireguard-go/tun"
+	"tailscale.com/types/logger"
+)
+
+// CreateTUN creates a TUN device with the given name and MTU. On
+// Linux, it's opened with virtio-net headers and checksum and TCP
+// segmentation offload, if the kernel supports them.
+//
+// Names starting with TAPPrefix, for TAP devices, are only supported
+// on Linux.
+func CreateTUN(logf logger.Logf, name string, mtu int) (tun.Device, error) {
+	if strings.HasPrefix(name, TAPPrefix) {
+		return nil, errors.New("TAP devices are only supported on Linux")
+	}
+	return tun.CreateTUN(name, mtu)
+}
+
+// OpenExistingTUN opens an existing TUN device without needing
+// privileges. It's only supported on Linux.
+func OpenExistingTUN(name string) (tun.Device, error) {
+	return nil, errors.New("opening existing TUN devices is only supported on Linux")
+}
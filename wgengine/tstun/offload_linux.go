@@ -0,0 +1,187 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"github.com/tailscale/wireguard-go/tun"
+	"golang.org/x/sys/unix"
+	"tailscale.com/types/logger"
+)
+
+// CreateTUN creates a TUN device with the given name and MTU. On
+// Linux, it's opened with virtio-net headers and checksum and TCP
+// segmentation offload, if the kernel supports them, so that TCP
+// streams cross it in segments of up to 64 KiB.
+//
+// Names starting with TAPPrefix create TAP devices instead.
+func CreateTUN(logf logger.Logf, name string, mtu int) (tun.Device, error) {
+	if strings.HasPrefix(name, TAPPrefix) {
+		return createTAP(strings.TrimPrefix(name, TAPPrefix), mtu)
+	}
+	if off, _ := strconv.ParseBool(os.Getenv("TS_DEBUG_DISABLE_TUN_OFFLOAD")); off {
+		return tun.CreateTUN(name, mtu)
+	}
+	dev, err := createOffloadTUN(name, mtu)
+	if err != nil {
+		logf("tstun: TUN offload unavailable, continuing without: %v", err)
+		return tun.CreateTUN(name, mtu)
+	}
+	return dev, nil
+}
+
+func createOffloadTUN(name string, mtu int) (tun.Device, error) {
+	f, err := openDevTUN(name, unix.IFF_TUN|unix.IFF_NO_PI|unix.IFF_VNET_HDR, unix.TUN_F_CSUM|unix.TUN_F_TSO4|unix.TUN_F_TSO6)
+	if err != nil {
+		return nil, err
+	}
+	dev, err := tun.CreateTUNFromFile(f, mtu)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return newOffloadTUN(dev, f), nil
+}
+
+// openDevTUN opens the TUN or TAP device name, with the given
+// TUNSETIFF flags, and TUNSETOFFLOAD offloads if non-zero.
+func openDevTUN(name string, flags uint16, offloads int) (*os.File, error) {
+	if len(name) >= unix.IFNAMSIZ {
+		return nil, fmt.Errorf("interface name too long: %q", name)
+	}
+	fd, err := unix.Open("/dev/net/tun", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var ifr [unix.IFNAMSIZ + 64]byte
+	copy(ifr[:], name)
+	*(*uint16)(unsafe.Pointer(&ifr[unix.IFNAMSIZ])) = flags
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(unix.TUNSETIFF), uintptr(unsafe.Pointer(&ifr[0]))); errno != 0 {
+		unix.Close(fd)
+		return nil, fmt.Errorf("TUNSETIFF: %w", errno)
+	}
+	if offloads != 0 {
+		if err := unix.IoctlSetInt(fd, unix.TUNSETOFFLOAD, offloads); err != nil {
+			unix.Close(fd)
+			return nil, fmt.Errorf("TUNSETOFFLOAD: %w", err)
+		}
+	}
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "/dev/net/tun"), nil
+}
+
+// createTAP creates the TAP device name, for CreateTUN.
+func createTAP(name string, mtu int) (tun.Device, error) {
+	f, err := openDevTUN(name, unix.IFF_TAP|unix.IFF_NO_PI, 0)
+	if err != nil {
+		return nil, err
+	}
+	dev, err := tun.CreateTUNFromFile(f, mtu)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return newTAPDevice(dev, f), nil
+}
+
+// offloadTUN is a TUN opened with virtio-net headers. Its Read splits
+// the TCP segments the kernel leaves to it, and WriteBatch coalesces
+// them. The wrapped tun.Device does everything else.
+type offloadTUN struct {
+	tun.Device
+	f *os.File
+
+	// Read is only called by TUN.poll, so these are unsynchronized.
+	rbuf   []byte   // virtio-net header and packet read from f
+	segBuf []byte   // backing storage of segs
+	segs   [][]byte // segments yet to be returned by Read
+}
+
+func newOffloadTUN(dev tun.Device, f *os.File) *offloadTUN {
+	return &offloadTUN{
+		Device: dev,
+		f:      f,
+		rbuf:   make([]byte, virtioNetHdrLen+maxBufferSize),
+	}
+}
+
+func (t *offloadTUN) File() *os.File {
+	return t.f
+}
+
+// Read reads one packet into buf[offset:], returning the next segment
+// of a split one if any are left. Packets that can't be made sense
+// of are dropped by returning 0, as read errors are fatal to
+// WireGuard.
+func (t *offloadTUN) Read(buf []byte, offset int) (int, error) {
+	if len(t.segs) > 0 {
+		n := copy(buf[offset:], t.segs[0])
+		t.segs[0] = nil
+		t.segs = t.segs[1:]
+		return n, nil
+	}
+	n, err := t.f.Read(t.rbuf)
+	if err != nil {
+		return 0, err
+	}
+	var h virtioNetHdr
+	if !h.decode(t.rbuf[:n]) {
+		return 0, nil
+	}
+	pkt := t.rbuf[virtioNetHdrLen:n]
+	if h.gsoType == virtioNetHdrGSONone {
+		if h.flags&virtioNetHdrFNeedsCsum != 0 && !finishChecksum(pkt, h) {
+			return 0, nil
+		}
+		return copy(buf[offset:], pkt), nil
+	}
+	t.segBuf, t.segs, err = tsoSplit(pkt, h, t.segBuf, t.segs[:0])
+	if err != nil || len(t.segs) == 0 {
+		return 0, nil
+	}
+	return t.Read(buf, offset)
+}
+
+// Write writes the packet at buf[offset:], with a virtio-net header in
+// the bytes before it.
+func (t *offloadTUN) Write(buf []byte, offset int) (int, error) {
+	if offset < virtioNetHdrLen {
+		return 0, errOffsetTooSmall
+	}
+	var h virtioNetHdr
+	h.encode(buf[offset-virtioNetHdrLen:])
+	n, err := t.f.Write(buf[offset-virtioNetHdrLen:])
+	if n > virtioNetHdrLen {
+		n -= virtioNetHdrLen
+	} else {
+		n = 0
+	}
+	return n, err
+}
+
+// WriteBatch writes the packets in pkts, each starting at offset in its
+// buffer, coalescing consecutive segments of TCP streams. It may
+// modify the buffers.
+func (t *offloadTUN) WriteBatch(pkts [][]byte, offset int) error {
+	if offset < virtioNetHdrLen {
+		return errOffsetTooSmall
+	}
+	var firstErr error
+	for _, pkt := range groCoalesce(pkts, offset, make([][]byte, 0, len(pkts))) {
+		if _, err := t.f.Write(pkt); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestTSOSplitAndCoalesce(t *testing.T) {
+	const mss = 1000
+	// tcpPacket returns a TCP segment with the given payload and a
+	// partial checksum, as the kernel hands it over for TSO.
+	tcpPacket := func(ipVersion int, payload []byte) []byte {
+		ipLen := 20
+		if ipVersion == 6 {
+			ipLen = 40
+		}
+		pkt := make([]byte, ipLen+24+len(payload))
+		if ipVersion == 4 {
+			pkt[0] = 0x45
+			binary.BigEndian.PutUint16(pkt[4:], 77)     // ID
+			binary.BigEndian.PutUint16(pkt[6:], 0x4000) // DF
+			pkt[8] = 64
+			pkt[9] = 6
+			copy(pkt[12:], []byte{100, 64, 0, 1, 100, 64, 0, 2})
+		} else {
+			pkt[0] = 0x60
+			pkt[6] = 6
+			pkt[7] = 64
+			pkt[8], pkt[23] = 0xfd, 1
+			pkt[24], pkt[39] = 0xfd, 2
+		}
+		tcp := pkt[ipLen:]
+		binary.BigEndian.PutUint16(tcp[0:], 1234)
+		binary.BigEndian.PutUint16(tcp[2:], 80)
+		binary.BigEndian.PutUint32(tcp[4:], 0xfffffe00) // wraps
+		binary.BigEndian.PutUint32(tcp[8:], 42)
+		tcp[12] = 6 << 4
+		tcp[13] = tcpACK | tcpPSH
+		binary.BigEndian.PutUint16(tcp[14:], 512)
+		copy(tcp[20:], []byte{1, 1, 1, 0}) // NOP options
+		copy(tcp[24:], payload)
+		setLengths(pkt, ipLen, 0, false)
+		return pkt
+	}
+	validChecksums := func(pkt []byte, tcpStart int) bool {
+		if pkt[0]>>4 == 4 && checksumFold(checksumAdd(0, pkt[:tcpStart])) != 0xffff {
+			return false
+		}
+		sum := checksumAdd(pseudoHeaderSum(pkt, len(pkt)-tcpStart), pkt[tcpStart:])
+		return checksumFold(sum) == 0xffff
+	}
+
+	payload := make([]byte, 2*mss+500)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	for _, v := range []int{4, 6} {
+		pkt := tcpPacket(v, payload)
+		tcpStart, hdrLen, ok := tcpHeaders(pkt)
+		if !ok {
+			t.Fatalf("v%d: tcpHeaders failed", v)
+		}
+		h := virtioNetHdr{
+			flags:      virtioNetHdrFNeedsCsum,
+			gsoType:    virtioNetHdrGSOTCPv4,
+			hdrLen:     uint16(hdrLen),
+			gsoSize:    mss,
+			csumStart:  uint16(tcpStart),
+			csumOffset: 16,
+		}
+		if v == 6 {
+			h.gsoType = virtioNetHdrGSOTCPv6
+		}
+
+		_, segs, err := tsoSplit(pkt, h, nil, nil)
+		if err != nil {
+			t.Fatalf("v%d: tsoSplit: %v", v, err)
+		}
+		if len(segs) != 3 {
+			t.Fatalf("v%d: got %d segments; want 3", v, len(segs))
+		}
+		for i, seg := range segs {
+			if !validChecksums(seg, tcpStart) {
+				t.Errorf("v%d: segment %d has bad checksums", v, i)
+			}
+			if psh := seg[tcpStart+13]&tcpPSH != 0; psh != (i == 2) {
+				t.Errorf("v%d: segment %d PSH = %v", v, i, psh)
+			}
+		}
+
+		// Coalescing the segments again gives back the original.
+		const offset = PacketStartOffset
+		var pkts [][]byte
+		for _, seg := range segs {
+			buf := make([]byte, offset, maxBufferSize)
+			pkts = append(pkts, append(buf, seg...))
+		}
+		out := groCoalesce(pkts, offset, nil)
+		if len(out) != 1 {
+			t.Fatalf("v%d: coalesced into %d packets; want 1", v, len(out))
+		}
+		var got virtioNetHdr
+		got.decode(out[0])
+		if got != h {
+			t.Errorf("v%d: header = %+v; want %+v", v, got, h)
+		}
+		if !bytes.Equal(out[0][virtioNetHdrLen:], pkt) {
+			t.Errorf("v%d: coalesced packet differs from the original", v)
+		}
+
+		// A partial checksum is finished.
+		finishChecksum(pkt, h)
+		if !validChecksums(pkt, tcpStart) {
+			t.Errorf("v%d: finishChecksum left a bad checksum", v)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"sort"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+)
+
+// peerMTU is the largest packet that fits the path to the peer IPs
+// or subnets in pfx.
+type peerMTU struct {
+	pfx netaddr.IPPrefix
+	mtu int
+}
+
+// SetPeerMTUs sets the size of the largest packet that can be sent
+// to each of the given peer IPs or subnets, replacing any set before.
+// The TUN's own MTU applies to traffic to everywhere else.
+//
+// A packet to one of them that's too large is handled as a router on
+// its way would: an IPv4 packet without the Don't Fragment bit is
+// fragmented to fit. Otherwise it's dropped, and an ICMP error saying
+// how large a packet can be is sent back, so that the sender sends
+// smaller ones.
+//
+// The map ownership passes to the TUN.
+func (t *TUN) SetPeerMTUs(m map[netaddr.IPPrefix]int) {
+	mtus := make([]peerMTU, 0, len(m))
+	for pfx, mtu := range m {
+		mtus = append(mtus, peerMTU{pfx, mtu})
+	}
+	sort.Slice(mtus, func(i, j int) bool {
+		return mtus[i].pfx.Bits > mtus[j].pfx.Bits
+	})
+	t.peerMTUs.Store(mtus)
+}
+
+// PeerMTUs returns the MTUs set by SetPeerMTUs.
+func (t *TUN) PeerMTUs() map[netaddr.IPPrefix]int {
+	mtus, _ := t.peerMTUs.Load().([]peerMTU)
+	m := make(map[netaddr.IPPrefix]int, len(mtus))
+	for _, pm := range mtus {
+		m[pm.pfx] = pm.mtu
+	}
+	return m
+}
+
+// fitPeerMTU makes p, of size n at the start of buf, fit the MTU of
+// the path to its destination, and returns its new size. If p is too
+// big, it either fragments p, leaving the first fragment in buf and p
+// and the rest for Read to return next, or it sends p's sender an
+// ICMP error and returns 0.
+func (t *TUN) fitPeerMTU(p *packet.Parsed, buf []byte, n int) int {
+	mtus, _ := t.peerMTUs.Load().([]peerMTU)
+	if len(mtus) == 0 {
+		return n
+	}
+	var dst netaddr.IP
+	switch p.IPVersion {
+	case 4:
+		dst = p.DstIP4.Netaddr()
+	case 6:
+		dst = p.DstIP6.Netaddr()
+	default:
+		return n
+	}
+	for _, pm := range mtus {
+		if !pm.pfx.Contains(dst) {
+			continue
+		}
+		if n <= pm.mtu {
+			return n
+		}
+		if frags := p.Fragment(pm.mtu); frags != nil {
+			t.fragsMu.Lock()
+			t.frags = append(t.frags, frags[1:]...)
+			t.fragsMu.Unlock()
+			n = copy(buf, frags[0])
+			p.Decode(buf[:n])
+			return n
+		}
+		if err := t.InjectInboundCopy(p.TooBig(pm.mtu)); err != nil {
+			t.logf("sending packet too big to %v: %v", p, err)
+		}
+		return 0
+	}
+	return n
+}
+
+// nextFrag returns the next fragment queued by fitPeerMTU, if any.
+func (t *TUN) nextFrag() []byte {
+	t.fragsMu.Lock()
+	defer t.fragsMu.Unlock()
+	if len(t.frags) == 0 {
+		return nil
+	}
+	f := t.frags[0]
+	t.frags[0] = nil
+	t.frags = t.frags[1:]
+	if len(t.frags) == 0 {
+		t.frags = nil
+	}
+	return f
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+)
+
+func TestPeerMTUs(t *testing.T) {
+	chtun, tun := newChannelTUN(t.Logf, false)
+	defer tun.Close()
+
+	tun.SetPeerMTUs(map[netaddr.IPPrefix]int{
+		nets("5.6.7.0/24")[0]: 1280,
+		nets("5.6.7.8")[0]:    30,
+	})
+	if got := tun.PeerMTUs(); len(got) != 2 {
+		t.Errorf("PeerMTUs = %v; want 2", got)
+	}
+
+	src := packet.IP4FromNetaddr(netaddr.IPv4(1, 2, 3, 4))
+	fits := udp(src, packet.IP4FromNetaddr(netaddr.IPv4(5, 6, 7, 9)), 1, 2)
+	tooBig := udp(src, packet.IP4FromNetaddr(netaddr.IPv4(5, 6, 7, 8)), 1, 2)
+	go func() {
+		chtun.Outbound <- tooBig
+		chtun.Outbound <- fits
+	}()
+
+	reads := make(chan int, 2)
+	go func() {
+		var buf [MaxPacketSize]byte
+		for i := 0; i < 2; i++ {
+			n, err := tun.Read(buf[:], 0)
+			if err != nil {
+				t.Errorf("read %d: %v", i, err)
+			}
+			reads <- n
+		}
+	}()
+
+	select {
+	case b := <-chtun.Inbound:
+		var p packet.Parsed
+		p.Decode(b)
+		if !p.IsError() || p.DstIP4 != src {
+			t.Errorf("sent back %v; want an ICMP error to %v", &p, src)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no ICMP error sent back")
+	}
+	if n := <-reads; n != 0 {
+		t.Errorf("read %d bytes of the packet too big; want 0", n)
+	}
+	if n := <-reads; n != len(fits) {
+		t.Errorf("read %d bytes; want %d", n, len(fits))
+	}
+}
+
+func TestPeerMTUFragments(t *testing.T) {
+	chtun, tun := newChannelTUN(t.Logf, false)
+	defer tun.Close()
+
+	tun.SetPeerMTUs(map[netaddr.IPPrefix]int{
+		nets("5.6.7.0/24")[0]: 1280,
+	})
+
+	src := packet.IP4FromNetaddr(netaddr.IPv4(1, 2, 3, 4))
+	dst := packet.IP4FromNetaddr(netaddr.IPv4(5, 6, 7, 8))
+	big := packet.Generate(&packet.UDP4Header{
+		IP4Header: packet.IP4Header{SrcIP: src, DstIP: dst},
+		SrcPort:   1,
+		DstPort:   2,
+	}, make([]byte, 2000))
+	df := append([]byte(nil), big...)
+	df[6] |= 0x40 // Don't Fragment
+	go func() {
+		chtun.Outbound <- big
+		chtun.Outbound <- df
+	}()
+
+	// big goes out in two fragments; df is bounced.
+	reads := make(chan int, 3)
+	go func() {
+		var buf [MaxPacketSize]byte
+		for i := 0; i < 3; i++ {
+			n, err := tun.Read(buf[:], 0)
+			if err != nil {
+				t.Errorf("read %d: %v", i, err)
+			}
+			reads <- n
+		}
+	}()
+	select {
+	case b := <-chtun.Inbound:
+		var p packet.Parsed
+		p.Decode(b)
+		if !p.IsError() || p.DstIP4 != src {
+			t.Errorf("sent back %v; want an ICMP error to %v", &p, src)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no ICMP error sent back for the Don't Fragment packet")
+	}
+	for i, want := range []int{1276, 772, 0} {
+		if n := <-reads; n != want {
+			t.Errorf("read %d: %d bytes; want %d", i, n, want)
+		}
+	}
+}
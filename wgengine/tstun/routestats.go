@@ -0,0 +1,98 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"sync/atomic"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+)
+
+// RouteBytes is the traffic through a subnet route this node
+// advertises, since the route was set with SetCountedRoutes.
+type RouteBytes struct {
+	Route   netaddr.IPPrefix
+	RxBytes int64 // from peers into the route's subnet
+	TxBytes int64 // from the route's subnet to peers
+}
+
+// routeCounter counts the traffic through a route.
+type routeCounter struct {
+	route  netaddr.IPPrefix
+	rx, tx int64 // accessed atomically
+}
+
+// SetCountedRoutes sets the subnet routes whose traffic to and from
+// peers is counted, for RouteCounts. Routes that were already counted
+// keep their counts.
+func (t *TUN) SetCountedRoutes(routes []netaddr.IPPrefix) {
+	t.routeMu.Lock()
+	defer t.routeMu.Unlock()
+	old := make(map[netaddr.IPPrefix]*routeCounter)
+	oldCounters, _ := t.routeCounters.Load().([]*routeCounter)
+	for _, rc := range oldCounters {
+		old[rc.route] = rc
+	}
+	var rcs []*routeCounter
+	for _, r := range routes {
+		rc := old[r]
+		if rc == nil {
+			rc = &routeCounter{route: r}
+		}
+		rcs = append(rcs, rc)
+	}
+	t.routeCounters.Store(rcs)
+}
+
+// RouteCounts returns the traffic through each route set with
+// SetCountedRoutes.
+func (t *TUN) RouteCounts() []RouteBytes {
+	rcs, _ := t.routeCounters.Load().([]*routeCounter)
+	ret := make([]RouteBytes, 0, len(rcs))
+	for _, rc := range rcs {
+		ret = append(ret, RouteBytes{
+			Route:   rc.route,
+			RxBytes: atomic.LoadInt64(&rc.rx),
+			TxBytes: atomic.LoadInt64(&rc.tx),
+		})
+	}
+	return ret
+}
+
+// countRoute adds p to the counts of the first counted route that
+// contains its destination, if it's inbound from a peer, or its
+// source, if it's outbound to one.
+func (t *TUN) countRoute(p *packet.Parsed, inbound bool) {
+	rcs, _ := t.routeCounters.Load().([]*routeCounter)
+	if len(rcs) == 0 {
+		return
+	}
+	var ip netaddr.IP
+	switch {
+	case p.IPVersion == 4 && inbound:
+		ip = p.DstIP4.Netaddr()
+	case p.IPVersion == 4:
+		ip = p.SrcIP4.Netaddr()
+	case p.IPVersion == 6 && inbound:
+		ip = p.DstIP6.Netaddr()
+	case p.IPVersion == 6:
+		ip = p.SrcIP6.Netaddr()
+	default:
+		return
+	}
+	for _, rc := range rcs {
+		if !rc.route.Contains(ip) {
+			continue
+		}
+		n := int64(len(p.Buffer()))
+		if inbound {
+			atomic.AddInt64(&rc.rx, n)
+		} else {
+			atomic.AddInt64(&rc.tx, n)
+		}
+		return
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+)
+
+// Shape is a cap on the rate of the traffic a TUN sends to a peer or
+// a subnet routed through one, such as to keep backups to a remote
+// site from taking all of its link.
+//
+// Traffic over the rate is queued and sent as the rate allows, for up
+// to maxShapeDelay; traffic that would wait longer is dropped, which
+// makes TCP senders slow down.
+type Shape struct {
+	// Kbps is the rate, in kilobits per second.
+	Kbps int64
+	// BurstBytes is how many bytes can be sent at once, beyond the
+	// rate, after a lull. 0 means a tenth of a second's worth.
+	BurstBytes int `json:",omitempty"`
+}
+
+// maxShapeDelay is the longest a packet is queued by its Shape.
+const maxShapeDelay = 250 * time.Millisecond
+
+// SetShapes sets the rate caps on the traffic to the given peer IPs
+// or subnets, replacing any set before. Traffic to an address in
+// several of them is capped by the narrowest.
+//
+// The map ownership passes to the TUN.
+func (t *TUN) SetShapes(m map[netaddr.IPPrefix]Shape) {
+	var shapers []*shaper
+	for pfx, s := range m {
+		if s.Kbps > 0 {
+			shapers = append(shapers, newShaper(pfx, s, t.InjectOutbound))
+		}
+	}
+	sort.Slice(shapers, func(i, j int) bool {
+		return shapers[i].pfx.Bits > shapers[j].pfx.Bits
+	})
+	t.shapers.Store(shapers)
+}
+
+// Shapes returns the rate caps set by SetShapes.
+func (t *TUN) Shapes() map[netaddr.IPPrefix]Shape {
+	shapers, _ := t.shapers.Load().([]*shaper)
+	m := make(map[netaddr.IPPrefix]Shape, len(shapers))
+	for _, s := range shapers {
+		m[s.pfx] = s.shape
+	}
+	return m
+}
+
+// shape applies the rate cap, if any, on the traffic to p's
+// destination to pkt, p's bytes. It reports whether pkt should go on
+// as usual. If not, pkt was either dropped, or copied and queued to
+// be sent when the rate allows.
+func (t *TUN) shape(p *packet.Parsed, pkt []byte) bool {
+	shapers, _ := t.shapers.Load().([]*shaper)
+	if len(shapers) == 0 {
+		return true
+	}
+	var dst netaddr.IP
+	switch p.IPVersion {
+	case 4:
+		dst = p.DstIP4.Netaddr()
+	case 6:
+		dst = p.DstIP6.Netaddr()
+	default:
+		return true
+	}
+	for _, s := range shapers {
+		if s.pfx.Contains(dst) {
+			return s.admit(pkt, time.Now())
+		}
+	}
+	return true
+}
+
+// shaper is the token bucket and queue of one Shape.
+type shaper struct {
+	pfx   netaddr.IPPrefix
+	shape Shape
+	rate  float64 // bytes per second
+	burst float64 // bytes
+	send  func([]byte) error
+
+	mu      sync.Mutex
+	tokens  float64 // bytes that can be sent now
+	last    time.Time
+	queue   [][]byte
+	queued  int  // bytes in queue
+	pending bool // whether a drain is scheduled or running
+}
+
+func newShaper(pfx netaddr.IPPrefix, s Shape, send func([]byte) error) *shaper {
+	rate := float64(s.Kbps) * 1000 / 8
+	burst := float64(s.BurstBytes)
+	if burst == 0 {
+		burst = rate / 10
+	}
+	if burst < MaxPacketSize {
+		burst = MaxPacketSize
+	}
+	return &shaper{
+		pfx:    pfx,
+		shape:  s,
+		rate:   rate,
+		burst:  burst,
+		send:   send,
+		tokens: burst,
+	}
+}
+
+// refill adds the tokens earned since the last refill.
+//
+// s.mu must be held.
+func (s *shaper) refill(now time.Time) {
+	if !s.last.IsZero() {
+		s.tokens += now.Sub(s.last).Seconds() * s.rate
+		if s.tokens > s.burst {
+			s.tokens = s.burst
+		}
+	}
+	s.last = now
+}
+
+// wait returns how long until the packet at the head of the queue
+// can be sent.
+//
+// s.mu must be held.
+func (s *shaper) wait() time.Duration {
+	return time.Duration((float64(len(s.queue[0])) - s.tokens) / s.rate * float64(time.Second))
+}
+
+// admit reports whether pkt can be sent now. If not, it queues a
+// copy of it, unless it would wait too long.
+func (s *shaper) admit(pkt []byte, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refill(now)
+	n := float64(len(pkt))
+	if len(s.queue) == 0 && s.tokens >= n {
+		s.tokens -= n
+		return true
+	}
+	if (float64(s.queued)+n-s.tokens)/s.rate*float64(time.Second) > float64(maxShapeDelay) {
+		return false
+	}
+	s.queue = append(s.queue, append([]byte(nil), pkt...))
+	s.queued += len(pkt)
+	if !s.pending {
+		s.pending = true
+		time.AfterFunc(s.wait(), s.drain)
+	}
+	return false
+}
+
+// drain sends the queued packets that the rate allows, in order, and
+// schedules itself again for the rest.
+func (s *shaper) drain() {
+	s.mu.Lock()
+	s.refill(time.Now())
+	var batch [][]byte
+	for len(s.queue) > 0 && s.tokens >= float64(len(s.queue[0])) {
+		pkt := s.queue[0]
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		s.queued -= len(pkt)
+		s.tokens -= float64(len(pkt))
+		batch = append(batch, pkt)
+	}
+	s.mu.Unlock()
+
+	// Sending blocks until the TUN is read, which takes s.mu on
+	// its way, so s.mu can't be held. s.pending keeps admit from
+	// scheduling another drain, which could overtake this one.
+	for _, pkt := range batch {
+		if err := s.send(pkt); err != nil {
+			break
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) == 0 {
+		s.pending = false
+		return
+	}
+	time.AfterFunc(s.wait(), s.drain)
+}
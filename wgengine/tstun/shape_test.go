@@ -0,0 +1,76 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/types/logger"
+)
+
+func TestShapes(t *testing.T) {
+	tun := WrapTUN(logger.Discard, NewFakeTUN())
+	defer tun.Close()
+
+	mustPrefix := func(s string) netaddr.IPPrefix {
+		pfx, err := netaddr.ParseIPPrefix(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pfx
+	}
+	site := mustPrefix("10.2.0.0/16")
+	host := mustPrefix("10.2.0.5/32")
+	tun.SetShapes(map[netaddr.IPPrefix]Shape{
+		site:                      {Kbps: 50000},
+		host:                      {Kbps: 1000},
+		mustPrefix("10.3.0.0/16"): {},
+	})
+	if got := tun.Shapes(); len(got) != 2 {
+		t.Errorf("Shapes = %v; want the 2 non-zero ones", got)
+	}
+	shapers := tun.shapers.Load().([]*shaper)
+	if shapers[0].pfx != host {
+		t.Errorf("first shaper is for %v; want the narrowest, %v", shapers[0].pfx, host)
+	}
+}
+
+func TestShaper(t *testing.T) {
+	sent := make(chan []byte, 1)
+	send := func(b []byte) error {
+		sent <- b
+		return nil
+	}
+	// 1 MB/s, with a burst of 100 kB.
+	s := newShaper(netaddr.IPPrefix{}, Shape{Kbps: 8000, BurstBytes: 100000}, send)
+
+	now := time.Now()
+	if !s.admit(make([]byte, 60000), now) {
+		t.Fatal("packet within the burst held back")
+	}
+	// 40 kB of tokens are left, so this waits 20ms.
+	queued := make([]byte, 60000)
+	if s.admit(queued, now) {
+		t.Fatal("packet over the burst not held back")
+	}
+	// This would wait 320ms, which is too long.
+	if s.admit(make([]byte, 300000), now) {
+		t.Fatal("packet over the queue limit not dropped")
+	}
+	select {
+	case got := <-sent:
+		if len(got) != len(queued) {
+			t.Errorf("sent %d bytes; want %d", len(got), len(queued))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued packet never sent")
+	}
+	time.Sleep(400 * time.Millisecond)
+	if len(sent) != 0 {
+		t.Error("dropped packet was sent")
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/tailscale/wireguard-go/tun"
+	"inet.af/netaddr"
+	"tailscale.com/net/tsaddr"
+)
+
+// TAPPrefix is the prefix of the names given to CreateTUN for a TAP
+// device, which carries Ethernet frames rather than IP packets, instead
+// of a TUN. It's for attaching the engine to a bridge or a VM's NIC,
+// where hypervisors want a layer 2 device.
+const TAPPrefix = "tap:"
+
+const (
+	ethHdrLen = 14
+
+	etherTypeIPv4 = 0x0800
+	etherTypeARP  = 0x0806
+	etherTypeIPv6 = 0x86dd
+)
+
+// tapDevice adapts a TAP device to the tun.Device interface, so that
+// it carries IP packets. It acts as the router to the Tailscale IPs of
+// the tailnet for the hosts on the TAP: it answers ARP and NDP for
+// them with its own MAC address, and learns the hosts' MAC addresses
+// from the frames they send, to address the frames it sends them.
+type tapDevice struct {
+	tun.Device               // the TAP's, for everything but Read and Write
+	rw         io.ReadWriter // the TAP's frames
+	mac        [6]byte       // the engine's MAC address on the TAP
+
+	mu    sync.Mutex
+	neigh map[netaddr.IP][6]byte // the hosts' MAC addresses
+}
+
+func newTAPDevice(dev tun.Device, rw io.ReadWriter) *tapDevice {
+	t := &tapDevice{
+		Device: dev,
+		rw:     rw,
+		neigh:  make(map[netaddr.IP][6]byte),
+	}
+	rand.Read(t.mac[:])
+	t.mac[0] = t.mac[0]&^1 | 2 // unicast, locally administered
+	return t
+}
+
+// Read reads a frame into buf, returning the IP packet in it at
+// buf[offset:]. Frames that aren't IP packets for the engine, such as
+// ARP and NDP, are handled here or dropped, and read as 0 bytes.
+func (t *tapDevice) Read(buf []byte, offset int) (int, error) {
+	if offset < ethHdrLen {
+		return 0, errOffsetTooSmall
+	}
+	n, err := t.rw.Read(buf[offset-ethHdrLen:])
+	if err != nil || n < ethHdrLen {
+		return 0, err
+	}
+	frame := buf[offset-ethHdrLen : offset-ethHdrLen+n]
+	dst := frame[:6]
+	if dst[0]&1 == 0 && string(dst) != string(t.mac[:]) {
+		// Unicast to another host on the bridge.
+		return 0, nil
+	}
+	var src [6]byte
+	copy(src[:], frame[6:12])
+	pkt := frame[ethHdrLen:]
+	switch binary.BigEndian.Uint16(frame[12:]) {
+	case etherTypeIPv4:
+		if len(pkt) < 20 || pkt[0]>>4 != 4 {
+			return 0, nil
+		}
+		t.learn(netaddr.IPv4(pkt[12], pkt[13], pkt[14], pkt[15]), src)
+		return len(pkt), nil
+	case etherTypeIPv6:
+		if len(pkt) < 40 || pkt[0]>>4 != 6 {
+			return 0, nil
+		}
+		var ip [16]byte
+		copy(ip[:], pkt[8:24])
+		if srcIP := netaddr.IPFrom16(ip); !isUnspecified(srcIP) {
+			t.learn(srcIP, src)
+		}
+		if isNeighborSolicitation(pkt) {
+			t.handleNeighborSolicitation(pkt, src)
+			return 0, nil
+		}
+		return len(pkt), nil
+	case etherTypeARP:
+		t.handleARP(pkt, src)
+	}
+	return 0, nil
+}
+
+// Write writes the IP packet at buf[offset:] in a frame to the host
+// with its destination address, or to all of them if it's unknown.
+func (t *tapDevice) Write(buf []byte, offset int) (int, error) {
+	if offset < ethHdrLen {
+		return 0, errOffsetTooSmall
+	}
+	pkt := buf[offset:]
+	var dst netaddr.IP
+	var etherType uint16
+	switch {
+	case len(pkt) >= 20 && pkt[0]>>4 == 4:
+		dst = netaddr.IPv4(pkt[16], pkt[17], pkt[18], pkt[19])
+		etherType = etherTypeIPv4
+	case len(pkt) >= 40 && pkt[0]>>4 == 6:
+		var ip [16]byte
+		copy(ip[:], pkt[24:40])
+		dst = netaddr.IPFrom16(ip)
+		etherType = etherTypeIPv6
+	default:
+		return 0, nil
+	}
+	frame := buf[offset-ethHdrLen:]
+	t.putEthHdr(frame, t.lookup(dst), etherType)
+	n, err := t.rw.Write(frame)
+	if n > ethHdrLen {
+		n -= ethHdrLen
+	} else {
+		n = 0
+	}
+	return n, err
+}
+
+// putEthHdr puts an Ethernet header from t to dst in frame.
+func (t *tapDevice) putEthHdr(frame []byte, dst [6]byte, etherType uint16) {
+	copy(frame[0:6], dst[:])
+	copy(frame[6:12], t.mac[:])
+	binary.BigEndian.PutUint16(frame[12:], etherType)
+}
+
+// learn records mac as the MAC address of the host with IP ip.
+func (t *tapDevice) learn(ip netaddr.IP, mac [6]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.neigh[ip] = mac
+}
+
+var broadcastMAC = [6]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// lookup returns the MAC address of the host with IP ip, or the
+// broadcast address if it's unknown.
+func (t *tapDevice) lookup(ip netaddr.IP) [6]byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if mac, ok := t.neigh[ip]; ok {
+		return mac
+	}
+	return broadcastMAC
+}
+
+// shouldAnswer reports whether t answers for target, asked by sender:
+// whether it's the Tailscale IP of a peer rather than of a host on
+// the TAP. Probes for duplicates, from the unspecified address, are
+// never answered.
+func (t *tapDevice) shouldAnswer(target, sender netaddr.IP) bool {
+	if !tsaddr.IsTailscaleIP(target) || target == sender || isUnspecified(sender) {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, onTAP := t.neigh[target]
+	return !onTAP
+}
+
+// handleARP answers pkt, an ARP packet from src, if it asks for an
+// address t answers for.
+func (t *tapDevice) handleARP(pkt []byte, src [6]byte) {
+	// Ethernet and IPv4, with 6 and 4 byte addresses; a request.
+	if len(pkt) < 28 || string(pkt[:8]) != "\x00\x01\x08\x00\x06\x04\x00\x01" {
+		return
+	}
+	sender := netaddr.IPv4(pkt[14], pkt[15], pkt[16], pkt[17])
+	target := netaddr.IPv4(pkt[24], pkt[25], pkt[26], pkt[27])
+	if !isUnspecified(sender) {
+		t.learn(sender, src)
+	}
+	if !t.shouldAnswer(target, sender) {
+		return
+	}
+
+	var reply [ethHdrLen + 28]byte
+	t.putEthHdr(reply[:], src, etherTypeARP)
+	arp := reply[ethHdrLen:]
+	copy(arp, "\x00\x01\x08\x00\x06\x04\x00\x02")
+	copy(arp[8:14], t.mac[:])
+	copy(arp[14:18], pkt[24:28])
+	copy(arp[18:24], pkt[8:14])
+	copy(arp[24:28], pkt[14:18])
+	t.rw.Write(reply[:])
+}
+
+func isUnspecified(ip netaddr.IP) bool {
+	return ip == netaddr.IPv4(0, 0, 0, 0) || ip == netaddr.IPFrom16([16]byte{})
+}
+
+// isNeighborSolicitation reports whether pkt, an IPv6 packet, is an
+// NDP Neighbor Solicitation.
+func isNeighborSolicitation(pkt []byte) bool {
+	return len(pkt) >= 40+24 && pkt[6] == 58 && pkt[7] == 255 && pkt[40] == 135 && pkt[41] == 0
+}
+
+// handleNeighborSolicitation answers pkt, a Neighbor Solicitation from
+// src, if it asks for an address t answers for.
+func (t *tapDevice) handleNeighborSolicitation(pkt []byte, src [6]byte) {
+	var ip [16]byte
+	copy(ip[:], pkt[8:24])
+	sender := netaddr.IPFrom16(ip)
+	copy(ip[:], pkt[48:64])
+	target := netaddr.IPFrom16(ip)
+	if !t.shouldAnswer(target, sender) {
+		return
+	}
+
+	// A Neighbor Advertisement, solicited and overriding, with the
+	// target link-layer address option.
+	var reply [ethHdrLen + 40 + 32]byte
+	t.putEthHdr(reply[:], src, etherTypeIPv6)
+	ip6 := reply[ethHdrLen:]
+	ip6[0] = 0x60
+	binary.BigEndian.PutUint16(ip6[4:], 32)
+	ip6[6] = 58
+	ip6[7] = 255
+	copy(ip6[8:24], pkt[48:64])
+	copy(ip6[24:40], pkt[8:24])
+	na := ip6[40:]
+	na[0] = 136
+	na[4] = 0x60
+	copy(na[8:24], pkt[48:64])
+	na[24] = 2
+	na[25] = 1
+	copy(na[26:32], t.mac[:])
+	sum := checksumAdd(0, ip6[8:40]) + 32 + 58
+	binary.BigEndian.PutUint16(na[2:], ^checksumFold(checksumAdd(sum, na)))
+	t.rw.Write(reply[:])
+}
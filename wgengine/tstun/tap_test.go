@@ -0,0 +1,106 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// frameRW is the frames read from and written to a TAP.
+type frameRW struct {
+	in, out [][]byte
+}
+
+func (f *frameRW) Read(b []byte) (int, error) {
+	n := copy(b, f.in[0])
+	f.in = f.in[1:]
+	return n, nil
+}
+
+func (f *frameRW) Write(b []byte) (int, error) {
+	f.out = append(f.out, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func TestTAP(t *testing.T) {
+	rw := new(frameRW)
+	dev := newTAPDevice(NewFakeTUN(), rw)
+	hostMAC := []byte{2, 0, 0, 0, 0, 1}
+	frame := func(dst []byte, etherType uint16, payload []byte) []byte {
+		b := append(append(append([]byte(nil), dst...), hostMAC...), 0, 0)
+		binary.BigEndian.PutUint16(b[12:], etherType)
+		return append(b, payload...)
+	}
+	// An ARP request from the host, 100.64.0.1, for 100.64.0.2.
+	arpRequest := func(target byte) []byte {
+		arp := []byte("\x00\x01\x08\x00\x06\x04\x00\x01")
+		arp = append(arp, hostMAC...)
+		arp = append(arp, 100, 64, 0, 1)
+		arp = append(arp, 0, 0, 0, 0, 0, 0)
+		arp = append(arp, 100, 64, 0, target)
+		return frame(broadcastMAC[:], etherTypeARP, arp)
+	}
+	var buf [maxBufferSize]byte
+	const offset = PacketStartOffset
+
+	rw.in = append(rw.in, arpRequest(2), arpRequest(1))
+	if n, err := dev.Read(buf[:], offset); n != 0 || err != nil {
+		t.Fatalf("ARP read = %d, %v; want 0, nil", n, err)
+	}
+	if len(rw.out) != 1 {
+		t.Fatalf("got %d replies to ARP; want 1", len(rw.out))
+	}
+	reply := rw.out[0]
+	if !bytes.Equal(reply[:6], hostMAC) || !bytes.Equal(reply[22:28], dev.mac[:]) || !bytes.Equal(reply[28:32], []byte{100, 64, 0, 2}) {
+		t.Errorf("bad ARP reply % x", reply)
+	}
+	// The host's own address isn't answered for.
+	dev.Read(buf[:], offset)
+	if len(rw.out) != 1 {
+		t.Errorf("answered ARP for the host's own address")
+	}
+
+	// IP packets come out of frames, and go back in them to the
+	// host's MAC address.
+	pkt := udp(0x64400001, 0x64400002, 1, 2)
+	rw.in = append(rw.in, frame(dev.mac[:], etherTypeIPv4, pkt))
+	n, err := dev.Read(buf[:], offset)
+	if err != nil || !bytes.Equal(buf[offset:offset+n], pkt) {
+		t.Fatalf("IP read = %x, %v; want %x", buf[offset:offset+n], err, pkt)
+	}
+	copy(buf[offset:], udp(0x64400002, 0x64400001, 2, 1))
+	if _, err := dev.Write(buf[:offset+len(pkt)], offset); err != nil {
+		t.Fatal(err)
+	}
+	if got := rw.out[len(rw.out)-1]; !bytes.Equal(got[:6], hostMAC) || binary.BigEndian.Uint16(got[12:]) != etherTypeIPv4 {
+		t.Errorf("bad frame header % x", got[:ethHdrLen])
+	}
+
+	// A Neighbor Solicitation for fd7a:115c:a1e0::2 from ::1 gets an
+	// advertisement with a valid checksum.
+	ns := make([]byte, 40+32)
+	ns[0] = 0x60
+	binary.BigEndian.PutUint16(ns[4:], 32)
+	ns[6], ns[7] = 58, 255
+	copy(ns[8:24], []byte{0xfd, 0x7a, 0x11, 0x5c, 0xa1, 0xe0, 15: 1})
+	copy(ns[24:40], []byte{0xff, 0x02, 11: 1, 12: 0xff, 15: 2})
+	ns[40] = 135
+	copy(ns[48:64], []byte{0xfd, 0x7a, 0x11, 0x5c, 0xa1, 0xe0, 15: 2})
+	rw.in = append(rw.in, frame([]byte{0x33, 0x33, 0xff, 0, 0, 2}, etherTypeIPv6, ns))
+	before := len(rw.out)
+	if n, err := dev.Read(buf[:], offset); n != 0 || err != nil {
+		t.Fatalf("NS read = %d, %v; want 0, nil", n, err)
+	}
+	if len(rw.out) != before+1 {
+		t.Fatal("no reply to Neighbor Solicitation")
+	}
+	na := rw.out[before][ethHdrLen:]
+	sum := checksumAdd(checksumAdd(0, na[8:40])+32+58, na[40:])
+	if na[40] != 136 || checksumFold(sum) != 0xffff || !bytes.Equal(na[66:72], dev.mac[:]) {
+		t.Errorf("bad Neighbor Advertisement % x", na)
+	}
+}
@@ -7,6 +7,7 @@
 package tstun
 
 import (
+	"encoding/binary"
 	"errors"
 	"io"
 	"os"
@@ -14,9 +15,11 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/golang/groupcache/lru"
 	"github.com/tailscale/wireguard-go/device"
 	"github.com/tailscale/wireguard-go/tun"
 	"tailscale.com/net/packet"
+	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/wgengine/filter"
 )
@@ -93,8 +96,13 @@ type TUN struct {
 
 	// fitler stores the currently active package filter
 	filter atomic.Value // of *filter.Filter
+	// filterMu serializes SetFilter, which closes the old filter.
+	filterMu sync.Mutex
 	// filterFlags control the verbosity of logging packet drops/accepts.
 	filterFlags filter.RunFlags
+	// peerSrcs is the sources inbound packets from each peer may
+	// have; see SetPeerSrcs.
+	peerSrcs atomic.Value // of *peerSrcs
 
 	// PreFilterIn is the inbound filter function that runs before the main filter
 	// and therefore sees the packets that may be later dropped by it.
@@ -109,6 +117,48 @@ type TUN struct {
 
 	// disableFilter disables all filtering when set. This should only be used in tests.
 	disableFilter bool
+
+	// impairments is the artificial loss and delay per peer; see
+	// SetImpairments.
+	impairments atomic.Value // of map[netaddr.IP]Impairment
+	// delayed holds the packets that impairments delay.
+	delayed delayQueue
+
+	// shapers are the rate caps on outbound traffic, narrowest
+	// first; see SetShapes.
+	shapers atomic.Value // of []*shaper
+
+	// peerMTUs are the MTUs of the paths to peers, narrowest
+	// first; see SetPeerMTUs.
+	peerMTUs atomic.Value // of []peerMTU
+
+	// frags are the fragments after the first of the packet Read
+	// last fragmented to fit a peer MTU, for Read to return next.
+	fragsMu sync.Mutex
+	frags   [][]byte
+
+	// captureHook is the packet capture function; see SetCaptureHook.
+	captureHook atomic.Value // of CaptureFunc
+
+	// connHook is the new connection function; see SetConnHook.
+	connHook atomic.Value // of ConnFunc
+	// connMu guards connFlows, the UDP flows connHook was called
+	// with lately.
+	connMu    sync.Mutex
+	connFlows *lru.Cache // of connFlow
+	// taps are the functions added with AddTap. tapsMu
+	// serializes changes to it; reads don't take it.
+	tapsMu sync.Mutex
+	taps   atomic.Value // of []*tap
+	// routeCounters count the traffic through the routes set
+	// with SetCountedRoutes. routeMu serializes changes to it.
+	routeMu       sync.Mutex
+	routeCounters atomic.Value // of []*routeCounter
+
+	// batch holds the packets written until the next Flush,
+	// if tdev is a batchWriter. Otherwise, it's nil and packets
+	// are written as they come.
+	batch *writeBatch
 }
 
 func WrapTUN(logf logger.Logf, tdev tun.Device) *TUN {
@@ -125,6 +175,10 @@ func WrapTUN(logf logger.Logf, tdev tun.Device) *TUN {
 		filterFlags: filter.LogAccepts | filter.LogDrops,
 	}
 
+	if _, ok := tdev.(batchWriter); ok {
+		tun.batch = &writeBatch{max: maxBatch}
+	}
+
 	go tun.poll()
 	// The buffer starts out consumed.
 	tun.bufferConsumed <- struct{}{}
@@ -145,7 +199,11 @@ func (t *TUN) Close() error {
 	t.closeOnce.Do(func() {
 		// Other channels need not be closed: poll will exit gracefully after this.
 		close(t.closed)
+		t.delayed.close()
 
+		if filt := t.GetFilter(); filt != nil {
+			filt.Close()
+		}
 		err = t.tdev.Close()
 	})
 	return err
@@ -160,6 +218,11 @@ func (t *TUN) File() *os.File {
 }
 
 func (t *TUN) Flush() error {
+	if t.batch != nil {
+		if err := t.flushBatch(); err != nil {
+			return err
+		}
+	}
 	return t.tdev.Flush()
 }
 
@@ -238,6 +301,7 @@ func (t *TUN) filterOut(p *packet.Parsed) filter.Response {
 		}
 	}
 
+	t.countRoute(p, false)
 	return filter.Accept
 }
 
@@ -256,8 +320,13 @@ func (t *TUN) IdleDuration() time.Duration {
 }
 
 func (t *TUN) Read(buf []byte, offset int) (int, error) {
-	var n int
+	if frag := t.nextFrag(); frag != nil {
+		// Already filtered, as part of the packet it came from.
+		t.noteActivity()
+		return copy(buf[offset:], frag), nil
+	}
 
+	var n int
 	select {
 	case <-t.closed:
 		return 0, io.EOF
@@ -288,6 +357,7 @@ func (t *TUN) Read(buf []byte, offset int) (int, error) {
 		}
 	}
 
+	t.capture(CaptureFromLocal, buf[offset:offset+n])
 	if !t.disableFilter {
 		response := t.filterOut(p)
 		if response != filter.Accept {
@@ -295,12 +365,23 @@ func (t *TUN) Read(buf []byte, offset int) (int, error) {
 			return 0, nil
 		}
 	}
+	t.capture(CaptureFromLocalAccepted, buf[offset:offset+n])
+
+	if n = t.fitPeerMTU(p, buf[offset:], n); n == 0 {
+		return 0, nil
+	}
+	if !t.shape(p, buf[offset:offset+n]) {
+		return 0, nil
+	}
+	if !t.impair(buf[offset:offset+n], true, t.InjectOutbound) {
+		return 0, nil
+	}
 
 	t.noteActivity()
 	return n, nil
 }
 
-func (t *TUN) filterIn(buf []byte) filter.Response {
+func (t *TUN) filterIn(buf []byte, srcs *filter.SrcSet) filter.Response {
 	p := parsedPacketPool.Get().(*packet.Parsed)
 	defer parsedPacketPool.Put(p)
 	p.Decode(buf)
@@ -317,7 +398,7 @@ func (t *TUN) filterIn(buf []byte) filter.Response {
 		return filter.Drop
 	}
 
-	if filt.RunIn(p, t.filterFlags) != filter.Accept {
+	if filt.RunIn(p, srcs, t.filterFlags) != filter.Accept {
 		return filter.Drop
 	}
 
@@ -327,16 +408,29 @@ func (t *TUN) filterIn(buf []byte) filter.Response {
 		}
 	}
 
+	t.noteConn(p)
+	t.countRoute(p, true)
 	return filter.Accept
 }
 
 func (t *TUN) Write(buf []byte, offset int) (int, error) {
+	if t.batch != nil {
+		// Filtered, and written, on Flush, which wireguard-go
+		// calls when it has no more packets for the moment.
+		return t.writeBatched(buf, offset)
+	}
+	t.capture(CaptureFromPeer, buf[offset:])
 	if !t.disableFilter {
-		response := t.filterIn(buf[offset:])
+		response := t.filterIn(buf[offset:], t.peerSrcsOf(buf, offset))
 		if response != filter.Accept {
 			return 0, ErrFiltered
 		}
 	}
+	t.capture(CaptureFromPeerAccepted, buf[offset:])
+
+	if !t.impair(buf[offset:], false, t.InjectInboundCopy) {
+		return len(buf) - offset, nil
+	}
 
 	t.noteActivity()
 	return t.tdev.Write(buf, offset)
@@ -347,10 +441,76 @@ func (t *TUN) GetFilter() *filter.Filter {
 	return filt
 }
 
+// SetFilter sets the packet filter, closing the one it replaces.
 func (t *TUN) SetFilter(filt *filter.Filter) {
+	t.filterMu.Lock()
+	defer t.filterMu.Unlock()
+	if old := t.GetFilter(); old != nil && old != filt {
+		old.Close()
+	}
 	t.filter.Store(filt)
 }
 
+// peerSrcs is what the sources of packets from peers are checked
+// against; see SetPeerSrcs.
+type peerSrcs struct {
+	byPeer      map[key.Public]*filter.SrcSet
+	union       *filter.SrcSet // all of byPeer together
+	sessionPeer func(idx uint32) (key.Public, bool)
+}
+
+// noPeerSrcs allows no source, for packets from a peer that's no
+// longer configured.
+var noPeerSrcs = filter.NewSrcSet(nil)
+
+// SetPeerSrcs sets the sources that inbound packets may have, checked
+// by the filter: byPeer holds each peer's allowed IPs. wireguard-go
+// doesn't say which peer a packet it writes came from, but leaves the
+// packet's WireGuard transport header in the space before it, whose
+// receiver index sessionPeer maps to the peer of that session. A
+// packet whose session sessionPeer doesn't know may come from any
+// peer's allowed IPs. A nil byPeer allows any source.
+func (t *TUN) SetPeerSrcs(byPeer map[key.Public]*filter.SrcSet, sessionPeer func(idx uint32) (key.Public, bool)) {
+	if byPeer == nil {
+		t.peerSrcs.Store((*peerSrcs)(nil))
+		return
+	}
+	all := make([]*filter.SrcSet, 0, len(byPeer))
+	for _, srcs := range byPeer {
+		all = append(all, srcs)
+	}
+	t.peerSrcs.Store(&peerSrcs{
+		byPeer:      byPeer,
+		union:       filter.UnionSrcSets(all...),
+		sessionPeer: sessionPeer,
+	})
+}
+
+// peerSrcsOf returns the sources that the packet at buf[offset:],
+// written by wireguard-go, may have: the allowed IPs of the peer whose
+// session its transport header names. A nil set allows any source.
+func (t *TUN) peerSrcsOf(buf []byte, offset int) *filter.SrcSet {
+	ps, _ := t.peerSrcs.Load().(*peerSrcs)
+	if ps == nil {
+		return nil
+	}
+	if ps.sessionPeer == nil || offset < PacketStartOffset {
+		return ps.union
+	}
+	hdr := buf[offset-PacketStartOffset : offset]
+	if binary.LittleEndian.Uint32(hdr[:4]) != device.MessageTransportType {
+		return ps.union
+	}
+	peer, ok := ps.sessionPeer(binary.LittleEndian.Uint32(hdr[4:8]))
+	if !ok {
+		return ps.union
+	}
+	if srcs, ok := ps.byPeer[peer]; ok {
+		return srcs
+	}
+	return noPeerSrcs
+}
+
 // InjectInboundDirect makes the TUN device behave as if a packet
 // with the given contents was received from the network.
 // It blocks and does not take ownership of the packet.
@@ -6,6 +6,7 @@ package tstun
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"strconv"
 	"strings"
@@ -13,9 +14,11 @@ import (
 	"testing"
 	"unsafe"
 
+	"github.com/tailscale/wireguard-go/device"
 	"github.com/tailscale/wireguard-go/tun/tuntest"
 	"inet.af/netaddr"
 	"tailscale.com/net/packet"
+	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/wgengine/filter"
 )
@@ -315,6 +318,45 @@ func TestFilter(t *testing.T) {
 	}
 }
 
+func TestPeerSrcs(t *testing.T) {
+	_, tun := newFakeTUN(t.Logf, true)
+	defer tun.Close()
+
+	peerA, peerB, gone := key.Public{1}, key.Public{2}, key.Public{3}
+	sessions := map[uint32]key.Public{1: peerA, 2: peerB, 4: gone}
+	tun.SetPeerSrcs(map[key.Public]*filter.SrcSet{
+		peerA: filter.NewSrcSet(nets("5.6.7.8")),
+		peerB: filter.NewSrcSet(nets("9.9.9.9")),
+	}, func(idx uint32) (key.Public, bool) {
+		peer, ok := sessions[idx]
+		return peer, ok
+	})
+
+	pkt := udp(0x05060708, 0x01020304, 89, 89)
+	tests := []struct {
+		name string
+		idx  uint32
+		drop bool
+	}{
+		{"own_source", 1, false},
+		{"other_peers_source", 2, true},
+		{"unknown_session", 3, false},
+		{"removed_peer", 4, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := make([]byte, PacketStartOffset+len(pkt))
+			binary.LittleEndian.PutUint32(buf[0:4], device.MessageTransportType)
+			binary.LittleEndian.PutUint32(buf[4:8], tt.idx)
+			copy(buf[PacketStartOffset:], pkt)
+			_, err := tun.Write(buf, PacketStartOffset)
+			if dropped := err == ErrFiltered; dropped != tt.drop {
+				t.Errorf("dropped = %v (err %v); want %v", dropped, err, tt.drop)
+			}
+		})
+	}
+}
+
 func TestAllocs(t *testing.T) {
 	ftun, tun := newFakeTUN(t.Logf, false)
 	defer tun.Close()
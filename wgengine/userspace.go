@@ -29,6 +29,7 @@ import (
 	"go4.org/mem"
 	"inet.af/netaddr"
 	"tailscale.com/control/controlclient"
+	"tailscale.com/health"
 	"tailscale.com/internal/deepprint"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/interfaces"
@@ -46,6 +47,7 @@ import (
 	"tailscale.com/wgengine/router"
 	"tailscale.com/wgengine/tsdns"
 	"tailscale.com/wgengine/tstun"
+	"tailscale.com/wgengine/via6"
 )
 
 // minimalMTU is the MTU we set on tailscale's TUN
@@ -54,8 +56,9 @@ import (
 // (typically 1492 MTU) and on GCE (1460 MTU?!).
 //
 // 1280 is the smallest MTU allowed for IPv6, which is a sensible
-// "probably works everywhere" setting until we develop proper PMTU
-// discovery.
+// "probably works everywhere" setting. A larger MTU can be set to
+// turn on path MTU discovery, which finds how much more than this
+// the path to each peer carries.
 const minimalMTU = 1280
 
 const (
@@ -83,16 +86,18 @@ const (
 )
 
 type userspaceEngine struct {
-	logf      logger.Logf
-	reqCh     chan struct{}
-	waitCh    chan struct{} // chan is closed when first Close call completes; contrast with closing bool
-	timeNow   func() time.Time
-	tundev    *tstun.TUN
-	wgdev     *device.Device
-	router    router.Router
-	resolver  *tsdns.Resolver
-	magicConn *magicsock.Conn
-	linkMon   *monitor.Mon
+	logf       logger.Logf
+	reqCh      chan struct{}
+	waitCh     chan struct{} // chan is closed when first Close call completes; contrast with closing bool
+	timeNow    func() time.Time
+	tundev     *tstun.TUN
+	wgdev      *device.Device
+	router     router.Router
+	resolver   *tsdns.Resolver
+	via        *via6.Translator
+	handshakes *handshakeWatcher
+	magicConn  *magicsock.Conn
+	linkMon    *monitor.Mon
 
 	testMaybeReconfigHook func() // for tests; if non-nil, fires if maybeReconfigWireguardLocked called
 
@@ -103,9 +108,12 @@ type userspaceEngine struct {
 
 	wgLock              sync.Mutex // serializes all wgdev operations; see lock order comment below
 	lastCfgFull         wgcfg.Config
-	lastRouterSig       string // of router.Config
-	lastEngineSigFull   string // of full wireguard config
-	lastEngineSigTrim   string // of trimmed wireguard config
+	lastCfgMin          wgcfg.Config   // last config given to wgdev
+	lastRouterSig       string         // of router.Config
+	lastRouterCfg       *router.Config // last applied, or nil if that failed
+	lastDNSSig          string         // of router.Config.DNS
+	lastEngineSigFull   string         // of full wireguard config
+	lastEngineSigTrim   string         // of trimmed wireguard config
 	recvActivityAt      map[tailcfg.DiscoKey]time.Time
 	trimmedDisco        map[tailcfg.DiscoKey]bool // set of disco keys of peers currently excluded from wireguard config
 	sentActivityAt      map[packet.IP4]*int64     // value is atomic int64 of unixtime
@@ -120,6 +128,15 @@ type userspaceEngine struct {
 	pingers            map[wgcfg.Key]*pinger // legacy pingers for pre-discovery peers
 	linkState          *interfaces.State
 
+	// pmtud is whether path MTU discovery is on.
+	pmtud bool
+	// lowMemory is EngineConfig.LowMemory.
+	lowMemory bool
+
+	peerMTUMu  sync.Mutex                             // guards following; a leaf lock
+	peerMTU    map[tailcfg.NodeKey]int                // path MTUs found by magicsock
+	peerRoutes map[tailcfg.NodeKey][]netaddr.IPPrefix // peers' AllowedIPs, from the last Reconfig
+
 	// Lock ordering: magicsock.Conn.mu, wgLock, then mu.
 }
 
@@ -130,15 +147,34 @@ type RouterGen func(logf logger.Logf, wgdev *device.Device, tundev tun.Device) (
 type EngineConfig struct {
 	// Logf is the logging function used by the engine.
 	Logf logger.Logf
-	// TUN is the tun device used by the engine.
+	// TUN is the tun device used by the engine. If it's a
+	// *tstun.TUN, it's used as is, so that its creator can inject
+	// and tap packets; otherwise, the engine wraps it in one.
 	TUN tun.Device
 	// RouterGen is the function used to instantiate the router.
 	RouterGen RouterGen
 	// ListenPort is the port on which the engine will listen.
 	ListenPort uint16
+	// MTU is the MTU of TUN. If more than minimalMTU, path MTU
+	// discovery limits the packets to each peer to what the path
+	// to it carries; see magicsock.Options.MaxPeerMTU.
+	MTU int
 	// Fake determines whether this engine is running in fake mode,
 	// which disables such features as DNS configuration and unrestricted ICMP Echo responses.
 	Fake bool
+	// LowMemory makes the engine favor memory use over throughput,
+	// for processes with a hard memory limit such as an iOS or
+	// macOS Network Extension: fewer packets are buffered, and
+	// idle peers are always left out of the WireGuard config until
+	// there's traffic for them, however many peers there are.
+	LowMemory bool
+	// InheritedConns optionally holds the UDP sockets of a previous
+	// tailscaled to use; see magicsock.Options.InheritedConns.
+	InheritedConns map[string]net.PacketConn
+	// InheritedRouter optionally holds the router config a previous
+	// tailscaled applied to TUN, for the router to adopt rather
+	// than clear; see router.Adopter.
+	InheritedRouter *router.Config
 }
 
 func NewFakeUserspaceEngine(logf logger.Logf, listenPort uint16) (Engine, error) {
@@ -153,16 +189,43 @@ func NewFakeUserspaceEngine(logf logger.Logf, listenPort uint16) (Engine, error)
 	return NewUserspaceEngineAdvanced(conf)
 }
 
+// NewChannelEngine returns a Tailscale Engine whose data plane is a
+// tstun.ChannelTUN rather than an OS TUN device, so the caller
+// exchanges IP packets with it directly. The host's routes and DNS
+// are left alone.
+func NewChannelEngine(logf logger.Logf, listenPort uint16) (Engine, *tstun.ChannelTUN, error) {
+	logf("Starting userspace wireguard engine with channel TUN device")
+	tdev := tstun.NewChannelTUN()
+	conf := EngineConfig{
+		Logf:       logf,
+		TUN:        tdev,
+		RouterGen:  router.NewFake,
+		ListenPort: listenPort,
+	}
+	e, err := NewUserspaceEngineAdvanced(conf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return e, tdev, nil
+}
+
 // NewUserspaceEngine creates the named tun device and returns a
-// Tailscale Engine running on it.
-func NewUserspaceEngine(logf logger.Logf, tunname string, listenPort uint16) (Engine, error) {
+// Tailscale Engine running on it. An mtu of zero means the minimal
+// 1280.
+func NewUserspaceEngine(logf logger.Logf, tunname string, listenPort uint16, mtu int) (Engine, error) {
 	if tunname == "" {
 		return nil, fmt.Errorf("--tun name must not be blank")
 	}
 
 	logf("Starting userspace wireguard engine with tun device %q", tunname)
 
-	tun, err := tun.CreateTUN(tunname, minimalMTU)
+	if mtu == 0 {
+		mtu = minimalMTU
+	}
+	if mtu < minimalMTU || mtu > tstun.MaxPacketSize {
+		return nil, fmt.Errorf("MTU %d out of range %d-%d", mtu, minimalMTU, tstun.MaxPacketSize)
+	}
+	tun, err := tstun.CreateTUN(logf, tunname, mtu)
 	if err != nil {
 		diagnoseTUNFailure(logf)
 		logf("CreateTUN: %v", err)
@@ -175,6 +238,7 @@ func NewUserspaceEngine(logf logger.Logf, tunname string, listenPort uint16) (En
 		TUN:        tun,
 		RouterGen:  router.New,
 		ListenPort: listenPort,
+		MTU:        mtu,
 	}
 
 	e, err := NewUserspaceEngineAdvanced(conf)
@@ -184,6 +248,34 @@ func NewUserspaceEngine(logf logger.Logf, tunname string, listenPort uint16) (En
 	return e, err
 }
 
+// NewUnprivilegedEngine returns a Tailscale Engine running on the
+// existing tun device tunname, without root or CAP_NET_ADMIN; see
+// tstun.OpenExistingTUN. The device's addresses, routes and DNS are
+// left to something else, such as a reconfig hook.
+func NewUnprivilegedEngine(logf logger.Logf, tunname string, listenPort uint16) (Engine, error) {
+	logf("Starting userspace wireguard engine with existing tun device %q", tunname)
+
+	tun, err := tstun.OpenExistingTUN(tunname)
+	if err != nil {
+		logf("OpenExistingTUN: %v", err)
+		return nil, err
+	}
+	mtu, err := tun.MTU()
+	if err != nil {
+		tun.Close()
+		return nil, err
+	}
+
+	conf := EngineConfig{
+		Logf:       logf,
+		TUN:        tun,
+		RouterGen:  router.NewExternal,
+		ListenPort: listenPort,
+		MTU:        mtu,
+	}
+	return NewUserspaceEngineAdvanced(conf)
+}
+
 // NewUserspaceEngineAdvanced is like NewUserspaceEngine
 // but provides control over all config fields.
 func NewUserspaceEngineAdvanced(conf EngineConfig) (Engine, error) {
@@ -194,27 +286,39 @@ func newUserspaceEngineAdvanced(conf EngineConfig) (_ Engine, reterr error) {
 	logf := conf.Logf
 
 	rconf := tsdns.ResolverConfig{
-		Logf:    conf.Logf,
+		Logf:    logger.Component(conf.Logf, "dns"),
 		Forward: true,
 	}
+	tsTUNDev, ok := conf.TUN.(*tstun.TUN)
+	if !ok {
+		tsTUNDev = tstun.WrapTUN(logf, conf.TUN)
+	}
 	e := &userspaceEngine{
-		timeNow:  time.Now,
-		logf:     logf,
-		reqCh:    make(chan struct{}, 1),
-		waitCh:   make(chan struct{}),
-		tundev:   tstun.WrapTUN(logf, conf.TUN),
-		resolver: tsdns.NewResolver(rconf),
-		pingers:  make(map[wgcfg.Key]*pinger),
+		timeNow:    time.Now,
+		logf:       logf,
+		reqCh:      make(chan struct{}, 1),
+		waitCh:     make(chan struct{}),
+		tundev:     tsTUNDev,
+		resolver:   tsdns.NewResolver(rconf),
+		via:        via6.New(),
+		handshakes: newHandshakeWatcher(),
+		pingers:    make(map[wgcfg.Key]*pinger),
 	}
 	e.localAddrs.Store(map[packet.IP4]bool{})
 	e.linkState, _ = getLinkState()
 	logf("link state: %+v", e.linkState)
 
+	e.lowMemory = conf.LowMemory
+	e.tundev.SetLowMemory(conf.LowMemory)
+
 	// Respond to all pings only in fake mode.
 	if conf.Fake {
 		e.tundev.PostFilterIn = echoRespondToAll
+	} else {
+		e.tundev.PostFilterIn = e.handleVia6In
 	}
 	e.tundev.PreFilterOut = e.handleLocalPackets
+	e.tundev.PostFilterOut = e.trackHandshakes
 
 	mon, err := monitor.New(logf, func() {
 		e.LinkChange(false)
@@ -234,12 +338,19 @@ func newUserspaceEngineAdvanced(conf EngineConfig) (_ Engine, reterr error) {
 		e.RequestStatus()
 	}
 	magicsockOpts := magicsock.Options{
-		Logf:             logf,
+		Logf:             logger.Component(logf, "magicsock"),
 		Port:             conf.ListenPort,
 		EndpointsFunc:    endpointsFn,
 		DERPActiveFunc:   e.RequestStatus,
 		IdleFunc:         e.tundev.IdleDuration,
 		NoteRecvActivity: e.noteReceiveActivity,
+		LowMemory:        conf.LowMemory,
+		InheritedConns:   conf.InheritedConns,
+	}
+	if conf.MTU > minimalMTU {
+		e.pmtud = true
+		magicsockOpts.MaxPeerMTU = conf.MTU
+		magicsockOpts.PeerMTUFunc = e.setPeerMTU
 	}
 	e.magicConn, err = magicsock.NewConn(magicsockOpts)
 	if err != nil {
@@ -270,6 +381,8 @@ func newUserspaceEngineAdvanced(conf EngineConfig) (_ Engine, reterr error) {
 			// here.
 			go e.RequestStatus()
 
+			e.handshakes.noteHandshake(peerKey, e.timeNow())
+
 			if e.magicConn.PeerHasDiscoKey(tailcfg.NodeKey(peerKey)) {
 				e.logf("wireguard handshake complete for %v", peerKey.ShortString())
 				// This is a modern peer with discovery support. No need to send pings.
@@ -346,15 +459,26 @@ func newUserspaceEngineAdvanced(conf EngineConfig) (_ Engine, reterr error) {
 		e.wgdev.Close()
 		return nil, err
 	}
-	// TODO(danderson): we should delete this. It's pointless to apply
-	// a no-op settings here.
-	// TODO(bradfitz): counter-point: it tests the router implementation early
-	// to see if any part of it might fail.
-	e.logf("Clearing router settings...")
-	if err := e.router.Set(nil); err != nil {
-		e.magicConn.Close()
-		e.wgdev.Close()
-		return nil, err
+	if a, ok := e.router.(router.Adopter); ok && conf.InheritedRouter != nil {
+		// Leave a previous tailscaled's routes in place, rather
+		// than leak traffic until the first Reconfig.
+		e.logf("Adopting router settings...")
+		if err := a.Adopt(conf.InheritedRouter); err != nil {
+			e.magicConn.Close()
+			e.wgdev.Close()
+			return nil, err
+		}
+	} else {
+		// TODO(danderson): we should delete this. It's pointless to apply
+		// a no-op settings here.
+		// TODO(bradfitz): counter-point: it tests the router implementation early
+		// to see if any part of it might fail.
+		e.logf("Clearing router settings...")
+		if err := e.router.Set(nil); err != nil {
+			e.magicConn.Close()
+			e.wgdev.Close()
+			return nil, err
+		}
 	}
 	e.logf("Starting link monitor...")
 	e.linkMon.Start()
@@ -364,6 +488,7 @@ func newUserspaceEngineAdvanced(conf EngineConfig) (_ Engine, reterr error) {
 	e.logf("Starting resolver...")
 	e.resolver.Start()
 	go e.pollResolver()
+	go e.handshakeAlarmLoop()
 
 	e.logf("Engine created.")
 	return e, nil
@@ -392,6 +517,12 @@ func echoRespondToAll(p *packet.Parsed, t *tstun.TUN) filter.Response {
 // tailscaled directly. Other packets are allowed to proceed into the
 // main ACL filter.
 func (e *userspaceEngine) handleLocalPackets(p *packet.Parsed, t *tstun.TUN) filter.Response {
+	if out, ok := e.via.TranslateOut(p); ok {
+		// A reply from a subnet reached over a 4via6 route.
+		t.InjectOutbound(out)
+		return filter.Drop
+	}
+
 	if verdict := e.handleDNS(p, t); verdict == filter.Drop {
 		// local DNS handled the packet.
 		return filter.Drop
@@ -410,6 +541,95 @@ func (e *userspaceEngine) handleLocalPackets(p *packet.Parsed, t *tstun.TUN) fil
 	return filter.Accept
 }
 
+// handleVia6In is an inbound post-filter translating the packets to
+// the 4via6 routes this node advertises into IPv4 packets to the
+// subnets they map.
+func (e *userspaceEngine) handleVia6In(p *packet.Parsed, t *tstun.TUN) filter.Response {
+	out, ok := e.via.TranslateIn(p)
+	if !ok {
+		return filter.Accept
+	}
+	if out != nil {
+		t.InjectInboundCopy(out)
+	}
+	return filter.Drop
+}
+
+// trackHandshakes is an outbound post-filter noting the packets sent
+// to each peer, for the handshake alarms.
+func (e *userspaceEngine) trackHandshakes(p *packet.Parsed, t *tstun.TUN) filter.Response {
+	e.handshakes.noteSent(p, e.timeNow())
+	return filter.Accept
+}
+
+// handshakeAlarmLoop raises the SysPeerHandshakes health problem while
+// there are peers WireGuard can't complete a handshake with despite
+// traffic to them, until the engine is closed.
+func (e *userspaceEngine) handshakeAlarmLoop() {
+	t := time.NewTicker(handshakeCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-e.waitCh:
+			health.Set(health.SysPeerHandshakes, nil)
+			return
+		case <-t.C:
+		}
+		raised, changed := e.handshakes.check(e.timeNow())
+		for _, k := range raised {
+			e.logf("wgengine: no handshake with %v for %v despite traffic to it", k.ShortString(), handshakeAlarmTimeout)
+			if handshakeRecovery {
+				e.recoverPeer(k)
+			}
+		}
+		if changed {
+			err := e.handshakes.err()
+			if err == nil {
+				e.logf("wgengine: handshakes with all peers with traffic pending recovered")
+			}
+			health.Set(health.SysPeerHandshakes, err)
+		}
+	}
+}
+
+// recoverPeer tries to get handshakes with the peer k going again, by
+// reprobing its endpoints and dropping its WireGuard session so the
+// next packet starts a fresh handshake.
+func (e *userspaceEngine) recoverPeer(k wgcfg.Key) {
+	e.logf("wgengine: reprobing %v and resetting its session", k.ShortString())
+	e.magicConn.ReprobePeer(tailcfg.NodeKey(k))
+
+	e.wgLock.Lock()
+	defer e.wgLock.Unlock()
+	e.resetPeerSessionLocked(k)
+}
+
+// resetPeerSessionLocked drops the WireGuard session keys of the peer
+// k, by reconfiguring wgdev without it and then with it again.
+//
+// e.wgLock must be held.
+func (e *userspaceEngine) resetPeerSessionLocked(k wgcfg.Key) {
+	min := e.lastCfgMin
+	without := min
+	without.Peers = nil
+	for _, p := range min.Peers {
+		if p.PublicKey != k {
+			without.Peers = append(without.Peers, p)
+		}
+	}
+	if len(without.Peers) == len(min.Peers) {
+		// Not configured in wgdev (trimmed), so no session to drop.
+		return
+	}
+	if err := e.wgdev.Reconfig(&without); err != nil {
+		e.logf("wgdev.Reconfig: %v", err)
+		return
+	}
+	if err := e.wgdev.Reconfig(&min); err != nil {
+		e.logf("wgdev.Reconfig: %v", err)
+	}
+}
+
 func (e *userspaceEngine) isLocalAddr(ip packet.IP4) bool {
 	localAddrs, ok := e.localAddrs.Load().(map[packet.IP4]bool)
 	if !ok {
@@ -599,16 +819,20 @@ var (
 )
 
 // forceFullWireguardConfig reports whether we should give wireguard
-// our full network map, even for inactive peers
+// our full network map, even for inactive peers. In low-memory mode,
+// only the environment variable knob can ask for that.
 //
 // TODO(bradfitz): remove this after our 1.0 launch; we don't want to
 // enable wireguard config trimming quite yet because it just landed
 // and we haven't got enough time testing it.
-func forceFullWireguardConfig(numPeers int) bool {
+func forceFullWireguardConfig(numPeers int, lowMemory bool) bool {
 	// Did the user explicitly enable trimmming via the environment variable knob?
 	if debugTrimWireguardEnv != "" {
 		return !debugTrimWireguard
 	}
+	if lowMemory {
+		return false
+	}
 	if opt := controlclient.TrimWGConfig(); opt != "" {
 		return !opt.EqualBool(true)
 	}
@@ -622,6 +846,16 @@ func forceFullWireguardConfig(numPeers int) bool {
 	return false
 }
 
+// lazyPeerIdle returns how long a peer may be idle before it's
+// removed from the wireguard config: lazyPeerIdleThreshold, unless
+// control says otherwise.
+func lazyPeerIdle() time.Duration {
+	if d := controlclient.LazyPeerIdleThreshold(); d > 0 {
+		return d
+	}
+	return lazyPeerIdleThreshold
+}
+
 // isTrimmablePeer reports whether p is a peer that we can trim out of the
 // network map.
 //
@@ -631,8 +865,13 @@ func forceFullWireguardConfig(numPeers int) bool {
 // simplicity, have only one IP address (an IPv4 /32), which is the
 // common case for most peers. Subnet router nodes will just always be
 // created in the wireguard-go config.
-func isTrimmablePeer(p *wgcfg.Peer, numPeers int) bool {
-	if forceFullWireguardConfig(numPeers) {
+func isTrimmablePeer(p *wgcfg.Peer, numPeers int, lowMemory bool) bool {
+	if forceFullWireguardConfig(numPeers, lowMemory) {
+		return false
+	}
+	if p.PersistentKeepalive != 0 {
+		// The point of keepalives is to keep the path to the peer
+		// open while it's idle, which it can't do if removed.
 		return false
 	}
 	if len(p.AllowedIPs) != 1 || len(p.Endpoints) != 1 {
@@ -734,10 +973,10 @@ func (e *userspaceEngine) maybeReconfigWireguardLocked(discoChanged map[key.Publ
 	min.Peers = nil
 
 	// We'll only keep a peer around if it's been active in
-	// the past 5 minutes. That's more than WireGuard's key
-	// rotation time anyway so it's no harm if we remove it
-	// later if it's been inactive.
-	activeCutoff := e.timeNow().Add(-lazyPeerIdleThreshold)
+	// the past lazyPeerIdle (5 minutes by default). That's more
+	// than WireGuard's key rotation time anyway so it's no harm
+	// if we remove it later if it's been inactive.
+	activeCutoff := e.timeNow().Add(-lazyPeerIdle())
 
 	// Not all peers can be trimmed from the network map (see
 	// isTrimmablePeer).  For those are are trimmable, keep track
@@ -752,7 +991,7 @@ func (e *userspaceEngine) maybeReconfigWireguardLocked(discoChanged map[key.Publ
 	needRemoveStep := false
 	for i := range full.Peers {
 		p := &full.Peers[i]
-		if !isTrimmablePeer(p, len(full.Peers)) {
+		if !isTrimmablePeer(p, len(full.Peers), e.lowMemory) {
 			min.Peers = append(min.Peers, *p)
 			if discoChanged[key.Public(p.PublicKey)] {
 				needRemoveStep = true
@@ -807,6 +1046,7 @@ func (e *userspaceEngine) maybeReconfigWireguardLocked(discoChanged map[key.Publ
 		e.logf("wgdev.Reconfig: %v", err)
 		return err
 	}
+	e.lastCfgMin = min
 	return nil
 }
 
@@ -899,10 +1139,103 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config)
 
 	engineChanged := deepprint.UpdateHash(&e.lastEngineSigFull, cfg)
 	routerChanged := deepprint.UpdateHash(&e.lastRouterSig, routerCfg)
+	dnsChanged := deepprint.UpdateHash(&e.lastDNSSig, routerCfg.DNS)
 	if !engineChanged && !routerChanged {
 		return ErrNoChanges
 	}
+	if engineChanged {
+		if err := e.reconfigWireguardLocked(cfg, peerSet); err != nil {
+			return err
+		}
+		e.tundev.SetPeerSrcs(peerSrcSets(cfg), e.magicConn.SessionPeer)
+		e.via.SetPeers(via6Peers(cfg))
+		e.handshakes.setPeers(cfg)
+	}
+
+	if routerChanged {
+		e.tundev.SetCountedRoutes(routerCfg.SubnetRoutes)
+		e.via.SetRoutes(routerCfg.SubnetRoutes)
+		if routerCfg.DNS.Proxied {
+			ips := routerCfg.DNS.Nameservers
+			upstreams := make([]net.Addr, len(ips))
+			for i, ip := range ips {
+				stdIP := ip.IPAddr()
+				upstreams[i] = &net.UDPAddr{
+					IP:   stdIP.IP,
+					Port: 53,
+					Zone: stdIP.Zone,
+				}
+			}
+			if dnsChanged {
+				e.resolver.SetUpstreams(upstreams)
+			}
+			routerCfg.DNS.Nameservers = []netaddr.IP{tsaddr.TailscaleServiceIP()}
+		}
+		e.logf("wgengine: Reconfig: configuring router")
+		err := e.router.Set(routerCfg)
+		health.Set(health.SysRouter, err)
+		if err != nil {
+			e.lastRouterCfg = nil
+			return err
+		}
+		e.lastRouterCfg = routerCfg
+	}
+
+	e.logf("wgengine: Reconfig done")
+	return nil
+}
+
+// peerSrcSets returns the sources that packets from each of cfg's
+// peers may have: its allowed IPs.
+func peerSrcSets(cfg *wgcfg.Config) map[key.Public]*filter.SrcSet {
+	ret := make(map[key.Public]*filter.SrcSet, len(cfg.Peers))
+	for _, p := range cfg.Peers {
+		var pfxs []netaddr.IPPrefix
+		for _, cidr := range p.AllowedIPs {
+			pfx, ok := netaddr.FromStdIPNet(cidr.IPNet())
+			if !ok {
+				continue
+			}
+			pfx.IP = pfx.IP.Unmap()
+			pfxs = append(pfxs, pfx)
+		}
+		ret[key.Public(p.PublicKey)] = filter.NewSrcSet(pfxs)
+	}
+	return ret
+}
+
+// via6Peers returns the Tailscale IPv4 address of each of cfg's peers
+// by its Tailscale IPv6 address, for translating their packets to
+// 4via6 routes.
+func via6Peers(cfg *wgcfg.Config) map[packet.IP6]packet.IP4 {
+	ret := make(map[packet.IP6]packet.IP4)
+	for _, p := range cfg.Peers {
+		var ip4, ip6 netaddr.IP
+		for _, cidr := range p.AllowedIPs {
+			pfx, ok := netaddr.FromStdIPNet(cidr.IPNet())
+			if !ok {
+				continue
+			}
+			ip := pfx.IP.Unmap()
+			switch {
+			case !tsaddr.IsTailscaleIP(ip):
+			case ip.Is4() && pfx.Bits == 32:
+				ip4 = ip
+			case ip.Is6() && pfx.Bits == 128:
+				ip6 = ip
+			}
+		}
+		if ip4 != (netaddr.IP{}) && ip6 != (netaddr.IP{}) {
+			ret[packet.IP6FromNetaddr(ip6)] = packet.IP4FromNetaddr(ip4)
+		}
+	}
+	return ret
+}
 
+// reconfigWireguardLocked applies a changed full wireguard config,
+// cfg, to magicsock and wireguard-go. peerSet is the set of peers in
+// cfg. e.wgLock must be held.
+func (e *userspaceEngine) reconfigWireguardLocked(cfg *wgcfg.Config, peerSet map[key.Public]struct{}) error {
 	// See if any peers have changed disco keys, which means they've restarted.
 	// If so, we need to update the wireguard-go/device.Device in two phases:
 	// once without the node which has restarted, to clear its wireguard session key,
@@ -929,6 +1262,9 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config)
 	}
 
 	e.lastCfgFull = cfg.Copy()
+	if e.pmtud {
+		e.setPeerRoutes(cfg)
+	}
 
 	// Tell magicsock about the new (or initial) private key
 	// (which is needed by DERP) before wgdev gets it, as wgdev
@@ -939,33 +1275,7 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config)
 	}
 	e.magicConn.UpdatePeers(peerSet)
 
-	if err := e.maybeReconfigWireguardLocked(discoChanged); err != nil {
-		return err
-	}
-
-	if routerChanged {
-		if routerCfg.DNS.Proxied {
-			ips := routerCfg.DNS.Nameservers
-			upstreams := make([]net.Addr, len(ips))
-			for i, ip := range ips {
-				stdIP := ip.IPAddr()
-				upstreams[i] = &net.UDPAddr{
-					IP:   stdIP.IP,
-					Port: 53,
-					Zone: stdIP.Zone,
-				}
-			}
-			e.resolver.SetUpstreams(upstreams)
-			routerCfg.DNS.Nameservers = []netaddr.IP{tsaddr.TailscaleServiceIP()}
-		}
-		e.logf("wgengine: Reconfig: configuring router")
-		if err := e.router.Set(routerCfg); err != nil {
-			return err
-		}
-	}
-
-	e.logf("wgengine: Reconfig done")
-	return nil
+	return e.maybeReconfigWireguardLocked(discoChanged)
 }
 
 func (e *userspaceEngine) GetFilter() *filter.Filter {
@@ -974,6 +1284,9 @@ func (e *userspaceEngine) GetFilter() *filter.Filter {
 
 func (e *userspaceEngine) SetFilter(filt *filter.Filter) {
 	e.tundev.SetFilter(filt)
+	if fs, ok := e.router.(router.FilterSetter); ok {
+		fs.SetFilter(filt)
+	}
 }
 
 func (e *userspaceEngine) SetDNSMap(dm *tsdns.Map) {
@@ -1112,9 +1425,19 @@ func (e *userspaceEngine) getStatus() (*Status, error) {
 		}
 	}
 
+	var routes []RouteStatus
+	for _, rb := range e.tundev.RouteCounts() {
+		routes = append(routes, RouteStatus{
+			Route:   rb.Route,
+			TxBytes: ByteCount(rb.TxBytes),
+			RxBytes: ByteCount(rb.RxBytes),
+		})
+	}
+
 	return &Status{
 		LocalAddrs: append([]string(nil), e.endpoints...),
 		Peers:      peers,
+		Routes:     routes,
 		DERPs:      derpConns,
 	}, nil
 }
@@ -1258,6 +1581,7 @@ func (e *userspaceEngine) SetDERPMap(dm *tailcfg.DERPMap) {
 
 func (e *userspaceEngine) SetNetworkMap(nm *controlclient.NetworkMap) {
 	e.magicConn.SetNetworkMap(nm)
+	e.handshakes.setOnline(nm)
 }
 
 func (e *userspaceEngine) DiscoPublicKey() tailcfg.DiscoKey {
@@ -1286,6 +1610,38 @@ func (e *userspaceEngine) Ping(ip netaddr.IP, cb func(*ipnstate.PingResult)) {
 	e.magicConn.Ping(ip, cb)
 }
 
+func (e *userspaceEngine) PeerPath(ip netaddr.IP) (*ipnstate.PeerPath, error) {
+	return e.magicConn.PeerPath(ip)
+}
+
+func (e *userspaceEngine) SetListenPort(port uint16) {
+	e.magicConn.SetPreferredPort(port)
+}
+
+func (e *userspaceEngine) SetEndpointPrivacy(p magicsock.EndpointPrivacy) {
+	e.magicConn.SetEndpointPrivacy(p)
+}
+
+func (e *userspaceEngine) SetRelayOnlyPeers(ips []netaddr.IP) {
+	e.magicConn.SetRelayOnlyPeers(ips)
+}
+
+func (e *userspaceEngine) SetImpairments(m map[netaddr.IP]tstun.Impairment) {
+	e.tundev.SetImpairments(m)
+}
+
+func (e *userspaceEngine) SetShapes(m map[netaddr.IPPrefix]tstun.Shape) {
+	e.tundev.SetShapes(m)
+}
+
+func (e *userspaceEngine) SetCaptureHook(fn tstun.CaptureFunc) {
+	e.tundev.SetCaptureHook(fn)
+}
+
+func (e *userspaceEngine) SetConnHook(fn tstun.ConnFunc) {
+	e.tundev.SetConnHook(fn)
+}
+
 // diagnoseTUNFailure is called if tun.CreateTUN fails, to poke around
 // the system and log some diagnostic info that might help debug why
 // TUN failed. Because TUN's already failed and things the program's
@@ -13,6 +13,7 @@ import (
 
 	"github.com/tailscale/wireguard-go/wgcfg"
 	"go4.org/mem"
+	"inet.af/netaddr"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
 	"tailscale.com/wgengine/router"
@@ -133,6 +134,48 @@ func TestUserspaceEngineReconfig(t *testing.T) {
 	}
 }
 
+func TestUserspaceEngineReconfigRouterOnly(t *testing.T) {
+	e, err := NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	ue := e.(*userspaceEngine)
+	wgReconfigs := 0
+	ue.testMaybeReconfigHook = func() { wgReconfigs++ }
+
+	cfg := &wgcfg.Config{
+		Peers: []wgcfg.Peer{
+			{
+				AllowedIPs: []wgcfg.CIDR{
+					{IP: wgcfg.IPv4(100, 100, 99, 1), Mask: 32},
+				},
+			},
+		},
+	}
+	if err := e.Reconfig(cfg, &router.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if wgReconfigs != 1 {
+		t.Fatalf("after first Reconfig, wireguard reconfigured %d times; want 1", wgReconfigs)
+	}
+
+	// Only the router config changes; wireguard should be left alone.
+	routerCfg := &router.Config{
+		LocalAddrs: []netaddr.IPPrefix{{IP: netaddr.IPv4(100, 100, 99, 2), Bits: 32}},
+	}
+	if err := e.Reconfig(cfg, routerCfg); err != nil {
+		t.Fatal(err)
+	}
+	if wgReconfigs != 1 {
+		t.Errorf("after router-only change, wireguard reconfigured %d times; want 1", wgReconfigs)
+	}
+
+	if err := e.Reconfig(cfg, routerCfg); err != ErrNoChanges {
+		t.Errorf("unchanged Reconfig = %v; want ErrNoChanges", err)
+	}
+}
+
 func dkFromHex(hex string) tailcfg.DiscoKey {
 	if len(hex) != 64 {
 		panic(fmt.Sprintf("%q is len %d; want 64", hex, len(hex)))
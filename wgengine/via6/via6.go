@@ -0,0 +1,394 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package via6 translates between the IPv6 packets of 4via6 routes
+// and the IPv4 subnets they map, so that several sites advertising
+// the same IPv4 subnets can all be reached.
+//
+// A subnet router advertises a 4via6 route (see tsaddr.MapVia) in
+// place of its IPv4 subnet. Inbound IPv6 packets to the route are
+// translated to IPv4 packets to the subnet, from the sending peer's
+// Tailscale IPv4 address, and the IPv4 replies back to IPv6 packets
+// from the 4via6 address. Only TCP, UDP and ICMP echo are translated,
+// and only replies to flows the peer started.
+package via6
+
+import (
+	"container/list"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+	"tailscale.com/net/tsaddr"
+)
+
+const (
+	// flowTimeout is how long a flow may be idle before its replies
+	// are no longer translated.
+	flowTimeout = 5 * time.Minute
+
+	// maxFlows is the most flows a Translator tracks. When it's
+	// reached, the least recently active flow is forgotten.
+	maxFlows = 10000
+)
+
+// Translator translates the packets of the 4via6 routes a node
+// advertises. The zero value is not valid; use New.
+type Translator struct {
+	routes atomic.Value // of []netaddr.IPPrefix; the 4via6 routes
+	peers  atomic.Value // of map[packet.IP6]packet.IP4
+
+	mu     sync.Mutex
+	flows  map[flowKey]*list.Element // of *flow, in lru
+	lru    *list.List                // of *flow, most recently active first
+	expiry *time.Timer               // runs expireIdle; nil without flows
+	now    func() time.Time          // for tests
+}
+
+// flowKey identifies a translated flow by its IPv4 packets and the
+// site they're to. Sites mapping the same IPv4 subnet share IPv4
+// packets, so a reply is matched against each site's flow.
+type flowKey struct {
+	proto    packet.IPProto
+	site     uint16
+	peer     packet.IP4 // the peer's Tailscale IPv4 address
+	peerPort uint16     // or ICMP echo identifier
+	dst      packet.IP4 // the subnet address
+	dstPort  uint16
+}
+
+type flow struct {
+	key        flowKey
+	peer       packet.IP6 // the peer's Tailscale IPv6 address
+	lastActive time.Time
+}
+
+// New returns a new Translator with no routes.
+func New() *Translator {
+	t := &Translator{
+		flows: make(map[flowKey]*list.Element),
+		lru:   list.New(),
+		now:   time.Now,
+	}
+	t.routes.Store([]netaddr.IPPrefix(nil))
+	t.peers.Store(map[packet.IP6]packet.IP4(nil))
+	return t
+}
+
+// SetRoutes sets the routes the node advertises. Those that are
+// 4via6 routes are translated.
+func (t *Translator) SetRoutes(routes []netaddr.IPPrefix) {
+	var via []netaddr.IPPrefix
+	for _, r := range routes {
+		if _, _, ok := tsaddr.UnmapVia(r.IP); ok && r.Bits >= 96 {
+			via = append(via, r)
+		}
+	}
+	t.routes.Store(via)
+	if len(via) == 0 {
+		t.mu.Lock()
+		t.flows = make(map[flowKey]*list.Element)
+		t.lru.Init()
+		if t.expiry != nil {
+			t.expiry.Stop()
+			t.expiry = nil
+		}
+		t.mu.Unlock()
+	}
+}
+
+// SetPeers sets the Tailscale IPv4 address of each peer, by its
+// Tailscale IPv6 address. Packets from peers without both aren't
+// translated.
+func (t *Translator) SetPeers(peers map[packet.IP6]packet.IP4) {
+	t.peers.Store(peers)
+}
+
+// viaRoute reports whether ip is within one of t's routes.
+func (t *Translator) viaRoute(ip packet.IP6) bool {
+	routes := t.routes.Load().([]netaddr.IPPrefix)
+	if len(routes) == 0 {
+		return false
+	}
+	nip := ip.Netaddr()
+	for _, r := range routes {
+		if r.Contains(nip) {
+			return true
+		}
+	}
+	return false
+}
+
+// TranslateIn translates p, an inbound packet from a peer, if it's
+// to one of t's routes. It reports whether it was; if so, p must be
+// dropped, and the returned IPv4 packet, if non-nil, sent on in its
+// place.
+func (t *Translator) TranslateIn(p *packet.Parsed) (out []byte, ok bool) {
+	if p.IPVersion != 6 || !t.viaRoute(p.DstIP6) {
+		return nil, false
+	}
+	b := p.Buffer()
+	if len(b) < 40 {
+		return nil, true
+	}
+	n := 40 + int(binary.BigEndian.Uint16(b[4:6]))
+	if n > len(b) {
+		return nil, true
+	}
+	l4 := b[40:n]
+
+	peer, found := t.peers.Load().(map[packet.IP6]packet.IP4)[p.SrcIP6]
+	if !found {
+		return nil, true
+	}
+	site, dst, _ := tsaddr.UnmapVia(p.DstIP6.Netaddr())
+	dst4 := packet.IP4FromNetaddr(dst)
+
+	key := flowKey{proto: p.IPProto, site: site, peer: peer, dst: dst4}
+	proto := p.IPProto
+	switch p.IPProto {
+	case packet.TCP, packet.UDP:
+		key.peerPort, key.dstPort = p.SrcPort, p.DstPort
+	case packet.ICMPv6:
+		if len(l4) < 8 || packet.ICMP6Type(l4[0]) != packet.ICMP6EchoRequest || packet.ICMP6Code(l4[1]) != packet.ICMP6NoCode {
+			return nil, true
+		}
+		key.proto = packet.ICMPv4
+		key.peerPort = binary.BigEndian.Uint16(l4[4:6])
+		proto = packet.ICMPv4
+	default:
+		return nil, true
+	}
+	t.trackFlow(key, p.SrcIP6)
+
+	out = make([]byte, 20+len(l4))
+	out[0] = 0x45
+	out[1] = b[0]<<4 | b[1]>>4 // traffic class
+	binary.BigEndian.PutUint16(out[2:4], uint16(len(out)))
+	binary.BigEndian.PutUint16(out[6:8], 0x4000) // don't fragment
+	out[8] = b[7]                                // hop limit
+	out[9] = uint8(proto)
+	binary.BigEndian.PutUint32(out[12:16], uint32(peer))
+	binary.BigEndian.PutUint32(out[16:20], uint32(dst4))
+	binary.BigEndian.PutUint16(out[10:12], checksum(0, out[:20]))
+
+	seg := out[20:]
+	copy(seg, l4)
+	if proto == packet.ICMPv4 {
+		seg[0] = uint8(packet.ICMP4EchoRequest)
+		seg[2], seg[3] = 0, 0
+		binary.BigEndian.PutUint16(seg[2:4], checksum(0, seg))
+		return out, true
+	}
+	setL4Checksum(proto, seg, pseudoSum(out[12:20], proto, len(seg)))
+	return out, true
+}
+
+// TranslateOut translates p, an outbound packet to a peer, if it's a
+// reply in a flow TranslateIn translated. It reports whether it was;
+// if so, p must be dropped, and the returned IPv6 packet sent on in
+// its place.
+func (t *Translator) TranslateOut(p *packet.Parsed) (out []byte, ok bool) {
+	if p.IPVersion != 4 || len(t.routes.Load().([]netaddr.IPPrefix)) == 0 {
+		return nil, false
+	}
+	b := p.Buffer()
+	if len(b) < 20 {
+		return nil, false
+	}
+	hlen := int(b[0]&0x0f) * 4
+	n := int(binary.BigEndian.Uint16(b[2:4]))
+	if hlen < 20 || n < hlen || n > len(b) {
+		return nil, false
+	}
+	if binary.BigEndian.Uint16(b[6:8])&0x3fff != 0 {
+		// A fragment; they're not translated.
+		return nil, false
+	}
+	l4 := b[hlen:n]
+
+	key := flowKey{proto: p.IPProto, peer: p.DstIP4, dst: p.SrcIP4}
+	proto := p.IPProto
+	switch p.IPProto {
+	case packet.TCP, packet.UDP:
+		key.peerPort, key.dstPort = p.DstPort, p.SrcPort
+	case packet.ICMPv4:
+		if len(l4) < 8 || packet.ICMP4Type(l4[0]) != packet.ICMP4EchoReply || packet.ICMP4Code(l4[1]) != packet.ICMP4NoCode {
+			return nil, false
+		}
+		key.peerPort = binary.BigEndian.Uint16(l4[4:6])
+		proto = packet.ICMPv6
+	default:
+		return nil, false
+	}
+	f, found := t.replyFlow(key)
+	if !found {
+		return nil, false
+	}
+
+	src, err := tsaddr.MapVia(f.key.site, netaddr.IPPrefix{IP: p.SrcIP4.Netaddr(), Bits: 32})
+	if err != nil {
+		return nil, true
+	}
+	src6 := packet.IP6FromNetaddr(src.IP)
+
+	out = make([]byte, 40+len(l4))
+	out[0] = 0x60 | b[1]>>4 // version and traffic class
+	out[1] = b[1] << 4
+	binary.BigEndian.PutUint16(out[4:6], uint16(len(l4)))
+	out[6] = uint8(proto)
+	out[7] = b[8] // TTL
+	binary.BigEndian.PutUint64(out[8:16], src6.Hi)
+	binary.BigEndian.PutUint64(out[16:24], src6.Lo)
+	binary.BigEndian.PutUint64(out[24:32], f.peer.Hi)
+	binary.BigEndian.PutUint64(out[32:40], f.peer.Lo)
+
+	seg := out[40:]
+	copy(seg, l4)
+	if proto == packet.ICMPv6 {
+		seg[0] = uint8(packet.ICMP6EchoReply)
+	}
+	setL4Checksum(proto, seg, pseudoSum(out[8:40], proto, len(seg)))
+	return out, true
+}
+
+// trackFlow records that the flow key, from the peer with IPv6
+// address peer, is active.
+func (t *Translator) trackFlow(key flowKey, peer packet.IP6) {
+	now := t.now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.flows[key]; ok {
+		f := e.Value.(*flow)
+		f.peer, f.lastActive = peer, now
+		t.lru.MoveToFront(e)
+		return
+	}
+	t.flows[key] = t.lru.PushFront(&flow{key: key, peer: peer, lastActive: now})
+	if t.lru.Len() > maxFlows {
+		t.removeLocked(t.lru.Back())
+	}
+	if t.expiry == nil {
+		t.expiry = time.AfterFunc(flowTimeout, t.expireIdle)
+	}
+}
+
+// replyFlow returns a copy of the flow that key, with its site unset,
+// is a reply in, noting it as active, and whether there's one. Of the
+// sites whose routes map key.dst, the most recently active flow's is
+// picked.
+func (t *Translator) replyFlow(key flowKey) (flow, bool) {
+	var sites []uint16
+	dst := key.dst.Netaddr()
+	for _, r := range t.routes.Load().([]netaddr.IPPrefix) {
+		site, v4, _ := tsaddr.UnmapVia(r.IP)
+		if (netaddr.IPPrefix{IP: v4, Bits: r.Bits - 96}).Contains(dst) {
+			sites = append(sites, site)
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var best *list.Element
+	for _, site := range sites {
+		key.site = site
+		if e, ok := t.flows[key]; ok && (best == nil || e.Value.(*flow).lastActive.After(best.Value.(*flow).lastActive)) {
+			best = e
+		}
+	}
+	if best == nil {
+		return flow{}, false
+	}
+	f := best.Value.(*flow)
+	f.lastActive = t.now()
+	t.lru.MoveToFront(best)
+	return *f, true
+}
+
+func (t *Translator) removeLocked(e *list.Element) {
+	t.lru.Remove(e)
+	delete(t.flows, e.Value.(*flow).key)
+}
+
+// expireIdle forgets the flows idle for flowTimeout, then schedules
+// itself for when the next one would be, as long as any are left.
+func (t *Translator) expireIdle() {
+	now := t.now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for e := t.lru.Back(); e != nil; e = t.lru.Back() {
+		if now.Sub(e.Value.(*flow).lastActive) < flowTimeout {
+			break // the rest are more recent
+		}
+		t.removeLocked(e)
+	}
+	if t.expiry == nil {
+		return // stopped by SetRoutes
+	}
+	e := t.lru.Back()
+	if e == nil {
+		t.expiry = nil
+		return
+	}
+	t.expiry.Reset(flowTimeout - now.Sub(e.Value.(*flow).lastActive))
+}
+
+// pseudoSum returns the partial checksum of the pseudo-header of a
+// segment of the given protocol and length between the addresses
+// addrs: the source address followed by the destination one.
+func pseudoSum(addrs []byte, proto packet.IPProto, length int) uint32 {
+	sum := partialSum(0, addrs)
+	sum += uint32(proto)
+	sum += uint32(length>>16) + uint32(length&0xffff)
+	return sum
+}
+
+// setL4Checksum recomputes the checksum of seg, a segment of the
+// given protocol, with sum the partial checksum of its pseudo-header.
+func setL4Checksum(proto packet.IPProto, seg []byte, sum uint32) {
+	var off int
+	switch proto {
+	case packet.TCP:
+		off = 16
+	case packet.UDP:
+		off = 6
+	case packet.ICMPv6:
+		off = 2
+	default:
+		return
+	}
+	if len(seg) < off+2 {
+		return
+	}
+	seg[off], seg[off+1] = 0, 0
+	c := checksum(sum, seg)
+	if c == 0 && proto == packet.UDP {
+		c = 0xffff // zero means no checksum
+	}
+	binary.BigEndian.PutUint16(seg[off:off+2], c)
+}
+
+// partialSum adds the 16-bit words of b to sum.
+func partialSum(sum uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+// checksum returns the internet checksum (RFC 1071) of b, with sum
+// the partial checksum of what precedes it.
+func checksum(sum uint32, b []byte) uint16 {
+	sum = partialSum(sum, b)
+	for sum>>16 != 0 {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,258 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package via6
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+)
+
+func mustIP(s string) netaddr.IP {
+	ip, err := netaddr.ParseIP(s)
+	if err != nil {
+		panic(err)
+	}
+	return ip
+}
+
+func mustPrefix(s string) netaddr.IPPrefix {
+	p, err := netaddr.ParseIPPrefix(s)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+var (
+	peer4   = packet.IP4FromNetaddr(mustIP("100.101.102.103"))
+	peer6   = packet.IP6FromNetaddr(mustIP("fd7a:115c:a1e0:ab12:4843:cd96:6265:6667"))
+	subnet4 = packet.IP4FromNetaddr(mustIP("10.1.1.16"))
+	via     = packet.IP6FromNetaddr(mustIP("fd7a:115c:a1e0:b1a:0:7:a01:110"))
+)
+
+func newTranslator() *Translator {
+	t := New()
+	t.SetRoutes([]netaddr.IPPrefix{
+		mustPrefix("10.2.0.0/16"),
+		mustPrefix("fd7a:115c:a1e0:b1a:0:7:a01:100/120"),
+	})
+	t.SetPeers(map[packet.IP6]packet.IP4{peer6: peer4})
+	return t
+}
+
+func parse(b []byte) *packet.Parsed {
+	p := new(packet.Parsed)
+	p.Decode(b)
+	return p
+}
+
+// checkSum reports whether the segment of b at off, with its
+// pseudo-header from addrs, has a valid checksum.
+func checkSum(b []byte, addrs []byte, proto packet.IPProto, off int) bool {
+	seg := b[off:]
+	return checksum(pseudoSum(addrs, proto, len(seg)), seg) == 0
+}
+
+func TestTranslateUDP(t *testing.T) {
+	tr := newTranslator()
+	payload := []byte("hello")
+
+	in := packet.Generate(&packet.UDP6Header{
+		IP6Header: packet.IP6Header{SrcIP: peer6, DstIP: via},
+		SrcPort:   1234,
+		DstPort:   53,
+	}, payload)
+	out, ok := tr.TranslateIn(parse(in))
+	if !ok || out == nil {
+		t.Fatalf("TranslateIn = %v, %v; want a packet", out, ok)
+	}
+	p := parse(out)
+	if p.IPVersion != 4 || p.IPProto != packet.UDP || p.SrcIP4 != peer4 || p.DstIP4 != subnet4 || p.SrcPort != 1234 || p.DstPort != 53 {
+		t.Fatalf("translated to %v", p)
+	}
+	if string(p.Payload()) != "hello" {
+		t.Errorf("payload = %q", p.Payload())
+	}
+	if checksum(0, out[:20]) != 0 {
+		t.Error("bad IPv4 header checksum")
+	}
+	if !checkSum(out, out[12:20], packet.UDP, 20) {
+		t.Error("bad UDP checksum")
+	}
+
+	reply := packet.Generate(&packet.UDP4Header{
+		IP4Header: packet.IP4Header{SrcIP: subnet4, DstIP: peer4},
+		SrcPort:   53,
+		DstPort:   1234,
+	}, []byte("world"))
+	out, ok = tr.TranslateOut(parse(reply))
+	if !ok || out == nil {
+		t.Fatalf("TranslateOut = %v, %v; want a packet", out, ok)
+	}
+	p = parse(out)
+	if p.IPVersion != 6 || p.IPProto != packet.UDP || p.SrcIP6 != via || p.DstIP6 != peer6 || p.SrcPort != 53 || p.DstPort != 1234 {
+		t.Fatalf("translated to %v", p)
+	}
+	if string(p.Payload()) != "world" {
+		t.Errorf("payload = %q", p.Payload())
+	}
+	if !checkSum(out, out[8:40], packet.UDP, 40) {
+		t.Error("bad UDP checksum")
+	}
+
+	// Packets not in a translated flow pass untouched.
+	other := packet.Generate(&packet.UDP4Header{
+		IP4Header: packet.IP4Header{SrcIP: subnet4, DstIP: peer4},
+		SrcPort:   53,
+		DstPort:   4321,
+	}, nil)
+	if _, ok := tr.TranslateOut(parse(other)); ok {
+		t.Error("TranslateOut translated a packet of an unknown flow")
+	}
+}
+
+func TestTranslateICMP(t *testing.T) {
+	tr := newTranslator()
+
+	// An ICMPv6 echo request with identifier 0x1234 and sequence 1.
+	echo := []byte{uint8(packet.ICMP6EchoRequest), 0, 0, 0, 0x12, 0x34, 0, 1, 'p', 'i', 'n', 'g'}
+	in := make([]byte, 40+len(echo))
+	copy(in[40:], echo)
+	packet.IP6Header{IPProto: packet.ICMPv6, SrcIP: peer6, DstIP: via}.Marshal(in)
+	setL4Checksum(packet.ICMPv6, in[40:], pseudoSum(in[8:40], packet.ICMPv6, len(echo)))
+
+	out, ok := tr.TranslateIn(parse(in))
+	if !ok || out == nil {
+		t.Fatalf("TranslateIn = %v, %v; want a packet", out, ok)
+	}
+	p := parse(out)
+	if p.IPProto != packet.ICMPv4 || !p.IsEchoRequest() || p.SrcIP4 != peer4 || p.DstIP4 != subnet4 {
+		t.Fatalf("translated to %v", p)
+	}
+	if checksum(0, out[20:]) != 0 {
+		t.Error("bad ICMP checksum")
+	}
+
+	// The subnet host's reply.
+	reply := append([]byte(nil), out...)
+	reply[20] = uint8(packet.ICMP4EchoReply)
+	packet.IP4Header{IPProto: packet.ICMPv4, SrcIP: subnet4, DstIP: peer4}.Marshal(reply)
+	binary.BigEndian.PutUint16(reply[22:24], 0)
+	binary.BigEndian.PutUint16(reply[22:24], checksum(0, reply[20:]))
+
+	out, ok = tr.TranslateOut(parse(reply))
+	if !ok || out == nil {
+		t.Fatalf("TranslateOut = %v, %v; want a packet", out, ok)
+	}
+	p = parse(out)
+	if p.IPProto != packet.ICMPv6 || packet.ICMP6Type(out[40]) != packet.ICMP6EchoReply || p.SrcIP6 != via || p.DstIP6 != peer6 {
+		t.Fatalf("translated to %v", p)
+	}
+	if !checkSum(out, out[8:40], packet.ICMPv6, 40) {
+		t.Error("bad ICMPv6 checksum")
+	}
+}
+
+func TestTranslateInDrops(t *testing.T) {
+	tr := newTranslator()
+
+	// From a peer without an IPv4 address.
+	in := packet.Generate(&packet.UDP6Header{
+		IP6Header: packet.IP6Header{SrcIP: packet.IP6FromNetaddr(mustIP("fd7a:115c:a1e0::1")), DstIP: via},
+		SrcPort:   1234,
+		DstPort:   53,
+	}, nil)
+	if out, ok := tr.TranslateIn(parse(in)); !ok || out != nil {
+		t.Errorf("TranslateIn = %v, %v; want nil, true", out, ok)
+	}
+
+	// Not to a 4via6 route.
+	in = packet.Generate(&packet.UDP6Header{
+		IP6Header: packet.IP6Header{SrcIP: peer6, DstIP: packet.IP6FromNetaddr(mustIP("fd7a:115c:a1e0:b1a:0:8:a01:110"))},
+		SrcPort:   1234,
+		DstPort:   53,
+	}, nil)
+	if _, ok := tr.TranslateIn(parse(in)); ok {
+		t.Error("TranslateIn translated a packet to another site")
+	}
+}
+
+func TestTranslateSites(t *testing.T) {
+	tr := newTranslator()
+	via8 := packet.IP6FromNetaddr(mustIP("fd7a:115c:a1e0:b1a:0:8:a01:110"))
+	tr.SetRoutes([]netaddr.IPPrefix{
+		mustPrefix("fd7a:115c:a1e0:b1a:0:7:a01:100/120"),
+		mustPrefix("fd7a:115c:a1e0:b1a:0:8:a01:100/120"),
+	})
+	now := time.Unix(1000, 0)
+	tr.now = func() time.Time { return now }
+
+	// The same IPv4 flow, to site 7 and then to site 8.
+	for _, dst := range []packet.IP6{via, via8} {
+		in := packet.Generate(&packet.UDP6Header{
+			IP6Header: packet.IP6Header{SrcIP: peer6, DstIP: dst},
+			SrcPort:   1234,
+			DstPort:   53,
+		}, nil)
+		if out, ok := tr.TranslateIn(parse(in)); !ok || out == nil {
+			t.Fatalf("TranslateIn to %v = %v, %v; want a packet", dst, out, ok)
+		}
+		now = now.Add(time.Second)
+	}
+	if got := len(tr.flows); got != 2 {
+		t.Fatalf("%d flows; want 2", got)
+	}
+
+	// The reply comes from the most recently active site's address.
+	reply := packet.Generate(&packet.UDP4Header{
+		IP4Header: packet.IP4Header{SrcIP: subnet4, DstIP: peer4},
+		SrcPort:   53,
+		DstPort:   1234,
+	}, nil)
+	out, ok := tr.TranslateOut(parse(reply))
+	if !ok || out == nil {
+		t.Fatalf("TranslateOut = %v, %v; want a packet", out, ok)
+	}
+	if p := parse(out); p.SrcIP6 != via8 {
+		t.Errorf("reply from %v; want %v", p.SrcIP6, via8)
+	}
+}
+
+func TestExpireIdle(t *testing.T) {
+	tr := newTranslator()
+	now := time.Unix(1000, 0)
+	tr.now = func() time.Time { return now }
+
+	for port := uint16(1); port <= 2; port++ {
+		in := packet.Generate(&packet.UDP6Header{
+			IP6Header: packet.IP6Header{SrcIP: peer6, DstIP: via},
+			SrcPort:   port,
+			DstPort:   53,
+		}, nil)
+		tr.TranslateIn(parse(in))
+		now = now.Add(time.Minute)
+	}
+	if tr.expiry == nil {
+		t.Fatal("no expiry timer with flows")
+	}
+
+	now = now.Add(flowTimeout - 90*time.Second)
+	tr.expireIdle()
+	if got := len(tr.flows); got != 1 {
+		t.Fatalf("after one flow's idle: %d flows; want 1", got)
+	}
+	now = now.Add(time.Minute)
+	tr.expireIdle()
+	if got := len(tr.flows); got != 0 {
+		t.Fatalf("after both flows' idle: %d flows; want 0", got)
+	}
+	if tr.expiry != nil {
+		t.Error("expiry timer still set without flows")
+	}
+}
@@ -19,8 +19,10 @@ import (
 	"tailscale.com/net/interfaces"
 	"tailscale.com/tailcfg"
 	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/magicsock"
 	"tailscale.com/wgengine/router"
 	"tailscale.com/wgengine/tsdns"
+	"tailscale.com/wgengine/tstun"
 )
 
 // NewWatchdog wraps an Engine and makes sure that all methods complete
@@ -117,6 +119,35 @@ func (e *watchdogEngine) DiscoPublicKey() (k tailcfg.DiscoKey) {
 func (e *watchdogEngine) Ping(ip netaddr.IP, cb func(*ipnstate.PingResult)) {
 	e.watchdog("Ping", func() { e.wrap.Ping(ip, cb) })
 }
+func (e *watchdogEngine) PeerPath(ip netaddr.IP) (pp *ipnstate.PeerPath, err error) {
+	e.watchdog("PeerPath", func() { pp, err = e.wrap.PeerPath(ip) })
+	return pp, err
+}
+func (e *watchdogEngine) SetListenPort(port uint16) {
+	e.watchdog("SetListenPort", func() { e.wrap.SetListenPort(port) })
+}
+func (e *watchdogEngine) SetEndpointPrivacy(p magicsock.EndpointPrivacy) {
+	e.watchdog("SetEndpointPrivacy", func() { e.wrap.SetEndpointPrivacy(p) })
+}
+func (e *watchdogEngine) SetRelayOnlyPeers(ips []netaddr.IP) {
+	e.watchdog("SetRelayOnlyPeers", func() { e.wrap.SetRelayOnlyPeers(ips) })
+}
+func (e *watchdogEngine) SetImpairments(m map[netaddr.IP]tstun.Impairment) {
+	e.watchdog("SetImpairments", func() { e.wrap.SetImpairments(m) })
+}
+func (e *watchdogEngine) SetShapes(m map[netaddr.IPPrefix]tstun.Shape) {
+	e.watchdog("SetShapes", func() { e.wrap.SetShapes(m) })
+}
+func (e *watchdogEngine) SetCaptureHook(fn tstun.CaptureFunc) {
+	e.watchdog("SetCaptureHook", func() { e.wrap.SetCaptureHook(fn) })
+}
+func (e *watchdogEngine) SetConnHook(fn tstun.ConnFunc) {
+	e.watchdog("SetConnHook", func() { e.wrap.SetConnHook(fn) })
+}
+func (e *watchdogEngine) Handoff() (h *Handoff, err error) {
+	e.watchdog("Handoff", func() { h, err = e.wrap.Handoff() })
+	return h, err
+}
 func (e *watchdogEngine) Close() {
 	e.watchdog("Close", e.wrap.Close)
 }
@@ -15,8 +15,10 @@ import (
 	"tailscale.com/net/interfaces"
 	"tailscale.com/tailcfg"
 	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/magicsock"
 	"tailscale.com/wgengine/router"
 	"tailscale.com/wgengine/tsdns"
+	"tailscale.com/wgengine/tstun"
 )
 
 // ByteCount is the number of bytes that have been sent or received.
@@ -31,13 +33,21 @@ type PeerStatus struct {
 	NodeKey          tailcfg.NodeKey
 }
 
+// RouteStatus is the traffic through a subnet route this node
+// advertises, from peers (Rx) and to them (Tx).
+type RouteStatus struct {
+	Route            netaddr.IPPrefix
+	TxBytes, RxBytes ByteCount
+}
+
 // Status is the Engine status.
 //
 // TODO(bradfitz): remove this, subset of ipnstate? Need to migrate users.
 type Status struct {
 	Peers      []PeerStatus
-	LocalAddrs []string // TODO(crawshaw): []wgcfg.Endpoint?
-	DERPs      int      // number of active DERP connections
+	Routes     []RouteStatus // advertised subnet routes
+	LocalAddrs []string      // TODO(crawshaw): []wgcfg.Endpoint?
+	DERPs      int           // number of active DERP connections
 }
 
 // StatusCallback is the type of status callbacks used by
@@ -136,4 +146,49 @@ type Engine interface {
 	// Ping is a request to start a discovery ping with the peer handling
 	// the given IP and then call cb with its ping latency & method.
 	Ping(ip netaddr.IP, cb func(*ipnstate.PingResult))
+
+	// PeerPath reports the known paths to the peer handling the
+	// given IP, for diagnosing why it's not reached directly.
+	PeerPath(ip netaddr.IP) (*ipnstate.PeerPath, error)
+
+	// SetListenPort sets the UDP port to listen on for WireGuard
+	// and peer-to-peer traffic. Zero means the port the engine was
+	// created with. If the port is in use, the engine keeps its
+	// current port and retries periodically.
+	SetListenPort(port uint16)
+
+	// SetEndpointPrivacy sets which of the engine's endpoints are
+	// kept from peers, such as its private LAN addresses.
+	SetEndpointPrivacy(magicsock.EndpointPrivacy)
+
+	// SetRelayOnlyPeers sets the Tailscale IPs of the peers that
+	// are only to be reached through DERP, never over a direct
+	// path, besides those control marks RelayOnly.
+	SetRelayOnlyPeers([]netaddr.IP)
+
+	// SetImpairments sets artificial packet loss and delay for the
+	// traffic of the peers with the given Tailscale IPs, replacing
+	// any set before. It's for testing how applications cope with
+	// degraded paths.
+	SetImpairments(map[netaddr.IP]tstun.Impairment)
+
+	// SetShapes sets the rate caps on the traffic sent to the given
+	// peer IPs or subnets, replacing any set before.
+	SetShapes(map[netaddr.IPPrefix]tstun.Shape)
+
+	// SetCaptureHook sets the function called with the decrypted
+	// packets passing through the engine's TUN device, before and
+	// after the packet filter. A nil func stops capturing.
+	SetCaptureHook(tstun.CaptureFunc)
+
+	// SetConnHook sets the function called with each new inbound
+	// connection that the packet filter accepts. A nil func stops
+	// the calls.
+	SetConnHook(tstun.ConnFunc)
+
+	// Handoff returns the engine's TUN device, UDP sockets and
+	// packet filter flows, for a new tailscaled to carry on with
+	// in an in-place upgrade; see NewHandoffEngine. It's only
+	// supported by the userspace engine on Linux.
+	Handoff() (*Handoff, error)
 }